@@ -32,6 +32,9 @@ var (
 		templates  string
 
 		resourceLockNamespace string
+		metricsBindAddress    string
+
+		renderedConfigSizeLimit int
 	}
 )
 
@@ -39,6 +42,8 @@ func init() {
 	rootCmd.AddCommand(startCmd)
 	startCmd.PersistentFlags().StringVar(&startOpts.kubeconfig, "kubeconfig", "", "Kubeconfig file to access a remote cluster (testing only)")
 	startCmd.PersistentFlags().StringVar(&startOpts.resourceLockNamespace, "resourcelock-namespace", metav1.NamespaceSystem, "Path to the template files used for creating MachineConfig objects")
+	startCmd.PersistentFlags().StringVar(&startOpts.metricsBindAddress, "metrics-bind-address", controllercommon.DefaultMetricsBindAddress, "address to serve metrics on; empty to disable")
+	startCmd.PersistentFlags().IntVar(&startOpts.renderedConfigSizeLimit, "rendered-config-size-limit", render.DefaultRenderedConfigSizeLimit, "size limit of the rendered MachineConfigs in bytes, their large files are compressed to fit; 0 to disable")
 }
 
 func runStartCmd(cmd *cobra.Command, args []string) {
@@ -64,6 +69,10 @@ func runStartCmd(cmd *cobra.Command, args []string) {
 
 		close(ctrlctx.InformersStarted)
 
+		if startOpts.metricsBindAddress != "" {
+			go controllercommon.StartMetricsListener(startOpts.metricsBindAddress, ctrlctx.Stop)
+		}
+
 		for _, c := range controllers {
 			go c.Run(2, ctrlctx.Stop)
 		}
@@ -126,12 +135,15 @@ func createControllers(ctx *controllercommon.ControllerContext) []controllercomm
 			ctx.InformerFactory.Machineconfiguration().V1().MachineConfigPools(),
 			ctx.InformerFactory.Machineconfiguration().V1().MachineConfigs(),
 			ctx.InformerFactory.Machineconfiguration().V1().ControllerConfigs(),
+			ctx.KubeInformerFactory.Core().V1().Nodes(),
 			ctx.ClientBuilder.KubeClientOrDie("render-controller"),
 			ctx.ClientBuilder.MachineConfigClientOrDie("render-controller"),
+			startOpts.renderedConfigSizeLimit,
 		),
 		// The node controller consumes data written by the above
 		node.New(
 			ctx.InformerFactory.Machineconfiguration().V1().MachineConfigPools(),
+			ctx.InformerFactory.Machineconfiguration().V1().MachineConfigs(),
 			ctx.KubeInformerFactory.Core().V1().Nodes(),
 			ctx.ClientBuilder.KubeClientOrDie("node-update-controller"),
 			ctx.ClientBuilder.MachineConfigClientOrDie("node-update-controller"),
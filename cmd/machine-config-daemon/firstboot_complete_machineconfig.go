@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/openshift/machine-config-operator/pkg/daemon"
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/openshift/machine-config-operator/pkg/version"
+	"github.com/spf13/cobra"
+)
+
+var (
+	firstbootCompleteMachineconfigCmd = &cobra.Command{
+		Use:   "firstboot-complete-machineconfig",
+		Short: "Complete the first config of a newly provisioned node",
+		Long: `Applies the parts of the first config of the node which Ignition can't,
+as embedded by the Machine Config Server, then reboots into them if needed.
+Run by the machine-config-daemon-firstboot service.`,
+		Run: runFirstbootCompleteMachineconfigCmd,
+	}
+
+	firstbootCompleteMachineconfigOpts struct {
+		rootMount  string
+		skipReboot bool
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(firstbootCompleteMachineconfigCmd)
+	firstbootCompleteMachineconfigCmd.PersistentFlags().StringVar(&firstbootCompleteMachineconfigOpts.rootMount, "root-mount", "/rootfs", "where the nodes root filesystem is mounted for chroot and file manipulation.")
+	firstbootCompleteMachineconfigCmd.PersistentFlags().BoolVar(&firstbootCompleteMachineconfigOpts.skipReboot, "skip-reboot", false, "Skips the reboot after applying the config")
+}
+
+func runFirstbootCompleteMachineconfigCmd(cmd *cobra.Command, args []string) {
+	flag.Set("logtostderr", "true")
+	flag.Parse()
+
+	glog.Infof("Version: %+v", version.Version)
+
+	rootMount := firstbootCompleteMachineconfigOpts.rootMount
+	operatingSystem, err := daemon.GetHostRunningOS(rootMount)
+	if err != nil {
+		glog.Fatalf("Error found when checking operating system: %s", err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	exitCh := make(chan error)
+	defer close(exitCh)
+
+	// There is no cluster to talk to yet: this is a once-from daemon for the
+	// embedded config, without kube clients or node writer.
+	dn, err := daemon.New(
+		rootMount,
+		"",
+		operatingSystem,
+		daemon.NewNodeUpdaterClient(),
+		constants.MachineConfigEncapsulatedPath,
+		"",
+		firstbootCompleteMachineconfigOpts.skipReboot,
+		false,
+		nil,
+		nil,
+		false,
+		"",
+		nil,
+		exitCh,
+		stopCh,
+	)
+	if err != nil {
+		glog.Fatalf("Failed to initialize firstboot daemon: %v", err)
+	}
+
+	glog.Infof(`Calling chroot("%s")`, rootMount)
+	if err := syscall.Chroot(rootMount); err != nil {
+		glog.Fatalf("Unable to chroot to %s: %s", rootMount, err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		glog.Fatalf("Unable to change directory to /: %s", err)
+	}
+
+	err = dn.RunFirstbootCompleteMachineConfig()
+	status := daemon.OnceFromExitStatus(err)
+	if err != nil {
+		glog.Errorf("Failed to complete %s: %v", constants.MachineConfigEncapsulatedPath, err)
+	}
+	glog.Flush()
+	os.Exit(status)
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"os"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/openshift/machine-config-operator/internal/clients"
@@ -12,7 +13,13 @@ import (
 	mcfgclientset "github.com/openshift/machine-config-operator/pkg/generated/clientset/versioned"
 	"github.com/openshift/machine-config-operator/pkg/version"
 	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	clientsetcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 var (
@@ -28,22 +35,58 @@ var (
 		nodeName               string
 		rootMount              string
 		onceFrom               string
+		onceFromCAFile         string
 		skipReboot             bool
+		dryRun                 bool
+		drainTimeout           time.Duration
+		drainForceAfter        time.Duration
+		forceValidationRepair  bool
+		skipUnitValidation     bool
+		sshLoginAllowlist      []string
+		healthChecks           []string
+		healthGateTimeout      time.Duration
 		fromIgnition           bool
 		kubeletHealthzEnabled  bool
 		kubeletHealthzEndpoint string
+		metricsBindAddress     string
+		statusBindAddress      string
+		healthzBindAddress     string
+		enablePprof            bool
 	}
 )
 
+const masterNodeRoleLabel = "node-role.kubernetes.io/master"
+
+// masterNodeWriterBackoff retries conflicting node writes for 30 to 45 seconds
+var masterNodeWriterBackoff = wait.Backoff{
+	Steps:    7,
+	Duration: 500 * time.Millisecond,
+	Factor:   2.0,
+	Jitter:   0.5,
+}
+
 func init() {
 	rootCmd.AddCommand(startCmd)
 	startCmd.PersistentFlags().StringVar(&startOpts.kubeconfig, "kubeconfig", "", "Kubeconfig file to access a remote cluster (testing only)")
 	startCmd.PersistentFlags().StringVar(&startOpts.nodeName, "node-name", "", "kubernetes node name daemon is managing.")
 	startCmd.PersistentFlags().StringVar(&startOpts.rootMount, "root-mount", "/rootfs", "where the nodes root filesystem is mounted for chroot and file manipulation.")
 	startCmd.PersistentFlags().StringVar(&startOpts.onceFrom, "once-from", "", "Runs the daemon once using a provided file path or URL endpoint as its machine config or ignition (.ign) file source")
+	startCmd.PersistentFlags().StringVar(&startOpts.onceFromCAFile, "once-from-ca-file", "", "PEM bundle of extra CAs to trust fetching the once-from config from an https URL")
 	startCmd.PersistentFlags().BoolVar(&startOpts.skipReboot, "skip-reboot", false, "Skips reboot after a sync, applies only in once-from")
+	startCmd.PersistentFlags().BoolVar(&startOpts.dryRun, "dry-run", false, "Only report what updates would change on disk, without applying them")
 	startCmd.PersistentFlags().BoolVar(&startOpts.kubeletHealthzEnabled, "kubelet-healthz-enabled", true, "kubelet healthz endpoint monitoring")
 	startCmd.PersistentFlags().StringVar(&startOpts.kubeletHealthzEndpoint, "kubelet-healthz-endpoint", "http://localhost:10248/healthz", "healthz endpoint to check health")
+	startCmd.PersistentFlags().DurationVar(&startOpts.drainTimeout, "drain-timeout", daemon.DefaultDrainTimeout, "how long to retry draining the node before marking it degraded")
+	startCmd.PersistentFlags().DurationVar(&startOpts.drainForceAfter, "drain-force-after", 0, "how long into a drain to delete the pods still not evicted, bypassing their PDBs; 0 to never delete them")
+	startCmd.PersistentFlags().BoolVar(&startOpts.forceValidationRepair, "force-validation-repair", false, "rewrite files and units found drifted from the current config on startup, instead of marking the node degraded")
+	startCmd.PersistentFlags().BoolVar(&startOpts.skipUnitValidation, "skip-unit-validation", false, "write the systemd units and dropins of updates without checking their syntax first, for emergencies")
+	startCmd.PersistentFlags().StringSliceVar(&startOpts.sshLoginAllowlist, "ssh-login-allowlist", nil, "users whose SSH logins don't mark the node as accessed, e.g. cluster automation accounts")
+	startCmd.PersistentFlags().StringSliceVar(&startOpts.healthChecks, "health-checks", daemon.DefaultHealthChecks, "checks which must pass after rebooting into a new config before the node is marked done; empty to disable")
+	startCmd.PersistentFlags().DurationVar(&startOpts.healthGateTimeout, "health-gate-timeout", daemon.DefaultHealthGateTimeout, "how long to wait for the health checks before marking the node degraded")
+	startCmd.PersistentFlags().StringVar(&startOpts.metricsBindAddress, "metrics-bind-address", daemon.DefaultMetricsBindAddress, "address to serve metrics on; empty to disable")
+	startCmd.PersistentFlags().StringVar(&startOpts.statusBindAddress, "status-bind-address", daemon.DefaultStatusBindAddress, "address to serve /healthz and /debug/status on; empty to disable")
+	startCmd.PersistentFlags().StringVar(&startOpts.healthzBindAddress, "healthz-bind-address", daemon.DefaultHealthzBindAddress, "address to serve /healthz alone on, for probes; empty to disable")
+	startCmd.PersistentFlags().BoolVar(&startOpts.enablePprof, "enable-pprof", false, "serve pprof profiles on /debug/pprof/ of the status address")
 }
 
 func runStartCmd(cmd *cobra.Command, args []string) {
@@ -62,7 +105,7 @@ func runStartCmd(cmd *cobra.Command, args []string) {
 
 	if startOpts.nodeName == "" {
 		name, ok := os.LookupEnv("NODE_NAME")
-		if !ok || name == "" {
+		if (!ok || name == "") && startOpts.onceFrom == "" {
 			glog.Fatalf("node-name is required")
 		}
 		startOpts.nodeName = name
@@ -86,10 +129,6 @@ func runStartCmd(cmd *cobra.Command, args []string) {
 	exitCh := make(chan error)
 	defer close(exitCh)
 
-	glog.Info("Starting node writer")
-	nodeWriter := daemon.NewNodeWriter()
-	go nodeWriter.Run(stopCh)
-
 	cb, err := clients.NewBuilder(startOpts.kubeconfig)
 	if err != nil {
 		if startOpts.onceFrom != "" {
@@ -107,10 +146,24 @@ func runStartCmd(cmd *cobra.Command, args []string) {
 		}
 	}
 
+	var recorder record.EventRecorder
+	if kubeClient != nil {
+		eventBroadcaster := record.NewBroadcaster()
+		eventBroadcaster.StartLogging(glog.V(2).Infof)
+		eventBroadcaster.StartRecordingToSink(&clientsetcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+		recorder = eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "machineconfigdaemon", Host: startOpts.nodeName})
+	}
+
+	if startOpts.metricsBindAddress != "" {
+		go daemon.StartMetricsListener(startOpts.metricsBindAddress, stopCh)
+	}
+
 	var dn *daemon.Daemon
+	var nodeWriter *daemon.NodeWriter
 
 	// If we are asked to run once and it's a valid file system path use
-	// the bare Daemon
+	// the bare Daemon. It doesn't write node annotations, so there is no
+	// node writer.
 	if startOpts.onceFrom != "" {
 		var mcClient mcfgclientset.Interface
 		if cb != nil {
@@ -125,12 +178,14 @@ func runStartCmd(cmd *cobra.Command, args []string) {
 			operatingSystem,
 			daemon.NewNodeUpdaterClient(),
 			startOpts.onceFrom,
+			startOpts.onceFromCAFile,
 			startOpts.skipReboot,
+			startOpts.dryRun,
 			mcClient,
 			kubeClient,
 			startOpts.kubeletHealthzEnabled,
 			startOpts.kubeletHealthzEndpoint,
-			nodeWriter,
+			nil,
 			exitCh,
 			stopCh,
 		)
@@ -142,7 +197,24 @@ func runStartCmd(cmd *cobra.Command, args []string) {
 		if kubeClient == nil {
 			panic("Running in cluster mode without a kubeClient")
 		}
+
+		writerOpts := []daemon.Option{daemon.WithRecorder(recorder)}
+		if isMasterNode(kubeClient, startOpts.nodeName) {
+			// the API server is likely to be rolling out while masters update,
+			// don't give up on writes as quickly
+			glog.Info("Running on a master, using a longer node writer backoff")
+			writerOpts = append(writerOpts, daemon.WithBackoff(masterNodeWriterBackoff))
+		}
+
+		glog.Info("Starting node writer")
+		nodeWriter = daemon.NewNodeWriterWithOptions(writerOpts...)
+		go nodeWriter.Run(stopCh)
+
 		ctx := controllercommon.CreateControllerContext(cb, stopCh, componentName)
+		mcClient, err := cb.MachineConfigClient(componentName)
+		if err != nil {
+			glog.Fatalf("Failed to initialize MC client: %v", err)
+		}
 		// create the daemon instance. this also initializes kube client items
 		// which need to come from the container and not the chroot.
 		dn, err = daemon.NewClusterDrivenDaemon(
@@ -151,9 +223,18 @@ func runStartCmd(cmd *cobra.Command, args []string) {
 			operatingSystem,
 			daemon.NewNodeUpdaterClient(),
 			ctx.InformerFactory.Machineconfiguration().V1().MachineConfigs(),
+			mcClient,
 			kubeClient,
 			startOpts.onceFrom,
 			startOpts.skipReboot,
+			startOpts.dryRun,
+			startOpts.drainTimeout,
+			startOpts.drainForceAfter,
+			startOpts.forceValidationRepair,
+			startOpts.skipUnitValidation,
+			startOpts.sshLoginAllowlist,
+			startOpts.healthChecks,
+			startOpts.healthGateTimeout,
 			ctx.KubeInformerFactory.Core().V1().Nodes(),
 			startOpts.kubeletHealthzEnabled,
 			startOpts.kubeletHealthzEndpoint,
@@ -175,6 +256,13 @@ func runStartCmd(cmd *cobra.Command, args []string) {
 		close(ctx.InformersStarted)
 	}
 
+	if startOpts.statusBindAddress != "" {
+		go dn.StartStatusListener(startOpts.statusBindAddress, startOpts.enablePprof, stopCh)
+	}
+	if startOpts.healthzBindAddress != "" {
+		go daemon.StartHealthzListener(startOpts.healthzBindAddress, stopCh)
+	}
+
 	glog.Infof(`Calling chroot("%s")`, startOpts.rootMount)
 	if err := syscall.Chroot(startOpts.rootMount); err != nil {
 		glog.Fatalf("Unable to chroot to %s: %s", startOpts.rootMount, err)
@@ -188,7 +276,32 @@ func runStartCmd(cmd *cobra.Command, args []string) {
 	glog.Info("Starting MachineConfigDaemon")
 	defer glog.Info("Shutting down MachineConfigDaemon")
 
+	if startOpts.onceFrom != "" {
+		err := dn.Run(stopCh, exitCh)
+		status := daemon.OnceFromExitStatus(err)
+		if err != nil {
+			glog.Errorf("Failed to run once from %s: %v", startOpts.onceFrom, err)
+		}
+		glog.Flush()
+		os.Exit(status)
+	}
+
 	if err := dn.Run(stopCh, exitCh); err != nil {
 		glog.Fatalf("Failed to run: %v", err)
 	}
+
+	// flush any annotation writes still queued before we exit
+	nodeWriter.Close()
+}
+
+// isMasterNode returns whether the node has the master role. Errors are
+// logged and treated as not a master.
+func isMasterNode(kubeClient kubernetes.Interface, nodeName string) bool {
+	node, err := kubeClient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
+	if err != nil {
+		glog.Warningf("Unable to get node %s to check its role: %v", nodeName, err)
+		return false
+	}
+	_, ok := node.Labels[masterNodeRoleLabel]
+	return ok
 }
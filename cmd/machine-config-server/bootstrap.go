@@ -20,6 +20,7 @@ var (
 	bootstrapOpts struct {
 		serverBaseDir    string
 		serverKubeConfig string
+		manifestsDir     string
 	}
 )
 
@@ -27,6 +28,7 @@ func init() {
 	rootCmd.AddCommand(bootstrapCmd)
 	bootstrapCmd.PersistentFlags().StringVar(&bootstrapOpts.serverBaseDir, "server-basedir", "/etc/mcs/bootstrap", "base directory on the host, relative to which machine-configs and pools can be found.")
 	bootstrapCmd.PersistentFlags().StringVar(&bootstrapOpts.serverKubeConfig, "bootstrap-kubeconfig", "/etc/kubernetes/kubeconfig", "path to bootstrap kubeconfig served by the bootstrap server.")
+	bootstrapCmd.PersistentFlags().StringVar(&bootstrapOpts.manifestsDir, "bootstrap-manifests-dir", "", "directory of machineconfigpool and machineconfig manifests to render and serve the configs of, rendered again as they change; takes the place of --server-basedir.")
 }
 
 func runBootstrapCmd(cmd *cobra.Command, args []string) {
@@ -36,19 +38,22 @@ func runBootstrapCmd(cmd *cobra.Command, args []string) {
 	// To help debugging, immediately log version
 	glog.Infof("Version: %+v", version.Version)
 
-	bs, err := server.NewBootstrapServer(bootstrapOpts.serverBaseDir, bootstrapOpts.serverKubeConfig)
-
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	var (
+		bs  server.Server
+		err error
+	)
+	if bootstrapOpts.manifestsDir != "" {
+		bs, err = server.NewManifestsServer(bootstrapOpts.manifestsDir, bootstrapOpts.serverKubeConfig, stopCh)
+	} else {
+		bs, err = server.NewBootstrapServer(bootstrapOpts.serverBaseDir, bootstrapOpts.serverKubeConfig)
+	}
 	if err != nil {
 		glog.Exitf("Machine Config Server exited with error: %v", err)
 	}
 
-	apiHandler := server.NewServerAPIHandler(bs)
-	secureServer := server.NewAPIServer(apiHandler, rootOpts.sport, false, rootOpts.cert, rootOpts.key)
-	insecureServer := server.NewAPIServer(apiHandler, rootOpts.isport, true, "", "")
-
-	stopCh := make(chan struct{})
-	go secureServer.Serve()
-	go insecureServer.Serve()
-	<-stopCh
-	panic("not possible")
+	apiHandler := server.NewServerAPIHandlerWithOptions(bs, apiHandlerOptions(stopCh)...)
+	runServers(apiHandler)
 }
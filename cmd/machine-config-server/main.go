@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/openshift/machine-config-operator/pkg/server"
 	"github.com/spf13/cobra"
 )
 
@@ -23,15 +30,92 @@ var (
 		isport int
 		cert   string
 		key    string
+
+		metricsBindAddress string
+		rateLimitQPS       float32
+		rateLimitBurst     int
+
+		authTokensDir        string
+		authTokenGracePeriod time.Duration
+
+		shutdownGracePeriod time.Duration
 	}
 )
 
 func init() {
 	rootCmd.PersistentFlags().AddGoFlagSet(flag.CommandLine)
-	rootCmd.PersistentFlags().IntVar(&rootOpts.sport, "secure-port", 22623, "secure port to serve ignition configs")
-	rootCmd.PersistentFlags().StringVar(&rootOpts.cert, "cert", "/etc/ssl/mcs/tls.crt", "cert file for TLS")
-	rootCmd.PersistentFlags().StringVar(&rootOpts.key, "key", "/etc/ssl/mcs/tls.key", "key file for TLS")
-	rootCmd.PersistentFlags().IntVar(&rootOpts.isport, "insecure-port", 22624, "insecure port to serve ignition configs")
+	rootCmd.PersistentFlags().IntVar(&rootOpts.sport, "secure-port", 22623, "secure port to serve ignition configs; 0 to disable")
+	rootCmd.PersistentFlags().StringVar(&rootOpts.cert, "cert", "/etc/ssl/mcs/tls.crt", "cert file for TLS, reloaded when it changes")
+	rootCmd.PersistentFlags().StringVar(&rootOpts.key, "key", "/etc/ssl/mcs/tls.key", "key file for TLS, reloaded when it changes")
+	rootCmd.PersistentFlags().IntVar(&rootOpts.isport, "insecure-port", 22624, "insecure port to serve ignition configs, for the bootimages which can't fetch them over TLS; 0 to disable")
+	rootCmd.PersistentFlags().StringVar(&rootOpts.metricsBindAddress, "metrics-bind-address", server.DefaultMetricsBindAddress, "address to serve metrics on, apart from the ignition ports; empty to disable")
+	rootCmd.PersistentFlags().Float32Var(&rootOpts.rateLimitQPS, "rate-limit-qps", server.DefaultRateLimitQPS, "config requests per second allowed to each client IP; 0 to disable the limit")
+	rootCmd.PersistentFlags().IntVar(&rootOpts.rateLimitBurst, "rate-limit-burst", server.DefaultRateLimitBurst, "config requests each client IP can make at once")
+	rootCmd.PersistentFlags().StringVar(&rootOpts.authTokensDir, "auth-tokens-dir", "", "directory of the bearer tokens the config requests of each pool must have, in a file named after the pool; empty to serve configs anonymously")
+	rootCmd.PersistentFlags().DurationVar(&rootOpts.authTokenGracePeriod, "auth-token-grace-period", server.DefaultAuthTokenGracePeriod, "time the tokens removed from --auth-tokens-dir are still accepted, for rotating them")
+	rootCmd.PersistentFlags().DurationVar(&rootOpts.shutdownGracePeriod, "shutdown-grace-period", 25*time.Second, "time given to the responses in flight on SIGTERM; below the terminationGracePeriodSeconds of the pod")
+}
+
+// apiHandlerOptions returns the options of the API handler set by the flags.
+// The tokens of --auth-tokens-dir are reloaded until stopCh is closed.
+func apiHandlerOptions(stopCh <-chan struct{}) []server.APIHandlerOption {
+	opts := []server.APIHandlerOption{
+		server.WithClientRateLimit(rootOpts.rateLimitQPS, rootOpts.rateLimitBurst),
+	}
+	if rootOpts.authTokensDir != "" {
+		authorizer, err := server.NewTokenAuthorizer(rootOpts.authTokensDir, rootOpts.authTokenGracePeriod, stopCh)
+		if err != nil {
+			glog.Exitf("Machine Config Server could not read the auth tokens: %v", err)
+		}
+		opts = append(opts, server.WithTokenAuth(authorizer))
+	}
+	return opts
+}
+
+// runServers serves apiHandler on the secure and insecure ports enabled, and
+// the metrics, until SIGTERM or SIGINT. The servers then stop accepting
+// connections and finish the responses in flight, within
+// --shutdown-grace-period, so that no machine gets a truncated config.
+func runServers(apiHandler *server.APIHandler) {
+	var servers []*server.APIServer
+	if rootOpts.sport != 0 {
+		servers = append(servers, server.NewAPIServer(apiHandler, rootOpts.sport, false, rootOpts.cert, rootOpts.key))
+	}
+	if rootOpts.isport != 0 {
+		servers = append(servers, server.NewAPIServer(apiHandler, rootOpts.isport, true, "", ""))
+	}
+	if len(servers) == 0 {
+		glog.Exitf("Both --secure-port and --insecure-port are disabled, no config would be served")
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if rootOpts.metricsBindAddress != "" {
+		go server.StartMetricsListener(rootOpts.metricsBindAddress, stopCh)
+	}
+	for _, s := range servers {
+		go s.Serve()
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigCh
+	glog.Infof("Got %s, shutting down within %s", sig, rootOpts.shutdownGracePeriod)
+
+	ctx, cancel := context.WithTimeout(context.Background(), rootOpts.shutdownGracePeriod)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *server.APIServer) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				glog.Warningf("Responses still in flight at the end of the grace period: %v", err)
+			}
+		}(s)
+	}
+	wg.Wait()
+	glog.Info("Shut down")
 }
 
 func main() {
@@ -45,13 +45,8 @@ func runStartCmd(cmd *cobra.Command, args []string) {
 		glog.Exitf("Machine Config Server exited with error: %v", err)
 	}
 
-	apiHandler := server.NewServerAPIHandler(cs)
-	secureServer := server.NewAPIServer(apiHandler, rootOpts.sport, false, rootOpts.cert, rootOpts.key)
-	insecureServer := server.NewAPIServer(apiHandler, rootOpts.isport, true, "", "")
-
 	stopCh := make(chan struct{})
-	go secureServer.Serve()
-	go insecureServer.Serve()
-	<-stopCh
-	panic("not possible")
+	defer close(stopCh)
+	apiHandler := server.NewServerAPIHandlerWithOptions(cs, apiHandlerOptions(stopCh)...)
+	runServers(apiHandler)
 }
@@ -1,6 +1,8 @@
 package resourcemerge
 
 import (
+	"bytes"
+
 	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 )
@@ -67,5 +69,16 @@ func ensureControllerConfigSpec(modified *bool, existing *mcfgv1.ControllerConfi
 		*modified = true
 	}
 
+	// unlike the CAs above, the trust bundle and the proxy are optional:
+	// removing them from the cluster removes them from the spec
+	if !bytes.Equal(existing.AdditionalTrustBundle, required.AdditionalTrustBundle) {
+		existing.AdditionalTrustBundle = required.AdditionalTrustBundle
+		*modified = true
+	}
+	if !equality.Semantic.DeepEqual(existing.Proxy, required.Proxy) {
+		existing.Proxy = required.Proxy
+		*modified = true
+	}
+
 	mergeMap(modified, &existing.Images, required.Images)
 }
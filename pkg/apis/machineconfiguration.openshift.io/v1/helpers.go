@@ -5,6 +5,7 @@ import (
 	"sort"
 
 	ignv2_2 "github.com/coreos/ignition/config/v2_2"
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -12,6 +13,8 @@ import (
 // MergeMachineConfigs combines multiple machineconfig objects into one object.
 // It sorts all the configs in increasing order of their name.
 // It uses the Ign config from first object as base and appends all the rest.
+// A unit masked in some configs and not in others takes the masking of the
+// last config that sets it.
 // It uses only the OSImageURL provided by the CVO and ignores any MC provided OSImageURL.
 func MergeMachineConfigs(configs []*MachineConfig, osImageURL string) *MachineConfig {
 	if len(configs) == 0 {
@@ -23,15 +26,106 @@ func MergeMachineConfigs(configs []*MachineConfig, osImageURL string) *MachineCo
 	for idx := 1; idx < len(configs); idx++ {
 		outIgn = ignv2_2.Append(outIgn, configs[idx].Spec.Config)
 	}
+	outIgn.Systemd.Units = resolveUnitMasks(outIgn.Systemd.Units)
 
 	return &MachineConfig{
 		Spec: MachineConfigSpec{
-			OSImageURL: osImageURL,
-			Config:     outIgn,
+			OSImageURL:      osImageURL,
+			Config:          outIgn,
+			KernelArguments: mergeKernelArguments(configs),
+			KernelType:      mergeKernelType(configs),
+			Extensions:      mergeExtensions(configs),
+			FIPS:            mergeFIPS(configs),
 		},
 	}
 }
 
+// mergeKernelArguments returns the kernel arguments of configs in order, each
+// argument only once at its first occurrence.
+func mergeKernelArguments(configs []*MachineConfig) []string {
+	lists := make([][]string, 0, len(configs))
+	for _, config := range configs {
+		lists = append(lists, config.Spec.KernelArguments)
+	}
+	return mergeUnique(lists)
+}
+
+// mergeExtensions returns the extensions of configs in order, each only once.
+func mergeExtensions(configs []*MachineConfig) []string {
+	lists := make([][]string, 0, len(configs))
+	for _, config := range configs {
+		lists = append(lists, config.Spec.Extensions)
+	}
+	return mergeUnique(lists)
+}
+
+// mergeUnique concatenates lists, keeping each string only at its first
+// occurrence.
+func mergeUnique(lists [][]string) []string {
+	var merged []string
+	seen := make(map[string]struct{})
+	for _, list := range lists {
+		for _, s := range list {
+			if _, ok := seen[s]; ok {
+				continue
+			}
+			seen[s] = struct{}{}
+			merged = append(merged, s)
+		}
+	}
+	return merged
+}
+
+// mergeKernelType returns the kernel type of the last of configs which sets
+// one.
+func mergeKernelType(configs []*MachineConfig) string {
+	kernelType := ""
+	for _, config := range configs {
+		if config.Spec.KernelType != "" {
+			kernelType = config.Spec.KernelType
+		}
+	}
+	return kernelType
+}
+
+// mergeFIPS returns whether any of configs enables FIPS mode.
+func mergeFIPS(configs []*MachineConfig) bool {
+	for _, config := range configs {
+		if config.Spec.FIPS {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveUnitMasks makes all the entries of a unit agree on its masking: the
+// last entry that masks it, enables it or disables it wins. A masked unit
+// can't be enabled, so its entries stop enabling it.
+func resolveUnitMasks(units []ignv2_2types.Unit) []ignv2_2types.Unit {
+	if len(units) == 0 {
+		return units
+	}
+	masked := make(map[string]bool)
+	for _, u := range units {
+		if u.Mask || u.Enable || u.Enabled != nil {
+			masked[u.Name] = u.Mask
+		}
+	}
+	// the units may still be shared with the merged configs
+	resolved := make([]ignv2_2types.Unit, len(units))
+	copy(resolved, units)
+	for i := range resolved {
+		if masked[resolved[i].Name] {
+			resolved[i].Mask = true
+			resolved[i].Enable = false
+			resolved[i].Enabled = nil
+		} else {
+			resolved[i].Mask = false
+		}
+	}
+	return resolved
+}
+
 // NewMachineConfigPoolCondition creates a new MachineConfigPool condition.
 func NewMachineConfigPoolCondition(condType MachineConfigPoolConditionType, status corev1.ConditionStatus, reason, message string) *MachineConfigPoolCondition {
 	return &MachineConfigPoolCondition{
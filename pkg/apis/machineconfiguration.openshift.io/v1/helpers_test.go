@@ -1,11 +1,14 @@
 package v1
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -179,3 +182,172 @@ func TestIsControllerConfigCompleted(t *testing.T) {
 		})
 	}
 }
+
+func TestMergeMachineConfigsUnitMasks(t *testing.T) {
+	enabled := true
+	newConfig := func(name string, units ...ignv2_2types.Unit) *MachineConfig {
+		return &MachineConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: MachineConfigSpec{
+				Config: ignv2_2types.Config{
+					Systemd: ignv2_2types.Systemd{Units: units},
+				},
+			},
+		}
+	}
+	masked := ignv2_2types.Unit{Name: "docker.service", Mask: true}
+	enabledUnit := ignv2_2types.Unit{Name: "docker.service", Enabled: &enabled, Contents: "[Unit]"}
+	dropin := ignv2_2types.Unit{Name: "docker.service", Dropins: []ignv2_2types.SystemdDropin{{Name: "10-foo.conf", Contents: "foo"}}}
+
+	tests := []struct {
+		name    string
+		configs []*MachineConfig
+		masked  bool
+	}{{
+		name:    "masked last",
+		configs: []*MachineConfig{newConfig("50-enable", enabledUnit), newConfig("60-mask", masked)},
+		masked:  true,
+	}, {
+		name:    "enabled last",
+		configs: []*MachineConfig{newConfig("60-enable", enabledUnit), newConfig("50-mask", masked)},
+		masked:  false,
+	}, {
+		name:    "masked, then a dropin",
+		configs: []*MachineConfig{newConfig("50-mask", masked), newConfig("60-dropin", dropin)},
+		masked:  true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged := MergeMachineConfigs(test.configs, "")
+			for _, u := range merged.Spec.Config.Systemd.Units {
+				if u.Mask != test.masked {
+					t.Errorf("Expected %s entry masked %v, got %v", u.Name, test.masked, u.Mask)
+				}
+				if u.Mask && (u.Enable || u.Enabled != nil) {
+					t.Errorf("Expected masked %s entry to not be enabled", u.Name)
+				}
+			}
+		})
+	}
+
+	// the merged configs are left alone
+	enableConfig := newConfig("50-enable", enabledUnit)
+	MergeMachineConfigs([]*MachineConfig{enableConfig, newConfig("60-mask", masked)}, "")
+	if u := enableConfig.Spec.Config.Systemd.Units[0]; u.Mask || u.Enabled == nil {
+		t.Errorf("Expected merged configs to be unchanged")
+	}
+}
+
+func TestMergeMachineConfigsKernelArguments(t *testing.T) {
+	newConfig := func(name string, kargs ...string) *MachineConfig {
+		return &MachineConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       MachineConfigSpec{KernelArguments: kargs},
+		}
+	}
+
+	merged := MergeMachineConfigs([]*MachineConfig{
+		newConfig("60-hugepages", "hugepages=16", "nosmt"),
+		newConfig("50-nosmt", "nosmt", "console=ttyS0"),
+		newConfig("70-none"),
+	}, "")
+	expected := []string{"nosmt", "console=ttyS0", "hugepages=16"}
+	if !reflect.DeepEqual(merged.Spec.KernelArguments, expected) {
+		t.Errorf("Expected kernel arguments %v, got %v", expected, merged.Spec.KernelArguments)
+	}
+
+	if merged := MergeMachineConfigs([]*MachineConfig{newConfig("50-none")}, ""); merged.Spec.KernelArguments != nil {
+		t.Errorf("Expected no kernel arguments, got %v", merged.Spec.KernelArguments)
+	}
+
+	// the specs without kernel arguments serialize as before, so the names
+	// hashed from them don't change
+	data, err := json.Marshal(newConfig("50-none").Spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "kernelArguments") {
+		t.Errorf("Expected no kernelArguments in %s", data)
+	}
+}
+
+func TestMergeMachineConfigsExtensions(t *testing.T) {
+	newConfig := func(name string, extensions ...string) *MachineConfig {
+		return &MachineConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       MachineConfigSpec{Extensions: extensions},
+		}
+	}
+
+	merged := MergeMachineConfigs([]*MachineConfig{
+		newConfig("60-devel", "kernel-devel", "usbguard"),
+		newConfig("50-usbguard", "usbguard"),
+	}, "")
+	expected := []string{"usbguard", "kernel-devel"}
+	if !reflect.DeepEqual(merged.Spec.Extensions, expected) {
+		t.Errorf("Expected extensions %v, got %v", expected, merged.Spec.Extensions)
+	}
+}
+
+func TestMergeMachineConfigsFIPS(t *testing.T) {
+	newConfig := func(name string, fips bool) *MachineConfig {
+		return &MachineConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       MachineConfigSpec{FIPS: fips},
+		}
+	}
+
+	if merged := MergeMachineConfigs([]*MachineConfig{newConfig("50-none", false)}, ""); merged.Spec.FIPS {
+		t.Errorf("Expected FIPS mode disabled")
+	}
+	if merged := MergeMachineConfigs([]*MachineConfig{newConfig("99-fips", true), newConfig("50-none", false)}, ""); !merged.Spec.FIPS {
+		t.Errorf("Expected FIPS mode enabled by 99-fips")
+	}
+}
+
+func TestMachineConfigSpecUnmarshalV3(t *testing.T) {
+	var spec MachineConfigSpec
+	err := json.Unmarshal([]byte(`{"osImageURL": "example.com/os@sha256:0123", "kernelArguments": ["nosmt"], "config": {
+		"ignition": {"version": "3.0.0"},
+		"storage": {"files": [{"path": "/etc/motd", "contents": {"source": "data:,hello"}}]},
+		"systemd": {"units": [{"name": "foo.service", "dropins": [{"name": "10-foo.conf", "contents": "[Service]"}]}]}
+	}}`), &spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := MachineConfigSpec{
+		OSImageURL:      "example.com/os@sha256:0123",
+		KernelArguments: []string{"nosmt"},
+		Config: ignv2_2types.Config{
+			Ignition: ignv2_2types.Ignition{Version: "2.2.0"},
+			Storage: ignv2_2types.Storage{Files: []ignv2_2types.File{{
+				Node:          ignv2_2types.Node{Filesystem: "root", Path: "/etc/motd"},
+				FileEmbedded1: ignv2_2types.FileEmbedded1{Contents: ignv2_2types.FileContents{Source: "data:,hello"}},
+			}}},
+			Systemd: ignv2_2types.Systemd{Units: []ignv2_2types.Unit{{
+				Name:    "foo.service",
+				Dropins: []ignv2_2types.SystemdDropin{{Name: "10-foo.conf", Contents: "[Service]"}},
+			}}},
+		},
+	}
+	if !reflect.DeepEqual(expected, spec) {
+		t.Fatalf("expected %+v, got %+v", expected, spec)
+	}
+
+	// 2.2 configs are read as they are, and written back the same
+	b, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var roundTrip MachineConfigSpec
+	if err := json.Unmarshal(b, &roundTrip); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(spec, roundTrip) {
+		t.Fatalf("expected %+v, got %+v", spec, roundTrip)
+	}
+
+	if err := json.Unmarshal([]byte(`{"config": {"ignition": {"version": "3.0.0"}, "storage": {"raid": [{"name": "md0"}]}}}`), &spec); err == nil {
+		t.Fatal("expected an error for RAID arrays in a 3.0.0 config")
+	}
+}
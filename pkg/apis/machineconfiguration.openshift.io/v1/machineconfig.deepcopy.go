@@ -34,6 +34,14 @@ func (in *MachineConfig) DeepCopyObject() runtime.Object {
 func (in *MachineConfigSpec) DeepCopyInto(out *MachineConfigSpec) {
 	*out = *in
 	out.Config = deepCopyIgnConfig(in.Config)
+	if in.KernelArguments != nil {
+		out.KernelArguments = make([]string, len(in.KernelArguments))
+		copy(out.KernelArguments, in.KernelArguments)
+	}
+	if in.Extensions != nil {
+		out.Extensions = make([]string, len(in.Extensions))
+		copy(out.Extensions, in.Extensions)
+	}
 	return
 }
 
@@ -1,7 +1,11 @@
 package v1
 
 import (
+	"encoding/json"
+
 	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	configv1 "github.com/openshift/api/config/v1"
+	"github.com/openshift/machine-config-operator/pkg/ignition"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -121,6 +125,14 @@ type ControllerConfigSpec struct {
 	EtcdCAData       []byte `json:"etcdCAData"`
 	EtcdMetricCAData []byte `json:"etcdMetricCAData"`
 	RootCAData       []byte `json:"rootCAData"`
+	// AdditionalTrustBundle is the PEM bundle of the CAs trusted on top of the
+	// system ones, sourced from configmap/user-ca-bundle in openshift-config.
+	// Daemons trust it to fetch the remote contents of files.
+	AdditionalTrustBundle []byte `json:"additionalTrustBundle,omitempty"`
+
+	// Proxy is the cluster-wide proxy, sourced from proxy/cluster. Daemons
+	// fetch the remote contents of files through it.
+	Proxy *configv1.ProxySpec `json:"proxy,omitempty"`
 
 	// PullSecret is the default pull secret that needs to be installed
 	// on all machines.
@@ -227,10 +239,57 @@ type MachineConfigSpec struct {
 	// OSImageURL specifies the remote location that will be used to
 	// fetch the OS.
 	OSImageURL string `json:"osImageURL"`
-	// Config is a Ignition Config object.
+	// Config is a Ignition Config object. Configs of the 3.0 spec are
+	// translated to 2.2 when read, see UnmarshalJSON.
 	Config ignv2_2types.Config `json:"config"`
+	// KernelArguments are appended to the kernel command line of the
+	// machine, like "nosmt" or "hugepages=16".
+	KernelArguments []string `json:"kernelArguments,omitempty"`
+	// KernelType is the kernel the machine boots, one of "default" or
+	// "realtime". Empty means "default".
+	KernelType string `json:"kernelType,omitempty"`
+	// Extensions are the names of the extensions of the OS image to install,
+	// like "usbguard".
+	Extensions []string `json:"extensions,omitempty"`
+	// FIPS enables FIPS mode on the machine. It can only be set at install
+	// time.
+	FIPS bool `json:"fips,omitempty"`
+}
+
+// UnmarshalJSON reads the spec, translating its Ignition config to the 2.2
+// spec if it is of the 3.0 one. Other configs are read as they are.
+func (s *MachineConfigSpec) UnmarshalJSON(b []byte) error {
+	type plainSpec MachineConfigSpec
+	spec := struct {
+		*plainSpec
+		// shadows the Config of plainSpec
+		Config json.RawMessage `json:"config"`
+	}{plainSpec: (*plainSpec)(s)}
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return err
+	}
+	if !ignition.IsV3(spec.Config) {
+		s.Config = ignv2_2types.Config{}
+		if len(spec.Config) == 0 || string(spec.Config) == "null" {
+			return nil
+		}
+		return json.Unmarshal(spec.Config, &s.Config)
+	}
+	config, err := ignition.ParseV3(spec.Config)
+	if err != nil {
+		return err
+	}
+	s.Config = config
+	return nil
 }
 
+const (
+	// KernelTypeDefault is the kernel shipped in the OS image.
+	KernelTypeDefault = "default"
+	// KernelTypeRealtime is the kernel-rt kernel.
+	KernelTypeRealtime = "realtime"
+)
+
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
 // MachineConfigList is a list of MachineConfig resources
@@ -322,6 +381,10 @@ type MachineConfigPoolStatus struct {
 	// A node is marked unavailable if it is in updating state or NodeReady condition is false.
 	UnavailableMachineCount int32 `json:"unavailableMachineCount"`
 
+	// Number of machine configs added, removed or changed since the current
+	// MachineConfig was rendered while rendering is paused.
+	PendingSourceCount int32 `json:"pendingSourceCount,omitempty"`
+
 	// Represents the latest available observations of current state.
 	Conditions []MachineConfigPoolCondition `json:"conditions"`
 }
@@ -368,6 +431,18 @@ const (
 	// When at least one of machine is not either not updated or is in the process of updating
 	// to the desired machine config.
 	MachineConfigPoolUpdating MachineConfigPoolConditionType = "Updating"
+	// MachineConfigPoolDegraded means at least one machine of the pool is not
+	// in the state its machine config says, e.g. booted another OS image.
+	MachineConfigPoolDegraded MachineConfigPoolConditionType = "Degraded"
+	// MachineConfigPoolRenderDegraded means the configs of the pool render
+	// into a config which can't be rolled out to its nodes, e.g. changing
+	// sections of the Ignition config nodes only get when provisioned, or
+	// can't be rendered, e.g. defining a file with conflicting contents.
+	MachineConfigPoolRenderDegraded MachineConfigPoolConditionType = "RenderDegraded"
+	// MachineConfigPoolRenderingPaused means no new MachineConfig is rendered
+	// for the pool, as set by its pause-rendering annotation, unlike the
+	// paused spec which stops the update of its machines.
+	MachineConfigPoolRenderingPaused MachineConfigPoolConditionType = "RenderingPaused"
 )
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
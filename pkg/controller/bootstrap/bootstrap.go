@@ -44,11 +44,6 @@ func New(templatesDir, manifestDir, pullSecretFile string) *Bootstrap {
 // Run runs boostrap for Machine Config Controller
 // It writes all the assets to destDir
 func (b *Bootstrap) Run(destDir string) error {
-	infos, err := ioutil.ReadDir(b.manifestDir)
-	if err != nil {
-		return err
-	}
-
 	psfraw, err := ioutil.ReadFile(b.pullSecretFile)
 	if err != nil {
 		return err
@@ -59,47 +54,9 @@ func (b *Bootstrap) Run(destDir string) error {
 		return err
 	}
 
-	var cconfig *v1.ControllerConfig
-	var pools []*v1.MachineConfigPool
-	var configs []*v1.MachineConfig
-	for _, info := range infos {
-		if info.IsDir() {
-			continue
-		}
-
-		file, err := os.Open(filepath.Join(b.manifestDir, info.Name()))
-		if err != nil {
-			return fmt.Errorf("error opening %s: %v", file.Name(), err)
-		}
-		defer file.Close()
-
-		manifests, err := parseManifests(file.Name(), file)
-		if err != nil {
-			return fmt.Errorf("error parsing manifests from %s: %v", file.Name(), err)
-		}
-
-		for idx, m := range manifests {
-			obji, err := runtime.Decode(scheme.Codecs.UniversalDecoder(v1.SchemeGroupVersion), m.Raw)
-			if err != nil {
-				if runtime.IsNotRegisteredError(err) {
-					// don't care
-					glog.V(4).Infof("skipping path %q [%d] manifest because it is not part of expected api group: %v", file.Name(), idx+1, err)
-					continue
-				}
-				return fmt.Errorf("error parsing %q [%d] manifest: %v", file.Name(), idx+1, err)
-			}
-
-			switch obj := obji.(type) {
-			case *v1.MachineConfigPool:
-				pools = append(pools, obj)
-			case *v1.MachineConfig:
-				configs = append(configs, obj)
-			case *v1.ControllerConfig:
-				cconfig = obj
-			default:
-				glog.Infof("skipping %q [%d] manifest because of unhandled %T", file.Name(), idx+1, obji)
-			}
-		}
+	cconfig, pools, configs, err := LoadManifests(b.manifestDir)
+	if err != nil {
+		return err
 	}
 
 	if cconfig == nil {
@@ -148,6 +105,60 @@ func (b *Bootstrap) Run(destDir string) error {
 	return nil
 }
 
+// LoadManifests reads the ControllerConfig, MachineConfigPools and
+// MachineConfigs from the manifests in the files of dir, skipping the other
+// objects. The ControllerConfig is nil if there is none.
+func LoadManifests(dir string) (*v1.ControllerConfig, []*v1.MachineConfigPool, []*v1.MachineConfig, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var cconfig *v1.ControllerConfig
+	var pools []*v1.MachineConfigPool
+	var configs []*v1.MachineConfig
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+
+		file, err := os.Open(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("error opening %s: %v", file.Name(), err)
+		}
+		defer file.Close()
+
+		manifests, err := parseManifests(file.Name(), file)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("error parsing manifests from %s: %v", file.Name(), err)
+		}
+
+		for idx, m := range manifests {
+			obji, err := runtime.Decode(scheme.Codecs.UniversalDecoder(v1.SchemeGroupVersion), m.Raw)
+			if err != nil {
+				if runtime.IsNotRegisteredError(err) {
+					// don't care
+					glog.V(4).Infof("skipping path %q [%d] manifest because it is not part of expected api group: %v", file.Name(), idx+1, err)
+					continue
+				}
+				return nil, nil, nil, fmt.Errorf("error parsing %q [%d] manifest: %v", file.Name(), idx+1, err)
+			}
+
+			switch obj := obji.(type) {
+			case *v1.MachineConfigPool:
+				pools = append(pools, obj)
+			case *v1.MachineConfig:
+				configs = append(configs, obj)
+			case *v1.ControllerConfig:
+				cconfig = obj
+			default:
+				glog.Infof("skipping %q [%d] manifest because of unhandled %T", file.Name(), idx+1, obji)
+			}
+		}
+	}
+	return cconfig, pools, configs, nil
+}
+
 func getPullSecretFromSecret(sData []byte) ([]byte, error) {
 	obji, err := runtime.Decode(kscheme.Codecs.UniversalDecoder(corev1.SchemeGroupVersion), sData)
 	if err != nil {
@@ -4,6 +4,21 @@ const (
 	// GeneratedByControllerVersionAnnotationKey is used to tag the machineconfigs generated by the controller with the version of the controller.
 	GeneratedByControllerVersionAnnotationKey = "machineconfiguration.openshift.io/generated-by-controller-version"
 
+	// RenderedConfigSourcesAnnotationKey is set on the rendered machineconfigs to the JSON list of the machineconfigs they are rendered from, with their name, uid and generation.
+	RenderedConfigSourcesAnnotationKey = "machineconfiguration.openshift.io/source-machine-configs"
+
+	// RenderedConfigHistoryAnnotationKey is set on a machineconfigpool to the number of its rendered machineconfigs the render controller keeps.
+	RenderedConfigHistoryAnnotationKey = "machineconfiguration.openshift.io/rendered-config-history"
+
+	// PauseRenderingAnnotationKey is set on a machineconfigpool to "true" for the render controller to stop rendering its machineconfigs, keeping it on its current rendered machineconfig.
+	PauseRenderingAnnotationKey = "machineconfiguration.openshift.io/pause-rendering"
+
+	// MachineConfigRoleLabelKey is the label of the machineconfigs with the role of the pools they are for, like "worker".
+	MachineConfigRoleLabelKey = "machineconfiguration.openshift.io/role"
+
+	// MachineConfigRolesAnnotationKey is set on a machineconfig to the comma-separated roles of the pools it is for on top of its role label, like "master,worker": the pools selecting it with any of those roles get it.
+	MachineConfigRolesAnnotationKey = "machineconfiguration.openshift.io/roles"
+
 	// ControllerConfigName is the name of the ControllerConfig object that controllers use
 	ControllerConfigName = "machine-config-controller"
 )
@@ -1,6 +1,8 @@
 package common
 
 import (
+	"reflect"
+
 	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
 )
 
@@ -12,3 +14,59 @@ func NewIgnConfig() ignv2_2types.Config {
 		},
 	}
 }
+
+// UnsupportedSection is a section of the Ignition config which the daemon
+// never changes on a running node: nodes only get it when they are
+// provisioned.
+type UnsupportedSection struct {
+	// Path is the JSON path of the section in a MachineConfig
+	Path string
+	// Get returns the section of an Ignition config
+	Get func(ignv2_2types.Config) interface{}
+}
+
+// UnsupportedSections are the sections of the Ignition config which can't be
+// changed once nodes are provisioned. The daemon doesn't reconcile changes to
+// them, and the render controller doesn't roll them out.
+var UnsupportedSections = []UnsupportedSection{
+	{"spec.config.networkd.units", func(c ignv2_2types.Config) interface{} { return c.Networkd.Units }},
+	{"spec.config.passwd.groups", func(c ignv2_2types.Config) interface{} { return c.Passwd.Groups }},
+	{"spec.config.storage.disks", func(c ignv2_2types.Config) interface{} { return c.Storage.Disks }},
+	{"spec.config.storage.filesystems", func(c ignv2_2types.Config) interface{} { return c.Storage.Filesystems }},
+	{"spec.config.storage.raid", func(c ignv2_2types.Config) interface{} { return c.Storage.Raid }},
+	{"spec.config.storage.directories", func(c ignv2_2types.Config) interface{} { return c.Storage.Directories }},
+}
+
+// isEmptySection returns whether section, a list, has no items.
+func isEmptySection(section interface{}) bool {
+	return reflect.ValueOf(section).Len() == 0
+}
+
+// ChangedUnsupportedSections returns the paths of the UnsupportedSections
+// which differ between oldConfig and newConfig. Unset and empty sections are
+// the same.
+func ChangedUnsupportedSections(oldConfig, newConfig ignv2_2types.Config) []string {
+	var changed []string
+	for _, s := range UnsupportedSections {
+		oldSection, newSection := s.Get(oldConfig), s.Get(newConfig)
+		if isEmptySection(oldSection) && isEmptySection(newSection) {
+			continue
+		}
+		if !reflect.DeepEqual(oldSection, newSection) {
+			changed = append(changed, s.Path)
+		}
+	}
+	return changed
+}
+
+// SetUnsupportedSections returns the paths of the UnsupportedSections config
+// has items in.
+func SetUnsupportedSections(config ignv2_2types.Config) []string {
+	var set []string
+	for _, s := range UnsupportedSections {
+		if !isEmptySection(s.Get(config)) {
+			set = append(set, s.Path)
+		}
+	}
+	return set
+}
@@ -0,0 +1,31 @@
+package common
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultMetricsBindAddress is the address the metrics listener of the controllers binds to by default
+const DefaultMetricsBindAddress = "127.0.0.1:8798"
+
+// StartMetricsListener serves the metrics registered by the controllers on
+// addr until stopCh is closed. Intended to be run via a goroutine.
+func StartMetricsListener(addr string, stopCh <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	glog.Infof("Starting metrics listener on %s", addr)
+	s := http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			glog.Errorf("metrics listener exited with error: %v", err)
+		}
+	}()
+	<-stopCh
+	if err := s.Shutdown(context.Background()); err != nil {
+		glog.Errorf("error stopping metrics listener: %v", err)
+	}
+}
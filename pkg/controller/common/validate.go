@@ -0,0 +1,134 @@
+package common
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/url"
+	"reflect"
+	"strings"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/coreos/ignition/config/validate"
+	"github.com/coreos/ignition/config/validate/report"
+)
+
+// FileHashes are the functions of the verification hashes of files the
+// daemon supports, by the prefix naming them.
+var FileHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// InvalidField is a field of an Ignition config the daemon refuses to write.
+type InvalidField struct {
+	// Path is the JSON path of the field in a MachineConfig
+	Path string
+	// Unsupported is set for the values which are valid Ignition, but which
+	// the daemon doesn't support
+	Unsupported bool
+	Detail      string
+}
+
+func (f InvalidField) String() string {
+	return fmt.Sprintf("%s: %s", f.Path, f.Detail)
+}
+
+// ParseFileHash splits a verification hash, like "sha512-<hex sum>", into its
+// function and sum, checking both.
+func ParseFileHash(verification ignv2_2types.Verification) (string, string, error) {
+	function, sum, err := verification.HashParts()
+	if err != nil {
+		return "", "", err
+	}
+	newHash, ok := FileHashes[function]
+	if !ok {
+		return "", "", fmt.Errorf("unsupported hash function %q, expected sha256 or sha512", function)
+	}
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != newHash().Size() {
+		return "", "", fmt.Errorf("invalid %s sum", function)
+	}
+	return function, strings.ToLower(sum), nil
+}
+
+// CheckFileContents returns the fields of the files of config whose contents
+// the daemon can't write: invalid verification hashes, remote contents
+// without a verification hash, which would be neither cached nor trusted,
+// sources of other schemes than data, http and https, and compressions other
+// than gzip, the only one Ignition 2.2 supports.
+func CheckFileContents(config ignv2_2types.Config) []InvalidField {
+	var fields []InvalidField
+	for i, f := range config.Storage.Files {
+		if f.Contents.Verification.Hash == nil {
+			continue
+		}
+		if _, _, err := ParseFileHash(f.Contents.Verification); err != nil {
+			fields = append(fields, InvalidField{Path: fmt.Sprintf("spec.config.storage.files[%d].contents.verification.hash", i), Detail: err.Error()})
+		}
+	}
+	for i, f := range config.Storage.Files {
+		u, err := url.Parse(f.Contents.Source)
+		if err != nil {
+			// reported by the validation of the config
+			continue
+		}
+		switch u.Scheme {
+		case "", "data":
+		case "http", "https":
+			if f.Contents.Verification.Hash == nil {
+				fields = append(fields, InvalidField{Path: fmt.Sprintf("spec.config.storage.files[%d].contents.verification.hash", i), Detail: "required for remote contents"})
+			}
+		default:
+			fields = append(fields, InvalidField{Path: fmt.Sprintf("spec.config.storage.files[%d].contents.source", i), Unsupported: true, Detail: fmt.Sprintf("unsupported scheme %q, expected data, http or https", u.Scheme)})
+		}
+	}
+	for i, f := range config.Storage.Files {
+		switch f.Contents.Compression {
+		case "", "gzip":
+		default:
+			fields = append(fields, InvalidField{Path: fmt.Sprintf("spec.config.storage.files[%d].contents.compression", i), Unsupported: true, Detail: fmt.Sprintf("unsupported compression %q, expected gzip", f.Contents.Compression)})
+		}
+	}
+	return fields
+}
+
+// ValidateIgnition returns the report of the Ignition validation of config,
+// parsing its units and data URLs among others. The verification hashes and
+// compressions of the files are left out, see CheckFileContents: Ignition
+// 2.2 only knows sha512.
+func ValidateIgnition(config ignv2_2types.Config) report.Report {
+	return validate.ValidateWithoutSource(reflect.ValueOf(withoutContentsChecks(config)))
+}
+
+// withoutContentsChecks returns config without the verification hashes and
+// compressions of its files, so that Ignition doesn't reject those checks
+// itself: unknown compressions are reported as unsupported rather than
+// invalid.
+func withoutContentsChecks(config ignv2_2types.Config) ignv2_2types.Config {
+	files := make([]ignv2_2types.File, len(config.Storage.Files))
+	for i, f := range config.Storage.Files {
+		f.Contents.Verification.Hash = nil
+		f.Contents.Compression = ""
+		files[i] = f
+	}
+	config.Storage.Files = files
+	return config
+}
+
+// ConfigErrors returns the errors of config the daemon checks before
+// applying it which don't depend on the node: those of CheckFileContents and
+// of ValidateIgnition, empty if it has none.
+func ConfigErrors(config ignv2_2types.Config) []string {
+	var errs []string
+	for _, f := range CheckFileContents(config) {
+		errs = append(errs, f.String())
+	}
+	for _, entry := range ValidateIgnition(config).Entries {
+		if entry.Kind == report.EntryError {
+			errs = append(errs, entry.Message)
+		}
+	}
+	return errs
+}
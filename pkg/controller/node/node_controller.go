@@ -65,9 +65,11 @@ type Controller struct {
 	enqueueMachineConfigPool func(*mcfgv1.MachineConfigPool)
 
 	mcpLister  mcfglistersv1.MachineConfigPoolLister
+	mcLister   mcfglistersv1.MachineConfigLister
 	nodeLister corelisterv1.NodeLister
 
 	mcpListerSynced  cache.InformerSynced
+	mcListerSynced   cache.InformerSynced
 	nodeListerSynced cache.InformerSynced
 
 	queue workqueue.RateLimitingInterface
@@ -76,6 +78,7 @@ type Controller struct {
 // New returns a new node controller.
 func New(
 	mcpInformer mcfginformersv1.MachineConfigPoolInformer,
+	mcInformer mcfginformersv1.MachineConfigInformer,
 	nodeInformer coreinformersv1.NodeInformer,
 	kubeClient clientset.Interface,
 	mcfgClient mcfgclientset.Interface,
@@ -106,8 +109,10 @@ func New(
 	ctrl.enqueueMachineConfigPool = ctrl.enqueueDefault
 
 	ctrl.mcpLister = mcpInformer.Lister()
+	ctrl.mcLister = mcInformer.Lister()
 	ctrl.nodeLister = nodeInformer.Lister()
 	ctrl.mcpListerSynced = mcpInformer.Informer().HasSynced
+	ctrl.mcListerSynced = mcInformer.Informer().HasSynced
 	ctrl.nodeListerSynced = nodeInformer.Informer().HasSynced
 
 	return ctrl
@@ -121,7 +126,7 @@ func (ctrl *Controller) Run(workers int, stopCh <-chan struct{}) {
 	glog.Info("Starting MachineConfigController-NodeController")
 	defer glog.Info("Shutting down MachineConfigController-NodeController")
 
-	if !cache.WaitForCacheSync(stopCh, ctrl.mcpListerSynced, ctrl.nodeListerSynced) {
+	if !cache.WaitForCacheSync(stopCh, ctrl.mcpListerSynced, ctrl.mcListerSynced, ctrl.nodeListerSynced) {
 		return
 	}
 
@@ -251,6 +256,10 @@ func nodeChanged(old, cur *corev1.Node) bool {
 		return true
 	}
 
+	if old.Annotations[daemonconsts.NodeHoldAnnotationKey] != cur.Annotations[daemonconsts.NodeHoldAnnotationKey] {
+		return true
+	}
+
 	return false
 }
 
@@ -447,6 +456,11 @@ func (ctrl *Controller) syncMachineConfigPool(key string) error {
 		return err
 	}
 
+	updatable, err := ctrl.degradeNodesMissingConfig(pool, nodes)
+	if err != nil {
+		return err
+	}
+
 	progress, err := makeProgress(pool, nodes)
 	if err != nil {
 		return err
@@ -456,7 +470,7 @@ func (ctrl *Controller) syncMachineConfigPool(key string) error {
 		return ctrl.syncStatusOnly(pool)
 	}
 
-	candidates := getCandidateMachines(pool, nodes, progress)
+	candidates := getCandidateMachines(pool, updatable, progress)
 	for _, node := range candidates {
 		if err := ctrl.setDesiredMachineConfigAnnotation(node.Name, pool.Status.Configuration.Name); err != nil {
 			return err
@@ -465,8 +479,48 @@ func (ctrl *Controller) syncMachineConfigPool(key string) error {
 	return ctrl.syncStatusOnly(pool)
 }
 
+// degradeNodesMissingConfig marks the nodes whose current config doesn't
+// exist anymore, e.g. deleted with the pool they were in, as degraded: the
+// daemon can't update them without it. It returns the other nodes. The
+// configs are only checked once the rendered config of pool is cached, lest
+// all of them look missing.
+func (ctrl *Controller) degradeNodesMissingConfig(pool *mcfgv1.MachineConfigPool, nodes []*corev1.Node) ([]*corev1.Node, error) {
+	if _, err := ctrl.mcLister.Get(pool.Status.Configuration.Name); err != nil {
+		return nodes, nil
+	}
+	var updatable []*corev1.Node
+	for _, node := range nodes {
+		current := node.Annotations[daemonconsts.CurrentMachineConfigAnnotationKey]
+		if _, err := ctrl.mcLister.Get(current); current == "" || !errors.IsNotFound(err) {
+			updatable = append(updatable, node)
+			continue
+		}
+		reason := fmt.Sprintf("current machine config %s of the node doesn't exist, it may have been deleted with the pool of the node: set the %s annotation of the node to an existing machine config to recover",
+			current, daemonconsts.CurrentMachineConfigAnnotationKey)
+		if node.Annotations[daemonconsts.MachineConfigDaemonStateAnnotationKey] == daemonconsts.MachineConfigDaemonStateDegraded &&
+			node.Annotations[daemonconsts.MachineConfigDaemonReasonAnnotationKey] == reason {
+			continue
+		}
+		glog.Warningf("Marking node %s degraded: %s", node.Name, reason)
+		ctrl.eventRecorder.Eventf(pool, v1.EventTypeWarning, "MissingMachineConfig", "Node %s: %s", node.Name, reason)
+		if err := ctrl.patchNodeAnnotations(node.Name, map[string]string{
+			daemonconsts.MachineConfigDaemonStateAnnotationKey:  daemonconsts.MachineConfigDaemonStateDegraded,
+			daemonconsts.MachineConfigDaemonReasonAnnotationKey: reason,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return updatable, nil
+}
+
 func (ctrl *Controller) setDesiredMachineConfigAnnotation(nodeName, currentConfig string) error {
 	glog.Infof("Setting node %s to desired config %s", nodeName, currentConfig)
+	return ctrl.patchNodeAnnotations(nodeName, map[string]string{daemonconsts.DesiredMachineConfigAnnotationKey: currentConfig})
+}
+
+// patchNodeAnnotations sets annotations on the node nodeName, if it doesn't
+// have them already.
+func (ctrl *Controller) patchNodeAnnotations(nodeName string, annotations map[string]string) error {
 	return clientretry.RetryOnConflict(nodeUpdateBackoff, func() error {
 		oldNode, err := ctrl.kubeClient.CoreV1().Nodes().Get(nodeName, metav1.GetOptions{})
 		if err != nil {
@@ -481,10 +535,16 @@ func (ctrl *Controller) setDesiredMachineConfigAnnotation(nodeName, currentConfi
 		if newNode.Annotations == nil {
 			newNode.Annotations = map[string]string{}
 		}
-		if newNode.Annotations[daemonconsts.DesiredMachineConfigAnnotationKey] == currentConfig {
+		changed := false
+		for k, v := range annotations {
+			if newNode.Annotations[k] != v {
+				newNode.Annotations[k] = v
+				changed = true
+			}
+		}
+		if !changed {
 			return nil
 		}
-		newNode.Annotations[daemonconsts.DesiredMachineConfigAnnotationKey] = currentConfig
 		newData, err := json.Marshal(newNode)
 		if err != nil {
 			return err
@@ -524,7 +584,8 @@ func getCandidateMachines(pool *mcfgv1.MachineConfigPool, nodes []*corev1.Node,
 
 	var candidates []*corev1.Node
 	for _, node := range nodes {
-		if !actedMap[node.Name] {
+		// held nodes are left alone until released
+		if !actedMap[node.Name] && !isNodeHeld(node) {
 			candidates = append(candidates, node)
 		}
 	}
@@ -39,6 +39,7 @@ type fixture struct {
 	kubeclient *k8sfake.Clientset
 
 	mcpLister  []*mcfgv1.MachineConfigPool
+	mcLister   []*mcfgv1.MachineConfig
 	nodeLister []*corev1.Node
 
 	kubeactions []core.Action
@@ -76,10 +77,11 @@ func (f *fixture) newController() *Controller {
 
 	i := informers.NewSharedInformerFactory(f.client, noResyncPeriodFunc())
 	k8sI := kubeinformers.NewSharedInformerFactory(f.kubeclient, noResyncPeriodFunc())
-	c := New(i.Machineconfiguration().V1().MachineConfigPools(), k8sI.Core().V1().Nodes(),
+	c := New(i.Machineconfiguration().V1().MachineConfigPools(), i.Machineconfiguration().V1().MachineConfigs(), k8sI.Core().V1().Nodes(),
 		f.kubeclient, f.client)
 
 	c.mcpListerSynced = alwaysReady
+	c.mcListerSynced = alwaysReady
 	c.nodeListerSynced = alwaysReady
 	c.eventRecorder = &record.FakeRecorder{}
 
@@ -94,6 +96,10 @@ func (f *fixture) newController() *Controller {
 		i.Machineconfiguration().V1().MachineConfigPools().Informer().GetIndexer().Add(c)
 	}
 
+	for _, m := range f.mcLister {
+		i.Machineconfiguration().V1().MachineConfigs().Informer().GetIndexer().Add(m)
+	}
+
 	for _, m := range f.nodeLister {
 		k8sI.Core().V1().Nodes().Informer().GetIndexer().Add(m)
 	}
@@ -203,6 +209,8 @@ func filterInformerActions(actions []core.Action) []core.Action {
 		if len(action.GetNamespace()) == 0 &&
 			(action.Matches("list", "machineconfigpools") ||
 				action.Matches("watch", "machineconfigpools") ||
+				action.Matches("list", "machineconfigs") ||
+				action.Matches("watch", "machineconfigs") ||
 				action.Matches("list", "nodes") ||
 				action.Matches("watch", "nodes")) {
 			continue
@@ -459,6 +467,15 @@ func TestGetCandidateMachines(t *testing.T) {
 			newNodeWithReady("node-2", "v0", "v0", corev1.ConditionTrue),
 		},
 		expected: []*corev1.Node{newNodeWithReady("node-1", "v0.1", "v0.2", corev1.ConditionFalse)},
+	}, {
+		//held nodes are skipped
+		progress: 2,
+		nodes: []*corev1.Node{
+			newNodeWithReady("node-0", "v1", "v1", corev1.ConditionTrue),
+			newHeldNode(newNodeWithReady("node-1", "v0", "v0", corev1.ConditionTrue)),
+			newNodeWithReady("node-2", "v0", "v0", corev1.ConditionTrue),
+		},
+		expected: []*corev1.Node{newNodeWithReady("node-2", "v0", "v0", corev1.ConditionTrue)},
 	}}
 
 	for idx, test := range tests {
@@ -907,3 +924,76 @@ func filterLastTransitionTime(obj runtime.Object) runtime.Object {
 	}
 	return o
 }
+
+func TestDegradeNodesMissingConfig(t *testing.T) {
+	mcp := newMachineConfigPool("test-cluster-worker", metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role", "worker"), intStrPtr(intstr.FromInt(1)), "v1")
+	nodes := []*corev1.Node{
+		newNodeWithLabel("node-0", "v1", "v1", map[string]string{"node-role": "worker"}),
+		newNodeWithLabel("node-1", "v0", "v1", map[string]string{"node-role": "worker"}),
+		// rendered for an infra pool since deleted
+		newNodeWithLabel("node-2", "rendered-infra-0", "rendered-infra-0", map[string]string{"node-role": "worker"}),
+	}
+	degrade := func(mcs ...string) ([]*corev1.Node, []core.Action) {
+		f := newFixture(t)
+		f.mcpLister = append(f.mcpLister, mcp)
+		f.objects = append(f.objects, mcp)
+		for _, name := range mcs {
+			f.mcLister = append(f.mcLister, &mcfgv1.MachineConfig{ObjectMeta: metav1.ObjectMeta{Name: name}})
+		}
+		f.nodeLister = append(f.nodeLister, nodes...)
+		for idx := range nodes {
+			f.kubeobjects = append(f.kubeobjects, nodes[idx])
+		}
+		c := f.newController()
+		updatable, err := c.degradeNodesMissingConfig(mcp, nodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return updatable, filterInformerActions(f.kubeclient.Actions())
+	}
+
+	updatable, actions := degrade()
+	if len(updatable) != 3 || len(actions) != 0 {
+		t.Fatalf("expected the configs not to be checked before the config of the pool is cached, got %d updatable nodes and actions %v", len(updatable), actions)
+	}
+
+	updatable, actions = degrade("v0", "v1")
+	if len(updatable) != 2 || updatable[0].Name != "node-0" || updatable[1].Name != "node-1" {
+		t.Fatalf("expected node-0 and node-1 to be updatable, got %v", updatable)
+	}
+	if len(actions) != 2 || !actions[1].Matches("patch", "nodes") || actions[1].(core.PatchAction).GetName() != "node-2" {
+		t.Fatalf("expected node-2 to be patched, got actions %v", actions)
+	}
+	node, err := applyNodePatch(actions[1], nodes[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Annotations[daemonconsts.MachineConfigDaemonStateAnnotationKey] != daemonconsts.MachineConfigDaemonStateDegraded {
+		t.Fatalf("expected node-2 to be degraded, got annotations %v", node.Annotations)
+	}
+	expReason := "current machine config rendered-infra-0 of the node doesn't exist, it may have been deleted with the pool of the node: " +
+		"set the machineconfiguration.openshift.io/currentConfig annotation of the node to an existing machine config to recover"
+	if reason := node.Annotations[daemonconsts.MachineConfigDaemonReasonAnnotationKey]; reason != expReason {
+		t.Fatalf("expected reason %q, got %q", expReason, reason)
+	}
+
+	// the nodes degraded already aren't patched again
+	nodes[2] = node
+	if _, actions = degrade("v0", "v1"); len(actions) != 0 {
+		t.Fatalf("expected no actions, got %v", actions)
+	}
+}
+
+// applyNodePatch applies the patch of action to node.
+func applyNodePatch(action core.Action, node *corev1.Node) (*corev1.Node, error) {
+	oldData, err := json.Marshal(node)
+	if err != nil {
+		return nil, err
+	}
+	newData, err := strategicpatch.StrategicMergePatch(oldData, action.(core.PatchAction).GetPatch(), corev1.Node{})
+	if err != nil {
+		return nil, err
+	}
+	patched := &corev1.Node{}
+	return patched, json.Unmarshal(newData, patched)
+}
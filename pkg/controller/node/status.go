@@ -2,6 +2,8 @@ package node
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/golang/glog"
 	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
@@ -22,6 +24,10 @@ func (ctrl *Controller) syncStatusOnly(pool *mcfgv1.MachineConfigPool) error {
 	}
 
 	newStatus := calculateStatus(pool, nodes)
+	// the rendered config may not be there yet, drift is checked once it is
+	if config, err := ctrl.mcLister.Get(pool.Status.Configuration.Name); err == nil {
+		setOSImageDriftCondition(&newStatus, config.Spec.OSImageURL, nodes)
+	}
 	if equality.Semantic.DeepEqual(pool.Status, newStatus) {
 		return nil
 	}
@@ -53,6 +59,7 @@ func calculateStatus(pool *mcfgv1.MachineConfigPool, nodes []*corev1.Node) mcfgv
 	}
 
 	status.Configuration = pool.Status.Configuration
+	status.PendingSourceCount = pool.Status.PendingSourceCount
 
 	conditions := pool.Status.Conditions
 	for i := range conditions {
@@ -138,6 +145,11 @@ func isNodeReady(node *corev1.Node) bool {
 	return true
 }
 
+// isNodeHeld returns whether node has the hold annotation set to "true".
+func isNodeHeld(node *corev1.Node) bool {
+	return node.Annotations[daemonconsts.NodeHoldAnnotationKey] == "true"
+}
+
 func getUnavailableMachines(currentConfig string, nodes []*corev1.Node) []*corev1.Node {
 	var unavail []*corev1.Node
 	for _, node := range nodes {
@@ -154,6 +166,10 @@ func getUnavailableMachines(currentConfig string, nodes []*corev1.Node) []*corev
 		}
 
 		nodeNotReady := !isNodeReady(node)
+		// held nodes aren't updating, they only take disruption up when down
+		if isNodeHeld(node) && !nodeNotReady {
+			continue
+		}
 		if dconfig == currentConfig && (dconfig != cconfig || nodeNotReady) {
 			unavail = append(unavail, node)
 			glog.V(2).Infof("Node %s unavailable: different configs %v or node not ready %v", node.Name, dconfig != cconfig, nodeNotReady)
@@ -161,3 +177,54 @@ func getUnavailableMachines(currentConfig string, nodes []*corev1.Node) []*corev
 	}
 	return unavail
 }
+
+// setOSImageDriftCondition sets the Degraded condition of status to whether
+// any of nodes done updating to the pool's config booted another OS image than
+// osImageURL.
+func setOSImageDriftCondition(status *mcfgv1.MachineConfigPoolStatus, osImageURL string, nodes []*corev1.Node) {
+	drifted := getOSImageDriftedMachines(status.Configuration.Name, osImageURL, nodes)
+	if len(drifted) == 0 {
+		cond := mcfgv1.NewMachineConfigPoolCondition(mcfgv1.MachineConfigPoolDegraded, corev1.ConditionFalse, "", "")
+		mcfgv1.SetMachineConfigPoolCondition(status, *cond)
+		return
+	}
+	names := make([]string, 0, len(drifted))
+	for _, node := range drifted {
+		names = append(names, fmt.Sprintf("%s (%s)", node.Name, node.Annotations[daemonconsts.CurrentOSImageAnnotationKey]))
+	}
+	sort.Strings(names)
+	cond := mcfgv1.NewMachineConfigPoolCondition(mcfgv1.MachineConfigPoolDegraded, corev1.ConditionTrue, "OSImageDrift",
+		fmt.Sprintf("Nodes booted an OS image other than %s: %s", osImageURL, strings.Join(names, ", ")))
+	mcfgv1.SetMachineConfigPoolCondition(status, *cond)
+}
+
+// getOSImageDriftedMachines returns the nodes done updating to currentConfig
+// whose booted OS image isn't osImageURL. Nodes which don't publish their
+// booted OS image, like those not using rpm-ostree, can't drift.
+func getOSImageDriftedMachines(currentConfig, osImageURL string, nodes []*corev1.Node) []*corev1.Node {
+	// the legacy unspecified OS image
+	if osImageURL == "" || osImageURL == "://dummy" {
+		return nil
+	}
+	var drifted []*corev1.Node
+	for _, node := range getUpdatedMachines(currentConfig, nodes) {
+		booted, ok := node.Annotations[daemonconsts.CurrentOSImageAnnotationKey]
+		if !ok {
+			continue
+		}
+		if !sameOSImage(booted, osImageURL) {
+			drifted = append(drifted, node)
+		}
+	}
+	return drifted
+}
+
+// sameOSImage returns whether the image references a and b are the same, or
+// pin the same digest.
+func sameOSImage(a, b string) bool {
+	if a == b {
+		return true
+	}
+	aDigest, bDigest := a[strings.LastIndex(a, "@")+1:], b[strings.LastIndex(b, "@")+1:]
+	return strings.Contains(a, "@") && strings.Contains(b, "@") && aDigest == bDigest
+}
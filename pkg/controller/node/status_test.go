@@ -96,6 +96,11 @@ func newNodeWithReadyAndDaemonState(name string, currentConfig, desiredConfig st
 	return node
 }
 
+func newHeldNode(node *corev1.Node) *corev1.Node {
+	node.Annotations[daemonconsts.NodeHoldAnnotationKey] = "true"
+	return node
+}
+
 func TestGetUpdatedMachines(t *testing.T) {
 	tests := []struct {
 		nodes         []*corev1.Node
@@ -267,6 +272,15 @@ func TestGetUnavailableMachines(t *testing.T) {
 		},
 		currentConfig: "v1",
 		unavail:       []*corev1.Node{newNode("node-0", "v0", "v1"), newNodeWithReady("node-2", "v1", "v1", corev1.ConditionFalse)},
+	}, {
+		// held nodes are unavailable only when NotReady
+		nodes: []*corev1.Node{
+			newHeldNode(newNodeWithReady("node-0", "v0", "v1", corev1.ConditionTrue)),
+			newHeldNode(newNodeWithReady("node-1", "v1", "v1", corev1.ConditionFalse)),
+			newNodeWithReady("node-2", "v0", "v1", corev1.ConditionTrue),
+		},
+		currentConfig: "v1",
+		unavail:       []*corev1.Node{newHeldNode(newNodeWithReady("node-1", "v1", "v1", corev1.ConditionFalse)), newNodeWithReady("node-2", "v0", "v1", corev1.ConditionTrue)},
 	}}
 
 	for idx, test := range tests {
@@ -592,3 +606,56 @@ func TestCalculateStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestSetOSImageDriftCondition(t *testing.T) {
+	const desired = "quay.io/openshift/rhcos@sha256:new"
+	newNodeWithOSImage := func(name, currentConfig, osImage string) *corev1.Node {
+		node := newNode(name, currentConfig, currentConfig)
+		node.Annotations[daemonconsts.CurrentOSImageAnnotationKey] = osImage
+		return node
+	}
+
+	tests := []struct {
+		name     string
+		nodes    []*corev1.Node
+		degraded corev1.ConditionStatus
+	}{{
+		name: "all on the desired image",
+		nodes: []*corev1.Node{
+			newNodeWithOSImage("node-0", "v1", desired),
+			// the same digest from another registry
+			newNodeWithOSImage("node-1", "v1", "registry.example.com/rhcos@sha256:new"),
+			// not using rpm-ostree
+			newNode("node-2", "v1", "v1"),
+		},
+		degraded: corev1.ConditionFalse,
+	}, {
+		name: "still updating",
+		nodes: []*corev1.Node{
+			newNodeWithOSImage("node-0", "v0", "quay.io/openshift/rhcos@sha256:old"),
+		},
+		degraded: corev1.ConditionFalse,
+	}, {
+		name: "drifted",
+		nodes: []*corev1.Node{
+			newNodeWithOSImage("node-0", "v1", desired),
+			newNodeWithOSImage("node-1", "v1", "quay.io/openshift/rhcos@sha256:old"),
+		},
+		degraded: corev1.ConditionTrue,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status := mcfgv1.MachineConfigPoolStatus{
+				Configuration: mcfgv1.MachineConfigPoolStatusConfiguration{ObjectReference: corev1.ObjectReference{Name: "v1"}},
+			}
+			setOSImageDriftCondition(&status, desired, test.nodes)
+			cond := mcfgv1.GetMachineConfigPoolCondition(status, mcfgv1.MachineConfigPoolDegraded)
+			if cond == nil {
+				t.Fatal("Expected a Degraded condition")
+			}
+			if cond.Status != test.degraded {
+				t.Errorf("Expected Degraded %s, got %s: %s", test.degraded, cond.Status, cond.Message)
+			}
+		})
+	}
+}
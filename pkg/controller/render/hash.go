@@ -1,9 +1,13 @@
 package render
 
 import (
+	"bytes"
 	"crypto/md5"
 	"fmt"
+	"reflect"
+	"sort"
 
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
 	"github.com/ghodss/yaml"
 	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
 )
@@ -21,13 +25,15 @@ var (
 )
 
 // Given a config from a pool, generate a name for the config
-// of the form rendered-<poolname>-<hash>
+// of the form rendered-<poolname>-<hash>. The hash is of the canonical form
+// of its spec, see canonicalSpec, so that rendering the same contents again
+// keeps the name.
 func getMachineConfigHashedName(pool *mcfgv1.MachineConfigPool, config *mcfgv1.MachineConfig) (string, error) {
 	if config == nil {
 		return "", fmt.Errorf("empty machineconfig object")
 	}
 
-	data, err := yaml.Marshal(config.Spec)
+	data, err := yaml.Marshal(canonicalSpec(config.Spec))
 	if err != nil {
 		return "", err
 	}
@@ -49,3 +55,70 @@ func hashData(data []byte) ([]byte, error) {
 	}
 	return hasher.Sum(nil), nil
 }
+
+// canonicalSpec returns spec as its rendered config is named after: the
+// files, links, directories and units sorted by path or name, keeping the
+// order of the entries of a path, like the fragments appended to a file, the
+// identical definitions only once, the extensions sorted and the empty lists
+// unset. Those change the order the sources are listed in, not what is
+// written to the nodes.
+func canonicalSpec(spec mcfgv1.MachineConfigSpec) mcfgv1.MachineConfigSpec {
+	canonical := spec.DeepCopy()
+	storage := &canonical.Config.Storage
+	var files []ignv2_2types.File
+	for _, f := range storage.Files {
+		if !f.Append && containsFile(files, f) {
+			continue
+		}
+		files = append(files, f)
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	storage.Files = files
+	sort.SliceStable(storage.Links, func(i, j int) bool { return storage.Links[i].Path < storage.Links[j].Path })
+	sort.SliceStable(storage.Directories, func(i, j int) bool { return storage.Directories[i].Path < storage.Directories[j].Path })
+	var units []ignv2_2types.Unit
+	for _, u := range canonical.Config.Systemd.Units {
+		if !containsUnit(units, u) {
+			units = append(units, u)
+		}
+	}
+	sort.SliceStable(units, func(i, j int) bool { return units[i].Name < units[j].Name })
+	canonical.Config.Systemd.Units = units
+	sort.Strings(canonical.Extensions)
+	if len(canonical.KernelArguments) == 0 {
+		canonical.KernelArguments = nil
+	}
+	return *canonical
+}
+
+func containsFile(files []ignv2_2types.File, f ignv2_2types.File) bool {
+	for _, file := range files {
+		if reflect.DeepEqual(file, f) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsUnit(units []ignv2_2types.Unit, u ignv2_2types.Unit) bool {
+	for _, unit := range units {
+		if reflect.DeepEqual(unit, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameContents returns whether the rendered configs a and b have the same
+// canonical spec, see canonicalSpec, whatever they are named.
+func sameContents(a, b *mcfgv1.MachineConfig) (bool, error) {
+	aData, err := yaml.Marshal(canonicalSpec(a.Spec))
+	if err != nil {
+		return false, err
+	}
+	bData, err := yaml.Marshal(canonicalSpec(b.Spec))
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aData, bData), nil
+}
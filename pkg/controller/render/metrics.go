@@ -0,0 +1,20 @@
+package render
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// renderedConfigsPruned counts the rendered configs garbage collected, by
+	// pool
+	renderedConfigsPruned = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "mcc",
+			Name:      "rendered_configs_pruned_total",
+			Help:      "Number of rendered configs deleted by the render controller, by pool.",
+		}, []string{"pool"})
+)
+
+func init() {
+	prometheus.MustRegister(renderedConfigsPruned)
+}
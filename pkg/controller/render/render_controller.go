@@ -1,8 +1,13 @@
 package render
 
 import (
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coreos/ignition/config/validate"
@@ -10,6 +15,7 @@ import (
 	"github.com/openshift/machine-config-operator/lib/resourceapply"
 	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
 	"github.com/openshift/machine-config-operator/pkg/controller/common"
+	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
 	mcfgclientset "github.com/openshift/machine-config-operator/pkg/generated/clientset/versioned"
 	"github.com/openshift/machine-config-operator/pkg/generated/clientset/versioned/scheme"
 	mcfginformersv1 "github.com/openshift/machine-config-operator/pkg/generated/informers/externalversions/machineconfiguration.openshift.io/v1"
@@ -20,10 +26,13 @@ import (
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformersv1 "k8s.io/client-go/informers/core/v1"
 	clientset "k8s.io/client-go/kubernetes"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisterv1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
@@ -40,6 +49,10 @@ const (
 	// renderDelay is a pause to avoid churn in MachineConfigs; see
 	// https://github.com/openshift/machine-config-operator/issues/301
 	renderDelay = 5 * time.Second
+
+	// defaultRenderedConfigHistory is the number of rendered configs of a
+	// pool kept by default, see common.RenderedConfigHistoryAnnotationKey
+	defaultRenderedConfigHistory = 10
 )
 
 var (
@@ -66,7 +79,14 @@ type Controller struct {
 	ccLister       mcfglistersv1.ControllerConfigLister
 	ccListerSynced cache.InformerSynced
 
+	nodeLister       corelisterv1.NodeLister
+	nodeListerSynced cache.InformerSynced
+
 	queue workqueue.RateLimitingInterface
+
+	// renderedConfigSizeLimit is the size limit of the rendered configs in
+	// bytes, see fitSizeLimit
+	renderedConfigSizeLimit int
 }
 
 // New returns a new render controller.
@@ -74,8 +94,10 @@ func New(
 	mcpInformer mcfginformersv1.MachineConfigPoolInformer,
 	mcInformer mcfginformersv1.MachineConfigInformer,
 	ccInformer mcfginformersv1.ControllerConfigInformer,
+	nodeInformer coreinformersv1.NodeInformer,
 	kubeClient clientset.Interface,
 	mcfgClient mcfgclientset.Interface,
+	renderedConfigSizeLimit int,
 ) *Controller {
 	eventBroadcaster := record.NewBroadcaster()
 	eventBroadcaster.StartLogging(glog.Infof)
@@ -85,6 +107,8 @@ func New(
 		client:        mcfgClient,
 		eventRecorder: eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "machineconfigcontroller-rendercontroller"}),
 		queue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "machineconfigcontroller-rendercontroller"),
+
+		renderedConfigSizeLimit: renderedConfigSizeLimit,
 	}
 
 	mcpInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -107,6 +131,8 @@ func New(
 	ctrl.mcListerSynced = mcInformer.Informer().HasSynced
 	ctrl.ccLister = ccInformer.Lister()
 	ctrl.ccListerSynced = ccInformer.Informer().HasSynced
+	ctrl.nodeLister = nodeInformer.Lister()
+	ctrl.nodeListerSynced = nodeInformer.Informer().HasSynced
 
 	return ctrl
 }
@@ -119,7 +145,7 @@ func (ctrl *Controller) Run(workers int, stopCh <-chan struct{}) {
 	glog.Info("Starting MachineConfigController-RenderController")
 	defer glog.Info("Shutting down MachineConfigController-RenderController")
 
-	if !cache.WaitForCacheSync(stopCh, ctrl.mcpListerSynced, ctrl.mcListerSynced, ctrl.ccListerSynced) {
+	if !cache.WaitForCacheSync(stopCh, ctrl.mcpListerSynced, ctrl.mcListerSynced, ctrl.ccListerSynced, ctrl.nodeListerSynced) {
 		return
 	}
 
@@ -181,7 +207,7 @@ func (ctrl *Controller) addMachineConfig(obj interface{}) {
 
 	pools, err := ctrl.getPoolsForMachineConfig(mc)
 	if err != nil {
-		glog.Errorf("error finding pools for machineconfig: %v", err)
+		ctrl.warnNoPools(mc, err)
 		return
 	}
 
@@ -213,8 +239,14 @@ func (ctrl *Controller) updateMachineConfig(old, cur interface{}) {
 
 	pools, err := ctrl.getPoolsForMachineConfig(curMC)
 	if err != nil {
-		glog.Errorf("error finding pools for machineconfig: %v", err)
-		return
+		ctrl.warnNoPools(curMC, err)
+	}
+	// the pools which don't select the config anymore are rendered again
+	// without it
+	if !reflect.DeepEqual(oldMC.Labels, curMC.Labels) || oldMC.Annotations[common.MachineConfigRolesAnnotationKey] != curMC.Annotations[common.MachineConfigRolesAnnotationKey] {
+		if oldPools, err := ctrl.getPoolsForMachineConfig(oldMC); err == nil {
+			pools = append(pools, oldPools...)
+		}
 	}
 
 	glog.V(4).Infof("MachineConfig %s updated", curMC.Name)
@@ -280,7 +312,8 @@ func (ctrl *Controller) resolveControllerRef(controllerRef *metav1.OwnerReferenc
 }
 
 func (ctrl *Controller) getPoolsForMachineConfig(config *mcfgv1.MachineConfig) ([]*mcfgv1.MachineConfigPool, error) {
-	if len(config.Labels) == 0 {
+	roles := config.Annotations[common.MachineConfigRolesAnnotationKey]
+	if len(config.Labels) == 0 && roles == "" {
 		return nil, fmt.Errorf("no MachineConfigPool found for MachineConfig %v because it has no labels", config.Name)
 	}
 
@@ -297,7 +330,7 @@ func (ctrl *Controller) getPoolsForMachineConfig(config *mcfgv1.MachineConfig) (
 		}
 
 		// If a pool with a nil or empty selector creeps in, it should match nothing, not everything.
-		if selector.Empty() || !selector.Matches(labels.Set(config.Labels)) {
+		if selector.Empty() || !selectsConfig(selector, config) {
 			continue
 		}
 
@@ -305,11 +338,57 @@ func (ctrl *Controller) getPoolsForMachineConfig(config *mcfgv1.MachineConfig) (
 	}
 
 	if len(pools) == 0 {
+		if roles != "" {
+			return nil, fmt.Errorf("could not find any MachineConfigPool set for MachineConfig %s with labels: %v and roles: %s", config.Name, config.Labels, roles)
+		}
 		return nil, fmt.Errorf("could not find any MachineConfigPool set for MachineConfig %s with labels: %v", config.Name, config.Labels)
 	}
 	return pools, nil
 }
 
+// warnNoPools records err, the error of finding no pool for config. An
+// event is emitted for the configs with labels or roles, as their role is
+// likely misspelled: those without any, like the rendered configs, aren't
+// for a pool.
+func (ctrl *Controller) warnNoPools(config *mcfgv1.MachineConfig, err error) {
+	glog.Errorf("error finding pools for machineconfig: %v", err)
+	if len(config.Labels) == 0 && config.Annotations[common.MachineConfigRolesAnnotationKey] == "" {
+		return
+	}
+	ctrl.eventRecorder.Event(config, v1.EventTypeWarning, "NoMatchingPools", err.Error())
+}
+
+// configLabelSets returns the sets of labels pools select config by: its
+// labels, and those with the role label set to each of the roles of its
+// common.MachineConfigRolesAnnotationKey annotation.
+func configLabelSets(config *mcfgv1.MachineConfig) []labels.Set {
+	sets := []labels.Set{labels.Set(config.Labels)}
+	for _, role := range strings.Split(config.Annotations[common.MachineConfigRolesAnnotationKey], ",") {
+		role = strings.TrimSpace(role)
+		if role == "" {
+			continue
+		}
+		set := labels.Set{}
+		for k, v := range config.Labels {
+			set[k] = v
+		}
+		set[common.MachineConfigRoleLabelKey] = role
+		sets = append(sets, set)
+	}
+	return sets
+}
+
+// selectsConfig returns whether selector selects config by any of its sets
+// of labels, see configLabelSets.
+func selectsConfig(selector labels.Selector, config *mcfgv1.MachineConfig) bool {
+	for _, set := range configLabelSets(config) {
+		if selector.Matches(set) {
+			return true
+		}
+	}
+	return false
+}
+
 func (ctrl *Controller) enqueue(pool *mcfgv1.MachineConfigPool) {
 	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(pool)
 	if err != nil {
@@ -415,6 +494,10 @@ func (ctrl *Controller) syncMachineConfigPool(key string) error {
 		return nil
 	}
 
+	if err := ctrl.adoptRenderedConfigs(pool); err != nil {
+		return err
+	}
+
 	selector, err := metav1.LabelSelectorAsSelector(pool.Spec.MachineConfigSelector)
 	if err != nil {
 		return err
@@ -425,10 +508,17 @@ func (ctrl *Controller) syncMachineConfigPool(key string) error {
 		return err
 	}
 
-	mcs, err := ctrl.mcLister.List(selector)
+	// the roles of their annotation aren't labels the lister can select
+	all, err := ctrl.mcLister.List(labels.Everything())
 	if err != nil {
 		return err
 	}
+	var mcs []*mcfgv1.MachineConfig
+	for _, mc := range all {
+		if selectsConfig(selector, mc) {
+			mcs = append(mcs, mc)
+		}
+	}
 	if len(mcs) == 0 {
 		return fmt.Errorf("no MachineConfigs found matching selector %v", selector)
 	}
@@ -436,16 +526,114 @@ func (ctrl *Controller) syncMachineConfigPool(key string) error {
 	return ctrl.syncGeneratedMachineConfig(pool, mcs)
 }
 
-// This function will eventually contain a sane garbage collection policy for rendered MachineConfigs;
-// see https://github.com/openshift/machine-config-operator/issues/301
-// It will probably involve making sure we're only GCing a config after all nodes don't have it
-// in either desired or current config.
+// adoptRenderedConfigs makes pool the controller of its rendered configs
+// without one, as rendered before they were given one, for them to be
+// deleted with the pool. The rendered configs of a pool are named
+// rendered-<pool>-<hash>.
+func (ctrl *Controller) adoptRenderedConfigs(pool *mcfgv1.MachineConfigPool) error {
+	if pool.DeletionTimestamp != nil {
+		return nil
+	}
+	renderedName := regexp.MustCompile("^rendered-" + regexp.QuoteMeta(pool.Name) + "-[0-9a-f]{32}$")
+	mcs, err := ctrl.mcLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, mc := range mcs {
+		if mc.DeletionTimestamp != nil || metav1.GetControllerOf(mc) != nil || !renderedName.MatchString(mc.Name) {
+			continue
+		}
+		// Deep-copy otherwise we are mutating our cache. The update fails
+		// if the config changed meanwhile, it is retried with the pool.
+		adopted := mc.DeepCopy()
+		adopted.OwnerReferences = append(adopted.OwnerReferences, *metav1.NewControllerRef(pool, controllerKind))
+		if _, err := ctrl.client.MachineconfigurationV1().MachineConfigs().Update(adopted); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return fmt.Errorf("could not adopt rendered config %s: %v", mc.Name, err)
+		}
+		glog.Infof("Adopted rendered config %s in pool %s", mc.Name, pool.Name)
+	}
+	return nil
+}
+
+// garbageCollectRenderedConfigs deletes the rendered configs of pool but the
+// newest ones, see renderedConfigHistory, once all its nodes are updated to
+// its current config. The current config of the pool, and the configs any
+// node is on or is told to move to, are never deleted.
 func (ctrl *Controller) garbageCollectRenderedConfigs(pool *mcfgv1.MachineConfigPool) error {
-	// Temporarily until https://github.com/openshift/machine-config-operator/pull/318
-	// which depends on the strategy for https://github.com/openshift/machine-config-operator/issues/301
+	if !mcfgv1.IsMachineConfigPoolConditionTrue(pool.Status.Conditions, mcfgv1.MachineConfigPoolUpdated) ||
+		pool.Status.UpdatedMachineCount != pool.Status.MachineCount {
+		return nil
+	}
+	history, err := renderedConfigHistory(pool)
+	if err != nil {
+		ctrl.eventRecorder.Event(pool, v1.EventTypeWarning, "InvalidRenderedConfigHistory", err.Error())
+		return nil
+	}
+
+	mcs, err := ctrl.mcLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	var rendered []*mcfgv1.MachineConfig
+	for _, mc := range mcs {
+		if metav1.IsControlledBy(mc, pool) && strings.HasPrefix(mc.Name, fmt.Sprintf("rendered-%s-", pool.Name)) {
+			rendered = append(rendered, mc)
+		}
+	}
+	if len(rendered) <= history {
+		return nil
+	}
+
+	inUse := map[string]bool{pool.Status.Configuration.Name: true}
+	nodes, err := ctrl.nodeLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		inUse[node.Annotations[daemonconsts.CurrentMachineConfigAnnotationKey]] = true
+		inUse[node.Annotations[daemonconsts.DesiredMachineConfigAnnotationKey]] = true
+	}
+
+	// newest first
+	sort.Slice(rendered, func(i, j int) bool {
+		ti, tj := rendered[i].CreationTimestamp, rendered[j].CreationTimestamp
+		if !ti.Equal(&tj) {
+			return tj.Before(&ti)
+		}
+		return rendered[i].Name > rendered[j].Name
+	})
+	for _, mc := range rendered[history:] {
+		if inUse[mc.Name] {
+			continue
+		}
+		if err := ctrl.client.MachineconfigurationV1().MachineConfigs().Delete(mc.Name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		glog.V(2).Infof("Pruned rendered config %s of pool %s", mc.Name, pool.Name)
+		ctrl.eventRecorder.Eventf(pool, v1.EventTypeNormal, "RenderedConfigPruned", "Deleted rendered config %s, keeping the newest %d", mc.Name, history)
+		renderedConfigsPruned.WithLabelValues(pool.Name).Inc()
+	}
 	return nil
 }
 
+// renderedConfigHistory returns the number of rendered configs of pool kept by
+// garbageCollectRenderedConfigs, set by its
+// common.RenderedConfigHistoryAnnotationKey annotation.
+func renderedConfigHistory(pool *mcfgv1.MachineConfigPool) (int, error) {
+	value, ok := pool.Annotations[common.RenderedConfigHistoryAnnotationKey]
+	if !ok {
+		return defaultRenderedConfigHistory, nil
+	}
+	history, err := strconv.Atoi(value)
+	if err != nil || history < 1 {
+		return 0, fmt.Errorf("invalid %s annotation %q, must be a positive number of rendered configs to keep", common.RenderedConfigHistoryAnnotationKey, value)
+	}
+	return history, nil
+}
+
 func (ctrl *Controller) syncGeneratedMachineConfig(pool *mcfgv1.MachineConfigPool, configs []*mcfgv1.MachineConfig) error {
 	if len(configs) == 0 {
 		return nil
@@ -459,14 +647,52 @@ func (ctrl *Controller) syncGeneratedMachineConfig(pool *mcfgv1.MachineConfigPoo
 		return fmt.Errorf("ControllerConfigList is empty")
 	}
 
-	generated, err := generateRenderedMachineConfig(pool, configs, cc[0])
+	// a pool without a config yet is rendered one for its nodes to boot with
+	if current, err := ctrl.mcLister.Get(pool.Status.Configuration.Name); err == nil && renderingPaused(ctrl.eventRecorder, pool) {
+		return ctrl.syncRenderingPaused(pool, currentSources(current, pool), renderedConfigSources(configs))
+	}
+	if err := ctrl.syncRenderingPaused(pool, nil, nil); err != nil {
+		return err
+	}
+
+	// the configs have to be fixed by their owners, the pool stays on its
+	// config until they are
+	if reason := conflictingDefinitions(configs); reason != "" {
+		ctrl.eventRecorder.Event(pool, v1.EventTypeWarning, "ConflictingConfigs", reason)
+		return ctrl.syncRenderDegraded(pool, "ConflictingConfigs", reason)
+	}
+	if reason := invalidConfig(configs, cc[0].Spec.OSImageURL); reason != "" {
+		ctrl.eventRecorder.Event(pool, v1.EventTypeWarning, "InvalidConfig", reason)
+		return ctrl.syncRenderDegraded(pool, "InvalidConfig", reason)
+	}
+
+	generated, err := generateRenderedMachineConfig(pool, configs, cc[0], ctrl.renderedConfigSizeLimit)
+	if tooLarge, ok := err.(*renderedConfigTooLargeError); ok {
+		ctrl.eventRecorder.Event(pool, v1.EventTypeWarning, "RenderedConfigTooLarge", tooLarge.Error())
+		return ctrl.syncRenderDegraded(pool, "RenderedConfigTooLarge", tooLarge.Error())
+	}
+	if err != nil {
+		return err
+	}
+	generated, err = ctrl.reuseRenderedConfig(pool, generated)
 	if err != nil {
 		return err
 	}
 
+	// nodes are never handed a config they can't apply
+	if current, err := ctrl.mcLister.Get(pool.Status.Configuration.Name); err == nil && current.Name != generated.Name {
+		if reason := unsupportedChanges(current, generated, configs); reason != "" {
+			ctrl.eventRecorder.Event(pool, v1.EventTypeWarning, "UnsupportedChanges", reason)
+			return ctrl.syncRenderDegraded(pool, "UnsupportedChanges", reason)
+		}
+	}
+	if err := ctrl.syncRenderDegraded(pool, "", ""); err != nil {
+		return err
+	}
+
 	source := []v1.ObjectReference{}
 	for _, cfg := range configs {
-		source = append(source, v1.ObjectReference{Kind: machineconfigKind.Kind, Name: cfg.GetName(), APIVersion: machineconfigKind.GroupVersion().String()})
+		source = append(source, v1.ObjectReference{Kind: machineconfigKind.Kind, Name: cfg.GetName(), UID: cfg.GetUID(), APIVersion: machineconfigKind.GroupVersion().String()})
 	}
 
 	_, err = ctrl.mcLister.Get(generated.Name)
@@ -479,10 +705,26 @@ func (ctrl *Controller) syncGeneratedMachineConfig(pool *mcfgv1.MachineConfigPoo
 	}
 
 	if pool.Status.Configuration.Name == generated.Name {
-		_, _, err = resourceapply.ApplyMachineConfig(ctrl.client.MachineconfigurationV1(), generated)
-		return err
+		// the sources can change without the config, e.g. by adding an
+		// empty MachineConfig
+		if _, _, err := resourceapply.ApplyMachineConfig(ctrl.client.MachineconfigurationV1(), generated); err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(pool.Status.Configuration.Source, source) {
+			pool.Status.Configuration.Source = source
+			updated, err := ctrl.client.MachineconfigurationV1().MachineConfigPools().UpdateStatus(pool)
+			if err != nil {
+				return err
+			}
+			pool.ObjectMeta = updated.ObjectMeta
+		}
+		return ctrl.garbageCollectRenderedConfigs(pool)
 	}
 
+	if current, err := ctrl.mcLister.Get(pool.Status.Configuration.Name); err == nil {
+		ctrl.eventRecorder.Eventf(pool, v1.EventTypeNormal, "RenderedConfigChanged", "Moving from %s to %s: %s",
+			current.Name, generated.Name, sourcesDelta(currentSources(current, pool), renderedConfigSources(configs)))
+	}
 	pool.Status.Configuration.Name = generated.Name
 	pool.Status.Configuration.Source = source
 	_, err = ctrl.client.MachineconfigurationV1().MachineConfigPools().UpdateStatus(pool)
@@ -497,8 +739,144 @@ func (ctrl *Controller) syncGeneratedMachineConfig(pool *mcfgv1.MachineConfigPoo
 	return nil
 }
 
+// reuseRenderedConfig returns generated as the existing rendered config of
+// pool with the same contents, see sameContents: the config of the pool or
+// the one named as generated. Its spec is kept as it is, so that rendering
+// the same contents again, e.g. from sources listing them in another order
+// or by a controller naming them differently, doesn't update the config or
+// roll out another one.
+func (ctrl *Controller) reuseRenderedConfig(pool *mcfgv1.MachineConfigPool, generated *mcfgv1.MachineConfig) (*mcfgv1.MachineConfig, error) {
+	for _, name := range []string{pool.Status.Configuration.Name, generated.Name} {
+		existing, err := ctrl.mcLister.Get(name)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		same, err := sameContents(existing, generated)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			continue
+		}
+		reused := generated.DeepCopy()
+		reused.Name = existing.Name
+		reused.Spec = *existing.Spec.DeepCopy()
+		return reused, nil
+	}
+	return generated, nil
+}
+
+// unsupportedChanges describes the changes from the current rendered config
+// of a pool to generated, rendered from configs, which the daemon can't apply
+// to its nodes, empty if there are none. Each changed section is named with
+// the configs setting it.
+func unsupportedChanges(current, generated *mcfgv1.MachineConfig, configs []*mcfgv1.MachineConfig) string {
+	changed := common.ChangedUnsupportedSections(current.Spec.Config, generated.Spec.Config)
+	if len(changed) == 0 {
+		return ""
+	}
+	setBy := make(map[string][]string)
+	for _, config := range configs {
+		for _, path := range common.SetUnsupportedSections(config.Spec.Config) {
+			setBy[path] = append(setBy[path], config.Name)
+		}
+	}
+	var sections []string
+	for _, path := range changed {
+		if names := setBy[path]; len(names) > 0 {
+			sections = append(sections, fmt.Sprintf("%s (set by %s)", path, strings.Join(names, ", ")))
+		} else {
+			sections = append(sections, fmt.Sprintf("%s (removed)", path))
+		}
+	}
+	return fmt.Sprintf("machine configs change sections not supported for day-2 changes from %s: %s", current.Name, strings.Join(sections, "; "))
+}
+
+// syncRenderDegraded sets the RenderDegraded condition of pool to message,
+// with reason, cleared if message is empty.
+func (ctrl *Controller) syncRenderDegraded(pool *mcfgv1.MachineConfigPool, reason, message string) error {
+	cond := mcfgv1.NewMachineConfigPoolCondition(mcfgv1.MachineConfigPoolRenderDegraded, v1.ConditionFalse, "", "")
+	if message != "" {
+		cond = mcfgv1.NewMachineConfigPoolCondition(mcfgv1.MachineConfigPoolRenderDegraded, v1.ConditionTrue, reason, message)
+	}
+	current := mcfgv1.GetMachineConfigPoolCondition(pool.Status, mcfgv1.MachineConfigPoolRenderDegraded)
+	if current == nil && message == "" {
+		return nil
+	}
+	if current != nil && current.Status == cond.Status && current.Reason == cond.Reason && current.Message == cond.Message {
+		return nil
+	}
+	// the message changes with the configs, not only the status
+	if current != nil && current.Status == cond.Status {
+		cond.LastTransitionTime = current.LastTransitionTime
+	}
+	mcfgv1.RemoveMachineConfigPoolCondition(&pool.Status, mcfgv1.MachineConfigPoolRenderDegraded)
+	mcfgv1.SetMachineConfigPoolCondition(&pool.Status, *cond)
+	updated, err := ctrl.client.MachineconfigurationV1().MachineConfigPools().UpdateStatus(pool)
+	if err != nil {
+		return err
+	}
+	pool.ObjectMeta = updated.ObjectMeta
+	return nil
+}
+
+// renderingPaused returns whether the rendering of pool is paused by its
+// common.PauseRenderingAnnotationKey annotation. An invalid annotation doesn't
+// pause it, with an InvalidPauseRendering event.
+func renderingPaused(recorder record.EventRecorder, pool *mcfgv1.MachineConfigPool) bool {
+	value, ok := pool.Annotations[common.PauseRenderingAnnotationKey]
+	if !ok {
+		return false
+	}
+	paused, err := strconv.ParseBool(value)
+	if err != nil {
+		recorder.Eventf(pool, v1.EventTypeWarning, "InvalidPauseRendering", "invalid %s annotation %q, must be true or false", common.PauseRenderingAnnotationKey, value)
+		return false
+	}
+	return paused
+}
+
+// syncRenderingPaused sets the RenderingPaused condition of pool, rendered
+// from the sources previous, and its count of pending sources, the changes to
+// current. Both are cleared if current is empty, rendering not being paused.
+func (ctrl *Controller) syncRenderingPaused(pool *mcfgv1.MachineConfigPool, previous, current []renderedConfigSource) error {
+	cond := mcfgv1.NewMachineConfigPoolCondition(mcfgv1.MachineConfigPoolRenderingPaused, v1.ConditionFalse, "", "")
+	var pending int32
+	if len(current) > 0 {
+		added, removed, changed := sourceChanges(previous, current)
+		pending = int32(len(added) + len(removed) + len(changed))
+		message := fmt.Sprintf("Rendering is paused by the %s annotation on %s", common.PauseRenderingAnnotationKey, pool.Status.Configuration.Name)
+		if pending > 0 {
+			message = fmt.Sprintf("%s, with %d pending machine configs: %s", message, pending, sourcesDelta(previous, current))
+		}
+		cond = mcfgv1.NewMachineConfigPoolCondition(mcfgv1.MachineConfigPoolRenderingPaused, v1.ConditionTrue, "PauseRenderingAnnotation", message)
+	}
+	existing := mcfgv1.GetMachineConfigPoolCondition(pool.Status, mcfgv1.MachineConfigPoolRenderingPaused)
+	if existing == nil && len(current) == 0 && pool.Status.PendingSourceCount == 0 {
+		return nil
+	}
+	if existing != nil && existing.Status == cond.Status && existing.Reason == cond.Reason && existing.Message == cond.Message && pool.Status.PendingSourceCount == pending {
+		return nil
+	}
+	if existing != nil && existing.Status == cond.Status {
+		cond.LastTransitionTime = existing.LastTransitionTime
+	}
+	mcfgv1.RemoveMachineConfigPoolCondition(&pool.Status, mcfgv1.MachineConfigPoolRenderingPaused)
+	mcfgv1.SetMachineConfigPoolCondition(&pool.Status, *cond)
+	pool.Status.PendingSourceCount = pending
+	updated, err := ctrl.client.MachineconfigurationV1().MachineConfigPools().UpdateStatus(pool)
+	if err != nil {
+		return err
+	}
+	pool.ObjectMeta = updated.ObjectMeta
+	return nil
+}
+
 // generateRenderedMachineConfig takes all MCs for a given pool and returns a single rendered MC. For ex master-XXXX or worker-XXXX
-func generateRenderedMachineConfig(pool *mcfgv1.MachineConfigPool, configs []*mcfgv1.MachineConfig, cconfig *mcfgv1.ControllerConfig) (*mcfgv1.MachineConfig, error) {
+func generateRenderedMachineConfig(pool *mcfgv1.MachineConfigPool, configs []*mcfgv1.MachineConfig, cconfig *mcfgv1.ControllerConfig, sizeLimit int) (*mcfgv1.MachineConfig, error) {
 	// Before merging all MCs for a specific pool, let's make sure each contains a valid Ignition Config
 	for _, config := range configs {
 		rpt := validate.ValidateWithoutSource(reflect.ValueOf(config.Spec.Config.Ignition))
@@ -506,6 +884,21 @@ func generateRenderedMachineConfig(pool *mcfgv1.MachineConfigPool, configs []*mc
 			return nil, fmt.Errorf("machine config: %v contains invalid ignition config: %v", config.ObjectMeta.Name, rpt)
 		}
 	}
+	if err := validateKernelType(configs); err != nil {
+		return nil, err
+	}
+	if err := validateLinks(configs); err != nil {
+		return nil, err
+	}
+	if err := validateAppends(configs); err != nil {
+		return nil, err
+	}
+	if reason := conflictingDefinitions(configs); reason != "" {
+		return nil, fmt.Errorf("%s", reason)
+	}
+	if reason := invalidConfig(configs, cconfig.Spec.OSImageURL); reason != "" {
+		return nil, fmt.Errorf("%s", reason)
+	}
 	merged := mcfgv1.MergeMachineConfigs(configs, cconfig.Spec.OSImageURL)
 	hashedName, err := getMachineConfigHashedName(pool, merged)
 	if err != nil {
@@ -519,10 +912,284 @@ func generateRenderedMachineConfig(pool *mcfgv1.MachineConfigPool, configs []*mc
 		merged.Annotations = map[string]string{}
 	}
 	merged.Annotations[common.GeneratedByControllerVersionAnnotationKey] = version.Version.String()
+	sources, err := json.Marshal(renderedConfigSources(configs))
+	if err != nil {
+		return nil, err
+	}
+	merged.Annotations[common.RenderedConfigSourcesAnnotationKey] = string(sources)
+
+	// the files compressed to fit are part of the contents the config is
+	// named after
+	compressed, err := fitSizeLimit(merged, configs, sizeLimit)
+	if err != nil {
+		return nil, err
+	}
+	if compressed {
+		if hashedName, err = getMachineConfigHashedName(pool, merged); err != nil {
+			return nil, err
+		}
+		merged.SetName(hashedName)
+	}
 
 	return merged, nil
 }
 
+// renderedConfigSource is a MachineConfig a rendered config is rendered from,
+// as listed in its common.RenderedConfigSourcesAnnotationKey annotation.
+type renderedConfigSource struct {
+	Name       string    `json:"name"`
+	UID        types.UID `json:"uid"`
+	Generation int64     `json:"generation"`
+}
+
+// renderedConfigSources returns the sources of the config rendered from
+// configs, in the order they are merged in.
+func renderedConfigSources(configs []*mcfgv1.MachineConfig) []renderedConfigSource {
+	sources := make([]renderedConfigSource, 0, len(configs))
+	for _, config := range configs {
+		sources = append(sources, renderedConfigSource{Name: config.Name, UID: config.UID, Generation: config.Generation})
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Name < sources[j].Name })
+	return sources
+}
+
+// currentSources returns the sources of current, the rendered config of pool.
+// The configs rendered before the sources were recorded on them only have
+// those of the pool, without their generation.
+func currentSources(current *mcfgv1.MachineConfig, pool *mcfgv1.MachineConfigPool) []renderedConfigSource {
+	var sources []renderedConfigSource
+	if err := json.Unmarshal([]byte(current.Annotations[common.RenderedConfigSourcesAnnotationKey]), &sources); err == nil {
+		return sources
+	}
+	sources = nil
+	for _, ref := range pool.Status.Configuration.Source {
+		sources = append(sources, renderedConfigSource{Name: ref.Name, UID: ref.UID})
+	}
+	return sources
+}
+
+// sourcesDelta describes the changes from the sources previous to current,
+// e.g. "added 99-worker-chrony, removed 98-worker-foo, 00-worker changed
+// generation 3→4". A source recreated with the same name is changed.
+func sourcesDelta(previous, current []renderedConfigSource) string {
+	added, removed, changed := sourceChanges(previous, current)
+	var delta []string
+	if len(added) > 0 {
+		delta = append(delta, "added "+strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		delta = append(delta, "removed "+strings.Join(removed, ", "))
+	}
+	delta = append(delta, changed...)
+	if len(delta) == 0 {
+		return "the sources are unchanged"
+	}
+	return strings.Join(delta, ", ")
+}
+
+// sourceChanges returns the names of the sources added to and removed from
+// previous in current, and the descriptions of those changed, see
+// sourcesDelta.
+func sourceChanges(previous, current []renderedConfigSource) ([]string, []string, []string) {
+	before := make(map[string]renderedConfigSource, len(previous))
+	for _, s := range previous {
+		before[s.Name] = s
+	}
+	var added, changed, removed []string
+	after := make(map[string]bool, len(current))
+	for _, s := range current {
+		after[s.Name] = true
+		p, ok := before[s.Name]
+		switch {
+		case !ok:
+			added = append(added, s.Name)
+		case p.UID != "" && p.UID != s.UID:
+			changed = append(changed, fmt.Sprintf("%s was recreated", s.Name))
+		case p.Generation != 0 && p.Generation != s.Generation:
+			changed = append(changed, fmt.Sprintf("%s changed generation %d→%d", s.Name, p.Generation, s.Generation))
+		}
+	}
+	for _, s := range previous {
+		if !after[s.Name] {
+			removed = append(removed, s.Name)
+		}
+	}
+	return added, removed, changed
+}
+
+// validateKernelType makes sure the configs of a pool agree on a valid kernel
+// type, as a pool can only boot one kernel.
+func validateKernelType(configs []*mcfgv1.MachineConfig) error {
+	var kernelType, setBy string
+	for _, config := range configs {
+		switch config.Spec.KernelType {
+		case "":
+			continue
+		case mcfgv1.KernelTypeDefault, mcfgv1.KernelTypeRealtime:
+		default:
+			return fmt.Errorf("machine config: %v has invalid kernelType %q, must be %q or %q", config.Name, config.Spec.KernelType, mcfgv1.KernelTypeDefault, mcfgv1.KernelTypeRealtime)
+		}
+		if setBy != "" && config.Spec.KernelType != kernelType {
+			return fmt.Errorf("machine configs: %v and %v set conflicting kernelType %q and %q", setBy, config.Name, kernelType, config.Spec.KernelType)
+		}
+		kernelType, setBy = config.Spec.KernelType, config.Name
+	}
+	return nil
+}
+
+// validateLinks makes sure no link of the configs of a pool has the path of a
+// file, as the daemon can only write one of them there.
+func validateLinks(configs []*mcfgv1.MachineConfig) error {
+	fileSetBy := make(map[string]string)
+	for _, config := range configs {
+		for _, f := range config.Spec.Config.Storage.Files {
+			fileSetBy[f.Path] = config.Name
+		}
+	}
+	for _, config := range configs {
+		for _, link := range config.Spec.Config.Storage.Links {
+			setBy, ok := fileSetBy[link.Path]
+			if !ok {
+				continue
+			}
+			if setBy == config.Name {
+				return fmt.Errorf("machine config: %v sets both a file and a link at %q", config.Name, link.Path)
+			}
+			return fmt.Errorf("machine configs: %v and %v set conflicting file and link at %q", setBy, config.Name, link.Path)
+		}
+	}
+	return nil
+}
+
+// validateAppends makes sure no file of the configs of a pool, in the order
+// they are merged in, replaces a file another entry appended to, as the
+// fragment would be silently dropped.
+func validateAppends(configs []*mcfgv1.MachineConfig) error {
+	sorted := make([]*mcfgv1.MachineConfig, len(configs))
+	copy(sorted, configs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	appendedBy := make(map[string]string)
+	for _, config := range sorted {
+		for _, f := range config.Spec.Config.Storage.Files {
+			if f.Append {
+				if _, ok := appendedBy[f.Path]; !ok {
+					appendedBy[f.Path] = config.Name
+				}
+				continue
+			}
+			setBy, ok := appendedBy[f.Path]
+			if !ok {
+				continue
+			}
+			if setBy == config.Name {
+				return fmt.Errorf("machine config: %v overwrites %q after appending to it", config.Name, f.Path)
+			}
+			return fmt.Errorf("machine configs: %v overwrites %q after %v appends to it", config.Name, f.Path, setBy)
+		}
+	}
+	return nil
+}
+
+// repeatableKernelArguments are the kernel arguments which can be given more
+// than once with different values, each adding to the others.
+var repeatableKernelArguments = map[string]bool{
+	"console":             true,
+	"hugepagesz":          true,
+	"hugepages":           true,
+	"ip":                  true,
+	"nameserver":          true,
+	"rd.znet":             true,
+	"rd.dasd":             true,
+	"rd.zfcp":             true,
+	"bond":                true,
+	"vlan":                true,
+	"bridge":              true,
+	"rd.driver.blacklist": true,
+	"modprobe.blacklist":  true,
+}
+
+// conflictingDefinitions describes the files, units and dropins which two of
+// configs define with different contents, empty if there are none: the
+// rendered config would only get the contents of the last of them in the
+// merge order. Identical definitions merge, the files appended to aren't
+// definitions. So are the kernel arguments two of configs give different
+// values, like mitigations=off and mitigations=auto, as the kernel only
+// takes one of them, but for repeatableKernelArguments.
+func conflictingDefinitions(configs []*mcfgv1.MachineConfig) string {
+	sorted := make([]*mcfgv1.MachineConfig, len(configs))
+	copy(sorted, configs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	type definition struct {
+		setBy    string
+		contents interface{}
+	}
+	defined := make(map[string]definition)
+	conflicting := make(map[string]bool)
+	var conflicts []string
+	define := func(what, setBy string, contents interface{}) {
+		d, ok := defined[what]
+		if !ok {
+			defined[what] = definition{setBy: setBy, contents: contents}
+			return
+		}
+		if d.setBy == setBy || conflicting[what] || reflect.DeepEqual(d.contents, contents) {
+			return
+		}
+		conflicting[what] = true
+		conflicts = append(conflicts, fmt.Sprintf("%s (%s and %s)", what, d.setBy, setBy))
+	}
+	for _, config := range sorted {
+		for _, arg := range config.Spec.KernelArguments {
+			key := strings.SplitN(arg, "=", 2)[0]
+			if !repeatableKernelArguments[key] {
+				define(fmt.Sprintf("kernel argument %q", key), config.Name, arg)
+			}
+		}
+		for _, f := range config.Spec.Config.Storage.Files {
+			if !f.Append {
+				define(fmt.Sprintf("file %q", f.Path), config.Name, f.Contents)
+			}
+		}
+		for _, u := range config.Spec.Config.Systemd.Units {
+			// units can be enabled or masked without their contents
+			if u.Contents != "" {
+				define(fmt.Sprintf("unit %q", u.Name), config.Name, u.Contents)
+			}
+			for _, d := range u.Dropins {
+				define(fmt.Sprintf("dropin %q of unit %q", d.Name, u.Name), config.Name, d.Contents)
+			}
+		}
+	}
+	if len(conflicts) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("machine configs define conflicting contents: %s", strings.Join(conflicts, "; "))
+}
+
+// invalidConfig describes the errors of the config merged from configs the
+// daemon would refuse to apply, see common.ConfigErrors, empty if it has
+// none. The errors are named with the configs having them on their own,
+// those likely to be fixed; the others only come with the merge.
+func invalidConfig(configs []*mcfgv1.MachineConfig, osImageURL string) string {
+	sorted := make([]*mcfgv1.MachineConfig, len(configs))
+	copy(sorted, configs)
+	merged := mcfgv1.MergeMachineConfigs(sorted, osImageURL)
+	errs := common.ConfigErrors(merged.Spec.Config)
+	if len(errs) == 0 {
+		return ""
+	}
+	var invalid []string
+	for _, config := range sorted {
+		if configErrs := common.ConfigErrors(config.Spec.Config); len(configErrs) > 0 {
+			invalid = append(invalid, fmt.Sprintf("%s (%s)", config.Name, strings.Join(configErrs, ", ")))
+		}
+	}
+	if len(invalid) == 0 {
+		return fmt.Sprintf("merged machine configs are invalid: %s", strings.Join(errs, ", "))
+	}
+	return fmt.Sprintf("machine configs are invalid: %s", strings.Join(invalid, "; "))
+}
+
 // RunBootstrap runs the render controller in bootstrap mode.
 // For each pool, it matches the machineconfigs based on label selector and
 // returns the generated machineconfigs and pool with CurrentMachineConfig status field set.
@@ -537,7 +1204,7 @@ func RunBootstrap(pools []*mcfgv1.MachineConfigPool, configs []*mcfgv1.MachineCo
 			return nil, nil, err
 		}
 
-		generated, err := generateRenderedMachineConfig(pool, pcs, cconfig)
+		generated, err := generateRenderedMachineConfig(pool, pcs, cconfig, DefaultRenderedConfigSizeLimit)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -563,7 +1230,7 @@ func getMachineConfigsForPool(pool *mcfgv1.MachineConfigPool, configs []*mcfgv1.
 		return out, nil
 	}
 	for idx, config := range configs {
-		if selector.Matches(labels.Set(config.Labels)) {
+		if selectsConfig(selector, config) {
 			out = append(out, configs[idx])
 		}
 	}
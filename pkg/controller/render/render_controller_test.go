@@ -9,8 +9,10 @@ import (
 	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
 	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
 	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
 	"github.com/openshift/machine-config-operator/pkg/generated/clientset/versioned/fake"
 	informers "github.com/openshift/machine-config-operator/pkg/generated/informers/externalversions"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	corev1 "k8s.io/api/core/v1"
@@ -21,6 +23,7 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/diff"
 	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	kubeinformers "k8s.io/client-go/informers"
 	k8sfake "k8s.io/client-go/kubernetes/fake"
 	core "k8s.io/client-go/testing"
 	"k8s.io/client-go/tools/cache"
@@ -40,6 +43,7 @@ type fixture struct {
 	mcpLister []*mcfgv1.MachineConfigPool
 	mcLister  []*mcfgv1.MachineConfig
 	ccLister  []*mcfgv1.ControllerConfig
+	nodes     []*corev1.Node
 
 	actions []core.Action
 
@@ -71,6 +75,12 @@ func newMachineConfig(name string, labels map[string]string, osurl string, files
 		labels = map[string]string{}
 	}
 	ignCfg := ctrlcommon.NewIgnConfig()
+	// the files of the templates are all on the root filesystem
+	for i := range files {
+		if files[i].Filesystem == "" {
+			files[i].Filesystem = "root"
+		}
+	}
 	ignCfg.Storage.Files = files
 	return &mcfgv1.MachineConfig{
 		TypeMeta:   metav1.TypeMeta{APIVersion: mcfgv1.SchemeGroupVersion.String()},
@@ -82,17 +92,29 @@ func newMachineConfig(name string, labels map[string]string, osurl string, files
 	}
 }
 
+// newSource returns the status.configuration.source of a pool rendered from
+// configs.
+func newSource(configs []*mcfgv1.MachineConfig) []corev1.ObjectReference {
+	source := []corev1.ObjectReference{}
+	for _, config := range configs {
+		source = append(source, corev1.ObjectReference{Kind: machineconfigKind.Kind, Name: config.Name, UID: config.UID, APIVersion: machineconfigKind.GroupVersion().String()})
+	}
+	return source
+}
+
 func (f *fixture) newController() *Controller {
 	f.client = fake.NewSimpleClientset(f.objects...)
 
 	i := informers.NewSharedInformerFactory(f.client, noResyncPeriodFunc())
+	k8sI := kubeinformers.NewSharedInformerFactory(k8sfake.NewSimpleClientset(), noResyncPeriodFunc())
 
 	c := New(i.Machineconfiguration().V1().MachineConfigPools(), i.Machineconfiguration().V1().MachineConfigs(),
-		i.Machineconfiguration().V1().ControllerConfigs(), k8sfake.NewSimpleClientset(), f.client)
+		i.Machineconfiguration().V1().ControllerConfigs(), k8sI.Core().V1().Nodes(), k8sfake.NewSimpleClientset(), f.client, DefaultRenderedConfigSizeLimit)
 
 	c.mcpListerSynced = alwaysReady
 	c.mcListerSynced = alwaysReady
 	c.ccListerSynced = alwaysReady
+	c.nodeListerSynced = alwaysReady
 	c.eventRecorder = &record.FakeRecorder{}
 
 	stopCh := make(chan struct{})
@@ -113,6 +135,9 @@ func (f *fixture) newController() *Controller {
 	for _, m := range f.ccLister {
 		i.Machineconfiguration().V1().ControllerConfigs().Informer().GetIndexer().Add(m)
 	}
+	for _, n := range f.nodes {
+		k8sI.Core().V1().Nodes().Informer().GetIndexer().Add(n)
+	}
 
 	return c
 }
@@ -301,18 +326,103 @@ func TestIgnValidationGenerateRenderedMachineConfig(t *testing.T) {
 	}
 	cc := newControllerConfig(ctrlcommon.ControllerConfigName)
 
-	_, err := generateRenderedMachineConfig(mcp, mcs, cc)
+	_, err := generateRenderedMachineConfig(mcp, mcs, cc, DefaultRenderedConfigSizeLimit)
 	if err != nil {
 		t.Fatalf("expected no error. Got: %v", err)
 	}
 
 	mcs[1].Spec.Config.Ignition.Version = ""
-	_, err = generateRenderedMachineConfig(mcp, mcs, cc)
+	_, err = generateRenderedMachineConfig(mcp, mcs, cc, DefaultRenderedConfigSizeLimit)
 	if err == nil {
 		t.Fatalf("expected error. mcs contains a machine config with invalid ignconfig version")
 	}
 }
 
+func TestKernelTypeGenerateRenderedMachineConfig(t *testing.T) {
+	mcp := newMachineConfigPool("test-cluster-worker", metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role", "worker"), "")
+	mcs := []*mcfgv1.MachineConfig{
+		newMachineConfig("00-test-cluster-worker", map[string]string{"node-role": "worker"}, "dummy://", []ignv2_2types.File{}),
+		newMachineConfig("05-worker-rt", map[string]string{"node-role": "worker"}, "dummy://", []ignv2_2types.File{}),
+		newMachineConfig("06-worker-rt", map[string]string{"node-role": "worker"}, "dummy://", []ignv2_2types.File{}),
+	}
+	mcs[1].Spec.KernelType = mcfgv1.KernelTypeRealtime
+	mcs[2].Spec.KernelType = mcfgv1.KernelTypeRealtime
+	cc := newControllerConfig(ctrlcommon.ControllerConfigName)
+
+	gmc, err := generateRenderedMachineConfig(mcp, mcs, cc, DefaultRenderedConfigSizeLimit)
+	if err != nil {
+		t.Fatalf("expected no error. Got: %v", err)
+	}
+	assert.Equal(t, mcfgv1.KernelTypeRealtime, gmc.Spec.KernelType)
+
+	mcs[2].Spec.KernelType = mcfgv1.KernelTypeDefault
+	if _, err := generateRenderedMachineConfig(mcp, mcs, cc, DefaultRenderedConfigSizeLimit); err == nil {
+		t.Fatalf("expected error. mcs contains conflicting kernel types")
+	}
+
+	mcs[2].Spec.KernelType = "lowlatency"
+	if _, err := generateRenderedMachineConfig(mcp, mcs, cc, DefaultRenderedConfigSizeLimit); err == nil {
+		t.Fatalf("expected error. mcs contains an invalid kernel type")
+	}
+}
+
+func TestLinksGenerateRenderedMachineConfig(t *testing.T) {
+	mcp := newMachineConfigPool("test-cluster-worker", metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role", "worker"), "")
+	mcs := []*mcfgv1.MachineConfig{
+		newMachineConfig("00-test-cluster-worker", map[string]string{"node-role": "worker"}, "dummy://", []ignv2_2types.File{{
+			Node: ignv2_2types.Node{Path: "/etc/localtime"},
+		}}),
+		newMachineConfig("05-worker-timezone", map[string]string{"node-role": "worker"}, "dummy://", []ignv2_2types.File{}),
+	}
+	cc := newControllerConfig(ctrlcommon.ControllerConfigName)
+
+	mcs[1].Spec.Config.Storage.Links = []ignv2_2types.Link{{
+		Node:          ignv2_2types.Node{Filesystem: "root", Path: "/etc/timezone"},
+		LinkEmbedded1: ignv2_2types.LinkEmbedded1{Target: "/usr/share/zoneinfo/Europe/Paris"},
+	}}
+	gmc, err := generateRenderedMachineConfig(mcp, mcs, cc, DefaultRenderedConfigSizeLimit)
+	require.Nil(t, err)
+	assert.Len(t, gmc.Spec.Config.Storage.Links, 1)
+
+	mcs[1].Spec.Config.Storage.Links[0].Path = "/etc/localtime"
+	_, err = generateRenderedMachineConfig(mcp, mcs, cc, DefaultRenderedConfigSizeLimit)
+	require.NotNil(t, err)
+	assert.Equal(t, `machine configs: 00-test-cluster-worker and 05-worker-timezone set conflicting file and link at "/etc/localtime"`, err.Error())
+}
+
+func TestAppendsGenerateRenderedMachineConfig(t *testing.T) {
+	mcp := newMachineConfigPool("test-cluster-worker", metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role", "worker"), "")
+	motd := func(appended bool) ignv2_2types.File {
+		return ignv2_2types.File{
+			Node:          ignv2_2types.Node{Path: "/etc/motd"},
+			FileEmbedded1: ignv2_2types.FileEmbedded1{Append: appended},
+		}
+	}
+	mcs := []*mcfgv1.MachineConfig{
+		newMachineConfig("05-worker-motd", map[string]string{"node-role": "worker"}, "dummy://", []ignv2_2types.File{motd(true)}),
+		newMachineConfig("00-test-cluster-worker", map[string]string{"node-role": "worker"}, "dummy://", []ignv2_2types.File{motd(false)}),
+	}
+	cc := newControllerConfig(ctrlcommon.ControllerConfigName)
+
+	gmc, err := generateRenderedMachineConfig(mcp, mcs, cc, DefaultRenderedConfigSizeLimit)
+	require.Nil(t, err, "the file is appended to after it is written")
+	assert.Len(t, gmc.Spec.Config.Storage.Files, 2)
+
+	mcs = []*mcfgv1.MachineConfig{
+		newMachineConfig("00-worker-motd", map[string]string{"node-role": "worker"}, "dummy://", []ignv2_2types.File{motd(true)}),
+		newMachineConfig("05-test-cluster-worker", map[string]string{"node-role": "worker"}, "dummy://", []ignv2_2types.File{motd(false)}),
+	}
+	_, err = generateRenderedMachineConfig(mcp, mcs, cc, DefaultRenderedConfigSizeLimit)
+	require.NotNil(t, err)
+	assert.Equal(t, `machine configs: 05-test-cluster-worker overwrites "/etc/motd" after 00-worker-motd appends to it`, err.Error())
+
+	mcs = mcs[:1]
+	mcs[0].Spec.Config.Storage.Files = append(mcs[0].Spec.Config.Storage.Files, motd(false))
+	_, err = generateRenderedMachineConfig(mcp, mcs, cc, DefaultRenderedConfigSizeLimit)
+	require.NotNil(t, err)
+	assert.Equal(t, `machine config: 00-worker-motd overwrites "/etc/motd" after appending to it`, err.Error())
+}
+
 func TestUpdatesGeneratedMachineConfig(t *testing.T) {
 	f := newFixture(t)
 	mcp := newMachineConfigPool("test-cluster-master", metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role", "master"), "")
@@ -331,12 +441,13 @@ func TestUpdatesGeneratedMachineConfig(t *testing.T) {
 	}
 	cc := newControllerConfig(ctrlcommon.ControllerConfigName)
 
-	gmc, err := generateRenderedMachineConfig(mcp, mcs, cc)
+	gmc, err := generateRenderedMachineConfig(mcp, mcs, cc, DefaultRenderedConfigSizeLimit)
 	if err != nil {
 		t.Fatal(err)
 	}
 	gmc.Spec.OSImageURL = "why-did-you-change-it"
 	mcp.Status.Configuration.Name = gmc.Name
+	mcp.Status.Configuration.Source = newSource(mcs)
 
 	f.ccLister = append(f.ccLister, cc)
 
@@ -349,7 +460,7 @@ func TestUpdatesGeneratedMachineConfig(t *testing.T) {
 	f.mcLister = append(f.mcLister, gmc)
 	f.objects = append(f.objects, gmc)
 
-	expmc, err := generateRenderedMachineConfig(mcp, mcs, cc)
+	expmc, err := generateRenderedMachineConfig(mcp, mcs, cc, DefaultRenderedConfigSizeLimit)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -369,7 +480,7 @@ func TestGenerateMachineConfigNoOverrideOSImageURL(t *testing.T) {
 
 	cc := newControllerConfig(ctrlcommon.ControllerConfigName)
 
-	gmc, err := generateRenderedMachineConfig(mcp, mcs, cc)
+	gmc, err := generateRenderedMachineConfig(mcp, mcs, cc, DefaultRenderedConfigSizeLimit)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -394,11 +505,12 @@ func TestDoNothing(t *testing.T) {
 	}
 	cc := newControllerConfig(ctrlcommon.ControllerConfigName)
 
-	gmc, err := generateRenderedMachineConfig(mcp, mcs, cc)
+	gmc, err := generateRenderedMachineConfig(mcp, mcs, cc, DefaultRenderedConfigSizeLimit)
 	if err != nil {
 		t.Fatal(err)
 	}
 	mcp.Status.Configuration.Name = gmc.Name
+	mcp.Status.Configuration.Source = newSource(mcs)
 
 	f.ccLister = append(f.ccLister, cc)
 
@@ -416,6 +528,75 @@ func TestDoNothing(t *testing.T) {
 	f.run(getKey(mcp, t))
 }
 
+func TestRenderSameContentsAcrossRestarts(t *testing.T) {
+	mcp := newMachineConfigPool("test-cluster-worker", metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role", "worker"), "")
+	cc := newControllerConfig(ctrlcommon.ControllerConfigName)
+	// the sources of generated configs can list their contents in any order
+	sources := func(reversed bool) []*mcfgv1.MachineConfig {
+		files := []ignv2_2types.File{{Node: ignv2_2types.Node{Path: "/etc/a"}}, {Node: ignv2_2types.Node{Path: "/etc/b"}}}
+		units := []ignv2_2types.Unit{{Name: "a.service", Contents: "[Unit]\nDescription=a"}, {Name: "b.service", Contents: "[Unit]\nDescription=b"}}
+		kargs := []string{}
+		if reversed {
+			files[0], files[1] = files[1], files[0]
+			units[0], units[1] = units[1], units[0]
+			kargs = nil
+		}
+		base := newMachineConfig("00-test-cluster-worker", map[string]string{"node-role": "worker"}, "dummy://", files)
+		base.Spec.Config.Systemd.Units = units
+		base.Spec.KernelArguments = kargs
+		base.UID = "00-test-cluster-worker"
+		return []*mcfgv1.MachineConfig{base}
+	}
+	run := func(pool *mcfgv1.MachineConfigPool, configs []*mcfgv1.MachineConfig, rendered ...*mcfgv1.MachineConfig) *fixture {
+		f := newFixture(t)
+		f.ccLister = append(f.ccLister, cc)
+		f.mcpLister = append(f.mcpLister, pool)
+		f.mcLister = append(append(f.mcLister, configs...), rendered...)
+		f.objects = append(f.objects, pool)
+		for _, config := range append(configs, rendered...) {
+			f.objects = append(f.objects, config)
+		}
+		c := f.newController()
+		require.Nil(t, c.syncHandler(getKey(pool, t)))
+		return f
+	}
+
+	gmc, err := generateRenderedMachineConfig(mcp, sources(false), cc, DefaultRenderedConfigSizeLimit)
+	require.Nil(t, err)
+	reordered, err := generateRenderedMachineConfig(mcp, sources(true), cc, DefaultRenderedConfigSizeLimit)
+	require.Nil(t, err)
+	assert.Equal(t, gmc.Name, reordered.Name, "the name is of the contents, not of their order")
+
+	var created *mcfgv1.MachineConfig
+	var pool *mcfgv1.MachineConfigPool
+	for _, action := range filterInformerActions(run(mcp, sources(false)).client.Actions()) {
+		if a, ok := action.(core.CreateAction); ok && action.Matches("create", "machineconfigs") {
+			created = a.GetObject().(*mcfgv1.MachineConfig)
+		}
+		if a, ok := action.(core.UpdateAction); ok && action.Matches("update", "machineconfigpools") {
+			pool = a.GetObject().(*mcfgv1.MachineConfigPool)
+		}
+	}
+	require.NotNil(t, created)
+	require.NotNil(t, pool)
+	assert.Equal(t, gmc.Name, created.Name)
+
+	// restarted, with the sources listing their contents in another order
+	for _, action := range filterInformerActions(run(pool, sources(true), created).client.Actions()) {
+		assert.True(t, action.Matches("get", "machineconfigs"), "the rendered config is reused as it is, got %v", action)
+	}
+
+	// rendered by a controller naming the contents differently
+	renamed := created.DeepCopy()
+	renamed.Name = "rendered-test-cluster-worker-0123456789abcdef0123456789abcdef"
+	pool = pool.DeepCopy()
+	pool.Status.Configuration.Name = renamed.Name
+	for _, action := range filterInformerActions(run(pool, sources(true), renamed).client.Actions()) {
+		require.True(t, action.Matches("get", "machineconfigs"), "the config of the pool is reused, got %v", action)
+		assert.Equal(t, renamed.Name, action.(core.GetAction).GetName())
+	}
+}
+
 func TestGetMachineConfigsForPool(t *testing.T) {
 	masterPool := newMachineConfigPool("test-cluster-master", metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role", "master"), "")
 	files := []ignv2_2types.File{{
@@ -453,6 +634,79 @@ func TestGetMachineConfigsForPool(t *testing.T) {
 	}
 }
 
+func TestMachineConfigRoles(t *testing.T) {
+	role := func(r string) map[string]string {
+		return map[string]string{ctrlcommon.MachineConfigRoleLabelKey: r}
+	}
+	masterPool := newMachineConfigPool("master", &metav1.LabelSelector{MatchLabels: role("master")}, "")
+	workerPool := newMachineConfigPool("worker", &metav1.LabelSelector{MatchLabels: role("worker")}, "")
+	infraPool := newMachineConfigPool("infra", &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{
+		Key: ctrlcommon.MachineConfigRoleLabelKey, Operator: metav1.LabelSelectorOpIn, Values: []string{"worker", "infra"},
+	}}}, "")
+	chrony := newMachineConfig("50-chrony", role("master"), "dummy://", nil)
+	chrony.Annotations = map[string]string{ctrlcommon.MachineConfigRolesAnnotationKey: "master, worker"}
+
+	for _, pool := range []*mcfgv1.MachineConfigPool{masterPool, workerPool, infraPool} {
+		configs, err := getMachineConfigsForPool(pool, []*mcfgv1.MachineConfig{chrony})
+		require.Nil(t, err)
+		assert.Equal(t, []*mcfgv1.MachineConfig{chrony}, configs, "pool %s", pool.Name)
+	}
+
+	f := newFixture(t)
+	f.mcpLister = append(f.mcpLister, masterPool, workerPool, infraPool)
+	c := f.newController()
+	recorder := record.NewFakeRecorder(10)
+	c.eventRecorder = recorder
+	var enqueued []string
+	c.enqueueMachineConfigPool = func(pool *mcfgv1.MachineConfigPool) {
+		enqueued = append(enqueued, pool.Name)
+	}
+
+	// only the roles of the annotation are for worker
+	roles := chrony.DeepCopy()
+	roles.Labels = nil
+	roles.Annotations[ctrlcommon.MachineConfigRolesAnnotationKey] = "worker"
+	pools, err := c.getPoolsForMachineConfig(roles)
+	require.Nil(t, err)
+	require.Len(t, pools, 2)
+	assert.ElementsMatch(t, []string{"worker", "infra"}, []string{pools[0].Name, pools[1].Name})
+
+	c.updateMachineConfig(chrony, roles)
+	assert.ElementsMatch(t, []string{"master", "worker", "infra", "worker", "infra"}, enqueued, "the pools selecting the config before the update are rendered again")
+	assert.Len(t, recorder.Events, 0)
+
+	typo := newMachineConfig("50-chrony", role("wroker"), "dummy://", nil)
+	c.addMachineConfig(typo)
+	require.Len(t, recorder.Events, 1)
+	assert.Equal(t, "Warning NoMatchingPools could not find any MachineConfigPool set for MachineConfig 50-chrony with labels: map[machineconfiguration.openshift.io/role:wroker]", <-recorder.Events)
+
+	c.addMachineConfig(newMachineConfig("rendered-worker-0123", nil, "dummy://", nil))
+	assert.Len(t, recorder.Events, 0, "the configs without labels or roles aren't for a pool")
+
+	// the worker pool renders the config for several roles
+	base := newMachineConfig("00-worker", role("worker"), "dummy://", []ignv2_2types.File{{Node: ignv2_2types.Node{Path: "/etc/worker"}}})
+	chrony = newMachineConfig("50-chrony", role("master"), "dummy://", []ignv2_2types.File{{Node: ignv2_2types.Node{Path: "/etc/chrony.conf"}}})
+	chrony.Annotations = map[string]string{ctrlcommon.MachineConfigRolesAnnotationKey: "master,worker"}
+	f = newFixture(t)
+	f.ccLister = append(f.ccLister, newControllerConfig(ctrlcommon.ControllerConfigName))
+	f.mcpLister = append(f.mcpLister, workerPool)
+	f.mcLister = append(f.mcLister, base, chrony)
+	f.objects = append(f.objects, workerPool, base, chrony)
+	require.Nil(t, f.newController().syncHandler(getKey(workerPool, t)))
+	var rendered *mcfgv1.MachineConfig
+	for _, action := range filterInformerActions(f.client.Actions()) {
+		if a, ok := action.(core.CreateAction); ok && action.Matches("create", "machineconfigs") {
+			rendered = a.GetObject().(*mcfgv1.MachineConfig)
+		}
+	}
+	require.NotNil(t, rendered)
+	var paths []string
+	for _, file := range rendered.Spec.Config.Storage.Files {
+		paths = append(paths, file.Path)
+	}
+	assert.ElementsMatch(t, []string{"/etc/worker", "/etc/chrony.conf"}, paths)
+}
+
 func getKey(config *mcfgv1.MachineConfigPool, t *testing.T) string {
 	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(config)
 	if err != nil {
@@ -479,3 +733,451 @@ func TestMachineConfigsNoBailWithoutPool(t *testing.T) {
 	c.deleteMachineConfig(mc)
 	require.Len(t, queue, 3)
 }
+
+func TestUnsupportedChangesGeneratedMachineConfig(t *testing.T) {
+	mcp := newMachineConfigPool("test-cluster-worker", metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role", "worker"), "")
+	base := newMachineConfig("00-test-cluster-worker", map[string]string{"node-role": "worker"}, "dummy://", []ignv2_2types.File{{Node: ignv2_2types.Node{Path: "/dummy/0"}}})
+	cc := newControllerConfig(ctrlcommon.ControllerConfigName)
+	current, err := generateRenderedMachineConfig(mcp, []*mcfgv1.MachineConfig{base}, cc, DefaultRenderedConfigSizeLimit)
+	require.Nil(t, err)
+	mcp.Status.Configuration.Name = current.Name
+
+	disks := newMachineConfig("99-worker-disks", map[string]string{"node-role": "worker"}, "", nil)
+	disks.Spec.Config.Storage.Disks = []ignv2_2types.Disk{{Device: "/dev/sdb"}}
+	disks.Spec.Config.Storage.Raid = []ignv2_2types.Raid{{Name: "md0", Level: "raid1"}}
+	// supported sections, set but empty, aren't changes
+	empty := newMachineConfig("99-worker-empty", map[string]string{"node-role": "worker"}, "", nil)
+	empty.Spec.Config.Storage.Raid = []ignv2_2types.Raid{}
+	empty.Spec.Config.Passwd.Groups = []ignv2_2types.PasswdGroup{}
+
+	sync := func(configs ...*mcfgv1.MachineConfig) (*fixture, *mcfgv1.MachineConfigPool) {
+		f := newFixture(t)
+		f.ccLister = append(f.ccLister, cc)
+		f.mcpLister = append(f.mcpLister, mcp)
+		f.mcLister = append(f.mcLister, current)
+		f.mcLister = append(f.mcLister, configs...)
+		f.objects = append(f.objects, mcp, current)
+		for _, config := range configs {
+			f.objects = append(f.objects, config)
+		}
+		c := f.newController()
+		require.Nil(t, c.syncHandler(getKey(mcp, t)))
+		var pool *mcfgv1.MachineConfigPool
+		for _, action := range filterInformerActions(f.client.Actions()) {
+			if a, ok := action.(core.UpdateAction); ok && action.Matches("update", "machineconfigpools") {
+				pool = a.GetObject().(*mcfgv1.MachineConfigPool)
+			}
+		}
+		return f, pool
+	}
+
+	f, pool := sync(base, disks, empty)
+	require.NotNil(t, pool)
+	assert.Equal(t, current.Name, pool.Status.Configuration.Name, "the pool stays on its config")
+	cond := mcfgv1.GetMachineConfigPoolCondition(pool.Status, mcfgv1.MachineConfigPoolRenderDegraded)
+	require.NotNil(t, cond)
+	assert.Equal(t, corev1.ConditionTrue, cond.Status)
+	assert.Equal(t, "machine configs change sections not supported for day-2 changes from "+current.Name+
+		": spec.config.storage.disks (set by 99-worker-disks); spec.config.storage.raid (set by 99-worker-disks)", cond.Message)
+	for _, action := range f.client.Actions() {
+		assert.False(t, action.Matches("create", "machineconfigs"), "the config isn't rendered")
+	}
+
+	mcp.Status = pool.Status
+	file := newMachineConfig("99-worker-file", map[string]string{"node-role": "worker"}, "", []ignv2_2types.File{{Node: ignv2_2types.Node{Path: "/dummy/1"}}})
+	_, pool = sync(base, empty, file)
+	require.NotNil(t, pool)
+	assert.True(t, mcfgv1.IsMachineConfigPoolConditionFalse(pool.Status.Conditions, mcfgv1.MachineConfigPoolRenderDegraded))
+	assert.NotEqual(t, current.Name, pool.Status.Configuration.Name, "the pool moves to the new config")
+}
+
+func TestPauseRendering(t *testing.T) {
+	mcp := newMachineConfigPool("test-cluster-worker", metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role", "worker"), "")
+	base := newMachineConfig("00-test-cluster-worker", map[string]string{"node-role": "worker"}, "dummy://", []ignv2_2types.File{{Node: ignv2_2types.Node{Path: "/dummy/0"}}})
+	cc := newControllerConfig(ctrlcommon.ControllerConfigName)
+	current, err := generateRenderedMachineConfig(mcp, []*mcfgv1.MachineConfig{base}, cc, DefaultRenderedConfigSizeLimit)
+	require.Nil(t, err)
+	mcp.Status.Configuration.Name = current.Name
+	mcp.Annotations = map[string]string{ctrlcommon.PauseRenderingAnnotationKey: "true"}
+	file := newMachineConfig("99-worker-file", map[string]string{"node-role": "worker"}, "", []ignv2_2types.File{{Node: ignv2_2types.Node{Path: "/dummy/1"}}})
+
+	sync := func(configs ...*mcfgv1.MachineConfig) (*fixture, *mcfgv1.MachineConfigPool) {
+		f := newFixture(t)
+		f.ccLister = append(f.ccLister, cc)
+		f.mcpLister = append(f.mcpLister, mcp)
+		f.mcLister = append(f.mcLister, current)
+		f.mcLister = append(f.mcLister, configs...)
+		f.objects = append(f.objects, mcp, current)
+		for _, config := range configs {
+			f.objects = append(f.objects, config)
+		}
+		c := f.newController()
+		require.Nil(t, c.syncHandler(getKey(mcp, t)))
+		var pool *mcfgv1.MachineConfigPool
+		for _, action := range filterInformerActions(f.client.Actions()) {
+			if a, ok := action.(core.UpdateAction); ok && action.Matches("update", "machineconfigpools") {
+				pool = a.GetObject().(*mcfgv1.MachineConfigPool)
+			}
+		}
+		return f, pool
+	}
+
+	f, pool := sync(base, file)
+	require.NotNil(t, pool)
+	assert.Equal(t, current.Name, pool.Status.Configuration.Name, "the pool stays on its config")
+	assert.Equal(t, int32(1), pool.Status.PendingSourceCount)
+	cond := mcfgv1.GetMachineConfigPoolCondition(pool.Status, mcfgv1.MachineConfigPoolRenderingPaused)
+	require.NotNil(t, cond)
+	assert.Equal(t, corev1.ConditionTrue, cond.Status)
+	assert.Equal(t, "Rendering is paused by the machineconfiguration.openshift.io/pause-rendering annotation on "+current.Name+
+		", with 1 pending machine configs: added 99-worker-file", cond.Message)
+	for _, action := range f.client.Actions() {
+		assert.False(t, action.Matches("create", "machineconfigs"), "the config isn't rendered")
+	}
+
+	// synced again, the status is up to date
+	mcp.Status = pool.Status
+	_, pool = sync(base, file)
+	assert.Nil(t, pool)
+
+	// a pool without a config is rendered one while paused
+	unrendered := mcp.DeepCopy()
+	unrendered.Status = mcfgv1.MachineConfigPoolStatus{}
+	f = newFixture(t)
+	f.ccLister = append(f.ccLister, cc)
+	f.mcpLister = append(f.mcpLister, unrendered)
+	f.mcLister = append(f.mcLister, base)
+	f.objects = append(f.objects, unrendered, base)
+	require.Nil(t, f.newController().syncHandler(getKey(unrendered, t)))
+	created := false
+	for _, action := range f.client.Actions() {
+		created = created || action.Matches("create", "machineconfigs")
+	}
+	assert.True(t, created)
+
+	// unpaused, the pending configs are rendered
+	mcp.Annotations[ctrlcommon.PauseRenderingAnnotationKey] = "false"
+	_, pool = sync(base, file)
+	require.NotNil(t, pool)
+	assert.NotEqual(t, current.Name, pool.Status.Configuration.Name, "the pool moves to the new config")
+	assert.Equal(t, int32(0), pool.Status.PendingSourceCount)
+	assert.True(t, mcfgv1.IsMachineConfigPoolConditionFalse(pool.Status.Conditions, mcfgv1.MachineConfigPoolRenderingPaused))
+}
+
+func TestConflictsGenerateRenderedMachineConfig(t *testing.T) {
+	mcp := newMachineConfigPool("test-cluster-worker", metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role", "worker"), "")
+	chrony := func(contents string) []ignv2_2types.File {
+		return []ignv2_2types.File{{
+			Node:          ignv2_2types.Node{Path: "/etc/chrony.conf"},
+			FileEmbedded1: ignv2_2types.FileEmbedded1{Contents: ignv2_2types.FileContents{Source: "data:," + contents}},
+		}}
+	}
+	unit := func(contents, dropin string) []ignv2_2types.Unit {
+		return []ignv2_2types.Unit{{Name: "chronyd.service", Contents: contents, Dropins: []ignv2_2types.SystemdDropin{{Name: "10-opts.conf", Contents: dropin}}}}
+	}
+	base := newMachineConfig("00-test-cluster-worker", map[string]string{"node-role": "worker"}, "dummy://", chrony("server%20a"))
+	base.Spec.Config.Systemd.Units = unit("[Unit]", "[Service]")
+	same := newMachineConfig("50-worker-chrony", map[string]string{"node-role": "worker"}, "dummy://", chrony("server%20a"))
+	same.Spec.Config.Systemd.Units = unit("", "[Service]")
+	cc := newControllerConfig(ctrlcommon.ControllerConfigName)
+
+	_, err := generateRenderedMachineConfig(mcp, []*mcfgv1.MachineConfig{same, base}, cc, DefaultRenderedConfigSizeLimit)
+	require.Nil(t, err, "identical definitions merge")
+
+	other := newMachineConfig("50-worker-chrony", map[string]string{"node-role": "worker"}, "dummy://", chrony("server%20b"))
+	other.Spec.Config.Systemd.Units = unit("[Unit]\nAfter=network.target", "[Service]\nNice=1")
+	_, err = generateRenderedMachineConfig(mcp, []*mcfgv1.MachineConfig{other, base}, cc, DefaultRenderedConfigSizeLimit)
+	require.NotNil(t, err)
+	assert.Equal(t, `machine configs define conflicting contents: file "/etc/chrony.conf" (00-test-cluster-worker and 50-worker-chrony); `+
+		`unit "chronyd.service" (00-test-cluster-worker and 50-worker-chrony); dropin "10-opts.conf" of unit "chronyd.service" (00-test-cluster-worker and 50-worker-chrony)`, err.Error())
+
+	appended := newMachineConfig("50-worker-chrony", map[string]string{"node-role": "worker"}, "dummy://", chrony("server%20b"))
+	appended.Spec.Config.Storage.Files[0].Append = true
+	_, err = generateRenderedMachineConfig(mcp, []*mcfgv1.MachineConfig{appended, base}, cc, DefaultRenderedConfigSizeLimit)
+	require.Nil(t, err, "the files appended to aren't conflicts")
+
+	sync := func(configs ...*mcfgv1.MachineConfig) (*fixture, *mcfgv1.MachineConfigPool) {
+		f := newFixture(t)
+		f.ccLister = append(f.ccLister, cc)
+		f.mcpLister = append(f.mcpLister, mcp)
+		f.mcLister = append(f.mcLister, configs...)
+		f.objects = append(f.objects, mcp)
+		for _, config := range configs {
+			f.objects = append(f.objects, config)
+		}
+		c := f.newController()
+		require.Nil(t, c.syncHandler(getKey(mcp, t)))
+		var pool *mcfgv1.MachineConfigPool
+		for _, action := range filterInformerActions(f.client.Actions()) {
+			if a, ok := action.(core.UpdateAction); ok && action.Matches("update", "machineconfigpools") {
+				pool = a.GetObject().(*mcfgv1.MachineConfigPool)
+			}
+		}
+		return f, pool
+	}
+
+	f, pool := sync(base, other)
+	require.NotNil(t, pool)
+	cond := mcfgv1.GetMachineConfigPoolCondition(pool.Status, mcfgv1.MachineConfigPoolRenderDegraded)
+	require.NotNil(t, cond)
+	assert.Equal(t, corev1.ConditionTrue, cond.Status)
+	assert.Equal(t, "ConflictingConfigs", cond.Reason)
+	assert.Contains(t, cond.Message, `file "/etc/chrony.conf" (00-test-cluster-worker and 50-worker-chrony)`)
+	assert.Empty(t, pool.Status.Configuration.Name, "the pool isn't moved to a config")
+	for _, action := range f.client.Actions() {
+		assert.False(t, action.Matches("create", "machineconfigs"), "the config isn't rendered")
+	}
+
+	mcp.Status = pool.Status
+	_, pool = sync(base, same)
+	require.NotNil(t, pool)
+	assert.True(t, mcfgv1.IsMachineConfigPoolConditionFalse(pool.Status.Conditions, mcfgv1.MachineConfigPoolRenderDegraded))
+	assert.NotEmpty(t, pool.Status.Configuration.Name, "the pool moves to the config rendered once the conflict is resolved")
+}
+
+func TestKernelArgumentsGenerateRenderedMachineConfig(t *testing.T) {
+	mcp := newMachineConfigPool("test-cluster-worker", metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role", "worker"), "")
+	cc := newControllerConfig(ctrlcommon.ControllerConfigName)
+	config := func(name string, kargs []string, extensions ...string) *mcfgv1.MachineConfig {
+		mc := newMachineConfig(name, map[string]string{"node-role": "worker"}, "dummy://", nil)
+		mc.Spec.KernelArguments = kargs
+		mc.Spec.Extensions = extensions
+		return mc
+	}
+	base := config("00-test-cluster-worker", []string{"console=tty0", "mitigations=auto", "nosmt"}, "usbguard")
+	extra := config("50-worker-kargs", []string{"nosmt", "console=ttyS0,115200", "hugepagesz=1G", "hugepages=4", "hugepagesz=2M", "hugepages=512"}, "kerberos", "usbguard")
+
+	gmc, err := generateRenderedMachineConfig(mcp, []*mcfgv1.MachineConfig{extra, base}, cc, DefaultRenderedConfigSizeLimit)
+	require.Nil(t, err, "identical and repeatable arguments merge")
+	assert.Equal(t, []string{"console=tty0", "mitigations=auto", "nosmt", "console=ttyS0,115200", "hugepagesz=1G", "hugepages=4", "hugepagesz=2M", "hugepages=512"}, gmc.Spec.KernelArguments)
+	assert.Equal(t, []string{"usbguard", "kerberos"}, gmc.Spec.Extensions)
+	again, err := generateRenderedMachineConfig(mcp, []*mcfgv1.MachineConfig{base, extra}, cc, DefaultRenderedConfigSizeLimit)
+	require.Nil(t, err)
+	assert.Equal(t, gmc.Name, again.Name, "the arguments are merged in the order of the configs, whatever they are listed in")
+
+	_, err = generateRenderedMachineConfig(mcp, []*mcfgv1.MachineConfig{base, config("50-worker-mitigations", []string{"mitigations=off", "nosmt=force"})}, cc, DefaultRenderedConfigSizeLimit)
+	require.NotNil(t, err)
+	assert.Equal(t, `machine configs define conflicting contents: kernel argument "mitigations" (00-test-cluster-worker and 50-worker-mitigations); `+
+		`kernel argument "nosmt" (00-test-cluster-worker and 50-worker-mitigations)`, err.Error())
+}
+
+func TestInvalidGenerateRenderedMachineConfig(t *testing.T) {
+	mcp := newMachineConfigPool("test-cluster-worker", metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role", "worker"), "")
+	cc := newControllerConfig(ctrlcommon.ControllerConfigName)
+	motd := func(source string) []ignv2_2types.File {
+		return []ignv2_2types.File{{
+			Node:          ignv2_2types.Node{Path: "/etc/motd"},
+			FileEmbedded1: ignv2_2types.FileEmbedded1{Contents: ignv2_2types.FileContents{Source: source}},
+		}}
+	}
+	base := newMachineConfig("00-test-cluster-worker", map[string]string{"node-role": "worker"}, "dummy://", nil)
+	bad := newMachineConfig("50-worker-motd", map[string]string{"node-role": "worker"}, "dummy://", motd("data:,hello%zz"))
+	good := newMachineConfig("50-worker-motd", map[string]string{"node-role": "worker"}, "dummy://", motd("data:,hello"))
+
+	_, err := generateRenderedMachineConfig(mcp, []*mcfgv1.MachineConfig{base, bad}, cc, DefaultRenderedConfigSizeLimit)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "machine configs are invalid: 50-worker-motd (")
+
+	sha256 := "sha256-2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	verified := newMachineConfig("50-worker-motd", map[string]string{"node-role": "worker"}, "dummy://", motd("https://example.com/motd"))
+	verified.Spec.Config.Storage.Files[0].Contents.Verification.Hash = &sha256
+	_, err = generateRenderedMachineConfig(mcp, []*mcfgv1.MachineConfig{base, verified}, cc, DefaultRenderedConfigSizeLimit)
+	require.Nil(t, err, "the daemon supports sha256 hashes")
+
+	unverified := newMachineConfig("50-worker-motd", map[string]string{"node-role": "worker"}, "dummy://", motd("https://example.com/motd"))
+	unverified.Spec.Config.Storage.Files[0].Contents.Compression = "xz"
+	_, err = generateRenderedMachineConfig(mcp, []*mcfgv1.MachineConfig{base, unverified}, cc, DefaultRenderedConfigSizeLimit)
+	require.NotNil(t, err)
+	assert.Equal(t, "machine configs are invalid: 50-worker-motd (spec.config.storage.files[0].contents.verification.hash: required for remote contents, "+
+		`spec.config.storage.files[0].contents.compression: unsupported compression "xz", expected gzip)`, err.Error())
+
+	sync := func(configs ...*mcfgv1.MachineConfig) (*fixture, *mcfgv1.MachineConfigPool, *record.FakeRecorder) {
+		f := newFixture(t)
+		f.ccLister = append(f.ccLister, cc)
+		f.mcpLister = append(f.mcpLister, mcp)
+		f.mcLister = append(f.mcLister, configs...)
+		f.objects = append(f.objects, mcp)
+		for _, config := range configs {
+			f.objects = append(f.objects, config)
+		}
+		c := f.newController()
+		recorder := record.NewFakeRecorder(10)
+		c.eventRecorder = recorder
+		require.Nil(t, c.syncHandler(getKey(mcp, t)))
+		var pool *mcfgv1.MachineConfigPool
+		for _, action := range filterInformerActions(f.client.Actions()) {
+			if a, ok := action.(core.UpdateAction); ok && action.Matches("update", "machineconfigpools") {
+				pool = a.GetObject().(*mcfgv1.MachineConfigPool)
+			}
+		}
+		return f, pool, recorder
+	}
+
+	f, pool, recorder := sync(base, bad)
+	require.NotNil(t, pool)
+	cond := mcfgv1.GetMachineConfigPoolCondition(pool.Status, mcfgv1.MachineConfigPoolRenderDegraded)
+	require.NotNil(t, cond)
+	assert.Equal(t, corev1.ConditionTrue, cond.Status)
+	assert.Equal(t, "InvalidConfig", cond.Reason)
+	assert.Contains(t, cond.Message, "50-worker-motd (")
+	assert.NotContains(t, cond.Message, "00-test-cluster-worker")
+	assert.Empty(t, pool.Status.Configuration.Name, "the pool isn't moved to a config")
+	for _, action := range f.client.Actions() {
+		assert.False(t, action.Matches("create", "machineconfigs"), "the config isn't rendered")
+	}
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "Warning InvalidConfig machine configs are invalid: 50-worker-motd (")
+
+	mcp.Status = pool.Status
+	_, pool, _ = sync(base, good)
+	require.NotNil(t, pool)
+	assert.True(t, mcfgv1.IsMachineConfigPoolConditionFalse(pool.Status.Conditions, mcfgv1.MachineConfigPoolRenderDegraded))
+	assert.NotEmpty(t, pool.Status.Configuration.Name, "the pool moves to the config rendered once the source is fixed")
+}
+
+func TestGarbageCollectRenderedConfigs(t *testing.T) {
+	mcp := newMachineConfigPool("test-cluster-worker", metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role", "worker"), "rendered-test-cluster-worker-5")
+	mcp.Annotations = map[string]string{ctrlcommon.RenderedConfigHistoryAnnotationKey: "2"}
+	mcp.Status.MachineCount, mcp.Status.UpdatedMachineCount = 2, 2
+	mcfgv1.SetMachineConfigPoolCondition(&mcp.Status, *mcfgv1.NewMachineConfigPoolCondition(mcfgv1.MachineConfigPoolUpdated, corev1.ConditionTrue, "", ""))
+	other := newMachineConfigPool("test-cluster-infra", metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role", "infra"), "")
+
+	created := time.Now().Add(-time.Hour)
+	rendered := func(pool *mcfgv1.MachineConfigPool, name string) *mcfgv1.MachineConfig {
+		mc := newMachineConfig(name, nil, "dummy://", nil)
+		mc.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(pool, controllerKind)}
+		created = created.Add(time.Minute)
+		mc.CreationTimestamp = metav1.NewTime(created)
+		return mc
+	}
+	node := func(name, current, desired string) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{
+			daemonconsts.CurrentMachineConfigAnnotationKey: current,
+			daemonconsts.DesiredMachineConfigAnnotationKey: desired,
+		}}}
+	}
+
+	gc := func(pool *mcfgv1.MachineConfigPool) []string {
+		f := newFixture(t)
+		f.mcpLister = append(f.mcpLister, pool)
+		for i := 0; i < 6; i++ {
+			f.mcLister = append(f.mcLister, rendered(mcp, fmt.Sprintf("rendered-test-cluster-worker-%d", i)))
+		}
+		f.mcLister = append(f.mcLister,
+			rendered(other, "rendered-test-cluster-infra-0"),
+			newMachineConfig("00-test-cluster-worker", map[string]string{"node-role": "worker"}, "dummy://", nil))
+		// the node of another pool holds rendered-test-cluster-worker-1
+		f.nodes = append(f.nodes, node("node-0", "rendered-test-cluster-worker-0", "rendered-test-cluster-worker-5"), node("node-1", "rendered-test-cluster-infra-0", "rendered-test-cluster-worker-1"))
+		c := f.newController()
+		require.Nil(t, c.garbageCollectRenderedConfigs(pool))
+		var deleted []string
+		for _, action := range f.client.Actions() {
+			if a, ok := action.(core.DeleteAction); ok {
+				deleted = append(deleted, a.GetName())
+			}
+		}
+		return deleted
+	}
+	pruned := func() float64 {
+		var m dto.Metric
+		require.Nil(t, renderedConfigsPruned.WithLabelValues(mcp.Name).Write(&m))
+		return m.GetCounter().GetValue()
+	}
+
+	before := pruned()
+	assert.Equal(t, []string{"rendered-test-cluster-worker-3", "rendered-test-cluster-worker-2"}, gc(mcp),
+		"the 2 newest configs, the current one of the pool and those of the nodes are kept")
+	assert.Equal(t, before+2, pruned())
+
+	updating := mcp.DeepCopy()
+	updating.Status.UpdatedMachineCount = 1
+	assert.Empty(t, gc(updating), "nothing is deleted before all nodes are updated")
+
+	invalid := mcp.DeepCopy()
+	invalid.Annotations[ctrlcommon.RenderedConfigHistoryAnnotationKey] = "0"
+	assert.Empty(t, gc(invalid))
+
+	defaults := mcp.DeepCopy()
+	defaults.Annotations = nil
+	assert.Empty(t, gc(defaults), "10 configs are kept by default")
+}
+
+func TestRenderedConfigSources(t *testing.T) {
+	mcp := newMachineConfigPool("test-cluster-worker", metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role", "worker"), "")
+	base := newMachineConfig("00-worker", map[string]string{"node-role": "worker"}, "dummy://", []ignv2_2types.File{{Node: ignv2_2types.Node{Path: "/dummy/0"}}})
+	base.Generation = 3
+	foo := newMachineConfig("98-worker-foo", map[string]string{"node-role": "worker"}, "dummy://", []ignv2_2types.File{{Node: ignv2_2types.Node{Path: "/dummy/1"}}})
+	foo.Generation = 1
+	cc := newControllerConfig(ctrlcommon.ControllerConfigName)
+
+	current, err := generateRenderedMachineConfig(mcp, []*mcfgv1.MachineConfig{foo, base}, cc, DefaultRenderedConfigSizeLimit)
+	require.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf(`[{"name":"00-worker","uid":"%s","generation":3},{"name":"98-worker-foo","uid":"%s","generation":1}]`, base.UID, foo.UID),
+		current.Annotations[ctrlcommon.RenderedConfigSourcesAnnotationKey])
+	mcp.Status.Configuration.Name = current.Name
+	mcp.Status.Configuration.Source = newSource([]*mcfgv1.MachineConfig{base, foo})
+
+	changed := base.DeepCopy()
+	changed.Generation = 4
+	changed.Spec.Config.Storage.Files[0].Path = "/dummy/2"
+	chrony := newMachineConfig("99-worker-chrony", map[string]string{"node-role": "worker"}, "dummy://", []ignv2_2types.File{{Node: ignv2_2types.Node{Path: "/etc/chrony.conf"}}})
+	chrony.Generation = 1
+
+	f := newFixture(t)
+	f.ccLister = append(f.ccLister, cc)
+	f.mcpLister = append(f.mcpLister, mcp)
+	f.mcLister = append(f.mcLister, current, changed, chrony)
+	f.objects = append(f.objects, mcp, current, changed, chrony)
+	c := f.newController()
+	recorder := record.NewFakeRecorder(10)
+	c.eventRecorder = recorder
+	require.Nil(t, c.syncHandler(getKey(mcp, t)))
+
+	var pool *mcfgv1.MachineConfigPool
+	for _, action := range filterInformerActions(f.client.Actions()) {
+		if a, ok := action.(core.UpdateAction); ok && action.Matches("update", "machineconfigpools") {
+			pool = a.GetObject().(*mcfgv1.MachineConfigPool)
+		}
+	}
+	require.NotNil(t, pool)
+	assert.Equal(t, newSource([]*mcfgv1.MachineConfig{changed, chrony}), pool.Status.Configuration.Source)
+	require.Len(t, recorder.Events, 1)
+	assert.Equal(t, fmt.Sprintf("Normal RenderedConfigChanged Moving from %s to %s: added 99-worker-chrony, removed 98-worker-foo, 00-worker changed generation 3→4", current.Name, pool.Status.Configuration.Name), <-recorder.Events)
+}
+
+func TestSourcesDelta(t *testing.T) {
+	sources := []renderedConfigSource{{Name: "00-worker", UID: "a", Generation: 1}, {Name: "99-worker-ssh", UID: "b", Generation: 2}}
+	assert.Equal(t, "the sources are unchanged", sourcesDelta(sources, sources))
+	assert.Equal(t, "99-worker-ssh was recreated", sourcesDelta(sources, []renderedConfigSource{sources[0], {Name: "99-worker-ssh", UID: "c", Generation: 1}}))
+	// the configs rendered before the sources were recorded have no generation
+	assert.Equal(t, "added 99-worker-ssh", sourcesDelta([]renderedConfigSource{{Name: "00-worker"}}, sources))
+}
+
+func TestAdoptRenderedConfigs(t *testing.T) {
+	mcp := newMachineConfigPool("test-cluster-worker", metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role", "worker"), "")
+	other := newMachineConfigPool("test-cluster-worker-infra", metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role", "infra"), "")
+	hash := "0123456789abcdef0123456789abcdef"
+	orphan := newMachineConfig("rendered-test-cluster-worker-"+hash, nil, "dummy://", nil)
+	owned := newMachineConfig("rendered-test-cluster-worker-fedcba9876543210fedcba9876543210", nil, "dummy://", nil)
+	owned.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(mcp, controllerKind)}
+	otherPool := newMachineConfig("rendered-test-cluster-worker-infra-"+hash, nil, "dummy://", nil)
+	notRendered := newMachineConfig("rendered-test-cluster-worker-custom", nil, "dummy://", nil)
+
+	f := newFixture(t)
+	f.mcpLister = append(f.mcpLister, mcp, other)
+	f.mcLister = append(f.mcLister, orphan, owned, otherPool, notRendered)
+	f.objects = append(f.objects, mcp, other, orphan, owned, otherPool, notRendered)
+	c := f.newController()
+	require.Nil(t, c.adoptRenderedConfigs(mcp))
+
+	var updated []string
+	for _, action := range f.client.Actions() {
+		if a, ok := action.(core.UpdateAction); ok {
+			updated = append(updated, a.GetObject().(*mcfgv1.MachineConfig).Name)
+		}
+	}
+	assert.Equal(t, []string{orphan.Name}, updated, "only the rendered configs of the pool without a controller are adopted")
+	adopted, err := f.client.MachineconfigurationV1().MachineConfigs().Get(orphan.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.True(t, metav1.IsControlledBy(adopted, mcp))
+}
@@ -0,0 +1,155 @@
+package render
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/golang/glog"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/vincent-petithory/dataurl"
+)
+
+const (
+	// DefaultRenderedConfigSizeLimit is the size limit of the rendered
+	// configs by default, in bytes: etcd refuses the requests over 1.5MiB by
+	// default, the headroom is for their metadata to be updated.
+	DefaultRenderedConfigSizeLimit = 1 << 20
+
+	// largestFilesReported is how many of the largest files of a rendered
+	// config over the size limit are named
+	largestFilesReported = 3
+)
+
+// renderedConfigTooLargeError is the error of the rendered configs which are
+// over the size limit, even with their files compressed.
+type renderedConfigTooLargeError struct {
+	size  int
+	limit int
+	// largestFiles describes the largest files, with the configs setting
+	// them
+	largestFiles []string
+}
+
+func (e *renderedConfigTooLargeError) Error() string {
+	return fmt.Sprintf("rendered config is %d bytes, over the limit of %d bytes even with its files compressed, the largest files are %s",
+		e.size, e.limit, strings.Join(e.largestFiles, ", "))
+}
+
+// fitSizeLimit compresses the largest files of config, rendered from
+// configs, with gzip until it is no more than limit bytes serialized, a
+// limit of 0 meaning none. It returns whether files were compressed, and a
+// renderedConfigTooLargeError if config is still over the limit once they
+// all are. Only the files whose contents are uncompressed data URLs are
+// compressed: Ignition and the daemon decompress them, and their verification
+// hashes are over the decompressed contents.
+func fitSizeLimit(config *mcfgv1.MachineConfig, configs []*mcfgv1.MachineConfig, limit int) (bool, error) {
+	if limit <= 0 {
+		return false, nil
+	}
+	size, err := serializedSize(config)
+	if err != nil || size <= limit {
+		return false, err
+	}
+	// the files may still be shared with the merged configs
+	files := make([]ignv2_2types.File, len(config.Spec.Config.Storage.Files))
+	copy(files, config.Spec.Config.Storage.Files)
+	config.Spec.Config.Storage.Files = files
+	var candidates []int
+	for i, f := range files {
+		if f.Contents.Compression == "" && strings.HasPrefix(f.Contents.Source, "data:") {
+			candidates = append(candidates, i)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return len(files[candidates[i]].Contents.Source) > len(files[candidates[j]].Contents.Source)
+	})
+	compressed := false
+	for _, i := range candidates {
+		contents, err := dataurl.DecodeString(files[i].Contents.Source)
+		if err != nil {
+			// reported by the validation of the config
+			continue
+		}
+		data, err := gzipContents(contents.Data)
+		if err != nil {
+			return compressed, err
+		}
+		source := dataurl.EncodeBytes(data)
+		if len(source) >= len(files[i].Contents.Source) {
+			continue
+		}
+		glog.V(2).Infof("Compressing %s for the rendered config to fit under %d bytes: %d to %d bytes", files[i].Path, limit, len(files[i].Contents.Source), len(source))
+		files[i].Contents.Source = source
+		files[i].Contents.Compression = "gzip"
+		compressed = true
+		if size, err = serializedSize(config); err != nil || size <= limit {
+			return compressed, err
+		}
+	}
+	return compressed, &renderedConfigTooLargeError{size: size, limit: limit, largestFiles: largestFiles(config, configs)}
+}
+
+// serializedSize returns the size of config as stored.
+func serializedSize(config *mcfgv1.MachineConfig) (int, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// gzipContents compresses the contents of a file.
+func gzipContents(contents []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := gz.Write(contents); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// largestFiles describes the largest files of config, rendered from configs,
+// by the size of their contents in it, with the configs setting them.
+func largestFiles(config *mcfgv1.MachineConfig, configs []*mcfgv1.MachineConfig) []string {
+	files := make([]int, len(config.Spec.Config.Storage.Files))
+	for i := range files {
+		files[i] = i
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return len(config.Spec.Config.Storage.Files[files[i]].Contents.Source) > len(config.Spec.Config.Storage.Files[files[j]].Contents.Source)
+	})
+	var described []string
+	seen := make(map[string]bool)
+	for _, i := range files {
+		if len(described) == largestFilesReported {
+			break
+		}
+		f := config.Spec.Config.Storage.Files[i]
+		if seen[f.Path] {
+			continue
+		}
+		seen[f.Path] = true
+		var setBy []string
+		for _, source := range configs {
+			for _, sf := range source.Spec.Config.Storage.Files {
+				if sf.Path == f.Path {
+					setBy = append(setBy, source.Name)
+					break
+				}
+			}
+		}
+		described = append(described, fmt.Sprintf("%s (%d bytes, set by %s)", f.Path, len(f.Contents.Source), strings.Join(setBy, ", ")))
+	}
+	return described
+}
@@ -0,0 +1,108 @@
+package render
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vincent-petithory/dataurl"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestRenderedConfigSizeLimit(t *testing.T) {
+	const limit = 64 << 10
+	mcp := newMachineConfigPool("test-cluster-worker", metav1.AddLabelToSelector(&metav1.LabelSelector{}, "node-role", "worker"), "")
+	cc := newControllerConfig(ctrlcommon.ControllerConfigName)
+	bundle := func(contents []byte) []ignv2_2types.File {
+		return []ignv2_2types.File{{
+			Node:          ignv2_2types.Node{Path: "/etc/pki/ca-trust/source/anchors/bundle.crt"},
+			FileEmbedded1: ignv2_2types.FileEmbedded1{Contents: ignv2_2types.FileContents{Source: dataurl.EncodeBytes(contents)}},
+		}}
+	}
+	base := newMachineConfig("00-test-cluster-worker", map[string]string{"node-role": "worker"}, "dummy://", nil)
+	pem := []byte(strings.Repeat("MIIDdzCCAl+gAwIBAgIEAgAAuTANBgkqhkiG9w0BAQUFADBaMQswCQYDVQQGEwJJ\n", 2000))
+	compressible := newMachineConfig("99-worker-ca", map[string]string{"node-role": "worker"}, "dummy://", bundle(pem))
+	random := make([]byte, 128<<10)
+	_, err := rand.Read(random)
+	require.Nil(t, err)
+	incompressible := newMachineConfig("99-worker-ca", map[string]string{"node-role": "worker"}, "dummy://", bundle(random))
+
+	uncompressed, err := generateRenderedMachineConfig(mcp, []*mcfgv1.MachineConfig{base, compressible}, cc, 0)
+	require.Nil(t, err)
+	assert.Empty(t, uncompressed.Spec.Config.Storage.Files[0].Contents.Compression, "no limit")
+
+	gmc, err := generateRenderedMachineConfig(mcp, []*mcfgv1.MachineConfig{base, compressible}, cc, limit)
+	require.Nil(t, err)
+	f := gmc.Spec.Config.Storage.Files[0]
+	assert.Equal(t, "gzip", f.Contents.Compression)
+	contents, err := dataurl.DecodeString(f.Contents.Source)
+	require.Nil(t, err)
+	gz, err := gzip.NewReader(bytes.NewReader(contents.Data))
+	require.Nil(t, err)
+	decompressed, err := ioutil.ReadAll(gz)
+	require.Nil(t, err)
+	assert.Equal(t, pem, decompressed)
+	size, err := serializedSize(gmc)
+	require.Nil(t, err)
+	assert.True(t, size <= limit, "expected the rendered config to fit under %d bytes, got %d", limit, size)
+	assert.NotEqual(t, uncompressed.Name, gmc.Name, "the config is named after the compressed contents")
+	assert.Empty(t, compressible.Spec.Config.Storage.Files[0].Contents.Compression, "the source config is left as it is")
+	again, err := generateRenderedMachineConfig(mcp, []*mcfgv1.MachineConfig{base, compressible}, cc, limit)
+	require.Nil(t, err)
+	assert.Equal(t, gmc, again, "the compression is deterministic")
+
+	// the hashes are over the decompressed contents
+	sum := sha512.Sum512(pem)
+	hash := "sha512-" + hex.EncodeToString(sum[:])
+	hashed := compressible.DeepCopy()
+	hashed.Spec.Config.Storage.Files[0].Contents.Verification.Hash = &hash
+	gmc, err = generateRenderedMachineConfig(mcp, []*mcfgv1.MachineConfig{base, hashed}, cc, limit)
+	require.Nil(t, err)
+	assert.Equal(t, "gzip", gmc.Spec.Config.Storage.Files[0].Contents.Compression)
+	assert.Equal(t, &hash, gmc.Spec.Config.Storage.Files[0].Contents.Verification.Hash)
+
+	_, err = generateRenderedMachineConfig(mcp, []*mcfgv1.MachineConfig{base, incompressible}, cc, limit)
+	require.NotNil(t, err)
+	require.IsType(t, &renderedConfigTooLargeError{}, err)
+	assert.Contains(t, err.Error(), "over the limit of 65536 bytes even with its files compressed, the largest files are /etc/pki/ca-trust/source/anchors/bundle.crt (")
+	assert.Contains(t, err.Error(), "bytes, set by 99-worker-ca)")
+
+	fixture := newFixture(t)
+	fixture.ccLister = append(fixture.ccLister, cc)
+	fixture.mcpLister = append(fixture.mcpLister, mcp)
+	fixture.mcLister = append(fixture.mcLister, base, incompressible)
+	fixture.objects = append(fixture.objects, mcp, base, incompressible)
+	c := fixture.newController()
+	c.renderedConfigSizeLimit = limit
+	recorder := record.NewFakeRecorder(10)
+	c.eventRecorder = recorder
+	require.Nil(t, c.syncHandler(getKey(mcp, t)))
+	var pool *mcfgv1.MachineConfigPool
+	for _, action := range filterInformerActions(fixture.client.Actions()) {
+		assert.False(t, action.Matches("create", "machineconfigs"), "the config isn't rendered")
+		if a, ok := action.(core.UpdateAction); ok && action.Matches("update", "machineconfigpools") {
+			pool = a.GetObject().(*mcfgv1.MachineConfigPool)
+		}
+	}
+	require.NotNil(t, pool)
+	cond := mcfgv1.GetMachineConfigPoolCondition(pool.Status, mcfgv1.MachineConfigPoolRenderDegraded)
+	require.NotNil(t, cond)
+	assert.Equal(t, corev1.ConditionTrue, cond.Status)
+	assert.Equal(t, "RenderedConfigTooLarge", cond.Reason)
+	assert.Contains(t, cond.Message, "set by 99-worker-ca")
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "Warning RenderedConfigTooLarge rendered config is ")
+}
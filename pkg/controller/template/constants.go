@@ -12,4 +12,7 @@ const (
 
 	// KubeClientAgentImageKey is the key that references the kube-client-agent image in the controller
 	KubeClientAgentImageKey string = "kubeClientAgentImage"
+
+	// MachineConfigDaemonImageKey is the key that references the machine-config-daemon image in the controller for its firstboot service
+	MachineConfigDaemonImageKey string = "machineConfigDaemon"
 )
@@ -0,0 +1,82 @@
+package daemon
+
+import (
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/pkg/errors"
+	"github.com/vincent-petithory/dataurl"
+)
+
+// appendedPaths returns the paths files append to.
+func appendedPaths(files []ignv2_2types.File) map[string]bool {
+	paths := make(map[string]bool)
+	for _, f := range files {
+		if f.Append {
+			paths[f.Path] = true
+		}
+	}
+	return paths
+}
+
+// assembleFile returns the file at path as Ignition would leave it once done
+// with files, which append to it: the contents of the last entry for path
+// which doesn't append, the base, empty if there is none, followed by the
+// contents of the entries appending after it, in order. The mode and owner
+// are those of the last entry. The contents of each entry are verified
+// against its hash, the assembled file has none.
+//
+// The file is assembled from the config alone, rather than appended to on
+// disk, so that writing it again doesn't append the fragments twice.
+func assembleFile(files []ignv2_2types.File, path string) (ignv2_2types.File, error) {
+	var assembled ignv2_2types.File
+	var contents []byte
+	for _, f := range files {
+		if f.Path != path {
+			continue
+		}
+		fragment, err := decodeFileContents(f)
+		if err != nil {
+			return assembled, errors.Wrapf(err, "decoding contents of %s", path)
+		}
+		if err := verifyFileHash(path, f.Contents.Verification, fragment); err != nil {
+			return assembled, err
+		}
+		if !f.Append {
+			contents = nil
+		}
+		contents = append(contents, fragment...)
+		assembled = f
+	}
+	assembled.Append = false
+	assembled.Contents = ignv2_2types.FileContents{Source: dataurl.EncodeBytes(contents)}
+	return assembled, nil
+}
+
+// assembleFiles returns files with the entries of each path appended to
+// replaced by the file assembleFile makes of them, in place of the last one.
+// The other entries are left as they are.
+func assembleFiles(files []ignv2_2types.File) ([]ignv2_2types.File, error) {
+	appended := appendedPaths(files)
+	if len(appended) == 0 {
+		return files, nil
+	}
+	last := make(map[string]int)
+	for i, f := range files {
+		last[f.Path] = i
+	}
+	var out []ignv2_2types.File
+	for i, f := range files {
+		if !appended[f.Path] {
+			out = append(out, f)
+			continue
+		}
+		if last[f.Path] != i {
+			continue
+		}
+		assembled, err := assembleFile(files, f.Path)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, assembled)
+	}
+	return out, nil
+}
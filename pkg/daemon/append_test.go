@@ -0,0 +1,54 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAppend(path, contents string) ignv2_2types.File {
+	f := newTestFile(path, contents)
+	f.Append = true
+	return f
+}
+
+func TestWriteFilesAppends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "append")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dn := &Daemon{
+		ownedFilesPath:   filepath.Join(dir, "owned-files.json"),
+		originalFilesDir: filepath.Join(dir, "orig"),
+	}
+	motd := filepath.Join(dir, "etc/motd")
+	hosts := filepath.Join(dir, "etc/hosts")
+	files := []ignv2_2types.File{
+		newTestAppend(motd, "a\n"),
+		newTestFile(hosts, "127.0.0.1 localhost\n"),
+		newTestAppend(motd, "b\n"),
+		newTestFile(hosts, "::1 localhost\n"),
+		newTestAppend(hosts, "10.0.0.1 api\n"),
+	}
+
+	for i := 0; i < 2; i++ {
+		require.Nil(t, dn.writeFiles(files))
+		b, err := ioutil.ReadFile(motd)
+		require.Nil(t, err)
+		assert.Equal(t, "a\nb\n", string(b), "the fragments are written once, in order")
+		b, err = ioutil.ReadFile(hosts)
+		require.Nil(t, err)
+		assert.Equal(t, "::1 localhost\n10.0.0.1 api\n", string(b), "the fragments are appended to the last contents")
+	}
+	assert.Empty(t, checkFiles(files))
+
+	require.Nil(t, ioutil.WriteFile(motd, []byte("a\nb\nb\n"), 0644))
+	assert.Equal(t, []string{motd + " (contents)"}, checkFiles(files))
+
+	files[0].Contents.Source = "data:invalid"
+	assert.Equal(t, []string{motd + " (invalid contents in config)"}, checkFiles(files))
+}
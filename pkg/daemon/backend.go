@@ -0,0 +1,189 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// backendOSTree updates RHCOS and other rpm-ostree based hosts
+	backendOSTree = "ostree"
+	// backendPackages updates traditional, yum or dnf based, RHEL and CentOS
+	// hosts
+	backendPackages = "packages"
+
+	// pathOSTreeBooted exists on hosts booted into an ostree deployment
+	pathOSTreeBooted = "/run/ostree-booted"
+	// pathRpmOstree is the rpm-ostree binary
+	pathRpmOstree = "/usr/bin/rpm-ostree"
+)
+
+// updateBackend applies the parts of a config which depend on how the host
+// is installed: its OS image, kernel, kernel arguments and extensions. Files,
+// units and users are written the same way on every host.
+type updateBackend interface {
+	// name names the backend in logs and in the reconcile errors of the
+	// changes it rejects
+	name() string
+	// reconcilable records in diff the changes from oldConfig to newConfig
+	// the backend can't apply
+	reconcilable(diff *configDiffer, oldConfig, newConfig *mcfgv1.MachineConfig)
+	// managesOSImage returns whether the osImageURL of configs is applied
+	managesOSImage() bool
+	// updateOS stages osImageURL for the next boot, reporting the lines of
+	// progress to progress
+	updateOS(osImageURL string, progress func(string)) error
+	// cleanupPendingDeployment drops what was staged for the next boot
+	cleanupPendingDeployment() error
+	// updateKernelArguments adds and removes kernel arguments for the next
+	// boot
+	updateKernelArguments(added, removed []string) error
+	// switchKernel switches the next boot to the realtime kernel, or back to
+	// the default one
+	switchKernel(realtime bool) error
+	// updateExtensions installs and uninstalls the packages of extensions
+	updateExtensions(osImageURL string, install, uninstall []string) error
+}
+
+// detectUpdateBackend returns the backend updating a host running
+// operatingSystem, with its root at rootMount: the ostree backend on RHCOS
+// and on hosts booted from an ostree deployment with rpm-ostree available,
+// the packages backend otherwise.
+func detectUpdateBackend(operatingSystem, rootMount string, client NodeUpdaterClient) updateBackend {
+	if operatingSystem == machineConfigDaemonOSRHCOS || (fileExists(filepath.Join(rootMount, pathOSTreeBooted)) && fileExists(filepath.Join(rootMount, pathRpmOstree))) {
+		return &ostreeBackend{client: client}
+	}
+	return &packagesBackend{}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// updater returns the update backend of the daemon. Daemons not built by New
+// get the one of their OperatingSystem.
+func (dn *Daemon) updater() updateBackend {
+	if dn.backend != nil {
+		return dn.backend
+	}
+	switch dn.OperatingSystem {
+	case machineConfigDaemonOSRHEL, machineConfigDaemonOSCENTOS:
+		return &packagesBackend{}
+	default:
+		return &ostreeBackend{client: dn.NodeUpdaterClient}
+	}
+}
+
+// ostreeBackend applies configs through rpm-ostree, to the deployment booted
+// next.
+type ostreeBackend struct {
+	client NodeUpdaterClient
+}
+
+func (b *ostreeBackend) name() string {
+	return backendOSTree
+}
+
+// reconcilable rejects nothing, the ostree backend applies every change the
+// daemon supports.
+func (b *ostreeBackend) reconcilable(diff *configDiffer, oldConfig, newConfig *mcfgv1.MachineConfig) {
+}
+
+func (b *ostreeBackend) managesOSImage() bool {
+	return true
+}
+
+func (b *ostreeBackend) updateOS(osImageURL string, progress func(string)) error {
+	return b.client.RunPivot(osImageURL, progress)
+}
+
+func (b *ostreeBackend) cleanupPendingDeployment() error {
+	return b.client.CleanupPendingDeployment()
+}
+
+func (b *ostreeBackend) updateKernelArguments(added, removed []string) error {
+	return b.client.UpdateKernelArguments(added, removed)
+}
+
+func (b *ostreeBackend) switchKernel(realtime bool) error {
+	return b.client.SwitchKernel(realtime)
+}
+
+func (b *ostreeBackend) updateExtensions(osImageURL string, install, uninstall []string) error {
+	return b.client.UpdateExtensions(osImageURL, install, uninstall)
+}
+
+// packagesBackend applies configs to traditional RHEL and CentOS hosts, whose
+// packages are managed with yum or dnf, outside of the daemon. Kernel
+// arguments are set on every installed kernel with grubby; the OS image of
+// configs is ignored, and kernel and extension changes are rejected.
+type packagesBackend struct{}
+
+func (b *packagesBackend) name() string {
+	return backendPackages
+}
+
+func (b *packagesBackend) reconcilable(diff *configDiffer, oldConfig, newConfig *mcfgv1.MachineConfig) {
+	if oldType, newType := kernelType(oldConfig), kernelType(newConfig); oldType != newType {
+		diff.add("spec.kernelType", fieldUnsupported, fmt.Sprintf("%s -> %s: the %s update backend can't switch kernels", oldType, newType, b.name()))
+	}
+	if install, uninstall := diffExtensions(oldConfig.Spec.Extensions, newConfig.Spec.Extensions); len(install) > 0 || len(uninstall) > 0 {
+		diff.add("spec.extensions", fieldUnsupported, fmt.Sprintf("the %s update backend can't install extensions", b.name()))
+	}
+}
+
+func (b *packagesBackend) managesOSImage() bool {
+	return false
+}
+
+func (b *packagesBackend) updateOS(osImageURL string, progress func(string)) error {
+	return fmt.Errorf("the %s update backend can't update the OS image", b.name())
+}
+
+// cleanupPendingDeployment has nothing to drop, as the OS isn't staged.
+func (b *packagesBackend) cleanupPendingDeployment() error {
+	return nil
+}
+
+func (b *packagesBackend) updateKernelArguments(added, removed []string) error {
+	args := []string{"--update-kernel=ALL"}
+	if len(added) > 0 {
+		args = append(args, "--args="+strings.Join(added, " "))
+	}
+	if len(removed) > 0 {
+		args = append(args, "--remove-args="+strings.Join(removed, " "))
+	}
+	if _, err := RunGetOut("grubby", args...); err != nil {
+		return fmt.Errorf("failed to update kernel arguments: %v", err)
+	}
+	return nil
+}
+
+func (b *packagesBackend) switchKernel(realtime bool) error {
+	return fmt.Errorf("the %s update backend can't switch kernels", b.name())
+}
+
+func (b *packagesBackend) updateExtensions(osImageURL string, install, uninstall []string) error {
+	return fmt.Errorf("the %s update backend can't install extensions", b.name())
+}
+
+// warnIgnoredOSImage emits a Warning event when newConfig changes the OS
+// image of oldConfig on a node whose backend doesn't apply it. The rest of
+// the update goes on, the OS is left to the packages of the host.
+func (dn *Daemon) warnIgnoredOSImage(oldConfig, newConfig *mcfgv1.MachineConfig) {
+	if dn.updater().managesOSImage() || oldConfig.Spec.OSImageURL == newConfig.Spec.OSImageURL {
+		return
+	}
+	glog.Warningf("Ignoring the change of osImageURL to %s, the %s update backend doesn't update the OS image", newConfig.Spec.OSImageURL, dn.updater().name())
+	if dn.recorder != nil && dn.node != nil {
+		dn.recorder.Eventf(getNodeRef(dn.node), corev1.EventTypeWarning, "OSImageURLIgnored",
+			"Update to %s: osImageURL %s ignored, the %s update backend doesn't update the OS image", newConfig.GetName(), newConfig.Spec.OSImageURL, dn.updater().name())
+	}
+}
@@ -0,0 +1,77 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestDetectUpdateBackend(t *testing.T) {
+	rootMount, err := ioutil.TempDir("", "backend")
+	require.Nil(t, err)
+	defer os.RemoveAll(rootMount)
+
+	assert.Equal(t, backendOSTree, detectUpdateBackend(machineConfigDaemonOSRHCOS, rootMount, nil).name())
+	assert.Equal(t, backendPackages, detectUpdateBackend(machineConfigDaemonOSRHEL, rootMount, nil).name())
+
+	touch := func(path string) {
+		require.Nil(t, os.MkdirAll(filepath.Join(rootMount, filepath.Dir(path)), 0755))
+		require.Nil(t, ioutil.WriteFile(filepath.Join(rootMount, path), nil, 0644))
+	}
+	// rpm-ostree alone doesn't make a host an ostree one
+	touch(pathRpmOstree)
+	assert.Equal(t, backendPackages, detectUpdateBackend(machineConfigDaemonOSCENTOS, rootMount, nil).name())
+	touch(pathOSTreeBooted)
+	assert.Equal(t, backendOSTree, detectUpdateBackend(machineConfigDaemonOSCENTOS, rootMount, nil).name())
+}
+
+func TestReconcilablePackagesBackend(t *testing.T) {
+	d := Daemon{OperatingSystem: machineConfigDaemonOSRHEL}
+	oldConfig := newTestMachineConfig("old", nil, nil)
+	newConfig := newTestMachineConfig("new", nil, nil)
+
+	newConfig.Spec.OSImageURL = "quay.io/openshift/rhcos@sha256:new"
+	newConfig.Spec.KernelArguments = []string{"nosmt"}
+	assert.Nil(t, d.reconcilable(oldConfig, newConfig), "OS image and kernel arguments changes are reconcilable")
+
+	newConfig.Spec.KernelType = mcfgv1.KernelTypeRealtime
+	newConfig.Spec.Extensions = []string{"usbguard"}
+	err := d.reconcilable(oldConfig, newConfig)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "spec.kernelType (default -> realtime: the packages update backend can't switch kernels)")
+	assert.Contains(t, err.Error(), "spec.extensions (the packages update backend can't install extensions)")
+
+	d.OperatingSystem = machineConfigDaemonOSRHCOS
+	assert.Nil(t, d.reconcilable(oldConfig, newConfig), "the ostree backend switches kernels and installs extensions")
+}
+
+func TestWarnIgnoredOSImage(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	d := Daemon{
+		OperatingSystem: machineConfigDaemonOSRHEL,
+		recorder:        recorder,
+		node:            newTestNode("node", nil),
+	}
+	oldConfig := newTestMachineConfig("old", nil, nil)
+	newConfig := newTestMachineConfig("new", nil, nil)
+
+	d.warnIgnoredOSImage(oldConfig, newConfig)
+	assert.Len(t, recorder.Events, 0, "no event without an OS image change")
+
+	newConfig.Spec.OSImageURL = "quay.io/openshift/rhcos@sha256:new"
+	d.warnIgnoredOSImage(oldConfig, newConfig)
+	require.Len(t, recorder.Events, 1)
+	event := <-recorder.Events
+	assert.True(t, strings.HasPrefix(event, "Warning OSImageURLIgnored Update to new: osImageURL quay.io/openshift/rhcos@sha256:new ignored"), event)
+
+	d.OperatingSystem = machineConfigDaemonOSRHCOS
+	d.warnIgnoredOSImage(oldConfig, newConfig)
+	assert.Len(t, recorder.Events, 0, "the ostree backend applies the OS image")
+}
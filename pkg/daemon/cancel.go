@@ -0,0 +1,83 @@
+package daemon
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// updateCanceledError is returned by an update whose config isn't the desired
+// config of the node anymore, like when the MachineConfig it added is deleted
+// while the node drains. The update is rolled back like a failed one, then
+// completeCanceledUpdate marks the node done with the config it updated from.
+type updateCanceledError struct {
+	// phase is the phase the update was canceled in
+	phase  string
+	reason string
+}
+
+func (e *updateCanceledError) Error() string {
+	return fmt.Sprintf("update canceled in phase %s: %s", e.phase, e.reason)
+}
+
+// updateCancelable returns whether an update in phase can still be canceled.
+// They can as long as it could be rolled back, in the phases journal recovery
+// rolls back; once the reboot is requested there is no return.
+func updateCancelable(phase string) bool {
+	return journalRecoveryFor(&updateJournal{Phase: phase}, "") == journalRollBack
+}
+
+// checkUpdateCanceled returns an updateCanceledError when the update to
+// newConfig, in phase, is canceled: the desired config of the node, as the
+// API server has it, isn't newConfig anymore. The update goes on when the
+// node can't be read.
+func (dn *Daemon) checkUpdateCanceled(phase string, newConfig *mcfgv1.MachineConfig) error {
+	if dn.onceFrom != "" || dn.kubeClient == nil || !updateCancelable(phase) {
+		return nil
+	}
+	node, err := dn.kubeClient.CoreV1().Nodes().Get(dn.name, metav1.GetOptions{})
+	if err != nil {
+		glog.Warningf("Unable to get node to check its desired config: %v", err)
+		return nil
+	}
+	desired := node.Annotations[constants.DesiredMachineConfigAnnotationKey]
+	if desired == "" || desired == newConfig.GetName() {
+		return nil
+	}
+	if desired == node.Annotations[constants.CurrentMachineConfigAnnotationKey] {
+		return &updateCanceledError{phase: phase, reason: fmt.Sprintf("desired config reverted to the current config %s", desired)}
+	}
+	return &updateCanceledError{phase: phase, reason: fmt.Sprintf("desired config changed to %s", desired)}
+}
+
+// completeCanceledUpdate makes the node done with oldConfig again, once the
+// update to newConfig canceled by canceled was rolled back: the OS staged is
+// discarded, the node uncordoned and its updating taint removed. The new
+// desired config, if any, is applied by the next sync.
+func (dn *Daemon) completeCanceledUpdate(oldConfig, newConfig *mcfgv1.MachineConfig, canceled *updateCanceledError) error {
+	if (&updateJournal{Phase: canceled.phase}).phaseReached(updatePhaseUpdatingOS) {
+		if err := dn.updater().cleanupPendingDeployment(); err != nil {
+			return fmt.Errorf("failed to discard the OS staged for %s: %v", newConfig.GetName(), err)
+		}
+	}
+	ctx, cancel := nodeWriterContext()
+	defer cancel()
+	if err := dn.nodeWriter.SetUnschedulable(ctx, false, nil); err != nil {
+		return err
+	}
+	if err := dn.nodeWriter.RemoveUpdatingTaint(ctx); err != nil {
+		return err
+	}
+	if err := dn.nodeWriter.SetDone(ctx, oldConfig.GetName()); err != nil {
+		return err
+	}
+	dn.logSystem("Canceled the update from %s to %s: %v", oldConfig.GetName(), newConfig.GetName(), canceled)
+	if dn.recorder != nil && dn.node != nil {
+		dn.recorder.Eventf(getNodeRef(dn.node), corev1.EventTypeNormal, "UpdateCanceled", "Canceled the update to %s in phase %s: %s", newConfig.GetName(), canceled.phase, canceled.reason)
+	}
+	return nil
+}
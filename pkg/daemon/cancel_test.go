@@ -0,0 +1,115 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+)
+
+func TestUpdateCancelable(t *testing.T) {
+	for _, phase := range updatePhases {
+		assert.Equal(t, phase != updatePhaseRebooting, updateCancelable(phase), "phase %s", phase)
+	}
+}
+
+func TestCheckUpdateCanceled(t *testing.T) {
+	newConfig := newTestMachineConfig("rendered-new", nil, nil)
+	for _, test := range []struct {
+		desired string
+		phase   string
+		reason  string
+	}{
+		{"rendered-new", updatePhaseDraining, ""},
+		{"rendered-old", updatePhaseUpdatingFiles, "desired config reverted to the current config rendered-old"},
+		{"rendered-old", updatePhaseDraining, "desired config reverted to the current config rendered-old"},
+		{"rendered-newer", updatePhaseDraining, "desired config changed to rendered-newer"},
+		// past the point of no return
+		{"rendered-old", updatePhaseRebooting, ""},
+	} {
+		node := newTestNode("node-0", map[string]string{
+			constants.CurrentMachineConfigAnnotationKey: "rendered-old",
+			constants.DesiredMachineConfigAnnotationKey: test.desired,
+		})
+		dn := &Daemon{name: "node-0", kubeClient: k8sfake.NewSimpleClientset(node)}
+		err := dn.checkUpdateCanceled(test.phase, newConfig)
+		if test.reason == "" {
+			assert.Nil(t, err, "desired %s in phase %s", test.desired, test.phase)
+			continue
+		}
+		require.IsType(t, &updateCanceledError{}, err)
+		assert.Equal(t, &updateCanceledError{phase: test.phase, reason: test.reason}, err)
+	}
+}
+
+func TestUpdateCanceledAfterWritingFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-cancel")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	oldConfig, newConfig := newJournalTestConfigs(root)
+	require.Nil(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+	for name, contents := range map[string]string{"changed.conf": "old", "removed.conf": "removed"} {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(root, "etc", name), []byte(contents), defaultFilePermissions))
+	}
+
+	node := newTestNode("node-0", map[string]string{
+		constants.CurrentMachineConfigAnnotationKey:     "old",
+		constants.DesiredMachineConfigAnnotationKey:     "new",
+		constants.MachineConfigDaemonStateAnnotationKey: constants.MachineConfigDaemonStateDegraded,
+	})
+	node.Spec.Unschedulable = true
+	client := k8sfake.NewSimpleClientset(node)
+	// the desired config reverts once the files are written
+	reverted := node.DeepCopy()
+	reverted.Annotations[constants.DesiredMachineConfigAnnotationKey] = "old"
+	updating := true
+	client.PrependReactor("get", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		if _, err := os.Stat(filepath.Join(root, "etc/added.conf")); err != nil || !updating {
+			return false, nil, nil
+		}
+		return true, reverted, nil
+	})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), newTestNodeLister(t, node), node.Name)
+	go nw.Run(stopCh)
+
+	var sshKeys string
+	dn := newJournalTestDaemon(t, dir, "boot-1", RpmOstreeClientMock{}, &sshKeys, oldConfig, newConfig)
+	dn.name, dn.node, dn.kubeClient, dn.nodeWriter = "node-0", node, client, nw
+	dn.historyPath = filepath.Join(dir, "history.json")
+
+	require.Nil(t, dn.update(oldConfig, newConfig), "a canceled update completes")
+	updating = false
+	assert.Equal(t, map[string]string{"changed.conf": "old", "removed.conf": "removed"}, readTestFiles(t, root), "the files are rolled back")
+	assert.Equal(t, "", sshKeys, "the users aren't updated")
+	_, err = os.Stat(dn.journalPath)
+	assert.True(t, os.IsNotExist(err), "journal was not removed")
+	history, err := dn.loadUpdateHistory()
+	require.Nil(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, historyCanceled, history[0].Outcome)
+	assert.Equal(t, "new", history[0].NewConfig)
+
+	var patches []string
+	for _, a := range client.Actions() {
+		if p, ok := a.(core.PatchAction); ok {
+			patches = append(patches, string(p.GetPatch()))
+		}
+	}
+	assert.Contains(t, patches, `{"spec":{"unschedulable":null}}`, "the node is uncordoned")
+	updated, err := client.CoreV1().Nodes().Get("node-0", metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, constants.MachineConfigDaemonStateDone, updated.Annotations[constants.MachineConfigDaemonStateAnnotationKey])
+	assert.Equal(t, "old", updated.Annotations[constants.CurrentMachineConfigAnnotationKey])
+}
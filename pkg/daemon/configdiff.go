@@ -0,0 +1,232 @@
+package daemon
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// reconcileProblem is why a changed field keeps an update from being applied
+// in place.
+type reconcileProblem string
+
+const (
+	// fieldUnsupported is for fields the daemon never changes on a running
+	// node
+	fieldUnsupported reconcileProblem = "not supported for day-2 changes"
+	// fieldInvalid is for fields the daemon does change, but not the way the
+	// new config does
+	fieldInvalid reconcileProblem = "changed in a way that can't be applied"
+
+	// maxDiffValueLength bounds the values shown in a fieldDiff
+	maxDiffValueLength = 64
+)
+
+// sensitiveDiffFields are the fields whose values are never shown in a
+// fieldDiff, as they may hold secrets or whole file contents.
+var sensitiveDiffFields = map[string]bool{
+	"passwordHash":      true,
+	"sshAuthorizedKeys": true,
+	"source":            true,
+	"contents":          true,
+	"hash":              true,
+}
+
+// fieldDiff is a field of the new config which can't be applied in place.
+type fieldDiff struct {
+	// Path is the JSON path of the field in the MachineConfig, like
+	// spec.config.storage.disks[0].device.
+	Path string
+	// Old and New are the values of the field, when they are short scalars
+	// which are safe to show.
+	Old, New string
+	// Problem is why the field can't be applied, and Detail says more about
+	// it, if anything.
+	Problem reconcileProblem
+	Detail  string
+}
+
+func (d fieldDiff) String() string {
+	var extra []string
+	if d.Old != "" || d.New != "" {
+		extra = append(extra, fmt.Sprintf("%s -> %s", orNone(d.Old), orNone(d.New)))
+	}
+	if d.Detail != "" {
+		extra = append(extra, d.Detail)
+	}
+	if len(extra) == 0 {
+		return d.Path
+	}
+	return fmt.Sprintf("%s (%s)", d.Path, strings.Join(extra, ": "))
+}
+
+func orNone(v string) string {
+	if v == "" {
+		return "<none>"
+	}
+	return v
+}
+
+// reconcileError lists the fields of an update which can't be applied in
+// place.
+type reconcileError struct {
+	diffs []fieldDiff
+}
+
+// Error groups the fields by problem, e.g.
+// "not supported for day-2 changes: spec.config.storage.disks[0]".
+func (e *reconcileError) Error() string {
+	var parts []string
+	for _, problem := range []reconcileProblem{fieldUnsupported, fieldInvalid} {
+		var paths []string
+		for _, d := range e.diffs {
+			if d.Problem == problem {
+				paths = append(paths, d.String())
+			}
+		}
+		if len(paths) > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %s", problem, strings.Join(paths, ", ")))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// configDiffer accumulates the fields of an update which can't be applied.
+type configDiffer struct {
+	diffs []fieldDiff
+}
+
+// add records path as a field which can't be applied.
+func (c *configDiffer) add(path string, problem reconcileProblem, detail string) {
+	c.diffs = append(c.diffs, fieldDiff{Path: path, Problem: problem, Detail: detail})
+}
+
+// compare walks oldValue and newValue, which are of the same type, and
+// records each differing leaf field under path with problem. Lists of
+// different lengths have their extra items recorded as a whole.
+func (c *configDiffer) compare(path string, oldValue, newValue interface{}, problem reconcileProblem) {
+	c.walk(path, "", reflect.ValueOf(oldValue), reflect.ValueOf(newValue), problem)
+}
+
+// err returns the reconcileError of the fields recorded, nil if none.
+func (c *configDiffer) err() error {
+	if len(c.diffs) == 0 {
+		return nil
+	}
+	return &reconcileError{diffs: c.diffs}
+}
+
+func (c *configDiffer) walk(path, field string, oldValue, newValue reflect.Value, problem reconcileProblem) {
+	switch oldValue.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if oldValue.IsNil() && newValue.IsNil() {
+			return
+		}
+		if oldValue.IsNil() || newValue.IsNil() {
+			c.record(path, field, oldValue, newValue, problem)
+			return
+		}
+		c.walk(path, field, oldValue.Elem(), newValue.Elem(), problem)
+	case reflect.Struct:
+		c.walkStruct(path, oldValue, newValue, problem)
+	case reflect.Slice, reflect.Array:
+		n := oldValue.Len()
+		if newValue.Len() > n {
+			n = newValue.Len()
+		}
+		for i := 0; i < n; i++ {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= oldValue.Len():
+				c.record(itemPath, field, reflect.Value{}, newValue.Index(i), problem)
+			case i >= newValue.Len():
+				c.record(itemPath, field, oldValue.Index(i), reflect.Value{}, problem)
+			default:
+				c.walk(itemPath, field, oldValue.Index(i), newValue.Index(i), problem)
+			}
+		}
+	case reflect.Map:
+		keys := make(map[string]reflect.Value)
+		for _, k := range append(oldValue.MapKeys(), newValue.MapKeys()...) {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+		var names []string
+		for name := range keys {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			k := keys[name]
+			oldItem, newItem := oldValue.MapIndex(k), newValue.MapIndex(k)
+			if !oldItem.IsValid() || !newItem.IsValid() {
+				c.record(path+"."+name, field, oldItem, newItem, problem)
+				continue
+			}
+			c.walk(path+"."+name, field, oldItem, newItem, problem)
+		}
+	default:
+		if oldValue.Interface() != newValue.Interface() {
+			c.record(path, field, oldValue, newValue, problem)
+		}
+	}
+}
+
+// walkStruct walks the exported fields of a struct by their JSON names.
+// Embedded structs without a JSON name, which the Ignition types use a lot,
+// are walked as part of the struct embedding them.
+func (c *configDiffer) walkStruct(path string, oldValue, newValue reflect.Value, problem reconcileProblem) {
+	t := oldValue.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" && f.Anonymous {
+			c.walk(path, "", oldValue.Field(i), newValue.Field(i), problem)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		c.walk(path+"."+name, name, oldValue.Field(i), newValue.Field(i), problem)
+	}
+}
+
+// record adds path, showing its values unless field is sensitive or they
+// aren't scalars.
+func (c *configDiffer) record(path, field string, oldValue, newValue reflect.Value, problem reconcileProblem) {
+	d := fieldDiff{Path: path, Problem: problem}
+	if !sensitiveDiffFields[field] {
+		d.Old, d.New = diffValue(oldValue), diffValue(newValue)
+	}
+	c.diffs = append(c.diffs, d)
+}
+
+// diffValue formats v for a fieldDiff, "" if it isn't a scalar.
+func diffValue(v reflect.Value) string {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return ""
+	}
+	var s string
+	switch v.Kind() {
+	case reflect.String:
+		s = fmt.Sprintf("%q", v.String())
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		s = fmt.Sprint(v.Interface())
+	default:
+		return ""
+	}
+	return truncateUTF8(s, maxDiffValueLength)
+}
@@ -0,0 +1,171 @@
+package daemon
+
+import (
+	"encoding/json"
+	"os/user"
+	"testing"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigDifferPaths(t *testing.T) {
+	oldPath, newPath := "/old", "/new"
+	oldStorage := ignv2_2types.Storage{
+		Disks: []ignv2_2types.Disk{{Device: "/dev/sda"}},
+		Filesystems: []ignv2_2types.Filesystem{
+			{Name: "data", Path: &oldPath},
+		},
+	}
+	newStorage := ignv2_2types.Storage{
+		Disks: []ignv2_2types.Disk{{Device: "/dev/sdb"}, {Device: "/dev/sdc"}},
+		Filesystems: []ignv2_2types.Filesystem{
+			{Name: "data", Path: &newPath},
+		},
+	}
+
+	var diff configDiffer
+	diff.compare("spec.config.storage", oldStorage, newStorage, fieldUnsupported)
+	assert.Equal(t, []fieldDiff{
+		{Path: "spec.config.storage.disks[0].device", Old: `"/dev/sda"`, New: `"/dev/sdb"`, Problem: fieldUnsupported},
+		// whole items added or removed have no value shown
+		{Path: "spec.config.storage.disks[1]", Problem: fieldUnsupported},
+		{Path: "spec.config.storage.filesystems[0].path", Old: `"/old"`, New: `"/new"`, Problem: fieldUnsupported},
+	}, diff.diffs)
+}
+
+func TestConfigDifferEmbeddedAndSensitive(t *testing.T) {
+	mode := 0644
+	oldFiles := []ignv2_2types.File{{
+		Node:          ignv2_2types.Node{Path: "/etc/test"},
+		FileEmbedded1: ignv2_2types.FileEmbedded1{Contents: ignv2_2types.FileContents{Source: "data:,secret"}},
+	}}
+	newFiles := []ignv2_2types.File{{
+		Node:          ignv2_2types.Node{Path: "/etc/test"},
+		FileEmbedded1: ignv2_2types.FileEmbedded1{Contents: ignv2_2types.FileContents{Source: "data:,other"}, Mode: &mode},
+	}}
+	oldHash, newHash := "old", "new"
+	oldUser := ignv2_2types.PasswdUser{Name: "core", PasswordHash: &oldHash}
+	newUser := ignv2_2types.PasswdUser{Name: "core", PasswordHash: &newHash}
+
+	var diff configDiffer
+	diff.compare("files", oldFiles, newFiles, fieldUnsupported)
+	diff.compare("user", oldUser, newUser, fieldUnsupported)
+	// embedded structs don't show in the path, and secrets or contents aren't
+	// shown at all
+	assert.Equal(t, []fieldDiff{
+		{Path: "files[0].contents.source", Problem: fieldUnsupported},
+		{Path: "files[0].mode", New: "420", Problem: fieldUnsupported},
+		{Path: "user.passwordHash", Problem: fieldUnsupported},
+	}, diff.diffs)
+}
+
+func TestConfigDifferNilAndEmpty(t *testing.T) {
+	var diff configDiffer
+	diff.compare("spec.config.storage.disks", []ignv2_2types.Disk(nil), []ignv2_2types.Disk{}, fieldUnsupported)
+	assert.Nil(t, diff.err())
+}
+
+func TestReconcilableReportsPaths(t *testing.T) {
+	defer func(orig func(string) (*user.User, error)) { lookupHostUser = orig }(lookupHostUser)
+	lookupHostUser = func(name string) (*user.User, error) {
+		return &user.User{Username: name, Uid: "2"}, nil
+	}
+	d := Daemon{}
+	oldConfig := newTestMachineConfig("old", nil, nil)
+	newConfig := newTestMachineConfig("new", nil, nil)
+	newConfig.Spec.Config.Storage.Disks = []ignv2_2types.Disk{{Device: "/dev/sdb"}}
+	newConfig.Spec.Config.Passwd.Users = []ignv2_2types.PasswdUser{
+		{Name: "core", SSHAuthorizedKeys: []ignv2_2types.SSHAuthorizedKey{"key"}},
+		{Name: "bin", SSHAuthorizedKeys: []ignv2_2types.SSHAuthorizedKey{"key"}},
+	}
+	newConfig.Spec.KernelArguments = []string{"nosmt", "a b"}
+
+	err := d.reconcilable(oldConfig, newConfig)
+	require.NotNil(t, err)
+	rerr, ok := err.(*reconcileError)
+	require.True(t, ok, "unexpected error type %T", err)
+	var paths []string
+	problems := make(map[string]reconcileProblem)
+	for _, diff := range rerr.diffs {
+		paths = append(paths, diff.Path)
+		problems[diff.Path] = diff.Problem
+	}
+	assert.Equal(t, []string{
+		"spec.config.passwd.users[1].name",
+		"spec.config.storage.disks[0]",
+		"spec.kernelArguments[1]",
+	}, paths)
+	assert.Equal(t, fieldInvalid, problems["spec.config.passwd.users[1].name"])
+	assert.Equal(t, fieldUnsupported, problems["spec.config.storage.disks[0]"])
+	assert.Equal(t, fieldInvalid, problems["spec.kernelArguments[1]"])
+	assert.Equal(t, `not supported for day-2 changes: spec.config.storage.disks[0]; `+
+		`changed in a way that can't be applied: spec.config.passwd.users[1].name (bin is a system user (uid 2), only regular users can be managed), `+
+		`spec.kernelArguments[1] ("a b" is not a single argument)`, err.Error())
+}
+
+func TestReconcilableUnsupportedSections(t *testing.T) {
+	d := Daemon{}
+	oldConfig := newTestMachineConfig("old", nil, nil)
+	newConfig := newTestMachineConfig("new", nil, nil)
+	// sections set but empty are no change
+	newConfig.Spec.Config.Networkd.Units = []ignv2_2types.Networkdunit{}
+	newConfig.Spec.Config.Storage.Disks = []ignv2_2types.Disk{}
+	newConfig.Spec.Config.Storage.Filesystems = []ignv2_2types.Filesystem{}
+	newConfig.Spec.Config.Storage.Raid = []ignv2_2types.Raid{}
+	assert.Nil(t, d.reconcilable(oldConfig, newConfig))
+
+	newConfig.Spec.Config.Networkd.Units = []ignv2_2types.Networkdunit{{Name: "eth1.network"}}
+	newConfig.Spec.Config.Passwd.Groups = []ignv2_2types.PasswdGroup{{Name: "admins"}}
+	newConfig.Spec.Config.Storage.Disks = []ignv2_2types.Disk{{Device: "/dev/sdb"}}
+	err := d.reconcilable(oldConfig, newConfig)
+	require.NotNil(t, err)
+	assert.Equal(t, `not supported for day-2 changes: spec.config.networkd.units[0], spec.config.passwd.groups[0], `+
+		`spec.config.storage.disks[0]`, err.Error())
+}
+
+func TestReconcilableCoreUserFields(t *testing.T) {
+	d := Daemon{}
+	oldConfig := newTestMachineConfig("old", nil, nil)
+	newConfig := newTestMachineConfig("new", nil, nil)
+	newConfig.Spec.Config.Passwd.Users = []ignv2_2types.PasswdUser{{Name: "core", HomeDir: "/home/other"}}
+
+	err := d.reconcilable(oldConfig, newConfig)
+	require.NotNil(t, err)
+	assert.Equal(t, `not supported for day-2 changes: spec.config.passwd.users[0].homeDir ("" -> "/home/other"); `+
+		`changed in a way that can't be applied: spec.config.passwd.users[0].sshAuthorizedKeys (user core must have 1 or more sshKeys)`, err.Error())
+}
+
+func TestReconcilableKernelTypeValues(t *testing.T) {
+	d := Daemon{}
+	oldConfig := newTestMachineConfig("old", nil, nil)
+	newConfig := newTestMachineConfig("new", nil, nil)
+	newConfig.Spec.KernelType = "bogus"
+	err := d.reconcilable(oldConfig, newConfig)
+	require.NotNil(t, err)
+	assert.Equal(t, []fieldDiff{{Path: "spec.kernelType", Old: `""`, New: `"bogus"`, Problem: fieldInvalid}}, err.(*reconcileError).diffs)
+	newConfig.Spec.KernelType = mcfgv1.KernelTypeRealtime
+	assert.Nil(t, d.reconcilable(oldConfig, newConfig))
+}
+
+func TestReconcilableV3Config(t *testing.T) {
+	d := Daemon{}
+	var v2Config, v3Config mcfgv1.MachineConfig
+	require.Nil(t, json.Unmarshal([]byte(`{"kind": "MachineConfig", "metadata": {"name": "v2"}, "spec": {"config": {
+		"ignition": {"version": "2.2.0"},
+		"passwd": {"users": [{"name": "core", "sshAuthorizedKeys": ["key"]}]},
+		"storage": {"files": [{"filesystem": "root", "path": "/etc/motd", "mode": 420, "contents": {"source": "data:,hello"}}]},
+		"systemd": {"units": [{"name": "foo.service", "enabled": true, "contents": "[Service]", "dropins": [{"name": "10-foo.conf", "contents": "[Service]"}]}]}
+	}}}`), &v2Config))
+	require.Nil(t, json.Unmarshal([]byte(`{"kind": "MachineConfig", "metadata": {"name": "v3"}, "spec": {"config": {
+		"ignition": {"version": "3.0.0"},
+		"passwd": {"users": [{"name": "core", "sshAuthorizedKeys": ["key"]}]},
+		"storage": {"files": [{"path": "/etc/motd", "mode": 420, "contents": {"source": "data:,hello"}}]},
+		"systemd": {"units": [{"name": "foo.service", "enabled": true, "contents": "[Service]", "dropins": [{"name": "10-foo.conf", "contents": "[Service]"}]}]}
+	}}}`), &v3Config))
+	assert.Equal(t, v2Config.Spec, v3Config.Spec, "both specs are read into the same config")
+	assert.Nil(t, d.reconcilable(&v2Config, &v3Config))
+	assert.Nil(t, d.reconcilable(&v3Config, &v2Config))
+}
@@ -12,6 +12,8 @@ const (
 	CurrentMachineConfigAnnotationKey = "machineconfiguration.openshift.io/currentConfig"
 	// DesiredMachineConfigAnnotationKey is used to specify the desired MachineConfig for a machine
 	DesiredMachineConfigAnnotationKey = "machineconfiguration.openshift.io/desiredConfig"
+	// PendingMachineConfigAnnotationKey is set by the daemon to the MachineConfig it is rebooting into, and cleared once that config is Done
+	PendingMachineConfigAnnotationKey = "machineconfiguration.openshift.io/pendingConfig"
 	// MachineConfigDaemonStateAnnotationKey is used to fetch the state of the daemon on the machine.
 	MachineConfigDaemonStateAnnotationKey = "machineconfiguration.openshift.io/state"
 	// MachineConfigDaemonStateWorking is set by daemon when it is applying an update.
@@ -23,9 +25,30 @@ const (
 	MachineConfigDaemonStateDegraded = "Degraded"
 	// MachineConfigDaemonStateUnreconcilable is set by the daemon when a MachineConfig cannot be applied.
 	MachineConfigDaemonStateUnreconcilable = "Unreconcilable"
+	// MachineConfigDaemonStateHeld is set by the daemon when its node has an update to apply, but is held.
+	MachineConfigDaemonStateHeld = "Held"
+	// NodeHoldAnnotationKey holds the updates of a node, set to "true" by admins. The node controller doesn't pick held nodes
+	// for updates, and the daemon doesn't start updates while its node is held.
+	NodeHoldAnnotationKey = "machineconfiguration.openshift.io/hold"
+	// MachineConfigDaemonReasonAnnotationKey is set by the daemon when it needs to report a human readable reason for its state. E.g. when state flips to Degraded/Unreconcilable.
+	MachineConfigDaemonReasonAnnotationKey = "machineconfiguration.openshift.io/reason"
 	// InitialNodeAnnotationsFilePath defines the path at which it will find the node annotations it needs to set on the node once it comes up for the first time.
 	// The Machine Config Server writes the node annotations to this path.
 	InitialNodeAnnotationsFilePath = "/etc/machine-config-daemon/node-annotations.json"
+	// MachineConfigEncapsulatedPath is where the Machine Config Server embeds the parts of a node's first config Ignition can't apply.
+	// The daemon's firstboot service applies them and removes the file; until then the in-cluster daemon doesn't sync.
+	MachineConfigEncapsulatedPath = "/etc/ignition-machine-config-encapsulated.json"
+
+	// CurrentOSImageAnnotationKey is set by the daemon to the OS image the node booted, on hosts using rpm-ostree.
+	CurrentOSImageAnnotationKey = "machineconfiguration.openshift.io/currentOSImage"
+	// CurrentOSVersionAnnotationKey is set by the daemon to the version of the rpm-ostree deployment the node booted.
+	CurrentOSVersionAnnotationKey = "machineconfiguration.openshift.io/currentOSVersion"
+	// CurrentOSChecksumAnnotationKey is set by the daemon to the checksum of the rpm-ostree deployment the node booted.
+	CurrentOSChecksumAnnotationKey = "machineconfiguration.openshift.io/currentOSChecksum"
+	// CurrentOSReleaseAnnotationKey is set by the daemon to the contents of /etc/redhat-release, on hosts not using rpm-ostree.
+	CurrentOSReleaseAnnotationKey = "machineconfiguration.openshift.io/currentOSRelease"
+	// CurrentFIPSAnnotationKey is set by the daemon to "true" when the node booted in FIPS mode, "false" otherwise.
+	CurrentFIPSAnnotationKey = "machineconfiguration.openshift.io/currentFIPS"
 
 	// EtcPivotFile is used by the `pivot` command
 	// For more information, see https://github.com/openshift/pivot/pull/25/commits/c77788a35d7ee4058d1410e89e6c7937bca89f6c#diff-04c6e90faac2675aa89e2176d2eec7d8R44
@@ -0,0 +1,64 @@
+package daemon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/pkg/errors"
+	"github.com/vincent-petithory/dataurl"
+)
+
+const (
+	// compressionGzip is the only compression of file contents Ignition 2.2
+	// supports
+	compressionGzip = "gzip"
+	// maxDecompressedSize caps the decompressed contents of a file, so that a
+	// small compressed config can't fill the disk
+	maxDecompressedSize = 128 << 20
+)
+
+// decodeFileContents returns the contents of f: the decoded data URL, or the
+// cached remote contents, decompressed.
+func decodeFileContents(f ignv2_2types.File) ([]byte, error) {
+	if isRemoteSource(f) {
+		contents, err := cachedRemoteSource(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "remote contents of %s from %s not fetched", f.Path, redactSource(f.Contents.Source))
+		}
+		return contents, nil
+	}
+	contents, err := dataurl.DecodeString(f.Contents.Source)
+	if err != nil {
+		return nil, err
+	}
+	return decompressFileContents(f, contents.Data)
+}
+
+// decompressFileContents returns raw, the contents of f as given by its
+// source, decompressed per the compression of f. Verification hashes are
+// over the decompressed contents.
+func decompressFileContents(f ignv2_2types.File, raw []byte) ([]byte, error) {
+	switch f.Contents.Compression {
+	case "":
+		return raw, nil
+	case compressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress contents of %s: %v", f.Path, err)
+		}
+		defer r.Close()
+		contents, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress contents of %s: %v", f.Path, err)
+		}
+		if len(contents) > maxDecompressedSize {
+			return nil, fmt.Errorf("failed to decompress contents of %s: more than the maximum of %d bytes", f.Path, maxDecompressedSize)
+		}
+		return contents, nil
+	}
+	return nil, fmt.Errorf("unsupported compression %q of %s", f.Contents.Compression, f.Path)
+}
@@ -0,0 +1,80 @@
+package daemon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vincent-petithory/dataurl"
+)
+
+func newTestGzipFile(t *testing.T, path, contents string) ignv2_2types.File {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	_, err := w.Write([]byte(contents))
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+	f := newTestFile(path, "")
+	f.Contents.Source = dataurl.EncodeBytes(b.Bytes())
+	f.Contents.Compression = compressionGzip
+	return f
+}
+
+func TestWriteFilesGzip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "contents")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dn := &Daemon{
+		ownedFilesPath:   filepath.Join(dir, "owned-files.json"),
+		originalFilesDir: filepath.Join(dir, "orig"),
+	}
+	path := filepath.Join(dir, "etc/registries.conf")
+	contents := "[[registry]]\nlocation = \"quay.io\"\n"
+	sum := sha256.Sum256([]byte(contents))
+
+	// the verification hash is over the uncompressed contents
+	f := withFileHash(newTestGzipFile(t, path, contents), "sha256-"+hex.EncodeToString(sum[:]))
+	require.Nil(t, dn.writeFiles([]ignv2_2types.File{f}))
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, contents, string(b))
+	assert.Empty(t, checkFiles([]ignv2_2types.File{f}))
+
+	raw, err := dataurl.DecodeString(f.Contents.Source)
+	require.Nil(t, err)
+	compressedSum := sha256.Sum256(raw.Data)
+	f = withFileHash(f, "sha256-"+hex.EncodeToString(compressedSum[:]))
+	err = dn.writeFiles([]ignv2_2types.File{f})
+	require.NotNil(t, err)
+	assert.Equal(t, errHashMismatch, errors.Cause(err))
+
+	notGzip := newTestFile(path, contents)
+	notGzip.Contents.Compression = compressionGzip
+	err = dn.writeFiles([]ignv2_2types.File{notGzip})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "failed to decompress contents of "+path)
+}
+
+func TestReconcilableCompression(t *testing.T) {
+	d := Daemon{}
+	oldConfig := newTestMachineConfig("old", nil, nil)
+
+	newConfig := newTestMachineConfig("new", []ignv2_2types.File{newTestGzipFile(t, "/etc/foo", "contents")}, nil)
+	assert.Nil(t, d.reconcilable(oldConfig, newConfig), "gzip contents are reconcilable")
+
+	xz := newTestFile("/etc/foo", "contents")
+	xz.Contents.Compression = "xz"
+	newConfig = newTestMachineConfig("new", []ignv2_2types.File{xz}, nil)
+	err := d.reconcilable(oldConfig, newConfig)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), `spec.config.storage.files[0].contents.compression (unsupported compression "xz", expected gzip)`)
+}
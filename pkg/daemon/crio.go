@@ -0,0 +1,67 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// crioSocketPath is where CRI-O serves its status endpoints, next to the
+	// CRI
+	crioSocketPath = "/var/run/crio/crio.sock"
+
+	// crioStatusTimeout bounds how long CRI-O may take to answer again after
+	// a reload
+	crioStatusTimeout = 1 * time.Minute
+	// crioStatusInterval is the time between two queries of CRI-O's status
+	crioStatusInterval = 2 * time.Second
+)
+
+// crioStatus queries the info endpoint of CRI-O, which it only serves once its
+// configuration is loaded. It is swapped out by tests.
+var crioStatus = func() error {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", crioSocketPath)
+			},
+		},
+	}
+	resp, err := client.Get("http://localhost/info")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CRI-O info returned %s: %s", resp.Status, string(body))
+	}
+	return nil
+}
+
+// waitForCrio waits for CRI-O to answer on its status endpoint after being
+// reloaded or restarted, so the update isn't marked done before the registries
+// it reread are in effect.
+func waitForCrio() error {
+	deadline := time.Now().Add(crioStatusTimeout)
+	for {
+		err := crioStatus()
+		if err == nil {
+			glog.Info("CRI-O is up")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("CRI-O didn't come back within %v: %v", crioStatusTimeout, err)
+		}
+		glog.V(2).Infof("Waiting for CRI-O: %v", err)
+		time.Sleep(crioStatusInterval)
+	}
+}
@@ -6,28 +6,27 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	imgref "github.com/containers/image/docker/reference"
-	ignv2 "github.com/coreos/ignition/config/v2_2"
 	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
 	"github.com/golang/glog"
-	drain "github.com/openshift/kubernetes-drain"
 	"github.com/openshift/machine-config-operator/lib/resourceread"
 	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
 	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
 	mcfgclientset "github.com/openshift/machine-config-operator/pkg/generated/clientset/versioned"
 	mcfginformersv1 "github.com/openshift/machine-config-operator/pkg/generated/informers/externalversions/machineconfiguration.openshift.io/v1"
 	mcfglistersv1 "github.com/openshift/machine-config-operator/pkg/generated/listers/machineconfiguration.openshift.io/v1"
+	"github.com/openshift/machine-config-operator/pkg/ignition"
 	"github.com/pkg/errors"
-	"github.com/vincent-petithory/dataurl"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
@@ -54,6 +53,9 @@ type Daemon struct {
 	// NodeUpdaterClient an instance of the client which interfaces with host content deployments
 	NodeUpdaterClient NodeUpdaterClient
 
+	// backend applies the OS level parts of configs, see updater
+	backend updateBackend
+
 	// bootID is a unique value per boot (generated by the kernel)
 	bootID string
 
@@ -80,16 +82,77 @@ type Daemon struct {
 
 	// onceFrom defines where the source config is to run the daemon once and exit
 	onceFrom string
+	// onceFromCAFile is a PEM bundle of extra CAs to trust fetching onceFrom
+	// from an https URL
+	onceFromCAFile string
+
+	// drainTimeout is how long a drain is retried before the node is marked
+	// degraded, unless overridden by the node's drain-timeout annotation
+	drainTimeout time.Duration
+	// drainForceAfter is how long into a drain the pods stuck evicting are
+	// deleted, never if zero, unless overridden by the node's pool
+	drainForceAfter time.Duration
+
+	// healthChecks are run after rebooting into a new config, until they
+	// pass or healthGateTimeout elapses, before the node is marked done
+	healthChecks      []string
+	healthGateTimeout time.Duration
+
+	// ownedFilesPath is where the files written by the daemon are tracked,
+	// and originalFilesDir where the files they replaced are backed up
+	ownedFilesPath   string
+	originalFilesDir string
+	// createdUsersPath is where the users created by the daemon are tracked
+	createdUsersPath string
+	// journalPath is where the update in flight is recorded, see
+	// updateJournal
+	journalPath string
+	// stateFilePath is where the daemonState kept across reboots and
+	// restarts is stored
+	stateFilePath string
+	// fipsFile is where the FIPS mode of the kernel is read, see checkFIPS
+	fipsFile string
+	// lockPath is locked while the daemon runs, see acquireInstanceLock
+	lockPath string
+	// historyPath is where the updates applied are recorded, see
+	// historyEntry
+	historyPath string
+
+	// forceValidationRepair rewrites the files and units found drifted from
+	// the current config on startup, instead of marking the node degraded
+	forceValidationRepair bool
+
+	// skipUnitValidation writes the units and dropins of updates without
+	// checking their syntax first, see validateUnits
+	skipUnitValidation bool
+
+	// sshLoginAllowlist holds the users whose SSH logins don't mark the node
+	// as accessed, like cluster automation accounts
+	sshLoginAllowlist map[string]bool
 
 	// skipReboot skips the reboot after a sync, only valid with onceFrom != ""
 	skipReboot bool
 
+	// dryRun only reports what updates would change, see dryRunUpdate
+	dryRun bool
+
 	kubeletHealthzEnabled  bool
 	kubeletHealthzEndpoint string
 
 	installedSigterm bool
+	// terminating is closed once the cluster driven daemon got SIGTERM, see
+	// handleTermination
+	terminating chan struct{}
+	// syncMu is held for each sync of the node
+	syncMu sync.Mutex
 
 	nodeWriter *NodeWriter
+	// working is the Working state queued by the update in progress, see
+	// waitWorkingReported
+	working *PendingWrite
+	// inhibitor is the shutdown inhibitor lock held by the update in
+	// progress, see inhibitShutdown
+	inhibitor shutdownInhibitor
 
 	// channel used by callbacks to signal Run() of an error
 	exitCh chan<- error
@@ -109,14 +172,9 @@ type Daemon struct {
 	syncHandler func(node string) error
 
 	booting bool
-}
 
-// pendingConfigState is stored as JSON at pathStateJSON; it is only
-// written after an update is complete, and across the reboot to
-// denote success.
-type pendingConfigState struct {
-	PendingConfig string `json:"pendingConfig,omitempty"`
-	BootID        string `json:"bootID,omitempty"`
+	// status is what the status listener serves
+	status statusTracker
 }
 
 const (
@@ -128,6 +186,9 @@ const (
 	pathDevNull = "/dev/null"
 	// pathStateJSON is where we store temporary state across config changes
 	pathStateJSON = "/etc/machine-config-daemon/state.json"
+	// pathForceValidation is the break-glass touch file which skips the next
+	// on-disk state validation
+	pathForceValidation = "/run/machine-config-daemon/force"
 	// currentConfigPath is where we store the current config on disk to validate
 	// against annotations changes
 	currentConfigPath = "/var/machine-config-daemon/currentconfig"
@@ -148,14 +209,16 @@ const (
 
 	// updateDelay is a pause to deal with churn in Node
 	updateDelay = 5 * time.Second
-)
 
-type onceFromOrigin int
+	// nodeWriterTimeout bounds how long a single node annotation write may
+	// block the caller before giving up
+	nodeWriterTimeout = 2 * time.Minute
 
-const (
-	onceFromUnknownConfig onceFromOrigin = iota
-	onceFromLocalConfig
-	onceFromRemoteConfig
+	// apiOutageTimeout bounds how long an update carries on with its local
+	// phases while the API server is unavailable: the writes buffered
+	// meanwhile are given up after it, and the node isn't drained nor
+	// rebooted unless its Working state was written by then
+	apiOutageTimeout = 10 * time.Minute
 )
 
 var (
@@ -163,6 +226,10 @@ var (
 	defaultRebootCommand = "reboot"
 )
 
+// errOnDiskDrift is returned when files or units on disk differ from the
+// config they were written for.
+var errOnDiskDrift = errors.New("on-disk state drifted from config")
+
 // getBootID loads the unique "boot id" which is generated by the Linux kernel.
 func getBootID() (string, error) {
 	currentBootIDBytes, err := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
@@ -180,7 +247,9 @@ func New(
 	operatingSystem string,
 	nodeUpdaterClient NodeUpdaterClient,
 	onceFrom string,
+	onceFromCAFile string,
 	skipReboot bool,
+	dryRun bool,
 	mcClient mcfgclientset.Interface,
 	kubeClient kubernetes.Interface,
 	kubeletHealthzEnabled bool,
@@ -193,8 +262,10 @@ func New(
 		osImageURL string
 		err        error
 	)
-	// Only pull the osImageURL from OSTree when we are on RHCOS
-	if operatingSystem == machineConfigDaemonOSRHCOS {
+	backend := detectUpdateBackend(operatingSystem, rootMount, nodeUpdaterClient)
+	glog.Infof("Using the %s update backend on %s", backend.name(), operatingSystem)
+	// Only pull the osImageURL from OSTree when the backend manages it
+	if backend.managesOSImage() {
 		var osVersion string
 		osImageURL, osVersion, err = nodeUpdaterClient.GetBootedOSImageURL(rootMount)
 		if err != nil {
@@ -212,11 +283,14 @@ func New(
 		name:                   nodeName,
 		OperatingSystem:        operatingSystem,
 		NodeUpdaterClient:      nodeUpdaterClient,
+		backend:                backend,
 		rootMount:              rootMount,
 		bootID:                 bootID,
 		bootedOSImageURL:       osImageURL,
 		onceFrom:               onceFrom,
+		onceFromCAFile:         onceFromCAFile,
 		skipReboot:             skipReboot,
+		dryRun:                 dryRun,
 		kubeletHealthzEnabled:  kubeletHealthzEnabled,
 		kubeletHealthzEndpoint: kubeletHealthzEndpoint,
 		nodeWriter:             nodeWriter,
@@ -224,8 +298,19 @@ func New(
 		stopCh:                 stopCh,
 		kubeClient:             kubeClient,
 		mcClient:               mcClient,
+		ownedFilesPath:         pathOwnedFiles,
+		originalFilesDir:       pathOriginalFiles,
+		journalPath:            pathUpdateJournal,
+		createdUsersPath:       pathCreatedUsers,
+		stateFilePath:          pathStateJSON,
+		fipsFile:               pathFIPSEnabled,
+		lockPath:               pathDaemonLock,
+		historyPath:            pathUpdateHistory,
 	}
 	dn.atomicSSHKeysWriter = dn.atomicallyWriteSSHKey
+	if nodeWriter != nil && kubeClient != nil {
+		nodeWriter.Bind(kubeClient.CoreV1().Nodes(), nil, nodeName)
+	}
 
 	return dn, nil
 }
@@ -238,9 +323,18 @@ func NewClusterDrivenDaemon(
 	operatingSystem string,
 	nodeUpdaterClient NodeUpdaterClient,
 	mcInformer mcfginformersv1.MachineConfigInformer,
+	mcClient mcfgclientset.Interface,
 	kubeClient kubernetes.Interface,
 	onceFrom string,
 	skipReboot bool,
+	dryRun bool,
+	drainTimeout time.Duration,
+	drainForceAfter time.Duration,
+	forceValidationRepair bool,
+	skipUnitValidation bool,
+	sshLoginAllowlist []string,
+	healthChecks []string,
+	healthGateTimeout time.Duration,
 	nodeInformer coreinformersv1.NodeInformer,
 	kubeletHealthzEnabled bool,
 	kubeletHealthzEndpoint string,
@@ -254,8 +348,10 @@ func NewClusterDrivenDaemon(
 		operatingSystem,
 		nodeUpdaterClient,
 		onceFrom,
+		"",
 		skipReboot,
-		nil,
+		dryRun,
+		mcClient,
 		kubeClient,
 		kubeletHealthzEnabled,
 		kubeletHealthzEndpoint,
@@ -267,6 +363,19 @@ func NewClusterDrivenDaemon(
 		return nil, err
 	}
 
+	dn.drainTimeout = drainTimeout
+	dn.drainForceAfter = drainForceAfter
+	if err := validateHealthChecks(healthChecks); err != nil {
+		return nil, err
+	}
+	dn.healthChecks = healthChecks
+	dn.healthGateTimeout = healthGateTimeout
+	dn.forceValidationRepair = forceValidationRepair
+	dn.skipUnitValidation = skipUnitValidation
+	dn.sshLoginAllowlist = make(map[string]bool)
+	for _, user := range sshLoginAllowlist {
+		dn.sshLoginAllowlist[user] = true
+	}
 	dn.queue = workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "machineconfigdaemon")
 
 	eventBroadcaster := record.NewBroadcaster()
@@ -282,6 +391,8 @@ func NewClusterDrivenDaemon(
 		UpdateFunc: dn.handleNodeUpdate,
 	})
 	dn.nodeLister = nodeInformer.Lister()
+	// rebind now that there is a lister to read the node from
+	nodeWriter.Bind(kubeClient.CoreV1().Nodes(), dn.nodeLister, nodeName)
 	dn.nodeListerSynced = nodeInformer.Informer().HasSynced
 	dn.mcLister = mcInformer.Lister()
 	dn.mcListerSynced = mcInformer.Informer().HasSynced
@@ -301,6 +412,11 @@ func (dn *Daemon) worker() {
 }
 
 func (dn *Daemon) processNextWorkItem() bool {
+	dn.syncMu.Lock()
+	defer dn.syncMu.Unlock()
+	if dn.terminationRequested() {
+		return false
+	}
 	if dn.booting {
 		// any error here in bootstrap will cause a retry
 		if err := dn.bootstrapNode(); err != nil {
@@ -335,6 +451,7 @@ func (dn *Daemon) bootstrapNode() error {
 		return err
 	}
 	dn.node = node
+	dn.recordNodeConfigs(node)
 	if err := dn.CheckStateOnBoot(); err != nil {
 		return err
 	}
@@ -344,12 +461,37 @@ func (dn *Daemon) bootstrapNode() error {
 }
 
 func (dn *Daemon) handleErr(err error, key interface{}) {
+	dn.recordSyncError(err)
 	if err == nil {
 		dn.queue.Forget(key)
 		return
 	}
 
-	if dn.queue.NumRequeues(key) < maxRetries {
+	if errors.Cause(err) == ErrNodeGone {
+		// not a failure of ours, there is just nothing left to update
+		glog.V(2).Infof("node %v has been deleted: %v", key, err)
+		dn.queue.Forget(key)
+		return
+	}
+
+	if e, ok := errors.Cause(err).(*updateAttemptsError); ok {
+		// failed updates are retried with their own backoff, or not at all
+		// once they failed too many times
+		dn.updateErrorState(err)
+		dn.queue.Forget(key)
+		if e.retryIn > 0 {
+			dn.queue.AddAfter(key, e.retryIn)
+		}
+		return
+	}
+
+	// a drain has already been retried for its whole timeout, drift stays
+	// until someone fixes it, and neither does the OS image grow the realtime
+	// kernel nor the daemon new extensions, and a rolled back node waits for
+	// a new desired config, just as a node without a previous config has none
+	// to roll back to; the health checks and etcd members have already been
+	// waited for their whole timeout
+	if cause := errors.Cause(err); !isPermanentError(cause) && dn.queue.NumRequeues(key) < maxRetries {
 		glog.V(2).Infof("Error syncing node %v: %v", key, err)
 		dn.queue.AddRateLimited(key)
 		return
@@ -363,13 +505,71 @@ func (dn *Daemon) handleErr(err error, key interface{}) {
 	dn.queue.AddAfter(key, 1*time.Minute)
 }
 
+// isPermanentError returns whether retrying can't help with the error cause.
+func isPermanentError(cause error) bool {
+	switch cause {
+	case errDrainTimeout, errOnDiskDrift, errRealtimeKernelUnavailable, errUnsupportedExtension, errInvalidUnit, errRolledBack, errNoRollback, errHealthGate, errHashMismatch, errRebootNotOccurred, errEtcdUnhealthy:
+		return true
+	}
+	return false
+}
+
 func (dn *Daemon) updateErrorState(err error) {
+	ctx, cancel := nodeWriterContext()
+	defer cancel()
+	state := constants.MachineConfigDaemonStateDegraded
 	switch errors.Cause(err) {
 	case errUnreconcilable:
-		dn.nodeWriter.SetUnreconcilable(err, dn.kubeClient.CoreV1().Nodes(), dn.nodeLister, dn.name)
+		state = constants.MachineConfigDaemonStateUnreconcilable
+		dn.nodeWriter.SetUnreconcilable(ctx, err)
 	default:
-		dn.nodeWriter.SetDegraded(err, dn.kubeClient.CoreV1().Nodes(), dn.nodeLister, dn.name)
+		dn.nodeWriter.SetDegraded(ctx, err)
 	}
+	logLifecycle(sdMessageNodeDegraded, journalPriErr, fmt.Sprintf("Marking %s due to: %v", state, err), map[string]string{
+		"OLD_CONFIG": dn.currentState().CurrentConfig,
+		"NEW_CONFIG": dn.currentState().DesiredConfig,
+		"RESULT":     state,
+		"ERROR":      err.Error(),
+	})
+}
+
+// nodeWriterContext returns a context bounding a single NodeWriter call, so a
+// wedged writer or an unreachable API server can't stall the daemon forever.
+func nodeWriterContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), nodeWriterTimeout)
+}
+
+// outageWriterContext returns a context bounding a NodeWriter call made by an
+// update which outlives an API server outage, see apiOutageTimeout.
+func outageWriterContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), apiOutageTimeout)
+}
+
+// queueNodeWrite makes a write of an update with queue, without waiting for
+// it; its failure is only logged, as failing to do what.
+func (dn *Daemon) queueNodeWrite(what string, queue func(ctx context.Context) *PendingWrite) {
+	ctx, cancel := outageWriterContext()
+	w := queue(ctx)
+	go func() {
+		defer cancel()
+		if err := w.Wait(); err != nil {
+			glog.Warningf("Unable to %s: %v", what, err)
+		}
+	}()
+}
+
+// waitWorkingReported waits for the Working state queued by the update in
+// progress, if any, to be written. The node isn't drained nor rebooted before
+// it is, lest the controller take the node for idle; the update fails if it
+// isn't by apiOutageTimeout after it started.
+func (dn *Daemon) waitWorkingReported() error {
+	if dn.working == nil {
+		return nil
+	}
+	if err := dn.working.Wait(); err != nil {
+		return errors.Wrap(err, "failed to report the Working state")
+	}
+	return nil
 }
 
 func (dn *Daemon) syncNode(key string) error {
@@ -404,6 +604,10 @@ func (dn *Daemon) syncNode(key string) error {
 	if node.Name == dn.name {
 		// stash the current node being processed
 		dn.node = node
+		dn.recordNodeConfigs(node)
+		if rollbackRequested(node) {
+			return dn.rollback()
+		}
 		// Pass to the shared update prep method
 		current, desired, err := dn.prepUpdateFromCluster()
 		if err != nil {
@@ -411,9 +615,15 @@ func (dn *Daemon) syncNode(key string) error {
 			return err
 		}
 		if current != nil || desired != nil {
+			if proceed, err := dn.checkUpdateAttempts(key, desired); !proceed {
+				return err
+			}
 			if err := dn.triggerUpdateWithMachineConfig(current, desired); err != nil {
 				glog.Infof("Unable to apply update: %s", err)
-				return err
+				return dn.recordUpdateFailure(desired, err)
+			}
+			if err := dn.saveUpdateFailures(nil); err != nil {
+				glog.Warningf("Unable to clear the failed update attempts: %v", err)
 			}
 		}
 		glog.V(2).Infof("Node %s is already synced", node.Name)
@@ -437,32 +647,14 @@ func (dn *Daemon) enqueueDefault(node *corev1.Node) {
 	dn.enqueueAfter(node, updateDelay)
 }
 
-const (
-	// IDs are taken from https://cgit.freedesktop.org/systemd/systemd/plain/src/systemd/sd-messages.h
-	sdMessageSessionStart = "8d45620c1a4348dbb17410da57c60c66"
-)
-
-// detectEarlySSHAccessesFromBoot taints the node if we find a login before the daemon started up.
-func (dn *Daemon) detectEarlySSHAccessesFromBoot() error {
-	journalOutput, err := exec.Command("journalctl", "-b", "-o", "cat", "MESSAGE_ID="+sdMessageSessionStart).CombinedOutput()
-	if err != nil {
-		return err
-	}
-	if len(journalOutput) > 0 {
-		glog.Info("Detected a login session before the daemon took over on first boot")
-		glog.Infof("Applying annotation: %v", machineConfigDaemonSSHAccessAnnotationKey)
-		if err := dn.applySSHAccessedAnnotation(); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
+// runOnceFrom applies the config onceFrom points to, without going through
+// the cluster: no node annotations are written, even with a kubeconfig. The
+// cause of the error returned gives the exit status, see OnceFromExitStatus.
 func (dn *Daemon) runOnceFrom() error {
-	configi, contentFrom, err := dn.senseAndLoadOnceFrom()
+	configi, err := dn.senseAndLoadOnceFrom()
 	if err != nil {
 		glog.Warningf("Unable to decipher onceFrom config type: %s", err)
-		return err
+		return errors.Wrapf(errInvalidOnceFrom, "%v", err)
 	}
 	switch configi.(type) {
 	case ignv2_2types.Config:
@@ -470,15 +662,24 @@ func (dn *Daemon) runOnceFrom() error {
 		return dn.runOnceFromIgnition(configi.(ignv2_2types.Config))
 	case mcfgv1.MachineConfig:
 		glog.V(2).Info("Daemon running directly from MachineConfig")
-		return dn.runOnceFromMachineConfig(configi.(mcfgv1.MachineConfig), contentFrom)
+		return dn.runOnceFromMachineConfig(configi.(mcfgv1.MachineConfig))
 	}
-	return errors.New("unsupported onceFrom type provided")
+	return errors.Wrap(errInvalidOnceFrom, "unsupported onceFrom type provided")
 }
 
 // Run finishes informer setup and then blocks, and the informer will be
 // responsible for triggering callbacks to handle updates. Successful
 // updates shouldn't return, and should just reboot the node.
 func (dn *Daemon) Run(stopCh <-chan struct{}, exitCh <-chan error) error {
+	// Two daemons applying configs at once would corrupt each other's state
+	if dn.lockPath != "" {
+		lock, err := acquireInstanceLock(dn.lockPath)
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+	}
+
 	if dn.kubeletHealthzEnabled {
 		glog.Info("Enabling Kubelet Healthz Monitor")
 		go dn.runKubeletHealthzMonitor(stopCh, dn.exitCh)
@@ -492,6 +693,13 @@ func (dn *Daemon) Run(stopCh <-chan struct{}, exitCh <-chan error) error {
 	defer utilruntime.HandleCrash()
 	defer dn.queue.ShutDown()
 
+	dn.handleTermination()
+
+	// Don't sync while the firstboot service still applies the first config
+	if err := waitForFirstboot(constants.MachineConfigEncapsulatedPath, firstbootPollInterval, stopCh); err != nil {
+		return errors.Wrapf(err, "waiting for firstboot to complete")
+	}
+
 	if !cache.WaitForCacheSync(stopCh, dn.nodeListerSynced, dn.mcListerSynced) {
 		return errors.New("failed to sync initial listers cache")
 	}
@@ -521,58 +729,6 @@ func (dn *Daemon) BindPodMounts() error {
 	return mnt.Run()
 }
 
-func (dn *Daemon) runLoginMonitor(stopCh <-chan struct{}, exitCh chan<- error) {
-	cmd := exec.Command("journalctl", "-b", "-f", "-o", "cat", "MESSAGE_ID="+sdMessageSessionStart)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		exitCh <- err
-		return
-	}
-	if err := cmd.Start(); err != nil {
-		exitCh <- err
-		return
-	}
-	worker := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-worker:
-				return
-			default:
-				buf := make([]byte, 1024)
-				l, err := stdout.Read(buf)
-				if err != nil {
-					if err == io.EOF {
-						return
-					}
-					exitCh <- err
-					return
-				}
-				if l > 0 {
-					line := strings.Split(string(buf), "\n")[0]
-					glog.Infof("Detected a new login session: %s", line)
-					glog.Infof("Login access is discouraged! Applying annotation: %v", machineConfigDaemonSSHAccessAnnotationKey)
-					if err := dn.applySSHAccessedAnnotation(); err != nil {
-						exitCh <- err
-					}
-				}
-			}
-		}
-	}()
-	select {
-	case <-stopCh:
-		close(worker)
-		cmd.Process.Kill()
-	}
-}
-
-func (dn *Daemon) applySSHAccessedAnnotation() error {
-	if err := dn.nodeWriter.SetSSHAccessed(dn.kubeClient.CoreV1().Nodes(), dn.nodeLister, dn.name); err != nil {
-		return fmt.Errorf("error: cannot apply annotation for SSH access due to: %v", err)
-	}
-	return nil
-}
-
 func (dn *Daemon) runKubeletHealthzMonitor(stopCh <-chan struct{}, exitCh chan<- error) {
 	failureCount := 0
 	for {
@@ -716,20 +872,23 @@ func (dn *Daemon) getStateAndConfigs(pendingConfigName string) (*stateAndConfigs
 // getPendingConfig loads the JSON state we cache across attempting to apply
 // a config+reboot.  If no pending state is available, ("", nil) will be returned.
 // The bootID is stored in the pending state; if it is unchanged, we assume
-// that we failed to reboot; that for now should be a fatal error, in order to avoid
-// reboot loops.
+// that we failed to reboot, which retryPendingReboot handles beforehand.
 func (dn *Daemon) getPendingConfig() (string, error) {
-	s, err := ioutil.ReadFile(pathStateJSON)
+	s, err := ioutil.ReadFile(dn.stateFilePath)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return "", errors.Wrapf(err, "loading transient state")
 		}
 		return "", nil
 	}
-	var p pendingConfigState
+	var p daemonState
 	if err := json.Unmarshal([]byte(s), &p); err != nil {
 		return "", errors.Wrapf(err, "parsing transient state")
 	}
+	// the state may only track failed update attempts
+	if p.PendingConfig == "" {
+		return "", nil
+	}
 
 	if p.BootID == dn.bootID {
 		return "", fmt.Errorf("pending config %s bootID %s matches current! Failed to reboot?", p.PendingConfig, dn.bootID)
@@ -737,6 +896,21 @@ func (dn *Daemon) getPendingConfig() (string, error) {
 	return p.PendingConfig, nil
 }
 
+// checkPendingConfigAnnotation verifies that the pending config recorded on
+// the node before rebooting agrees with the one in the on-disk state. Nodes
+// last updated by a daemon which didn't set the annotation have none, and are
+// trusted.
+func checkPendingConfigAnnotation(node *corev1.Node, pendingConfigName string) error {
+	pendingAnnotation, err := getNodeAnnotationExt(node, constants.PendingMachineConfigAnnotationKey, true)
+	if err != nil {
+		return err
+	}
+	if pendingAnnotation != "" && pendingAnnotation != pendingConfigName {
+		return fmt.Errorf("node annotation %s is %q but the on-disk pending config is %q", constants.PendingMachineConfigAnnotationKey, pendingAnnotation, pendingConfigName)
+	}
+	return nil
+}
+
 // CheckStateOnBoot is a core entrypoint for our state machine.
 // It determines whether we're in our desired state, or if we're
 // transitioning between states, and whether or not we need to update
@@ -746,7 +920,7 @@ func (dn *Daemon) getPendingConfig() (string, error) {
 // Some more background in this PR: https://github.com/openshift/machine-config-operator/pull/245
 func (dn *Daemon) CheckStateOnBoot() error {
 	// Print status if available
-	if dn.OperatingSystem == machineConfigDaemonOSRHCOS {
+	if dn.updater().name() == backendOSTree {
 		status, err := dn.NodeUpdaterClient.GetStatus()
 		if err != nil {
 			glog.Fatalf("unable to get rpm-ostree status: %s", err)
@@ -754,6 +928,27 @@ func (dn *Daemon) CheckStateOnBoot() error {
 		glog.Info(status)
 	}
 
+	// Pivots used to be left to pivot.service, which an earlier daemon may
+	// not have seen through
+	if err := dn.runLegacyPivot(); err != nil {
+		return err
+	}
+
+	// The daemon may have been killed in the middle of an update
+	resume, err := dn.recoverUpdateJournal()
+	if err != nil {
+		return errors.Wrapf(err, "recovering interrupted update")
+	}
+	if resume != nil {
+		// This only returns on error
+		return dn.rebootIntoConfig(resume)
+	}
+
+	// The reboot into the pending config may not have happened
+	if rebooting, err := dn.retryPendingReboot(); rebooting || err != nil {
+		return err
+	}
+
 	pendingConfigName, err := dn.getPendingConfig()
 	if err != nil {
 		return err
@@ -762,6 +957,9 @@ func (dn *Daemon) CheckStateOnBoot() error {
 	if err != nil {
 		return err
 	}
+	if err := checkPendingConfigAnnotation(dn.node, pendingConfigName); err != nil {
+		return err
+	}
 	if err := dn.detectEarlySSHAccessesFromBoot(); err != nil {
 		return fmt.Errorf("error detecting previous SSH accesses: %v", err)
 	}
@@ -775,7 +973,7 @@ func (dn *Daemon) CheckStateOnBoot() error {
 		if !osMatch {
 			glog.Infof("Bootstrap pivot required to: %s", targetOSImageURL)
 			// This only returns on error
-			return dn.updateOSAndReboot(state.currentConfig)
+			return dn.updateOSAndReboot(state.currentConfig, nil)
 		}
 		glog.Info("No bootstrap pivot required; unlinking bootstrap node annotations")
 
@@ -802,10 +1000,25 @@ func (dn *Daemon) CheckStateOnBoot() error {
 	} else {
 		expectedConfig = state.currentConfig
 	}
-	if isOnDiskValid := dn.validateOnDiskState(expectedConfig); !isOnDiskValid {
-		return errors.New("unexpected on-disk state")
+	skip, err := skipValidationOnce(pathForceValidation)
+	if err != nil {
+		return err
 	}
-	glog.Info("Validated on-disk state")
+	if skip {
+		glog.Warningf("Skipping on-disk state validation once: %s found", pathForceValidation)
+	} else if err := dn.validateOnDiskState(expectedConfig); err != nil {
+		if errors.Cause(err) != errOnDiskDrift || !dn.forceValidationRepair {
+			return errors.Wrapf(err, "unexpected on-disk state")
+		}
+		dn.logSystem("Repairing on-disk state: %v", err)
+		if err := dn.repairOnDiskState(expectedConfig); err != nil {
+			return errors.Wrapf(err, "unexpected on-disk state after repair")
+		}
+		glog.Info("Repaired on-disk state")
+	} else {
+		glog.Info("Validated on-disk state")
+	}
+	dn.publishBootedOS()
 
 	// We've validated our state.  In the case where we had a pendingConfig,
 	// make that now currentConfig.  We update the node annotation, delete the
@@ -815,23 +1028,33 @@ func (dn *Daemon) CheckStateOnBoot() error {
 	// were coming up, so we next look at that before uncordoning the node (so
 	// we don't uncordon and then immediately re-cordon)
 	if state.pendingConfig != nil {
-		if err := dn.nodeWriter.SetDone(dn.kubeClient.CoreV1().Nodes(), dn.nodeLister, dn.name, state.pendingConfig.GetName()); err != nil {
+		if err := dn.waitForHealthy(state.pendingConfig.GetName()); err != nil {
+			return err
+		}
+		if err := dn.waitForEtcdMembers(dn.name, etcdMemberTimeout); err != nil {
+			return errors.Wrapf(err, "waiting for the etcd member to rejoin")
+		}
+		ctx, cancel := nodeWriterContext()
+		defer cancel()
+		if err := dn.nodeWriter.RemoveUpdatingTaint(ctx); err != nil {
+			return err
+		}
+		if err := dn.nodeWriter.SetDone(ctx, state.pendingConfig.GetName()); err != nil {
 			return err
 		}
+		dn.recordUpdateFinished(state.pendingConfig.GetName(), true, nil)
+		dn.recordRebootReason(state.pendingConfig.GetName(), bootRebootReason(state.currentConfig, state.pendingConfig))
 		// And remove the pending state file
-		if err := os.Remove(pathStateJSON); err != nil {
+		if err := os.Remove(dn.stateFilePath); err != nil {
 			return errors.Wrapf(err, "removing transient state file")
 		}
+		dn.runPostUpdateHooks(state.currentConfig.GetName(), state.pendingConfig.GetName())
 
 		state.currentConfig = state.pendingConfig
 	}
 
-	mcJSON, err := json.Marshal(state.currentConfig)
-	if err != nil {
-		return err
-	}
-	// write a file with current fingerprint overriding the previous
-	if err := writeFileAtomicallyWithDefaults(currentConfigPath, mcJSON); err != nil {
+	// write a file with current fingerprint, keeping the previous one
+	if err := dn.storeCurrentConfig(state.currentConfig); err != nil {
 		return err
 	}
 
@@ -841,7 +1064,7 @@ func (dn *Daemon) CheckStateOnBoot() error {
 			// Great, we've successfully rebooted for the desired config,
 			// let's mark it done!
 			glog.Infof("Completing pending config %s", state.pendingConfig.GetName())
-			if err := dn.completeUpdate(dn.node, state.pendingConfig.GetName()); err != nil {
+			if err := dn.completeUpdate(state.pendingConfig.GetName()); err != nil {
 				return err
 			}
 		}
@@ -853,53 +1076,29 @@ func (dn *Daemon) CheckStateOnBoot() error {
 	}
 	// currentConfig != desiredConfig, and we're not booting up into the desiredConfig.
 	// Kick off an update.
-	return dn.triggerUpdateWithMachineConfig(state.currentConfig, state.desiredConfig)
-}
-
-// runOnceFromMachineConfig utilizes a parsed machineConfig and executes in onceFrom
-// mode. If the content was remote, it executes cluster calls, otherwise it assumes
-// no cluster is present yet.
-func (dn *Daemon) runOnceFromMachineConfig(machineConfig mcfgv1.MachineConfig, contentFrom onceFromOrigin) error {
-	if contentFrom == onceFromRemoteConfig {
-		if dn.kubeClient == nil || dn.mcClient == nil {
-			panic("running in onceFrom mode with a remote MachineConfig without a cluster")
-		}
-		// NOTE: This case expects a cluster to exists already.
-		current, desired, err := dn.prepUpdateFromCluster()
-		if err != nil {
-			dn.nodeWriter.SetDegraded(err, dn.kubeClient.CoreV1().Nodes(), dn.nodeLister, dn.name)
+	err = dn.triggerUpdateWithMachineConfig(state.currentConfig, state.desiredConfig)
+	if errors.Cause(err) == errRolledBack && state.pendingConfig != nil {
+		// we rebooted into the config rolled back to, which is done
+		if err := dn.completeUpdate(state.pendingConfig.GetName()); err != nil {
 			return err
 		}
-		if current == nil || desired == nil {
-			return nil
-		}
-		// At this point we have verified we need to update
-		if err := dn.triggerUpdateWithMachineConfig(current, &machineConfig); err != nil {
-			dn.nodeWriter.SetDegraded(err, dn.kubeClient.CoreV1().Nodes(), dn.nodeLister, dn.name)
-			return err
-		}
-		return nil
-	}
-	if contentFrom == onceFromLocalConfig {
-		// NOTE: This case expects that the cluster is NOT CREATED YET.
-		oldConfig := mcfgv1.MachineConfig{}
-		// Execute update without hitting the cluster
-		return dn.update(&oldConfig, &machineConfig)
 	}
-	// Otherwise return an error as the input format is unsupported
-	return fmt.Errorf("%s is not a path nor url; can not run once", dn.onceFrom)
+	return err
+}
+
+// runOnceFromMachineConfig utilizes a parsed machineConfig and executes in onceFrom
+// mode, whether it was read from a file or a URL. There is no prior state to
+// match against, and the cluster, if any, isn't involved.
+func (dn *Daemon) runOnceFromMachineConfig(machineConfig mcfgv1.MachineConfig) error {
+	oldConfig := mcfgv1.MachineConfig{}
+	// Execute update without hitting the cluster
+	return dn.update(&oldConfig, &machineConfig)
 }
 
 // runOnceFromIgnition executes MCD's subset of Ignition functionality in onceFrom mode
 func (dn *Daemon) runOnceFromIgnition(ignConfig ignv2_2types.Config) error {
 	// Execute update without hitting the cluster
-	if err := dn.writeFiles(ignConfig.Storage.Files); err != nil {
-		return err
-	}
-	if err := dn.writeUnits(ignConfig.Systemd.Units); err != nil {
-		return err
-	}
-	return dn.reboot("runOnceFromIgnition complete", defaultRebootTimeout, exec.Command(defaultRebootCommand))
+	return dn.update(&mcfgv1.MachineConfig{}, dn.ignitionMachineConfig(ignConfig))
 }
 
 func (dn *Daemon) handleNodeUpdate(old, cur interface{}) {
@@ -962,8 +1161,10 @@ func (dn *Daemon) prepUpdateFromCluster() (*mcfgv1.MachineConfig, *mcfgv1.Machin
 // completeUpdate marks the node as schedulable again, then deletes the
 // "transient state" file, which signifies that all of those prior steps have
 // been completed.
-func (dn *Daemon) completeUpdate(node *corev1.Node, desiredConfigName string) error {
-	if err := drain.Uncordon(dn.kubeClient.CoreV1().Nodes(), node, nil); err != nil {
+func (dn *Daemon) completeUpdate(desiredConfigName string) error {
+	ctx, cancel := nodeWriterContext()
+	defer cancel()
+	if err := dn.nodeWriter.SetUnschedulable(ctx, false, nil); err != nil {
 		return err
 	}
 
@@ -997,33 +1198,100 @@ func (dn *Daemon) triggerUpdateWithMachineConfig(currentConfig *mcfgv1.MachineCo
 		}
 	}
 
+	if err := checkRolledBack(pathRollbackState, desiredConfig); err != nil {
+		return err
+	}
+
+	if dn.isDryRun() {
+		glog.Infof("Dry run: not updating to %s", desiredConfig.GetName())
+		return dn.dryRunUpdate(currentConfig, desiredConfig)
+	}
+
+	if nodeHeld(dn.node) && currentConfig.GetName() != desiredConfig.GetName() {
+		return dn.holdUpdate(desiredConfig)
+	}
+
 	// run the update process. this function doesn't currently return.
 	return dn.update(currentConfig, desiredConfig)
 }
 
+// nodeHeld returns whether node has the hold annotation set to "true".
+func nodeHeld(node *corev1.Node) bool {
+	return node != nil && node.Annotations[constants.NodeHoldAnnotationKey] == "true"
+}
+
+// holdUpdate leaves the update to desiredConfig for later, marking the node
+// Held unless it already is. Removing the hold annotation updates the node,
+// which syncs it again.
+func (dn *Daemon) holdUpdate(desiredConfig *mcfgv1.MachineConfig) error {
+	if dn.node.Annotations[constants.MachineConfigDaemonStateAnnotationKey] == constants.MachineConfigDaemonStateHeld {
+		return nil
+	}
+	glog.Infof("Node is held, not updating to %s", desiredConfig.GetName())
+	ctx, cancel := nodeWriterContext()
+	defer cancel()
+	return dn.nodeWriter.SetHeld(ctx, desiredConfig.GetName())
+}
+
 // validateOnDiskState compares the on-disk state against what a configuration
 // specifies.  If for example an admin ssh'd into a node, or another operator
 // is stomping on our files, we want to highlight that and mark the system
-// degraded.
-func (dn *Daemon) validateOnDiskState(currentConfig *mcfgv1.MachineConfig) bool {
+// degraded. Drifted files and units are reported by an error wrapping
+// errOnDiskDrift.
+func (dn *Daemon) validateOnDiskState(currentConfig *mcfgv1.MachineConfig) error {
 	// Be sure we're booted into the OS we expect
 	osMatch, err := dn.checkOS(currentConfig.Spec.OSImageURL)
 	if err != nil {
-		glog.Errorf("%s", err)
-		return false
+		return err
 	}
 	if !osMatch {
-		glog.Errorf("expected target osImageURL %s", currentConfig.Spec.OSImageURL)
-		return false
+		return fmt.Errorf("expected target osImageURL %s, booted %s", currentConfig.Spec.OSImageURL, dn.bootedOSImageURL)
+	}
+	// with the kernel arguments we expect
+	if err := dn.checkBootedKernelArguments(currentConfig); err != nil {
+		return err
+	}
+	// in the FIPS mode we expect
+	if err := dn.checkFIPS(currentConfig); err != nil {
+		return err
 	}
 	// And the rest of the disk state
-	if !checkFiles(currentConfig.Spec.Config.Storage.Files) {
-		return false
+	drifted := append(checkFiles(currentConfig.Spec.Config.Storage.Files), checkLinks(currentConfig.Spec.Config.Storage.Links)...)
+	drifted = append(drifted, checkUnits(currentConfig.Spec.Config.Systemd.Units)...)
+	if len(drifted) > 0 {
+		return errors.Wrapf(errOnDiskDrift, "%s", strings.Join(drifted, ", "))
 	}
-	if !checkUnits(currentConfig.Spec.Config.Systemd.Units) {
-		return false
+	return nil
+}
+
+// repairOnDiskState rewrites the files, links and units of config, for when
+// validateOnDiskState found them drifted and repairs are enabled.
+func (dn *Daemon) repairOnDiskState(config *mcfgv1.MachineConfig) error {
+	if err := dn.writeFiles(config.Spec.Config.Storage.Files); err != nil {
+		return errors.Wrapf(err, "repairing files")
 	}
-	return true
+	if err := dn.writeLinks(config.Spec.Config.Storage.Links); err != nil {
+		return errors.Wrapf(err, "repairing links")
+	}
+	if err := dn.writeUnits(config.Spec.Config.Systemd.Units); err != nil {
+		return errors.Wrapf(err, "repairing units")
+	}
+	return dn.validateOnDiskState(config)
+}
+
+// skipValidationOnce returns whether the force file exists, consuming it so
+// that only this validation is skipped.
+func skipValidationOnce(forceFile string) (bool, error) {
+	if _, err := os.Stat(forceFile); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := os.Remove(forceFile); err != nil {
+		return false, errors.Wrapf(err, "removing %s", forceFile)
+	}
+	return true, nil
 }
 
 // getRefDigest parses a Docker/OCI image reference and returns
@@ -1076,14 +1344,14 @@ func compareOSImageURL(current, desired string) (bool, error) {
 
 // checkOS determines whether the booted system matches the target
 // osImageURL and if not whether we need to take action.  This function
-// returns `true` if no action is required, which is the case if we're
-// not running RHCOS, or if the target osImageURL is "" (unspecified),
+// returns `true` if no action is required, which is the case if the update
+// backend doesn't manage the OS image, or if the target osImageURL is "" (unspecified),
 // or if the digests match.
 // Otherwise if `false` is returned, then we need to perform an update.
 func (dn *Daemon) checkOS(osImageURL string) (bool, error) {
-	// Nothing to do if we're not on RHCOS
-	if dn.OperatingSystem != machineConfigDaemonOSRHCOS {
-		glog.Infof(`Not booted into Red Hat CoreOS, ignoring target OSImageURL %s`, osImageURL)
+	// Nothing to do if the OS image isn't ours to update
+	if !dn.updater().managesOSImage() {
+		glog.Infof(`The %s update backend doesn't update the OS image, ignoring target OSImageURL %s`, dn.updater().name(), osImageURL)
 		return true, nil
 	}
 
@@ -1091,91 +1359,130 @@ func (dn *Daemon) checkOS(osImageURL string) (bool, error) {
 }
 
 // checkUnits validates the contents of all the units in the
-// target config and retursn true if they match.
-func checkUnits(units []ignv2_2types.Unit) bool {
+// target config and returns the drift of those which don't match.
+func checkUnits(units []ignv2_2types.Unit) []string {
+	var drifted []string
 	for _, u := range units {
 		for j := range u.Dropins {
 			path := filepath.Join(pathSystemd, u.Name+".d", u.Dropins[j].Name)
-			if status := checkFileContentsAndMode(path, []byte(u.Dropins[j].Contents), defaultFilePermissions); !status {
-				return false
+			if drift := checkFileContentsAndMode(path, []byte(u.Dropins[j].Contents), defaultFilePermissions, -1, -1); drift != "" {
+				drifted = append(drifted, drift)
 			}
 		}
 
-		if u.Contents == "" {
+		path := filepath.Join(pathSystemd, u.Name)
+		masked, err := isMasked(path)
+		if err != nil {
+			glog.Errorf("state validation: error while evaluation symlink for path: %q, err: %v", path, err)
+			drifted = append(drifted, fmt.Sprintf("%s (%v)", path, err))
 			continue
 		}
-
-		path := filepath.Join(pathSystemd, u.Name)
 		if u.Mask {
-			link, err := filepath.EvalSymlinks(path)
-			if err != nil {
-				glog.Errorf("state validation: error while evaluation symlink for path: %q, err: %v", path, err)
-				return false
-			}
-			if strings.Compare(pathDevNull, link) != 0 {
-				glog.Errorf("state validation: invalid unit masked setting. path: %q; expected: %v; received: %v", path, pathDevNull, link)
-				return false
+			if !masked {
+				glog.Errorf("state validation: invalid unit masked setting. path: %q; expected: %v", path, pathDevNull)
+				drifted = append(drifted, fmt.Sprintf("%s (not masked)", path))
 			}
+			continue
+		}
+		if masked {
+			glog.Errorf("state validation: unit %q is masked", path)
+			drifted = append(drifted, fmt.Sprintf("%s (masked)", path))
+			continue
+		}
+
+		if u.Contents == "" {
+			continue
 		}
-		if status := checkFileContentsAndMode(path, []byte(u.Contents), defaultFilePermissions); !status {
-			return false
+		if drift := checkFileContentsAndMode(path, []byte(u.Contents), defaultFilePermissions, -1, -1); drift != "" {
+			drifted = append(drifted, drift)
 		}
 
 	}
-	return true
+	return drifted
 }
 
 // checkFiles validates the contents of  all the files in the
-// target config.
-func checkFiles(files []ignv2_2types.File) bool {
+// target config and returns the drift of those which don't match.
+func checkFiles(files []ignv2_2types.File) []string {
+	var drifted []string
 	checkedFiles := make(map[string]bool)
+	appended := appendedPaths(files)
 	for i := len(files) - 1; i >= 0; i-- {
 		f := files[i]
 		// skip over checked validated files
 		if _, ok := checkedFiles[f.Path]; ok {
 			continue
 		}
+		checkedFiles[f.Path] = true
+		if appended[f.Path] {
+			assembled, err := assembleFile(files, f.Path)
+			if err != nil {
+				glog.Errorf("couldn't assemble file: %v", err)
+				drifted = append(drifted, fmt.Sprintf("%s (invalid contents in config)", f.Path))
+				continue
+			}
+			f = assembled
+		}
 		mode := defaultFilePermissions
 		if f.Mode != nil {
 			mode = os.FileMode(*f.Mode)
 		}
-		contents, err := dataurl.DecodeString(f.Contents.Source)
+		contents, err := decodeFileContents(f)
 		if err != nil {
-			glog.Errorf("couldn't parse file: %v", err)
-			return false
+			glog.Errorf("couldn't get the contents of file: %v", err)
+			drifted = append(drifted, fmt.Sprintf("%s (invalid contents in config)", f.Path))
+			continue
 		}
-		if status := checkFileContentsAndMode(f.Path, contents.Data, mode); !status {
-			return false
+		// like writeFiles, only check the ownership when the config sets it
+		uid, gid := -1, -1
+		if f.User != nil || f.Group != nil {
+			uid, gid, err = getFileOwnership(f)
+			if err != nil {
+				glog.Errorf("couldn't resolve ownership of file: %v", err)
+				drifted = append(drifted, fmt.Sprintf("%s (unknown owner)", f.Path))
+				continue
+			}
+		}
+		if drift := checkFileContentsAndMode(f.Path, contents, mode, uid, gid); drift != "" {
+			drifted = append(drifted, drift)
 		}
-		checkedFiles[f.Path] = true
 	}
-	return true
+	return drifted
 }
 
 // checkFileContentsAndMode reads the file from the filepath and compares its
-// contents and mode with the expectedContent and mode parameters. It logs an
-// error in case of an error or mismatch and returns the status of the
-// evaluation.
-func checkFileContentsAndMode(filePath string, expectedContent []byte, mode os.FileMode) bool {
+// contents, mode and, unless uid and gid are -1, ownership with the expected
+// ones, and its SELinux label with the default one. It logs an error in case of an error or mismatch and returns the path
+// along with what differs, or "" if nothing does.
+func checkFileContentsAndMode(filePath string, expectedContent []byte, mode os.FileMode, uid, gid int) string {
 	fi, err := os.Lstat(filePath)
 	if err != nil {
 		glog.Errorf("could not stat file: %q, error: %v", filePath, err)
-		return false
+		if os.IsNotExist(err) {
+			return fmt.Sprintf("%s (missing)", filePath)
+		}
+		return fmt.Sprintf("%s (%v)", filePath, err)
 	}
 	if fi.Mode() != mode {
 		glog.Errorf("mode mismatch for file: %q; expected: %v; received: %v", filePath, mode, fi.Mode())
-		return false
+		return fmt.Sprintf("%s (mode %v, expected %v)", filePath, fi.Mode(), mode)
+	}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok && uid != -1 && gid != -1 {
+		if int(stat.Uid) != uid || int(stat.Gid) != gid {
+			glog.Errorf("owner mismatch for file: %q; expected: %d:%d; received: %d:%d", filePath, uid, gid, stat.Uid, stat.Gid)
+			return fmt.Sprintf("%s (owner %d:%d, expected %d:%d)", filePath, stat.Uid, stat.Gid, uid, gid)
+		}
 	}
 	contents, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		glog.Errorf("could not read file: %q, error: %v", filePath, err)
-		return false
+		return fmt.Sprintf("%s (%v)", filePath, err)
 	}
 	if !bytes.Equal(contents, expectedContent) {
 		glog.Errorf("content mismatch for file: %q", filePath)
-		return false
+		return fmt.Sprintf("%s (contents)", filePath)
 	}
-	return true
+	return checkLabel(filePath)
 }
 
 // Close closes all the connections the node agent has open for it's lifetime
@@ -1194,45 +1501,36 @@ func ValidPath(path string) bool {
 }
 
 // senseAndLoadOnceFrom gets a hold of the content for supported onceFrom configurations,
-// parses to verify the type, and returns back the genericInterface, the type description,
-// if it was local or remote, and error.
-func (dn *Daemon) senseAndLoadOnceFrom() (interface{}, onceFromOrigin, error) {
+// parses to verify the type, and returns back the genericInterface and error.
+func (dn *Daemon) senseAndLoadOnceFrom() (interface{}, error) {
 	var (
-		content     []byte
-		contentFrom onceFromOrigin
+		content []byte
+		err     error
 	)
 	// Read the content from a remote endpoint if requested
 	if strings.HasPrefix(dn.onceFrom, "http://") || strings.HasPrefix(dn.onceFrom, "https://") {
-		contentFrom = onceFromRemoteConfig
-		resp, err := http.Get(dn.onceFrom)
+		content, err = dn.fetchOnceFrom(dn.onceFrom)
 		if err != nil {
-			return nil, contentFrom, err
-		}
-		defer resp.Body.Close()
-		// Read the body content from the request
-		content, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, contentFrom, err
+			return nil, err
 		}
-
 	} else {
 		// Otherwise read it from a local file
-		contentFrom = onceFromLocalConfig
 		absoluteOnceFrom, err := filepath.Abs(filepath.Clean(dn.onceFrom))
 		if err != nil {
-			return nil, contentFrom, err
+			return nil, err
 		}
 		content, err = ioutil.ReadFile(absoluteOnceFrom)
 		if err != nil {
-			return nil, contentFrom, err
+			return nil, err
 		}
 	}
 
-	// Try each supported parser
-	ignConfig, _, err := ignv2.Parse(content)
+	// Try each supported parser, Ignition configs of the 3.0 spec are
+	// translated
+	ignConfig, err := ignition.Parse(content)
 	if err == nil && ignConfig.Ignition.Version != "" {
 		glog.V(2).Info("onceFrom file is of type Ignition")
-		return ignConfig, contentFrom, nil
+		return ignConfig, nil
 	}
 
 	glog.V(2).Infof("%s is not an Ignition config: %v. Trying MachineConfig.", dn.onceFrom, err)
@@ -1241,8 +1539,8 @@ func (dn *Daemon) senseAndLoadOnceFrom() (interface{}, onceFromOrigin, error) {
 	mc, err := resourceread.ReadMachineConfigV1(content)
 	if err == nil && mc != nil {
 		glog.V(2).Info("onceFrom file is of type MachineConfig")
-		return *mc, contentFrom, nil
+		return *mc, nil
 	}
 
-	return nil, onceFromUnknownConfig, fmt.Errorf("unable to decipher onceFrom config type: %v", err)
+	return nil, fmt.Errorf("unable to decipher onceFrom config type: %v", err)
 }
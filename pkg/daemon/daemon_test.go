@@ -1,15 +1,23 @@
 package daemon
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 
 	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
 	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/vincent-petithory/dataurl"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
 )
 
 var pathtests = []struct {
@@ -55,8 +63,8 @@ func TestOverwrittenFile(t *testing.T) {
 		},
 	}
 
-	if status := checkFiles(files); !status {
-		t.Errorf("Invalid files")
+	if drifted := checkFiles(files); len(drifted) != 0 {
+		t.Errorf("Invalid files: %v", drifted)
 	}
 
 	// validate overwritten file
@@ -85,8 +93,8 @@ func TestOverwrittenFile(t *testing.T) {
 		},
 	}
 
-	if status := checkFiles(files); !status {
-		t.Errorf("Validating an overwritten file failed")
+	if drifted := checkFiles(files); len(drifted) != 0 {
+		t.Errorf("Validating an overwritten file failed: %v", drifted)
 	}
 }
 
@@ -130,6 +138,8 @@ func TestDaemonOnceFromNoPanic(t *testing.T) {
 		"testos",
 		NewNodeUpdaterClient(),
 		"test",
+		"",
+		false,
 		false,
 		nil,
 		k8sfake.NewSimpleClientset(),
@@ -142,3 +152,150 @@ func TestDaemonOnceFromNoPanic(t *testing.T) {
 	require.Nil(t, err)
 	require.NotPanics(t, func() { dn.triggerUpdateWithMachineConfig(&mcfgv1.MachineConfig{}, &mcfgv1.MachineConfig{}) })
 }
+
+func TestHoldUpdate(t *testing.T) {
+	assert.False(t, nodeHeld(nil))
+	assert.False(t, nodeHeld(newTestNode("node-0", map[string]string{constants.NodeHoldAnnotationKey: "false"})))
+	assert.True(t, nodeHeld(newTestNode("node-0", map[string]string{constants.NodeHoldAnnotationKey: "true"})))
+
+	node := newTestNode("node-0", map[string]string{constants.NodeHoldAnnotationKey: "true"})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+	recorder := record.NewFakeRecorder(10)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(recorder)
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+	go nw.Run(stopCh)
+
+	dn := &Daemon{node: node, nodeWriter: nw}
+	desired := &mcfgv1.MachineConfig{ObjectMeta: metav1.ObjectMeta{Name: "rendered-worker-1"}}
+	require.Nil(t, dn.holdUpdate(desired))
+	updated, err := client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, constants.MachineConfigDaemonStateHeld, updated.Annotations[constants.MachineConfigDaemonStateAnnotationKey])
+
+	// a node already held isn't written again
+	dn.node = updated
+	require.Nil(t, dn.holdUpdate(desired))
+	close(recorder.Events)
+	var events []string
+	for e := range recorder.Events {
+		events = append(events, e)
+	}
+	assert.Len(t, events, 1)
+}
+
+func TestCheckPendingConfigAnnotation(t *testing.T) {
+	tests := []struct {
+		annotation string
+		onDisk     string
+		valid      bool
+	}{
+		// no reboot in flight
+		{"", "", true},
+		// rebooted by a daemon that didn't set the annotation
+		{"", "rendered-worker-1", true},
+		{"rendered-worker-1", "rendered-worker-1", true},
+		{"rendered-worker-1", "rendered-worker-2", false},
+		// the on-disk state was lost across the reboot
+		{"rendered-worker-1", "", false},
+	}
+	for _, tc := range tests {
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+		if tc.annotation != "" {
+			node.Annotations[constants.PendingMachineConfigAnnotationKey] = tc.annotation
+		}
+		err := checkPendingConfigAnnotation(node, tc.onDisk)
+		if tc.valid {
+			require.Nil(t, err, "annotation %q, on disk %q", tc.annotation, tc.onDisk)
+		} else {
+			require.NotNil(t, err, "annotation %q, on disk %q", tc.annotation, tc.onDisk)
+		}
+	}
+}
+
+func TestValidateOnDiskStateDrift(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-validate")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	mode := 0644
+	newFile := func(name, contents string) ignv2_2types.File {
+		return ignv2_2types.File{
+			Node: ignv2_2types.Node{Path: filepath.Join(dir, name)},
+			FileEmbedded1: ignv2_2types.FileEmbedded1{
+				Contents: ignv2_2types.FileContents{Source: dataurl.EncodeBytes([]byte(contents))},
+				Mode:     &mode,
+			},
+		}
+	}
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "good"), []byte("good"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "edited"), []byte("hand edited"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "chmoded"), []byte("chmoded"), 0644))
+	require.Nil(t, os.Chmod(filepath.Join(dir, "chmoded"), 0600))
+
+	config := &mcfgv1.MachineConfig{}
+	config.Spec.Config.Storage.Files = []ignv2_2types.File{
+		newFile("good", "good"),
+		newFile("edited", "edited"),
+		newFile("chmoded", "chmoded"),
+		newFile("missing", "missing"),
+	}
+
+	dn := &Daemon{
+		OperatingSystem:  machineConfigDaemonOSCENTOS,
+		ownedFilesPath:   filepath.Join(dir, "owned-files.json"),
+		originalFilesDir: filepath.Join(dir, "orig"),
+	}
+	err = dn.validateOnDiskState(config)
+	require.NotNil(t, err)
+	require.Equal(t, errOnDiskDrift, errors.Cause(err))
+	for _, drift := range []string{
+		filepath.Join(dir, "edited") + " (contents)",
+		filepath.Join(dir, "chmoded") + " (mode -rw-------, expected -rw-r--r--)",
+		filepath.Join(dir, "missing") + " (missing)",
+	} {
+		require.Contains(t, err.Error(), drift)
+	}
+	require.NotContains(t, err.Error(), filepath.Join(dir, "good"))
+
+	// repairing rewrites the drifted files
+	require.Nil(t, dn.repairOnDiskState(config))
+	require.Nil(t, dn.validateOnDiskState(config))
+}
+
+func TestSkipValidationOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-force")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	forceFile := filepath.Join(dir, "force")
+
+	skip, err := skipValidationOnce(forceFile)
+	require.Nil(t, err)
+	require.False(t, skip)
+
+	require.Nil(t, ioutil.WriteFile(forceFile, nil, 0644))
+	skip, err = skipValidationOnce(forceFile)
+	require.Nil(t, err)
+	require.True(t, skip)
+
+	// the force file only skips a single validation
+	skip, err = skipValidationOnce(forceFile)
+	require.Nil(t, err)
+	require.False(t, skip)
+}
+
+func TestWaitWorkingReported(t *testing.T) {
+	dn := &Daemon{}
+	assert.Nil(t, dn.waitWorkingReported(), "there is nothing to wait for outside of updates")
+
+	dn.working = failedWrite(nil)
+	assert.Nil(t, dn.waitWorkingReported())
+
+	dn.working = failedWrite(errNodeWriterClosed)
+	err := dn.waitWorkingReported()
+	require.NotNil(t, err, "the node isn't drained without the Working state")
+	assert.Equal(t, errNodeWriterClosed, errors.Cause(err))
+}
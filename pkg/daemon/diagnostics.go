@@ -0,0 +1,120 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// journalExcerptLines is how many of the last lines of the journal of a
+	// failing unit are attached to the error
+	journalExcerptLines = 50
+	// maxExcerptLength caps the excerpt attached to an error, as it ends up in
+	// the Degraded reason; the end of the output is kept
+	maxExcerptLength = 2048
+	// minSecretLength is the length from which the values of secret
+	// environment variables are redacted from outputs
+	minSecretLength = 4
+)
+
+var (
+	// ansiEscape matches the CSI and OSC sequences tools color and decorate
+	// their output with, and the two-character escapes
+	ansiEscape = regexp.MustCompile(`\x1b(\[[0-9;?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)|[@-Z\\-_])`)
+	// secretName matches the names of variables likely to hold secrets
+	secretName = `[A-Za-z0-9_]*(?i:password|passwd|secret|token|credential|api_?key|auth)[A-Za-z0-9_]*`
+	// secretAssignment matches NAME=value assignments of such variables, as
+	// echoed by commands and units
+	secretAssignment = regexp.MustCompile(`\b(` + secretName + `)=("[^"]*"|'[^']*'|\S+)`)
+	secretNameRegexp = regexp.MustCompile(`^` + secretName + `$`)
+)
+
+// sanitizeOutput strips the ANSI escapes of s and redacts the secrets it may
+// echo: assignments of variables named like secrets, and the values of the
+// environment variables of the daemon named like secrets.
+func sanitizeOutput(s string) string {
+	s = ansiEscape.ReplaceAllString(s, "")
+	s = secretAssignment.ReplaceAllString(s, "$1=<redacted>")
+	for _, kv := range os.Environ() {
+		i := strings.Index(kv, "=")
+		if i < 0 || !secretNameRegexp.MatchString(kv[:i]) || len(kv[i+1:]) < minSecretLength {
+			continue
+		}
+		s = strings.Replace(s, kv[i+1:], "<redacted>", -1)
+	}
+	return strings.TrimSpace(s)
+}
+
+// tailExcerpt returns the end of s within maxExcerptLength bytes, starting on
+// a line when it is cut.
+func tailExcerpt(s string) string {
+	if len(s) <= maxExcerptLength {
+		return s
+	}
+	s = s[len(s)-maxExcerptLength:]
+	if i := strings.Index(s, "\n"); i >= 0 {
+		return "...\n" + s[i+1:]
+	}
+	// a single line, don't start it with a partial character
+	for i := 0; i < len(s) && i < utf8.UTFMax; i++ {
+		if utf8.RuneStart(s[i]) {
+			return "..." + s[i:]
+		}
+	}
+	return "..." + s
+}
+
+// excerptError is err with the excerpt of output it came with.
+type excerptError struct {
+	err     error
+	source  string
+	excerpt string
+}
+
+func (e *excerptError) Error() string {
+	return fmt.Sprintf("%v; last lines of the %s:\n%s", e.err, e.source, e.excerpt)
+}
+
+// Cause makes errors.Cause see through the excerpt.
+func (e *excerptError) Cause() error {
+	return e.err
+}
+
+// withExcerpt attaches the end of output, read from source, to err. The whole
+// output is logged between markers.
+func withExcerpt(err error, source, output string) error {
+	output = sanitizeOutput(output)
+	if output == "" {
+		return err
+	}
+	glog.Errorf("%v\n----- BEGIN %s -----\n%s\n----- END %s -----", err, source, output, source)
+	return &excerptError{err: err, source: source, excerpt: tailExcerpt(output)}
+}
+
+// unitJournal returns the last journalExcerptLines lines the journal of unit
+// got since, it is swapped out by tests.
+var unitJournal = func(unit string, since time.Time) (string, error) {
+	out, err := exec.Command("journalctl", "-b", "-u", unit, "--no-pager", "-o", "cat",
+		"--since", fmt.Sprintf("@%d", since.Unix()), "-n", fmt.Sprintf("%d", journalExcerptLines)).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// withUnitJournal attaches the journal of unit since to err.
+func withUnitJournal(err error, unit string, since time.Time) error {
+	out, jerr := unitJournal(unit, since)
+	if jerr != nil {
+		glog.Warningf("Unable to read the journal of %s: %v", unit, jerr)
+		return err
+	}
+	return withExcerpt(err, unit+" journal", out)
+}
@@ -0,0 +1,58 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeOutput(t *testing.T) {
+	os.Setenv("MCD_TEST_TOKEN", "s3cr3t-value")
+	defer os.Unsetenv("MCD_TEST_TOKEN")
+
+	out := sanitizeOutput("\x1b[0;1;31mFailed\x1b[0m to start foo.service\n" +
+		"Environment: HTTP_PROXY=http://proxy PROXY_PASSWORD=hunter2 api_key='abc def'\n" +
+		"login with s3cr3t-value\n")
+	assert.Equal(t, "Failed to start foo.service\n"+
+		"Environment: HTTP_PROXY=http://proxy PROXY_PASSWORD=<redacted> api_key=<redacted>\n"+
+		"login with <redacted>", out)
+}
+
+func TestTailExcerpt(t *testing.T) {
+	assert.Equal(t, "short", tailExcerpt("short"))
+
+	var lines []string
+	for i := 0; i < 1000; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	excerpt := tailExcerpt(strings.Join(lines, "\n"))
+	assert.True(t, len(excerpt) <= maxExcerptLength+len("...\n"))
+	assert.True(t, strings.HasPrefix(excerpt, "...\nline "))
+	assert.True(t, strings.HasSuffix(excerpt, "\nline 999"))
+
+	// a single line isn't cut in the middle of a character
+	excerpt = tailExcerpt(strings.Repeat("é", maxExcerptLength))
+	assert.Equal(t, "..."+strings.Repeat("é", maxExcerptLength/2), excerpt)
+}
+
+func TestWithUnitJournal(t *testing.T) {
+	origJournal := unitJournal
+	defer func() { unitJournal = origJournal }()
+	unitJournal = func(unit string, since time.Time) (string, error) {
+		return fmt.Sprintf("%s: \x1b[31mbad config\x1b[0m\n", unit), nil
+	}
+
+	err := withUnitJournal(errors.Wrap(errLiveUpdateFailed, "failed to run systemctl restart crio.service: exit status 1"), "crio.service", time.Now())
+	assert.Equal(t, "failed to run systemctl restart crio.service: exit status 1: live update failed; last lines of the crio.service journal:\ncrio.service: bad config", err.Error())
+	assert.Equal(t, errLiveUpdateFailed, errors.Cause(err))
+
+	// nothing to attach
+	unitJournal = func(unit string, since time.Time) (string, error) { return "", nil }
+	orig := fmt.Errorf("boom")
+	assert.Equal(t, orig, withUnitJournal(orig, "crio.service", time.Now()))
+}
@@ -0,0 +1,393 @@
+package daemon
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	drain "github.com/openshift/kubernetes-drain"
+	errors "github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// DefaultDrainTimeout is how long a drain is retried before giving up
+	DefaultDrainTimeout = time.Hour
+	// drainTimeoutAnnotationKey overrides the drain timeout of a node, as a
+	// duration like "2h"
+	drainTimeoutAnnotationKey = "machineconfiguration.openshift.io/drain-timeout"
+	// drainBlockedEventInterval is how often an event is emitted while the
+	// drain is blocked
+	drainBlockedEventInterval = 5 * time.Minute
+	// drainRetryInterval and maxDrainRetryInterval bound the wait between
+	// drain attempts, which doubles after each failure
+	drainRetryInterval    = 10 * time.Second
+	maxDrainRetryInterval = 5 * time.Minute
+	// mirrorPodAnnotationKey marks static pods, which can't be evicted and
+	// don't block a drain
+	mirrorPodAnnotationKey = "kubernetes.io/config.mirror"
+	// skipDrainAnnotationKey set to "true" on a node, or on a pool for all
+	// its nodes, skips the drain of updates: the node is cordoned and
+	// tainted, then rebooted without evicting its pods
+	skipDrainAnnotationKey = "machineconfiguration.openshift.io/skip-drain"
+	// drainForceAfterAnnotationKey on a pool overrides the --drain-force-after
+	// of the daemons of its nodes, as a duration like "30m"
+	drainForceAfterAnnotationKey = "machineconfiguration.openshift.io/drain-force-after"
+	// drainPodTimeout is how long each drain attempt waits for the evicted
+	// pods to be gone
+	drainPodTimeout = 5 * time.Minute
+	// configSourceAnnotationKey is set by the kubelet to where it got a pod
+	// from, "file" or "http" for static pods
+	configSourceAnnotationKey = "kubernetes.io/config.source"
+)
+
+// errDrainTimeout is returned when a node couldn't be drained within its
+// drain timeout.
+var errDrainTimeout = errors.New("drain timed out")
+
+// nodeDrainTimeout returns how long draining node is retried: its drain-timeout
+// annotation if set and valid, otherwise def.
+func nodeDrainTimeout(node *corev1.Node, def time.Duration) time.Duration {
+	if def <= 0 {
+		def = DefaultDrainTimeout
+	}
+	if node == nil {
+		return def
+	}
+	value, ok := node.Annotations[drainTimeoutAnnotationKey]
+	if !ok {
+		return def
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		glog.Warningf("Ignoring invalid %s annotation %q, using %v", drainTimeoutAnnotationKey, value, def)
+		return def
+	}
+	return timeout
+}
+
+// skipDrainReason returns why the drain of node is skipped, "" if it isn't:
+// when it or one of its pools has the skip-drain annotation, or when it is
+// the only node of the cluster and its pods have nowhere to go.
+func (dn *Daemon) skipDrainReason(node *corev1.Node) string {
+	if node.Annotations[skipDrainAnnotationKey] == "true" {
+		return fmt.Sprintf("the node has %s=true", skipDrainAnnotationKey)
+	}
+	if pool, value, err := dn.nodePoolAnnotation(node, skipDrainAnnotationKey); err != nil {
+		glog.Warningf("Unable to check the pools of the node for %s: %v", skipDrainAnnotationKey, err)
+	} else if value == "true" {
+		return fmt.Sprintf("pool %s has %s=true", pool, skipDrainAnnotationKey)
+	}
+	if dn.nodeLister != nil {
+		nodes, err := dn.nodeLister.List(labels.Everything())
+		if err != nil {
+			glog.Warningf("Unable to count the nodes of the cluster: %v", err)
+		} else if len(nodes) == 1 && nodes[0].GetName() == node.GetName() {
+			return "it is the only node of the cluster"
+		}
+	}
+	return ""
+}
+
+// nodePoolAnnotation returns the first pool selecting node which has the
+// annotation key, and its value; "" if none has.
+func (dn *Daemon) nodePoolAnnotation(node *corev1.Node, key string) (string, string, error) {
+	if dn.mcClient == nil {
+		return "", "", nil
+	}
+	pools, err := dn.mcClient.MachineconfigurationV1().MachineConfigPools().List(metav1.ListOptions{})
+	if err != nil {
+		return "", "", err
+	}
+	for _, pool := range pools.Items {
+		value, ok := pool.Annotations[key]
+		if !ok {
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(pool.Spec.NodeSelector)
+		if err != nil {
+			glog.Warningf("Ignoring pool %s with an invalid node selector: %v", pool.GetName(), err)
+			continue
+		}
+		if !selector.Empty() && selector.Matches(labels.Set(node.Labels)) {
+			return pool.GetName(), value, nil
+		}
+	}
+	return "", "", nil
+}
+
+// nodeDrainForceAfter returns how long into the drain of node the pods stuck
+// evicting are deleted: the drain-force-after annotation of its pool if set
+// and valid, otherwise the --drain-force-after of the daemon. Zero never
+// deletes them.
+func (dn *Daemon) nodeDrainForceAfter(node *corev1.Node) time.Duration {
+	pool, value, err := dn.nodePoolAnnotation(node, drainForceAfterAnnotationKey)
+	if err != nil {
+		glog.Warningf("Unable to check the pools of the node for %s: %v", drainForceAfterAnnotationKey, err)
+		return dn.drainForceAfter
+	}
+	if pool == "" {
+		return dn.drainForceAfter
+	}
+	forceAfter, err := time.ParseDuration(value)
+	if err != nil || forceAfter < 0 {
+		glog.Warningf("Ignoring invalid %s annotation %q of pool %s, using %v", drainForceAfterAnnotationKey, value, pool, dn.drainForceAfter)
+		return dn.drainForceAfter
+	}
+	return forceAfter
+}
+
+// drainNode evicts the pods of the already cordoned node, retrying until its
+// drain timeout. While blocked an event listing the pods left is emitted every
+// drainBlockedEventInterval; once timed out, the returned error wraps
+// errDrainTimeout and lists the pods and PDBs which blocked the drain. Past
+// its nodeDrainForceAfter, the pods still left are deleted instead, see
+// forceDeletePods. Between attempts the drain stops with the error of
+// canceled, when the update draining the node was canceled.
+func (dn *Daemon) drainNode(node *corev1.Node, canceled func(phase string) error) (retErr error) {
+	started := time.Now()
+	defer func() {
+		drainDuration.Observe(time.Since(started).Seconds())
+		if _, ok := retErr.(*updateCanceledError); retErr != nil && !ok {
+			drainErrors.Inc()
+		}
+	}()
+	timeout := nodeDrainTimeout(node, dn.drainTimeout)
+	deadline := time.Now().Add(timeout)
+	forceAfter := dn.nodeDrainForceAfter(node)
+	forced := make(map[string]bool)
+
+	stopEvents := make(chan struct{})
+	defer close(stopEvents)
+	go dn.reportBlockedDrain(node, stopEvents)
+	dn.recordDrainProgress(fmt.Sprintf("draining, timeout %v", timeout))
+	defer dn.recordDrainProgress("")
+
+	interval := drainRetryInterval
+	var lastErr error
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+		// evict, waiting for the pods for a while only, so the pods stuck
+		// are force deleted in time
+		attemptTimeout := remaining
+		if attemptTimeout > drainPodTimeout {
+			attemptTimeout = drainPodTimeout
+		}
+		err := drain.Drain(dn.kubeClient, []*corev1.Node{node}, &drain.DrainOptions{
+			DeleteLocalData:    true,
+			Force:              true,
+			GracePeriodSeconds: 600,
+			IgnoreDaemonsets:   true,
+			Timeout:            attemptTimeout,
+		})
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		glog.Infof("Draining failed with: %v, retrying", err)
+		dn.recordDrainProgress(fmt.Sprintf("retrying, %v left, last error: %v", time.Until(deadline).Round(time.Second), err))
+		if forceAfter > 0 && time.Since(started) >= forceAfter {
+			dn.forceDeletePods(node, time.Since(started), forced)
+		}
+
+		if remaining = time.Until(deadline); remaining <= 0 {
+			break
+		}
+		if interval > remaining {
+			interval = remaining
+		}
+		dn.exitIfTerminating("while draining")
+		if err := canceled(updatePhaseDraining); err != nil {
+			return err
+		}
+		time.Sleep(interval)
+		if interval *= 2; interval > maxDrainRetryInterval {
+			interval = maxDrainRetryInterval
+		}
+	}
+
+	blocked, err := blockingPods(dn.kubeClient, node.GetName())
+	if err != nil {
+		glog.Warningf("Unable to list the pods blocking the drain: %v", err)
+	}
+	return errors.Wrapf(errDrainTimeout, "failed to drain node within %v, pods blocking eviction: %s; last error: %v", timeout, describeBlockingPods(blocked), lastErr)
+}
+
+// forceDeletePods deletes the pods left on node after draining it for
+// elapsed, bypassing the eviction API, its PDBs and webhooks. Each deleted
+// pod is logged and reported by a PodForceDeleted event, and recorded in
+// forced to be deleted once only. Static pods are never deleted.
+func (dn *Daemon) forceDeletePods(node *corev1.Node, elapsed time.Duration, forced map[string]bool) {
+	pods, err := evictablePods(dn.kubeClient, node.GetName())
+	if err != nil {
+		glog.Warningf("Unable to list the pods to force delete: %v", err)
+		return
+	}
+	noGracePeriod := int64(0)
+	for _, pod := range pods {
+		name := fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
+		if forced[name] || isStaticPod(pod) {
+			continue
+		}
+		err := dn.kubeClient.CoreV1().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{GracePeriodSeconds: &noGracePeriod})
+		if err != nil && !apierrors.IsNotFound(err) {
+			glog.Warningf("Unable to force delete pod %s: %v", name, err)
+			continue
+		}
+		forced[name] = true
+		dn.logSystem("Force deleted pod %s, still not evicted after draining for %v", name, elapsed.Round(time.Second))
+		if dn.recorder != nil {
+			dn.recorder.Eventf(getNodeRef(node), corev1.EventTypeWarning, "PodForceDeleted",
+				"Force deleted pod %s, still not evicted after draining for %v", name, elapsed.Round(time.Second))
+		}
+	}
+}
+
+// reportBlockedDrain emits an event listing the pods left on node every
+// drainBlockedEventInterval, until stop is closed.
+func (dn *Daemon) reportBlockedDrain(node *corev1.Node, stop <-chan struct{}) {
+	if dn.recorder == nil {
+		return
+	}
+	ticker := time.NewTicker(drainBlockedEventInterval)
+	defer ticker.Stop()
+	start := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			blocked, err := blockingPods(dn.kubeClient, node.GetName())
+			if err != nil {
+				glog.Warningf("Unable to list the pods blocking the drain: %v", err)
+				continue
+			}
+			dn.recordDrainProgress(fmt.Sprintf("blocked for %v, pods left: %s", time.Since(start).Round(time.Second), describeBlockingPods(blocked)))
+			dn.recorder.Eventf(getNodeRef(node), corev1.EventTypeWarning, "DrainBlocked",
+				"Drain blocked for %v, pods left: %s", time.Since(start).Round(time.Second), describeBlockingPods(blocked))
+		}
+	}
+}
+
+// blockingPod is a pod left on a node being drained, and the PDBs covering it.
+type blockingPod struct {
+	namespace string
+	name      string
+	pdbs      []string
+}
+
+// blockingPods returns the pods on nodeName a drain would evict, with the PDBs
+// which cover them.
+func blockingPods(client kubernetes.Interface, nodeName string) ([]blockingPod, error) {
+	pods, err := evictablePods(client, nodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocked []blockingPod
+	for _, pod := range pods {
+		pdbs, err := coveringPDBs(client, pod)
+		if err != nil {
+			return nil, err
+		}
+		blocked = append(blocked, blockingPod{namespace: pod.Namespace, name: pod.Name, pdbs: pdbs})
+	}
+	sort.Slice(blocked, func(i, j int) bool {
+		if blocked[i].namespace != blocked[j].namespace {
+			return blocked[i].namespace < blocked[j].namespace
+		}
+		return blocked[i].name < blocked[j].name
+	})
+	return blocked, nil
+}
+
+// evictablePods returns the pods on nodeName a drain would evict.
+func evictablePods(client kubernetes.Interface, nodeName string) ([]corev1.Pod, error) {
+	pods, err := client.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", nodeName).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var evictable []corev1.Pod
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == nodeName && isEvictable(pod) {
+			evictable = append(evictable, pod)
+		}
+	}
+	return evictable, nil
+}
+
+// isEvictable returns whether a drain tries to evict pod.
+func isEvictable(pod corev1.Pod) bool {
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return false
+	}
+	if _, ok := pod.Annotations[mirrorPodAnnotationKey]; ok {
+		return false
+	}
+	if ref := metav1.GetControllerOf(&pod); ref != nil && ref.Kind == "DaemonSet" {
+		return false
+	}
+	return true
+}
+
+// isStaticPod returns whether pod is the mirror of a static pod, run by the
+// kubelet from a manifest rather than the API server, like the control plane
+// pods of masters.
+func isStaticPod(pod corev1.Pod) bool {
+	if _, ok := pod.Annotations[mirrorPodAnnotationKey]; ok {
+		return true
+	}
+	if source := pod.Annotations[configSourceAnnotationKey]; source == "file" || source == "http" {
+		return true
+	}
+	ref := metav1.GetControllerOf(&pod)
+	return ref != nil && ref.Kind == "Node"
+}
+
+// coveringPDBs returns the sorted names of the PDBs whose selector matches pod.
+func coveringPDBs(client kubernetes.Interface, pod corev1.Pod) ([]string, error) {
+	pdbs, err := client.PolicyV1beta1().PodDisruptionBudgets(pod.Namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, pdb := range pdbs.Items {
+		selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil || selector.Empty() {
+			continue
+		}
+		if selector.Matches(labels.Set(pod.Labels)) {
+			names = append(names, pdb.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// describeBlockingPods describes pods as "namespace/name (PDB a, b)".
+func describeBlockingPods(pods []blockingPod) string {
+	if len(pods) == 0 {
+		return "none found"
+	}
+	descriptions := make([]string, 0, len(pods))
+	for _, pod := range pods {
+		description := fmt.Sprintf("%s/%s", pod.namespace, pod.name)
+		if len(pod.pdbs) > 0 {
+			description += fmt.Sprintf(" (PDB %s)", strings.Join(pod.pdbs, ", "))
+		}
+		descriptions = append(descriptions, description)
+	}
+	return strings.Join(descriptions, ", ")
+}
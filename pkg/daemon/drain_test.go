@@ -0,0 +1,249 @@
+package daemon
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/openshift/machine-config-operator/pkg/generated/clientset/versioned/fake"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestNodeDrainTimeout(t *testing.T) {
+	withAnnotation := func(value string) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{drainTimeoutAnnotationKey: value},
+		}}
+	}
+
+	tests := []struct {
+		name     string
+		node     *corev1.Node
+		def      time.Duration
+		expected time.Duration
+	}{
+		{name: "default", node: &corev1.Node{}, expected: DefaultDrainTimeout},
+		{name: "flag", node: &corev1.Node{}, def: 10 * time.Minute, expected: 10 * time.Minute},
+		{name: "annotation", node: withAnnotation("2h"), def: 10 * time.Minute, expected: 2 * time.Hour},
+		{name: "invalid annotation", node: withAnnotation("soon"), def: 10 * time.Minute, expected: 10 * time.Minute},
+		{name: "negative annotation", node: withAnnotation("-1h"), expected: DefaultDrainTimeout},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if timeout := nodeDrainTimeout(test.node, test.def); timeout != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, timeout)
+			}
+		})
+	}
+}
+
+func TestBlockingPods(t *testing.T) {
+	isController := true
+	newPod := func(namespace, name, nodeName string, labels map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels},
+			Spec:       corev1.PodSpec{NodeName: nodeName},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		}
+	}
+	daemonSetPod := newPod("openshift-dns", "dns", "node", nil)
+	daemonSetPod.OwnerReferences = []metav1.OwnerReference{{Kind: "DaemonSet", Name: "dns", Controller: &isController}}
+	mirrorPod := newPod("kube-system", "etcd", "node", nil)
+	mirrorPod.Annotations = map[string]string{mirrorPodAnnotationKey: "hash"}
+	succeededPod := newPod("default", "job", "node", nil)
+	succeededPod.Status.Phase = corev1.PodSucceeded
+
+	client := k8sfake.NewSimpleClientset(
+		newPod("default", "web-1", "node", map[string]string{"app": "web"}),
+		newPod("default", "web-2", "other-node", map[string]string{"app": "web"}),
+		newPod("default", "db", "node", map[string]string{"app": "db"}),
+		newPod("monitoring", "prometheus", "node", map[string]string{"app": "web"}),
+		daemonSetPod,
+		mirrorPod,
+		succeededPod,
+		&policyv1beta1.PodDisruptionBudget{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+			Spec: policyv1beta1.PodDisruptionBudgetSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			},
+		},
+		&policyv1beta1.PodDisruptionBudget{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "all-apps"},
+			Spec: policyv1beta1.PodDisruptionBudgetSpec{
+				Selector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{
+					Key: "app", Operator: metav1.LabelSelectorOpExists,
+				}}},
+			},
+		},
+	)
+
+	blocked, err := blockingPods(client, "node")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := "default/db (PDB all-apps), default/web-1 (PDB all-apps, web), monitoring/prometheus"
+	if description := describeBlockingPods(blocked); description != expected {
+		t.Errorf("Expected %q, got %q", expected, description)
+	}
+
+	blocked, err = blockingPods(client, "empty-node")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if description := describeBlockingPods(blocked); description != "none found" {
+		t.Errorf("Expected no blocking pods, got %q", description)
+	}
+}
+
+func TestSkipDrainReason(t *testing.T) {
+	worker := newTestNode("worker-0", nil)
+	worker.Labels = map[string]string{"node-role.kubernetes.io/worker": ""}
+	master := newTestNode("master-0", nil)
+	skipping := newTestNode("worker-1", map[string]string{skipDrainAnnotationKey: "true"})
+	newPool := func(name, role string, annos map[string]string) *mcfgv1.MachineConfigPool {
+		return &mcfgv1.MachineConfigPool{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annos},
+			Spec: mcfgv1.MachineConfigPoolSpec{
+				NodeSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"node-role.kubernetes.io/" + role: ""}},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		node     *corev1.Node
+		nodes    []*corev1.Node
+		pools    []*mcfgv1.MachineConfigPool
+		expected string
+	}{{
+		name:     "drained",
+		node:     worker,
+		nodes:    []*corev1.Node{worker, master},
+		pools:    []*mcfgv1.MachineConfigPool{newPool("worker", "worker", nil)},
+		expected: "",
+	}, {
+		name:     "node annotation",
+		node:     skipping,
+		nodes:    []*corev1.Node{worker, skipping},
+		expected: "the node has machineconfiguration.openshift.io/skip-drain=true",
+	}, {
+		name:  "pool annotation",
+		node:  worker,
+		nodes: []*corev1.Node{worker, master},
+		pools: []*mcfgv1.MachineConfigPool{
+			newPool("master", "master", map[string]string{skipDrainAnnotationKey: "true"}),
+			newPool("worker", "worker", map[string]string{skipDrainAnnotationKey: "true"}),
+		},
+		expected: "pool worker has machineconfiguration.openshift.io/skip-drain=true",
+	}, {
+		name:     "single node",
+		node:     master,
+		nodes:    []*corev1.Node{master},
+		expected: "it is the only node of the cluster",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var objects []runtime.Object
+			for _, pool := range test.pools {
+				objects = append(objects, pool)
+			}
+			dn := &Daemon{
+				mcClient:   fake.NewSimpleClientset(objects...),
+				nodeLister: newTestNodeLister(t, test.nodes...),
+			}
+			if reason := dn.skipDrainReason(test.node); reason != test.expected {
+				t.Errorf("Expected %q, got %q", test.expected, reason)
+			}
+		})
+	}
+}
+
+func TestNodeDrainForceAfter(t *testing.T) {
+	worker := newTestNode("worker-0", nil)
+	worker.Labels = map[string]string{"node-role.kubernetes.io/worker": ""}
+	newPool := func(forceAfter string) *mcfgv1.MachineConfigPool {
+		return &mcfgv1.MachineConfigPool{
+			ObjectMeta: metav1.ObjectMeta{Name: "worker", Annotations: map[string]string{drainForceAfterAnnotationKey: forceAfter}},
+			Spec: mcfgv1.MachineConfigPoolSpec{
+				NodeSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"node-role.kubernetes.io/worker": ""}},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		pools    []runtime.Object
+		flag     time.Duration
+		expected time.Duration
+	}{
+		{name: "disabled", expected: 0},
+		{name: "flag", flag: time.Hour, expected: time.Hour},
+		{name: "pool", pools: []runtime.Object{newPool("30m")}, flag: time.Hour, expected: 30 * time.Minute},
+		{name: "pool disabling", pools: []runtime.Object{newPool("0s")}, flag: time.Hour, expected: 0},
+		{name: "invalid pool", pools: []runtime.Object{newPool("soon")}, flag: time.Hour, expected: time.Hour},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dn := &Daemon{mcClient: fake.NewSimpleClientset(test.pools...), drainForceAfter: test.flag}
+			if forceAfter := dn.nodeDrainForceAfter(worker); forceAfter != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, forceAfter)
+			}
+		})
+	}
+}
+
+func TestForceDeletePods(t *testing.T) {
+	isController := true
+	newPod := func(namespace, name string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Spec:       corev1.PodSpec{NodeName: "node"},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		}
+	}
+	stuckPod := newPod("default", "stuck")
+	daemonSetPod := newPod("openshift-dns", "dns")
+	daemonSetPod.OwnerReferences = []metav1.OwnerReference{{Kind: "DaemonSet", Name: "dns", Controller: &isController}}
+	mirrorPod := newPod("openshift-kube-apiserver", "kube-apiserver")
+	mirrorPod.Annotations = map[string]string{mirrorPodAnnotationKey: "hash"}
+	staticPod := newPod("openshift-etcd", "etcd")
+	staticPod.Annotations = map[string]string{configSourceAnnotationKey: "file"}
+
+	client := k8sfake.NewSimpleClientset(stuckPod, daemonSetPod, mirrorPod, staticPod)
+	recorder := record.NewFakeRecorder(10)
+	dn := &Daemon{kubeClient: client, recorder: recorder}
+	node := newTestNode("node", nil)
+	forced := make(map[string]bool)
+
+	dn.forceDeletePods(node, time.Hour, forced)
+	pods, err := client.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, pod := range pods.Items {
+		left = append(left, pod.Namespace+"/"+pod.Name)
+	}
+	sort.Strings(left)
+	expected := []string{"openshift-dns/dns", "openshift-etcd/etcd", "openshift-kube-apiserver/kube-apiserver"}
+	if !reflect.DeepEqual(left, expected) {
+		t.Errorf("Expected only %v to be left, got %v", expected, left)
+	}
+	if !forced["default/stuck"] {
+		t.Errorf("Expected default/stuck to be recorded as force deleted")
+	}
+	if len(recorder.Events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(recorder.Events))
+	}
+	if event := <-recorder.Events; !strings.HasPrefix(event, "Warning PodForceDeleted Force deleted pod default/stuck") {
+		t.Errorf("Unexpected event %q", event)
+	}
+}
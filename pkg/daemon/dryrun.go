@@ -0,0 +1,274 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+const (
+	// dryRunAnnotationKey asks a running daemon to only report what the next
+	// update would change, when set to "true"
+	dryRunAnnotationKey = "machineconfiguration.openshift.io/dry-run"
+	// dryRunReportAnnotationKey holds the report of the last dry run
+	dryRunReportAnnotationKey = "machineconfiguration.openshift.io/dry-run-report"
+	// maxDryRunReportLength caps the size of the report annotation; the full
+	// report is always in the daemon's logs
+	maxDryRunReportLength = 32 * 1024
+)
+
+// isDryRun returns whether updates should only be reported, not applied.
+func (dn *Daemon) isDryRun() bool {
+	if dn.dryRun {
+		return true
+	}
+	if dn.node == nil {
+		return false
+	}
+	return dn.node.Annotations[dryRunAnnotationKey] == "true"
+}
+
+// dryRunUpdate reports what updating from oldConfig to newConfig would change
+// on disk, without changing anything. The report goes to stdout and, when
+// cluster driven, to the dry-run-report node annotation.
+func (dn *Daemon) dryRunUpdate(oldConfig, newConfig *mcfgv1.MachineConfig) error {
+	report, err := dn.dryRunReport(oldConfig, newConfig)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(os.Stdout, report)
+
+	if dn.nodeWriter == nil || dn.kubeClient == nil {
+		return nil
+	}
+	if len(report) > maxDryRunReportLength {
+		report = truncateUTF8(report, maxDryRunReportLength) + "\n[truncated, see the daemon logs for the full report]\n"
+	}
+	ctx, cancel := nodeWriterContext()
+	defer cancel()
+	return dn.nodeWriter.SetAnnotations(ctx, map[string]string{dryRunReportAnnotationKey: report})
+}
+
+// dryRunReport describes the differences between oldConfig and newConfig
+// which an update would apply, and whether it can be applied at all.
+func (dn *Daemon) dryRunReport(oldConfig, newConfig *mcfgv1.MachineConfig) (string, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Dry run of update from %s to %s\n", oldConfig.GetName(), newConfig.GetName())
+
+	// the same checks as a real update
+	if err := dn.reconcilable(oldConfig, newConfig); err != nil {
+		fmt.Fprintf(&b, "Reconcilable: no, would be unreconcilable: %v\n", err)
+	} else {
+		fmt.Fprintf(&b, "Reconcilable: yes\n")
+	}
+
+	if oldConfig.Spec.OSImageURL != newConfig.Spec.OSImageURL {
+		fmt.Fprintf(&b, "OS image: %s -> %s\n", oldConfig.Spec.OSImageURL, newConfig.Spec.OSImageURL)
+	}
+
+	if kernelType(oldConfig) != kernelType(newConfig) {
+		fmt.Fprintf(&b, "Kernel type: %s -> %s\n", kernelType(oldConfig), kernelType(newConfig))
+	}
+	added, removed := diffKernelArguments(oldConfig.Spec.KernelArguments, newConfig.Spec.KernelArguments)
+	for _, karg := range added {
+		fmt.Fprintf(&b, "Kernel argument added: %s\n", karg)
+	}
+	for _, karg := range removed {
+		fmt.Fprintf(&b, "Kernel argument removed: %s\n", karg)
+	}
+
+	if err := validateExtensions(newConfig.Spec.Extensions); err != nil {
+		fmt.Fprintf(&b, "Extensions: would fail: %v\n", err)
+	} else {
+		install, uninstall := diffExtensions(oldConfig.Spec.Extensions, newConfig.Spec.Extensions)
+		for _, pkg := range install {
+			fmt.Fprintf(&b, "Package installed: %s\n", pkg)
+		}
+		for _, pkg := range uninstall {
+			fmt.Fprintf(&b, "Package uninstalled: %s\n", pkg)
+		}
+	}
+
+	if err := diffFiles(&b, oldConfig.Spec.Config.Storage.Files, newConfig.Spec.Config.Storage.Files); err != nil {
+		return "", err
+	}
+	if err := diffUnits(&b, oldConfig.Spec.Config.Systemd.Units, newConfig.Spec.Config.Systemd.Units); err != nil {
+		return "", err
+	}
+
+	if !reflect.DeepEqual(oldConfig.Spec.Config.Passwd.Users, newConfig.Spec.Config.Passwd.Users) {
+		fmt.Fprintf(&b, "SSH keys: changed\n")
+	}
+	return b.String(), nil
+}
+
+// fileContents returns the decoded contents of f. Remote contents aren't
+// fetched, they are described by their source and verification hash.
+func fileContents(f ignv2_2types.File) (string, error) {
+	if isRemoteSource(f) {
+		hash := "<none>"
+		if f.Contents.Verification.Hash != nil {
+			hash = *f.Contents.Verification.Hash
+		}
+		return fmt.Sprintf("<remote contents from %s, %s>\n", redactSource(f.Contents.Source), hash), nil
+	}
+	contents, err := decodeFileContents(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode contents of %s: %v", f.Path, err)
+	}
+	return string(contents), nil
+}
+
+func fileMode(f ignv2_2types.File) os.FileMode {
+	if f.Mode != nil {
+		return os.FileMode(*f.Mode)
+	}
+	return defaultFilePermissions
+}
+
+// diffFiles writes the files added, removed and changed between old and new
+// to w, with a unified diff of the contents of the changed ones.
+func diffFiles(w *bytes.Buffer, oldFiles, newFiles []ignv2_2types.File) error {
+	paths := make(map[string]struct{})
+	oldByPath := make(map[string]ignv2_2types.File)
+	for _, f := range oldFiles {
+		oldByPath[f.Path] = f
+		paths[f.Path] = struct{}{}
+	}
+	newByPath := make(map[string]ignv2_2types.File)
+	for _, f := range newFiles {
+		newByPath[f.Path] = f
+		paths[f.Path] = struct{}{}
+	}
+
+	for _, path := range sortedSet(paths) {
+		o, inOld := oldByPath[path]
+		n, inNew := newByPath[path]
+		switch {
+		case !inOld:
+			fmt.Fprintf(w, "File added: %s\n", path)
+		case !inNew:
+			fmt.Fprintf(w, "File removed: %s\n", path)
+		default:
+			if reflect.DeepEqual(o, n) {
+				continue
+			}
+			fmt.Fprintf(w, "File changed: %s\n", path)
+			if fileMode(o) != fileMode(n) {
+				fmt.Fprintf(w, "  mode: %#o -> %#o\n", fileMode(o), fileMode(n))
+			}
+			if !reflect.DeepEqual(o.User, n.User) || !reflect.DeepEqual(o.Group, n.Group) {
+				fmt.Fprintf(w, "  ownership changed\n")
+			}
+			if err := writeContentsDiff(w, o, n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeContentsDiff(w *bytes.Buffer, o, n ignv2_2types.File) error {
+	oldContents, err := fileContents(o)
+	if err != nil {
+		return err
+	}
+	newContents, err := fileContents(n)
+	if err != nil {
+		return err
+	}
+	return writeDiff(w, n.Path, oldContents, newContents)
+}
+
+// diffUnits writes the units and dropins added, removed and changed between
+// old and new to w, along with the units whose enablement or masking changes.
+func diffUnits(w *bytes.Buffer, oldUnits, newUnits []ignv2_2types.Unit) error {
+	names := make(map[string]struct{})
+	oldByName := make(map[string]ignv2_2types.Unit)
+	for _, u := range oldUnits {
+		oldByName[u.Name] = u
+		names[u.Name] = struct{}{}
+	}
+	newByName := make(map[string]ignv2_2types.Unit)
+	for _, u := range newUnits {
+		newByName[u.Name] = u
+		names[u.Name] = struct{}{}
+	}
+
+	for _, name := range sortedSet(names) {
+		o, inOld := oldByName[name]
+		n, inNew := newByName[name]
+		switch {
+		case !inOld:
+			fmt.Fprintf(w, "Unit added: %s%s\n", name, unitState(n))
+		case !inNew:
+			fmt.Fprintf(w, "Unit removed: %s\n", name)
+		default:
+			if reflect.DeepEqual(o, n) {
+				continue
+			}
+			fmt.Fprintf(w, "Unit changed: %s\n", name)
+			if unitState(o) != unitState(n) {
+				fmt.Fprintf(w, "  state:%s ->%s\n", unitState(o), unitState(n))
+			}
+			if err := writeDiff(w, filepath.Join(pathSystemd, name), o.Contents, n.Contents); err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(o.Dropins, n.Dropins) {
+				fmt.Fprintf(w, "  dropins changed\n")
+			}
+		}
+	}
+	return nil
+}
+
+// writeDiff writes a unified diff of the contents of path to w, if they
+// changed.
+func writeDiff(w *bytes.Buffer, path, oldContents, newContents string) error {
+	if oldContents == newContents {
+		return nil
+	}
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(oldContents),
+		B:        difflib.SplitLines(newContents),
+		FromFile: "a" + path,
+		ToFile:   "b" + path,
+		Context:  3,
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteString(diff)
+	return nil
+}
+
+// unitState describes whether u is masked, enabled or disabled, in the way
+// writeUnits applies it.
+func unitState(u ignv2_2types.Unit) string {
+	switch {
+	case u.Mask:
+		return " (masked)"
+	case u.Enabled != nil && *u.Enabled, u.Enable:
+		return " (enabled)"
+	case u.Enabled != nil:
+		return " (disabled)"
+	}
+	return ""
+}
+
+// sortedSet returns the members of set, sorted.
+func sortedSet(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,87 @@
+package daemon
+
+import (
+	"testing"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vincent-petithory/dataurl"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestFile(path, contents string) ignv2_2types.File {
+	mode := 0644
+	return ignv2_2types.File{
+		Node: ignv2_2types.Node{Path: path, Filesystem: "root"},
+		FileEmbedded1: ignv2_2types.FileEmbedded1{
+			Contents: ignv2_2types.FileContents{Source: dataurl.EncodeBytes([]byte(contents))},
+			Mode:     &mode,
+		},
+	}
+}
+
+func newTestMachineConfig(name string, files []ignv2_2types.File, units []ignv2_2types.Unit) *mcfgv1.MachineConfig {
+	return &mcfgv1.MachineConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: mcfgv1.MachineConfigSpec{
+			Config: ignv2_2types.Config{
+				Ignition: ignv2_2types.Ignition{Version: "2.2.0"},
+				Storage:  ignv2_2types.Storage{Files: files},
+				Systemd:  ignv2_2types.Systemd{Units: units},
+			},
+		},
+	}
+}
+
+func TestDryRunReport(t *testing.T) {
+	enabled := true
+	oldConfig := newTestMachineConfig("rendered-worker-1",
+		[]ignv2_2types.File{
+			newTestFile("/etc/changed.conf", "a\nb\nc\n"),
+			newTestFile("/etc/removed.conf", "gone\n"),
+			newTestFile("/etc/same.conf", "same\n"),
+		},
+		[]ignv2_2types.Unit{{Name: "foo.service", Contents: "[Unit]\n"}},
+	)
+	newConfig := newTestMachineConfig("rendered-worker-2",
+		[]ignv2_2types.File{
+			newTestFile("/etc/added.conf", "new\n"),
+			newTestFile("/etc/changed.conf", "a\nB\nc\n"),
+			newTestFile("/etc/same.conf", "same\n"),
+		},
+		[]ignv2_2types.Unit{{Name: "foo.service", Contents: "[Unit]\n", Enabled: &enabled}},
+	)
+
+	d := Daemon{}
+	report, err := d.dryRunReport(oldConfig, newConfig)
+	require.Nil(t, err)
+	assert.Contains(t, report, "from rendered-worker-1 to rendered-worker-2")
+	assert.Contains(t, report, "Reconcilable: yes")
+	assert.Contains(t, report, "File added: /etc/added.conf")
+	assert.Contains(t, report, "File removed: /etc/removed.conf")
+	assert.Contains(t, report, "File changed: /etc/changed.conf")
+	assert.Contains(t, report, "-b\n+B\n")
+	assert.NotContains(t, report, "/etc/same.conf")
+	assert.Contains(t, report, "Unit changed: foo.service")
+	assert.Contains(t, report, "state: -> (enabled)")
+
+	// unreconcilable changes are reported too
+	newConfig.Spec.Config.Networkd = ignv2_2types.Networkd{Units: []ignv2_2types.Networkdunit{{Name: "test.network"}}}
+	report, err = d.dryRunReport(oldConfig, newConfig)
+	require.Nil(t, err)
+	assert.Contains(t, report, "Reconcilable: no, would be unreconcilable: not supported for day-2 changes: spec.config.networkd.units[0]")
+}
+
+func TestIsDryRun(t *testing.T) {
+	d := Daemon{}
+	assert.False(t, d.isDryRun())
+
+	d.node = &corev1.Node{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{dryRunAnnotationKey: "true"}}}
+	assert.True(t, d.isDryRun())
+
+	d = Daemon{dryRun: true}
+	assert.True(t, d.isDryRun())
+}
@@ -0,0 +1,107 @@
+package daemon
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// masterNodeLabel is the label of the control plane nodes, which run an
+	// etcd member each
+	masterNodeLabel = "node-role.kubernetes.io/master"
+	// etcdNamespace and etcdPodSelector find the etcd member static pods
+	etcdNamespace   = "openshift-etcd"
+	etcdPodSelector = "k8s-app=etcd"
+	// etcdPollInterval is the time between two checks of the etcd members
+	etcdPollInterval = 10 * time.Second
+	// etcdQuorumTimeout is how long a master waits for all the etcd members
+	// to be healthy before draining, and etcdMemberTimeout how long it waits
+	// for its own member after rebooting
+	etcdQuorumTimeout = 30 * time.Minute
+	etcdMemberTimeout = 20 * time.Minute
+)
+
+// errEtcdUnhealthy is returned when the etcd members a master waited for
+// didn't become healthy in time.
+var errEtcdUnhealthy = errors.New("etcd members unhealthy")
+
+// isMasterNode returns whether node is a control plane node.
+func isMasterNode(node *corev1.Node) bool {
+	if node == nil {
+		return false
+	}
+	_, ok := node.Labels[masterNodeLabel]
+	return ok
+}
+
+// unhealthyEtcdMembers returns the sorted names of the masters whose etcd
+// member pod isn't ready, as the API server has them, among all the masters
+// or only the node named only.
+func (dn *Daemon) unhealthyEtcdMembers(only string) ([]string, error) {
+	nodes, err := dn.kubeClient.CoreV1().Nodes().List(metav1.ListOptions{LabelSelector: masterNodeLabel})
+	if err != nil {
+		return nil, err
+	}
+	pods, err := dn.kubeClient.CoreV1().Pods(etcdNamespace).List(metav1.ListOptions{LabelSelector: etcdPodSelector})
+	if err != nil {
+		return nil, err
+	}
+	ready := make(map[string]bool)
+	for _, pod := range pods.Items {
+		for _, c := range pod.Status.Conditions {
+			if c.Type == corev1.PodReady && c.Status == corev1.ConditionTrue {
+				ready[pod.Spec.NodeName] = true
+			}
+		}
+	}
+	var unhealthy []string
+	for _, node := range nodes.Items {
+		if only != "" && node.Name != only {
+			continue
+		}
+		if !ready[node.Name] {
+			unhealthy = append(unhealthy, node.Name)
+		}
+	}
+	sort.Strings(unhealthy)
+	return unhealthy, nil
+}
+
+// waitForEtcdMembers waits up to timeout for the etcd members of the masters,
+// or only the one of the node named only, to be healthy. Other nodes than
+// masters don't wait. If the members aren't healthy in time, the error
+// returned has errEtcdUnhealthy as its cause and names them.
+func (dn *Daemon) waitForEtcdMembers(only string, timeout time.Duration) error {
+	if dn.kubeClient == nil || !isMasterNode(dn.node) {
+		return nil
+	}
+	var unhealthy []string
+	var lastErr error
+	err := wait.PollImmediate(etcdPollInterval, timeout, func() (bool, error) {
+		members, err := dn.unhealthyEtcdMembers(only)
+		if err != nil {
+			glog.Warningf("Unable to check the etcd members: %v", err)
+			lastErr = err
+			return false, nil
+		}
+		if len(members) > 0 && strings.Join(members, ",") != strings.Join(unhealthy, ",") {
+			glog.Infof("Waiting for the etcd members of %s to be healthy", strings.Join(members, ", "))
+		}
+		unhealthy, lastErr = members, nil
+		return len(members) == 0, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		if lastErr != nil {
+			return errors.Wrapf(errEtcdUnhealthy, "unable to check the etcd members for %v: %v", timeout, lastErr)
+		}
+		return errors.Wrapf(errEtcdUnhealthy, "etcd members of %s not healthy after %v", strings.Join(unhealthy, ", "), timeout)
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func newEtcdTestMaster(name string) *corev1.Node {
+	return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{masterNodeLabel: ""}}}
+}
+
+func newEtcdTestPod(node string, ready corev1.ConditionStatus) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "etcd-member-" + node, Namespace: etcdNamespace, Labels: map[string]string{"k8s-app": "etcd"}},
+		Spec:       corev1.PodSpec{NodeName: node},
+		Status:     corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: ready}}},
+	}
+}
+
+func TestWaitForEtcdMembers(t *testing.T) {
+	master0, master1, master2 := newEtcdTestMaster("master-0"), newEtcdTestMaster("master-1"), newEtcdTestMaster("master-2")
+	worker := newTestNode("worker-0", map[string]string{})
+	objects := []runtime.Object{
+		master0, master1, master2, worker,
+		newEtcdTestPod("master-0", corev1.ConditionTrue),
+		newEtcdTestPod("master-1", corev1.ConditionFalse),
+	}
+	dn := &Daemon{
+		name:       "master-0",
+		node:       master0,
+		kubeClient: k8sfake.NewSimpleClientset(objects...),
+	}
+
+	unhealthy, err := dn.unhealthyEtcdMembers("")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"master-1", "master-2"}, unhealthy, "members not ready or missing are unhealthy")
+
+	err = dn.waitForEtcdMembers("", 10*time.Millisecond)
+	require.NotNil(t, err)
+	assert.Equal(t, errEtcdUnhealthy, errors.Cause(err))
+	assert.Equal(t, "etcd members of master-1, master-2 not healthy after 10ms: etcd members unhealthy", err.Error())
+
+	// after rebooting only the local member matters
+	assert.Nil(t, dn.waitForEtcdMembers("master-0", 10*time.Millisecond))
+	dn.name, dn.node = "master-1", master1
+	err = dn.waitForEtcdMembers("master-1", 10*time.Millisecond)
+	require.NotNil(t, err)
+	assert.Equal(t, errEtcdUnhealthy, errors.Cause(err))
+
+	// workers don't wait on etcd
+	dn.name, dn.node = "worker-0", worker
+	assert.Nil(t, dn.waitForEtcdMembers("", 10*time.Millisecond))
+}
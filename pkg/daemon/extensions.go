@@ -0,0 +1,87 @@
+package daemon
+
+import (
+	"sort"
+	"strings"
+
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	errors "github.com/pkg/errors"
+)
+
+// supportedExtensions maps the extensions which can be installed from the
+// extensions repo of the OS image to their packages.
+var supportedExtensions = map[string][]string{
+	"usbguard":     {"usbguard"},
+	"kernel-devel": {"kernel-devel", "kernel-headers"},
+	"kerberos":     {"krb5-workstation", "libkadm5"},
+}
+
+// errUnsupportedExtension is returned for configs asking for extensions not
+// in supportedExtensions.
+var errUnsupportedExtension = errors.New("unsupported extension")
+
+// validateExtensions returns an error wrapping errUnsupportedExtension and
+// listing the supported extensions if any of extensions isn't supported.
+func validateExtensions(extensions []string) error {
+	var unsupported []string
+	for _, ext := range extensions {
+		if _, ok := supportedExtensions[ext]; !ok {
+			unsupported = append(unsupported, ext)
+		}
+	}
+	if len(unsupported) == 0 {
+		return nil
+	}
+	supported := make([]string, 0, len(supportedExtensions))
+	for ext := range supportedExtensions {
+		supported = append(supported, ext)
+	}
+	sort.Strings(supported)
+	return errors.Wrapf(errUnsupportedExtension, "%s, supported extensions are: %s",
+		strings.Join(unsupported, ", "), strings.Join(supported, ", "))
+}
+
+// extensionPackages returns the set of packages of extensions.
+func extensionPackages(extensions []string) map[string]struct{} {
+	packages := make(map[string]struct{})
+	for _, ext := range extensions {
+		for _, pkg := range supportedExtensions[ext] {
+			packages[pkg] = struct{}{}
+		}
+	}
+	return packages
+}
+
+// diffExtensions returns the sorted packages to install and to uninstall to go
+// from the extensions oldExtensions to newExtensions. Both must be supported.
+func diffExtensions(oldExtensions, newExtensions []string) (install, uninstall []string) {
+	oldPackages := extensionPackages(oldExtensions)
+	newPackages := extensionPackages(newExtensions)
+	for _, pkg := range sortedSet(newPackages) {
+		if _, ok := oldPackages[pkg]; !ok {
+			install = append(install, pkg)
+		}
+	}
+	for _, pkg := range sortedSet(oldPackages) {
+		if _, ok := newPackages[pkg]; !ok {
+			uninstall = append(uninstall, pkg)
+		}
+	}
+	return install, uninstall
+}
+
+// updateExtensions installs the packages of the extensions added between
+// oldConfig and newConfig and uninstalls those of the extensions dropped, in a
+// single transaction applied to the deployment booted next.
+func (dn *Daemon) updateExtensions(oldConfig, newConfig *mcfgv1.MachineConfig) error {
+	if err := validateExtensions(newConfig.Spec.Extensions); err != nil {
+		return err
+	}
+	install, uninstall := diffExtensions(oldConfig.Spec.Extensions, newConfig.Spec.Extensions)
+	if len(install) == 0 && len(uninstall) == 0 {
+		return nil
+	}
+
+	dn.logSystem("Updating extensions: installing %v, uninstalling %v", install, uninstall)
+	return dn.updater().updateExtensions(newConfig.Spec.OSImageURL, install, uninstall)
+}
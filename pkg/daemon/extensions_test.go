@@ -0,0 +1,54 @@
+package daemon
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestValidateExtensions(t *testing.T) {
+	if err := validateExtensions([]string{"usbguard", "kernel-devel"}); err != nil {
+		t.Errorf("Expected supported extensions to be valid: %v", err)
+	}
+
+	err := validateExtensions([]string{"usbguard", "emacs"})
+	if errors.Cause(err) != errUnsupportedExtension {
+		t.Fatalf("Expected %v, got %v", errUnsupportedExtension, err)
+	}
+	for _, s := range []string{"emacs", "supported extensions are: kerberos, kernel-devel, usbguard"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("Expected %q in %q", s, err)
+		}
+	}
+}
+
+func TestDiffExtensions(t *testing.T) {
+	install, uninstall := diffExtensions([]string{"usbguard", "kerberos"}, []string{"kernel-devel", "usbguard"})
+	if expected := []string{"kernel-devel", "kernel-headers"}; !reflect.DeepEqual(install, expected) {
+		t.Errorf("Expected to install %v, got %v", expected, install)
+	}
+	if expected := []string{"krb5-workstation", "libkadm5"}; !reflect.DeepEqual(uninstall, expected) {
+		t.Errorf("Expected to uninstall %v, got %v", expected, uninstall)
+	}
+
+	install, uninstall = diffExtensions([]string{"usbguard"}, []string{"usbguard"})
+	if len(install) != 0 || len(uninstall) != 0 {
+		t.Errorf("Expected no changes, got install %v uninstall %v", install, uninstall)
+	}
+}
+
+func TestUpdateExtensionsUnsupported(t *testing.T) {
+	d := Daemon{
+		OperatingSystem:   machineConfigDaemonOSRHCOS,
+		NodeUpdaterClient: RpmOstreeClientMock{UpdateExtensionsReturns: errors.New("rpm-ostree ran")},
+	}
+	oldConfig := newTestMachineConfig("old", nil, nil)
+	newConfig := newTestMachineConfig("new", nil, nil)
+	newConfig.Spec.Extensions = []string{"usbguard", "emacs"}
+
+	if err := d.updateExtensions(oldConfig, newConfig); errors.Cause(err) != errUnsupportedExtension {
+		t.Errorf("Expected %v before running rpm-ostree, got %v", errUnsupportedExtension, err)
+	}
+}
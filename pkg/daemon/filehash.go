@@ -0,0 +1,63 @@
+package daemon
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/pkg/errors"
+)
+
+// errHashMismatch is the cause of the errors of files whose contents don't
+// match their verification hash. Retrying can't help, the config is wrong.
+var errHashMismatch = errors.New("hash mismatch")
+
+// hashMismatchError is a file whose contents don't match its verification
+// hash.
+type hashMismatchError struct {
+	path     string
+	expected string
+	got      string
+}
+
+func (e *hashMismatchError) Error() string {
+	return fmt.Sprintf("hash mismatch for %s (expected %s, got %s)", e.path, e.expected, e.got)
+}
+
+// Cause makes errors.Cause return errHashMismatch.
+func (e *hashMismatchError) Cause() error {
+	return errHashMismatch
+}
+
+// verifyFileHash checks that contents, those of the file at path, match the
+// verification hash of the file, if it has one.
+func verifyFileHash(path string, verification ignv2_2types.Verification, contents []byte) error {
+	if verification.Hash == nil {
+		return nil
+	}
+	function, sum, err := ctrlcommon.ParseFileHash(verification)
+	if err != nil {
+		return errors.Wrapf(err, "verifying %s", path)
+	}
+	h := ctrlcommon.FileHashes[function]()
+	h.Write(contents)
+	if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+		return &hashMismatchError{path: path, expected: function + "-" + sum, got: function + "-" + got}
+	}
+	return nil
+}
+
+// verifyWrittenFile reads back the file at path and checks it against its
+// verification hash, if it has one.
+func verifyWrittenFile(path string, verification ignv2_2types.Verification) error {
+	if verification.Hash == nil {
+		return nil
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "reading back %s", path)
+	}
+	return verifyFileHash(path, verification, contents)
+}
@@ -0,0 +1,82 @@
+package daemon
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withFileHash(f ignv2_2types.File, hash string) ignv2_2types.File {
+	f.Contents.Verification.Hash = &hash
+	return f
+}
+
+func TestVerifyFileHash(t *testing.T) {
+	contents := []byte("contents")
+	sum256 := sha256.Sum256(contents)
+	sum512 := sha512.Sum512(contents)
+	other := sha256.Sum256([]byte("other"))
+
+	for _, hash := range []string{"sha256-" + hex.EncodeToString(sum256[:]), "sha512-" + hex.EncodeToString(sum512[:])} {
+		assert.Nil(t, verifyFileHash("/etc/foo", ignv2_2types.Verification{Hash: &hash}, contents), hash)
+	}
+	assert.Nil(t, verifyFileHash("/etc/foo", ignv2_2types.Verification{}, contents), "files without hash aren't verified")
+
+	hash := "sha256-" + hex.EncodeToString(other[:])
+	err := verifyFileHash("/etc/foo", ignv2_2types.Verification{Hash: &hash}, contents)
+	require.NotNil(t, err)
+	assert.Equal(t, errHashMismatch, errors.Cause(err))
+	assert.Equal(t, "hash mismatch for /etc/foo (expected "+hash+", got sha256-"+hex.EncodeToString(sum256[:])+")", err.Error())
+}
+
+func TestReconcilableFileHash(t *testing.T) {
+	d := Daemon{}
+	oldConfig := newTestMachineConfig("old", nil, nil)
+	sum := sha256.Sum256([]byte("contents"))
+
+	newConfig := newTestMachineConfig("new", []ignv2_2types.File{
+		withFileHash(newTestFile("/etc/foo", "contents"), "sha256-"+hex.EncodeToString(sum[:])),
+	}, nil)
+	assert.Nil(t, d.reconcilable(oldConfig, newConfig), "sha256 hashes are supported")
+
+	newConfig = newTestMachineConfig("new", []ignv2_2types.File{
+		withFileHash(newTestFile("/etc/foo", "contents"), "md5-9a0364b9e99bb480dd25e1f0284c8555"),
+		withFileHash(newTestFile("/etc/bar", "contents"), "sha512-abcd"),
+	}, nil)
+	err := d.reconcilable(oldConfig, newConfig)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), `spec.config.storage.files[0].contents.verification.hash (unsupported hash function "md5", expected sha256 or sha512)`)
+	assert.Contains(t, err.Error(), `spec.config.storage.files[1].contents.verification.hash (invalid sha512 sum)`)
+}
+
+func TestWriteFilesHashMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filehash")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dn := &Daemon{
+		ownedFilesPath:   filepath.Join(dir, "owned-files.json"),
+		originalFilesDir: filepath.Join(dir, "orig"),
+	}
+	path := filepath.Join(dir, "etc/foo.conf")
+	sum := sha512.Sum512([]byte("expected"))
+
+	err = dn.writeFiles([]ignv2_2types.File{withFileHash(newTestFile(path, "corrupted"), "sha512-"+hex.EncodeToString(sum[:]))})
+	require.NotNil(t, err)
+	assert.Equal(t, errHashMismatch, errors.Cause(err))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "mismatching contents aren't written")
+
+	require.Nil(t, dn.writeFiles([]ignv2_2types.File{withFileHash(newTestFile(path, "expected"), "sha512-"+hex.EncodeToString(sum[:]))}))
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "expected", string(b))
+}
@@ -0,0 +1,65 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+)
+
+// pathFIPSEnabled holds 1 when the running kernel is in FIPS mode
+const pathFIPSEnabled = "/proc/sys/crypto/fips_enabled"
+
+// fipsEnabled returns whether fipsFile says the kernel is in FIPS mode. A
+// kernel without FIPS support has no such file, and isn't.
+func fipsEnabled(fipsFile string) (bool, error) {
+	b, err := ioutil.ReadFile(fipsFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read the FIPS mode: %v", err)
+	}
+	return strings.TrimSpace(string(b)) == "1", nil
+}
+
+// fipsMode describes whether FIPS mode is enabled
+func fipsMode(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+// checkFIPS checks that the node is in FIPS mode if and only if config asks
+// for it. It is skipped when the daemon has no fipsFile, like in tests.
+func (dn *Daemon) checkFIPS(config *mcfgv1.MachineConfig) error {
+	if dn.fipsFile == "" {
+		return nil
+	}
+	enabled, err := fipsEnabled(dn.fipsFile)
+	if err != nil {
+		return err
+	}
+	if enabled != config.Spec.FIPS {
+		return fmt.Errorf("FIPS mode is %s on the node, %s expects it %s", fipsMode(enabled), config.GetName(), fipsMode(config.Spec.FIPS))
+	}
+	return nil
+}
+
+// fipsAnnotations returns the annotation recording whether the node booted
+// in FIPS mode, none when the daemon has no fipsFile.
+func (dn *Daemon) fipsAnnotations() (map[string]string, error) {
+	if dn.fipsFile == "" {
+		return nil, nil
+	}
+	enabled, err := fipsEnabled(dn.fipsFile)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{constants.CurrentFIPSAnnotationKey: strconv.FormatBool(enabled)}, nil
+}
@@ -0,0 +1,62 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFIPS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fips")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dn := &Daemon{fipsFile: filepath.Join(dir, "fips_enabled")}
+	config := newTestMachineConfig("fips", nil, nil)
+
+	// no fips_enabled, no FIPS mode
+	assert.Nil(t, dn.checkFIPS(config))
+	config.Spec.FIPS = true
+	err = dn.checkFIPS(config)
+	require.NotNil(t, err)
+	assert.Equal(t, "FIPS mode is disabled on the node, fips expects it enabled", err.Error())
+
+	require.Nil(t, ioutil.WriteFile(dn.fipsFile, []byte("1\n"), 0644))
+	assert.Nil(t, dn.checkFIPS(config))
+	annos, err := dn.fipsAnnotations()
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{constants.CurrentFIPSAnnotationKey: "true"}, annos)
+	config.Spec.FIPS = false
+	err = dn.checkFIPS(config)
+	require.NotNil(t, err)
+	assert.Equal(t, "FIPS mode is enabled on the node, fips expects it disabled", err.Error())
+
+	assert.Nil(t, (&Daemon{}).checkFIPS(config), "the check is skipped without a fips file")
+}
+
+func TestReconcilableFIPS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fips")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dn := &Daemon{fipsFile: filepath.Join(dir, "fips_enabled")}
+	require.Nil(t, ioutil.WriteFile(dn.fipsFile, []byte("0\n"), 0644))
+
+	oldConfig := newTestMachineConfig("old", nil, nil)
+	newConfig := newTestMachineConfig("new", nil, nil)
+	assert.Nil(t, dn.reconcilable(oldConfig, newConfig))
+
+	newConfig.Spec.FIPS = true
+	err = dn.reconcilable(oldConfig, newConfig)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "spec.fips (false -> true: FIPS mode can only be set at install time)")
+
+	// a node the installer didn't put in FIPS mode can't be updated into it
+	oldConfig.Spec.FIPS = true
+	err = dn.reconcilable(oldConfig, newConfig)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "spec.fips (FIPS mode is disabled on the node, new expects it enabled)")
+}
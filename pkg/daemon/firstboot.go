@@ -0,0 +1,94 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/golang/glog"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// firstbootPollInterval is how often the in-cluster daemon checks whether the
+// firstboot service is done
+const firstbootPollInterval = 10 * time.Second
+
+// firstbootOldConfig returns the config a node being provisioned with config
+// comes from: Ignition wrote all of config but the OS image, kernel arguments,
+// kernel type and extensions, which are still those booted.
+func firstbootOldConfig(config *mcfgv1.MachineConfig, bootedOSImageURL string) *mcfgv1.MachineConfig {
+	oldConfig := config.DeepCopy()
+	oldConfig.Spec.OSImageURL = bootedOSImageURL
+	oldConfig.Spec.KernelArguments = nil
+	oldConfig.Spec.KernelType = ""
+	oldConfig.Spec.Extensions = nil
+	return oldConfig
+}
+
+// RunFirstbootCompleteMachineConfig applies the parts of the first config of
+// the node which Ignition can't, embedded by the Machine Config Server at
+// onceFrom, MachineConfigEncapsulatedPath. They go through the same update as
+// once-from configs. The file is removed once they are applied, before
+// rebooting into them if they need it, unless the reboot is skipped.
+func (dn *Daemon) RunFirstbootCompleteMachineConfig() error {
+	configi, err := dn.senseAndLoadOnceFrom()
+	if err != nil {
+		return errors.Wrapf(errInvalidOnceFrom, "%v", err)
+	}
+	mc, ok := configi.(mcfgv1.MachineConfig)
+	if !ok {
+		return errors.Wrapf(errInvalidOnceFrom, "%s is not a MachineConfig", dn.onceFrom)
+	}
+
+	oldConfig := firstbootOldConfig(&mc, dn.bootedOSImageURL)
+	plan := computeUpdatePlan(oldConfig, &mc)
+	if !plan.reboot {
+		glog.Infof("Ignition applied all of %s", mc.GetName())
+		return dn.removeEncapsulatedConfig()
+	}
+
+	dn.logSystem("Completing %s on first boot: %s", mc.GetName(), plan)
+	// the marker goes once the update is applied, but before the reboot
+	skipReboot := dn.skipReboot
+	dn.skipReboot = true
+	if err := dn.update(oldConfig, &mc); err != nil {
+		return err
+	}
+	if err := dn.removeEncapsulatedConfig(); err != nil {
+		return err
+	}
+	dn.skipReboot = skipReboot
+	return dn.reboot(fmt.Sprintf("Completed first boot into config %s", mc.GetName()), defaultRebootTimeout, exec.Command(defaultRebootCommand))
+}
+
+func (dn *Daemon) removeEncapsulatedConfig() error {
+	if err := os.Remove(dn.onceFrom); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "removing %s", dn.onceFrom)
+	}
+	return nil
+}
+
+// firstbootComplete returns whether the firstboot service is done with the
+// config embedded at path, that is whether path is gone.
+func firstbootComplete(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	return false, err
+}
+
+// waitForFirstboot blocks until the firstboot service is done, so that a sync
+// doesn't apply the first config of the node again underneath it.
+func waitForFirstboot(path string, interval time.Duration, stopCh <-chan struct{}) error {
+	if done, err := firstbootComplete(path); err != nil || done {
+		return err
+	}
+	glog.Infof("Waiting for the firstboot service to apply and remove %s before syncing", path)
+	return wait.PollUntil(interval, func() (bool, error) {
+		return firstbootComplete(path)
+	}, stopCh)
+}
@@ -0,0 +1,65 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirstbootOldConfig(t *testing.T) {
+	booted := "example.com/os@sha256:0123"
+	config := newTestMachineConfig("test", []ignv2_2types.File{newTestFile("/etc/test", "test")}, nil)
+	config.Spec.OSImageURL = booted
+
+	// Ignition wrote everything
+	plan := computeUpdatePlan(firstbootOldConfig(config, booted), config)
+	assert.False(t, plan.reboot, "unexpected reboot: %s", plan)
+
+	config.Spec.KernelArguments = []string{"nosmt"}
+	oldConfig := firstbootOldConfig(config, booted)
+	assert.Empty(t, oldConfig.Spec.KernelArguments)
+	assert.Equal(t, config.Spec.Config, oldConfig.Spec.Config)
+	plan = computeUpdatePlan(oldConfig, config)
+	assert.True(t, plan.reboot)
+	assert.Equal(t, []string{"kernelArguments changed"}, plan.reasons)
+
+	config.Spec.KernelArguments = nil
+	config.Spec.OSImageURL = "example.com/os@sha256:4567"
+	plan = computeUpdatePlan(firstbootOldConfig(config, booted), config)
+	assert.Equal(t, []string{"osImageURL changed"}, plan.reasons)
+}
+
+func TestWaitForFirstboot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "firstboot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "encapsulated.json")
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	// no firstboot pending
+	require.Nil(t, waitForFirstboot(path, time.Millisecond, stopCh))
+
+	require.Nil(t, ioutil.WriteFile(path, []byte("{}"), 0644))
+	done := make(chan error)
+	go func() { done <- waitForFirstboot(path, time.Millisecond, stopCh) }()
+	select {
+	case err := <-done:
+		t.Fatalf("returned before firstboot completed: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	require.Nil(t, os.Remove(path))
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("still waiting after firstboot completed")
+	}
+}
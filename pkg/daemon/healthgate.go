@@ -0,0 +1,142 @@
+package daemon
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// DefaultHealthGateTimeout is how long a node rebooted into a new config
+	// may take to pass its health checks before it is marked degraded
+	DefaultHealthGateTimeout = 10 * time.Minute
+	// healthGateInterval is the time between two rounds of health checks
+	healthGateInterval = 5 * time.Second
+
+	// HealthCheckNodeReady waits for the kubelet to report the node Ready
+	HealthCheckNodeReady = "node-ready"
+	// HealthCheckCrio and HealthCheckKubelet wait for their units to be
+	// active
+	HealthCheckCrio    = "crio"
+	HealthCheckKubelet = "kubelet"
+	// HealthCheckPendingConfig waits for the pending config annotation of the
+	// node, as the API server has it, to name the config booted into
+	HealthCheckPendingConfig = "pending-config"
+)
+
+// DefaultHealthChecks are the checks of the health gate, in the order they
+// are run.
+var DefaultHealthChecks = []string{HealthCheckCrio, HealthCheckKubelet, HealthCheckNodeReady, HealthCheckPendingConfig}
+
+// healthCheckUnits are the units whose journal explains the failure of the
+// health checks.
+var healthCheckUnits = map[string]string{
+	HealthCheckCrio:      "crio.service",
+	HealthCheckKubelet:   "kubelet.service",
+	HealthCheckNodeReady: "kubelet.service",
+}
+
+// errHealthGate is returned when a node didn't pass its health checks within
+// the health gate timeout after rebooting into a new config.
+var errHealthGate = errors.New("health gate timed out")
+
+// validateHealthChecks returns an error if any of checks is unknown.
+func validateHealthChecks(checks []string) error {
+	known := make(map[string]bool)
+	for _, c := range DefaultHealthChecks {
+		known[c] = true
+	}
+	for _, c := range checks {
+		if !known[c] {
+			return fmt.Errorf("unknown health check %q, expected one of %s", c, strings.Join(DefaultHealthChecks, ", "))
+		}
+	}
+	return nil
+}
+
+// unitActive returns an error unless unit is active, it is swapped out by
+// tests.
+var unitActive = func(unit string) error {
+	out, err := exec.Command("systemctl", "is-active", unit).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s is %s", unit, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// runHealthCheck runs check once for the config pendingConfigName.
+func (dn *Daemon) runHealthCheck(check, pendingConfigName string) error {
+	switch check {
+	case HealthCheckCrio:
+		return unitActive("crio.service")
+	case HealthCheckKubelet:
+		return unitActive("kubelet.service")
+	}
+
+	// the informer's copy of the node may be stale, ask the API server
+	node, err := dn.kubeClient.CoreV1().Nodes().Get(dn.name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	switch check {
+	case HealthCheckNodeReady:
+		for _, c := range node.Status.Conditions {
+			if c.Type == corev1.NodeReady {
+				if c.Status != corev1.ConditionTrue {
+					return fmt.Errorf("node is not Ready: %s", c.Message)
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("node has no %s condition", corev1.NodeReady)
+	case HealthCheckPendingConfig:
+		return checkPendingConfigAnnotation(node, pendingConfigName)
+	}
+	return fmt.Errorf("unknown health check %q", check)
+}
+
+// waitForHealthy runs the health checks of the daemon until they all pass,
+// before a node rebooted into pendingConfigName is marked done, so a config
+// breaking nodes doesn't roll out to the rest of the pool. If they don't
+// within the health gate timeout, the returned error has errHealthGate as its
+// cause and names the check failing.
+func (dn *Daemon) waitForHealthy(pendingConfigName string) error {
+	if len(dn.healthChecks) == 0 {
+		return nil
+	}
+	glog.Infof("Waiting up to %v for health checks %s", dn.healthGateTimeout, strings.Join(dn.healthChecks, ", "))
+	started := time.Now()
+	var failing string
+	var lastErr error
+	err := wait.PollImmediate(healthGateInterval, dn.healthGateTimeout, func() (bool, error) {
+		for _, check := range dn.healthChecks {
+			if err := dn.runHealthCheck(check, pendingConfigName); err != nil {
+				if failing != check {
+					glog.Infof("Health check %s failing: %v", check, err)
+				}
+				failing, lastErr = check, err
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		err = errors.Wrapf(errHealthGate, "health check %s failed after %v: %v", failing, dn.healthGateTimeout, lastErr)
+		if unit, ok := healthCheckUnits[failing]; ok {
+			return withUnitJournal(err, unit, started)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	glog.Info("Health checks passed")
+	return nil
+}
@@ -0,0 +1,81 @@
+package daemon
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func newHealthGateTestDaemon(ready corev1.ConditionStatus, pendingConfig string) *Daemon {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "node",
+			Annotations: map[string]string{constants.PendingMachineConfigAnnotationKey: pendingConfig},
+		},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: ready, Message: "container runtime is down"}},
+		},
+	}
+	return &Daemon{
+		name:              "node",
+		kubeClient:        k8sfake.NewSimpleClientset(node),
+		healthChecks:      DefaultHealthChecks,
+		healthGateTimeout: 10 * time.Millisecond,
+	}
+}
+
+func TestWaitForHealthy(t *testing.T) {
+	defer func(orig func(string) error) { unitActive = orig }(unitActive)
+	inactive := map[string]bool{}
+	unitActive = func(unit string) error {
+		if inactive[unit] {
+			return fmt.Errorf("%s is failed", unit)
+		}
+		return nil
+	}
+
+	dn := newHealthGateTestDaemon(corev1.ConditionTrue, "rendered-new")
+	assert.Nil(t, dn.waitForHealthy("rendered-new"))
+
+	for _, tc := range []struct {
+		name     string
+		dn       *Daemon
+		inactive string
+		failing  string
+	}{
+		{"crio", newHealthGateTestDaemon(corev1.ConditionTrue, "rendered-new"), "crio.service", HealthCheckCrio},
+		{"kubelet", newHealthGateTestDaemon(corev1.ConditionTrue, "rendered-new"), "kubelet.service", HealthCheckKubelet},
+		{"not ready", newHealthGateTestDaemon(corev1.ConditionFalse, "rendered-new"), "", HealthCheckNodeReady},
+		{"pending config", newHealthGateTestDaemon(corev1.ConditionTrue, "rendered-other"), "", HealthCheckPendingConfig},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inactive = map[string]bool{tc.inactive: true}
+			err := tc.dn.waitForHealthy("rendered-new")
+			require.NotNil(t, err)
+			assert.Equal(t, errHealthGate, errors.Cause(err))
+			assert.Contains(t, err.Error(), "health check "+tc.failing+" failed")
+		})
+	}
+
+	// only the configured checks run
+	inactive = map[string]bool{"crio.service": true}
+	dn = newHealthGateTestDaemon(corev1.ConditionTrue, "rendered-new")
+	dn.healthChecks = []string{HealthCheckKubelet}
+	assert.Nil(t, dn.waitForHealthy("rendered-new"))
+	dn.healthChecks = nil
+	assert.Nil(t, dn.waitForHealthy("rendered-new"))
+}
+
+func TestValidateHealthChecks(t *testing.T) {
+	assert.Nil(t, validateHealthChecks(DefaultHealthChecks))
+	assert.Nil(t, validateHealthChecks(nil))
+	assert.NotNil(t, validateHealthChecks([]string{HealthCheckCrio, "disk"}))
+}
@@ -0,0 +1,184 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// pathUpdateHistory is where the updates applied to the node are
+	// recorded, see historyEntry
+	pathUpdateHistory = "/etc/machine-config-daemon/history.json"
+	// maxHistoryEntries is how many updates the history keeps, the oldest
+	// are dropped first
+	maxHistoryEntries = 20
+)
+
+// The outcomes of the updates of the history.
+const (
+	// historyStarted is for the update in progress, or one the daemon never
+	// got to finish recording, e.g. across the reboot
+	historyStarted = "Started"
+	// historySucceeded is for updates which made the new config current
+	historySucceeded = "Succeeded"
+	// historyFailed is for updates which failed, and were rolled back
+	historyFailed = "Failed"
+	// historyCanceled is for updates canceled as the desired config changed,
+	// see checkUpdateCanceled
+	historyCanceled = "Canceled"
+	// historyInterrupted is for updates another update started after,
+	// without their outcome being recorded
+	historyInterrupted = "Interrupted"
+)
+
+// historyEntry is an update applied to the node, as recorded at
+// pathUpdateHistory for support. The entry is written when the update
+// starts, and completed when it finishes, after the reboot if it takes one.
+type historyEntry struct {
+	OldConfig  string     `json:"oldConfig"`
+	NewConfig  string     `json:"newConfig"`
+	OSImageURL string     `json:"osImageURL,omitempty"`
+	Started    time.Time  `json:"started"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	// Reboot is whether the update rebooted the node
+	Reboot  bool   `json:"reboot"`
+	Outcome string `json:"outcome"`
+	// Error is why the update failed
+	Error string `json:"error,omitempty"`
+}
+
+// loadUpdateHistory returns the updates of the history, oldest first.
+func (dn *Daemon) loadUpdateHistory() ([]historyEntry, error) {
+	if dn.historyPath == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(dn.historyPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading update history")
+	}
+	var history []historyEntry
+	if err := json.Unmarshal(b, &history); err != nil {
+		return nil, errors.Wrapf(err, "parsing update history %s", dn.historyPath)
+	}
+	return history, nil
+}
+
+func (dn *Daemon) saveUpdateHistory(history []historyEntry) error {
+	if len(history) > maxHistoryEntries {
+		history = history[len(history)-maxHistoryEntries:]
+	}
+	b, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomicallyWithDefaults(dn.historyPath, b)
+}
+
+// recordUpdateStarted adds the update from oldConfig to newConfig to the
+// history, before it changes anything. The updates left started are
+// recorded as interrupted. Failing to record it doesn't fail the update.
+func (dn *Daemon) recordUpdateStarted(oldConfig, newConfig *mcfgv1.MachineConfig) {
+	logLifecycle(sdMessageUpdateStarted, journalPriInfo, fmt.Sprintf("Update from %s to %s started", oldConfig.GetName(), newConfig.GetName()), map[string]string{
+		"OLD_CONFIG": oldConfig.GetName(),
+		"NEW_CONFIG": newConfig.GetName(),
+	})
+	if dn.historyPath == "" {
+		return
+	}
+	history, err := dn.loadUpdateHistory()
+	if err != nil {
+		glog.Warningf("Unable to record the update to %s: %v", newConfig.GetName(), err)
+		history = nil
+	}
+	for i := range history {
+		if history[i].Outcome == historyStarted {
+			history[i].Outcome = historyInterrupted
+		}
+	}
+	history = append(history, historyEntry{
+		OldConfig:  oldConfig.GetName(),
+		NewConfig:  newConfig.GetName(),
+		OSImageURL: newConfig.Spec.OSImageURL,
+		Started:    time.Now().UTC(),
+		Outcome:    historyStarted,
+	})
+	if err := dn.saveUpdateHistory(history); err != nil {
+		glog.Warningf("Unable to record the update to %s: %v", newConfig.GetName(), err)
+	}
+}
+
+// recordUpdateFinished records the outcome of the update to newConfigName
+// started last, if it is still recorded as started: succeeded if err is nil,
+// else canceled or failed with err. Failing to record it is only logged.
+func (dn *Daemon) recordUpdateFinished(newConfigName string, reboot bool, err error) {
+	if dn.historyPath == "" {
+		logUpdateFinished("", newConfigName, updateOutcome(err), reboot, err)
+		return
+	}
+	history, lerr := dn.loadUpdateHistory()
+	if lerr != nil {
+		glog.Warningf("Unable to record the outcome of the update to %s: %v", newConfigName, lerr)
+		logUpdateFinished("", newConfigName, updateOutcome(err), reboot, err)
+		return
+	}
+	i := len(history) - 1
+	if i < 0 || history[i].NewConfig != newConfigName || history[i].Outcome != historyStarted {
+		return
+	}
+	finished := time.Now().UTC()
+	entry := &history[i]
+	entry.Finished = &finished
+	entry.Reboot = reboot
+	entry.Outcome = updateOutcome(err)
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	logUpdateFinished(entry.OldConfig, newConfigName, entry.Outcome, reboot, err)
+	// logged too, for must-gather to collect it with the daemon logs
+	glog.Infof("Update from %s to %s: %s (reboot: %v, started %s)", entry.OldConfig, entry.NewConfig, entry.Outcome, entry.Reboot, entry.Started.Format(time.RFC3339))
+	if err := dn.saveUpdateHistory(history); err != nil {
+		glog.Warningf("Unable to record the outcome of the update to %s: %v", newConfigName, err)
+	}
+}
+
+// updateOutcome returns the outcome of an update which returned err.
+func updateOutcome(err error) string {
+	switch err.(type) {
+	case nil:
+		return historySucceeded
+	case *updateCanceledError:
+		return historyCanceled
+	default:
+		return historyFailed
+	}
+}
+
+// logUpdateFinished sends the journal entry for the outcome of the update
+// from oldConfig, if known, to newConfig.
+func logUpdateFinished(oldConfig, newConfig, outcome string, reboot bool, err error) {
+	message := fmt.Sprintf("Update to %s: %s", newConfig, outcome)
+	priority := journalPriInfo
+	fields := map[string]string{
+		"OLD_CONFIG": oldConfig,
+		"NEW_CONFIG": newConfig,
+		"RESULT":     outcome,
+		"REBOOT":     strconv.FormatBool(reboot),
+	}
+	if err != nil {
+		message = fmt.Sprintf("%s: %v", message, err)
+		priority = journalPriWarning
+		fields["ERROR"] = err.Error()
+	}
+	logLifecycle(sdMessageUpdateFinished, priority, message, fields)
+}
@@ -0,0 +1,74 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-history")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dn := &Daemon{historyPath: filepath.Join(dir, "history.json")}
+	oldConfig := newTestMachineConfig("old", nil, nil)
+	newConfig := newTestMachineConfig("new", nil, nil)
+	newConfig.Spec.OSImageURL = "quay.io/openshift/os@sha256:new"
+
+	dn.recordUpdateStarted(oldConfig, newConfig)
+	history, err := dn.loadUpdateHistory()
+	require.Nil(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, historyStarted, history[0].Outcome)
+	assert.Equal(t, "quay.io/openshift/os@sha256:new", history[0].OSImageURL)
+	assert.Nil(t, history[0].Finished)
+
+	// as after the reboot into it
+	dn.recordUpdateFinished("new", true, nil)
+	history, err = dn.loadUpdateHistory()
+	require.Nil(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, historySucceeded, history[0].Outcome)
+	assert.True(t, history[0].Reboot)
+	require.NotNil(t, history[0].Finished)
+	dn.recordUpdateFinished("new", false, fmt.Errorf("too late"))
+	history, err = dn.loadUpdateHistory()
+	require.Nil(t, err)
+	assert.Equal(t, historySucceeded, history[0].Outcome, "a finished update is only recorded once")
+
+	dn.recordUpdateStarted(newConfig, oldConfig)
+	dn.recordUpdateFinished("old", false, errors.Wrapf(errDrainTimeout, "draining"))
+	dn.recordUpdateStarted(oldConfig, newConfig)
+	dn.recordUpdateStarted(oldConfig, newConfig)
+	dn.recordUpdateFinished("new", false, &updateCanceledError{phase: updatePhaseDraining, reason: "desired config changed to other"})
+	history, err = dn.loadUpdateHistory()
+	require.Nil(t, err)
+	var outcomes []string
+	for _, entry := range history {
+		outcomes = append(outcomes, entry.Outcome)
+	}
+	assert.Equal(t, []string{historySucceeded, historyFailed, historyInterrupted, historyCanceled}, outcomes)
+	assert.Equal(t, "draining: drain timed out", history[1].Error)
+
+	for i := 0; i < maxHistoryEntries; i++ {
+		dn.recordUpdateStarted(oldConfig, newConfig)
+		dn.recordUpdateFinished("new", false, nil)
+	}
+	history, err = dn.loadUpdateHistory()
+	require.Nil(t, err)
+	assert.Len(t, history, maxHistoryEntries, "the oldest updates are dropped")
+
+	w := httptest.NewRecorder()
+	dn.serveStatus(w, httptest.NewRequest("GET", "/debug/status", nil))
+	var status statusResponse
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Len(t, status.History, maxHistoryEntries, "the history is served on /debug/status")
+}
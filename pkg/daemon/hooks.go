@@ -0,0 +1,125 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// preUpdateHooksDir holds the executables run before a node is drained
+	// for an update, shipped as ordinary files of the config
+	preUpdateHooksDir = "/etc/machine-config-daemon/hooks/pre-update.d"
+	// postUpdateHooksDir holds the executables run once a node booted into
+	// the config of an update
+	postUpdateHooksDir = "/etc/machine-config-daemon/hooks/post-update.d"
+
+	// hookTimeout bounds the run of each hook
+	hookTimeout = 5 * time.Minute
+	// maxHookStderr bounds the stderr of failed hooks reported, as it ends up
+	// in the Degraded reason
+	maxHookStderr = 1024
+
+	// hookOldConfigEnv and hookNewConfigEnv pass the names of the configs
+	// updated from and to to hooks
+	hookOldConfigEnv = "MCD_OLD_CONFIG"
+	hookNewConfigEnv = "MCD_NEW_CONFIG"
+)
+
+// hookError is the failure of a hook, with what it wrote to stderr.
+type hookError struct {
+	hook   string
+	stderr string
+	err    error
+}
+
+func (e *hookError) Error() string {
+	if e.stderr == "" {
+		return fmt.Sprintf("hook %s failed: %v", e.hook, e.err)
+	}
+	return fmt.Sprintf("hook %s failed: %v: %s", e.hook, e.err, e.stderr)
+}
+
+// listHooks returns the sorted paths of the executables in dir, none if it
+// doesn't exist.
+func listHooks(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var hooks []string
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || e.Mode().Perm()&0111 == 0 {
+			glog.V(2).Infof("Skipping %s in %s, not an executable", e.Name(), dir)
+			continue
+		}
+		// ReadDir sorts by name, so hooks run in the order of their names
+		hooks = append(hooks, filepath.Join(dir, e.Name()))
+	}
+	return hooks, nil
+}
+
+// runHooks runs the hooks of dir one after the other, and stops at the first
+// failing.
+func runHooks(dir, oldConfigName, newConfigName string) error {
+	hooks, err := listHooks(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list hooks in %s: %v", dir, err)
+	}
+	for _, hook := range hooks {
+		glog.Infof("Running hook %s", hook)
+		if err := runHook(hook, oldConfigName, newConfigName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runHook runs hook with the config names in its environment, within
+// hookTimeout.
+func runHook(hook, oldConfigName, newConfigName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, hook)
+	cmd.Env = append(os.Environ(), hookOldConfigEnv+"="+oldConfigName, hookNewConfigEnv+"="+newConfigName)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %v", hookTimeout)
+		}
+		return &hookError{hook: filepath.Base(hook), stderr: truncateUTF8(strings.TrimSpace(stderr.String()), maxHookStderr), err: err}
+	}
+	return nil
+}
+
+// runPreUpdateHooks runs the pre-update hooks before the node is drained for
+// the update from oldConfigName to newConfigName. A failing hook aborts the
+// update.
+func (dn *Daemon) runPreUpdateHooks(oldConfigName, newConfigName string) error {
+	return runHooks(preUpdateHooksDir, oldConfigName, newConfigName)
+}
+
+// runPostUpdateHooks runs the post-update hooks once the node booted into
+// newConfigName. The update is done by then, so failing hooks only get a
+// warning event.
+func (dn *Daemon) runPostUpdateHooks(oldConfigName, newConfigName string) {
+	if err := runHooks(postUpdateHooksDir, oldConfigName, newConfigName); err != nil {
+		glog.Warningf("Post-update hooks of %s: %v", newConfigName, err)
+		if dn.recorder != nil && dn.node != nil {
+			dn.recorder.Eventf(getNodeRef(dn.node), corev1.EventTypeWarning, "PostUpdateHookFailed", "Update to %s: %v", newConfigName, err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeHook(t *testing.T, dir, name, script string, mode os.FileMode) {
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), mode))
+}
+
+func TestRunHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-hooks")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	writeHook(t, dir, "20-second", `echo "second $MCD_OLD_CONFIG $MCD_NEW_CONFIG" >> `+out, 0755)
+	writeHook(t, dir, "10-first", `echo first >> `+out, 0755)
+	// not executable, so not a hook
+	writeHook(t, dir, "30-disabled", `echo disabled >> `+out, 0644)
+
+	require.Nil(t, runHooks(dir, "rendered-old", "rendered-new"))
+	b, err := ioutil.ReadFile(out)
+	require.Nil(t, err)
+	assert.Equal(t, "first\nsecond rendered-old rendered-new\n", string(b))
+
+	// a missing directory has no hooks
+	assert.Nil(t, runHooks(filepath.Join(dir, "missing"), "rendered-old", "rendered-new"))
+}
+
+func TestRunHooksFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-hooks")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	writeHook(t, dir, "10-quiesce", `echo "storage busy" >&2; exit 3`, 0755)
+	writeHook(t, dir, "20-notify", `echo notified >> `+out, 0755)
+
+	err = runHooks(dir, "rendered-old", "rendered-new")
+	require.NotNil(t, err)
+	herr, ok := err.(*hookError)
+	require.True(t, ok, "unexpected error type %T", err)
+	assert.Equal(t, "10-quiesce", herr.hook)
+	assert.Equal(t, "storage busy", herr.stderr)
+	assert.Equal(t, "hook 10-quiesce failed: exit status 3: storage busy", err.Error())
+	// the hooks after the failing one don't run
+	_, err = os.Stat(out)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,154 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/godbus/dbus"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// shutdownInhibitReason is what logind reports holds up a shutdown delayed
+// by the daemon, e.g. in systemd-inhibit --list
+const shutdownInhibitReason = "machine-config-daemon is applying configuration"
+
+// shutdownInhibitor is a logind delay inhibitor lock on shutdowns and reboots.
+// While it is held, logind announces a shutdown and waits for the lock to be
+// released, or for InhibitDelayMaxSec, before going on with it.
+type shutdownInhibitor interface {
+	// shutdownRequested is closed once logind announced a shutdown
+	shutdownRequested() <-chan struct{}
+	// release releases the lock
+	release() error
+}
+
+// takeShutdownInhibitor takes a shutdown inhibitor lock from logind, it is
+// swapped out by tests.
+var takeShutdownInhibitor = func() (shutdownInhibitor, error) {
+	return takeLogindInhibitor()
+}
+
+// logindInhibitor is a shutdownInhibitor held from logind, over a private
+// connection to the system bus the shutdown announcements are received on.
+type logindInhibitor struct {
+	conn     *dbus.Conn
+	fd       *os.File
+	shutdown chan struct{}
+	done     chan struct{}
+}
+
+func takeLogindInhibitor() (*logindInhibitor, error) {
+	conn, err := connectLogind()
+	if err != nil {
+		return nil, errors.Wrapf(err, "connecting to the system bus")
+	}
+	// subscribe first, so that no announcement is missed once the lock is
+	// taken
+	rule := fmt.Sprintf("type='signal',sender='%s',interface='%s',member='PrepareForShutdown'", logindBusName, logindManagerInterface)
+	if err := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, rule).Err; err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "subscribing to %s", rule)
+	}
+	signals := make(chan *dbus.Signal, 4)
+	conn.Signal(signals)
+
+	var fd dbus.UnixFD
+	if err := conn.Object(logindBusName, logindPath).Call(logindManagerInterface+".Inhibit", 0, "shutdown", "machine-config-daemon", shutdownInhibitReason, "delay").Store(&fd); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "taking shutdown inhibitor lock")
+	}
+	inhibitor := &logindInhibitor{
+		conn:     conn,
+		fd:       os.NewFile(uintptr(fd), "shutdown-inhibitor"),
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go inhibitor.watch(signals)
+	return inhibitor, nil
+}
+
+// watch closes shutdown once logind announces a shutdown, until released.
+func (i *logindInhibitor) watch(signals <-chan *dbus.Signal) {
+	for {
+		select {
+		case <-i.done:
+			return
+		case signal, ok := <-signals:
+			if !ok {
+				return
+			}
+			if signal.Name != logindManagerInterface+".PrepareForShutdown" || len(signal.Body) < 1 {
+				continue
+			}
+			if starting, _ := signal.Body[0].(bool); starting {
+				close(i.shutdown)
+				return
+			}
+		}
+	}
+}
+
+func (i *logindInhibitor) shutdownRequested() <-chan struct{} {
+	return i.shutdown
+}
+
+func (i *logindInhibitor) release() error {
+	close(i.done)
+	err := i.fd.Close()
+	i.conn.Close()
+	return err
+}
+
+// inhibitShutdown takes a shutdown inhibitor lock for the steps of an update
+// which leave the node half updated if it is interrupted, writing files and
+// staging the OS, so that a shutdown requested meanwhile waits for the next
+// step the update journal recovers from, see exitIfTerminating. Failing to
+// take it is only logged, the update goes on unprotected.
+func (dn *Daemon) inhibitShutdown() {
+	if dn.inhibitor != nil {
+		return
+	}
+	inhibitor, err := takeShutdownInhibitor()
+	if err != nil {
+		glog.Warningf("Unable to inhibit shutdowns during the update: %v", err)
+		return
+	}
+	glog.Info("Inhibiting shutdowns while applying the update")
+	dn.inhibitor = inhibitor
+	dn.status.update(func(s *daemonState) {
+		s.ShutdownInhibited = true
+	})
+}
+
+// releaseShutdownInhibitor releases the lock taken by inhibitShutdown, if
+// held. It is released before the daemon reboots the node itself, which would
+// otherwise be delayed by it.
+func (dn *Daemon) releaseShutdownInhibitor() {
+	if dn.inhibitor == nil {
+		return
+	}
+	if err := dn.inhibitor.release(); err != nil {
+		glog.Warningf("Unable to release the shutdown inhibitor lock: %v", err)
+	} else {
+		glog.Info("Released the shutdown inhibitor lock")
+	}
+	dn.inhibitor = nil
+	dn.status.update(func(s *daemonState) {
+		s.ShutdownInhibited = false
+	})
+}
+
+// shutdownRequested returns whether logind announced a shutdown the daemon
+// holds up.
+func (dn *Daemon) shutdownRequested() bool {
+	if dn.inhibitor == nil {
+		return false
+	}
+	select {
+	case <-dn.inhibitor.shutdownRequested():
+		return true
+	default:
+		return false
+	}
+}
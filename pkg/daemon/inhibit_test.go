@@ -0,0 +1,65 @@
+package daemon
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeInhibitor struct {
+	shutdown chan struct{}
+	released int
+}
+
+func (i *fakeInhibitor) shutdownRequested() <-chan struct{} {
+	return i.shutdown
+}
+
+func (i *fakeInhibitor) release() error {
+	i.released++
+	return nil
+}
+
+func TestInhibitShutdown(t *testing.T) {
+	var exits []int
+	defer func(orig func(int)) { exitProcess = orig }(exitProcess)
+	exitProcess = func(code int) { exits = append(exits, code) }
+	inhibitor := &fakeInhibitor{shutdown: make(chan struct{})}
+	defer func(orig func() (shutdownInhibitor, error)) { takeShutdownInhibitor = orig }(takeShutdownInhibitor)
+	takeShutdownInhibitor = func() (shutdownInhibitor, error) {
+		return inhibitor, nil
+	}
+
+	dn := &Daemon{}
+	dn.inhibitShutdown()
+	assert.True(t, dn.currentState().ShutdownInhibited)
+	dn.exitIfTerminating("after writing files")
+	assert.Empty(t, exits)
+
+	// a shutdown is held up until the next step recovery starts from
+	close(inhibitor.shutdown)
+	dn.exitIfTerminating("after writing files")
+	assert.Equal(t, []int{0}, exits)
+	assert.Equal(t, 1, inhibitor.released)
+	assert.False(t, dn.currentState().ShutdownInhibited)
+
+	// releasing again is a no-op
+	dn.releaseShutdownInhibitor()
+	assert.Equal(t, 1, inhibitor.released)
+}
+
+func TestInhibitShutdownUnavailable(t *testing.T) {
+	defer func(orig func() (shutdownInhibitor, error)) { takeShutdownInhibitor = orig }(takeShutdownInhibitor)
+	takeShutdownInhibitor = func() (shutdownInhibitor, error) {
+		return nil, fmt.Errorf("no system bus")
+	}
+
+	// the update goes on unprotected
+	dn := &Daemon{}
+	dn.inhibitShutdown()
+	assert.Nil(t, dn.inhibitor)
+	assert.False(t, dn.currentState().ShutdownInhibited)
+	assert.False(t, dn.shutdownRequested())
+	dn.releaseShutdownInhibitor()
+}
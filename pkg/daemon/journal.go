@@ -0,0 +1,198 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/golang/glog"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/pkg/errors"
+)
+
+// pathUpdateJournal is where the update in flight is recorded, so that a
+// daemon killed halfway through it can recover on startup
+const pathUpdateJournal = "/etc/machine-config-daemon/update-journal.json"
+
+// updateJournal records an update in flight. It is written before the update
+// changes anything and removed once the update is complete or rolled back.
+type updateJournal struct {
+	// OldConfig and NewConfig are the names of the configs updated from and
+	// to.
+	OldConfig string `json:"oldConfig"`
+	NewConfig string `json:"newConfig"`
+	// Files and Units are the paths of the files and the names of the units
+	// the update touches.
+	Files []string `json:"files,omitempty"`
+	Units []string `json:"units,omitempty"`
+	// Phase is the last update phase reached.
+	Phase string `json:"phase"`
+	// BootID is the boot the update was made in.
+	BootID string `json:"bootID"`
+}
+
+// journaling returns whether the updates of the daemon are journaled. Only
+// the cluster driven daemon recovers them.
+func (dn *Daemon) journaling() bool {
+	return dn.onceFrom == "" && dn.journalPath != ""
+}
+
+func (dn *Daemon) loadUpdateJournal() (*updateJournal, error) {
+	b, err := ioutil.ReadFile(dn.journalPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading update journal")
+	}
+	var j updateJournal
+	if err := json.Unmarshal(b, &j); err != nil {
+		return nil, errors.Wrapf(err, "parsing update journal %s", dn.journalPath)
+	}
+	return &j, nil
+}
+
+func (dn *Daemon) saveUpdateJournal(j *updateJournal) error {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomicallyWithDefaults(dn.journalPath, b)
+}
+
+// startUpdateJournal records that the update from oldConfig to newConfig is
+// about to write files, before it does.
+func (dn *Daemon) startUpdateJournal(oldConfig, newConfig *mcfgv1.MachineConfig) error {
+	if !dn.journaling() {
+		return nil
+	}
+	return dn.saveUpdateJournal(&updateJournal{
+		OldConfig: oldConfig.GetName(),
+		NewConfig: newConfig.GetName(),
+		Files:     changedFiles(oldConfig.Spec.Config.Storage.Files, newConfig.Spec.Config.Storage.Files),
+		Units:     changedUnits(oldConfig.Spec.Config.Systemd.Units, newConfig.Spec.Config.Systemd.Units),
+		Phase:     updatePhaseUpdatingFiles,
+		BootID:    dn.bootID,
+	})
+}
+
+// journalUpdatePhase records that the update in flight entered phase, before
+// it makes the changes of that phase.
+func (dn *Daemon) journalUpdatePhase(phase string) error {
+	if !dn.journaling() {
+		return nil
+	}
+	j, err := dn.loadUpdateJournal()
+	if err != nil || j == nil {
+		return err
+	}
+	j.Phase = phase
+	return dn.saveUpdateJournal(j)
+}
+
+// clearUpdateJournal records that there is no update in flight anymore.
+func (dn *Daemon) clearUpdateJournal() error {
+	if !dn.journaling() {
+		return nil
+	}
+	if err := os.Remove(dn.journalPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "removing update journal")
+	}
+	return nil
+}
+
+// journalRecovery is what an interrupted update takes on startup.
+type journalRecovery int
+
+const (
+	// journalComplete is for updates which went through, the reboot
+	// included
+	journalComplete journalRecovery = iota
+	// journalResumeReboot is for updates interrupted once everything was
+	// applied, with only the reboot left
+	journalResumeReboot
+	// journalRollBack is for updates interrupted while applying changes,
+	// which are undone before retrying
+	journalRollBack
+)
+
+// journalRecoveryFor returns how to recover from the update recorded in j, on
+// the boot bootID.
+func journalRecoveryFor(j *updateJournal, bootID string) journalRecovery {
+	if j.Phase != updatePhaseRebooting {
+		return journalRollBack
+	}
+	if j.BootID == bootID {
+		return journalResumeReboot
+	}
+	return journalComplete
+}
+
+// phaseReached returns whether the update recorded in j got to phase.
+func (j *updateJournal) phaseReached(phase string) bool {
+	reached, at := -1, -1
+	for i, p := range updatePhases {
+		if p == j.Phase {
+			reached = i
+		}
+		if p == phase {
+			at = i
+		}
+	}
+	return reached >= at
+}
+
+// recoverUpdateJournal recovers from an update the daemon was killed in the
+// middle of, if any. Updates interrupted with only the reboot left are
+// resumed: the config to reboot into is returned. Any other is rolled back:
+// the pending deployment is discarded, then the files, units and users of
+// the old config are rewritten, as if the update had failed, so that it is
+// retried from a known state.
+func (dn *Daemon) recoverUpdateJournal() (*mcfgv1.MachineConfig, error) {
+	j, err := dn.loadUpdateJournal()
+	if err != nil || j == nil {
+		return nil, err
+	}
+
+	switch journalRecoveryFor(j, dn.bootID) {
+	case journalComplete:
+		glog.V(2).Infof("Update from %s to %s completed with the reboot", j.OldConfig, j.NewConfig)
+		return nil, dn.clearUpdateJournal()
+	case journalResumeReboot:
+		newConfig, err := dn.mcLister.Get(j.NewConfig)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting config %s to resume the update to", j.NewConfig)
+		}
+		dn.logSystem("Resuming the update from %s to %s interrupted before rebooting", j.OldConfig, j.NewConfig)
+		return newConfig, nil
+	}
+
+	oldConfig, err := dn.mcLister.Get(j.OldConfig)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting config %s to roll back to", j.OldConfig)
+	}
+	newConfig, err := dn.mcLister.Get(j.NewConfig)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting config %s to roll back from", j.NewConfig)
+	}
+	dn.logSystem("Rolling back the update from %s to %s interrupted in phase %s (files %v, units %v)",
+		j.OldConfig, j.NewConfig, j.Phase, j.Files, j.Units)
+
+	if j.phaseReached(updatePhaseUpdatingOS) {
+		if err := dn.updater().cleanupPendingDeployment(); err != nil {
+			return nil, fmt.Errorf("failed to roll back the OS changes of %s: %v", j.NewConfig, err)
+		}
+	}
+	if err := dn.updateFiles(newConfig, oldConfig); err != nil {
+		return nil, fmt.Errorf("failed to roll back the files of %s: %v", j.NewConfig, err)
+	}
+	if j.phaseReached(updatePhaseUpdatingSSHKeys) {
+		if err := dn.updatePasswd(newConfig.Spec.Config.Passwd.Users, oldConfig.Spec.Config.Passwd.Users); err != nil {
+			return nil, fmt.Errorf("failed to roll back the users of %s: %v", j.NewConfig, err)
+		}
+	}
+	glog.Infof("Rolled back to %s", j.OldConfig)
+	dn.recordUpdateFinished(j.NewConfig, false, errors.Errorf("interrupted in phase %s, rolled back on startup", j.Phase))
+	return nil, dn.clearUpdateJournal()
+}
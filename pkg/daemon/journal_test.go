@@ -0,0 +1,193 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	mcfglistersv1 "github.com/openshift/machine-config-operator/pkg/generated/listers/machineconfiguration.openshift.io/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/tools/cache"
+)
+
+// newJournalTestDaemon returns a daemon knowing configs which keeps its state
+// under dir, as a restarted daemon would find it. The SSH keys it writes are
+// stored in sshKeys.
+func newJournalTestDaemon(t *testing.T, dir, bootID string, client NodeUpdaterClient, sshKeys *string, configs ...*mcfgv1.MachineConfig) *Daemon {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, config := range configs {
+		require.Nil(t, indexer.Add(config))
+	}
+	return &Daemon{
+		bootID:            bootID,
+		OperatingSystem:   machineConfigDaemonOSRHCOS,
+		NodeUpdaterClient: client,
+		mcLister:          mcfglistersv1.NewMachineConfigLister(indexer),
+		ownedFilesPath:    filepath.Join(dir, "owned-files.json"),
+		originalFilesDir:  filepath.Join(dir, "orig"),
+		journalPath:       filepath.Join(dir, "update-journal.json"),
+		createdUsersPath:  filepath.Join(dir, "created-users.json"),
+		atomicSSHKeysWriter: func(user ignv2_2types.PasswdUser, keys string) error {
+			*sshKeys = keys
+			return nil
+		},
+	}
+}
+
+func newJournalTestConfigs(root string) (*mcfgv1.MachineConfig, *mcfgv1.MachineConfig) {
+	oldConfig := newTestMachineConfig("old", []ignv2_2types.File{
+		newTestFile(filepath.Join(root, "etc/changed.conf"), "old"),
+		newTestFile(filepath.Join(root, "etc/removed.conf"), "removed"),
+	}, nil)
+	oldConfig.Spec.Config.Passwd.Users = []ignv2_2types.PasswdUser{{Name: "core", SSHAuthorizedKeys: []ignv2_2types.SSHAuthorizedKey{"old-key"}}}
+	newConfig := newTestMachineConfig("new", []ignv2_2types.File{
+		newTestFile(filepath.Join(root, "etc/changed.conf"), "new"),
+		newTestFile(filepath.Join(root, "etc/added.conf"), "added"),
+	}, nil)
+	newConfig.Spec.Config.Passwd.Users = []ignv2_2types.PasswdUser{{Name: "core", SSHAuthorizedKeys: []ignv2_2types.SSHAuthorizedKey{"new-key"}}}
+	return oldConfig, newConfig
+}
+
+// runUpdateUntil applies the update from oldConfig to newConfig like update
+// does, journal included, and stops as if the daemon was killed right after
+// entering phase.
+func runUpdateUntil(t *testing.T, dn *Daemon, oldConfig, newConfig *mcfgv1.MachineConfig, phase string) {
+	require.Nil(t, dn.startUpdateJournal(oldConfig, newConfig))
+	if phase == updatePhaseUpdatingFiles {
+		// killed halfway through writing the files
+		require.Nil(t, dn.writeFiles(newConfig.Spec.Config.Storage.Files[:1]))
+		return
+	}
+	require.Nil(t, dn.updateFiles(oldConfig, newConfig))
+
+	require.Nil(t, dn.journalUpdatePhase(updatePhaseUpdatingSSHKeys))
+	require.Nil(t, dn.updatePasswd(oldConfig.Spec.Config.Passwd.Users, newConfig.Spec.Config.Passwd.Users))
+	for _, p := range []string{updatePhaseUpdatingOS, updatePhaseDraining, updatePhaseRebooting} {
+		j, err := dn.loadUpdateJournal()
+		require.Nil(t, err)
+		if j.Phase == phase {
+			return
+		}
+		require.Nil(t, dn.journalUpdatePhase(p))
+	}
+}
+
+func readTestFiles(t *testing.T, root string) map[string]string {
+	contents := make(map[string]string)
+	for _, name := range []string{"changed.conf", "removed.conf", "added.conf"} {
+		b, err := ioutil.ReadFile(filepath.Join(root, "etc", name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		require.Nil(t, err)
+		contents[name] = string(b)
+	}
+	return contents
+}
+
+func TestUpdateJournalRecovery(t *testing.T) {
+	oldFiles := map[string]string{"changed.conf": "old", "removed.conf": "removed"}
+	newFiles := map[string]string{"changed.conf": "new", "added.conf": "added"}
+
+	for _, phase := range []string{
+		updatePhaseUpdatingFiles,
+		updatePhaseUpdatingSSHKeys,
+		updatePhaseUpdatingOS,
+		updatePhaseDraining,
+		updatePhaseRebooting,
+	} {
+		t.Run(phase, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "mcd-journal")
+			require.Nil(t, err)
+			defer os.RemoveAll(dir)
+			root := filepath.Join(dir, "root")
+			oldConfig, newConfig := newJournalTestConfigs(root)
+
+			var sshKeys string
+			dn := newJournalTestDaemon(t, dir, "boot-1", RpmOstreeClientMock{}, &sshKeys, oldConfig, newConfig)
+			require.Nil(t, dn.updateFiles(&mcfgv1.MachineConfig{}, oldConfig))
+			require.Nil(t, dn.updatePasswd(nil, oldConfig.Spec.Config.Passwd.Users))
+			runUpdateUntil(t, dn, oldConfig, newConfig, phase)
+
+			// the daemon restarts
+			dn = newJournalTestDaemon(t, dir, "boot-1", RpmOstreeClientMock{}, &sshKeys, oldConfig, newConfig)
+			resume, err := dn.recoverUpdateJournal()
+			require.Nil(t, err)
+
+			if phase != updatePhaseRebooting {
+				assert.Nil(t, resume)
+				assert.Equal(t, oldFiles, readTestFiles(t, root))
+				assert.Equal(t, "old-key\n", sshKeys)
+				_, err = os.Stat(dn.journalPath)
+				assert.True(t, os.IsNotExist(err), "journal was not removed")
+				return
+			}
+
+			// everything was applied, only the reboot is left
+			require.NotNil(t, resume)
+			assert.Equal(t, newConfig.GetName(), resume.GetName())
+			assert.Equal(t, newFiles, readTestFiles(t, root))
+			assert.Equal(t, "new-key\n", sshKeys)
+
+			// the daemon restarts after the reboot
+			dn = newJournalTestDaemon(t, dir, "boot-2", RpmOstreeClientMock{}, &sshKeys, oldConfig, newConfig)
+			resume, err = dn.recoverUpdateJournal()
+			require.Nil(t, err)
+			assert.Nil(t, resume)
+			assert.Equal(t, newFiles, readTestFiles(t, root))
+			_, err = os.Stat(dn.journalPath)
+			assert.True(t, os.IsNotExist(err), "journal was not removed")
+		})
+	}
+}
+
+func TestUpdateJournalRollBackOSChanges(t *testing.T) {
+	client := RpmOstreeClientMock{CleanupPendingDeploymentReturns: fmt.Errorf("cleanup failed")}
+
+	for _, test := range []struct {
+		phase   string
+		cleanup bool
+	}{
+		{updatePhaseUpdatingSSHKeys, false},
+		{updatePhaseUpdatingOS, true},
+		{updatePhaseDraining, true},
+	} {
+		dir, err := ioutil.TempDir("", "mcd-journal")
+		require.Nil(t, err)
+		defer os.RemoveAll(dir)
+		oldConfig, newConfig := newJournalTestConfigs(filepath.Join(dir, "root"))
+
+		var sshKeys string
+		dn := newJournalTestDaemon(t, dir, "boot-1", client, &sshKeys, oldConfig, newConfig)
+		runUpdateUntil(t, dn, oldConfig, newConfig, test.phase)
+		_, err = dn.recoverUpdateJournal()
+		if !test.cleanup {
+			assert.Nil(t, err, "phase %s", test.phase)
+			continue
+		}
+		// the pending deployment is discarded first, and the rollback is
+		// retried on the next start
+		assert.NotNil(t, err, "phase %s", test.phase)
+		_, err = os.Stat(dn.journalPath)
+		assert.Nil(t, err, "phase %s: journal was removed", test.phase)
+	}
+}
+
+func TestJournalNotWrittenOnceFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-journal")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	oldConfig, newConfig := newJournalTestConfigs(filepath.Join(dir, "root"))
+
+	var sshKeys string
+	dn := newJournalTestDaemon(t, dir, "boot-1", RpmOstreeClientMock{}, &sshKeys)
+	dn.onceFrom = "/etc/test.ign"
+	require.Nil(t, dn.startUpdateJournal(oldConfig, newConfig))
+	_, err = os.Stat(dn.journalPath)
+	assert.True(t, os.IsNotExist(err), "journal was written")
+}
@@ -0,0 +1,83 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+)
+
+// pathProcCmdline is the kernel command line of the running system
+const pathProcCmdline = "/proc/cmdline"
+
+// diffKernelArguments returns the kernel arguments in newKargs but not in
+// oldKargs, and those in oldKargs but not in newKargs, in order.
+func diffKernelArguments(oldKargs, newKargs []string) (added, removed []string) {
+	oldSet := make(map[string]struct{}, len(oldKargs))
+	for _, karg := range oldKargs {
+		oldSet[karg] = struct{}{}
+	}
+	newSet := make(map[string]struct{}, len(newKargs))
+	for _, karg := range newKargs {
+		newSet[karg] = struct{}{}
+	}
+	for _, karg := range newKargs {
+		if _, ok := oldSet[karg]; !ok {
+			added = append(added, karg)
+			oldSet[karg] = struct{}{}
+		}
+	}
+	for _, karg := range oldKargs {
+		if _, ok := newSet[karg]; !ok {
+			removed = append(removed, karg)
+			newSet[karg] = struct{}{}
+		}
+	}
+	return added, removed
+}
+
+// updateKernelArguments applies the kernel arguments added and removed between
+// oldConfig and newConfig to the deployment booted next. They take effect on
+// reboot.
+func (dn *Daemon) updateKernelArguments(oldConfig, newConfig *mcfgv1.MachineConfig) error {
+	added, removed := diffKernelArguments(oldConfig.Spec.KernelArguments, newConfig.Spec.KernelArguments)
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	dn.logSystem("Updating kernel arguments: adding %v, removing %v", added, removed)
+	return dn.updater().updateKernelArguments(added, removed)
+}
+
+// checkKernelArguments returns an error listing the kernel arguments of
+// expected which are missing from the kernel command line cmdline.
+func checkKernelArguments(cmdline string, expected []string) error {
+	booted := make(map[string]struct{})
+	for _, karg := range strings.Fields(cmdline) {
+		booted[karg] = struct{}{}
+	}
+	var missing []string
+	for _, karg := range expected {
+		if _, ok := booted[karg]; !ok {
+			missing = append(missing, karg)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("expected kernel arguments %s, missing from %s", strings.Join(missing, " "), pathProcCmdline)
+	}
+	return nil
+}
+
+// checkBootedKernelArguments checks that the system was booted with the
+// kernel arguments of config.
+func (dn *Daemon) checkBootedKernelArguments(config *mcfgv1.MachineConfig) error {
+	if len(config.Spec.KernelArguments) == 0 {
+		return nil
+	}
+	cmdline, err := ioutil.ReadFile(pathProcCmdline)
+	if err != nil {
+		return fmt.Errorf("failed to read the kernel command line: %v", err)
+	}
+	return checkKernelArguments(string(cmdline), config.Spec.KernelArguments)
+}
@@ -0,0 +1,79 @@
+package daemon
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffKernelArguments(t *testing.T) {
+	tests := []struct {
+		name           string
+		oldKargs       []string
+		newKargs       []string
+		added, removed []string
+	}{{
+		name:     "unchanged",
+		oldKargs: []string{"nosmt", "hugepages=16"},
+		newKargs: []string{"nosmt", "hugepages=16"},
+	}, {
+		name:     "reordered",
+		oldKargs: []string{"nosmt", "hugepages=16"},
+		newKargs: []string{"hugepages=16", "nosmt"},
+	}, {
+		name:     "added",
+		newKargs: []string{"nosmt", "hugepages=16"},
+		added:    []string{"nosmt", "hugepages=16"},
+	}, {
+		name:     "changed value",
+		oldKargs: []string{"nosmt", "hugepages=16"},
+		newKargs: []string{"hugepages=32", "nosmt"},
+		added:    []string{"hugepages=32"},
+		removed:  []string{"hugepages=16"},
+	}, {
+		name:     "duplicates",
+		oldKargs: []string{"nosmt", "nosmt"},
+		newKargs: []string{"console=tty0", "console=tty0"},
+		added:    []string{"console=tty0"},
+		removed:  []string{"nosmt"},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			added, removed := diffKernelArguments(test.oldKargs, test.newKargs)
+			if !reflect.DeepEqual(added, test.added) {
+				t.Errorf("Expected added %v, got %v", test.added, added)
+			}
+			if !reflect.DeepEqual(removed, test.removed) {
+				t.Errorf("Expected removed %v, got %v", test.removed, removed)
+			}
+		})
+	}
+}
+
+func TestCheckKernelArguments(t *testing.T) {
+	cmdline := "BOOT_IMAGE=/ostree/vmlinuz rw nosmt hugepages=16\n"
+	if err := checkKernelArguments(cmdline, []string{"nosmt", "hugepages=16"}); err != nil {
+		t.Errorf("Expected kernel arguments to match: %v", err)
+	}
+	if err := checkKernelArguments(cmdline, nil); err != nil {
+		t.Errorf("Expected no kernel arguments to match: %v", err)
+	}
+	if err := checkKernelArguments(cmdline, []string{"nosmt", "hugepages=32"}); err == nil {
+		t.Errorf("Expected missing hugepages=32 to fail")
+	}
+}
+
+func TestReconcilableKernelArguments(t *testing.T) {
+	d := Daemon{}
+	oldConfig := newTestMachineConfig("old", nil, nil)
+	newConfig := newTestMachineConfig("new", nil, nil)
+
+	newConfig.Spec.KernelArguments = []string{"nosmt"}
+	if err := d.reconcilable(oldConfig, newConfig); err != nil {
+		t.Errorf("Expected kernel arguments changes to be reconcilable: %v", err)
+	}
+
+	newConfig.Spec.KernelArguments = []string{"nosmt hugepages=16"}
+	if err := d.reconcilable(oldConfig, newConfig); err == nil {
+		t.Errorf("Expected a kernel argument with spaces to be unreconcilable")
+	}
+}
@@ -0,0 +1,26 @@
+package daemon
+
+import (
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+)
+
+// kernelType returns the kernel type of config, defaulting it.
+func kernelType(config *mcfgv1.MachineConfig) string {
+	if config.Spec.KernelType == "" {
+		return mcfgv1.KernelTypeDefault
+	}
+	return config.Spec.KernelType
+}
+
+// updateKernelType switches the deployment booted next to the kernel of
+// newConfig, if it changed from oldConfig. Switching to the default kernel
+// removes the realtime kernel overrides.
+func (dn *Daemon) updateKernelType(oldConfig, newConfig *mcfgv1.MachineConfig) error {
+	oldType, newType := kernelType(oldConfig), kernelType(newConfig)
+	if oldType == newType {
+		return nil
+	}
+
+	dn.logSystem("Switching kernel from %s to %s", oldType, newType)
+	return dn.updater().switchKernel(newType == mcfgv1.KernelTypeRealtime)
+}
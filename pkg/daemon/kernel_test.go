@@ -0,0 +1,49 @@
+package daemon
+
+import (
+	"testing"
+
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/pkg/errors"
+)
+
+func TestUpdateKernelType(t *testing.T) {
+	unavailable := errors.Wrap(errRealtimeKernelUnavailable, "no kernel-rt-core")
+	d := Daemon{
+		OperatingSystem:   machineConfigDaemonOSRHCOS,
+		NodeUpdaterClient: RpmOstreeClientMock{SwitchKernelReturns: unavailable},
+	}
+	defaultConfig := newTestMachineConfig("default", nil, nil)
+	explicitDefaultConfig := newTestMachineConfig("explicit-default", nil, nil)
+	explicitDefaultConfig.Spec.KernelType = mcfgv1.KernelTypeDefault
+	realtimeConfig := newTestMachineConfig("realtime", nil, nil)
+	realtimeConfig.Spec.KernelType = mcfgv1.KernelTypeRealtime
+
+	if err := d.updateKernelType(defaultConfig, explicitDefaultConfig); err != nil {
+		t.Errorf("Expected no switch between default kernels, got %v", err)
+	}
+	if err := d.updateKernelType(defaultConfig, realtimeConfig); errors.Cause(err) != errRealtimeKernelUnavailable {
+		t.Errorf("Expected switching to the realtime kernel to fail with %v, got %v", errRealtimeKernelUnavailable, err)
+	}
+
+	d.OperatingSystem = machineConfigDaemonOSCENTOS
+	if err := d.updateKernelType(defaultConfig, realtimeConfig); err == nil {
+		t.Errorf("Expected switching kernels to fail on the packages update backend")
+	}
+}
+
+func TestReconcilableKernelType(t *testing.T) {
+	d := Daemon{}
+	oldConfig := newTestMachineConfig("old", nil, nil)
+	newConfig := newTestMachineConfig("new", nil, nil)
+
+	newConfig.Spec.KernelType = mcfgv1.KernelTypeRealtime
+	if err := d.reconcilable(oldConfig, newConfig); err != nil {
+		t.Errorf("Expected switching to the realtime kernel to be reconcilable: %v", err)
+	}
+
+	newConfig.Spec.KernelType = "lowlatency"
+	if err := d.reconcilable(oldConfig, newConfig); err == nil {
+		t.Errorf("Expected an invalid kernel type to be unreconcilable")
+	}
+}
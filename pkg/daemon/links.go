@@ -0,0 +1,149 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/golang/glog"
+)
+
+// linkOwnership returns the uid and gid link is owned by, -1 for both when the
+// config doesn't set them.
+func linkOwnership(link ignv2_2types.Link) (int, int, error) {
+	if link.User == nil && link.Group == nil {
+		return -1, -1, nil
+	}
+	return getFileOwnership(ignv2_2types.File{Node: link.Node})
+}
+
+// writeLinks creates the given links, hard or symbolic, replacing what is at
+// their path unless it already is the link.
+func (dn *Daemon) writeLinks(links []ignv2_2types.Link) error {
+	owned, err := loadOwnedFiles(dn.ownedFilesPath, dn.originalFilesDir)
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		glog.Infof("Writing link %q to %q", link.Path, link.Target)
+		uid, gid, err := linkOwnership(link)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve link ownership for link %q: %v", link.Path, err)
+		}
+		if err := owned.claimLink(link.Path, link.Target, link.Hard); err != nil {
+			return err
+		}
+		if err := writeLinkAtomically(link.Path, link.Target, link.Hard, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isLink returns whether path is a link to target: a symlink whose target is
+// target, or, for hard links, the same file as target.
+func isLink(path, target string, hard bool) bool {
+	if !hard {
+		t, err := os.Readlink(path)
+		return err == nil && t == target
+	}
+	fi, err := os.Lstat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	tfi, err := os.Lstat(target)
+	return err == nil && os.SameFile(fi, tfi)
+}
+
+// writeLinkAtomically makes path a link to target, owned by uid:gid unless
+// they are -1. Like writeFileAtomically, the link is created next to path and
+// renamed over it, so a crash leaves either what was there or the link, and
+// gets its default SELinux label.
+func writeLinkAtomically(path, target string, hard bool, uid, gid int) error {
+	dir := filepath.Dir(path)
+	createdDirs := missingDirs(path)
+	if err := os.MkdirAll(dir, defaultDirectoryPermissions); err != nil {
+		return fmt.Errorf("failed to create directory %q: %v", dir, readOnlyError(err))
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.IsDir() {
+		return fmt.Errorf("refusing to replace %q with a link: it is a directory", path)
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if !isLink(path, target, hard) {
+		tmp := filepath.Join(dir, "."+filepath.Base(path)+".mcd-link")
+		if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		link := os.Symlink
+		if hard {
+			link = os.Link
+		}
+		if err := link(target, tmp); err != nil {
+			return fmt.Errorf("failed to link %q to %q: %v", path, target, readOnlyError(err))
+		}
+		if err := renameFile(tmp, path); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+	if uid != -1 && gid != -1 {
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return fmt.Errorf("failed to chown link %q: %v", path, err)
+		}
+	}
+	return restoreLabels(append(createdDirs, path)...)
+}
+
+// checkLinks validates all the links in the target config and returns the
+// drift of those which aren't links to their target, with their owner when
+// the config sets it and their default SELinux label.
+func checkLinks(links []ignv2_2types.Link) []string {
+	var drifted []string
+	checked := make(map[string]bool)
+	for i := len(links) - 1; i >= 0; i-- {
+		link := links[i]
+		if checked[link.Path] {
+			continue
+		}
+		checked[link.Path] = true
+		fi, err := os.Lstat(link.Path)
+		if err != nil {
+			glog.Errorf("could not stat link: %q, error: %v", link.Path, err)
+			if os.IsNotExist(err) {
+				drifted = append(drifted, fmt.Sprintf("%s (missing)", link.Path))
+			} else {
+				drifted = append(drifted, fmt.Sprintf("%s (%v)", link.Path, err))
+			}
+			continue
+		}
+		if !isLink(link.Path, link.Target, link.Hard) {
+			glog.Errorf("link mismatch for: %q; expected a link to: %q", link.Path, link.Target)
+			drifted = append(drifted, fmt.Sprintf("%s (not a link to %s)", link.Path, link.Target))
+			continue
+		}
+		uid, gid, err := linkOwnership(link)
+		if err != nil {
+			glog.Errorf("couldn't resolve ownership of link: %v", err)
+			drifted = append(drifted, fmt.Sprintf("%s (unknown owner)", link.Path))
+			continue
+		}
+		if stat, ok := fi.Sys().(*syscall.Stat_t); ok && uid != -1 && gid != -1 {
+			if int(stat.Uid) != uid || int(stat.Gid) != gid {
+				glog.Errorf("owner mismatch for link: %q; expected: %d:%d; received: %d:%d", link.Path, uid, gid, stat.Uid, stat.Gid)
+				drifted = append(drifted, fmt.Sprintf("%s (owner %d:%d, expected %d:%d)", link.Path, stat.Uid, stat.Gid, uid, gid))
+				continue
+			}
+		}
+		if drift := checkLabel(link.Path); drift != "" {
+			drifted = append(drifted, drift)
+		}
+	}
+	return drifted
+}
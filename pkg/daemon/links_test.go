@@ -0,0 +1,117 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLink(path, target string, hard bool) ignv2_2types.Link {
+	return ignv2_2types.Link{
+		Node:          ignv2_2types.Node{Path: path, Filesystem: "root"},
+		LinkEmbedded1: ignv2_2types.LinkEmbedded1{Target: target, Hard: hard},
+	}
+}
+
+func TestWriteLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "links")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dn := &Daemon{
+		ownedFilesPath:   filepath.Join(dir, "owned-files.json"),
+		originalFilesDir: filepath.Join(dir, "orig"),
+	}
+	localtime := filepath.Join(dir, "etc/localtime")
+	require.Nil(t, os.MkdirAll(filepath.Dir(localtime), 0755))
+	require.Nil(t, os.Symlink("/usr/share/zoneinfo/UTC", localtime))
+	redirected := filepath.Join(dir, "etc/redirected")
+	target := filepath.Join(dir, "target")
+	require.Nil(t, ioutil.WriteFile(target, []byte("target"), 0644))
+	hard := filepath.Join(dir, "etc/hard")
+
+	oldConfig := newTestMachineConfig("old", nil, nil)
+	newConfig := newTestMachineConfig("new", nil, nil)
+	newConfig.Spec.Config.Storage.Links = []ignv2_2types.Link{
+		newTestLink(localtime, "/usr/share/zoneinfo/Europe/Paris", false),
+		newTestLink(redirected, target, false),
+		newTestLink(hard, target, true),
+	}
+	assert.Equal(t, []string{hard + " (missing)", redirected + " (missing)", localtime + " (not a link to /usr/share/zoneinfo/Europe/Paris)"},
+		checkLinks(newConfig.Spec.Config.Storage.Links))
+
+	require.Nil(t, dn.updateFiles(oldConfig, newConfig))
+	assert.Empty(t, checkLinks(newConfig.Spec.Config.Storage.Links))
+	got, err := os.Readlink(localtime)
+	require.Nil(t, err)
+	assert.Equal(t, "/usr/share/zoneinfo/Europe/Paris", got)
+	b, err := ioutil.ReadFile(hard)
+	require.Nil(t, err)
+	assert.Equal(t, "target", string(b))
+
+	// a changed target replaces the link
+	newerConfig := newTestMachineConfig("newer", nil, nil)
+	newerConfig.Spec.Config.Storage.Links = []ignv2_2types.Link{newTestLink(localtime, "/usr/share/zoneinfo/Asia/Tokyo", false)}
+	require.Nil(t, dn.updateFiles(newConfig, newerConfig))
+	got, err = os.Readlink(localtime)
+	require.Nil(t, err)
+	assert.Equal(t, "/usr/share/zoneinfo/Asia/Tokyo", got)
+	// links dropped from the config are removed, the target stays
+	for _, path := range []string{redirected, hard} {
+		_, err = os.Lstat(path)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+	_, err = os.Stat(target)
+	assert.Nil(t, err)
+
+	// the original link is restored
+	require.Nil(t, dn.updateFiles(newerConfig, oldConfig))
+	got, err = os.Readlink(localtime)
+	require.Nil(t, err)
+	assert.Equal(t, "/usr/share/zoneinfo/UTC", got)
+}
+
+func TestWriteLinksOverFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "links")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dn := &Daemon{
+		ownedFilesPath:   filepath.Join(dir, "owned-files.json"),
+		originalFilesDir: filepath.Join(dir, "orig"),
+	}
+	path := filepath.Join(dir, "etc/foo.conf")
+	require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.Nil(t, ioutil.WriteFile(path, []byte("original"), 0644))
+
+	oldConfig := newTestMachineConfig("old", nil, nil)
+	newConfig := newTestMachineConfig("new", nil, nil)
+	newConfig.Spec.Config.Storage.Links = []ignv2_2types.Link{newTestLink(path, "/usr/share/foo.conf", false)}
+	require.Nil(t, dn.updateFiles(oldConfig, newConfig))
+	got, err := os.Readlink(path)
+	require.Nil(t, err)
+	assert.Equal(t, "/usr/share/foo.conf", got)
+
+	require.Nil(t, dn.updateFiles(newConfig, oldConfig))
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "original", string(b), "the file the link replaced is restored")
+
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "etc/dir"), 0755))
+	newConfig.Spec.Config.Storage.Links = []ignv2_2types.Link{newTestLink(filepath.Join(dir, "etc/dir"), "/usr/share", false)}
+	err = dn.updateFiles(oldConfig, newConfig)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "it is a directory")
+}
+
+func TestReconcilableLinks(t *testing.T) {
+	d := Daemon{}
+	oldConfig := newTestMachineConfig("old", nil, nil)
+	newConfig := newTestMachineConfig("new", nil, nil)
+	newConfig.Spec.Config.Storage.Links = []ignv2_2types.Link{newTestLink("/etc/localtime", "/usr/share/zoneinfo/Europe/Paris", false)}
+	assert.Nil(t, d.reconcilable(oldConfig, newConfig))
+	assert.Nil(t, d.reconcilable(newConfig, oldConfig))
+}
@@ -0,0 +1,77 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// pathDaemonLock is locked by the daemon applying configs to the host, so a
+// second one, like from a pod stuck terminating or run by hand, doesn't
+// apply configs concurrently
+const pathDaemonLock = "/run/machine-config-daemon/daemon.lock"
+
+// lockHolder describes the daemon holding the lock, recorded in the lock
+// file for the daemons failing to take it.
+type lockHolder struct {
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+}
+
+// instanceLock is the exclusive flock of a daemon on its lock file.
+type instanceLock struct {
+	f *os.File
+}
+
+// acquireInstanceLock takes the exclusive lock on path without waiting,
+// failing with the PID and start time of the daemon holding it if another
+// does.
+func acquireInstanceLock(path string) (*instanceLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), defaultDirectoryPermissions); err != nil {
+		return nil, fmt.Errorf("failed to create directory of the lock %q: %v", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, defaultFilePermissions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the lock %q: %v", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if err != syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("failed to lock %q: %v", path, err)
+		}
+		var holder lockHolder
+		if b, err := ioutil.ReadAll(f); err == nil && json.Unmarshal(b, &holder) == nil && holder.PID != 0 {
+			return nil, fmt.Errorf("another machine-config-daemon is running on this host: %q is held by pid %d, started %s", path, holder.PID, holder.Started.Format(time.RFC3339))
+		}
+		return nil, fmt.Errorf("another machine-config-daemon is running on this host: %q is held", path)
+	}
+
+	b, err := json.Marshal(lockHolder{PID: os.Getpid(), Started: time.Now().UTC()})
+	if err == nil {
+		if err = f.Truncate(0); err == nil {
+			_, err = f.WriteAt(b, 0)
+		}
+	}
+	if err != nil {
+		// the lock still works, only the error of the next daemon suffers
+		glog.Warningf("Unable to record the lock holder in %q: %v", path, err)
+	}
+	return &instanceLock{f: f}, nil
+}
+
+// release clears the holder recorded and unlocks, closing the lock file.
+func (l *instanceLock) release() {
+	if err := l.f.Truncate(0); err != nil {
+		glog.Warningf("Unable to clear the lock holder in %q: %v", l.f.Name(), err)
+	}
+	if err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN); err != nil {
+		glog.Warningf("Unable to unlock %q: %v", l.f.Name(), err)
+	}
+	l.f.Close()
+}
@@ -0,0 +1,31 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquireInstanceLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-lock")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run/machine-config-daemon/daemon.lock")
+
+	lock, err := acquireInstanceLock(path)
+	require.Nil(t, err)
+	_, err = acquireInstanceLock(path)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), fmt.Sprintf("another machine-config-daemon is running on this host: %q is held by pid %d, started ", path, os.Getpid()))
+
+	// once released, the next daemon takes it
+	lock.release()
+	lock, err = acquireInstanceLock(path)
+	require.Nil(t, err)
+	lock.release()
+}
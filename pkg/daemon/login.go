@@ -0,0 +1,273 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// IDs are taken from https://cgit.freedesktop.org/systemd/systemd/plain/src/systemd/sd-messages.h
+	sdMessageSessionStart = "8d45620c1a4348dbb17410da57c60c66"
+
+	logindBusName          = "org.freedesktop.login1"
+	logindPath             = "/org/freedesktop/login1"
+	logindManagerInterface = "org.freedesktop.login1.Manager"
+	logindSessionInterface = "org.freedesktop.login1.Session"
+
+	// sshdPAMService is the PAM service of the sessions sshd opens
+	sshdPAMService = "sshd"
+
+	// logindReconnectInterval is how long the login monitor waits before
+	// reconnecting to the system bus once the connection is lost
+	logindReconnectInterval = 5 * time.Second
+)
+
+// loginSession is what the login monitor looks at in a logind session.
+type loginSession struct {
+	ID      string
+	User    string
+	Service string
+	TTY     string
+}
+
+// interactiveSSH returns whether s is an SSH session with a terminal, as
+// opposed to automation running commands over SSH.
+func (s loginSession) interactiveSSH() bool {
+	return s.Service == sshdPAMService && s.TTY != ""
+}
+
+// connectLogind opens a private connection to the system bus, so that a lost
+// connection can be replaced without affecting other users of the bus.
+func connectLogind() (*dbus.Conn, error) {
+	conn, err := dbus.SystemBusPrivate()
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Auth(nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.Hello(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// getLoginSession reads the logind session at path.
+func getLoginSession(conn *dbus.Conn, path dbus.ObjectPath) (loginSession, error) {
+	var props map[string]dbus.Variant
+	if err := conn.Object(logindBusName, path).Call("org.freedesktop.DBus.Properties.GetAll", 0, logindSessionInterface).Store(&props); err != nil {
+		return loginSession{}, errors.Wrapf(err, "reading login session %s", path)
+	}
+	str := func(name string) string {
+		s, _ := props[name].Value().(string)
+		return s
+	}
+	return loginSession{
+		ID:      str("Id"),
+		User:    str("Name"),
+		Service: str("Service"),
+		TTY:     str("TTY"),
+	}, nil
+}
+
+// getLoginSessionByID reads the logind session id, if it is still open.
+func getLoginSessionByID(conn *dbus.Conn, id string) (loginSession, bool, error) {
+	var path dbus.ObjectPath
+	if err := conn.Object(logindBusName, logindPath).Call(logindManagerInterface+".GetSession", 0, id).Store(&path); err != nil {
+		if dbusErr, ok := err.(dbus.Error); ok && dbusErr.Name == "org.freedesktop.login1.NoSuchSession" {
+			return loginSession{}, false, nil
+		}
+		return loginSession{}, false, errors.Wrapf(err, "getting login session %s", id)
+	}
+	s, err := getLoginSession(conn, path)
+	return s, err == nil, err
+}
+
+// sshLoginAllowed returns whether logins of user are expected, and don't mark
+// the node as accessed.
+func (dn *Daemon) sshLoginAllowed(user string) bool {
+	return dn.sshLoginAllowlist[user]
+}
+
+// handleLoginSession annotates the node for the interactive SSH session s,
+// unless its user is allowed to log in.
+func (dn *Daemon) handleLoginSession(s loginSession) error {
+	if !s.interactiveSSH() {
+		glog.V(2).Infof("Ignoring login session %s of user %s: service %q, tty %q", s.ID, s.User, s.Service, s.TTY)
+		return nil
+	}
+	if dn.sshLoginAllowed(s.User) {
+		glog.Infof("Ignoring SSH session %s of allowed user %s", s.ID, s.User)
+		return nil
+	}
+	glog.Infof("Detected a new SSH session %s of user %s on %s", s.ID, s.User, s.TTY)
+	glog.Infof("Login access is discouraged! Applying annotation: %v", machineConfigDaemonSSHAccessAnnotationKey)
+	return dn.applySSHAccessedAnnotation(s.User)
+}
+
+// runLoginMonitor annotates the node on every interactive SSH login, as
+// logind announces them over D-Bus, until stopCh is closed. The connection is
+// made again whenever it is lost, e.g. to a restart of the bus.
+func (dn *Daemon) runLoginMonitor(stopCh <-chan struct{}, exitCh chan<- error) {
+	runReconnecting(func() error {
+		return dn.watchLoginSessions(stopCh, exitCh)
+	}, logindReconnectInterval, stopCh)
+}
+
+// runReconnecting runs watch again, interval after it returns, until stopCh
+// is closed.
+func runReconnecting(watch func() error, interval time.Duration, stopCh <-chan struct{}) {
+	for {
+		err := watch()
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+		glog.Warningf("Lost logind, reconnecting in %v: %v", interval, err)
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// watchLoginSessions handles the sessions logind opens until stopCh is closed
+// or the connection to the bus is lost. Logind restarting doesn't affect the
+// subscription, which follows the owner of its bus name.
+func (dn *Daemon) watchLoginSessions(stopCh <-chan struct{}, exitCh chan<- error) error {
+	conn, err := connectLogind()
+	if err != nil {
+		return errors.Wrapf(err, "connecting to the system bus")
+	}
+	defer conn.Close()
+
+	rules := []string{
+		fmt.Sprintf("type='signal',sender='%s',interface='%s',member='SessionNew'", logindBusName, logindManagerInterface),
+		fmt.Sprintf("type='signal',interface='org.freedesktop.DBus',member='NameOwnerChanged',arg0='%s'", logindBusName),
+	}
+	for _, rule := range rules {
+		if err := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, rule).Err; err != nil {
+			return errors.Wrapf(err, "subscribing to %s", rule)
+		}
+	}
+	signals := make(chan *dbus.Signal, 16)
+	conn.Signal(signals)
+
+	for {
+		select {
+		case <-stopCh:
+			return nil
+		case signal, ok := <-signals:
+			if !ok {
+				return fmt.Errorf("system bus connection closed")
+			}
+			switch signal.Name {
+			case "org.freedesktop.DBus.NameOwnerChanged":
+				glog.Infof("%s changed owner, logind restarted", logindBusName)
+			case logindManagerInterface + ".SessionNew":
+				if len(signal.Body) < 2 {
+					continue
+				}
+				path, ok := signal.Body[1].(dbus.ObjectPath)
+				if !ok {
+					continue
+				}
+				s, err := getLoginSession(conn, path)
+				if err != nil {
+					// the session may be closed already
+					glog.Warningf("Failed to read new login session: %v", err)
+					continue
+				}
+				if err := dn.handleLoginSession(s); err != nil {
+					exitCh <- err
+				}
+			}
+		}
+	}
+}
+
+// parseSessionStarts reads the sessions of the logind session start messages
+// journalctl printed as JSON.
+func parseSessionStarts(journalOutput []byte) ([]loginSession, error) {
+	var sessions []loginSession
+	scanner := bufio.NewScanner(bytes.NewReader(journalOutput))
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry struct {
+			SessionID string `json:"SESSION_ID"`
+			UserID    string `json:"USER_ID"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, errors.Wrapf(err, "parsing journal entry")
+		}
+		sessions = append(sessions, loginSession{ID: entry.SessionID, User: entry.UserID})
+	}
+	return sessions, scanner.Err()
+}
+
+// detectEarlySSHAccessesFromBoot annotates the node, once, if we find a login
+// before the daemon started up. Sessions still open are filtered like the ones
+// the login monitor sees; those already closed can't be told apart, and count
+// unless their user is allowed to log in.
+func (dn *Daemon) detectEarlySSHAccessesFromBoot() error {
+	journalOutput, err := exec.Command("journalctl", "-b", "-o", "json", "MESSAGE_ID="+sdMessageSessionStart).Output()
+	if err != nil {
+		return err
+	}
+	sessions, err := parseSessionStarts(journalOutput)
+	if err != nil || len(sessions) == 0 {
+		return err
+	}
+
+	conn, err := connectLogind()
+	if err != nil {
+		glog.Warningf("Failed to connect to logind, counting all early logins: %v", err)
+	} else {
+		defer conn.Close()
+	}
+	var accessed *loginSession
+	for i, s := range sessions {
+		if dn.sshLoginAllowed(s.User) {
+			continue
+		}
+		if conn != nil {
+			open, ok, err := getLoginSessionByID(conn, s.ID)
+			if err != nil {
+				glog.Warningf("Failed to read login session %s: %v", s.ID, err)
+			}
+			if ok && !open.interactiveSSH() {
+				continue
+			}
+		}
+		accessed = &sessions[i]
+	}
+	if accessed == nil {
+		return nil
+	}
+	glog.Infof("Detected login session %s of user %s before the daemon took over", accessed.ID, accessed.User)
+	glog.Infof("Applying annotation: %v", machineConfigDaemonSSHAccessAnnotationKey)
+	return dn.applySSHAccessedAnnotation(accessed.User)
+}
+
+func (dn *Daemon) applySSHAccessedAnnotation(user string) error {
+	ctx, cancel := nodeWriterContext()
+	defer cancel()
+	if err := dn.nodeWriter.SetSSHAccessed(ctx, user); err != nil {
+		return fmt.Errorf("error: cannot apply annotation for SSH access due to: %v", err)
+	}
+	return nil
+}
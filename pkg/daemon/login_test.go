@@ -0,0 +1,82 @@
+package daemon
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginSessionInteractiveSSH(t *testing.T) {
+	for _, tc := range []struct {
+		session loginSession
+		want    bool
+	}{
+		{loginSession{Service: "sshd", TTY: "pts/0"}, true},
+		// commands run over SSH, e.g. by automation
+		{loginSession{Service: "sshd"}, false},
+		{loginSession{Service: "login", TTY: "tty1"}, false},
+		{loginSession{Service: "systemd-user"}, false},
+	} {
+		assert.Equal(t, tc.want, tc.session.interactiveSSH(), "%+v", tc.session)
+	}
+}
+
+func TestHandleLoginSessionAllowlist(t *testing.T) {
+	dn := &Daemon{sshLoginAllowlist: map[string]bool{"automation": true}}
+	// neither reaches the node writer, which this daemon doesn't have
+	assert.Nil(t, dn.handleLoginSession(loginSession{ID: "1", User: "automation", Service: "sshd", TTY: "pts/0"}))
+	assert.Nil(t, dn.handleLoginSession(loginSession{ID: "2", User: "core", Service: "sshd"}))
+	assert.True(t, dn.sshLoginAllowed("automation"))
+	assert.False(t, dn.sshLoginAllowed("core"))
+}
+
+func TestParseSessionStarts(t *testing.T) {
+	out := []byte(`{"MESSAGE":"New session 1 of user core.","SESSION_ID":"1","USER_ID":"core"}
+{"MESSAGE":"New session c2 of user automation.","SESSION_ID":"c2","USER_ID":"automation"}
+
+`)
+	sessions, err := parseSessionStarts(out)
+	require.Nil(t, err)
+	assert.Equal(t, []loginSession{{ID: "1", User: "core"}, {ID: "c2", User: "automation"}}, sessions)
+
+	sessions, err = parseSessionStarts(nil)
+	assert.Nil(t, err)
+	assert.Empty(t, sessions)
+
+	_, err = parseSessionStarts([]byte("New session 1 of user core."))
+	assert.NotNil(t, err)
+}
+
+func TestRunReconnecting(t *testing.T) {
+	stopCh := make(chan struct{})
+	watches := make(chan struct{}, 10)
+	done := make(chan struct{})
+	go func() {
+		runReconnecting(func() error {
+			select {
+			case watches <- struct{}{}:
+			default:
+			}
+			return fmt.Errorf("connection closed")
+		}, time.Millisecond, stopCh)
+		close(done)
+	}()
+
+	// the watch is started again each time the connection is lost
+	for i := 0; i < 3; i++ {
+		select {
+		case <-watches:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watch %d not started", i)
+		}
+	}
+	close(stopCh)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("still reconnecting after stop")
+	}
+}
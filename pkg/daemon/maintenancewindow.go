@@ -0,0 +1,202 @@
+package daemon
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// maintenanceWindowAnnotationKey restricts the drain and reboot of an
+	// update to a window, like "22:00-04:00,Sat,Sun" or "01:00-03:00,Mon-Fri",
+	// in UTC. Without days, the window opens every day.
+	maintenanceWindowAnnotationKey = "machineconfiguration.openshift.io/maintenance-window"
+	// rebootNowAnnotationKey set to "true" lets an update waiting for its
+	// maintenance window drain and reboot right away. The daemon removes it
+	// once it acted on it.
+	rebootNowAnnotationKey = "machineconfiguration.openshift.io/reboot-now"
+
+	// maintenanceWindowInterval is the time between two checks of the window
+	// of an update waiting for it
+	maintenanceWindowInterval = 2 * time.Minute
+)
+
+// windowNow returns the current time, it is swapped out by tests.
+var windowNow = time.Now
+
+// maintenanceWindow is a daily window, opening on days only.
+type maintenanceWindow struct {
+	spec string
+	// start and end are minutes in the day, the window ends the next day
+	// when end <= start
+	start, end int
+	// days are the days the window opens on, any day if empty
+	days map[time.Weekday]bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseTimeOfDay parses HH:MM into minutes in the day.
+func parseTimeOfDay(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 || len(parts[0]) != 2 || len(parts[1]) != 2 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil || h < 0 || h > 23 {
+		return 0, fmt.Errorf("invalid hour in %q", s)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || m < 0 || m > 59 {
+		return 0, fmt.Errorf("invalid minute in %q", s)
+	}
+	return h*60 + m, nil
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	d, ok := weekdays[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("invalid day %q, expected one of Mon, Tue, Wed, Thu, Fri, Sat, Sun", s)
+	}
+	return d, nil
+}
+
+// parseMaintenanceWindow parses "HH:MM-HH:MM" followed by comma separated
+// days, or ranges of days like Mon-Fri.
+func parseMaintenanceWindow(spec string) (*maintenanceWindow, error) {
+	fields := strings.Split(spec, ",")
+	times := strings.Split(strings.TrimSpace(fields[0]), "-")
+	if len(times) != 2 {
+		return nil, fmt.Errorf("invalid maintenance window %q, expected HH:MM-HH:MM followed by days", spec)
+	}
+	w := &maintenanceWindow{spec: spec}
+	var err error
+	if w.start, err = parseTimeOfDay(times[0]); err != nil {
+		return nil, errors.Wrapf(err, "invalid maintenance window %q", spec)
+	}
+	if w.end, err = parseTimeOfDay(times[1]); err != nil {
+		return nil, errors.Wrapf(err, "invalid maintenance window %q", spec)
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("invalid maintenance window %q, it is empty", spec)
+	}
+	for _, f := range fields[1:] {
+		if w.days == nil {
+			w.days = make(map[time.Weekday]bool)
+		}
+		bounds := strings.Split(strings.TrimSpace(f), "-")
+		if len(bounds) > 2 {
+			return nil, fmt.Errorf("invalid maintenance window %q, bad days %q", spec, f)
+		}
+		first, err := parseWeekday(bounds[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid maintenance window %q", spec)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = parseWeekday(bounds[1]); err != nil {
+				return nil, errors.Wrapf(err, "invalid maintenance window %q", spec)
+			}
+		}
+		// ranges may wrap around the week, like Fri-Mon
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return w, nil
+}
+
+func (w *maintenanceWindow) opensOn(d time.Weekday) bool {
+	return len(w.days) == 0 || w.days[d]
+}
+
+// contains returns whether t, in UTC, falls inside the window. A window
+// ending the next day belongs to the day it starts on.
+func (w *maintenanceWindow) contains(t time.Time) bool {
+	t = t.UTC()
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end && w.opensOn(t.Weekday())
+	}
+	if m >= w.start {
+		return w.opensOn(t.Weekday())
+	}
+	return m < w.end && w.opensOn((t.Weekday()+6)%7)
+}
+
+// nodeMaintenanceWindow returns the maintenance window of node, nil if it has
+// none.
+func nodeMaintenanceWindow(node *corev1.Node) (*maintenanceWindow, error) {
+	if node == nil {
+		return nil, nil
+	}
+	spec, ok := node.Annotations[maintenanceWindowAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	return parseMaintenanceWindow(spec)
+}
+
+// waitForMaintenanceWindow returns once the drain and reboot into newConfig
+// may start: when the node has no maintenance window, is inside it or has the
+// reboot-now annotation. The node is fetched from the API server at every
+// check, so changes to the annotations are picked up while waiting.
+func (dn *Daemon) waitForMaintenanceWindow(newConfig *mcfgv1.MachineConfig) error {
+	if dn.onceFrom != "" || dn.kubeClient == nil {
+		return nil
+	}
+	waiting := false
+	return wait.PollImmediateUntil(maintenanceWindowInterval, func() (bool, error) {
+		dn.exitIfTerminating("while waiting for the maintenance window")
+		node, err := dn.kubeClient.CoreV1().Nodes().Get(dn.name, metav1.GetOptions{})
+		if err != nil {
+			glog.Warningf("Unable to get node to check its maintenance window: %v", err)
+			return false, nil
+		}
+		if node.Annotations[rebootNowAnnotationKey] == "true" {
+			dn.logSystem("Node has %s=true, rebooting into %s now", rebootNowAnnotationKey, newConfig.GetName())
+			ctx, cancel := nodeWriterContext()
+			defer cancel()
+			return true, dn.nodeWriter.RemoveAnnotations(ctx, []string{rebootNowAnnotationKey})
+		}
+		window, err := nodeMaintenanceWindow(node)
+		if err != nil {
+			return false, err
+		}
+		if window == nil || window.contains(windowNow()) {
+			if waiting {
+				glog.Infof("Maintenance window open, rebooting into %s", newConfig.GetName())
+			}
+			return true, nil
+		}
+		if !waiting {
+			waiting = true
+			glog.Infof("Waiting for maintenance window %s to reboot into %s", window.spec, newConfig.GetName())
+			logUpdatePhase(updatePhaseWaitingForWindow, newConfig.GetName())
+			dn.publishUpdateProgress(updatePhaseWaitingForWindow, time.Now().UTC(), fmt.Sprintf("updating to %s, waiting for maintenance window %s", newConfig.GetName(), window.spec))
+			if dn.recorder != nil {
+				dn.recorder.Eventf(getNodeRef(node), corev1.EventTypeNormal, "WaitingForMaintenanceWindow", "Update to %s staged, waiting for maintenance window %s to reboot", newConfig.GetName(), window.spec)
+			}
+		}
+		return false, nil
+	}, dn.stopCh)
+}
@@ -0,0 +1,80 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	// 2020-06-06 is a Saturday
+	at := func(day int, hm string) time.Time {
+		m, err := parseTimeOfDay(hm)
+		require.Nil(t, err)
+		return time.Date(2020, 6, day, m/60, m%60, 0, 0, time.UTC)
+	}
+	for _, tc := range []struct {
+		spec     string
+		at       time.Time
+		contains bool
+	}{
+		{"01:00-03:00", at(3, "02:00"), true},
+		{"01:00-03:00", at(3, "03:00"), false},
+		{"01:00-03:00,Mon-Fri", at(5, "01:00"), true},
+		{"01:00-03:00,Mon-Fri", at(6, "01:00"), false},
+		// the window of Saturday night ends on Sunday
+		{"22:00-04:00,Sat", at(6, "23:30"), true},
+		{"22:00-04:00,Sat", at(7, "03:59"), true},
+		{"22:00-04:00,Sat", at(6, "03:00"), false},
+		{"22:00-04:00,Sat", at(7, "22:00"), false},
+		// ranges wrap around the week
+		{"10:00-11:00,fri-mon", at(7, "10:30"), true},
+		{"10:00-11:00,fri-mon", at(3, "10:30"), false},
+	} {
+		w, err := parseMaintenanceWindow(tc.spec)
+		require.Nil(t, err, tc.spec)
+		assert.Equal(t, tc.contains, w.contains(tc.at), "%s at %v", tc.spec, tc.at)
+	}
+
+	for _, spec := range []string{"", "01:00", "1:00-03:00", "01:00-24:00", "01:00-01:00", "01:00-03:00,Someday", "01:00-03:00,Mon-Tue-Wed"} {
+		_, err := parseMaintenanceWindow(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestWaitForMaintenanceWindow(t *testing.T) {
+	origNow := windowNow
+	defer func() { windowNow = origNow }()
+	windowNow = func() time.Time { return time.Date(2020, 6, 6, 12, 0, 0, 0, time.UTC) }
+
+	newConfig := &mcfgv1.MachineConfig{ObjectMeta: metav1.ObjectMeta{Name: "rendered-worker-1"}}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	// inside the window
+	node := newTestNode("node-0", map[string]string{maintenanceWindowAnnotationKey: "11:00-13:00"})
+	dn := &Daemon{name: node.Name, kubeClient: k8sfake.NewSimpleClientset(node), stopCh: stopCh}
+	assert.Nil(t, dn.waitForMaintenanceWindow(newConfig))
+
+	// outside of it, with reboot-now set
+	node = newTestNode("node-0", map[string]string{
+		maintenanceWindowAnnotationKey: "01:00-03:00",
+		rebootNowAnnotationKey:         "true",
+	})
+	client := k8sfake.NewSimpleClientset(node)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), newTestNodeLister(t, node), node.Name)
+	go nw.Run(stopCh)
+	dn = &Daemon{name: node.Name, kubeClient: client, nodeWriter: nw, stopCh: stopCh}
+	assert.Nil(t, dn.waitForMaintenanceWindow(newConfig))
+
+	// an invalid window stops the wait
+	node = newTestNode("node-0", map[string]string{maintenanceWindowAnnotationKey: "soon"})
+	dn = &Daemon{name: node.Name, kubeClient: k8sfake.NewSimpleClientset(node), stopCh: stopCh}
+	assert.NotNil(t, dn.waitForMaintenanceWindow(newConfig))
+}
@@ -0,0 +1,151 @@
+package daemon
+
+import (
+	"net/http"
+
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// DefaultMetricsBindAddress is the address the metrics listener binds to by default
+	DefaultMetricsBindAddress = "127.0.0.1:8797"
+
+	metricsNamespace = "mcd"
+)
+
+var (
+	// nodeWriterQueueDepth is the number of writes waiting in the NodeWriter channel
+	nodeWriterQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "node_writer",
+			Name:      "queue_depth",
+			Help:      "Number of node annotation writes waiting to be processed.",
+		})
+
+	// nodeWriterWriteLatency is the time from queueing a write to its completion
+	nodeWriterWriteLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "node_writer",
+			Name:      "write_duration_seconds",
+			Help:      "Time from queueing a node annotation write to its completion.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		})
+
+	// nodeWriterErrors counts the failed writes by the state they were writing
+	nodeWriterErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "node_writer",
+			Name:      "errors_total",
+			Help:      "Number of node annotation writes that failed.",
+		}, []string{"state"})
+
+	// nodeWriterOutageRetries counts the retries of writes made while the API
+	// server was unavailable
+	nodeWriterOutageRetries = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "node_writer",
+			Name:      "outage_retries_total",
+			Help:      "Number of node annotation writes retried because the API server was unavailable.",
+		})
+
+	// drainDuration is the time taken by drains, successful or not
+	drainDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "drain_duration_seconds",
+			Help:      "Time taken to drain the node for an update.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+		})
+
+	// drainErrors counts the drains which failed
+	drainErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "drain_err",
+			Help:      "Number of drains that failed.",
+		})
+
+	// pivotErrors counts the OS updates which failed
+	pivotErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "pivot_err",
+			Help:      "Number of OS updates that failed.",
+		})
+
+	// reboots counts the reboots initiated by the daemon
+	reboots = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "reboots_total",
+			Help:      "Number of reboots initiated to apply updates.",
+		})
+
+	// updateDuration is the time spent in each phase of updates
+	updateDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "update_duration_seconds",
+			Help:      "Time spent in each phase of an update.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 16),
+		}, []string{"phase"})
+
+	// daemonStateGauge is 1 for the state last written to the node, 0 for
+	// the others
+	daemonStateGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "state",
+			Help:      "State of the daemon, as last written to the node.",
+		}, []string{"state"})
+)
+
+// daemonStates are the values of the state annotation, and of the state label
+// of daemonStateGauge.
+var daemonStates = []string{
+	constants.MachineConfigDaemonStateDone,
+	constants.MachineConfigDaemonStateWorking,
+	constants.MachineConfigDaemonStateDegraded,
+	constants.MachineConfigDaemonStateUnreconcilable,
+	constants.MachineConfigDaemonStateHeld,
+}
+
+func init() {
+	prometheus.MustRegister(
+		nodeWriterQueueDepth,
+		nodeWriterWriteLatency,
+		nodeWriterErrors,
+		nodeWriterOutageRetries,
+		drainDuration,
+		drainErrors,
+		pivotErrors,
+		reboots,
+		updateDuration,
+		daemonStateGauge,
+	)
+}
+
+// setDaemonStateMetric sets daemonStateGauge to state.
+func setDaemonStateMetric(state string) {
+	for _, s := range daemonStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		daemonStateGauge.WithLabelValues(s).Set(value)
+	}
+}
+
+// StartMetricsListener serves the registered metrics on addr until stopCh is
+// closed. Intended to be run via a goroutine.
+func StartMetricsListener(addr string, stopCh <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	runListener("metrics", addr, mux, stopCh)
+}
@@ -0,0 +1,49 @@
+package daemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readMetric(t *testing.T, m prometheus.Metric) *dto.Metric {
+	var out dto.Metric
+	require.Nil(t, m.Write(&out))
+	return &out
+}
+
+func TestSetDaemonStateMetric(t *testing.T) {
+	setDaemonStateMetric(constants.MachineConfigDaemonStateWorking)
+	setDaemonStateMetric(constants.MachineConfigDaemonStateDegraded)
+	for _, state := range daemonStates {
+		expected := 0.0
+		if state == constants.MachineConfigDaemonStateDegraded {
+			expected = 1
+		}
+		assert.Equal(t, expected, readMetric(t, daemonStateGauge.WithLabelValues(state)).GetGauge().GetValue(), state)
+	}
+}
+
+func TestUpdateDurationByPhase(t *testing.T) {
+	sampleCount := func(phase string) uint64 {
+		return readMetric(t, updateDuration.WithLabelValues(phase).(prometheus.Metric)).GetHistogram().GetSampleCount()
+	}
+	files, draining := sampleCount(updatePhaseUpdatingFiles), sampleCount(updatePhaseDraining)
+
+	var tracker statusTracker
+	start := time.Now()
+	tracker.setPhase(updatePhaseUpdatingFiles, start)
+	// progress within a phase doesn't end it
+	tracker.setPhase(updatePhaseUpdatingFiles, start.Add(time.Second))
+	assert.Equal(t, files, sampleCount(updatePhaseUpdatingFiles))
+
+	tracker.setPhase(updatePhaseDraining, start.Add(2*time.Second))
+	assert.Equal(t, files+1, sampleCount(updatePhaseUpdatingFiles))
+	tracker.setPhase("", start.Add(5*time.Second))
+	assert.Equal(t, draining+1, sampleCount(updatePhaseDraining))
+}
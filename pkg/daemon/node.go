@@ -8,6 +8,7 @@ import (
 	"github.com/golang/glog"
 	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
 	core_v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func (dn *Daemon) loadNodeAnnotations(node *core_v1.Node) (*core_v1.Node, error) {
@@ -31,10 +32,16 @@ func (dn *Daemon) loadNodeAnnotations(node *core_v1.Node) (*core_v1.Node, error)
 	}
 
 	glog.Infof("Setting initial node config: %s", initial[constants.CurrentMachineConfigAnnotationKey])
-	n, err := setNodeAnnotations(dn.kubeClient.CoreV1().Nodes(), dn.nodeLister, node.Name, initial)
-	if err != nil {
+	ctx, cancel := nodeWriterContext()
+	defer cancel()
+	if err := dn.nodeWriter.SetAnnotations(ctx, initial); err != nil {
 		return nil, fmt.Errorf("failed to set initial annotations: %v", err)
 	}
+	// the lister may not have caught up with the write yet
+	n, err := dn.kubeClient.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node after setting initial annotations: %v", err)
+	}
 	return n, nil
 }
 
@@ -0,0 +1,111 @@
+package daemon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Exit statuses of the daemon in once-from mode.
+const (
+	// OnceFromExitSuccess is for configs applied, the host reboots into them
+	// unless --skip-reboot is given
+	OnceFromExitSuccess = 0
+	// OnceFromExitFailed is for configs which failed to apply, the writes
+	// done are rolled back
+	OnceFromExitFailed = 1
+	// OnceFromExitInvalidConfig is for configs which couldn't be fetched or
+	// parsed, nothing is written
+	OnceFromExitInvalidConfig = 2
+	// OnceFromExitUnreconcilable is for configs with changes the daemon
+	// doesn't know how to apply, nothing is written
+	OnceFromExitUnreconcilable = 3
+)
+
+const (
+	// onceFromConfigName names the MachineConfig a once-from ignition
+	// config is applied as
+	onceFromConfigName = "once-from"
+	// onceFromFetchTimeout bounds fetching a once-from config from a URL
+	onceFromFetchTimeout = 2 * time.Minute
+)
+
+// errInvalidOnceFrom is returned for once-from configs which can't be fetched
+// or parsed.
+var errInvalidOnceFrom = errors.New("invalid once-from config")
+
+// OnceFromExitStatus returns the exit status for the error err returned by Run
+// in once-from mode.
+func OnceFromExitStatus(err error) int {
+	switch errors.Cause(err) {
+	case nil:
+		return OnceFromExitSuccess
+	case errInvalidOnceFrom:
+		return OnceFromExitInvalidConfig
+	case errUnreconcilable, errUnsupportedExtension, errInvalidUnit:
+		return OnceFromExitUnreconcilable
+	}
+	return OnceFromExitFailed
+}
+
+// onceFromHTTPClient returns the client fetching once-from configs from URLs.
+// It goes through the proxy of the environment and, if caFile isn't empty,
+// trusts the CAs of the PEM bundle caFile on top of the system ones.
+func onceFromHTTPClient(caFile string) (*http.Client, error) {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+	}
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport, Timeout: onceFromFetchTimeout}, nil
+}
+
+// fetchOnceFrom returns the body of the once-from config at url.
+func (dn *Daemon) fetchOnceFrom(url string) ([]byte, error) {
+	client, err := onceFromHTTPClient(dn.onceFromCAFile)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// ignitionMachineConfig wraps the ignition config ignConfig in a
+// MachineConfig, keeping the booted OS image, so that it goes through the same
+// update as MachineConfigs.
+func (dn *Daemon) ignitionMachineConfig(ignConfig ignv2_2types.Config) *mcfgv1.MachineConfig {
+	return &mcfgv1.MachineConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: onceFromConfigName},
+		Spec: mcfgv1.MachineConfigSpec{
+			OSImageURL: dn.bootedOSImageURL,
+			Config:     ignConfig,
+		},
+	}
+}
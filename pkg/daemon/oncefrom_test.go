@@ -0,0 +1,144 @@
+package daemon
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testOnceFromIgnition = `{"ignition": {"version": "2.2.0"}, "storage": {"files": [{"path": "/etc/test", "filesystem": "root", "contents": {"source": "data:,test"}}]}}`
+
+	testOnceFromMachineConfig = `apiVersion: machineconfiguration.openshift.io/v1
+kind: MachineConfig
+metadata:
+  name: test
+spec:
+  osImageURL: example.com/os@sha256:0123
+  config:
+    ignition:
+      version: 2.2.0
+`
+)
+
+func TestSenseAndLoadOnceFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oncefrom")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		content string
+		check   func(t *testing.T, config interface{})
+	}{
+		{
+			content: testOnceFromIgnition,
+			check: func(t *testing.T, config interface{}) {
+				ignConfig, ok := config.(ignv2_2types.Config)
+				require.True(t, ok, "expected an ignition config, got %T", config)
+				require.Len(t, ignConfig.Storage.Files, 1)
+				assert.Equal(t, "/etc/test", ignConfig.Storage.Files[0].Path)
+			},
+		},
+		{
+			content: `{"ignition": {"version": "3.0.0"}, "storage": {"files": [{"path": "/etc/test", "contents": {"source": "data:,test"}}]}}`,
+			check: func(t *testing.T, config interface{}) {
+				ignConfig, ok := config.(ignv2_2types.Config)
+				require.True(t, ok, "expected an ignition config, got %T", config)
+				assert.Equal(t, "2.2.0", ignConfig.Ignition.Version, "3.0.0 configs are translated")
+				require.Len(t, ignConfig.Storage.Files, 1)
+				assert.Equal(t, "/etc/test", ignConfig.Storage.Files[0].Path)
+			},
+		},
+		{
+			content: testOnceFromMachineConfig,
+			check: func(t *testing.T, config interface{}) {
+				mc, ok := config.(mcfgv1.MachineConfig)
+				require.True(t, ok, "expected a MachineConfig, got %T", config)
+				assert.Equal(t, "test", mc.GetName())
+				assert.Equal(t, "example.com/os@sha256:0123", mc.Spec.OSImageURL)
+			},
+		},
+	}
+	for i, test := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("config-%d", i))
+		require.Nil(t, ioutil.WriteFile(path, []byte(test.content), 0644))
+		dn := &Daemon{onceFrom: path}
+		config, err := dn.senseAndLoadOnceFrom()
+		require.Nil(t, err)
+		test.check(t, config)
+	}
+
+	path := filepath.Join(dir, "invalid")
+	require.Nil(t, ioutil.WriteFile(path, []byte("not a config"), 0644))
+	dn := &Daemon{onceFrom: path}
+	assert.Equal(t, OnceFromExitInvalidConfig, OnceFromExitStatus(dn.runOnceFrom()))
+}
+
+func TestSenseAndLoadOnceFromURL(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, testOnceFromIgnition)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "oncefrom")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.crt")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.Nil(t, ioutil.WriteFile(caFile, ca, 0644))
+
+	// the server's CA is only trusted from the CA bundle
+	dn := &Daemon{onceFrom: server.URL + "/config"}
+	_, err = dn.senseAndLoadOnceFrom()
+	assert.NotNil(t, err)
+
+	dn.onceFromCAFile = caFile
+	config, err := dn.senseAndLoadOnceFrom()
+	require.Nil(t, err)
+	assert.IsType(t, ignv2_2types.Config{}, config)
+
+	dn.onceFrom = server.URL + "/missing"
+	_, err = dn.senseAndLoadOnceFrom()
+	assert.NotNil(t, err)
+}
+
+func TestOnceFromExitStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{nil, OnceFromExitSuccess},
+		{errors.New("failed"), OnceFromExitFailed},
+		{errors.Wrap(errInvalidOnceFrom, "test"), OnceFromExitInvalidConfig},
+		{errors.Wrap(errUnreconcilable, "test"), OnceFromExitUnreconcilable},
+		{errors.Wrap(errUnsupportedExtension, "test"), OnceFromExitUnreconcilable},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.status, OnceFromExitStatus(test.err), "error %v", test.err)
+	}
+}
+
+func TestIgnitionMachineConfig(t *testing.T) {
+	dn := &Daemon{bootedOSImageURL: "example.com/os@sha256:0123"}
+	ignConfig := ignv2_2types.Config{Ignition: ignv2_2types.Ignition{Version: "2.2.0"}}
+	mc := dn.ignitionMachineConfig(ignConfig)
+	assert.Equal(t, onceFromConfigName, mc.GetName())
+	// the ignition config doesn't change the OS
+	assert.Equal(t, dn.bootedOSImageURL, mc.Spec.OSImageURL)
+	assert.Equal(t, ignConfig, mc.Spec.Config)
+}
@@ -2,9 +2,13 @@ package daemon
 
 import (
 	"fmt"
+	"io/ioutil"
 	"path"
+	"strings"
 
 	"github.com/ashcrow/osrelease"
+	"github.com/golang/glog"
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
 )
 
 const (
@@ -14,6 +18,9 @@ const (
 	machineConfigDaemonOSRHEL = "RHEL"
 	// machineConfigDaemonOSCENTOS denotes CENTOS
 	machineConfigDaemonOSCENTOS = "CENTOS"
+
+	// pathRedHatRelease describes the release of hosts not using rpm-ostree
+	pathRedHatRelease = "/etc/redhat-release"
 )
 
 // GetHostRunningOS reads os-release from the rootFs prefix to return what
@@ -41,3 +48,54 @@ func GetHostRunningOS(rootFs string) (string, error) {
 		return "", fmt.Errorf("an unsupported OS is being used: %s:%s", or.ID, or.VARIANT_ID)
 	}
 }
+
+// bootedOSAnnotations returns the annotations describing the OS the node
+// booted: the OS image, version and checksum of the booted deployment on
+// ostree hosts, the contents of releaseFile on other hosts.
+func (dn *Daemon) bootedOSAnnotations(releaseFile string) (map[string]string, error) {
+	if !dn.updater().managesOSImage() {
+		release, err := ioutil.ReadFile(releaseFile)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{
+			constants.CurrentOSReleaseAnnotationKey: strings.TrimSpace(string(release)),
+		}, nil
+	}
+
+	booted, err := dn.NodeUpdaterClient.GetBootedDeployment("/")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		constants.CurrentOSImageAnnotationKey:    deploymentOSImageURL(*booted),
+		constants.CurrentOSVersionAnnotationKey:  booted.Version,
+		constants.CurrentOSChecksumAnnotationKey: booted.Checksum,
+	}, nil
+}
+
+// publishBootedOS records the OS the node booted, and whether it is in FIPS
+// mode, in node annotations. They are informational, so failing to publish
+// them is just logged.
+func (dn *Daemon) publishBootedOS() {
+	if dn.nodeWriter == nil || dn.kubeClient == nil {
+		return
+	}
+	annos, err := dn.bootedOSAnnotations(pathRedHatRelease)
+	if err != nil {
+		glog.Warningf("Unable to query the booted OS: %v", err)
+		return
+	}
+	fips, err := dn.fipsAnnotations()
+	if err != nil {
+		glog.Warningf("Unable to query the FIPS mode: %v", err)
+	}
+	for k, v := range fips {
+		annos[k] = v
+	}
+	ctx, cancel := nodeWriterContext()
+	defer cancel()
+	if err := dn.nodeWriter.SetAnnotations(ctx, annos); err != nil {
+		glog.Warningf("Unable to publish the booted OS: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+)
+
+func TestBootedOSAnnotations(t *testing.T) {
+	d := Daemon{
+		OperatingSystem: machineConfigDaemonOSRHCOS,
+		NodeUpdaterClient: RpmOstreeClientMock{GetBootedDeploymentReturns: &RpmOstreeDeployment{
+			Booted:       true,
+			Checksum:     "b0c39192ab8f79e8a22598a1bb278bc11eaf6d5779e7fa6a2859ae13c2fd5e56",
+			Version:      "410.8.20190520.0",
+			CustomOrigin: []string{"pivot://quay.io/openshift/rhcos@sha256:new"},
+		}},
+	}
+	annos, err := d.bootedOSAnnotations("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		constants.CurrentOSImageAnnotationKey:    "quay.io/openshift/rhcos@sha256:new",
+		constants.CurrentOSVersionAnnotationKey:  "410.8.20190520.0",
+		constants.CurrentOSChecksumAnnotationKey: "b0c39192ab8f79e8a22598a1bb278bc11eaf6d5779e7fa6a2859ae13c2fd5e56",
+	}
+	if !reflect.DeepEqual(annos, expected) {
+		t.Errorf("Expected %v, got %v", expected, annos)
+	}
+
+	dir, err := ioutil.TempDir("", "osrelease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	releaseFile := filepath.Join(dir, "redhat-release")
+	if err := ioutil.WriteFile(releaseFile, []byte("Red Hat Enterprise Linux Server release 7.6 (Maipo)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d.OperatingSystem = machineConfigDaemonOSRHEL
+	annos, err = d.bootedOSAnnotations(releaseFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]string{
+		constants.CurrentOSReleaseAnnotationKey: "Red Hat Enterprise Linux Server release 7.6 (Maipo)",
+	}
+	if !reflect.DeepEqual(annos, expected) {
+		t.Errorf("Expected %v, got %v", expected, annos)
+	}
+}
@@ -0,0 +1,264 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/google/renameio"
+)
+
+const (
+	// pathOwnedFiles is where the files written by the daemon are tracked
+	pathOwnedFiles = "/etc/machine-config-daemon/owned-files.json"
+	// pathOriginalFiles is where the files found on disk before the daemon
+	// first wrote over them are backed up
+	pathOriginalFiles = "/etc/machine-config-daemon/orig"
+)
+
+// ownedFiles tracks the files and directories the daemon wrote, so that the
+// ones dropped from the config can be removed again without touching anything
+// the daemon didn't create. It is persisted as JSON at its path.
+type ownedFiles struct {
+	// Files maps the paths of the files written to how to undo the writes.
+	Files map[string]ownedFile `json:"files"`
+	// Dirs are the directories created to write files in.
+	Dirs map[string]struct{} `json:"dirs"`
+
+	path      string
+	backupDir string
+}
+
+// ownedFile records how to undo the writes to a file.
+type ownedFile struct {
+	// Backup is where the file found on disk before the first write was
+	// copied to, empty if the daemon created the file.
+	Backup string `json:"backup,omitempty"`
+	// OriginalLink is the target of the symlink found on disk before a link
+	// was written over it.
+	OriginalLink string `json:"originalLink,omitempty"`
+}
+
+// loadOwnedFiles reads the owned files persisted at path. Backups of the
+// original files go under backupDir.
+func loadOwnedFiles(path, backupDir string) (*ownedFiles, error) {
+	o := &ownedFiles{
+		Files:     make(map[string]ownedFile),
+		Dirs:      make(map[string]struct{}),
+		path:      path,
+		backupDir: backupDir,
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read owned files: %v", err)
+	}
+	if err := json.Unmarshal(b, o); err != nil {
+		return nil, fmt.Errorf("failed to parse owned files %q: %v", path, err)
+	}
+	if o.Files == nil {
+		o.Files = make(map[string]ownedFile)
+	}
+	if o.Dirs == nil {
+		o.Dirs = make(map[string]struct{})
+	}
+	return o, nil
+}
+
+func (o *ownedFiles) save() error {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomicallyWithDefaults(o.path, b)
+}
+
+// claim records that path is about to be written with contents, before it
+// is. The file already there, if any, is backed up the first time, and the
+// missing directories leading to it are recorded. A file which already has
+// contents was written by the daemon before it kept track, so it is adopted
+// without a backup.
+func (o *ownedFiles) claim(path string, contents []byte) error {
+	if _, ok := o.Files[path]; ok {
+		return nil
+	}
+
+	var owned ownedFile
+	fi, err := os.Lstat(path)
+	switch {
+	case err == nil && fi.Mode().IsRegular() && hasContents(path, contents):
+		glog.Infof("Adopting %q", path)
+	case err == nil && fi.Mode().IsRegular():
+		owned.Backup = filepath.Join(o.backupDir, path)
+		if err := copyFile(path, owned.Backup, fi); err != nil {
+			return fmt.Errorf("failed to back up %q: %v", path, err)
+		}
+		glog.Infof("Backed up original %q to %q", path, owned.Backup)
+	case err == nil:
+		// not something that can be written over, the write will fail
+		return nil
+	case !os.IsNotExist(err):
+		return err
+	default:
+		if err := o.claimDirs(path); err != nil {
+			return err
+		}
+	}
+	o.Files[path] = owned
+	return o.save()
+}
+
+// claimLink records that path is about to be made a link to target, before
+// it is. A regular file already there is backed up as by claim, and the
+// target of a symlink already there is kept to be restored. Links already to
+// target are adopted.
+func (o *ownedFiles) claimLink(path, target string, hard bool) error {
+	if _, ok := o.Files[path]; ok {
+		return nil
+	}
+
+	var owned ownedFile
+	fi, err := os.Lstat(path)
+	switch {
+	case err == nil && isLink(path, target, hard):
+		glog.Infof("Adopting %q", path)
+	case err == nil && fi.Mode()&os.ModeSymlink != 0:
+		if owned.OriginalLink, err = os.Readlink(path); err != nil {
+			return fmt.Errorf("failed to back up %q: %v", path, err)
+		}
+		glog.Infof("Backed up original link %q to %q", path, owned.OriginalLink)
+	case err == nil && fi.Mode().IsRegular():
+		owned.Backup = filepath.Join(o.backupDir, path)
+		if err := copyFile(path, owned.Backup, fi); err != nil {
+			return fmt.Errorf("failed to back up %q: %v", path, err)
+		}
+		glog.Infof("Backed up original %q to %q", path, owned.Backup)
+	case err == nil:
+		// not something that can be replaced, the write will fail
+		return nil
+	case !os.IsNotExist(err):
+		return err
+	default:
+		if err := o.claimDirs(path); err != nil {
+			return err
+		}
+	}
+	o.Files[path] = owned
+	return o.save()
+}
+
+// claimDirs records the missing directories leading to path.
+func (o *ownedFiles) claimDirs(path string) error {
+	for dir := filepath.Dir(path); dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		o.Dirs[dir] = struct{}{}
+	}
+	return nil
+}
+
+// release undoes the writes to path: the original file or link is restored
+// if there was one, otherwise the file or link is removed, along with the directories created
+// for it once empty. Files which aren't owned are left alone. It returns
+// whether path was owned.
+func (o *ownedFiles) release(path string) (bool, error) {
+	owned, ok := o.Files[path]
+	if !ok {
+		glog.Warningf("Not deleting %q: it wasn't created by the machine-config-daemon", path)
+		return false, nil
+	}
+
+	switch {
+	case owned.OriginalLink != "":
+		if err := renameio.Symlink(owned.OriginalLink, path); err != nil {
+			return false, fmt.Errorf("failed to restore original link %q: %v", path, err)
+		}
+		glog.Infof("Restored original link %q to %q", path, owned.OriginalLink)
+	case owned.Backup != "":
+		fi, err := os.Lstat(owned.Backup)
+		if err != nil {
+			return false, fmt.Errorf("failed to restore original %q: %v", path, err)
+		}
+		// a symlink written over the original is replaced, not followed
+		if lfi, err := os.Lstat(path); err == nil && lfi.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(path); err != nil {
+				return false, fmt.Errorf("failed to restore original %q: %v", path, err)
+			}
+		}
+		if err := copyFile(owned.Backup, path, fi); err != nil {
+			return false, fmt.Errorf("failed to restore original %q: %v", path, err)
+		}
+		if err := os.Remove(owned.Backup); err != nil {
+			glog.Warningf("Unable to remove backup %q: %v", owned.Backup, err)
+		}
+		glog.Infof("Restored original %q", path)
+	default:
+		if err := os.Remove(path); err != nil {
+			if !os.IsNotExist(err) {
+				return false, fmt.Errorf("unable to delete %s: %s", path, err)
+			}
+			glog.Warningf("unable to delete %s: %s", path, err)
+		}
+		glog.Infof("Removed stale file %q", path)
+		o.removeEmptyDirs(path)
+	}
+
+	delete(o.Files, path)
+	return true, o.save()
+}
+
+// removeEmptyDirs removes the directories created for path which are empty,
+// deepest first.
+func (o *ownedFiles) removeEmptyDirs(path string) {
+	var dirs []string
+	for dir := filepath.Dir(path); dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if _, ok := o.Dirs[dir]; ok {
+			dirs = append(dirs, dir)
+		}
+	}
+	// deepest first
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		if err := os.Remove(dir); err != nil {
+			if !os.IsNotExist(err) {
+				// not empty, so neither are its parents
+				glog.V(2).Infof("Keeping directory %q: %v", dir, err)
+				return
+			}
+		} else {
+			glog.Infof("Removed empty directory %q", dir)
+		}
+		delete(o.Dirs, dir)
+	}
+}
+
+// hasContents returns whether the file at path has contents.
+func hasContents(path string, contents []byte) bool {
+	b, err := ioutil.ReadFile(path)
+	return err == nil && bytes.Equal(b, contents)
+}
+
+// copyFile copies the file from, described by fi, to to along with its mode
+// and ownership.
+func copyFile(from, to string, fi os.FileInfo) error {
+	b, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	uid, gid := -1, -1
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		uid, gid = int(stat.Uid), int(stat.Gid)
+	}
+	return writeFileAtomically(to, b, defaultDirectoryPermissions, fi.Mode().Perm(), uid, gid)
+}
@@ -0,0 +1,125 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteStaleFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-owned")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	path := func(p string) string { return filepath.Join(root, p) }
+
+	dn := &Daemon{
+		ownedFilesPath:   filepath.Join(dir, "owned-files.json"),
+		originalFilesDir: filepath.Join(dir, "orig"),
+	}
+
+	// a file shipped with the OS, which a config writes over
+	require.Nil(t, os.MkdirAll(path("etc"), 0755))
+	require.Nil(t, ioutil.WriteFile(path("etc/chrony.conf"), []byte("original"), 0600))
+	// a file nobody told the daemon about
+	require.Nil(t, ioutil.WriteFile(path("etc/unowned.conf"), []byte("unowned"), 0644))
+
+	oldConfig := &mcfgv1.MachineConfig{}
+	newConfig := &mcfgv1.MachineConfig{}
+	oldConfig.Spec.Config.Storage.Files = []ignv2_2types.File{
+		newTestFile(path("etc/chrony.conf"), "managed"),
+		newTestFile(path("etc/foo.d/sub/foo.conf"), "foo"),
+		newTestFile(path("etc/foo.d/bar.conf"), "bar"),
+	}
+	require.Nil(t, dn.updateFiles(newConfig, oldConfig))
+	for p, contents := range map[string]string{
+		"etc/chrony.conf":        "managed",
+		"etc/foo.d/sub/foo.conf": "foo",
+		"etc/foo.d/bar.conf":     "bar",
+	} {
+		b, err := ioutil.ReadFile(path(p))
+		require.Nil(t, err)
+		assert.Equal(t, contents, string(b))
+	}
+
+	// the bookkeeping survives the daemon
+	newConfig.Spec.Config.Storage.Files = []ignv2_2types.File{
+		newTestFile(path("etc/foo.d/bar.conf"), "bar"),
+	}
+	oldConfig.Spec.Config.Storage.Files = append(oldConfig.Spec.Config.Storage.Files, newTestFile(path("etc/unowned.conf"), "unowned"))
+	require.Nil(t, dn.updateFiles(oldConfig, newConfig))
+
+	// the original is restored, along with its mode
+	b, err := ioutil.ReadFile(path("etc/chrony.conf"))
+	require.Nil(t, err)
+	assert.Equal(t, "original", string(b))
+	fi, err := os.Stat(path("etc/chrony.conf"))
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode())
+	_, err = os.Stat(filepath.Join(dn.originalFilesDir, path("etc/chrony.conf")))
+	assert.True(t, os.IsNotExist(err), "backup was not removed")
+
+	// created files are removed, along with the directories created for
+	// them once empty
+	_, err = os.Stat(path("etc/foo.d/sub"))
+	assert.True(t, os.IsNotExist(err), "empty directory was not removed")
+	_, err = os.Stat(path("etc/foo.d/bar.conf"))
+	assert.Nil(t, err)
+
+	// files which weren't created by the daemon are kept
+	_, err = os.Stat(path("etc/unowned.conf"))
+	assert.Nil(t, err)
+
+	// removing the last file removes the directories created for it
+	require.Nil(t, dn.updateFiles(newConfig, &mcfgv1.MachineConfig{}))
+	_, err = os.Stat(path("etc/foo.d"))
+	assert.True(t, os.IsNotExist(err), "empty directory was not removed")
+	_, err = os.Stat(path("etc"))
+	assert.Nil(t, err, "directory which existed before was removed")
+
+	owned, err := loadOwnedFiles(dn.ownedFilesPath, dn.originalFilesDir)
+	require.Nil(t, err)
+	assert.Empty(t, owned.Files)
+	assert.Empty(t, owned.Dirs)
+}
+
+func TestClaimAdoptsWrittenFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-owned")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	owned, err := loadOwnedFiles(filepath.Join(dir, "owned-files.json"), filepath.Join(dir, "orig"))
+	require.Nil(t, err)
+
+	// a dropin written by a daemon which didn't keep track of its files
+	dropinDir := filepath.Join(dir, "kubelet.service.d")
+	dropin := filepath.Join(dropinDir, "20-foo.conf")
+	require.Nil(t, os.MkdirAll(dropinDir, 0755))
+	require.Nil(t, ioutil.WriteFile(dropin, []byte("foo"), 0644))
+	assert.True(t, isUnitFileUpToDate(dropin, []byte("foo")))
+	assert.False(t, isUnitFileUpToDate(dropin, []byte("bar")))
+
+	require.Nil(t, owned.claim(dropin, []byte("foo")))
+	assert.Equal(t, ownedFile{}, owned.Files[dropin], "adopted file was backed up")
+
+	released, err := owned.release(dropin)
+	require.Nil(t, err)
+	assert.True(t, released)
+	_, err = os.Stat(dropin)
+	assert.True(t, os.IsNotExist(err))
+
+	removeEmptyDropinDir(dropinDir)
+	_, err = os.Stat(dropinDir)
+	assert.True(t, os.IsNotExist(err), "empty dropin directory was not removed")
+
+	// files which aren't owned aren't released
+	released, err = owned.release(dropin)
+	require.Nil(t, err)
+	assert.False(t, released)
+}
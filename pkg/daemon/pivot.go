@@ -0,0 +1,181 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/pkg/errors"
+)
+
+const (
+	// pathOSContent is where the OSTree repo of the OS image is extracted to
+	// while rebasing onto it
+	pathOSContent = "/run/mco-machine-os-content"
+	// ostreeCommitLabel is the label of the OS image naming the OSTree commit
+	// it carries
+	ostreeCommitLabel = "com.coreos.ostree-commit"
+	// pivotOriginPrefix prefixes the OS image URL in the custom origin of the
+	// deployments rebased onto it
+	pivotOriginPrefix = "pivot://"
+	// pivotOutputLines is how many of the last lines of output of a failed
+	// command a failed pivot reports
+	pivotOutputLines = 20
+	// pivotProgressInterval is how often the progress of a pivot is published
+	// in the update-progress annotation
+	pivotProgressInterval = 10 * time.Second
+)
+
+// RunPivot rebases the deployment booted next onto the OSTree commit carried
+// by the OS image osImageURL, unless it already is. The output of rpm-ostree is
+// logged and passed to progress line by line. On failure the error includes
+// the rpm-ostreed journal.
+func (r *RpmOstreeClient) RunPivot(osImageURL string, progress func(string)) error {
+	output, err := RunGetOut("rpm-ostree", "status", "--json")
+	if err != nil {
+		return errors.Wrapf(err, "failed to get rpm-ostree status")
+	}
+	var state RpmOstreeState
+	if err := json.Unmarshal(output, &state); err != nil {
+		return fmt.Errorf("failed to parse `rpm-ostree status --json` output: %v", err)
+	}
+	if current := defaultDeploymentOSImageURL(state); current != "" {
+		if match, err := compareOSImageURL(current, osImageURL); err == nil && match {
+			glog.Infof("Already on or staged for %s", osImageURL)
+			return nil
+		}
+	}
+
+	progress(fmt.Sprintf("pulling %s", osImageURL))
+	if err := pullImage(osImageURL); err != nil {
+		return err
+	}
+	commit, err := RunGetOut("podman", "inspect", "--type=image", "--format", fmt.Sprintf("{{index .Labels %q}}", ostreeCommitLabel), osImageURL)
+	if err != nil {
+		return errors.Wrapf(err, "failed to inspect %s", osImageURL)
+	}
+	if strings.TrimSpace(string(commit)) == "" || strings.TrimSpace(string(commit)) == "<no value>" {
+		return fmt.Errorf("OS image %s has no %s label", osImageURL, ostreeCommitLabel)
+	}
+
+	if err := os.RemoveAll(pathOSContent); err != nil {
+		return errors.Wrapf(err, "removing %s", pathOSContent)
+	}
+	defer os.RemoveAll(pathOSContent)
+	progress(fmt.Sprintf("extracting %s", osImageURL))
+	if err := extractFromImage(osImageURL, "/srv/repo", pathOSContent); err != nil {
+		return errors.Wrapf(err, "failed to extract the OSTree repo of %s", osImageURL)
+	}
+
+	since := time.Now()
+	if err := runStreaming(progress, "rpm-ostree", "rebase", "--experimental",
+		fmt.Sprintf("%s:%s", pathOSContent, strings.TrimSpace(string(commit))),
+		"--custom-origin-url", pivotOriginPrefix+osImageURL,
+		"--custom-origin-description", "Managed by machine-config-operator"); err != nil {
+		return withUnitJournal(fmt.Errorf("failed to rebase onto %s: %v", osImageURL, err), rpmostreedUnit, since)
+	}
+	return nil
+}
+
+// defaultDeploymentOSImageURL returns the OS image URL of the deployment
+// booted next, the first one, if it was rebased onto an OS image.
+func defaultDeploymentOSImageURL(state RpmOstreeState) string {
+	if len(state.Deployments) == 0 {
+		return ""
+	}
+	return deploymentOSImageURL(state.Deployments[0])
+}
+
+// pullImage pulls image with the pull secret of the node.
+func pullImage(image string) error {
+	if _, err := RunGetOut("podman", "pull", "-q", "--authfile", pathPullSecret, image); err != nil {
+		return errors.Wrapf(err, "failed to pull %s", image)
+	}
+	return nil
+}
+
+// extractFromImage copies the directory src of the pulled image to dst.
+func extractFromImage(image, src, dst string) error {
+	out, err := RunGetOut("podman", "create", "--net=none", image)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create a container of %s", image)
+	}
+	container := strings.TrimSpace(string(out))
+	defer func() {
+		if err := exec.Command("podman", "rm", "-f", container).Run(); err != nil {
+			glog.Warningf("Unable to remove container %s: %v", container, err)
+		}
+	}()
+	_, err = RunGetOut("podman", "cp", container+":"+src, dst)
+	return err
+}
+
+// runStreaming runs command, logging its output and passing it to progress
+// line by line. The error of a failed command ends with its last lines of
+// output.
+func runStreaming(progress func(string), command string, args ...string) error {
+	glog.Infof("Running %s %s", command, strings.Join(args, " "))
+	cmd := exec.Command(command, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var last []string
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		glog.Info(line)
+		progress(line)
+		if last = append(last, line); len(last) > pivotOutputLines {
+			last = last[1:]
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s %s: %v: %s", command, args[0], err, strings.Join(last, "\n"))
+	}
+	return nil
+}
+
+// runLegacyPivot completes a pivot left for pivot.service by an earlier
+// daemon, in-process, then removes it so pivot.service doesn't run it again
+// on boot.
+func (dn *Daemon) runLegacyPivot() error {
+	b, err := ioutil.ReadFile(constants.EtcPivotFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "reading %s", constants.EtcPivotFile)
+	}
+	if exec.Command("systemctl", "is-active", "--quiet", pivotUnit).Run() == nil {
+		glog.Infof("Leaving the pending pivot in %s to the running %s", constants.EtcPivotFile, pivotUnit)
+		return nil
+	}
+
+	if osImageURL := strings.TrimSpace(string(b)); osImageURL != "" && dn.updater().managesOSImage() {
+		dn.logSystem("Completing pending pivot to %s from %s", osImageURL, constants.EtcPivotFile)
+		if err := dn.NodeUpdaterClient.RunPivot(osImageURL, func(string) {}); err != nil {
+			pivotErrors.Inc()
+			return errors.Wrapf(err, "completing pending pivot")
+		}
+	}
+	if err := os.Remove(constants.EtcPivotFile); err != nil {
+		return errors.Wrapf(err, "removing %s", constants.EtcPivotFile)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package daemon
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDefaultDeploymentOSImageURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		state    RpmOstreeState
+		expected string
+	}{{
+		name: "staged",
+		state: RpmOstreeState{Deployments: []RpmOstreeDeployment{
+			{CustomOrigin: []string{"pivot://quay.io/openshift/rhcos@sha256:new"}},
+			{Booted: true, CustomOrigin: []string{"pivot://quay.io/openshift/rhcos@sha256:old"}},
+		}},
+		expected: "quay.io/openshift/rhcos@sha256:new",
+	}, {
+		name: "not pivoted",
+		state: RpmOstreeState{Deployments: []RpmOstreeDeployment{
+			{Booted: true, Origin: "rhcos:rhcos/x86_64/coreos"},
+		}},
+	}, {
+		name: "other origin",
+		state: RpmOstreeState{Deployments: []RpmOstreeDeployment{
+			{Booted: true, CustomOrigin: []string{"file:///srv/repo"}},
+		}},
+	}, {
+		name: "no deployments",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := defaultDeploymentOSImageURL(test.state); got != test.expected {
+				t.Errorf("Expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestRunStreaming(t *testing.T) {
+	var lines []string
+	progress := func(line string) { lines = append(lines, line) }
+
+	if err := runStreaming(progress, "sh", "-c", "echo Receiving objects; echo; echo Staging deployment >&2"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if expected := []string{"Receiving objects", "Staging deployment"}; !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected progress %v, got %v", expected, lines)
+	}
+
+	lines = nil
+	err := runStreaming(progress, "sh", "-c", "echo Receiving objects; echo error: No space left on device >&2; exit 1")
+	if err == nil {
+		t.Fatal("Expected the failed command to fail")
+	}
+	if !strings.Contains(err.Error(), "No space left on device") {
+		t.Errorf("Expected the output in the error, got %v", err)
+	}
+}
@@ -0,0 +1,538 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/golang/glog"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// errLiveUpdateFailed is the cause of the errors of live updates whose units
+// couldn't be reloaded or restarted.
+var errLiveUpdateFailed = errors.New("live update failed")
+
+const (
+	// updateActionAnnotationKey records the action taken to apply the last
+	// update, and the changes which required it
+	updateActionAnnotationKey = "machineconfiguration.openshift.io/update-action"
+	// rebootReasonAnnotationKey records the changes which made the last
+	// completed update reboot the node, "none" if it didn't, see
+	// recordRebootReason. It is removed when the next update starts.
+	rebootReasonAnnotationKey = "machineconfiguration.openshift.io/reason-for-reboot"
+	// noRebootReason is the reason for reboot of updates which didn't reboot
+	noRebootReason = "none"
+)
+
+// actionKind is what applying a change takes. Kinds are ordered, a plan takes
+// the maximal kind across all of its changes.
+type actionKind int
+
+const (
+	// actionNone is for changes which are picked up without any action
+	actionNone actionKind = iota
+	// actionReloadUnit is for changes a running unit picks up on reload
+	actionReloadUnit
+	// actionReloadConfig is for changes picked up by running the command of
+	// a config reload, see configReloads
+	actionReloadConfig
+	// actionRestartUnit is for changes a unit only picks up on start
+	actionRestartUnit
+	// actionReboot is for everything else
+	actionReboot
+)
+
+// updateAction is the action needed to apply a change.
+type updateAction struct {
+	kind actionKind
+	// unit is the unit to reload or restart
+	unit string
+	// config is the name of the config reload to run
+	config string
+}
+
+func (a updateAction) String() string {
+	switch a.kind {
+	case actionNone:
+		return "None"
+	case actionReloadUnit:
+		return fmt.Sprintf("ReloadUnit(%s)", a.unit)
+	case actionReloadConfig:
+		return fmt.Sprintf("ReloadConfig(%s)", a.config)
+	case actionRestartUnit:
+		return fmt.Sprintf("RestartUnit(%s)", a.unit)
+	}
+	return "Reboot"
+}
+
+var (
+	none   = updateAction{kind: actionNone}
+	reboot = updateAction{kind: actionReboot}
+)
+
+// reloadUnit and restartUnit return the action to reload or restart unit.
+func reloadUnit(unit string) updateAction  { return updateAction{kind: actionReloadUnit, unit: unit} }
+func restartUnit(unit string) updateAction { return updateAction{kind: actionRestartUnit, unit: unit} }
+
+// reloadConfig returns the action to run the config reload name.
+func reloadConfig(name string) updateAction {
+	return updateAction{kind: actionReloadConfig, config: name}
+}
+
+// filePolicies maps the paths of files we know how to update live to the
+// action it takes. Files not listed here need a reboot.
+var filePolicies = map[string]updateAction{
+	// crio rereads its registries, mirrors included, and its signature
+	// policy on SIGHUP
+	"/etc/containers/registries.conf": reloadUnit("crio.service"),
+	"/etc/containers/policy.json":     reloadUnit("crio.service"),
+	"/etc/chrony.conf":                restartUnit("chronyd.service"),
+	// the kubelet only reads its client CA bundle on start
+	"/etc/kubernetes/ca.crt": restartUnit("kubelet.service"),
+	// the kubelet watches its serving CA bundle and reloads it on change
+	"/etc/kubernetes/kubelet-ca.crt": none,
+	// the pull secret is read on every pull
+	"/var/lib/kubelet/config.json": none,
+}
+
+// caBundlePaths are the CA bundles updates are checked for removed
+// certificates, which break the clients still relying on them.
+var caBundlePaths = []string{
+	"/etc/kubernetes/ca.crt",
+	"/etc/kubernetes/kubelet-ca.crt",
+}
+
+// dirPolicies maps the directories whose files we know how to update live to
+// the action it takes, for the files not in filePolicies.
+var dirPolicies = map[string]updateAction{
+	"/etc/containers/registries.conf.d": reloadUnit("crio.service"),
+	// the signature lookaside configuration of the registries
+	"/etc/containers/registries.d": reloadUnit("crio.service"),
+}
+
+// patternPolicies maps the patterns, as of filepath.Match, of the files we
+// know how to update live to the action it takes, for the files not in
+// filePolicies or dirPolicies.
+var patternPolicies = map[string]updateAction{
+	"/etc/NetworkManager/conf.d/*.conf": reloadConfig("NetworkManager"),
+	"/etc/sysctl.d/*.conf":              reloadConfig("sysctl"),
+}
+
+// filePolicy returns the action changing the file at path takes, and whether
+// it is known.
+func filePolicy(path string) (updateAction, bool) {
+	if action, ok := filePolicies[path]; ok {
+		return action, true
+	}
+	if action, ok := dirPolicies[filepath.Dir(path)]; ok {
+		return action, true
+	}
+	for pattern, action := range patternPolicies {
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return action, true
+		}
+	}
+	return none, false
+}
+
+// unitChecks are run after a unit is reloaded or restarted, to make sure it
+// picked up the change before the update is done.
+var unitChecks = map[string]func() error{
+	"crio.service": waitForCrio,
+}
+
+// unitPolicies maps the names of units we know how to update live to the
+// action it takes. Units not listed here need a reboot.
+var unitPolicies = map[string]updateAction{}
+
+// updatePlan is the set of actions applying an update takes.
+type updatePlan struct {
+	// reboot is whether at least one change needs a reboot
+	reboot bool
+	// reload and restart are the units to reload and to restart
+	reload  map[string]struct{}
+	restart map[string]struct{}
+	// configs are the config reloads to run
+	configs map[string]struct{}
+	// reasons describes the changes which needed the maximal action
+	reasons []string
+	// maxKind is the maximal kind across the changes
+	maxKind actionKind
+}
+
+// add records that the change described by reason takes action.
+func (p *updatePlan) add(action updateAction, reason string) {
+	switch action.kind {
+	case actionReboot:
+		p.reboot = true
+	case actionReloadUnit:
+		p.reload[action.unit] = struct{}{}
+	case actionRestartUnit:
+		p.restart[action.unit] = struct{}{}
+	case actionReloadConfig:
+		p.configs[action.config] = struct{}{}
+	}
+	switch {
+	case action.kind.rank() > p.maxKind.rank():
+		p.reasons = []string{reason}
+	case action.kind.rank() == p.maxKind.rank():
+		p.reasons = append(p.reasons, reason)
+	}
+	if action.kind > p.maxKind {
+		p.maxKind = action.kind
+	}
+}
+
+// rank orders kinds for the reasons of a plan: all the reloads and restarts
+// of a plan are taken, so they rank the same.
+func (k actionKind) rank() actionKind {
+	if k == actionRestartUnit || k == actionReloadConfig {
+		return actionReloadUnit
+	}
+	return k
+}
+
+// String describes the plan's maximal action and why it is needed.
+func (p *updatePlan) String() string {
+	var action string
+	switch p.maxKind {
+	case actionReboot:
+		action = reboot.String()
+	case actionNone:
+		action = none.String()
+	default:
+		var actions []string
+		for _, c := range sortedSet(p.configs) {
+			actions = append(actions, reloadConfig(c).String())
+		}
+		for _, u := range sortedSet(p.restart) {
+			actions = append(actions, restartUnit(u).String())
+		}
+		for _, u := range sortedSet(p.reload) {
+			// restarting a unit also picks up the changes a reload would
+			if _, ok := p.restart[u]; !ok {
+				actions = append(actions, reloadUnit(u).String())
+			}
+		}
+		action = strings.Join(actions, ", ")
+	}
+	if len(p.reasons) == 0 {
+		return action
+	}
+	return fmt.Sprintf("%s: %s", action, strings.Join(p.reasons, ", "))
+}
+
+// rebootReason returns the changes which need the plan to reboot, or
+// noRebootReason if it doesn't.
+func (p *updatePlan) rebootReason() string {
+	if !p.reboot {
+		return noRebootReason
+	}
+	return strings.Join(p.reasons, ", ")
+}
+
+// computeUpdatePlan returns the actions needed to apply the changes from
+// oldConfig to newConfig.
+func computeUpdatePlan(oldConfig, newConfig *mcfgv1.MachineConfig) *updatePlan {
+	plan := &updatePlan{
+		reload:  make(map[string]struct{}),
+		restart: make(map[string]struct{}),
+		configs: make(map[string]struct{}),
+	}
+
+	if oldConfig.Spec.OSImageURL != newConfig.Spec.OSImageURL {
+		plan.add(reboot, "osImageURL changed")
+	}
+
+	if added, removed := diffKernelArguments(oldConfig.Spec.KernelArguments, newConfig.Spec.KernelArguments); len(added) > 0 || len(removed) > 0 {
+		plan.add(reboot, "kernelArguments changed")
+	}
+
+	if kernelType(oldConfig) != kernelType(newConfig) {
+		plan.add(reboot, "kernelType changed")
+	}
+
+	if install, uninstall := diffExtensions(oldConfig.Spec.Extensions, newConfig.Spec.Extensions); len(install) > 0 || len(uninstall) > 0 {
+		plan.add(reboot, "extensions changed")
+	}
+
+	newFiles := make(map[string]bool)
+	for _, f := range newConfig.Spec.Config.Storage.Files {
+		newFiles[f.Path] = true
+	}
+	for _, path := range changedFiles(oldConfig.Spec.Config.Storage.Files, newConfig.Spec.Config.Storage.Files) {
+		action, ok := filePolicy(path)
+		if !ok {
+			action = reboot
+		}
+		if action.kind == actionReloadConfig && configReloads[action.config].keepsRemoved && !newFiles[path] {
+			plan.add(reboot, fmt.Sprintf("file %s removed", path))
+			continue
+		}
+		plan.add(action, fmt.Sprintf("file %s changed", path))
+	}
+
+	for _, path := range changedLinks(oldConfig.Spec.Config.Storage.Links, newConfig.Spec.Config.Storage.Links) {
+		action, ok := filePolicy(path)
+		if !ok {
+			action = reboot
+		}
+		plan.add(action, fmt.Sprintf("link %s changed", path))
+	}
+
+	for _, name := range changedUnits(oldConfig.Spec.Config.Systemd.Units, newConfig.Spec.Config.Systemd.Units) {
+		action, ok := unitPolicies[name]
+		if !ok {
+			action = reboot
+		}
+		plan.add(action, fmt.Sprintf("unit %s changed", name))
+	}
+
+	// users are updated before the action is taken, and sshd and login read
+	// them on every login.
+	oldSpec := oldConfig.Spec.DeepCopy()
+	newSpec := newConfig.Spec.DeepCopy()
+	oldUsers, newUsers := oldSpec.Config.Passwd.Users, newSpec.Config.Passwd.Users
+	if !reflect.DeepEqual(oldUsers, newUsers) && usersUpdatableLive(oldUsers, newUsers) {
+		if onlySSHKeysChanged(oldUsers, newUsers) {
+			plan.add(none, "SSH keys changed")
+		} else {
+			plan.add(none, "passwd users changed")
+		}
+		oldSpec.Config.Passwd.Users = nil
+		newSpec.Config.Passwd.Users = nil
+	}
+
+	// anything else needs a reboot
+	for _, spec := range []*mcfgv1.MachineConfigSpec{oldSpec, newSpec} {
+		spec.OSImageURL = ""
+		spec.KernelArguments = nil
+		spec.KernelType = ""
+		spec.Extensions = nil
+		spec.Config.Storage.Files = nil
+		spec.Config.Storage.Links = nil
+		spec.Config.Systemd.Units = nil
+	}
+	if !reflect.DeepEqual(oldSpec, newSpec) {
+		plan.add(reboot, "other changes")
+	}
+	return plan
+}
+
+// changedFiles returns the sorted paths of the files added, removed or
+// changed between oldFiles and newFiles.
+func changedFiles(oldFiles, newFiles []ignv2_2types.File) []string {
+	oldByPath := make(map[string]ignv2_2types.File)
+	for _, f := range oldFiles {
+		oldByPath[f.Path] = f
+	}
+	changed := make(map[string]struct{})
+	for _, f := range newFiles {
+		if o, ok := oldByPath[f.Path]; !ok || !reflect.DeepEqual(o, f) {
+			changed[f.Path] = struct{}{}
+		}
+		delete(oldByPath, f.Path)
+	}
+	for path := range oldByPath {
+		changed[path] = struct{}{}
+	}
+	return sortedSet(changed)
+}
+
+// changedLinks returns the sorted paths of the links added, removed or
+// changed between oldLinks and newLinks.
+func changedLinks(oldLinks, newLinks []ignv2_2types.Link) []string {
+	oldByPath := make(map[string]ignv2_2types.Link)
+	for _, l := range oldLinks {
+		oldByPath[l.Path] = l
+	}
+	changed := make(map[string]struct{})
+	for _, l := range newLinks {
+		if o, ok := oldByPath[l.Path]; !ok || !reflect.DeepEqual(o, l) {
+			changed[l.Path] = struct{}{}
+		}
+		delete(oldByPath, l.Path)
+	}
+	for path := range oldByPath {
+		changed[path] = struct{}{}
+	}
+	return sortedSet(changed)
+}
+
+// changedUnits returns the sorted names of the units added, removed or changed
+// between oldUnits and newUnits.
+func changedUnits(oldUnits, newUnits []ignv2_2types.Unit) []string {
+	oldByName := make(map[string]ignv2_2types.Unit)
+	for _, u := range oldUnits {
+		oldByName[u.Name] = u
+	}
+	changed := make(map[string]struct{})
+	for _, u := range newUnits {
+		if o, ok := oldByName[u.Name]; !ok || !reflect.DeepEqual(o, u) {
+			changed[u.Name] = struct{}{}
+		}
+		delete(oldByName, u.Name)
+	}
+	for name := range oldByName {
+		changed[name] = struct{}{}
+	}
+	return sortedSet(changed)
+}
+
+// recordUpdatePlan records the plan for newConfig in the update-action node
+// annotation and an event. The annotation is written without waiting for it,
+// failing to is only logged.
+func (dn *Daemon) recordUpdatePlan(newConfig *mcfgv1.MachineConfig, plan *updatePlan) {
+	description := plan.String()
+	glog.Infof("Update to %s needs %s", newConfig.GetName(), description)
+	if dn.recorder != nil && dn.node != nil {
+		dn.recorder.Eventf(getNodeRef(dn.node), corev1.EventTypeNormal, "UpdateAction", "Update to %s needs %s", newConfig.GetName(), description)
+	}
+	dn.queueNodeWrite("record the update action", func(ctx context.Context) *PendingWrite {
+		return dn.nodeWriter.QueueAnnotations(ctx, map[string]string{
+			updateActionAnnotationKey: truncateReason(description),
+		})
+	})
+}
+
+// recordRebootReason records, once the update to newConfig completed, why it
+// rebooted the node in the reason-for-reboot node annotation and an event.
+// Failing to record it is only logged.
+func (dn *Daemon) recordRebootReason(newConfig, reason string) {
+	message := fmt.Sprintf("Update to %s rebooted the node: %s", newConfig, reason)
+	if reason == noRebootReason {
+		message = fmt.Sprintf("Update to %s completed without a reboot", newConfig)
+	}
+	glog.Info(message)
+	if dn.recorder != nil && dn.node != nil {
+		dn.recorder.Event(getNodeRef(dn.node), corev1.EventTypeNormal, "RebootReason", message)
+	}
+	if dn.nodeWriter == nil {
+		return
+	}
+	ctx, cancel := nodeWriterContext()
+	defer cancel()
+	if err := dn.nodeWriter.SetAnnotations(ctx, map[string]string{
+		rebootReasonAnnotationKey: truncateReason(reason),
+	}); err != nil {
+		glog.Warningf("Unable to record the reason for reboot of the update to %s: %v", newConfig, err)
+	}
+}
+
+// bootRebootReason returns why the update from oldConfig to newConfig, which
+// the node just rebooted into, rebooted it. It is computed again from the
+// configs, like the plan was: a plan which doesn't need a reboot only got one
+// as its live update failed.
+func bootRebootReason(oldConfig, newConfig *mcfgv1.MachineConfig) string {
+	if oldConfig == nil {
+		return "no current config"
+	}
+	reason := computeUpdatePlan(oldConfig, newConfig).rebootReason()
+	if reason == noRebootReason {
+		return "live update failed"
+	}
+	return reason
+}
+
+// shrunkCABundles returns a description of each CA bundle of caBundlePaths
+// which holds fewer certificates in newConfig than in oldConfig.
+func shrunkCABundles(oldConfig, newConfig *mcfgv1.MachineConfig) []string {
+	var shrunk []string
+	for _, path := range caBundlePaths {
+		oldCount, newCount := countCertificates(oldConfig, path), countCertificates(newConfig, path)
+		if newCount < oldCount {
+			shrunk = append(shrunk, fmt.Sprintf("%s shrinks from %d to %d certificates", path, oldCount, newCount))
+		}
+	}
+	return shrunk
+}
+
+// countCertificates returns the number of PEM certificates of the file at path
+// in config, 0 if it has no such file or it can't be decoded.
+func countCertificates(config *mcfgv1.MachineConfig, path string) int {
+	for _, f := range config.Spec.Config.Storage.Files {
+		if f.Path != path {
+			continue
+		}
+		contents, err := fileContents(f)
+		if err != nil {
+			return 0
+		}
+		return strings.Count(contents, "-----BEGIN CERTIFICATE-----")
+	}
+	return 0
+}
+
+// warnShrunkCABundles warns, with an event, about the CA bundles the update
+// from oldConfig to newConfig removes certificates from. The update still
+// goes ahead, as removing expired or revoked certificates is legitimate.
+func (dn *Daemon) warnShrunkCABundles(oldConfig, newConfig *mcfgv1.MachineConfig) {
+	for _, description := range shrunkCABundles(oldConfig, newConfig) {
+		glog.Warningf("Update to %s: CA bundle %s", newConfig.GetName(), description)
+		if dn.recorder != nil && dn.node != nil {
+			dn.recorder.Eventf(getNodeRef(dn.node), corev1.EventTypeWarning, "CABundleShrunk", "Update to %s: CA bundle %s", newConfig.GetName(), description)
+		}
+	}
+}
+
+// applyLiveUpdate finishes an update which doesn't need a reboot: the files,
+// units and SSH keys are already written and systemd reloaded by then, so only
+// the config reloads and the units picking them up need running, reloading or
+// restarting. If that fails, the returned error has errLiveUpdateFailed as its
+// cause and the update can still be applied with a reboot.
+func (dn *Daemon) applyLiveUpdate(newConfig *mcfgv1.MachineConfig, plan *updatePlan) error {
+	dn.logSystem("Applying %s without drain or reboot: %s", newConfig.GetName(), plan)
+
+	if err := dn.reloadConfigs(newConfig, plan); err != nil {
+		return errors.Wrapf(errLiveUpdateFailed, "%v", err)
+	}
+	for _, unit := range sortedSet(plan.restart) {
+		if err := runUnitAction("restart", unit); err != nil {
+			return errors.Wrapf(errLiveUpdateFailed, "%v", err)
+		}
+	}
+	for _, unit := range sortedSet(plan.reload) {
+		if _, ok := plan.restart[unit]; ok {
+			continue
+		}
+		if err := runUnitAction("reload", unit); err != nil {
+			return errors.Wrapf(errLiveUpdateFailed, "%v", err)
+		}
+	}
+	if err := dn.completeLiveUpdate(newConfig); err != nil {
+		return err
+	}
+	dn.recordRebootReason(newConfig.GetName(), plan.rebootReason())
+	return nil
+}
+
+// runUnitAction reloads or restarts unit, then runs its check if any. It is
+// swapped out by tests.
+var runUnitAction = func(action, unit string) error {
+	since := time.Now()
+	if err := runSystemctl(action, unit); err != nil {
+		return withUnitJournal(err, unit, since)
+	}
+	if check, ok := unitChecks[unit]; ok {
+		if err := check(); err != nil {
+			return withUnitJournal(errors.Wrapf(err, "%s did not come back after %s", unit, action), unit, since)
+		}
+	}
+	return nil
+}
+
+func runSystemctl(args ...string) error {
+	glog.Infof("Running systemctl %s", strings.Join(args, " "))
+	if out, err := exec.Command("systemctl", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to run systemctl %s: %s: %v", strings.Join(args, " "), string(out), err)
+	}
+	return nil
+}
@@ -0,0 +1,376 @@
+package daemon
+
+import (
+	"fmt"
+	"testing"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestComputeUpdatePlan(t *testing.T) {
+	newConfig := func(osImageURL string, files []ignv2_2types.File, keys ...ignv2_2types.SSHAuthorizedKey) *mcfgv1.MachineConfig {
+		return &mcfgv1.MachineConfig{
+			Spec: mcfgv1.MachineConfigSpec{
+				OSImageURL: osImageURL,
+				Config: ignv2_2types.Config{
+					Passwd: ignv2_2types.Passwd{
+						Users: []ignv2_2types.PasswdUser{{Name: "core", SSHAuthorizedKeys: keys}},
+					},
+					Storage: ignv2_2types.Storage{Files: files},
+				},
+			},
+		}
+	}
+	registries := newTestFile("/etc/containers/registries.conf", "registries")
+	chrony := newTestFile("/etc/chrony.conf", "chrony")
+	oldConfig := newConfig("os", []ignv2_2types.File{registries, chrony}, "1234")
+
+	hash := "hash"
+	withPassword := newConfig("os", []ignv2_2types.File{registries, chrony}, "5678")
+	withPassword.Spec.Config.Passwd.Users[0].PasswordHash = &hash
+
+	withUnit := newConfig("os", []ignv2_2types.File{registries, chrony}, "1234")
+	withUnit.Spec.Config.Systemd.Units = []ignv2_2types.Unit{{Name: "foo.service", Contents: "foo"}}
+
+	withDirectory := newConfig("os", []ignv2_2types.File{registries, chrony}, "1234")
+	withDirectory.Spec.Config.Storage.Directories = []ignv2_2types.Directory{{Node: ignv2_2types.Node{Path: "/etc/foo"}}}
+
+	withKernelArguments := newConfig("os", []ignv2_2types.File{registries, chrony}, "1234")
+	withKernelArguments.Spec.KernelArguments = []string{"nosmt"}
+
+	withRealtimeKernel := newConfig("os", []ignv2_2types.File{registries, chrony}, "1234")
+	withRealtimeKernel.Spec.KernelType = mcfgv1.KernelTypeRealtime
+
+	withExtensions := newConfig("os", []ignv2_2types.File{registries, chrony}, "1234")
+	withExtensions.Spec.Extensions = []string{"usbguard"}
+
+	tests := []struct {
+		name        string
+		newConfig   *mcfgv1.MachineConfig
+		reboot      bool
+		description string
+	}{{
+		name:        "no changes",
+		newConfig:   newConfig("os", []ignv2_2types.File{registries, chrony}, "1234"),
+		description: "None",
+	}, {
+		name:        "ssh keys",
+		newConfig:   newConfig("os", []ignv2_2types.File{registries, chrony}, "1234", "5678"),
+		description: "None: SSH keys changed",
+	}, {
+		name:        "reload",
+		newConfig:   newConfig("os", []ignv2_2types.File{newTestFile(registries.Path, "changed"), chrony}, "5678"),
+		description: "ReloadUnit(crio.service): file /etc/containers/registries.conf changed",
+	}, {
+		name:        "reload and restart",
+		newConfig:   newConfig("os", []ignv2_2types.File{newTestFile(registries.Path, "changed"), newTestFile(chrony.Path, "changed")}),
+		description: "RestartUnit(chronyd.service), ReloadUnit(crio.service): file /etc/chrony.conf changed, file /etc/containers/registries.conf changed",
+	}, {
+		name:        "removed file",
+		newConfig:   newConfig("os", []ignv2_2types.File{registries}, "1234"),
+		description: "RestartUnit(chronyd.service): file /etc/chrony.conf changed",
+	}, {
+		name:        "unknown file",
+		newConfig:   newConfig("os", []ignv2_2types.File{registries, chrony, newTestFile("/etc/foo", "foo")}, "1234"),
+		reboot:      true,
+		description: "Reboot: file /etc/foo changed",
+	}, {
+		name:        "os",
+		newConfig:   newConfig("other-os", []ignv2_2types.File{newTestFile(registries.Path, "changed"), chrony}, "1234"),
+		reboot:      true,
+		description: "Reboot: osImageURL changed",
+	}, {
+		name:        "kernel arguments",
+		newConfig:   withKernelArguments,
+		reboot:      true,
+		description: "Reboot: kernelArguments changed",
+	}, {
+		name:        "kernel type",
+		newConfig:   withRealtimeKernel,
+		reboot:      true,
+		description: "Reboot: kernelType changed",
+	}, {
+		name:        "extensions",
+		newConfig:   withExtensions,
+		reboot:      true,
+		description: "Reboot: extensions changed",
+	}, {
+		name:        "unit",
+		newConfig:   withUnit,
+		reboot:      true,
+		description: "Reboot: unit foo.service changed",
+	}, {
+		name:        "password",
+		newConfig:   withPassword,
+		reboot:      false,
+		description: "None: passwd users changed",
+	}, {
+		name:        "directory",
+		newConfig:   withDirectory,
+		reboot:      true,
+		description: "Reboot: other changes",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := computeUpdatePlan(oldConfig, test.newConfig)
+			if plan.reboot != test.reboot {
+				t.Errorf("Expected reboot %v, got %v", test.reboot, plan.reboot)
+			}
+			if plan.String() != test.description {
+				t.Errorf("Expected description %q, got %q", test.description, plan.String())
+			}
+		})
+	}
+}
+
+func TestComputeUpdatePlanUnitPolicy(t *testing.T) {
+	oldConfig := &mcfgv1.MachineConfig{}
+	newConfig := oldConfig.DeepCopy()
+	newConfig.Spec.Config.Systemd.Units = []ignv2_2types.Unit{{Name: "foo.service", Contents: "foo"}}
+
+	unitPolicies["foo.service"] = restartUnit("foo.service")
+	defer delete(unitPolicies, "foo.service")
+
+	plan := computeUpdatePlan(oldConfig, newConfig)
+	if plan.reboot {
+		t.Errorf("Expected no reboot")
+	}
+	if _, ok := plan.restart["foo.service"]; !ok {
+		t.Errorf("Expected foo.service to be restarted, got %v", plan.restart)
+	}
+}
+
+func TestComputeUpdatePlanContainersPolicy(t *testing.T) {
+	oldConfig := &mcfgv1.MachineConfig{}
+	for _, path := range []string{
+		"/etc/containers/registries.conf",
+		"/etc/containers/policy.json",
+		"/etc/containers/registries.conf.d/99-mirrors.conf",
+		"/etc/containers/registries.d/default.yaml",
+	} {
+		newConfig := oldConfig.DeepCopy()
+		newConfig.Spec.Config.Storage.Files = []ignv2_2types.File{newTestFile(path, "mirrors")}
+		plan := computeUpdatePlan(oldConfig, newConfig)
+		if plan.reboot {
+			t.Errorf("Expected no reboot for %s", path)
+		}
+		if expected := "ReloadUnit(crio.service): file " + path + " changed"; plan.String() != expected {
+			t.Errorf("Expected description %q, got %q", expected, plan.String())
+		}
+	}
+
+	// only the directories themselves are known
+	newConfig := oldConfig.DeepCopy()
+	newConfig.Spec.Config.Storage.Files = []ignv2_2types.File{newTestFile("/etc/containers/registries.d/sub/default.yaml", "mirrors")}
+	if plan := computeUpdatePlan(oldConfig, newConfig); !plan.reboot {
+		t.Errorf("Expected a reboot for files in subdirectories")
+	}
+}
+
+func TestComputeUpdatePlanConfigReloadPolicy(t *testing.T) {
+	oldConfig := &mcfgv1.MachineConfig{}
+	for path, expected := range map[string]string{
+		"/etc/NetworkManager/conf.d/99-dns.conf": "ReloadConfig(NetworkManager): file /etc/NetworkManager/conf.d/99-dns.conf changed",
+		"/etc/sysctl.d/99-inotify.conf":          "ReloadConfig(sysctl): file /etc/sysctl.d/99-inotify.conf changed",
+		"/etc/sysctl.d/99-inotify.txt":           "Reboot: file /etc/sysctl.d/99-inotify.txt changed",
+		"/etc/sysctl.d/sub/99-inotify.conf":      "Reboot: file /etc/sysctl.d/sub/99-inotify.conf changed",
+	} {
+		newConfig := oldConfig.DeepCopy()
+		newConfig.Spec.Config.Storage.Files = []ignv2_2types.File{newTestFile(path, "fs.inotify.max_user_watches = 65536\n")}
+		if plan := computeUpdatePlan(oldConfig, newConfig); plan.String() != expected {
+			t.Errorf("Expected description %q, got %q", expected, plan.String())
+		}
+	}
+
+	// the sysctls of removed files stay set until a reboot
+	withFiles := oldConfig.DeepCopy()
+	withFiles.Spec.Config.Storage.Files = []ignv2_2types.File{
+		newTestFile("/etc/NetworkManager/conf.d/99-dns.conf", "[main]\ndns=none\n"),
+		newTestFile("/etc/sysctl.d/99-inotify.conf", "fs.inotify.max_user_watches = 65536\n"),
+	}
+	withoutNM := withFiles.DeepCopy()
+	withoutNM.Spec.Config.Storage.Files = withoutNM.Spec.Config.Storage.Files[1:]
+	if plan := computeUpdatePlan(withFiles, withoutNM); plan.reboot {
+		t.Errorf("Expected no reboot for a removed NetworkManager file")
+	}
+	if plan := computeUpdatePlan(withFiles, oldConfig); plan.String() != "Reboot: file /etc/sysctl.d/99-inotify.conf removed" {
+		t.Errorf("Expected a reboot for a removed sysctl file, got %q", plan.String())
+	}
+}
+
+func TestApplyLiveUpdateConfigReloadFailure(t *testing.T) {
+	defer func(orig func(string, *mcfgv1.MachineConfig) error) { runConfigReload = orig }(runConfigReload)
+	defer func(orig func(string, string) error) { runUnitAction = orig }(runUnitAction)
+	var reloads []string
+	runConfigReload = func(name string, newConfig *mcfgv1.MachineConfig) error {
+		reloads = append(reloads, name)
+		return fmt.Errorf("%s did not pick up the config", name)
+	}
+	runUnitAction = func(action, unit string) error {
+		t.Errorf("Unexpected %s of %s", action, unit)
+		return nil
+	}
+
+	dn := &Daemon{}
+	newConfig := &mcfgv1.MachineConfig{
+		Spec: mcfgv1.MachineConfigSpec{
+			Config: ignv2_2types.Config{
+				Storage: ignv2_2types.Storage{Files: []ignv2_2types.File{
+					newTestFile("/etc/sysctl.d/99-inotify.conf", "fs.inotify.max_user_watches = 65536\n"),
+					newTestFile("/etc/containers/registries.conf", "mirrors"),
+				}},
+			},
+		},
+	}
+	plan := computeUpdatePlan(&mcfgv1.MachineConfig{}, newConfig)
+	err := dn.applyLiveUpdate(newConfig, plan)
+	// the update falls back to a reboot instead of failing
+	if errors.Cause(err) != errLiveUpdateFailed {
+		t.Errorf("Expected errLiveUpdateFailed, got %v", err)
+	}
+	if len(reloads) != 1 || reloads[0] != "sysctl" {
+		t.Errorf("Expected sysctl to be reloaded, got %v", reloads)
+	}
+}
+
+func TestRebootReason(t *testing.T) {
+	oldConfig := &mcfgv1.MachineConfig{}
+	newConfig := oldConfig.DeepCopy()
+	newConfig.Spec.OSImageURL = "quay.io/openshift/os@sha256:2"
+	newConfig.Spec.KernelArguments = []string{"nosmt"}
+	newConfig.Spec.Config.Storage.Files = []ignv2_2types.File{
+		newTestFile("/etc/kubernetes/kubelet.conf", "kind: KubeletConfiguration"),
+		newTestFile("/etc/containers/registries.conf", "mirrors"),
+	}
+	expected := "osImageURL changed, kernelArguments changed, file /etc/kubernetes/kubelet.conf changed"
+	if reason := computeUpdatePlan(oldConfig, newConfig).rebootReason(); reason != expected {
+		t.Errorf("Expected reason %q, got %q", expected, reason)
+	}
+	if reason := bootRebootReason(oldConfig, newConfig); reason != expected {
+		t.Errorf("Expected the reason to be computed again on boot as %q, got %q", expected, reason)
+	}
+
+	liveConfig := oldConfig.DeepCopy()
+	liveConfig.Spec.Config.Storage.Files = []ignv2_2types.File{newTestFile("/etc/containers/registries.conf", "mirrors")}
+	if reason := computeUpdatePlan(oldConfig, liveConfig).rebootReason(); reason != noRebootReason {
+		t.Errorf("Expected no reason for a live update, got %q", reason)
+	}
+	if reason := bootRebootReason(oldConfig, liveConfig); reason != "live update failed" {
+		t.Errorf("Expected a live update rebooting to have failed, got %q", reason)
+	}
+}
+
+func TestRecordRebootReason(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{rebootReasonAnnotationKey: "osImageURL changed"})
+	client := k8sfake.NewSimpleClientset(node)
+	recorder := record.NewFakeRecorder(10)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), newTestNodeLister(t, node), node.Name)
+	go nw.Run(stopCh)
+
+	dn := &Daemon{node: node, nodeWriter: nw, recorder: recorder}
+	dn.recordRebootReason("rendered-worker-2", noRebootReason)
+	updated, err := client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, noRebootReason, updated.Annotations[rebootReasonAnnotationKey])
+	assert.Equal(t, "Normal RebootReason Update to rendered-worker-2 completed without a reboot", <-recorder.Events)
+
+	dn.recordRebootReason("rendered-worker-3", "kernelArguments changed")
+	updated, err = client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, "kernelArguments changed", updated.Annotations[rebootReasonAnnotationKey])
+	assert.Equal(t, "Normal RebootReason Update to rendered-worker-3 rebooted the node: kernelArguments changed", <-recorder.Events)
+}
+
+func TestApplyLiveUpdateFailure(t *testing.T) {
+	defer func(orig func(string, string) error) { runUnitAction = orig }(runUnitAction)
+	var actions []string
+	runUnitAction = func(action, unit string) error {
+		actions = append(actions, action+" "+unit)
+		return fmt.Errorf("%s did not come back after %s", unit, action)
+	}
+
+	dn := &Daemon{}
+	plan := computeUpdatePlan(&mcfgv1.MachineConfig{}, &mcfgv1.MachineConfig{
+		Spec: mcfgv1.MachineConfigSpec{
+			Config: ignv2_2types.Config{
+				Storage: ignv2_2types.Storage{Files: []ignv2_2types.File{newTestFile("/etc/containers/registries.conf", "mirrors")}},
+			},
+		},
+	})
+	err := dn.applyLiveUpdate(&mcfgv1.MachineConfig{}, plan)
+	// the update falls back to a reboot instead of failing
+	if errors.Cause(err) != errLiveUpdateFailed {
+		t.Errorf("Expected errLiveUpdateFailed, got %v", err)
+	}
+	if len(actions) != 1 || actions[0] != "reload crio.service" {
+		t.Errorf("Expected crio.service to be reloaded, got %v", actions)
+	}
+}
+
+func TestWaitForCrio(t *testing.T) {
+	defer func(orig func() error) { crioStatus = orig }(crioStatus)
+	calls := 0
+	crioStatus = func() error {
+		calls++
+		return nil
+	}
+	if err := waitForCrio(); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected CRI-O to be queried once, got %d", calls)
+	}
+}
+
+func TestComputeUpdatePlanCAAndPullSecret(t *testing.T) {
+	oldConfig := &mcfgv1.MachineConfig{}
+	newConfig := oldConfig.DeepCopy()
+	newConfig.Spec.Config.Storage.Files = []ignv2_2types.File{
+		newTestFile("/etc/kubernetes/kubelet-ca.crt", "ca"),
+		newTestFile("/var/lib/kubelet/config.json", "{}"),
+	}
+	plan := computeUpdatePlan(oldConfig, newConfig)
+	if plan.reboot {
+		t.Errorf("Expected no reboot")
+	}
+	expected := "None: file /etc/kubernetes/kubelet-ca.crt changed, file /var/lib/kubelet/config.json changed"
+	if plan.String() != expected {
+		t.Errorf("Expected description %q, got %q", expected, plan.String())
+	}
+}
+
+func TestShrunkCABundles(t *testing.T) {
+	cert := "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+	withCA := func(contents string) *mcfgv1.MachineConfig {
+		return &mcfgv1.MachineConfig{
+			Spec: mcfgv1.MachineConfigSpec{
+				Config: ignv2_2types.Config{
+					Storage: ignv2_2types.Storage{Files: []ignv2_2types.File{newTestFile("/etc/kubernetes/kubelet-ca.crt", contents)}},
+				},
+			},
+		}
+	}
+
+	shrunk := shrunkCABundles(withCA(cert+cert), withCA(cert))
+	expected := []string{"/etc/kubernetes/kubelet-ca.crt shrinks from 2 to 1 certificates"}
+	if len(shrunk) != 1 || shrunk[0] != expected[0] {
+		t.Errorf("Expected %v, got %v", expected, shrunk)
+	}
+	// certificates added, or bundles added, aren't a problem
+	if shrunk := shrunkCABundles(withCA(cert), withCA(cert+cert)); len(shrunk) != 0 {
+		t.Errorf("Expected no shrunk bundles, got %v", shrunk)
+	}
+	if shrunk := shrunkCABundles(&mcfgv1.MachineConfig{}, withCA(cert)); len(shrunk) != 0 {
+		t.Errorf("Expected no shrunk bundles, got %v", shrunk)
+	}
+}
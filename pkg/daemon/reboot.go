@@ -0,0 +1,62 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// maxRebootAttempts is the number of times the reboot into a pending config
+// is requested before giving up, when the node keeps coming back in the boot
+// it was requested in
+const maxRebootAttempts = 3
+
+// errRebootNotOccurred is returned when the node still is in the boot the
+// reboot into its pending config was requested in, after maxRebootAttempts.
+var errRebootNotOccurred = errors.New("reboot did not occur")
+
+// recordRebootRetry returns the pending state to reboot again with, when the
+// node still is in the boot the reboot into its pending config was requested
+// in, nil when there is no such pending config. The attempt is counted in the
+// state file, and once maxRebootAttempts were made an error wrapping
+// errRebootNotOccurred is returned instead.
+func (dn *Daemon) recordRebootRetry() (*daemonState, error) {
+	s, err := dn.loadDaemonState()
+	if err != nil {
+		return nil, err
+	}
+	if s.PendingConfig == "" || s.BootID != dn.bootID {
+		return nil, nil
+	}
+	// states written before the attempts were counted made one
+	if s.RebootAttempts == 0 {
+		s.RebootAttempts = 1
+	}
+	if s.RebootAttempts >= maxRebootAttempts {
+		return nil, errors.Wrapf(errRebootNotOccurred, "boot %s is still running after requesting the reboot into %s %d times", dn.bootID, s.PendingConfig, s.RebootAttempts)
+	}
+	s.RebootAttempts++
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomicallyWithDefaults(dn.stateFilePath, b); err != nil {
+		return nil, errors.Wrapf(err, "writing pending state")
+	}
+	return s, nil
+}
+
+// retryPendingReboot requests the reboot into the pending config again when
+// the previous request didn't reboot the node, see recordRebootRetry. It
+// returns false when no reboot is needed; otherwise it only returns on error.
+func (dn *Daemon) retryPendingReboot() (bool, error) {
+	retry, err := dn.recordRebootRetry()
+	if err != nil || retry == nil {
+		return false, err
+	}
+	glog.Warningf("Boot %s is still running after requesting the reboot into %s", dn.bootID, retry.PendingConfig)
+	return true, dn.reboot(fmt.Sprintf("Reboot into config %s did not occur, retrying (attempt %d of %d)", retry.PendingConfig, retry.RebootAttempts, maxRebootAttempts), defaultRebootTimeout, exec.Command(defaultRebootCommand))
+}
@@ -0,0 +1,51 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRecordRebootRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-reboot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dn := &Daemon{
+		bootID:        "boot-1",
+		stateFilePath: filepath.Join(dir, "state.json"),
+	}
+
+	retry, err := dn.recordRebootRetry()
+	require.Nil(t, err)
+	assert.Nil(t, retry, "no pending config, no reboot")
+
+	config := &mcfgv1.MachineConfig{ObjectMeta: metav1.ObjectMeta{Name: "rendered-worker-1"}}
+	require.Nil(t, dn.writePendingState(config))
+	for attempt := 2; attempt <= maxRebootAttempts; attempt++ {
+		retry, err = dn.recordRebootRetry()
+		require.Nil(t, err)
+		require.NotNil(t, retry)
+		assert.Equal(t, "rendered-worker-1", retry.PendingConfig)
+		assert.Equal(t, attempt, retry.RebootAttempts)
+	}
+	_, err = dn.recordRebootRetry()
+	require.NotNil(t, err)
+	assert.Equal(t, errRebootNotOccurred, errors.Cause(err))
+	assert.Equal(t, "boot boot-1 is still running after requesting the reboot into rendered-worker-1 3 times: reboot did not occur", err.Error())
+
+	// the reboot happened after all
+	dn.bootID = "boot-2"
+	retry, err = dn.recordRebootRetry()
+	require.Nil(t, err)
+	assert.Nil(t, retry)
+	pending, err := dn.getPendingConfig()
+	require.Nil(t, err)
+	assert.Equal(t, "rendered-worker-1", pending)
+}
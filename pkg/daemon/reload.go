@@ -0,0 +1,161 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// configReload is how a service rereads the configuration files a policy
+// maps to it, without a unit to reload or restart.
+type configReload struct {
+	// command rereads the configuration
+	command []string
+	// verify checks, once command succeeded, that the configuration of
+	// newConfig was picked up
+	verify func(newConfig *mcfgv1.MachineConfig) error
+	// keepsRemoved is whether what removed files set stays in effect until
+	// a reboot, removing them then takes one
+	keepsRemoved bool
+}
+
+// configReloads are the config reloads of the file policies, by name.
+var configReloads = map[string]configReload{
+	// NetworkManager rereads its configuration, the connections aside
+	"NetworkManager": {command: []string{"nmcli", "general", "reload"}},
+	// sysctl --system applies what the files set, but doesn't reset what
+	// removed files set
+	"sysctl": {command: []string{"sysctl", "--system"}, verify: verifySysctlConfig, keepsRemoved: true},
+}
+
+// runConfigReload runs the config reload name, then its verification if any.
+// It is swapped out by tests.
+var runConfigReload = func(name string, newConfig *mcfgv1.MachineConfig) error {
+	reload := configReloads[name]
+	if _, err := RunGetOut(reload.command[0], reload.command[1:]...); err != nil {
+		return errors.Wrapf(err, "failed to reload %s", name)
+	}
+	if reload.verify != nil {
+		if err := reload.verify(newConfig); err != nil {
+			return errors.Wrapf(err, "%s did not pick up the config", name)
+		}
+	}
+	return nil
+}
+
+// reloadConfigs runs the config reloads of plan, recording the outcome of
+// each in an event.
+func (dn *Daemon) reloadConfigs(newConfig *mcfgv1.MachineConfig, plan *updatePlan) error {
+	for _, name := range sortedSet(plan.configs) {
+		if err := runConfigReload(name, newConfig); err != nil {
+			if dn.recorder != nil && dn.node != nil {
+				dn.recorder.Eventf(getNodeRef(dn.node), corev1.EventTypeWarning, "ConfigReloadFailed", "Update to %s: %v", newConfig.GetName(), err)
+			}
+			return err
+		}
+		if dn.recorder != nil && dn.node != nil {
+			dn.recorder.Eventf(getNodeRef(dn.node), corev1.EventTypeNormal, "ConfigReloaded", "Update to %s: reloaded %s", newConfig.GetName(), name)
+		}
+	}
+	return nil
+}
+
+// procSysDir is where the kernel exposes sysctls, it is swapped out by tests.
+var procSysDir = "/proc/sys"
+
+// verifySysctlConfig checks the sysctls set by the /etc/sysctl.d files of
+// newConfig, as written on disk, have the values they set.
+func verifySysctlConfig(newConfig *mcfgv1.MachineConfig) error {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, f := range newConfig.Spec.Config.Storage.Files {
+		if action, _ := filePolicy(f.Path); action.config == "sysctl" && !seen[f.Path] {
+			seen[f.Path] = true
+			paths = append(paths, f.Path)
+		}
+	}
+	return verifySysctls(paths)
+}
+
+// verifySysctls checks the sysctls set by the files at paths have the values
+// they set. Like sysctl --system, the files are read in the order of their
+// names and the last value of a key wins. Keys with globs, and missing keys
+// whose errors are ignored with a leading "-", aren't checked.
+func verifySysctls(paths []string) error {
+	sorted := append([]string(nil), paths...)
+	sort.Slice(sorted, func(i, j int) bool { return filepath.Base(sorted[i]) < filepath.Base(sorted[j]) })
+	expected := make(map[string]string)
+	setBy := make(map[string]string)
+	optional := make(map[string]bool)
+	var keys []string
+	for _, path := range sorted {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(b))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+				continue
+			}
+			parts := strings.SplitN(line, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			key, value := strings.TrimSpace(parts[0]), strings.Join(strings.Fields(parts[1]), " ")
+			ignoreErrors := strings.HasPrefix(key, "-")
+			key = strings.TrimPrefix(key, "-")
+			if strings.ContainsAny(key, "*?[") {
+				continue
+			}
+			if _, ok := expected[key]; !ok {
+				keys = append(keys, key)
+			}
+			expected[key], setBy[key], optional[key] = value, path, ignoreErrors
+		}
+		if err := scanner.Err(); err != nil {
+			return errors.Wrapf(err, "reading %s", path)
+		}
+	}
+	for _, key := range keys {
+		b, err := ioutil.ReadFile(filepath.Join(procSysDir, sysctlPath(key)))
+		if err != nil {
+			if optional[key] {
+				continue
+			}
+			return errors.Wrapf(err, "reading sysctl %s", key)
+		}
+		if actual := strings.Join(strings.Fields(string(b)), " "); actual != expected[key] {
+			return fmt.Errorf("sysctl %s is %q, expected %q as set by %s", key, actual, expected[key], setBy[key])
+		}
+	}
+	return nil
+}
+
+// sysctlPath returns the path of key under procSysDir. As for sysctl.d, if
+// the first separator of key is a slash it is the path, else dots and
+// slashes are swapped, e.g. net.ipv4.conf.eth0/100.forwarding is
+// net/ipv4/conf/eth0.100/forwarding.
+func sysctlPath(key string) string {
+	if i := strings.IndexAny(key, "./"); i >= 0 && key[i] == '/' {
+		return key
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.':
+			return '/'
+		case '/':
+			return '.'
+		}
+		return r
+	}, key)
+}
@@ -0,0 +1,63 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifySysctls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysctl")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(orig string) { procSysDir = orig }(procSysDir)
+	procSysDir = filepath.Join(dir, "proc")
+
+	setSysctl := func(path, value string) {
+		path = filepath.Join(procSysDir, path)
+		require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.Nil(t, ioutil.WriteFile(path, []byte(value+"\n"), 0644))
+	}
+	writeConf := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		require.Nil(t, ioutil.WriteFile(path, []byte(contents), 0644))
+		return path
+	}
+	setSysctl("fs/inotify/max_user_watches", "65536")
+	setSysctl("net/ipv4/tcp_rmem", "4096\t87380\t6291456")
+	setSysctl("net/ipv4/conf/eth0.100/forwarding", "1")
+	paths := []string{
+		writeConf("99-override.conf", "fs.inotify.max_user_watches = 65536\n"),
+		writeConf("10-tuning.conf", `# comment
+; comment too
+fs.inotify.max_user_watches = 8192
+net.ipv4.tcp_rmem = 4096 87380 6291456
+net.ipv4.conf.eth0/100.forwarding=1
+-net.ipv4.missing = 1
+net.ipv4.conf.*.rp_filter = 2
+`),
+	}
+	assert.Nil(t, verifySysctls(paths), "the files are applied in the order of their names")
+
+	setSysctl("net/ipv4/tcp_rmem", "4096 87380 4194304")
+	err = verifySysctls(paths)
+	require.NotNil(t, err)
+	assert.Equal(t, `sysctl net.ipv4.tcp_rmem is "4096 87380 4194304", expected "4096 87380 6291456" as set by `+paths[1], err.Error())
+
+	paths = append(paths, writeConf("50-missing.conf", "kernel.missing = 1\n"))
+	assert.NotNil(t, verifySysctls(paths[2:]), "missing keys fail unless their errors are ignored")
+}
+
+func TestSysctlPath(t *testing.T) {
+	for key, expected := range map[string]string{
+		"fs.inotify.max_user_watches":       "fs/inotify/max_user_watches",
+		"net.ipv4.conf.eth0/100.forwarding": "net/ipv4/conf/eth0.100/forwarding",
+		"net/ipv4/conf/eth0.100/forwarding": "net/ipv4/conf/eth0.100/forwarding",
+	} {
+		assert.Equal(t, expected, sysctlPath(key), key)
+	}
+}
@@ -0,0 +1,305 @@
+package daemon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/golang/glog"
+	configv1 "github.com/openshift/api/config/v1"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// maxRemoteSourceSize caps the size of the remote contents of a file
+	maxRemoteSourceSize = 32 << 20
+	// remoteSourceFetchTimeout bounds each attempt at fetching the remote
+	// contents of a file
+	remoteSourceFetchTimeout = 2 * time.Minute
+)
+
+// remoteSourcesDir caches the remote contents of files by verification hash,
+// so that retries and reboots don't download unchanged contents again, it is
+// swapped out by tests.
+var remoteSourcesDir = "/etc/machine-config-daemon/remote-sources"
+
+// remoteSourceBackoff is how fetching remote contents is retried on network
+// errors and on the HTTP statuses of transient failures, it is swapped out by
+// tests.
+var remoteSourceBackoff = wait.Backoff{Steps: 5, Duration: 2 * time.Second, Factor: 2, Jitter: 0.1}
+
+// isRemoteSource returns whether the contents of f are fetched over HTTP,
+// rather than embedded in the config as a data URL.
+func isRemoteSource(f ignv2_2types.File) bool {
+	u, err := url.Parse(f.Contents.Source)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// redactSource returns source without the credentials it may carry, for
+// logs and errors.
+func redactSource(source string) string {
+	u, err := url.Parse(source)
+	if err != nil || u.User == nil {
+		return source
+	}
+	u.User = nil
+	return u.String()
+}
+
+// remoteSourcePath returns the path f's remote contents are cached at.
+func remoteSourcePath(f ignv2_2types.File) (string, error) {
+	function, sum, err := ctrlcommon.ParseFileHash(f.Contents.Verification)
+	if err != nil {
+		return "", errors.Wrapf(err, "verifying %s", f.Path)
+	}
+	return filepath.Join(remoteSourcesDir, function+"-"+sum), nil
+}
+
+// cachedRemoteSource returns the decompressed remote contents of f cached by
+// fetchRemoteSources, dropping them if they don't match the verification
+// hash anymore.
+func cachedRemoteSource(f ignv2_2types.File) ([]byte, error) {
+	path, err := remoteSourcePath(f)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := decompressFileContents(f, raw)
+	if err == nil {
+		err = verifyFileHash(f.Path, f.Contents.Verification, contents)
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return contents, nil
+}
+
+// fetchRemoteSources downloads the remote contents of files not cached yet,
+// checks them against their verification hash and caches them, before
+// anything is written.
+func (dn *Daemon) fetchRemoteSources(files []ignv2_2types.File) error {
+	var client *http.Client
+	for _, f := range files {
+		if !isRemoteSource(f) {
+			continue
+		}
+		if _, err := cachedRemoteSource(f); err == nil {
+			glog.V(2).Infof("Remote contents of %s already fetched", f.Path)
+			continue
+		}
+		if client == nil {
+			var err error
+			if client, err = dn.remoteSourceClient(); err != nil {
+				return err
+			}
+		}
+		glog.Infof("Fetching the contents of %s from %s", f.Path, redactSource(f.Contents.Source))
+		raw, err := fetchRemoteSource(client, f.Contents.Source)
+		if err != nil {
+			return err
+		}
+		contents, err := decompressFileContents(f, raw)
+		if err != nil {
+			return errors.Wrapf(err, "fetching %s", redactSource(f.Contents.Source))
+		}
+		if err := verifyFileHash(f.Path, f.Contents.Verification, contents); err != nil {
+			return errors.Wrapf(err, "fetching %s", redactSource(f.Contents.Source))
+		}
+		path, err := remoteSourcePath(f)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomically(path, raw, 0700, 0600, -1, -1); err != nil {
+			return errors.Wrapf(err, "caching the contents of %s", f.Path)
+		}
+	}
+	return nil
+}
+
+// pruneRemoteSources drops the cached remote contents none of the files of
+// configs refer to.
+func pruneRemoteSources(configs ...*mcfgv1.MachineConfig) {
+	entries, err := ioutil.ReadDir(remoteSourcesDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Warningf("Unable to prune the cached remote contents: %v", err)
+		}
+		return
+	}
+	referenced := make(map[string]bool)
+	for _, config := range configs {
+		for _, f := range config.Spec.Config.Storage.Files {
+			if !isRemoteSource(f) {
+				continue
+			}
+			if path, err := remoteSourcePath(f); err == nil {
+				referenced[path] = true
+			}
+		}
+	}
+	for _, entry := range entries {
+		path := filepath.Join(remoteSourcesDir, entry.Name())
+		if referenced[path] {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			glog.Warningf("Unable to prune the cached remote contents %s: %v", path, err)
+		}
+	}
+}
+
+// fetchRemoteSource downloads source, retrying with remoteSourceBackoff.
+// Errors name source and the HTTP status of the last attempt.
+func fetchRemoteSource(client *http.Client, source string) ([]byte, error) {
+	var (
+		contents []byte
+		lastErr  error
+	)
+	err := wait.ExponentialBackoff(remoteSourceBackoff, func() (bool, error) {
+		var retry bool
+		contents, retry, lastErr = fetchRemoteSourceOnce(client, source)
+		if lastErr != nil && retry {
+			glog.Warningf("%v, retrying", lastErr)
+			return false, nil
+		}
+		return true, lastErr
+	})
+	if err == wait.ErrWaitTimeout {
+		return nil, lastErr
+	}
+	return contents, err
+}
+
+// fetchRemoteSourceOnce downloads source, returning whether a failure may be
+// transient.
+func fetchRemoteSourceOnce(client *http.Client, source string) ([]byte, bool, error) {
+	resp, err := client.Get(source)
+	if err != nil {
+		// the error of the client quotes the URL
+		return nil, true, fmt.Errorf("failed to fetch %s: %v", redactSource(source), strings.Replace(err.Error(), source, redactSource(source), -1))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		retry := resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retry, fmt.Errorf("failed to fetch %s: HTTP %s", redactSource(source), resp.Status)
+	}
+	if resp.ContentLength > maxRemoteSourceSize {
+		return nil, false, fmt.Errorf("failed to fetch %s: %d bytes, more than the maximum of %d", redactSource(source), resp.ContentLength, maxRemoteSourceSize)
+	}
+	contents, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRemoteSourceSize+1))
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to fetch %s: %v", redactSource(source), err)
+	}
+	if len(contents) > maxRemoteSourceSize {
+		return nil, false, fmt.Errorf("failed to fetch %s: more than the maximum of %d bytes", redactSource(source), maxRemoteSourceSize)
+	}
+	return contents, false, nil
+}
+
+// remoteSourceClient returns the client fetching remote contents. It goes
+// through the cluster-wide proxy and trusts the additional trust bundle of the
+// ControllerConfig on top of the system CAs; without a cluster, as in
+// once-from mode, through the proxy of the environment.
+func (dn *Daemon) remoteSourceClient() (*http.Client, error) {
+	var spec mcfgv1.ControllerConfigSpec
+	if dn.mcClient != nil {
+		cc, err := dn.mcClient.MachineconfigurationV1().ControllerConfigs().Get(ctrlcommon.ControllerConfigName, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, errors.Wrapf(err, "getting the proxy and trust bundle for remote contents")
+		}
+		if err == nil {
+			spec = cc.Spec
+		}
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+	}
+	if spec.Proxy != nil {
+		transport.Proxy = proxyFunc(*spec.Proxy)
+	}
+	if len(spec.AdditionalTrustBundle) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(spec.AdditionalTrustBundle) {
+			return nil, errors.New("no certificates found in the additional trust bundle")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport, Timeout: remoteSourceFetchTimeout}, nil
+}
+
+// proxyFunc returns the proxy of requests per proxy, like
+// http.ProxyFromEnvironment does per the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// variables.
+func proxyFunc(proxy configv1.ProxySpec) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		raw := proxy.HTTPProxy
+		if req.URL.Scheme == "https" {
+			raw = proxy.HTTPSProxy
+		}
+		if raw == "" || noProxy(proxy.NoProxy, req.URL.Hostname()) {
+			return nil, nil
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			// like the variables, proxies may be given without scheme
+			if u, err = url.Parse("http://" + raw); err != nil {
+				return nil, fmt.Errorf("invalid proxy address %q: %v", raw, err)
+			}
+		}
+		return u, nil
+	}
+}
+
+// noProxy returns whether host is excluded from proxying by the
+// comma-separated entries of noProxy: "*", domains, matching their
+// subdomains too, IPs and CIDRs.
+func noProxy(noProxy, host string) bool {
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		switch {
+		case entry == "":
+		case entry == "*":
+			return true
+		case ip != nil:
+			if _, cidr, err := net.ParseCIDR(entry); err == nil && cidr.Contains(ip) {
+				return true
+			}
+			if ip.Equal(net.ParseIP(entry)) {
+				return true
+			}
+		default:
+			entry = strings.TrimPrefix(entry, ".")
+			host = strings.ToLower(host)
+			if host == entry || strings.HasSuffix(host, "."+entry) {
+				return true
+			}
+		}
+	}
+	return false
+}
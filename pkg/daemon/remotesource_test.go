@@ -0,0 +1,179 @@
+package daemon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	configv1 "github.com/openshift/api/config/v1"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
+	"github.com/openshift/machine-config-operator/pkg/generated/clientset/versioned/fake"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func newTestRemoteFile(path, source, contents string) ignv2_2types.File {
+	sum := sha256.Sum256([]byte(contents))
+	f := withFileHash(newTestFile(path, ""), "sha256-"+hex.EncodeToString(sum[:]))
+	f.Contents.Source = source
+	return f
+}
+
+// useTestRemoteSources points the cache of remote contents to a temporary
+// directory and makes retries immediate, the returned func restores both.
+func useTestRemoteSources(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "remotesource")
+	require.Nil(t, err)
+	origDir, origBackoff := remoteSourcesDir, remoteSourceBackoff
+	remoteSourcesDir = filepath.Join(dir, "remote-sources")
+	remoteSourceBackoff = wait.Backoff{Steps: 3, Duration: time.Millisecond, Factor: 1}
+	return dir, func() {
+		remoteSourcesDir, remoteSourceBackoff = origDir, origBackoff
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFetchRemoteSources(t *testing.T) {
+	dir, restore := useTestRemoteSources(t)
+	defer restore()
+
+	requests := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("remote contents"))
+	}))
+	defer srv.Close()
+
+	// the server is only trusted through the additional trust bundle
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	dn := &Daemon{
+		mcClient: fake.NewSimpleClientset(&mcfgv1.ControllerConfig{
+			ObjectMeta: metav1.ObjectMeta{Name: ctrlcommon.ControllerConfigName},
+			Spec:       mcfgv1.ControllerConfigSpec{AdditionalTrustBundle: bundle},
+		}),
+		ownedFilesPath:   filepath.Join(dir, "owned-files.json"),
+		originalFilesDir: filepath.Join(dir, "orig"),
+	}
+	path := filepath.Join(dir, "etc/foo.conf")
+	files := []ignv2_2types.File{newTestRemoteFile(path, srv.URL+"/foo.conf", "remote contents")}
+
+	_, err := decodeFileContents(files[0])
+	assert.NotNil(t, err, "remote contents are only written once fetched")
+
+	require.Nil(t, dn.fetchRemoteSources(files))
+	assert.Equal(t, 2, requests, "transient failures are retried")
+	require.Nil(t, dn.writeFiles(files))
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "remote contents", string(b))
+	assert.Empty(t, checkFiles(files))
+
+	require.Nil(t, dn.fetchRemoteSources(files))
+	assert.Equal(t, 2, requests, "cached contents aren't fetched again")
+
+	pruneRemoteSources(newTestMachineConfig("new", files, nil))
+	_, err = cachedRemoteSource(files[0])
+	assert.Nil(t, err, "contents referenced by the configs are kept")
+	pruneRemoteSources(newTestMachineConfig("other", nil, nil))
+	_, err = cachedRemoteSource(files[0])
+	assert.NotNil(t, err, "contents nothing refers to are pruned")
+}
+
+func TestFetchRemoteSourceErrors(t *testing.T) {
+	_, restore := useTestRemoteSources(t)
+	defer restore()
+
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/large":
+			w.Write(make([]byte, maxRemoteSourceSize+1))
+		default:
+			w.Write([]byte("unexpected contents"))
+		}
+	}))
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.Nil(t, err)
+	dn := &Daemon{}
+
+	err = dn.fetchRemoteSources([]ignv2_2types.File{newTestRemoteFile("/etc/foo", "http://user:secret@"+u.Host+"/missing", "contents")})
+	require.NotNil(t, err)
+	assert.Equal(t, "failed to fetch "+srv.URL+"/missing: HTTP 404 Not Found", err.Error())
+	assert.Equal(t, 1, requests, "client errors aren't retried")
+
+	err = dn.fetchRemoteSources([]ignv2_2types.File{newTestRemoteFile("/etc/foo", srv.URL+"/large", "contents")})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "more than the maximum of")
+
+	err = dn.fetchRemoteSources([]ignv2_2types.File{newTestRemoteFile("/etc/foo", srv.URL+"/foo", "contents")})
+	require.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "fetching "+srv.URL+"/foo: hash mismatch for /etc/foo"), err.Error())
+	_, err = os.Stat(remoteSourcesDir)
+	assert.True(t, os.IsNotExist(err), "mismatching contents aren't cached")
+}
+
+func TestReconcilableRemoteSources(t *testing.T) {
+	d := Daemon{}
+	oldConfig := newTestMachineConfig("old", nil, nil)
+
+	newConfig := newTestMachineConfig("new", []ignv2_2types.File{newTestRemoteFile("/etc/foo", "https://example.com/foo", "contents")}, nil)
+	assert.Nil(t, d.reconcilable(oldConfig, newConfig), "remote contents with a hash are reconcilable")
+
+	unverified := newTestFile("/etc/foo", "")
+	unverified.Contents.Source = "https://example.com/foo"
+	tftp := newTestRemoteFile("/etc/bar", "tftp://example.com/bar", "contents")
+	newConfig = newTestMachineConfig("new", []ignv2_2types.File{unverified, tftp}, nil)
+	err := d.reconcilable(oldConfig, newConfig)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "spec.config.storage.files[0].contents.verification.hash (required for remote contents)")
+	assert.Contains(t, err.Error(), `spec.config.storage.files[1].contents.source (unsupported scheme "tftp", expected data, http or https)`)
+}
+
+func TestProxyFunc(t *testing.T) {
+	proxy := proxyFunc(configv1.ProxySpec{
+		HTTPProxy:  "http://proxy:3128",
+		HTTPSProxy: "proxy:3129",
+		NoProxy:    "internal.example.com, .svc,10.0.0.0/16,192.168.1.1",
+	})
+	for source, expected := range map[string]string{
+		"http://example.com/foo":               "http://proxy:3128",
+		"https://example.com/foo":              "http://proxy:3129",
+		"https://internal.example.com/foo":     "",
+		"https://mirror.internal.example.com/": "",
+		"http://foo.ns.svc:8080/foo":           "",
+		"http://10.0.3.4/foo":                  "",
+		"http://10.1.3.4/foo":                  "http://proxy:3128",
+		"http://192.168.1.1/foo":               "",
+	} {
+		req, err := http.NewRequest("GET", source, nil)
+		require.Nil(t, err)
+		u, err := proxy(req)
+		require.Nil(t, err)
+		if expected == "" {
+			assert.Nil(t, u, source)
+		} else if assert.NotNil(t, u, source) {
+			assert.Equal(t, expected, u.String(), source)
+		}
+	}
+}
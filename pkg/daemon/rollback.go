@@ -0,0 +1,171 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/golang/glog"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// rollbackAnnotationKey asks a running daemon to roll the node back to
+	// the config applied before the current one, when set to "true"
+	rollbackAnnotationKey = "machineconfiguration.openshift.io/rollback"
+	// previousConfigPath is where the config applied before the current one
+	// is kept, for rollbacks
+	previousConfigPath = "/var/machine-config-daemon/previousconfig"
+	// pathRollbackState is where the rollback made, if any, is recorded
+	pathRollbackState = "/etc/machine-config-daemon/rollback.json"
+)
+
+// errRolledBack is returned when the desired config is the one the node was
+// rolled back from: applying it again would undo the rollback.
+var errRolledBack = errors.New("node was rolled back from its desired config")
+
+// errNoRollback is returned when a rollback is requested without a config to
+// roll back to.
+var errNoRollback = errors.New("cannot roll back")
+
+// rollbackState records a rollback, so that the config rolled back from isn't
+// applied again until the desired config moves on.
+type rollbackState struct {
+	// From is the config rolled back from, and To the previous config
+	// rolled back to.
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// rollbackRequested returns whether the rollback annotation is set on node.
+func rollbackRequested(node *corev1.Node) bool {
+	if node == nil {
+		return false
+	}
+	return node.Annotations[rollbackAnnotationKey] == "true"
+}
+
+// loadConfigFile reads the config stored at path, nil if there is none.
+func loadConfigFile(path string) (*mcfgv1.MachineConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", path)
+	}
+	var config mcfgv1.MachineConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", path)
+	}
+	return &config, nil
+}
+
+// storeConfig writes config at currentPath. The config found there before, if
+// it is another one, is moved to previousPath first, so that it can be rolled
+// back to.
+func storeConfig(currentPath, previousPath string, config *mcfgv1.MachineConfig) error {
+	current, err := loadConfigFile(currentPath)
+	if err != nil {
+		return err
+	}
+	if current != nil && current.GetName() != config.GetName() {
+		if err := os.Rename(currentPath, previousPath); err != nil {
+			return errors.Wrapf(err, "keeping previous config %s", current.GetName())
+		}
+	}
+	mcJSON, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomicallyWithDefaults(currentPath, mcJSON)
+}
+
+// storeCurrentConfig records config as the one applied on disk, keeping the
+// one applied before.
+func (dn *Daemon) storeCurrentConfig(config *mcfgv1.MachineConfig) error {
+	return storeConfig(currentConfigPath, previousConfigPath, config)
+}
+
+func loadRollbackState(path string) (*rollbackState, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading rollback state")
+	}
+	var state rollbackState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, errors.Wrapf(err, "parsing rollback state %s", path)
+	}
+	return &state, nil
+}
+
+// checkRolledBack returns errRolledBack if the node was rolled back from
+// desiredConfig. Once the desired config is another one, the rollback is
+// forgotten and updates go on as usual.
+func checkRolledBack(path string, desiredConfig *mcfgv1.MachineConfig) error {
+	state, err := loadRollbackState(path)
+	if err != nil || state == nil {
+		return err
+	}
+	if state.From == desiredConfig.GetName() {
+		return errors.Wrapf(errRolledBack, "rolled back from %s to %s, waiting for a new desired config", state.From, state.To)
+	}
+	glog.Infof("Desired config is now %s, forgetting the rollback from %s", desiredConfig.GetName(), state.From)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "removing rollback state")
+	}
+	return nil
+}
+
+// rollback re-applies the config applied before the current one, through the
+// regular update: files, units, SSH keys, kernel arguments, OS image and all.
+// The trigger annotation is removed first, so that a failing rollback isn't
+// retried. Only the previous config can be rolled back to.
+func (dn *Daemon) rollback() error {
+	ctx, cancel := nodeWriterContext()
+	defer cancel()
+	if err := dn.nodeWriter.RemoveAnnotations(ctx, []string{rollbackAnnotationKey}); err != nil {
+		return err
+	}
+
+	state, err := loadRollbackState(pathRollbackState)
+	if err != nil {
+		return err
+	}
+	if state != nil {
+		return errors.Wrapf(errNoRollback, "already rolled back from %s to %s, only the previous config can be rolled back to", state.From, state.To)
+	}
+	currentConfig, err := loadConfigFile(currentConfigPath)
+	if err != nil {
+		return err
+	}
+	previousConfig, err := loadConfigFile(previousConfigPath)
+	if err != nil {
+		return err
+	}
+	if currentConfig == nil || previousConfig == nil {
+		return errors.Wrapf(errNoRollback, "no previous config to roll back to")
+	}
+
+	b, err := json.Marshal(&rollbackState{From: currentConfig.GetName(), To: previousConfig.GetName()})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomicallyWithDefaults(pathRollbackState, b); err != nil {
+		return err
+	}
+	dn.logSystem("Rolling back from %s to the previous config %s", currentConfig.GetName(), previousConfig.GetName())
+	if err := dn.update(currentConfig, previousConfig); err != nil {
+		// the node is still in the config rolled back from
+		if err := os.Remove(pathRollbackState); err != nil && !os.IsNotExist(err) {
+			glog.Warningf("Failed to remove rollback state: %v", err)
+		}
+		return errors.Wrapf(err, "rolling back to %s", previousConfig.GetName())
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package daemon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStoreConfigKeepsPrevious(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-rollback")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	currentPath := filepath.Join(dir, "currentconfig")
+	previousPath := filepath.Join(dir, "previousconfig")
+
+	loadNames := func() (string, string) {
+		current, err := loadConfigFile(currentPath)
+		require.Nil(t, err)
+		previous, err := loadConfigFile(previousPath)
+		require.Nil(t, err)
+		var currentName, previousName string
+		if current != nil {
+			currentName = current.GetName()
+		}
+		if previous != nil {
+			previousName = previous.GetName()
+		}
+		return currentName, previousName
+	}
+
+	require.Nil(t, storeConfig(currentPath, previousPath, newTestMachineConfig("a", nil, nil)))
+	current, previous := loadNames()
+	assert.Equal(t, "a", current)
+	assert.Equal(t, "", previous)
+
+	// restarting in the same config keeps the previous one
+	require.Nil(t, storeConfig(currentPath, previousPath, newTestMachineConfig("a", nil, nil)))
+	current, previous = loadNames()
+	assert.Equal(t, "a", current)
+	assert.Equal(t, "", previous)
+
+	require.Nil(t, storeConfig(currentPath, previousPath, newTestMachineConfig("b", nil, nil)))
+	current, previous = loadNames()
+	assert.Equal(t, "b", current)
+	assert.Equal(t, "a", previous)
+
+	// only one generation is kept
+	require.Nil(t, storeConfig(currentPath, previousPath, newTestMachineConfig("c", nil, nil)))
+	current, previous = loadNames()
+	assert.Equal(t, "c", current)
+	assert.Equal(t, "b", previous)
+}
+
+func TestCheckRolledBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-rollback")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rollback.json")
+
+	// no rollback made
+	assert.Nil(t, checkRolledBack(path, newTestMachineConfig("bad", nil, nil)))
+
+	b, err := json.Marshal(&rollbackState{From: "bad", To: "good"})
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(path, b, 0644))
+
+	// the config rolled back from isn't applied again
+	err = checkRolledBack(path, newTestMachineConfig("bad", nil, nil))
+	assert.Equal(t, errRolledBack, errors.Cause(err))
+	assert.True(t, isPermanentError(errors.Cause(err)))
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+
+	// a new desired config is
+	assert.Nil(t, checkRolledBack(path, newTestMachineConfig("fixed", nil, nil)))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "rollback state was not removed")
+}
+
+func TestRollbackRequested(t *testing.T) {
+	assert.False(t, rollbackRequested(nil))
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+	assert.False(t, rollbackRequested(node))
+	node.Annotations[rollbackAnnotationKey] = "false"
+	assert.False(t, rollbackRequested(node))
+	node.Annotations[rollbackAnnotationKey] = "true"
+	assert.True(t, rollbackRequested(node))
+}
@@ -6,21 +6,37 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
-	"time"
 
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
-
-	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
 )
 
 const (
 	pivotUnit      = "pivot.service"
 	rpmostreedUnit = "rpm-ostreed.service"
+
+	// pathExtensions is where the extensions repo of the OS image is
+	// extracted to while installing extensions
+	pathExtensions = "/run/mco-extensions"
+	// pathExtensionsRepo makes the extracted extensions repo available to
+	// rpm-ostree
+	pathExtensionsRepo = "/etc/yum.repos.d/coreos-extensions.repo"
+	// pathPullSecret authenticates pulling the OS image
+	pathPullSecret = "/var/lib/kubelet/config.json"
 )
 
+var (
+	// defaultKernelPackages are the kernel packages of the OS image, which
+	// are overridden by realtimeKernelPackages to boot the realtime kernel
+	defaultKernelPackages  = []string{"kernel", "kernel-core", "kernel-modules", "kernel-modules-extra"}
+	realtimeKernelPackages = []string{"kernel-rt-core", "kernel-rt-modules", "kernel-rt-modules-extra"}
+)
+
+// errRealtimeKernelUnavailable is returned when the realtime kernel packages
+// can't be found to switch to them.
+var errRealtimeKernelUnavailable = errors.New("realtime kernel packages unavailable")
+
 // RpmOstreeState houses zero or more RpmOstreeDeployments
 // Subset of `rpm-ostree status --json`
 // https://github.com/projectatomic/rpm-ostree/blob/bce966a9812df141d38e3290f845171ec745aa4e/src/daemon/rpmostreed-deployment-utils.c#L227
@@ -46,7 +62,12 @@ type RpmOstreeDeployment struct {
 type NodeUpdaterClient interface {
 	GetStatus() (string, error)
 	GetBootedOSImageURL(string) (string, string, error)
-	RunPivot(string) error
+	GetBootedDeployment(string) (*RpmOstreeDeployment, error)
+	RunPivot(osImageURL string, progress func(string)) error
+	UpdateKernelArguments(added, removed []string) error
+	SwitchKernel(realtime bool) error
+	UpdateExtensions(osImageURL string, install, uninstall []string) error
+	CleanupPendingDeployment() error
 }
 
 // RpmOstreeClient provides all RpmOstree related methods in one structure.
@@ -58,8 +79,8 @@ func NewNodeUpdaterClient() NodeUpdaterClient {
 	return &RpmOstreeClient{}
 }
 
-// getBootedDeployment returns the current deployment found
-func (r *RpmOstreeClient) getBootedDeployment(rootMount string) (*RpmOstreeDeployment, error) {
+// GetBootedDeployment returns the current deployment found
+func (r *RpmOstreeClient) GetBootedDeployment(rootMount string) (*RpmOstreeDeployment, error) {
 	var rosState RpmOstreeState
 	output, err := RunGetOut("chroot", rootMount, "rpm-ostree", "status", "--json")
 	if err != nil {
@@ -91,58 +112,136 @@ func (r *RpmOstreeClient) GetStatus() (string, error) {
 
 // GetBootedOSImageURL returns the image URL as well as the OSTree version (for logging)
 func (r *RpmOstreeClient) GetBootedOSImageURL(rootMount string) (string, string, error) {
-	bootedDeployment, err := r.getBootedDeployment(rootMount)
+	bootedDeployment, err := r.GetBootedDeployment(rootMount)
 	if err != nil {
 		return "", "", err
 	}
 
-	// the canonical image URL is stored in the custom origin field by the pivot tool
-	osImageURL := "<not pivoted>"
-	if len(bootedDeployment.CustomOrigin) > 0 {
-		if strings.HasPrefix(bootedDeployment.CustomOrigin[0], "pivot://") {
-			osImageURL = bootedDeployment.CustomOrigin[0][len("pivot://"):]
-		}
+	osImageURL := deploymentOSImageURL(*bootedDeployment)
+	if osImageURL == "" {
+		osImageURL = "<not pivoted>"
 	}
 
 	return osImageURL, bootedDeployment.Version, nil
 }
 
-// RunPivot executes a pivot from one deployment to another as found in the referenced
-// osImageURL. See https://github.com/openshift/pivot.
-func (r *RpmOstreeClient) RunPivot(osImageURL string) error {
-	if err := os.MkdirAll(filepath.Dir(constants.EtcPivotFile), os.FileMode(0755)); err != nil {
-		return fmt.Errorf("error creating leading dirs for %s: %v", constants.EtcPivotFile, err)
+// deploymentOSImageURL returns the URL of the OS image deployment was
+// rebased onto, empty if it wasn't. The canonical image URL is stored in the
+// custom origin field when rebasing.
+func deploymentOSImageURL(deployment RpmOstreeDeployment) string {
+	if len(deployment.CustomOrigin) == 0 || !strings.HasPrefix(deployment.CustomOrigin[0], pivotOriginPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(deployment.CustomOrigin[0], pivotOriginPrefix)
+}
+
+// UpdateKernelArguments deletes removed from and appends added to the kernel
+// arguments of the deployment booted next.
+func (r *RpmOstreeClient) UpdateKernelArguments(added, removed []string) error {
+	args := []string{"kargs"}
+	for _, karg := range removed {
+		args = append(args, "--delete="+karg)
 	}
+	for _, karg := range added {
+		args = append(args, "--append="+karg)
+	}
+	if _, err := RunGetOut("rpm-ostree", args...); err != nil {
+		return errors.Wrapf(err, "failed to run rpm-ostree %s", strings.Join(args, " "))
+	}
+	return nil
+}
 
-	if err := ioutil.WriteFile(constants.EtcPivotFile, []byte(osImageURL), 0644); err != nil {
-		return fmt.Errorf("error writing to %s: %v", constants.EtcPivotFile, err)
+// CleanupPendingDeployment discards the deployment staged to boot next, and
+// with it the OS image, kernel arguments, kernel and packages changed for it.
+func (r *RpmOstreeClient) CleanupPendingDeployment() error {
+	if _, err := RunGetOut("rpm-ostree", "cleanup", "--pending"); err != nil {
+		return errors.Wrapf(err, "failed to run rpm-ostree cleanup --pending")
 	}
+	return nil
+}
 
-	journalStopCh := make(chan time.Time)
-	defer close(journalStopCh)
-	go followPivotJournalLogs(journalStopCh)
+// SwitchKernel replaces the kernel packages of the OS image with the realtime
+// ones in the deployment booted next, or removes the replacement. When the
+// realtime packages can't be found, the error wraps
+// errRealtimeKernelUnavailable.
+func (r *RpmOstreeClient) SwitchKernel(realtime bool) error {
+	args := []string{"override"}
+	if realtime {
+		args = append(args, "remove")
+		args = append(args, defaultKernelPackages...)
+		for _, pkg := range realtimeKernelPackages {
+			args = append(args, "--install", pkg)
+		}
+	} else {
+		args = append(args, "reset")
+		args = append(args, defaultKernelPackages...)
+		for _, pkg := range realtimeKernelPackages {
+			args = append(args, "--uninstall", pkg)
+		}
+	}
 
-	err := exec.Command("systemctl", "start", "pivot.service").Run()
+	glog.Infof("Running rpm-ostree %s", strings.Join(args, " "))
+	out, err := exec.Command("rpm-ostree", args...).CombinedOutput()
 	if err != nil {
-		return errors.Wrapf(err, "failed to start pivot.service")
+		if realtime && strings.Contains(string(out), "Packages not found") {
+			return errors.Wrapf(errRealtimeKernelUnavailable, "the OS image doesn't carry the realtime kernel packages %s: %s",
+				strings.Join(realtimeKernelPackages, ", "), strings.TrimSpace(string(out)))
+		}
+		return fmt.Errorf("failed to run rpm-ostree %s: %s: %v", strings.Join(args, " "), strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// UpdateExtensions installs and uninstalls packages in a single transaction
+// applied to the deployment booted next. The packages installed come from the
+// extensions repo of the OS image osImageURL.
+func (r *RpmOstreeClient) UpdateExtensions(osImageURL string, install, uninstall []string) error {
+	if len(install) > 0 {
+		cleanup, err := setupExtensionsRepo(osImageURL)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+	}
+
+	args := []string{"update"}
+	for _, pkg := range install {
+		args = append(args, "--install", pkg)
+	}
+	for _, pkg := range uninstall {
+		args = append(args, "--uninstall", pkg)
+	}
+	glog.Infof("Running rpm-ostree %s", strings.Join(args, " "))
+	if out, err := exec.Command("rpm-ostree", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to run rpm-ostree %s: %s: %v", strings.Join(args, " "), strings.TrimSpace(string(out)), err)
 	}
 	return nil
 }
 
-// Proxy pivot and rpm-ostree daemon journal logs until told to stop. Warns if
-// we encounter an error.
-func followPivotJournalLogs(stopCh <-chan time.Time) {
-	cmd := exec.Command("journalctl", "-f", "-b", "-o", "cat",
-		"-u", "rpm-ostreed",
-		"-u", "pivot")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Start(); err != nil {
-		glog.Fatal(err)
-	}
-
-	go func() {
-		<- stopCh
-		cmd.Process.Kill()
-	}()
+// setupExtensionsRepo extracts the extensions repo of the OS image osImageURL
+// and configures it for rpm-ostree. The returned function removes it again.
+func setupExtensionsRepo(osImageURL string) (func(), error) {
+	if err := os.RemoveAll(pathExtensions); err != nil {
+		return nil, errors.Wrapf(err, "removing %s", pathExtensions)
+	}
+	if err := pullImage(osImageURL); err != nil {
+		return nil, err
+	}
+	if err := extractFromImage(osImageURL, "/extensions", pathExtensions); err != nil {
+		return nil, errors.Wrapf(err, "failed to extract the extensions repo of %s", osImageURL)
+	}
+
+	repo := fmt.Sprintf("[coreos-extensions]\nname=Extensions of the OS image\nbaseurl=file://%s\nenabled=1\ngpgcheck=0\n", pathExtensions)
+	if err := ioutil.WriteFile(pathExtensionsRepo, []byte(repo), 0644); err != nil {
+		os.RemoveAll(pathExtensions)
+		return nil, errors.Wrapf(err, "writing %s", pathExtensionsRepo)
+	}
+	return func() {
+		if err := os.Remove(pathExtensionsRepo); err != nil {
+			glog.Warningf("Unable to remove %s: %v", pathExtensionsRepo, err)
+		}
+		if err := os.RemoveAll(pathExtensions); err != nil {
+			glog.Warningf("Unable to remove %s: %v", pathExtensions, err)
+		}
+	}, nil
 }
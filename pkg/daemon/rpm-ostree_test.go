@@ -1,5 +1,7 @@
 package daemon
 
+import "fmt"
+
 /*
  * This file contains test code for the rpm-ostree client. It is meant to be used when
  * testing the daemon and mocking the responses that would normally be executed by the
@@ -17,8 +19,13 @@ type GetBootedOSImageURLReturn struct {
 // RpmOstreeClientMock is a testing implementation of NodeUpdaterClient. Fields presented here
 // hold return values that will be returned when their corresponding methods are called.
 type RpmOstreeClientMock struct {
-	GetBootedOSImageURLReturns []GetBootedOSImageURLReturn
-	RunPivotReturns            []error
+	GetBootedOSImageURLReturns      []GetBootedOSImageURLReturn
+	GetBootedDeploymentReturns      *RpmOstreeDeployment
+	RunPivotReturns                 []error
+	UpdateKernelArgumentsReturns    error
+	SwitchKernelReturns             error
+	UpdateExtensionsReturns         error
+	CleanupPendingDeploymentReturns error
 }
 
 // GetBootedOSImageURL implements a test version of RpmOStreeClients GetBootedOSImageURL.
@@ -31,9 +38,19 @@ func (r RpmOstreeClientMock) GetBootedOSImageURL(string) (string, string, error)
 	return returnValues.OsImageURL, returnValues.Version, returnValues.Error
 }
 
+// GetBootedDeployment implements a test version of RpmOstreeClients
+// GetBootedDeployment. It returns GetBootedDeploymentReturns, or an error if
+// that is nil.
+func (r RpmOstreeClientMock) GetBootedDeployment(string) (*RpmOstreeDeployment, error) {
+	if r.GetBootedDeploymentReturns == nil {
+		return nil, fmt.Errorf("not currently booted in a deployment")
+	}
+	return r.GetBootedDeploymentReturns, nil
+}
+
 // RunPivot implements a test version of RpmOstreeClients RunPivot. It returns errors as defined
 // in the instances RunPivotReturns field in order.
-func (r RpmOstreeClientMock) RunPivot(string) error {
+func (r RpmOstreeClientMock) RunPivot(string, func(string)) error {
 	err := r.RunPivotReturns[0]
 	if len(r.RunPivotReturns) > 1 {
 		r.RunPivotReturns = r.RunPivotReturns[1:]
@@ -41,6 +58,30 @@ func (r RpmOstreeClientMock) RunPivot(string) error {
 	return err
 }
 
+// UpdateKernelArguments implements a test version of RpmOstreeClients
+// UpdateKernelArguments. It returns UpdateKernelArgumentsReturns.
+func (r RpmOstreeClientMock) UpdateKernelArguments(added, removed []string) error {
+	return r.UpdateKernelArgumentsReturns
+}
+
+// SwitchKernel implements a test version of RpmOstreeClients SwitchKernel.
+// It returns SwitchKernelReturns.
+func (r RpmOstreeClientMock) SwitchKernel(realtime bool) error {
+	return r.SwitchKernelReturns
+}
+
+// UpdateExtensions implements a test version of RpmOstreeClients
+// UpdateExtensions. It returns UpdateExtensionsReturns.
+func (r RpmOstreeClientMock) UpdateExtensions(osImageURL string, install, uninstall []string) error {
+	return r.UpdateExtensionsReturns
+}
+
+// CleanupPendingDeployment implements a test version of RpmOstreeClients
+// CleanupPendingDeployment. It returns CleanupPendingDeploymentReturns.
+func (r RpmOstreeClientMock) CleanupPendingDeployment() error {
+	return r.CleanupPendingDeploymentReturns
+}
+
 func (r RpmOstreeClientMock) GetStatus() (string, error) {
 	return "rpm-ostree mock: blah blah some status here", nil
 }
@@ -1,6 +1,8 @@
 package daemon
 
 import (
+	"bytes"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
@@ -17,14 +19,16 @@ func Run(command string, args ...string) error {
 	return cmd.Run()
 }
 
-// RunGetOut executes a command, logging it, and return the stdout output.
+// RunGetOut executes a command, logging it, and return the stdout output. The
+// error of a failed command ends with its stderr.
 func RunGetOut(command string, args ...string) ([]byte, error) {
 	glog.Infof("Running captured: %s %s\n", command, strings.Join(args, " "))
 	cmd := exec.Command(command, args...)
-	cmd.Stderr = os.Stderr
+	var stderr bytes.Buffer
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
 	rawOut, err := cmd.Output()
 	if err != nil {
-		return nil, err
+		return nil, withExcerpt(err, command+" stderr", stderr.String())
 	}
 	return rawOut, nil
 }
@@ -0,0 +1,112 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// The MESSAGE_IDs of the journal entries of the update lifecycle, stable so
+// that fleet tooling can query them, e.g. with
+// journalctl MESSAGE_ID=4f0e3c5ab7d84a8e9d2c61f0b35e7a91.
+const (
+	// sdMessageUpdateStarted is for an update starting
+	sdMessageUpdateStarted = "4f0e3c5ab7d84a8e9d2c61f0b35e7a91"
+	// sdMessageUpdatePhase is for an update entering a phase
+	sdMessageUpdatePhase = "8a61d27c0e9f4b3da5c4e2b71f9068d3"
+	// sdMessageUpdateReboot is for the daemon requesting a reboot
+	sdMessageUpdateReboot = "c3b9e5f2a1d64c07b8e0f4a9d62137ce"
+	// sdMessageUpdateFinished is for an update which succeeded, failed or
+	// was canceled, as its RESULT says
+	sdMessageUpdateFinished = "1d7a4e98c2b5437f9e06a3c8b4f51d26"
+	// sdMessageNodeDegraded is for the node being marked Degraded or
+	// Unreconcilable
+	sdMessageNodeDegraded = "e6c20f8d3a9b4e51b7d1c5a2f08e9b47"
+)
+
+// The syslog priorities of journal entries.
+const (
+	journalPriErr     = 3
+	journalPriWarning = 4
+	journalPriInfo    = 6
+)
+
+// journalSocketPath is where journald takes native protocol entries. The
+// daemon is chrooted into the host with /run mounted, so this is the host
+// journal. It is swapped out by tests.
+var journalSocketPath = "/run/systemd/journal/socket"
+
+// sendJournal sends an entry with message and fields at priority to the
+// journal, over the native protocol go-systemd's journal.Send speaks. Field
+// names are upper case letters, digits and underscores. The socket is dialed
+// for each entry, so it is always the one of the host.
+func sendJournal(message string, priority int, fields map[string]string) error {
+	var data bytes.Buffer
+	appendJournalField(&data, "MESSAGE", message)
+	appendJournalField(&data, "PRIORITY", strconv.Itoa(priority))
+	appendJournalField(&data, "SYSLOG_IDENTIFIER", "machine-config-daemon")
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		appendJournalField(&data, k, fields[k])
+	}
+
+	conn, err := net.Dial("unixgram", journalSocketPath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(data.Bytes())
+	return err
+}
+
+// appendJournalField appends the field name=value to data. Values with a
+// newline are written with their length, as the native protocol requires.
+func appendJournalField(data *bytes.Buffer, name, value string) {
+	if !strings.ContainsRune(value, '\n') {
+		fmt.Fprintf(data, "%s=%s\n", name, value)
+		return
+	}
+	fmt.Fprintln(data, name)
+	binary.Write(data, binary.LittleEndian, uint64(len(value)))
+	data.WriteString(value)
+	data.WriteByte('\n')
+}
+
+// logLifecycle sends a journal entry with messageID for an event of the
+// update lifecycle, on top of the glog output. Fields without a value are
+// left out. The entries are dropped silently when journald isn't there, as
+// in unit tests.
+func logLifecycle(messageID string, priority int, message string, fields map[string]string) {
+	if _, err := os.Stat(journalSocketPath); err != nil {
+		return
+	}
+	entry := map[string]string{"MESSAGE_ID": messageID}
+	for k, v := range fields {
+		if v != "" {
+			entry[k] = v
+		}
+	}
+	if err := sendJournal(message, priority, entry); err != nil {
+		glog.V(2).Infof("Unable to send journal entry %s: %v", messageID, err)
+	}
+}
+
+// logUpdatePhase sends the journal entry for the update to newConfig entering
+// phase.
+func logUpdatePhase(phase, newConfig string) {
+	logLifecycle(sdMessageUpdatePhase, journalPriInfo, fmt.Sprintf("Update to %s entered phase %s", newConfig, phase), map[string]string{
+		"NEW_CONFIG": newConfig,
+		"PHASE":      phase,
+	})
+}
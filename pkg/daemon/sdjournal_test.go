@@ -0,0 +1,86 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenJournal swaps the journal socket for one in dir and returns it.
+func listenJournal(t *testing.T, dir string) *net.UnixConn {
+	journalSocketPath = filepath.Join(dir, "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: journalSocketPath, Net: "unixgram"})
+	require.Nil(t, err)
+	return conn
+}
+
+// readJournalEntry reads an entry sent to conn and returns its fields.
+func readJournalEntry(t *testing.T, conn *net.UnixConn) map[string]string {
+	buf := make([]byte, 65536)
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, err := conn.Read(buf)
+	require.Nil(t, err)
+	data := buf[:n]
+	fields := make(map[string]string)
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		require.True(t, i >= 0, "unterminated field %q", data)
+		line := string(data[:i])
+		data = data[i+1:]
+		if eq := bytes.IndexByte([]byte(line), '='); eq >= 0 {
+			fields[line[:eq]] = line[eq+1:]
+			continue
+		}
+		size := binary.LittleEndian.Uint64(data[:8])
+		fields[line] = string(data[8 : 8+size])
+		data = data[8+size+1:]
+	}
+	return fields
+}
+
+func TestLogLifecycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(orig string) { journalSocketPath = orig }(journalSocketPath)
+	conn := listenJournal(t, dir)
+	defer conn.Close()
+
+	logUpdateFinished("rendered-worker-1", "rendered-worker-2", historyFailed, false, fmt.Errorf("failed to write\n/etc/foo"))
+	assert.Equal(t, map[string]string{
+		"MESSAGE":           "Update to rendered-worker-2: Failed: failed to write\n/etc/foo",
+		"MESSAGE_ID":        sdMessageUpdateFinished,
+		"PRIORITY":          "4",
+		"SYSLOG_IDENTIFIER": "machine-config-daemon",
+		"OLD_CONFIG":        "rendered-worker-1",
+		"NEW_CONFIG":        "rendered-worker-2",
+		"RESULT":            historyFailed,
+		"REBOOT":            "false",
+		"ERROR":             "failed to write\n/etc/foo",
+	}, readJournalEntry(t, conn))
+
+	// fields without a value are left out
+	logUpdatePhase(updatePhaseDraining, "rendered-worker-2")
+	entry := readJournalEntry(t, conn)
+	assert.Equal(t, sdMessageUpdatePhase, entry["MESSAGE_ID"])
+	assert.Equal(t, updatePhaseDraining, entry["PHASE"])
+	assert.Equal(t, "rendered-worker-2", entry["NEW_CONFIG"])
+	_, ok := entry["OLD_CONFIG"]
+	assert.False(t, ok)
+}
+
+func TestLogLifecycleWithoutJournal(t *testing.T) {
+	defer func(orig string) { journalSocketPath = orig }(journalSocketPath)
+	journalSocketPath = "/nonexistent/journal/socket"
+	// dropped silently
+	logUpdatePhase(updatePhaseDraining, "rendered-worker-2")
+}
@@ -0,0 +1,121 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// selinuxLabeler applies the default SELinux labels of the host's file
+// context policy, those restorecon assigns.
+type selinuxLabeler interface {
+	// enabled returns whether SELinux is enabled on the host
+	enabled() bool
+	// restore gives paths their default label
+	restore(paths ...string) error
+	// mislabeled describes how the label of path differs from its default
+	// one, empty if it doesn't
+	mislabeled(path string) (string, error)
+}
+
+// fileLabeler labels the files and directories the daemon writes, it is
+// swapped out by tests.
+var fileLabeler selinuxLabeler = &restoreconLabeler{}
+
+// restoreLabels gives paths their default SELinux label, unless SELinux is
+// disabled.
+func restoreLabels(paths ...string) error {
+	if len(paths) == 0 || !fileLabeler.enabled() {
+		return nil
+	}
+	if err := fileLabeler.restore(paths...); err != nil {
+		return fmt.Errorf("failed to restore SELinux labels of %s: %v", strings.Join(paths, ", "), err)
+	}
+	return nil
+}
+
+// checkLabel returns the drift of the SELinux label of path, empty if it has
+// its default label or SELinux is disabled.
+func checkLabel(path string) string {
+	if !fileLabeler.enabled() {
+		return ""
+	}
+	detail, err := fileLabeler.mislabeled(path)
+	if err != nil {
+		// not knowing the label isn't drift
+		glog.Warningf("Unable to check the SELinux label of %q: %v", path, err)
+		return ""
+	}
+	if detail == "" {
+		return ""
+	}
+	glog.Errorf("SELinux label mismatch for file: %q; %s", path, detail)
+	return fmt.Sprintf("%s (SELinux label %s)", path, detail)
+}
+
+// missingDirs returns the directories leading to path which don't exist,
+// outermost first.
+func missingDirs(path string) []string {
+	var dirs []string
+	for dir := filepath.Dir(path); dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil || !os.IsNotExist(err) {
+			break
+		}
+		dirs = append([]string{dir}, dirs...)
+	}
+	return dirs
+}
+
+// restoreconRelabel matches the changes restorecon -n -v reports, from
+// "Would relabel <path> from <label> to <label>" and, for older versions,
+// "restorecon reset <path> context <label>-><label>".
+var restoreconRelabel = regexp.MustCompile(`(?: from (\S+) to (\S+)| context (\S+)->(\S+))$`)
+
+// restoreconLabeler labels with restorecon, when selinuxenabled says SELinux
+// is enabled.
+type restoreconLabeler struct {
+	once      sync.Once
+	isEnabled bool
+}
+
+func (l *restoreconLabeler) enabled() bool {
+	l.once.Do(func() {
+		l.isEnabled = exec.Command("selinuxenabled").Run() == nil
+		if !l.isEnabled {
+			glog.Info("SELinux is disabled, files are written unlabeled")
+		}
+	})
+	return l.isEnabled
+}
+
+func (l *restoreconLabeler) restore(paths ...string) error {
+	out, err := exec.Command("restorecon", append([]string{"-F"}, paths...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (l *restoreconLabeler) mislabeled(path string) (string, error) {
+	out, err := exec.Command("restorecon", "-n", "-v", "-F", path).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	line := strings.TrimSpace(string(out))
+	if line == "" {
+		return "", nil
+	}
+	if m := restoreconRelabel.FindStringSubmatch(line); m != nil {
+		if m[1] != "" {
+			return fmt.Sprintf("%s, expected %s", m[1], m[2]), nil
+		}
+		return fmt.Sprintf("%s, expected %s", m[3], m[4]), nil
+	}
+	return line, nil
+}
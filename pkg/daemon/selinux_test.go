@@ -0,0 +1,101 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLabeler records the paths it restores, and reports the paths of
+// wrongLabels as mislabeled until they are restored.
+type fakeLabeler struct {
+	disabled    bool
+	restored    []string
+	wrongLabels map[string]string
+}
+
+func (l *fakeLabeler) enabled() bool {
+	return !l.disabled
+}
+
+func (l *fakeLabeler) restore(paths ...string) error {
+	l.restored = append(l.restored, paths...)
+	for _, path := range paths {
+		delete(l.wrongLabels, path)
+	}
+	return nil
+}
+
+func (l *fakeLabeler) mislabeled(path string) (string, error) {
+	return l.wrongLabels[path], nil
+}
+
+func useFakeLabeler(l *fakeLabeler) func() {
+	orig := fileLabeler
+	fileLabeler = l
+	return func() {
+		fileLabeler = orig
+	}
+}
+
+func TestWriteFileAtomicallyRestoresLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "selinux")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	labeler := &fakeLabeler{}
+	defer useFakeLabeler(labeler)()
+
+	path := filepath.Join(dir, "etc/chrony.d/servers.conf")
+	require.Nil(t, writeFileAtomically(path, []byte("server pool.ntp.org\n"), defaultDirectoryPermissions, defaultFilePermissions, -1, -1))
+	assert.Equal(t, []string{filepath.Join(dir, "etc"), filepath.Join(dir, "etc/chrony.d"), path}, labeler.restored,
+		"the file and the directories created for it are labeled")
+
+	labeler.restored = nil
+	require.Nil(t, writeFileAtomically(path, []byte("server time.example.com\n"), defaultDirectoryPermissions, defaultFilePermissions, -1, -1))
+	assert.Equal(t, []string{path}, labeler.restored)
+
+	labeler.restored = nil
+	link := filepath.Join(dir, "etc/localtime")
+	require.Nil(t, writeLinkAtomically(link, "/usr/share/zoneinfo/UTC", false, -1, -1))
+	assert.Equal(t, []string{link}, labeler.restored)
+
+	labeler.restored, labeler.disabled = nil, true
+	require.Nil(t, writeFileAtomically(filepath.Join(dir, "var/foo"), []byte("foo"), defaultDirectoryPermissions, defaultFilePermissions, -1, -1))
+	assert.Empty(t, labeler.restored, "nothing is labeled when SELinux is disabled")
+}
+
+func TestCheckFilesLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "selinux")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	labeler := &fakeLabeler{}
+	defer useFakeLabeler(labeler)()
+
+	path := filepath.Join(dir, "chrony.conf")
+	require.Nil(t, ioutil.WriteFile(path, []byte("server pool.ntp.org\n"), 0644))
+	require.Nil(t, os.Chmod(path, 0644))
+	files := []ignv2_2types.File{newTestFile(path, "server pool.ntp.org\n")}
+	assert.Empty(t, checkFiles(files))
+
+	labeler.wrongLabels = map[string]string{path: "system_u:object_r:container_file_t:s0, expected system_u:object_r:etc_t:s0"}
+	assert.Equal(t, []string{path + " (SELinux label system_u:object_r:container_file_t:s0, expected system_u:object_r:etc_t:s0)"}, checkFiles(files))
+
+	labeler.disabled = true
+	assert.Empty(t, checkFiles(files), "labels aren't checked when SELinux is disabled")
+}
+
+func TestRestoreconRelabel(t *testing.T) {
+	for line, expected := range map[string][]string{
+		"Would relabel /etc/chrony.conf from system_u:object_r:container_file_t:s0 to system_u:object_r:etc_t:s0":     {"system_u:object_r:container_file_t:s0", "system_u:object_r:etc_t:s0", "", ""},
+		"restorecon reset /etc/chrony.conf context system_u:object_r:container_file_t:s0->system_u:object_r:etc_t:s0": {"", "", "system_u:object_r:container_file_t:s0", "system_u:object_r:etc_t:s0"},
+	} {
+		m := restoreconRelabel.FindStringSubmatch(line)
+		require.NotNil(t, m, line)
+		assert.Equal(t, expected, m[1:], line)
+	}
+}
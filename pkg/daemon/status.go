@@ -0,0 +1,202 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// DefaultStatusBindAddress is the address the status listener, serving
+	// /healthz and /debug/status, binds to by default
+	DefaultStatusBindAddress = "127.0.0.1:8798"
+	// DefaultHealthzBindAddress is the address the listener serving only
+	// /healthz, for the liveness and readiness probes, binds to by default.
+	// The daemon runs on the host network, so the kubelet probes the node's
+	// address rather than localhost.
+	DefaultHealthzBindAddress = ":8799"
+)
+
+// daemonState is the state of the daemon, as served on /debug/status and
+// stored as JSON at pathStateJSON. The state file has the pending config and
+// boot ID across the reboot into a new config: it is written right before
+// rebooting, and removed once the config is done. It also tracks the failed
+// attempts of an update, across restarts of the daemon.
+type daemonState struct {
+	PendingConfig string `json:"pendingConfig,omitempty"`
+	BootID        string `json:"bootID,omitempty"`
+	// RebootAttempts is how many times the reboot into PendingConfig was
+	// requested in the boot BootID, see recordRebootRetry
+	RebootAttempts int `json:"rebootAttempts,omitempty"`
+	// CurrentConfig and DesiredConfig are the configs the node annotations
+	// name
+	CurrentConfig string `json:"currentConfig,omitempty"`
+	DesiredConfig string `json:"desiredConfig,omitempty"`
+	// Phase is the phase of the update in progress, see updatePhases, and
+	// PhaseDetail says more about it
+	Phase       string `json:"phase,omitempty"`
+	PhaseDetail string `json:"phaseDetail,omitempty"`
+	// LastError is the error of the last sync, cleared by the next successful
+	// one
+	LastError string `json:"lastError,omitempty"`
+	// DrainProgress describes the drain in progress, if any
+	DrainProgress string `json:"drainProgress,omitempty"`
+	// UpdateFailures are the consecutive failed attempts of the update to
+	// the desired config, if any
+	UpdateFailures *updateFailures `json:"updateFailures,omitempty"`
+	// ShutdownInhibited is whether the update in progress holds up
+	// shutdowns, see inhibitShutdown
+	ShutdownInhibited bool `json:"shutdownInhibited,omitempty"`
+}
+
+// statusResponse is what /debug/status serves: the state of the daemon and
+// the updates of its history, which isn't part of the state file.
+type statusResponse struct {
+	daemonState
+	History []historyEntry `json:"history,omitempty"`
+}
+
+// statusTracker records the state of the daemon for its status endpoint, as
+// the sync loop updates it.
+type statusTracker struct {
+	mu    sync.Mutex
+	state daemonState
+	// phaseStartedAt is when state.Phase started, to observe its duration
+	// in updateDuration once the next one starts
+	phaseStartedAt time.Time
+}
+
+// setPhase moves the state to phase at now, observing the duration of the
+// phase it leaves. The caller holds mu.
+func (t *statusTracker) setPhase(phase string, now time.Time) {
+	if t.state.Phase == phase {
+		return
+	}
+	if t.state.Phase != "" {
+		updateDuration.WithLabelValues(t.state.Phase).Observe(now.Sub(t.phaseStartedAt).Seconds())
+	}
+	t.state.Phase, t.phaseStartedAt = phase, now
+}
+
+func (t *statusTracker) update(f func(*daemonState)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f(&t.state)
+}
+
+func (t *statusTracker) get() daemonState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+// recordNodeConfigs records the configs named by the annotations of node. The
+// update is over once the node is done in its desired config.
+func (dn *Daemon) recordNodeConfigs(node *corev1.Node) {
+	annotations := node.GetAnnotations()
+	dn.status.mu.Lock()
+	defer dn.status.mu.Unlock()
+	s := &dn.status.state
+	s.CurrentConfig = annotations[constants.CurrentMachineConfigAnnotationKey]
+	s.DesiredConfig = annotations[constants.DesiredMachineConfigAnnotationKey]
+	s.PendingConfig = annotations[constants.PendingMachineConfigAnnotationKey]
+	if s.CurrentConfig == s.DesiredConfig && annotations[constants.MachineConfigDaemonStateAnnotationKey] == constants.MachineConfigDaemonStateDone {
+		dn.status.setPhase("", time.Now())
+		s.PhaseDetail, s.DrainProgress = "", ""
+	}
+}
+
+func (dn *Daemon) recordPhase(phase, detail string) {
+	dn.status.mu.Lock()
+	defer dn.status.mu.Unlock()
+	dn.status.setPhase(phase, time.Now())
+	dn.status.state.PhaseDetail = detail
+}
+
+func (dn *Daemon) recordDrainProgress(progress string) {
+	dn.status.update(func(s *daemonState) {
+		s.DrainProgress = progress
+	})
+}
+
+// recordSyncError records err as the last error, clearing it if nil.
+func (dn *Daemon) recordSyncError(err error) {
+	dn.status.update(func(s *daemonState) {
+		s.LastError = ""
+		if err != nil {
+			s.LastError = err.Error()
+		}
+	})
+}
+
+// currentState returns the state of the daemon.
+func (dn *Daemon) currentState() daemonState {
+	s := dn.status.get()
+	s.BootID = dn.bootID
+	return s
+}
+
+func serveHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+func (dn *Daemon) serveStatus(w http.ResponseWriter, _ *http.Request) {
+	history, err := dn.loadUpdateHistory()
+	if err != nil {
+		glog.Warningf("Unable to serve the update history: %v", err)
+	}
+	b, err := json.MarshalIndent(statusResponse{dn.currentState(), history}, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// StartStatusListener serves /healthz and /debug/status on addr until stopCh
+// is closed, and the pprof profiles on /debug/pprof/ if enablePprof. Intended
+// to be run via a goroutine.
+func (dn *Daemon) StartStatusListener(addr string, enablePprof bool, stopCh <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", serveHealthz)
+	mux.HandleFunc("/debug/status", dn.serveStatus)
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	runListener("status", addr, mux, stopCh)
+}
+
+// StartHealthzListener serves /healthz alone on addr until stopCh is closed.
+// Intended to be run via a goroutine.
+func StartHealthzListener(addr string, stopCh <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", serveHealthz)
+	runListener("healthz", addr, mux, stopCh)
+}
+
+func runListener(name, addr string, handler http.Handler, stopCh <-chan struct{}) {
+	glog.Infof("Starting %s listener on %s", name, addr)
+	s := http.Server{Addr: addr, Handler: handler}
+
+	go func() {
+		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			glog.Errorf("%s listener exited with error: %v", name, err)
+		}
+	}()
+	<-stopCh
+	if err := s.Shutdown(context.Background()); err != nil {
+		glog.Errorf("error stopping %s listener: %v", name, err)
+	}
+}
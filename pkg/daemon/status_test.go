@@ -0,0 +1,58 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestServeStatus(t *testing.T) {
+	dn := &Daemon{bootID: "boot-1"}
+	dn.recordNodeConfigs(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		constants.CurrentMachineConfigAnnotationKey:     "rendered-old",
+		constants.DesiredMachineConfigAnnotationKey:     "rendered-new",
+		constants.MachineConfigDaemonStateAnnotationKey: constants.MachineConfigDaemonStateWorking,
+	}}})
+	dn.recordPhase(updatePhaseDraining, "updating to rendered-new")
+	dn.recordDrainProgress("draining, timeout 1h0m0s")
+	dn.recordSyncError(fmt.Errorf("failed to drain node"))
+
+	w := httptest.NewRecorder()
+	dn.serveStatus(w, httptest.NewRequest("GET", "/debug/status", nil))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var state daemonState
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &state))
+	assert.Equal(t, daemonState{
+		BootID:        "boot-1",
+		CurrentConfig: "rendered-old",
+		DesiredConfig: "rendered-new",
+		Phase:         updatePhaseDraining,
+		PhaseDetail:   "updating to rendered-new",
+		LastError:     "failed to drain node",
+		DrainProgress: "draining, timeout 1h0m0s",
+	}, state)
+
+	// a successful sync clears the error, and the update is over once the node
+	// is done in its desired config
+	dn.recordSyncError(nil)
+	dn.recordNodeConfigs(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		constants.CurrentMachineConfigAnnotationKey:     "rendered-new",
+		constants.DesiredMachineConfigAnnotationKey:     "rendered-new",
+		constants.MachineConfigDaemonStateAnnotationKey: constants.MachineConfigDaemonStateDone,
+	}}})
+	assert.Equal(t, daemonState{BootID: "boot-1", CurrentConfig: "rendered-new", DesiredConfig: "rendered-new"}, dn.currentState())
+}
+
+func TestServeHealthz(t *testing.T) {
+	w := httptest.NewRecorder()
+	serveHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "ok", w.Body.String())
+}
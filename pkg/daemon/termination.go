@@ -0,0 +1,75 @@
+package daemon
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+// exitProcess exits the daemon, it is swapped out by tests.
+var exitProcess = os.Exit
+
+// handleTermination makes the cluster driven daemon exit gracefully on
+// SIGTERM, as when its daemonset is rolled: no sync starts anymore, and the
+// sync in flight runs until its end or, for updates, until the next step
+// the update journal can recover from. An update is journaled before each of
+// its phases, so the next daemon rolls it back and retries it, or resumes its
+// reboot if only the reboot was left.
+func (dn *Daemon) handleTermination() {
+	termChan := make(chan os.Signal, 1)
+	signal.Notify(termChan, syscall.SIGTERM)
+	dn.terminating = make(chan struct{})
+
+	go func() {
+		<-termChan
+		glog.Info("Got SIGTERM, exiting once the sync in flight is at a safe point")
+		close(dn.terminating)
+		// never unlocked, no sync starts after this one reached a safe point
+		dn.syncMu.Lock()
+		dn.exitTerminated("got SIGTERM, no update in flight")
+	}()
+}
+
+// terminationRequested returns whether the daemon got SIGTERM.
+func (dn *Daemon) terminationRequested() bool {
+	select {
+	case <-dn.terminating:
+		return true
+	default:
+		return false
+	}
+}
+
+// exitIfTerminating exits if the daemon got SIGTERM, or if logind announced a
+// shutdown held up by the shutdown inhibitor, which is released first. The
+// update in flight calls it between steps, once the phase it is in was
+// journaled.
+func (dn *Daemon) exitIfTerminating(step string) {
+	switch {
+	case dn.terminationRequested():
+		dn.exitTerminated("got SIGTERM, update interrupted " + step)
+	case dn.shutdownRequested():
+		dn.releaseShutdownInhibitor()
+		dn.exitTerminated("node shutting down, update interrupted " + step)
+	}
+}
+
+// exitTerminated flushes the pending node writes and exits 0.
+func (dn *Daemon) exitTerminated(reason string) {
+	glog.Infof("Exiting: %s", reason)
+	if dn.nodeWriter != nil {
+		dn.nodeWriter.Close()
+	}
+	glog.Flush()
+	exitProcess(0)
+}
+
+// stopHandlingTermination restores the default SIGTERM behaviour, so the
+// daemon doesn't delay the shutdown of a rebooting node.
+func (dn *Daemon) stopHandlingTermination() {
+	if dn.terminating != nil {
+		signal.Reset(syscall.SIGTERM)
+	}
+}
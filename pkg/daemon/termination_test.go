@@ -0,0 +1,30 @@
+package daemon
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitIfTerminating(t *testing.T) {
+	var exits []int
+	origExit := exitProcess
+	defer func() { exitProcess = origExit }()
+	exitProcess = func(code int) { exits = append(exits, code) }
+
+	// daemons not handling SIGTERM, like onceFrom ones, never exit
+	dn := &Daemon{}
+	dn.exitIfTerminating("after writing files")
+	assert.Empty(t, exits)
+
+	dn.terminating = make(chan struct{})
+	dn.exitIfTerminating("after writing files")
+	assert.Empty(t, exits)
+
+	close(dn.terminating)
+	dn.exitIfTerminating("after writing files")
+	assert.Equal(t, []int{0}, exits)
+
+	// no sync starts once SIGTERM was received
+	assert.False(t, dn.processNextWorkItem())
+}
@@ -0,0 +1,205 @@
+package daemon
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/golang/glog"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// errInvalidUnit is the cause of the errors of configs with units or dropins
+// systemd can't parse.
+var errInvalidUnit = errors.New("invalid systemd unit")
+
+// unitSections maps the extensions of the unit types to the sections their
+// units can have on top of [Unit] and [Install]. Sections of unknown types
+// aren't checked.
+var unitSections = map[string][]string{
+	".service":   {"Service"},
+	".socket":    {"Socket"},
+	".mount":     {"Mount"},
+	".automount": {"Automount"},
+	".swap":      {"Swap"},
+	".path":      {"Path"},
+	".timer":     {"Timer"},
+	".slice":     {"Slice"},
+	".scope":     {"Scope"},
+	".target":    {},
+	".device":    {},
+}
+
+// unitSyntaxError is a line of a unit or dropin systemd can't parse.
+type unitSyntaxError struct {
+	// file is the unit, or the dropin as <unit>.d/<dropin>
+	file string
+	line int
+	msg  string
+}
+
+func (e *unitSyntaxError) Error() string {
+	return fmt.Sprintf("%s line %d: %s", e.file, e.line, e.msg)
+}
+
+// checkUnitSyntax returns the syntax errors of contents, the contents of file
+// which is of unit: lines outside of sections, which aren't assignments or
+// comments, and sections unknown to the unit type, whose settings systemd
+// would ignore. Extension sections, prefixed with X-, are allowed.
+func checkUnitSyntax(unit, file, contents string) []error {
+	known, checkSections := unitSections[filepath.Ext(unit)]
+	var errs []error
+	var section string
+	lines := strings.Split(contents, "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNumber := i + 1
+		line := strings.TrimSpace(lines[i])
+		// continuation lines are joined with the next one
+		for strings.HasSuffix(line, "\\") && i+1 < len(lines) {
+			i++
+			line = strings.TrimSuffix(line, "\\") + " " + strings.TrimSpace(lines[i])
+		}
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "["):
+			if !strings.HasSuffix(line, "]") || len(line) < 3 {
+				errs = append(errs, &unitSyntaxError{file, lineNumber, fmt.Sprintf("malformed section header %q", line)})
+				section = ""
+				continue
+			}
+			section = line[1 : len(line)-1]
+			if checkSections && !isKnownUnitSection(section, known) {
+				errs = append(errs, &unitSyntaxError{file, lineNumber, fmt.Sprintf("unknown section [%s] for a %s unit", section, strings.TrimPrefix(filepath.Ext(unit), "."))})
+			}
+		case section == "":
+			errs = append(errs, &unitSyntaxError{file, lineNumber, fmt.Sprintf("%q is outside of any section", line)})
+		case !strings.Contains(line, "="):
+			errs = append(errs, &unitSyntaxError{file, lineNumber, fmt.Sprintf("%q is not an assignment", line)})
+		case strings.TrimSpace(strings.SplitN(line, "=", 2)[0]) == "":
+			errs = append(errs, &unitSyntaxError{file, lineNumber, fmt.Sprintf("%q assigns no key", line)})
+		}
+	}
+	return errs
+}
+
+func isKnownUnitSection(section string, known []string) bool {
+	if section == "Unit" || section == "Install" || strings.HasPrefix(section, "X-") {
+		return true
+	}
+	for _, s := range known {
+		if section == s {
+			return true
+		}
+	}
+	return false
+}
+
+// changedUnitFiles calls fn with the contents of each unit and dropin of
+// newConfig which oldConfig doesn't have with the same contents, by the path
+// it is written at.
+func changedUnitFiles(oldConfig, newConfig *mcfgv1.MachineConfig, fn func(unit ignv2_2types.Unit, file, path, contents string)) {
+	oldContents := make(map[string]string)
+	for _, u := range oldConfig.Spec.Config.Systemd.Units {
+		oldContents[u.Name] = u.Contents
+		for _, d := range u.Dropins {
+			oldContents[u.Name+".d/"+d.Name] = d.Contents
+		}
+	}
+	for _, u := range newConfig.Spec.Config.Systemd.Units {
+		if u.Contents != "" && !u.Mask {
+			if old, ok := oldContents[u.Name]; !ok || old != u.Contents {
+				fn(u, u.Name, filepath.Join(pathSystemd, u.Name), u.Contents)
+			}
+		}
+		for _, d := range u.Dropins {
+			file := u.Name + ".d/" + d.Name
+			if old, ok := oldContents[file]; !ok || old != d.Contents {
+				fn(u, file, filepath.Join(pathSystemd, file), d.Contents)
+			}
+		}
+	}
+}
+
+// validateUnits returns an error wrapping errInvalidUnit and listing the
+// syntax errors, see checkUnitSyntax, of the units and dropins newConfig adds
+// or changes from oldConfig. Those already applied aren't checked again.
+func (dn *Daemon) validateUnits(oldConfig, newConfig *mcfgv1.MachineConfig) error {
+	if dn.skipUnitValidation {
+		return nil
+	}
+	var errs []string
+	changedUnitFiles(oldConfig, newConfig, func(unit ignv2_2types.Unit, file, _, contents string) {
+		for _, err := range checkUnitSyntax(unit.Name, file, contents) {
+			errs = append(errs, err.Error())
+		}
+	})
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.Wrapf(errInvalidUnit, "%s", strings.Join(errs, "; "))
+}
+
+// unitVerifyWarning matches the lines of systemd-analyze verify about a line
+// of a file, e.g. "/etc/systemd/system/foo.service:3: Unknown key name
+// 'ExecStrat' in section 'Service', ignoring."
+var unitVerifyWarning = regexp.MustCompile(`^(/\S+):(\d+): (.*)$`)
+
+// verifyUnits runs systemd-analyze verify on units, it is swapped out by
+// tests. Its exit status is ignored, only the warnings of its output are
+// used.
+var verifyUnits = func(units []string) string {
+	args := append([]string{"verify"}, units...)
+	out, err := exec.Command("systemd-analyze", args...).CombinedOutput()
+	if err != nil {
+		glog.V(2).Infof("systemd-analyze verify: %v", err)
+	}
+	return string(out)
+}
+
+// warnUnits emits an event for each warning systemd-analyze verify reports
+// for a line of the units and dropins newConfig adds or changes from
+// oldConfig, once they are written, like unknown keys, which systemd ignores.
+// They don't fail the update.
+func (dn *Daemon) warnUnits(oldConfig, newConfig *mcfgv1.MachineConfig) {
+	if dn.skipUnitValidation {
+		return
+	}
+	// the units are verified with their dropins, by name for the units the
+	// config only has dropins of
+	var units []string
+	verified := make(map[string]bool)
+	files := make(map[string]string)
+	changedUnitFiles(oldConfig, newConfig, func(unit ignv2_2types.Unit, file, path, _ string) {
+		files[path] = file
+		target := unit.Name
+		if unit.Contents != "" {
+			target = filepath.Join(pathSystemd, unit.Name)
+		}
+		if !verified[target] {
+			verified[target] = true
+			units = append(units, target)
+		}
+	})
+	if len(units) == 0 {
+		return
+	}
+	for _, line := range strings.Split(verifyUnits(units), "\n") {
+		m := unitVerifyWarning.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		file, ok := files[m[1]]
+		if !ok {
+			continue
+		}
+		glog.Warningf("Update to %s: %s line %s: %s", newConfig.GetName(), file, m[2], m[3])
+		if dn.recorder != nil && dn.node != nil {
+			dn.recorder.Eventf(getNodeRef(dn.node), corev1.EventTypeWarning, "UnitWarning", "Update to %s: %s line %s: %s", newConfig.GetName(), file, m[2], m[3])
+		}
+	}
+}
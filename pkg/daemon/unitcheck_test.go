@@ -0,0 +1,111 @@
+package daemon
+
+import (
+	"path/filepath"
+	"testing"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestCheckUnitSyntax(t *testing.T) {
+	valid := `# comment
+[Unit]
+Description=Foo
+; comment too
+
+[Service]
+ExecStart=/usr/bin/foo \
+  --bar
+X-Custom=1
+
+[X-Vendor]
+Key=value
+
+[Install]
+WantedBy=multi-user.target
+`
+	assert.Empty(t, checkUnitSyntax("foo.service", "foo.service", valid))
+	assert.Empty(t, checkUnitSyntax("foo.unknown", "foo.unknown", "[Anything]\nKey=value\n"), "the sections of unknown unit types aren't checked")
+
+	var msgs []string
+	for _, err := range checkUnitSyntax("foo.service", "foo.service.d/10-foo.conf", `Description=Foo
+[Servicee]
+ExecStart=/usr/bin/foo
+[Service
+ExecStart
+=/usr/bin/foo
+`) {
+		msgs = append(msgs, err.Error())
+	}
+	assert.Equal(t, []string{
+		`foo.service.d/10-foo.conf line 1: "Description=Foo" is outside of any section`,
+		`foo.service.d/10-foo.conf line 2: unknown section [Servicee] for a service unit`,
+		`foo.service.d/10-foo.conf line 4: malformed section header "[Service"`,
+		`foo.service.d/10-foo.conf line 5: "ExecStart" is outside of any section`,
+		`foo.service.d/10-foo.conf line 6: "=/usr/bin/foo" is outside of any section`,
+	}, msgs)
+
+	var lines []string
+	for _, err := range checkUnitSyntax("foo.timer", "foo.timer", "[Timer]\nOnCalendar\n=daily\n[Service]\n") {
+		lines = append(lines, err.Error())
+	}
+	assert.Equal(t, []string{
+		`foo.timer line 2: "OnCalendar" is not an assignment`,
+		`foo.timer line 3: "=daily" assigns no key`,
+		`foo.timer line 4: unknown section [Service] for a timer unit`,
+	}, lines)
+}
+
+func TestValidateUnits(t *testing.T) {
+	withUnits := func(units ...ignv2_2types.Unit) *mcfgv1.MachineConfig {
+		return &mcfgv1.MachineConfig{Spec: mcfgv1.MachineConfigSpec{Config: ignv2_2types.Config{Systemd: ignv2_2types.Systemd{Units: units}}}}
+	}
+	typo := ignv2_2types.Unit{Name: "foo.service", Contents: "[Servicee]\nExecStart=/usr/bin/foo\n"}
+	dn := &Daemon{}
+
+	err := dn.validateUnits(withUnits(), withUnits(typo))
+	require.NotNil(t, err)
+	assert.Equal(t, errInvalidUnit, errors.Cause(err))
+	assert.Equal(t, "foo.service line 1: unknown section [Servicee] for a service unit: invalid systemd unit", err.Error())
+
+	dropin := ignv2_2types.Unit{Name: "kubelet.service", Dropins: []ignv2_2types.SystemdDropin{{Name: "10-env.conf", Contents: "Environment=A=B\n"}}}
+	err = dn.validateUnits(withUnits(), withUnits(dropin))
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "kubelet.service.d/10-env.conf line 1")
+
+	assert.Nil(t, dn.validateUnits(withUnits(typo), withUnits(typo)), "units already applied aren't checked again")
+	assert.Nil(t, dn.validateUnits(withUnits(), withUnits(ignv2_2types.Unit{Name: "foo.service", Contents: "[Servicee]", Mask: true})), "masked units aren't written")
+
+	dn.skipUnitValidation = true
+	assert.Nil(t, dn.validateUnits(withUnits(), withUnits(typo)))
+}
+
+func TestWarnUnits(t *testing.T) {
+	defer func(orig func([]string) string) { verifyUnits = orig }(verifyUnits)
+	var verified []string
+	unitPath := filepath.Join(pathSystemd, "foo.service")
+	verifyUnits = func(units []string) string {
+		verified = units
+		return unitPath + ":3: Unknown key name 'ExecStrat' in section 'Service', ignoring.\n" +
+			"/usr/lib/systemd/system/other.service:1: Unknown key name 'Foo' in section 'Unit', ignoring.\n" +
+			"foo.service: Failed to create foo.service/start: Unit network-online.target not found.\n"
+	}
+	recorder := record.NewFakeRecorder(10)
+	dn := &Daemon{recorder: recorder, node: &corev1.Node{}}
+	newConfig := &mcfgv1.MachineConfig{Spec: mcfgv1.MachineConfigSpec{Config: ignv2_2types.Config{Systemd: ignv2_2types.Systemd{Units: []ignv2_2types.Unit{
+		{Name: "foo.service", Contents: "[Service]\nType=oneshot\nExecStrat=/usr/bin/foo\n"},
+		{Name: "kubelet.service", Dropins: []ignv2_2types.SystemdDropin{{Name: "10-env.conf", Contents: "[Service]\nEnvironment=A=B\n"}}},
+	}}}}}
+	newConfig.Name = "rendered-worker-2"
+
+	dn.warnUnits(&mcfgv1.MachineConfig{}, newConfig)
+	assert.Equal(t, []string{unitPath, "kubelet.service"}, verified)
+	require.Len(t, recorder.Events, 1, "only the warnings about lines of the units changed are reported")
+	assert.Equal(t, "Warning UnitWarning Update to rendered-worker-2: foo.service line 3: Unknown key name 'ExecStrat' in section 'Service', ignoring.", <-recorder.Events)
+}
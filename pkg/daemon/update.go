@@ -2,31 +2,30 @@ package daemon
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/signal"
-	"os/user"
 	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
-	"github.com/coreos/ignition/config/validate"
 	"github.com/golang/glog"
 	"github.com/google/renameio"
-	drain "github.com/openshift/kubernetes-drain"
 	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	ctrlcommon "github.com/openshift/machine-config-operator/pkg/controller/common"
 	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
 	errors "github.com/pkg/errors"
-	"github.com/vincent-petithory/dataurl"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 const (
@@ -34,27 +33,58 @@ const (
 	defaultDirectoryPermissions os.FileMode = 0755
 	// defaultFilePermissions houses the default mode to use when no file permissions are provided
 	defaultFilePermissions os.FileMode = 0644
-	// coreUser is "core" and currently the only permissible user name
+	// coreUserName is "core", the user every node has
 	coreUserName = "core"
 	// SSH Keys for user "core" will only be written at /home/core/.ssh
 	coreUserSSHPath = "/home/core/.ssh/"
+	// coreUserSSHDirPermissions is the mode of coreUserSSHPath
+	coreUserSSHDirPermissions os.FileMode = 0700
+	// coreUserSSHKeysPermissions is the mode of the authorized_keys file
+	coreUserSSHKeysPermissions os.FileMode = 0600
 )
 
 func writeFileAtomicallyWithDefaults(fpath string, b []byte) error {
 	return writeFileAtomically(fpath, b, defaultDirectoryPermissions, defaultFilePermissions, -1, -1)
 }
 
-// writeFileAtomically uses the renameio package to provide atomic file writing, we can't use renameio.WriteFile
-// directly since we need to 1) Chown 2) go through a buffer since files provided can be big
-func writeFileAtomically(fpath string, b []byte, dirMode, fileMode os.FileMode, uid, gid int) error {
-	if err := os.MkdirAll(filepath.Dir(fpath), dirMode); err != nil {
-		return fmt.Errorf("failed to create directory %q: %v", filepath.Dir(fpath), err)
+// renameFile replaces the destination of an atomic write, it is swapped out by
+// tests to simulate a crash between writing and renaming.
+var renameFile = os.Rename
+
+// selinuxLabelXattr is the extended attribute holding a file's SELinux label
+const selinuxLabelXattr = "security.selinux"
+
+// writeFileAtomically writes b to fpath such that a crash or power loss at any
+// point leaves either the previous file or the complete new one: b is written
+// to a temporary file in the same directory, which gets its mode, ownership and
+// SELinux label and is fsynced before being renamed over fpath, then the
+// directory is fsynced so the rename itself is durable. The file and the
+// directories created for it finally get their default SELinux label, as the
+// label of the temporary file is the one fpath had, or the one of the daemon.
+func writeFileAtomically(fpath string, b []byte, dirMode, fileMode os.FileMode, uid, gid int) (retErr error) {
+	dir := filepath.Dir(fpath)
+	createdDirs := missingDirs(fpath)
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return fmt.Errorf("failed to create directory %q: %v", dir, readOnlyError(err))
 	}
-	t, err := renameio.TempFile("", fpath)
-	if err != nil {
+	// renaming over a symlink replaces the link, not the file it points to
+	if fi, err := os.Lstat(fpath); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("refusing to write %q: it is a symlink", fpath)
+	} else if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	defer t.Cleanup()
+
+	// in the same directory, the rename can't cross a mount point
+	t, err := ioutil.TempFile(dir, "."+filepath.Base(fpath))
+	if err != nil {
+		return fmt.Errorf("failed to write %q: %v", fpath, readOnlyError(err))
+	}
+	defer func() {
+		if retErr != nil {
+			t.Close()
+			os.Remove(t.Name())
+		}
+	}()
 	// Set permissions before writing data, in case the data is sensitive.
 	if err := t.Chmod(fileMode); err != nil {
 		return err
@@ -71,19 +101,69 @@ func writeFileAtomically(fpath string, b []byte, dirMode, fileMode os.FileMode,
 			return err
 		}
 	}
-	return t.CloseAtomicallyReplace()
+	if err := copySELinuxLabel(fpath, t.Name()); err != nil {
+		return fmt.Errorf("failed to set SELinux label of %q: %v", fpath, err)
+	}
+	if err := t.Sync(); err != nil {
+		return err
+	}
+	if err := t.Close(); err != nil {
+		return err
+	}
+	if err := renameFile(t.Name(), fpath); err != nil {
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	return restoreLabels(append(createdDirs, fpath)...)
 }
 
-func (dn *Daemon) writePendingState(desiredConfig *mcfgv1.MachineConfig) error {
-	t := &pendingConfigState{
-		PendingConfig: desiredConfig.GetName(),
-		BootID:        dn.bootID,
+// readOnlyError makes the error of a write to a read-only mount explicit.
+func readOnlyError(err error) error {
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EROFS {
+		return fmt.Errorf("%s is on a read-only filesystem", pe.Path)
 	}
+	return err
+}
+
+// copySELinuxLabel labels to with the SELinux label of from, if from exists and has
+// one. A new file already gets the default label of its directory.
+func copySELinuxLabel(from, to string) error {
+	size, err := syscall.Getxattr(from, selinuxLabelXattr, nil)
+	if err != nil {
+		if err == syscall.ENOENT || err == syscall.ENODATA || err == syscall.ENOTSUP {
+			return nil
+		}
+		return err
+	}
+	label := make([]byte, size)
+	size, err = syscall.Getxattr(from, selinuxLabelXattr, label)
+	if err != nil {
+		return err
+	}
+	return syscall.Setxattr(to, selinuxLabelXattr, label[:size], 0)
+}
+
+// syncDir fsyncs the directory dir, making the renames in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (dn *Daemon) writePendingState(desiredConfig *mcfgv1.MachineConfig) error {
+	t := dn.currentState()
+	t.PendingConfig = desiredConfig.GetName()
+	t.RebootAttempts = 1
 	b, err := json.Marshal(t)
 	if err != nil {
 		return err
 	}
-	return writeFileAtomicallyWithDefaults(pathStateJSON, b)
+	return writeFileAtomicallyWithDefaults(dn.stateFilePath, b)
 }
 
 func getNodeRef(node *corev1.Node) *corev1.ObjectReference {
@@ -95,58 +175,116 @@ func getNodeRef(node *corev1.Node) *corev1.ObjectReference {
 }
 
 // updateOSAndReboot is the last step in an update(), and it can also
-// be called as a special case for the "bootstrap pivot".
-func (dn *Daemon) updateOSAndReboot(newConfig *mcfgv1.MachineConfig) error {
+// be called as a special case for the "bootstrap pivot". Between phases, and
+// drain attempts, canceled returns whether the update was canceled, see
+// checkUpdateCanceled; it is nil when it can't be.
+func (dn *Daemon) updateOSAndReboot(newConfig *mcfgv1.MachineConfig, canceled func(phase string) error) error {
+	if canceled == nil {
+		canceled = func(string) error { return nil }
+	}
+	dn.setUpdateProgress(updatePhaseUpdatingOS, newConfig)
 	if err := dn.updateOS(newConfig); err != nil {
 		return err
 	}
+	dn.exitIfTerminating("after staging the OS")
+	// interrupting the drain leaves nothing half done
+	dn.releaseShutdownInhibitor()
+	if err := canceled(updatePhaseUpdatingOS); err != nil {
+		return err
+	}
 
 	// Skip draining of the node when we're not cluster driven
 	if dn.onceFrom == "" {
-		glog.Info("Update prepared; draining the node")
-
-		dn.recorder.Eventf(getNodeRef(dn.node), corev1.EventTypeNormal, "Drain", "Draining node to update config.")
-
-		backoff := wait.Backoff{
-			Steps:    5,
-			Duration: 10 * time.Second,
-			Factor:   2,
-		}
-		var lastErr error
-		if err := wait.ExponentialBackoff(backoff, func() (bool, error) {
-			err := drain.Drain(dn.kubeClient, []*corev1.Node{dn.node}, &drain.DrainOptions{
-				DeleteLocalData:    true,
-				Force:              true,
-				GracePeriodSeconds: 600,
-				IgnoreDaemonsets:   true,
-			})
-			if err == nil {
-				return true, nil
-			}
-			lastErr = err
-			glog.Infof("Draining failed with: %v, retrying", err)
-			return false, nil
+		if err := dn.waitWorkingReported(); err != nil {
+			return err
+		}
+		if err := dn.waitForMaintenanceWindow(newConfig); err != nil {
+			return errors.Wrapf(err, "waiting for maintenance window")
+		}
+		if err := canceled(updatePhaseWaitingForWindow); err != nil {
+			return err
+		}
+		// taking down a master while another etcd member is down could
+		// lose quorum
+		if err := dn.waitForEtcdMembers("", etcdQuorumTimeout); err != nil {
+			return errors.Wrapf(err, "waiting for etcd members before draining")
+		}
+		if err := dn.journalUpdatePhase(updatePhaseDraining); err != nil {
+			return err
+		}
+		dn.setUpdateProgress(updatePhaseDraining, newConfig)
+
+		// on single-node clusters the pods have nowhere to go, evicting them
+		// would just time out
+		skipDrain := dn.skipDrainReason(dn.node)
+		if skipDrain != "" {
+			dn.logSystem("Update prepared; skipping drain of the node, %s", skipDrain)
+			dn.recorder.Eventf(getNodeRef(dn.node), corev1.EventTypeNormal, "DrainSkipped", "Skipping drain to update config: %s.", skipDrain)
+		} else {
+			glog.Info("Update prepared; draining the node")
+			dn.recorder.Eventf(getNodeRef(dn.node), corev1.EventTypeNormal, "Drain", "Draining node to update config.")
+		}
+
+		// drain then finds the node already cordoned
+		if err := dn.cordon(); err != nil {
+			return errors.Wrap(err, "failed to cordon node")
+		}
+		ctx, cancel := nodeWriterContext()
+		err := dn.nodeWriter.ApplyUpdatingTaint(ctx)
+		cancel()
+		if err != nil {
+			return errors.Wrap(err, "failed to taint node")
+		}
+		node := dn.node.DeepCopy()
+		node.Spec.Unschedulable = true
 
-		}); err != nil {
-			if err == wait.ErrWaitTimeout {
-				return errors.Wrapf(lastErr, "failed to drain node (%d tries): %v", backoff.Steps, err)
+		if skipDrain == "" {
+			if err := dn.drainNode(node, canceled); err != nil {
+				return err
 			}
-			return errors.Wrap(err, "failed to drain node")
+			glog.Info("Node successfully drained")
+		}
+		// the last chance to cancel, there is no return from the reboot
+		if err := canceled(updatePhaseDraining); err != nil {
+			return err
 		}
-		glog.Info("Node successfully drained")
 	}
 
+	if err := dn.journalUpdatePhase(updatePhaseRebooting); err != nil {
+		return err
+	}
+	// the next daemon resumes the reboot
+	dn.exitIfTerminating("before rebooting")
+	return dn.rebootIntoConfig(newConfig)
+}
+
+// rebootIntoConfig records that newConfig is pending, then reboots into it. It
+// only returns on error.
+func (dn *Daemon) rebootIntoConfig(newConfig *mcfgv1.MachineConfig) error {
 	if err := dn.writePendingState(newConfig); err != nil {
 		return errors.Wrapf(err, "writing pending state")
 	}
 
+	// Let the cluster know a reboot is expected, so a node that is slow to
+	// come back isn't mistaken for a hung one.
+	if dn.onceFrom == "" && dn.nodeWriter != nil {
+		ctx, cancel := nodeWriterContext()
+		err := dn.nodeWriter.SetPendingConfig(ctx, newConfig.GetName())
+		cancel()
+		if err != nil {
+			return errors.Wrapf(err, "setting pending config annotation")
+		}
+	}
+
+	dn.setUpdateProgress(updatePhaseRebooting, newConfig)
 	// reboot. this function shouldn't actually return.
 	return dn.reboot(fmt.Sprintf("Node will reboot into config %v", newConfig.GetName()), defaultRebootTimeout, exec.Command(defaultRebootCommand))
 }
 
 // isUpdating returns true if the MCD is actively applying an update
 func (dn *Daemon) catchIgnoreSIGTERM() {
-	if dn.installedSigterm {
+	// the cluster driven daemon handles SIGTERM itself
+	if dn.installedSigterm || dn.terminating != nil {
 		return
 	}
 
@@ -168,18 +306,106 @@ func (dn *Daemon) catchIgnoreSIGTERM() {
 
 var errUnreconcilable = errors.New("unreconcilable")
 
+// The phases of an update published in the update-progress annotation, in
+// the order they happen.
+const (
+	updatePhaseValidating      = "Validating"
+	updatePhaseUpdatingFiles   = "UpdatingFiles"
+	updatePhaseUpdatingSSHKeys = "UpdatingSSHKeys"
+	updatePhaseUpdatingOS      = "UpdatingOS"
+	// updatePhaseWaitingForWindow is only entered by nodes outside of their
+	// maintenance window
+	updatePhaseWaitingForWindow = "WaitingForMaintenanceWindow"
+	updatePhaseDraining         = "Draining"
+	updatePhaseRebooting        = "Rebooting"
+)
+
+var updatePhases = []string{
+	updatePhaseValidating,
+	updatePhaseUpdatingFiles,
+	updatePhaseUpdatingSSHKeys,
+	updatePhaseUpdatingOS,
+	updatePhaseWaitingForWindow,
+	updatePhaseDraining,
+	updatePhaseRebooting,
+}
+
+// setUpdateProgress publishes that the update to config entered phase. The
+// progress is informational only, so failing to publish it is just logged.
+func (dn *Daemon) setUpdateProgress(phase string, config *mcfgv1.MachineConfig) {
+	logUpdatePhase(phase, config.GetName())
+	dn.publishUpdateProgress(phase, time.Now().UTC(), fmt.Sprintf("updating to %s", config.GetName()))
+}
+
+// publishUpdateProgress publishes that the update is in phase since startedAt,
+// with detail.
+func (dn *Daemon) publishUpdateProgress(phase string, startedAt time.Time, detail string) {
+	dn.recordPhase(phase, detail)
+	if dn.nodeWriter == nil || dn.kubeClient == nil {
+		return
+	}
+	step := 0
+	for i, p := range updatePhases {
+		if p == phase {
+			step = i + 1
+		}
+	}
+	progress := UpdateProgress{
+		Phase:     phase,
+		Step:      fmt.Sprintf("%d/%d", step, len(updatePhases)),
+		StartedAt: startedAt,
+		Detail:    detail,
+	}
+	dn.queueNodeWrite("publish update progress "+phase, func(ctx context.Context) *PendingWrite {
+		return dn.nodeWriter.QueueUpdateProgress(ctx, progress)
+	})
+}
+
+// cordon marks the node unschedulable through the node writer, so it can't
+// race with the annotation writes, and sets the state to Working in the same
+// patch: the bootstrap pivot doesn't go through update(), which sets it first.
+func (dn *Daemon) cordon() error {
+	ctx, cancel := nodeWriterContext()
+	defer cancel()
+	return dn.nodeWriter.SetUnschedulable(ctx, true, map[string]string{
+		constants.MachineConfigDaemonStateAnnotationKey: constants.MachineConfigDaemonStateWorking,
+	})
+}
+
 // update the node to the provided node configuration.
 func (dn *Daemon) update(oldConfig, newConfig *mcfgv1.MachineConfig) (retErr error) {
+	dn.exitIfTerminating("before starting")
+
 	if dn.nodeWriter != nil {
 		state, err := getNodeAnnotationExt(dn.node, constants.MachineConfigDaemonStateAnnotationKey, true)
 		if err != nil {
 			return err
 		}
 		if state != constants.MachineConfigDaemonStateDegraded && state != constants.MachineConfigDaemonStateUnreconcilable {
-			if err := dn.nodeWriter.SetWorking(dn.kubeClient.CoreV1().Nodes(), dn.nodeLister, dn.name); err != nil {
-				return err
-			}
+			// the API server may be unavailable for minutes while the
+			// control plane updates; the local phases carry on meanwhile
+			ctx, cancel := outageWriterContext()
+			defer cancel()
+			dn.working = dn.nodeWriter.QueueWorking(ctx)
+			defer func() {
+				dn.working = nil
+			}()
 		}
+		// the reason for reboot is that of the last completed update
+		dn.queueNodeWrite("clear the reason for reboot", func(ctx context.Context) *PendingWrite {
+			return dn.nodeWriter.QueueRemoveAnnotations(ctx, []string{rebootReasonAnnotationKey})
+		})
+	}
+
+	// once rolled back by the defers below, a canceled update is done with
+	// oldConfig again
+	defer func() {
+		if canceled, ok := retErr.(*updateCanceledError); ok {
+			retErr = dn.completeCanceledUpdate(oldConfig, newConfig, canceled)
+		}
+	}()
+	canceled := func(phase string) error {
+		return dn.checkUpdateCanceled(phase, newConfig)
 	}
 
 	dn.catchIgnoreSIGTERM()
@@ -192,11 +418,12 @@ func (dn *Daemon) update(oldConfig, newConfig *mcfgv1.MachineConfig) (retErr err
 	oldConfigName := oldConfig.GetName()
 	newConfigName := newConfig.GetName()
 	glog.Infof("Checking reconcilable for config %v to %v", oldConfigName, newConfigName)
+	dn.setUpdateProgress(updatePhaseValidating, newConfig)
 	// make sure we can actually reconcile this state
 	reconcilableError := dn.reconcilable(oldConfig, newConfig)
 
 	if reconcilableError != nil {
-		wrappedErr := fmt.Errorf("can't reconcile config %s with %s: %v", oldConfigName, newConfigName, reconcilableError)
+		wrappedErr := fmt.Errorf("can't reconcile config %s with %s (%s update backend): %v", oldConfigName, newConfigName, dn.updater().name(), reconcilableError)
 		if dn.recorder != nil {
 			mcRef := &corev1.ObjectReference{
 				Kind: "MachineConfig",
@@ -209,10 +436,62 @@ func (dn *Daemon) update(oldConfig, newConfig *mcfgv1.MachineConfig) (retErr err
 		return errors.Wrapf(errUnreconcilable, "%v", wrappedErr)
 	}
 
+	// don't write anything for extensions which can't be installed
+	if err := validateExtensions(newConfig.Spec.Extensions); err != nil {
+		return err
+	}
+	// nor for units systemd can't parse, which would only fail on boot
+	if err := dn.validateUnits(oldConfig, newConfig); err != nil {
+		return err
+	}
+	dn.warnIgnoredOSImage(oldConfig, newConfig)
+
+	// record the attempt in the history; its outcome is recorded once the
+	// rollbacks below ran, before a canceled update is completed
+	dn.recordUpdateStarted(oldConfig, newConfig)
+	defer func() {
+		if retErr != nil {
+			dn.recordUpdateFinished(newConfigName, false, retErr)
+		}
+	}()
+
+	// fetch the remote contents of files before writing anything; those of
+	// the old config stay cached for rollbacks
+	if err := dn.fetchRemoteSources(newConfig.Spec.Config.Storage.Files); err != nil {
+		return err
+	}
+	pruneRemoteSources(oldConfig, newConfig)
+	if err := canceled(updatePhaseValidating); err != nil {
+		return err
+	}
+
+	// hold up shutdowns until the files are written and the OS staged, or
+	// the next step recovery can start from
+	dn.inhibitShutdown()
+	defer dn.releaseShutdownInhibitor()
+
+	// record the update before writing anything, so that it can be
+	// recovered if the daemon is killed halfway through
+	if err := dn.startUpdateJournal(oldConfig, newConfig); err != nil {
+		return errors.Wrapf(err, "recording update")
+	}
+
+	defer func() {
+		// the rollbacks below run first
+		if retErr != nil {
+			if err := dn.clearUpdateJournal(); err != nil {
+				glog.Warningf("Unable to clear the update journal: %v", err)
+			}
+		}
+	}()
+
 	// update files on disk that need updating
+	dn.setUpdateProgress(updatePhaseUpdatingFiles, newConfig)
 	if err := dn.updateFiles(oldConfig, newConfig); err != nil {
 		return err
 	}
+	dn.warnUnits(oldConfig, newConfig)
+	dn.exitIfTerminating("after writing files")
 
 	defer func() {
 		if retErr != nil {
@@ -222,27 +501,134 @@ func (dn *Daemon) update(oldConfig, newConfig *mcfgv1.MachineConfig) (retErr err
 			}
 		}
 	}()
+	if err := canceled(updatePhaseUpdatingFiles); err != nil {
+		return err
+	}
 
-	if err := dn.updateSSHKeys(newConfig.Spec.Config.Passwd.Users); err != nil {
+	if err := dn.journalUpdatePhase(updatePhaseUpdatingSSHKeys); err != nil {
+		return err
+	}
+	dn.setUpdateProgress(updatePhaseUpdatingSSHKeys, newConfig)
+	if err := dn.updatePasswd(oldConfig.Spec.Config.Passwd.Users, newConfig.Spec.Config.Passwd.Users); err != nil {
 		return err
 	}
+	dn.exitIfTerminating("after updating users")
 
 	defer func() {
 		if retErr != nil {
-			if err := dn.updateSSHKeys(oldConfig.Spec.Config.Passwd.Users); err != nil {
-				retErr = errors.Wrapf(retErr, "error rolling back SSH keys updates %v", err)
+			if err := dn.updatePasswd(newConfig.Spec.Config.Passwd.Users, oldConfig.Spec.Config.Passwd.Users); err != nil {
+				retErr = errors.Wrapf(retErr, "error rolling back users updates %v", err)
 				return
 			}
 		}
 	}()
+	if err := canceled(updatePhaseUpdatingSSHKeys); err != nil {
+		return err
+	}
 
-	return dn.updateOSAndReboot(newConfig)
+	if dn.onceFrom == "" {
+		plan := computeUpdatePlan(oldConfig, newConfig)
+		dn.recordUpdatePlan(newConfig, plan)
+		dn.warnShrunkCABundles(oldConfig, newConfig)
+		if !plan.reboot {
+			err := dn.applyLiveUpdate(newConfig, plan)
+			if errors.Cause(err) != errLiveUpdateFailed {
+				return err
+			}
+			dn.logSystem("%v, falling back to a reboot", err)
+			plan.add(reboot, "live update failed")
+			dn.recordUpdatePlan(newConfig, plan)
+		}
+	}
+
+	// the reboot may have to wait for a window, don't stage anything for one
+	// which can't be parsed
+	if _, err := nodeMaintenanceWindow(dn.node); err != nil {
+		return err
+	}
+
+	if err := dn.runPreUpdateHooks(oldConfig.GetName(), newConfig.GetName()); err != nil {
+		return err
+	}
+
+	if err := dn.journalUpdatePhase(updatePhaseUpdatingOS); err != nil {
+		return err
+	}
+
+	if err := dn.updateKernelArguments(oldConfig, newConfig); err != nil {
+		return err
+	}
+
+	defer func() {
+		if retErr != nil {
+			if err := dn.updateKernelArguments(newConfig, oldConfig); err != nil {
+				retErr = errors.Wrapf(retErr, "error rolling back kernel arguments updates %v", err)
+				return
+			}
+		}
+	}()
+
+	if err := dn.updateKernelType(oldConfig, newConfig); err != nil {
+		return err
+	}
+
+	defer func() {
+		if retErr != nil {
+			if err := dn.updateKernelType(newConfig, oldConfig); err != nil {
+				retErr = errors.Wrapf(retErr, "error rolling back kernel switch %v", err)
+				return
+			}
+		}
+	}()
+
+	if err := dn.updateExtensions(oldConfig, newConfig); err != nil {
+		return err
+	}
+
+	defer func() {
+		if retErr != nil {
+			if err := dn.updateExtensions(newConfig, oldConfig); err != nil {
+				retErr = errors.Wrapf(retErr, "error rolling back extensions updates %v", err)
+				return
+			}
+		}
+	}()
+
+	return dn.updateOSAndReboot(newConfig, canceled)
+}
+
+// completeLiveUpdate marks newConfig as current and done, for updates applied
+// without a reboot.
+func (dn *Daemon) completeLiveUpdate(newConfig *mcfgv1.MachineConfig) error {
+	if err := dn.storeCurrentConfig(newConfig); err != nil {
+		return err
+	}
+	if err := dn.clearUpdateJournal(); err != nil {
+		return err
+	}
+
+	// the Working state may still be buffered, Done supersedes it
+	ctx, cancel := outageWriterContext()
+	defer cancel()
+	if err := dn.nodeWriter.SetDone(ctx, newConfig.GetName()); err != nil {
+		return err
+	}
+	dn.cancelSIGTERM()
+	dn.recordUpdateFinished(newConfig.GetName(), false, nil)
+	dn.publishBootedOS()
+
+	if dn.recorder != nil && dn.node != nil {
+		dn.recorder.Eventf(getNodeRef(dn.node), corev1.EventTypeNormal, "UpdatedWithoutReboot", "Updated to %s without reboot", newConfig.GetName())
+	}
+	return nil
 }
 
 // reconcilable checks the configs to make sure that the only changes requested
 // are ones we know how to do in-place.  If we can reconcile, (nil, nil) is returned.
 // Otherwise, if we can't do it in place, the node is marked as degraded;
-// the returned string value includes the rationale.
+// the returned reconcileError lists the JSON paths of the fields keeping us
+// from it, telling fields never changed in place from fields changed in a way
+// we can't apply.
 //
 // we can only update machine configs that have changes to the files,
 // directories, links, and systemd units sections of the included ignition
@@ -258,124 +644,118 @@ func (dn *Daemon) reconcilable(oldConfig, newConfig *mcfgv1.MachineConfig) error
 	}
 	oldIgn := oldConfig.Spec.Config
 	newIgn := newConfig.Spec.Config
+	// every field which keeps us from reconciling is recorded, so that the
+	// error lists them all
+	var diff configDiffer
 
 	// Ignition section
-	// First check if this is a generally valid Ignition Config
-	rpt := validate.ValidateWithoutSource(reflect.ValueOf(newIgn))
+	// First check if this is a generally valid Ignition Config. The
+	// verification hashes of files are checked apart, as sha256 is supported
+	// too, and so are their sources and compressions.
+	for _, f := range ctrlcommon.CheckFileContents(newIgn) {
+		problem := fieldInvalid
+		if f.Unsupported {
+			problem = fieldUnsupported
+		}
+		diff.add(f.Path, problem, f.Detail)
+	}
+	rpt := ctrlcommon.ValidateIgnition(newIgn)
 	if rpt.IsFatal() {
 		return errors.Errorf("invalid Ignition config found: %v", rpt)
 	}
 
 	// if the config versions are different, all bets are off. this probably
 	// shouldn't happen, but if it does, we can't deal with it.
-	if oldIgn.Ignition.Version != newIgn.Ignition.Version {
-		return fmt.Errorf("ignition version mismatch between old and new config: old: %s new: %s",
-			oldIgn.Ignition.Version, newIgn.Ignition.Version)
-	}
+	diff.compare("spec.config.ignition.version", oldIgn.Ignition.Version, newIgn.Ignition.Version, fieldInvalid)
 	// everything else in the ignition section doesn't matter to us, since the
 	// rest of the stuff in this section has to do with fetching remote
 	// resources, and the mcc should've fully rendered those out before the
 	// config gets here.
 
-	// Networkd section
+	// Passwd section
 
-	// we don't currently configure the network in place. we can't fix it if
+	// we don't configure Users except for setting/updating SSHAuthorizedKeys
+	// for the only allowed user "core". otherwise we can't fix it if
 	// something changed here.
-	if !reflect.DeepEqual(oldIgn.Networkd, newIgn.Networkd) {
-		return errors.New("ignition networkd section contains changes")
+	if !reflect.DeepEqual(oldIgn.Passwd.Users, newIgn.Passwd.Users) {
+		// there is an update to Users, we must verify that it is ONLY making
+		// changes we apply: users other than system users added or removed,
+		// and their SSHAuthorizedKeys, PasswordHash and Groups changed
+		oldUsers := make(map[string]ignv2_2types.PasswdUser)
+		for _, user := range oldIgn.Passwd.Users {
+			oldUsers[user.Name] = user
+		}
+		for i, user := range newIgn.Passwd.Users {
+			glog.V(2).Infof("user data to be verified before passwd update: %s", user.Name)
+			verifyUserFields(&diff, fmt.Sprintf("spec.config.passwd.users[%d]", i), oldUsers[user.Name], user)
+		}
 	}
 
-	// Passwd section
+	// Unsupported sections
 
-	// we don't currently configure Groups in place. we don't configure Users except
-	// for setting/updating SSHAuthorizedKeys for the only allowed user "core".
-	// otherwise we can't fix it if something changed here.
-	if !reflect.DeepEqual(oldIgn.Passwd, newIgn.Passwd) {
-		if !reflect.DeepEqual(oldIgn.Passwd.Groups, newIgn.Passwd.Groups) {
-			return errors.New("ignition Passwd Groups section contains changes")
-		}
-		if !reflect.DeepEqual(oldIgn.Passwd.Users, newIgn.Passwd.Users) {
-			// check if the prior config is empty and that this is the first time running.
-			// if so, the SSHKey from the cluster config and user "core" must be added to machine config.
-			if len(oldIgn.Passwd.Users) >= 0 && len(newIgn.Passwd.Users) >= 1 {
-				// there is an update to Users, we must verify that it is ONLY making an acceptable
-				// change to the SSHAuthorizedKeys for the user "core"
-				for _, user := range newIgn.Passwd.Users {
-					if user.Name != coreUserName {
-						return errors.New("ignition passwd user section contains unsupported changes: non-core user")
-					}
-				}
-				glog.Infof("user data to be verified before ssh update: %v", newIgn.Passwd.Users[len(newIgn.Passwd.Users)-1])
-				if err := verifyUserFields(newIgn.Passwd.Users[len(newIgn.Passwd.Users)-1]); err != nil {
-					return err
-				}
-			}
-		}
+	// we don't currently configure the network, groups, disks, filesystems,
+	// RAID arrays or directories in place: see UnsupportedSections, which
+	// the render controller checks too. we can't fix it if something changed
+	// there; each changed field is named.
+	for _, s := range ctrlcommon.UnsupportedSections {
+		diff.compare(s.Path, s.Get(oldIgn), s.Get(newIgn), fieldUnsupported)
 	}
 
 	// Storage section
 
-	// we can only reconcile files right now. make sure the sections we can't
-	// fix aren't changed.
-	if !reflect.DeepEqual(oldIgn.Storage.Disks, newIgn.Storage.Disks) {
-		return errors.New("ignition disks section contains changes")
-	}
-	if !reflect.DeepEqual(oldIgn.Storage.Filesystems, newIgn.Storage.Filesystems) {
-		return errors.New("ignition filesystems section contains changes")
-	}
-	if !reflect.DeepEqual(oldIgn.Storage.Raid, newIgn.Storage.Raid) {
-		return errors.New("ignition raid section contains changes")
-	}
-	if !reflect.DeepEqual(oldIgn.Storage.Directories, newIgn.Storage.Directories) {
-		return errors.New("ignition directories section contains changes")
+	// we can only reconcile files and links right now, the other sections
+	// are checked above.
+
+	// files appended to are assembled from the config, see assembleFile, so
+	// writing them again is idempotent.
+
+	// Systemd section
+
+	// we can reconcile any state changes in the systemd section.
+
+	// Kernel type
+
+	// switching kernels needs a reboot, see computeUpdatePlan.
+	switch newConfig.Spec.KernelType {
+	case "", mcfgv1.KernelTypeDefault, mcfgv1.KernelTypeRealtime:
+	default:
+		diff.compare("spec.kernelType", oldConfig.Spec.KernelType, newConfig.Spec.KernelType, fieldInvalid)
 	}
-	if !reflect.DeepEqual(oldIgn.Storage.Links, newIgn.Storage.Links) {
-		// This means links have been added, as opposed as being removed as it happened with
-		// https://bugzilla.redhat.com/show_bug.cgi?id=1677198. This doesn't really change behavior
-		// since we still don't support links but we allow old MC to remove links when upgrading.
-		if len(newIgn.Storage.Links) != 0 {
-			return errors.New("ignition links section contains changes")
-		}
+
+	// FIPS mode
+
+	// FIPS mode is set at install time, it can't be switched on or off on a
+	// running node. A node not in the mode its config expects can't be
+	// updated into it either.
+	if oldConfig.Spec.FIPS != newConfig.Spec.FIPS {
+		diff.add("spec.fips", fieldUnsupported, fmt.Sprintf("%v -> %v: FIPS mode can only be set at install time", oldConfig.Spec.FIPS, newConfig.Spec.FIPS))
+	} else if err := dn.checkFIPS(newConfig); err != nil {
+		diff.add("spec.fips", fieldInvalid, err.Error())
 	}
 
-	// Special case files append: if the new config wants us to append, then we
-	// have to force a reprovision since it's not idempotent
-	for _, f := range newIgn.Storage.Files {
-		if f.Append {
-			return fmt.Errorf("ignition file %v includes append", f.Path)
+	// Kernel arguments
+
+	// we can apply any changes of the kernel arguments, but only by
+	// rebooting into them; see computeUpdatePlan. each must be a single
+	// argument though.
+	for i, karg := range newConfig.Spec.KernelArguments {
+		if karg == "" || strings.ContainsAny(karg, " \t\n") {
+			diff.add(fmt.Sprintf("spec.kernelArguments[%d]", i), fieldInvalid, fmt.Sprintf("%q is not a single argument", karg))
 		}
 	}
 
-	// Systemd section
+	// and whatever the update backend of the node can't apply
+	dn.updater().reconcilable(&diff, oldConfig, newConfig)
 
-	// we can reconcile any state changes in the systemd section.
+	if err := diff.err(); err != nil {
+		return err
+	}
 
 	// we made it through all the checks. reconcile away!
 	glog.V(2).Info("Configs are reconcilable")
 	return nil
 }
 
-// verifyUserFields returns nil if the user Name = "core", if 1 or more SSHKeys exist for
-// this user and if all other fields in User are empty.
-// Otherwise, an error will be returned and the proposed config will not be reconcilable.
-// At this time we do not support non-"core" users or any changes to the "core" user
-// outside of SSHAuthorizedKeys.
-func verifyUserFields(pwdUser ignv2_2types.PasswdUser) error {
-	emptyUser := ignv2_2types.PasswdUser{}
-	tempUser := pwdUser
-	if tempUser.Name == coreUserName && len(tempUser.SSHAuthorizedKeys) >= 1 {
-		tempUser.Name = ""
-		tempUser.SSHAuthorizedKeys = nil
-		if !reflect.DeepEqual(emptyUser, tempUser) {
-			return errors.New("ignition passwd user section contains unsupported changes: non-sshKey changes")
-		}
-		glog.Info("SSH Keys reconcilable")
-	} else {
-		return errors.New("ignition passwd user section contains unsupported changes: user must be core and have 1 or more sshKeys")
-	}
-	return nil
-}
-
 // updateFiles writes files specified by the nodeconfig to disk. it also writes
 // systemd units. there is no support for multiple filesystems at this point.
 //
@@ -389,48 +769,90 @@ func verifyUserFields(pwdUser ignv2_2types.PasswdUser) error {
 // ignition is built on the assumption that it is working with a fresh system,
 // where as we are trying to reconcile a system that has already been running.
 //
+// only the units which differ between the configs are written, masked,
+// enabled or disabled, and systemd is only told to reload its units, once,
+// if one of them or their dropins changed on disk, so updates which only
+// change files don't touch systemd at all.
+//
 // in the future, this function should do any additional work to confirm that
 // whatever has been written is picked up by the appropriate daemons, if
-// required. in particular, a daemon-reload and restart for any unit files
-// touched.
+// required. in particular, a restart for any unit files touched.
 func (dn *Daemon) updateFiles(oldConfig, newConfig *mcfgv1.MachineConfig) error {
 	glog.Info("Updating files")
 
 	if err := dn.writeFiles(newConfig.Spec.Config.Storage.Files); err != nil {
 		return err
 	}
-	if err := dn.writeUnits(newConfig.Spec.Config.Systemd.Units); err != nil {
+	if err := dn.writeLinks(newConfig.Spec.Config.Storage.Links); err != nil {
+		return err
+	}
+	written, err := dn.writeUnitFiles(unitsChangedIn(oldConfig, newConfig))
+	if err != nil {
 		return err
 	}
-	if err := dn.deleteStaleData(oldConfig, newConfig); err != nil {
+	deleted, err := dn.deleteStaleData(oldConfig, newConfig)
+	if err != nil {
 		return err
 	}
+	if written || deleted {
+		return daemonReload()
+	}
 	return nil
 }
 
+// unitsChangedIn returns the units of newConfig which oldConfig doesn't have
+// as they are, see changedUnits.
+func unitsChangedIn(oldConfig, newConfig *mcfgv1.MachineConfig) []ignv2_2types.Unit {
+	changed := make(map[string]bool)
+	for _, name := range changedUnits(oldConfig.Spec.Config.Systemd.Units, newConfig.Spec.Config.Systemd.Units) {
+		changed[name] = true
+	}
+	var units []ignv2_2types.Unit
+	for _, u := range newConfig.Spec.Config.Systemd.Units {
+		if changed[u.Name] {
+			units = append(units, u)
+		}
+	}
+	return units
+}
+
 // deleteStaleData performs a diff of the new and the old config. It then deletes
-// all the files, units that are present in the old config but not in the new one.
+// all the files, links, units that are present in the old config but not in the new one.
+// Files and links are only deleted if the daemon created them, and restored from their
+// backup if it wrote over them.
 // this function will error out if it fails to delete a file (with the exception
 // of simply warning if the error is ENOENT since that's the desired state).
-func (dn *Daemon) deleteStaleData(oldConfig, newConfig *mcfgv1.MachineConfig) error {
+// It returns whether a unit or dropin was removed, which systemd needs a
+// daemon-reload to notice.
+func (dn *Daemon) deleteStaleData(oldConfig, newConfig *mcfgv1.MachineConfig) (bool, error) {
 	glog.Info("Deleting stale data")
+	// paths still in the new config, as a file or as a link, are kept
 	newFileSet := make(map[string]struct{})
 	for _, f := range newConfig.Spec.Config.Storage.Files {
 		newFileSet[f.Path] = struct{}{}
 	}
+	for _, l := range newConfig.Spec.Config.Storage.Links {
+		newFileSet[l.Path] = struct{}{}
+	}
 
+	owned, err := loadOwnedFiles(dn.ownedFilesPath, dn.originalFilesDir)
+	if err != nil {
+		return false, err
+	}
 	for _, f := range oldConfig.Spec.Config.Storage.Files {
 		if _, ok := newFileSet[f.Path]; !ok {
 			glog.V(2).Infof("Deleting stale config file: %s", f.Path)
-			if err := os.Remove(f.Path); err != nil {
-				newErr := fmt.Errorf("unable to delete %s: %s", f.Path, err)
-				if !os.IsNotExist(err) {
-					return newErr
-				}
-				// otherwise, just warn
-				glog.Warningf("%v", newErr)
+			if _, err := owned.release(f.Path); err != nil {
+				return false, err
+			}
+		}
+	}
+	for _, l := range oldConfig.Spec.Config.Storage.Links {
+		if _, ok := newFileSet[l.Path]; !ok {
+			glog.V(2).Infof("Deleting stale link: %s", l.Path)
+			if _, err := owned.release(l.Path); err != nil {
+				return false, err
 			}
-			glog.Infof("Removed stale file %q", f.Path)
 		}
 	}
 
@@ -445,20 +867,18 @@ func (dn *Daemon) deleteStaleData(oldConfig, newConfig *mcfgv1.MachineConfig) er
 		newUnitSet[path] = struct{}{}
 	}
 
+	var unitsChanged bool
 	for _, u := range oldConfig.Spec.Config.Systemd.Units {
 		for j := range u.Dropins {
 			path := filepath.Join(pathSystemd, u.Name+".d", u.Dropins[j].Name)
 			if _, ok := newDropinSet[path]; !ok {
 				glog.V(2).Infof("Deleting stale systemd dropin file: %s", path)
-				if err := os.Remove(path); err != nil {
-					newErr := fmt.Errorf("unable to delete %s: %s", path, err)
-					if !os.IsNotExist(err) {
-						return newErr
-					}
-					// otherwise, just warn
-					glog.Warningf("%v", newErr)
+				released, err := owned.release(path)
+				if err != nil {
+					return false, err
 				}
-				glog.Infof("Removed stale systemd dropin %q", path)
+				unitsChanged = unitsChanged || released
+				removeEmptyDropinDir(filepath.Dir(path))
 			}
 		}
 		path := filepath.Join(pathSystemd, u.Name)
@@ -470,16 +890,17 @@ func (dn *Daemon) deleteStaleData(oldConfig, newConfig *mcfgv1.MachineConfig) er
 			if err := os.Remove(path); err != nil {
 				newErr := fmt.Errorf("unable to delete %s: %s", path, err)
 				if !os.IsNotExist(err) {
-					return newErr
+					return false, newErr
 				}
 				// otherwise, just warn
 				glog.Warningf("%v", newErr)
 			}
 			glog.Infof("Removed stale systemd unit %q", path)
+			unitsChanged = true
 		}
 	}
 
-	return nil
+	return unitsChanged, nil
 }
 
 // enableUnit enables a systemd unit via symlink
@@ -517,51 +938,86 @@ func (dn *Daemon) disableUnit(unit ignv2_2types.Unit) error {
 	return os.Remove(wantsPath)
 }
 
-// writeUnits writes the systemd units to disk
+// writeUnits writes the systemd units to disk, and reloads systemd if any of
+// them changed.
 func (dn *Daemon) writeUnits(units []ignv2_2types.Unit) error {
+	changed, err := dn.writeUnitFiles(units)
+	if err != nil {
+		return err
+	}
+	if changed {
+		return daemonReload()
+	}
+	return nil
+}
+
+// writeUnitFiles writes the systemd units to disk, masking, enabling and
+// disabling them as the config says. It returns whether a unit or dropin
+// changed, which systemd needs a daemon-reload to notice.
+func (dn *Daemon) writeUnitFiles(units []ignv2_2types.Unit) (bool, error) {
+	owned, err := loadOwnedFiles(dn.ownedFilesPath, dn.originalFilesDir)
+	if err != nil {
+		return false, err
+	}
+	var changed bool
 	for _, u := range units {
 		// write the dropin to disk
 		for i := range u.Dropins {
-			glog.Infof("Writing systemd unit dropin %q", u.Dropins[i].Name)
 			dpath := filepath.Join(pathSystemd, u.Name+".d", u.Dropins[i].Name)
-			if err := writeFileAtomicallyWithDefaults(dpath, []byte(u.Dropins[i].Contents)); err != nil {
-				return fmt.Errorf("failed to write systemd unit dropin %q: %v", u.Dropins[i].Name, err)
+			contents := []byte(u.Dropins[i].Contents)
+			if err := owned.claim(dpath, contents); err != nil {
+				return false, err
+			}
+			if isUnitFileUpToDate(dpath, contents) {
+				continue
 			}
+			glog.Infof("Writing systemd unit dropin %q", u.Dropins[i].Name)
+			if err := writeFileAtomicallyWithDefaults(dpath, contents); err != nil {
+				return false, fmt.Errorf("failed to write systemd unit dropin %q: %v", u.Dropins[i].Name, err)
+			}
+			changed = true
 
 			glog.V(2).Infof("Wrote systemd unit dropin at %s", dpath)
 		}
 
-		if u.Contents == "" {
-			continue
-		}
-
-		glog.Infof("Writing systemd unit %q", u.Name)
-
 		fpath := filepath.Join(pathSystemd, u.Name)
 
 		// check if the unit is masked. if it is, we write a symlink to
 		// /dev/null and continue
 		if u.Mask {
-			glog.V(2).Info("Systemd unit masked")
-			if err := os.RemoveAll(fpath); err != nil {
-				return fmt.Errorf("failed to remove unit %q: %v", u.Name, err)
+			masked, err := maskUnit(fpath)
+			if err != nil {
+				return false, fmt.Errorf("failed to mask unit %q: %v", u.Name, err)
 			}
-			glog.V(2).Infof("Removed unit %q", u.Name)
-
-			if err := renameio.Symlink(pathDevNull, fpath); err != nil {
-				return fmt.Errorf("failed to symlink unit %q to %s: %v", u.Name, pathDevNull, err)
+			if masked {
+				glog.Infof("Masked systemd unit %q", u.Name)
+				changed = true
 			}
-			glog.V(2).Infof("Created symlink unit %q to %s", u.Name, pathDevNull)
+			continue
+		}
+		unmasked, err := unmaskUnit(fpath)
+		if err != nil {
+			return false, fmt.Errorf("failed to unmask unit %q: %v", u.Name, err)
+		}
+		if unmasked {
+			glog.Infof("Unmasked systemd unit %q", u.Name)
+			changed = true
+		}
 
+		if u.Contents == "" {
 			continue
 		}
 
 		// write the unit to disk
-		if err := writeFileAtomicallyWithDefaults(fpath, []byte(u.Contents)); err != nil {
-			return fmt.Errorf("failed to write systemd unit %q: %v", u.Name, err)
-		}
+		if !isUnitFileUpToDate(fpath, []byte(u.Contents)) {
+			glog.Infof("Writing systemd unit %q", u.Name)
+			if err := writeFileAtomicallyWithDefaults(fpath, []byte(u.Contents)); err != nil {
+				return false, fmt.Errorf("failed to write systemd unit %q: %v", u.Name, err)
+			}
+			changed = true
 
-		glog.V(2).Infof("Successfully wrote systemd unit %q: ", u.Name)
+			glog.V(2).Infof("Successfully wrote systemd unit %q: ", u.Name)
+		}
 
 		// if the unit doesn't note if it should be enabled or disabled then
 		// skip all linking.
@@ -570,40 +1026,126 @@ func (dn *Daemon) writeUnits(units []ignv2_2types.Unit) error {
 		// disabled. even if the unit wasn't previously enabled the result will
 		// be fine as disableUnit is idempotent.
 		// Note: we have to check for legacy unit.Enable and honor it
-		glog.Infof("Enabling systemd unit %q", u.Name)
 		if u.Enable {
 			if err := dn.enableUnit(u); err != nil {
-				return err
+				return false, err
 			}
 			glog.V(2).Infof("Enabled systemd unit %q", u.Name)
 		}
 		if u.Enabled != nil {
 			if *u.Enabled {
 				if err := dn.enableUnit(u); err != nil {
-					return err
+					return false, err
 				}
 				glog.V(2).Infof("Enabled systemd unit %q", u.Name)
 			} else {
 				if err := dn.disableUnit(u); err != nil {
-					return err
+					return false, err
 				}
 				glog.V(2).Infof("Disabled systemd unit %q", u.Name)
 			}
 		}
 	}
-	return nil
+	return changed, nil
+}
+
+// removeEmptyDropinDir removes the dropin directory dir of a unit once its
+// last dropin is gone.
+func removeEmptyDropinDir(dir string) {
+	if err := os.Remove(dir); err == nil {
+		glog.Infof("Removed empty dropin directory %q", dir)
+	} else if !os.IsNotExist(err) {
+		glog.V(2).Infof("Keeping dropin directory %q: %v", dir, err)
+	}
+}
+
+// isUnitFileUpToDate returns whether the unit or dropin at fpath already has
+// contents and the default mode, so writing it would change nothing.
+func isUnitFileUpToDate(fpath string, contents []byte) bool {
+	fi, err := os.Lstat(fpath)
+	if err != nil || fi.Mode() != defaultFilePermissions {
+		return false
+	}
+	return hasContents(fpath, contents)
+}
+
+// isMasked returns whether the unit at fpath is a symlink to /dev/null.
+func isMasked(fpath string) (bool, error) {
+	fi, err := os.Lstat(fpath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return false, nil
+	}
+	target, err := os.Readlink(fpath)
+	if err != nil {
+		return false, err
+	}
+	return target == pathDevNull, nil
+}
+
+// maskUnit replaces the unit at fpath with a symlink to /dev/null, returning
+// whether it wasn't masked already.
+func maskUnit(fpath string) (bool, error) {
+	masked, err := isMasked(fpath)
+	if err != nil || masked {
+		return false, err
+	}
+	if err := os.RemoveAll(fpath); err != nil {
+		return false, err
+	}
+	glog.V(2).Infof("Removed unit %q", fpath)
+	if err := renameio.Symlink(pathDevNull, fpath); err != nil {
+		return false, fmt.Errorf("failed to symlink %q to %s: %v", fpath, pathDevNull, err)
+	}
+	glog.V(2).Infof("Created symlink unit %q to %s", fpath, pathDevNull)
+	return true, nil
+}
+
+// unmaskUnit removes the /dev/null symlink masking the unit at fpath,
+// returning whether it was masked.
+func unmaskUnit(fpath string) (bool, error) {
+	masked, err := isMasked(fpath)
+	if err != nil || !masked {
+		return false, err
+	}
+	if err := os.Remove(fpath); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// daemonReload makes systemd reread its units, it is swapped out by tests.
+var daemonReload = func() error {
+	return runSystemctl("daemon-reload")
 }
 
 // writeFiles writes the given files to disk.
-// it doesn't fetch remote files and expects a flattened config file.
+// it doesn't fetch remote files, their contents are expected to have been
+// cached by fetchRemoteSources.
 func (dn *Daemon) writeFiles(files []ignv2_2types.File) error {
+	owned, err := loadOwnedFiles(dn.ownedFilesPath, dn.originalFilesDir)
+	if err != nil {
+		return err
+	}
+	files, err = assembleFiles(files)
+	if err != nil {
+		return err
+	}
 	for _, file := range files {
 		glog.Infof("Writing file %q", file.Path)
 
-		contents, err := dataurl.DecodeString(file.Contents.Source)
+		contents, err := decodeFileContents(file)
 		if err != nil {
 			return err
 		}
+		if err := verifyFileHash(file.Path, file.Contents.Verification, contents); err != nil {
+			return err
+		}
 		mode := defaultFilePermissions
 		if file.Mode != nil {
 			mode = os.FileMode(*file.Mode)
@@ -618,7 +1160,13 @@ func (dn *Daemon) writeFiles(files []ignv2_2types.File) error {
 				return fmt.Errorf("failed to retrieve file ownership for file %q: %v", file.Path, err)
 			}
 		}
-		if err := writeFileAtomically(file.Path, contents.Data, defaultDirectoryPermissions, mode, uid, gid); err != nil {
+		if err := owned.claim(file.Path, contents); err != nil {
+			return err
+		}
+		if err := writeFileAtomically(file.Path, contents, defaultDirectoryPermissions, mode, uid, gid); err != nil {
+			return err
+		}
+		if err := verifyWrittenFile(file.Path, file.Contents.Verification); err != nil {
 			return err
 		}
 	}
@@ -626,74 +1174,99 @@ func (dn *Daemon) writeFiles(files []ignv2_2types.File) error {
 }
 
 // This is essentially ResolveNodeUidAndGid() from Ignition; XXX should dedupe
+//
+// Names are resolved against the host databases on every call, rather than
+// once when rendering, since their ids may differ between OS versions.
 func getFileOwnership(file ignv2_2types.File) (int, int, error) {
 	uid, gid := 0, 0 // default to root
 	if file.User != nil {
 		if file.User.ID != nil {
 			uid = *file.User.ID
 		} else if file.User.Name != "" {
-			osUser, err := user.Lookup(file.User.Name)
+			id, err := lookupHostUID(file.User.Name)
 			if err != nil {
-				return uid, gid, fmt.Errorf("failed to retrieve UserID for username: %s", file.User.Name)
+				return uid, gid, err
 			}
-			glog.V(2).Infof("Retrieved UserId: %s for username: %s", osUser.Uid, file.User.Name)
-			uid, _ = strconv.Atoi(osUser.Uid)
+			glog.V(2).Infof("Retrieved UserId: %d for username: %s", id, file.User.Name)
+			uid = id
 		}
 	}
 	if file.Group != nil {
 		if file.Group.ID != nil {
 			gid = *file.Group.ID
 		} else if file.Group.Name != "" {
-			osGroup, err := user.LookupGroup(file.Group.Name)
+			id, err := lookupHostGID(file.Group.Name)
 			if err != nil {
-				return uid, gid, fmt.Errorf("failed to retrieve GroupID for group: %s", file.Group.Name)
+				return uid, gid, err
 			}
-			glog.V(2).Infof("Retrieved GroupID: %s for group: %s", osGroup.Gid, file.Group.Name)
-			gid, _ = strconv.Atoi(osGroup.Gid)
+			glog.V(2).Infof("Retrieved GroupID: %d for group: %s", id, file.Group.Name)
+			gid = id
 		}
 	}
 	return uid, gid, nil
 }
 
+// atomicallyWriteSSHKey writes keys to the authorized_keys of newUser, in
+// the .ssh directory of its home.
 func (dn *Daemon) atomicallyWriteSSHKey(newUser ignv2_2types.PasswdUser, keys string) error {
-	authKeyPath := filepath.Join(coreUserSSHPath, "authorized_keys")
-
-	// Keys should only be written to "/home/core/.ssh"
-	// Once Users are supported fully this should be writing to PasswdUser.HomeDir
+	sshPath := coreUserSSHPath
+	if newUser.Name != coreUserName {
+		u, err := lookupHostUser(newUser.Name)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve home directory for username: %s", newUser.Name)
+		}
+		sshPath = filepath.Join(u.HomeDir, ".ssh")
+	}
+	authKeyPath := filepath.Join(sshPath, "authorized_keys")
 	glog.Infof("Writing SSHKeys at %q", authKeyPath)
 
-	if err := writeFileAtomicallyWithDefaults(authKeyPath, []byte(keys)); err != nil {
+	uid, gid, err := lookupUserIDs(newUser.Name)
+	if err != nil {
 		return err
 	}
+	// sshd refuses keys in files or directories writable by others, so both
+	// need to be owned by the user and private to it
+	if err := os.MkdirAll(sshPath, coreUserSSHDirPermissions); err != nil {
+		return fmt.Errorf("failed to create directory %q: %v", sshPath, err)
+	}
+	if err := os.Chown(sshPath, uid, gid); err != nil {
+		return fmt.Errorf("failed to change ownership of %q: %v", sshPath, err)
+	}
+	if err := writeFileAtomically(authKeyPath, []byte(keys), coreUserSSHDirPermissions, coreUserSSHKeysPermissions, uid, gid); err != nil {
+		return err
+	}
+	// the temporary file gets the SELinux label of the directory it was created
+	// in, restore the ssh_home_t label sshd needs to read it
+	if out, err := exec.Command("restorecon", "-R", sshPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to restore SELinux context of %q: %s: %v", sshPath, string(out), err)
+	}
 
 	glog.V(2).Infof("Wrote SSHKeys at %s", authKeyPath)
 
 	return nil
 }
 
-// Update a given PasswdUser's SSHKey
-func (dn *Daemon) updateSSHKeys(newUsers []ignv2_2types.PasswdUser) error {
-	if len(newUsers) == 0 {
-		return nil
+// lookupUserIDs returns the uid and gid of the named user.
+func lookupUserIDs(name string) (int, int, error) {
+	u, err := lookupHostUser(name)
+	if err != nil {
+		return -1, -1, fmt.Errorf("failed to retrieve UserID for username: %s", name)
 	}
-
-	// we're also appending all keys for any user to core, so for now
-	// we pass this to atomicallyWriteSSHKeys to write.
-	var concatSSHKeys string
-	for _, k := range newUsers[len(newUsers)-1].SSHAuthorizedKeys {
-		concatSSHKeys = concatSSHKeys + string(k) + "\n"
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return -1, -1, fmt.Errorf("invalid UserID %q for username: %s", u.Uid, name)
 	}
-	// newUsers[0] is currently unused since we write keys only for the core user
-	if err := dn.atomicSSHKeysWriter(newUsers[0], concatSSHKeys); err != nil {
-		return err
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return -1, -1, fmt.Errorf("invalid GroupID %q for username: %s", u.Gid, name)
 	}
-	return nil
+	return uid, gid, nil
 }
 
 // updateOS updates the system OS to the one specified in newConfig
 func (dn *Daemon) updateOS(config *mcfgv1.MachineConfig) error {
-	if dn.OperatingSystem != machineConfigDaemonOSRHCOS {
-		glog.V(2).Info("Updating of non RHCOS nodes are not supported")
+	if !dn.updater().managesOSImage() {
+		glog.V(2).Infof("The %s update backend doesn't update the OS image", dn.updater().name())
 		return nil
 	}
 
@@ -707,8 +1280,18 @@ func (dn *Daemon) updateOS(config *mcfgv1.MachineConfig) error {
 	}
 
 	glog.Infof("Updating OS to %s", newURL)
-	if err := dn.NodeUpdaterClient.RunPivot(newURL); err != nil {
-		return fmt.Errorf("failed to run pivot: %v", err)
+	startedAt := time.Now().UTC()
+	var published time.Time
+	progress := func(line string) {
+		if time.Since(published) < pivotProgressInterval {
+			return
+		}
+		published = time.Now()
+		dn.publishUpdateProgress(updatePhaseUpdatingOS, startedAt, fmt.Sprintf("updating to %s: %s", config.GetName(), line))
+	}
+	if err := dn.updater().updateOS(newURL, progress); err != nil {
+		pivotErrors.Inc()
+		return fmt.Errorf("failed to update OS to %s: %v", newURL, err)
 	}
 
 	return nil
@@ -756,9 +1339,14 @@ func (dn *Daemon) reboot(rationale string, timeout time.Duration, rebootCmd *exe
 		dn.recorder.Eventf(getNodeRef(dn.node), corev1.EventTypeNormal, "Reboot", rationale)
 	}
 	dn.logSystem("machine-config-daemon initiating reboot: %s", rationale)
+	logLifecycle(sdMessageUpdateReboot, journalPriInfo, "machine-config-daemon initiating reboot: "+rationale, map[string]string{
+		"PHASE": updatePhaseRebooting,
+	})
 
 	// Now that everything is done, avoid delaying shutdown.
 	dn.cancelSIGTERM()
+	dn.stopHandlingTermination()
+	dn.releaseShutdownInhibitor()
 
 	dn.Close()
 
@@ -769,6 +1357,7 @@ func (dn *Daemon) reboot(rationale string, timeout time.Duration, rebootCmd *exe
 
 	// reboot, executed async via systemd-run so that the reboot command is executed
 	// in the context of the host asynchronously from us
+	reboots.Inc()
 	err := rebootCmd.Run()
 	if err != nil {
 		return errors.Wrapf(err, "Failed to reboot")
@@ -2,14 +2,20 @@ package daemon
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"os/user"
+	"path/filepath"
 	"testing"
 
 	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
 	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	k8sfake "k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
 )
 
 // TestUpdateOS verifies the return errors from attempting to update the OS follow expectations
@@ -237,14 +243,27 @@ func TestReconcilableSSH(t *testing.T) {
 	errMsg := d.reconcilable(oldMcfg, newMcfg)
 	checkReconcilableResults(t, "SSH", errMsg)
 
-	// 	Check that updating User with User that is not core is not supported
+	// Check that adding regular users other than core is supported, but not
+	// managing system users
+	defer func(orig func(string) (*user.User, error)) { lookupHostUser = orig }(lookupHostUser)
+	lookupHostUser = func(name string) (*user.User, error) {
+		if name == "daemon" {
+			return &user.User{Username: name, Uid: "2"}, nil
+		}
+		return nil, user.UnknownUserError(name)
+	}
 	tempUser2 := ignv2_2types.PasswdUser{Name: "core", SSHAuthorizedKeys: []ignv2_2types.SSHAuthorizedKey{"1234"}}
 	oldMcfg.Spec.Config.Passwd.Users = append(oldMcfg.Spec.Config.Passwd.Users, tempUser2)
 	tempUser3 := ignv2_2types.PasswdUser{Name: "another user", SSHAuthorizedKeys: []ignv2_2types.SSHAuthorizedKey{"5678"}}
-	newMcfg.Spec.Config.Passwd.Users[0] = tempUser3
+	newMcfg.Spec.Config.Passwd.Users = []ignv2_2types.PasswdUser{tempUser2, tempUser3}
 
+	errMsg = d.reconcilable(oldMcfg, newMcfg)
+	checkReconcilableResults(t, "SSH", errMsg)
+
+	newMcfg.Spec.Config.Passwd.Users[1].Name = "daemon"
 	errMsg = d.reconcilable(oldMcfg, newMcfg)
 	checkIrreconcilableResults(t, "SSH", errMsg)
+	newMcfg.Spec.Config.Passwd.Users = newMcfg.Spec.Config.Passwd.Users[:1]
 
 	// check that we cannot make updates if any other Passwd.User field is changed.
 	tempUser4 := ignv2_2types.PasswdUser{Name: "core", SSHAuthorizedKeys: []ignv2_2types.SSHAuthorizedKey{"5678"}, HomeDir: "somedir"}
@@ -253,7 +272,7 @@ func TestReconcilableSSH(t *testing.T) {
 	errMsg = d.reconcilable(oldMcfg, newMcfg)
 	checkIrreconcilableResults(t, "SSH", errMsg)
 
-	// check that we cannot add a user or have len(Passwd.Users)> 1
+	// check that the other fields of a user added can't be set either
 	tempUser5 := ignv2_2types.PasswdUser{Name: "some user", SSHAuthorizedKeys: []ignv2_2types.SSHAuthorizedKey{"5678"}}
 	newMcfg.Spec.Config.Passwd.Users = append(newMcfg.Spec.Config.Passwd.Users, tempUser5)
 
@@ -276,6 +295,119 @@ func TestReconcilableSSH(t *testing.T) {
 
 }
 
+func TestReconcilableUnitMasks(t *testing.T) {
+	d := Daemon{
+		name:             "nodeName",
+		OperatingSystem:  machineConfigDaemonOSRHCOS,
+		kubeClient:       k8sfake.NewSimpleClientset(),
+		rootMount:        "/",
+		bootedOSImageURL: "test",
+	}
+	newConfig := func(mask bool) *mcfgv1.MachineConfig {
+		return &mcfgv1.MachineConfig{
+			Spec: mcfgv1.MachineConfigSpec{
+				Config: ignv2_2types.Config{
+					Ignition: ignv2_2types.Ignition{Version: "2.2.0"},
+					Systemd: ignv2_2types.Systemd{
+						Units: []ignv2_2types.Unit{{Name: "docker.service", Mask: mask}},
+					},
+				},
+			},
+		}
+	}
+
+	checkReconcilableResults(t, "mask", d.reconcilable(newConfig(false), newConfig(true)))
+	checkReconcilableResults(t, "unmask", d.reconcilable(newConfig(true), newConfig(false)))
+}
+
+func TestMaskUnit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-mask")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	unit := filepath.Join(dir, "docker.service")
+	require.Nil(t, ioutil.WriteFile(unit, []byte("[Unit]"), 0644))
+
+	changed, err := maskUnit(unit)
+	require.Nil(t, err)
+	assert.True(t, changed)
+	target, err := os.Readlink(unit)
+	require.Nil(t, err)
+	assert.Equal(t, pathDevNull, target)
+
+	// masking again changes nothing, so needs no daemon-reload
+	changed, err = maskUnit(unit)
+	require.Nil(t, err)
+	assert.False(t, changed)
+
+	changed, err = unmaskUnit(unit)
+	require.Nil(t, err)
+	assert.True(t, changed)
+	_, err = os.Lstat(unit)
+	assert.True(t, os.IsNotExist(err))
+
+	changed, err = unmaskUnit(unit)
+	require.Nil(t, err)
+	assert.False(t, changed)
+
+	// a unit which isn't masked is left alone
+	require.Nil(t, ioutil.WriteFile(unit, []byte("[Unit]"), 0644))
+	changed, err = unmaskUnit(unit)
+	require.Nil(t, err)
+	assert.False(t, changed)
+	_, err = os.Stat(unit)
+	assert.Nil(t, err)
+}
+
+func TestUnitsChangedIn(t *testing.T) {
+	enabled := true
+	kubelet := ignv2_2types.Unit{Name: "kubelet.service", Contents: "[Service]\nExecStart=/usr/bin/kubelet\n", Enabled: &enabled}
+	crio := ignv2_2types.Unit{Name: "crio.service", Dropins: []ignv2_2types.SystemdDropin{{Name: "10-env.conf", Contents: "[Service]\n"}}}
+	withUnits := func(units ...ignv2_2types.Unit) *mcfgv1.MachineConfig {
+		return &mcfgv1.MachineConfig{Spec: mcfgv1.MachineConfigSpec{Config: ignv2_2types.Config{Systemd: ignv2_2types.Systemd{Units: units}}}}
+	}
+	oldConfig := withUnits(kubelet, crio)
+	assert.Empty(t, unitsChangedIn(oldConfig, withUnits(kubelet, crio)))
+
+	newCrio := crio
+	newCrio.Dropins = []ignv2_2types.SystemdDropin{{Name: "10-env.conf", Contents: "[Service]\nEnvironment=A=B\n"}}
+	newConfig := withUnits(kubelet, newCrio)
+	changed := unitsChangedIn(oldConfig, newConfig)
+	require.Len(t, changed, 1, "only the unit whose dropin changed is written")
+	assert.Equal(t, "crio.service", changed[0].Name)
+
+	newConfig = withUnits(kubelet)
+	assert.Empty(t, unitsChangedIn(oldConfig, newConfig), "removed units are left to deleteStaleData")
+}
+
+func TestUpdateFilesWithoutUnitChanges(t *testing.T) {
+	defer func(orig func() error) { daemonReload = orig }(daemonReload)
+	reloads := 0
+	daemonReload = func() error {
+		reloads++
+		return nil
+	}
+	dir, err := ioutil.TempDir("", "mcd-units")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dn := &Daemon{
+		ownedFilesPath:   filepath.Join(dir, "owned-files.json"),
+		originalFilesDir: filepath.Join(dir, "orig"),
+	}
+
+	// the unit would be written, and systemd reloaded, if it was looked at
+	units := []ignv2_2types.Unit{{Name: "mcd-test-unchanged.service", Contents: "[Service]\nExecStart=/bin/true\n"}}
+	oldConfig := newTestMachineConfig("old", []ignv2_2types.File{newTestFile(filepath.Join(dir, "foo"), "old")}, units)
+	newConfig := newTestMachineConfig("new", []ignv2_2types.File{newTestFile(filepath.Join(dir, "foo"), "new")}, units)
+	require.Nil(t, dn.updateFiles(oldConfig, newConfig))
+	assert.Equal(t, 0, reloads, "systemd isn't reloaded for files")
+	b, err := ioutil.ReadFile(filepath.Join(dir, "foo"))
+	require.Nil(t, err)
+	assert.Equal(t, "new", string(b))
+	_, err = os.Lstat(filepath.Join(pathSystemd, "mcd-test-unchanged.service"))
+	assert.True(t, os.IsNotExist(err), "unchanged units aren't written")
+}
+
 func TestUpdateSSHKeys(t *testing.T) {
 	// expectedError is the error we will use when expecting an error to return
 	expectedError := fmt.Errorf("broken")
@@ -313,7 +445,7 @@ func TestUpdateSSHKeys(t *testing.T) {
 
 	d.atomicSSHKeysWriter = func(user ignv2_2types.PasswdUser, keys string) error { return nil }
 
-	err := d.updateSSHKeys(newMcfg.Spec.Config.Passwd.Users)
+	err := d.updatePasswd(nil, newMcfg.Spec.Config.Passwd.Users)
 	if err != nil {
 		t.Errorf("Expected no error. Got %s.", err)
 
@@ -321,7 +453,7 @@ func TestUpdateSSHKeys(t *testing.T) {
 
 	// if Users is empty, nothing should happen and no error should ever be generated
 	newMcfg2 := &mcfgv1.MachineConfig{}
-	err = d.updateSSHKeys(newMcfg2.Spec.Config.Passwd.Users)
+	err = d.updatePasswd(newMcfg.Spec.Config.Passwd.Users, newMcfg2.Spec.Config.Passwd.Users)
 	if err != nil {
 		t.Errorf("Expected no error. Got: %s", err)
 	}
@@ -417,3 +549,99 @@ func TestSkipReboot(t *testing.T) {
 	}
 	require.NotNil(t, d.reboot("", 0, exec.Command("true")))
 }
+
+func TestWriteFileAtomically(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-write")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sub", "kubelet.conf")
+	require.Nil(t, writeFileAtomically(path, []byte("new"), defaultDirectoryPermissions, 0600, -1, -1))
+	contents, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "new", string(contents))
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode())
+
+	// replacing keeps no temporary files around
+	require.Nil(t, writeFileAtomically(path, []byte("newer"), defaultDirectoryPermissions, 0644, -1, -1))
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	require.Nil(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestWriteFileAtomicallyFailureBeforeRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-write")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "kubelet.conf")
+	require.Nil(t, ioutil.WriteFile(path, []byte("original"), 0644))
+
+	// fail as if the daemon crashed after writing the new contents out
+	var written string
+	renameFile = func(oldpath, newpath string) error {
+		b, err := ioutil.ReadFile(oldpath)
+		require.Nil(t, err)
+		written = string(b)
+		return fmt.Errorf("crashed")
+	}
+	defer func() { renameFile = os.Rename }()
+
+	err = writeFileAtomically(path, []byte("half written"), defaultDirectoryPermissions, 0644, -1, -1)
+	require.NotNil(t, err)
+	assert.Equal(t, "half written", written)
+
+	contents, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	assert.Equal(t, "original", string(contents))
+	entries, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	assert.Len(t, entries, 1, "temporary file was not cleaned up")
+}
+
+func TestWriteFileAtomicallySymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-write")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target")
+	require.Nil(t, ioutil.WriteFile(target, []byte("target"), 0644))
+	link := filepath.Join(dir, "link")
+	require.Nil(t, os.Symlink(target, link))
+
+	require.NotNil(t, writeFileAtomically(link, []byte("new"), defaultDirectoryPermissions, 0644, -1, -1))
+	contents, err := ioutil.ReadFile(target)
+	require.Nil(t, err)
+	assert.Equal(t, "target", string(contents))
+	fi, err := os.Lstat(link)
+	require.Nil(t, err)
+	assert.True(t, fi.Mode()&os.ModeSymlink != 0, "symlink was replaced")
+}
+
+func TestCordonSetsWorking(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{
+		constants.MachineConfigDaemonStateAnnotationKey: constants.MachineConfigDaemonStateDone,
+	})
+	client := k8sfake.NewSimpleClientset(node)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), newTestNodeLister(t, node), node.Name)
+	go nw.Run(stopCh)
+	dn := &Daemon{name: node.Name, node: node, kubeClient: client, nodeWriter: nw}
+
+	require.Nil(t, dn.cordon())
+
+	var patches []string
+	for _, a := range client.Actions() {
+		if p, ok := a.(core.PatchAction); ok {
+			patches = append(patches, string(p.GetPatch()))
+		}
+	}
+	// the bootstrap pivot cordons a node which update() didn't set Working
+	require.Len(t, patches, 1, "cordoning and the state go out in a single patch")
+	assert.Contains(t, patches[0], `"unschedulable":true`)
+	assert.Contains(t, patches[0], fmt.Sprintf("%q:%q", constants.MachineConfigDaemonStateAnnotationKey, constants.MachineConfigDaemonStateWorking))
+}
@@ -0,0 +1,204 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxUpdateAttempts is the number of consecutive failed attempts after
+	// which an update isn't retried anymore, until it is reset
+	maxUpdateAttempts = 5
+
+	// resetUpdateAttemptsAnnotationKey set to "true" resets the failed
+	// attempts of the update of a node, so it is retried right away. The
+	// daemon removes it once it acted on it.
+	resetUpdateAttemptsAnnotationKey = "machineconfiguration.openshift.io/reset-update-attempts"
+)
+
+// updateAttemptBackoffs are the pauses after each failed attempt of an update,
+// the last one repeating.
+var updateAttemptBackoffs = []time.Duration{1 * time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// updateFailures are the consecutive failed attempts of the update to Config.
+type updateFailures struct {
+	Config      string    `json:"config"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError"`
+	LastFailure time.Time `json:"lastFailure"`
+}
+
+// retryIn returns how long to wait at now before attempting the update again,
+// zero if it can be attempted right away.
+func (f *updateFailures) retryIn(now time.Time) time.Duration {
+	i := f.Attempts - 1
+	if i >= len(updateAttemptBackoffs) {
+		i = len(updateAttemptBackoffs) - 1
+	}
+	if wait := f.LastFailure.Add(updateAttemptBackoffs[i]).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// updateAttemptsError is returned for a failed update attempt. The update is
+// retried in retryIn, or never if it is zero as it failed too many times.
+type updateAttemptsError struct {
+	config   string
+	attempts int
+	retryIn  time.Duration
+	lastErr  string
+}
+
+func (e *updateAttemptsError) Error() string {
+	if e.retryIn == 0 {
+		return fmt.Sprintf("max retries exceeded, update to %s failed %d times: %s", e.config, e.attempts, e.lastErr)
+	}
+	return fmt.Sprintf("update to %s failed (attempt %d of %d), retrying in %v: %s", e.config, e.attempts, maxUpdateAttempts, e.retryIn.Round(time.Second), e.lastErr)
+}
+
+func newUpdateAttemptsError(f *updateFailures, now time.Time) *updateAttemptsError {
+	e := &updateAttemptsError{config: f.Config, attempts: f.Attempts, lastErr: f.LastError}
+	if f.Attempts < maxUpdateAttempts {
+		e.retryIn = f.retryIn(now)
+	}
+	return e
+}
+
+// loadDaemonState reads the state file, an empty state if there is none.
+func (dn *Daemon) loadDaemonState() (*daemonState, error) {
+	s := &daemonState{}
+	b, err := ioutil.ReadFile(dn.stateFilePath)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "loading transient state")
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, errors.Wrapf(err, "parsing transient state")
+	}
+	return s, nil
+}
+
+// loadUpdateFailures returns the failed attempts recorded in the state file.
+func (dn *Daemon) loadUpdateFailures() (*updateFailures, error) {
+	s, err := dn.loadDaemonState()
+	if err != nil {
+		return nil, err
+	}
+	return s.UpdateFailures, nil
+}
+
+// saveUpdateFailures records f in the state file, keeping the pending config
+// it may have. A nil f clears the failed attempts, and the file along with
+// them if nothing else is left in it.
+func (dn *Daemon) saveUpdateFailures(f *updateFailures) error {
+	dn.status.update(func(s *daemonState) {
+		s.UpdateFailures = f
+	})
+	if dn.stateFilePath == "" {
+		return nil
+	}
+	s, err := dn.loadDaemonState()
+	if err != nil {
+		return err
+	}
+	if s.UpdateFailures == nil && f == nil {
+		return nil
+	}
+	s.UpdateFailures = f
+	if f == nil && s.PendingConfig == "" {
+		if err := os.Remove(dn.stateFilePath); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "removing transient state file")
+		}
+		return nil
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomicallyWithDefaults(dn.stateFilePath, b)
+}
+
+// recordUpdateFailure counts the failed attempt to update to desiredConfig
+// with err, and returns the updateAttemptsError to handle it with. Errors
+// which retrying can't help with aren't counted and are returned unchanged,
+// they are handled as before.
+func (dn *Daemon) recordUpdateFailure(desiredConfig *mcfgv1.MachineConfig, err error) error {
+	cause := errors.Cause(err)
+	if isPermanentError(cause) || cause == errUnreconcilable || cause == ErrNodeGone {
+		return err
+	}
+	f, loadErr := dn.loadUpdateFailures()
+	if loadErr != nil {
+		glog.Warningf("Unable to load the failed update attempts: %v", loadErr)
+		return err
+	}
+	if f == nil || f.Config != desiredConfig.GetName() {
+		f = &updateFailures{Config: desiredConfig.GetName()}
+	}
+	now := time.Now()
+	f.Attempts++
+	f.LastError = err.Error()
+	f.LastFailure = now
+	if saveErr := dn.saveUpdateFailures(f); saveErr != nil {
+		glog.Warningf("Unable to record the failed update attempt: %v", saveErr)
+		return err
+	}
+	return newUpdateAttemptsError(f, now)
+}
+
+// checkUpdateAttempts returns whether the update to desiredConfig may be
+// attempted now, given its failed attempts. An update backing off is queued
+// again under key for when it is over; one which failed too many times waits
+// for a new desired config or the reset annotation, and the error returned
+// marks the node degraded unless it already is.
+func (dn *Daemon) checkUpdateAttempts(key string, desiredConfig *mcfgv1.MachineConfig) (bool, error) {
+	if dn.node.Annotations[resetUpdateAttemptsAnnotationKey] == "true" {
+		dn.logSystem("Node has %s=true, resetting the failed update attempts", resetUpdateAttemptsAnnotationKey)
+		if err := dn.saveUpdateFailures(nil); err != nil {
+			return false, err
+		}
+		ctx, cancel := nodeWriterContext()
+		defer cancel()
+		if err := dn.nodeWriter.RemoveAnnotations(ctx, []string{resetUpdateAttemptsAnnotationKey}); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	f, err := dn.loadUpdateFailures()
+	if err != nil {
+		return false, err
+	}
+	// a new desired config starts over
+	if f == nil || f.Config != desiredConfig.GetName() {
+		return true, nil
+	}
+	dn.status.update(func(s *daemonState) {
+		s.UpdateFailures = f
+	})
+	e := newUpdateAttemptsError(f, time.Now())
+	if e.retryIn == 0 && f.Attempts < maxUpdateAttempts {
+		return true, nil
+	}
+	if e.retryIn > 0 {
+		glog.V(2).Infof("Update to %s failed %d times, backing off for %v", f.Config, f.Attempts, e.retryIn)
+		dn.queue.AddAfter(key, e.retryIn)
+		return false, nil
+	}
+	if dn.node.Annotations[constants.MachineConfigDaemonStateAnnotationKey] == constants.MachineConfigDaemonStateDegraded {
+		glog.V(2).Infof("Not retrying the update to %s, it failed %d times", f.Config, f.Attempts)
+		return false, nil
+	}
+	return false, e
+}
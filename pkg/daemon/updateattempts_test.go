@@ -0,0 +1,109 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestUpdateFailuresRetryIn(t *testing.T) {
+	now := time.Now()
+	for attempts, backoff := range map[int]time.Duration{1: time.Minute, 2: 5 * time.Minute, 3: 15 * time.Minute, 4: 15 * time.Minute} {
+		f := &updateFailures{Attempts: attempts, LastFailure: now}
+		assert.Equal(t, backoff, f.retryIn(now), "attempt %d", attempts)
+		assert.Equal(t, time.Duration(0), f.retryIn(now.Add(backoff)), "attempt %d", attempts)
+	}
+}
+
+func TestRecordUpdateFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-attempts")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dn := &Daemon{stateFilePath: filepath.Join(dir, "state.json")}
+	config := &mcfgv1.MachineConfig{ObjectMeta: metav1.ObjectMeta{Name: "rendered-worker-1"}}
+
+	for i := 1; i < maxUpdateAttempts; i++ {
+		err := dn.recordUpdateFailure(config, fmt.Errorf("failed to pull image"))
+		e, ok := err.(*updateAttemptsError)
+		require.True(t, ok, "%v", err)
+		assert.Equal(t, i, e.attempts)
+		assert.True(t, e.retryIn > 0)
+	}
+	err = dn.recordUpdateFailure(config, fmt.Errorf("failed to pull image"))
+	assert.Equal(t, "max retries exceeded, update to rendered-worker-1 failed 5 times: failed to pull image", err.Error())
+
+	// errors retrying can't help with aren't counted
+	unreconcilable := errors.Wrap(errUnreconcilable, "bad config")
+	assert.Equal(t, unreconcilable, dn.recordUpdateFailure(config, unreconcilable))
+
+	// a new desired config starts over
+	other := &mcfgv1.MachineConfig{ObjectMeta: metav1.ObjectMeta{Name: "rendered-worker-2"}}
+	err = dn.recordUpdateFailure(other, fmt.Errorf("failed to pull image"))
+	assert.Equal(t, 1, err.(*updateAttemptsError).attempts)
+
+	// the failures alone aren't a pending config
+	pending, err := dn.getPendingConfig()
+	require.Nil(t, err)
+	assert.Equal(t, "", pending)
+
+	require.Nil(t, dn.saveUpdateFailures(nil))
+	_, err = os.Stat(dn.stateFilePath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCheckUpdateAttempts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-attempts")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	queue := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "test")
+	defer queue.ShutDown()
+	dn := &Daemon{
+		stateFilePath: filepath.Join(dir, "state.json"),
+		node:          newTestNode("node-0", map[string]string{}),
+		queue:         queue,
+	}
+	config := &mcfgv1.MachineConfig{ObjectMeta: metav1.ObjectMeta{Name: "rendered-worker-1"}}
+
+	proceed, err := dn.checkUpdateAttempts("node-0", config)
+	assert.True(t, proceed)
+	assert.Nil(t, err)
+
+	// backing off
+	require.Nil(t, dn.saveUpdateFailures(&updateFailures{Config: "rendered-worker-1", Attempts: 2, LastFailure: time.Now()}))
+	proceed, err = dn.checkUpdateAttempts("node-0", config)
+	assert.False(t, proceed)
+	assert.Nil(t, err)
+
+	// backoff over
+	require.Nil(t, dn.saveUpdateFailures(&updateFailures{Config: "rendered-worker-1", Attempts: 2, LastFailure: time.Now().Add(-time.Hour)}))
+	proceed, err = dn.checkUpdateAttempts("node-0", config)
+	assert.True(t, proceed)
+	assert.Nil(t, err)
+
+	// too many attempts, the node gets degraded, once
+	require.Nil(t, dn.saveUpdateFailures(&updateFailures{Config: "rendered-worker-1", Attempts: maxUpdateAttempts, LastError: "boom", LastFailure: time.Now().Add(-time.Hour)}))
+	proceed, err = dn.checkUpdateAttempts("node-0", config)
+	assert.False(t, proceed)
+	_, ok := err.(*updateAttemptsError)
+	assert.True(t, ok)
+	dn.node.Annotations[constants.MachineConfigDaemonStateAnnotationKey] = constants.MachineConfigDaemonStateDegraded
+	proceed, err = dn.checkUpdateAttempts("node-0", config)
+	assert.False(t, proceed)
+	assert.Nil(t, err)
+
+	// but another config is attempted
+	proceed, err = dn.checkUpdateAttempts("node-0", &mcfgv1.MachineConfig{ObjectMeta: metav1.ObjectMeta{Name: "rendered-worker-2"}})
+	assert.True(t, proceed)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,338 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	// pathCreatedUsers is where the users created by the daemon are tracked
+	pathCreatedUsers = "/etc/machine-config-daemon/created-users.json"
+
+	// minRegularUID is the lowest uid of regular users, below are system
+	// users
+	minRegularUID = 1000
+
+	// lockedPasswordHash locks the password of users whose passwordHash is
+	// dropped from the config
+	lockedPasswordHash = "!"
+)
+
+// lookupHostUser looks up users on the host, it is swapped out by tests.
+var lookupHostUser = user.Lookup
+
+// hostPasswdPath and hostGroupPath are the databases the owners of files are
+// resolved against. The daemon is chrooted into the host, so they are those of
+// the host rather than of the container. They are swapped out by tests.
+var (
+	hostPasswdPath = "/etc/passwd"
+	hostGroupPath  = "/etc/group"
+)
+
+// lookupHostUID returns the uid of the host user name.
+func lookupHostUID(name string) (int, error) {
+	return lookupHostID(hostPasswdPath, "user", name)
+}
+
+// lookupHostGID returns the gid of the host group name.
+func lookupHostGID(name string) (int, error) {
+	return lookupHostID(hostGroupPath, "group", name)
+}
+
+// lookupHostID returns the id of the entry for name, the user or group kind,
+// in the passwd or group database at path, the third field of its line. The
+// database is read again each time: the ids of system users and groups like
+// chrony differ between OS versions, so they can change with an OS update.
+func lookupHostID(path, kind, name string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, errors.Wrapf(err, "reading %s", path)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, fmt.Errorf("%s %q has an invalid id %q in %s", kind, name, fields[2], path)
+		}
+		return id, nil
+	}
+	return 0, fmt.Errorf("%s %q does not exist in %s of the host", kind, name, path)
+}
+
+// runUserCommand runs the shadow-utils commands managing users, it is swapped
+// out by tests.
+var runUserCommand = func(name string, args ...string) error {
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %s: %v", name, strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// systemUserID returns the uid of the host user name if it is a system user,
+// one of the users with a uid below minRegularUID.
+func systemUserID(name string) (int, bool) {
+	u, err := lookupHostUser(name)
+	if err != nil {
+		return 0, false
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil || uid >= minRegularUID {
+		return 0, false
+	}
+	return uid, true
+}
+
+// verifyUserFields records the fields of pwdUser at path which can't be
+// applied over oldUser, the user of the same name in the old config if any.
+// Users get their SSHAuthorizedKeys and PasswordHash updated, and users other
+// than "core" their Groups too; "core" must keep 1 or more SSH keys. System
+// users other than "core" can't be managed at all, nor can the other fields
+// of any user change.
+func verifyUserFields(diff *configDiffer, path string, oldUser, pwdUser ignv2_2types.PasswdUser) {
+	if pwdUser.Name == coreUserName {
+		if len(pwdUser.SSHAuthorizedKeys) == 0 {
+			diff.add(path+".sshAuthorizedKeys", fieldInvalid, "user core must have 1 or more sshKeys")
+		}
+	} else if uid, ok := systemUserID(pwdUser.Name); ok {
+		diff.add(path+".name", fieldInvalid, fmt.Sprintf("%s is a system user (uid %d), only regular users can be managed", pwdUser.Name, uid))
+		return
+	}
+	diff.compare(path, unmanagedUserFields(oldUser), unmanagedUserFields(pwdUser), fieldUnsupported)
+}
+
+// unmanagedUserFields returns pwdUser without its name and the fields the
+// daemon updates.
+func unmanagedUserFields(pwdUser ignv2_2types.PasswdUser) ignv2_2types.PasswdUser {
+	u := pwdUser
+	u.Name = ""
+	u.SSHAuthorizedKeys = nil
+	u.PasswordHash = nil
+	if pwdUser.Name != coreUserName {
+		u.Groups = nil
+	}
+	return u
+}
+
+// usersUpdatableLive returns whether the changes from oldUsers to newUsers
+// only add and remove users, and change the fields the daemon updates.
+func usersUpdatableLive(oldUsers, newUsers []ignv2_2types.PasswdUser) bool {
+	oldByName := make(map[string]ignv2_2types.PasswdUser)
+	for _, u := range oldUsers {
+		oldByName[u.Name] = u
+	}
+	for _, u := range newUsers {
+		o, ok := oldByName[u.Name]
+		if !ok {
+			o = ignv2_2types.PasswdUser{Name: u.Name}
+		}
+		if !reflect.DeepEqual(unmanagedUserFields(o), unmanagedUserFields(u)) {
+			return false
+		}
+		delete(oldByName, u.Name)
+	}
+	for _, o := range oldByName {
+		if !reflect.DeepEqual(unmanagedUserFields(o), ignv2_2types.PasswdUser{}) {
+			return false
+		}
+	}
+	return true
+}
+
+// onlySSHKeysChanged returns whether the changes from oldUsers to newUsers
+// are all to SSHAuthorizedKeys.
+func onlySSHKeysChanged(oldUsers, newUsers []ignv2_2types.PasswdUser) bool {
+	if len(oldUsers) != len(newUsers) {
+		return false
+	}
+	for i := range oldUsers {
+		o, n := oldUsers[i], newUsers[i]
+		o.SSHAuthorizedKeys, n.SSHAuthorizedKeys = nil, nil
+		if !reflect.DeepEqual(o, n) {
+			return false
+		}
+	}
+	return true
+}
+
+// createdUsers tracks the users the daemon created, so that those dropped
+// from the config can be removed again without touching users the daemon
+// didn't create. It is persisted as JSON at its path.
+type createdUsers struct {
+	Users []string `json:"users"`
+
+	path string
+}
+
+func loadCreatedUsers(path string) (*createdUsers, error) {
+	c := &createdUsers{path: path}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading created users")
+	}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, errors.Wrapf(err, "parsing created users %s", path)
+	}
+	return c, nil
+}
+
+func (c *createdUsers) has(name string) bool {
+	for _, u := range c.Users {
+		if u == name {
+			return true
+		}
+	}
+	return false
+}
+
+// set records whether the daemon created the user name.
+func (c *createdUsers) set(name string, created bool) error {
+	var users []string
+	for _, u := range c.Users {
+		if u != name {
+			users = append(users, u)
+		}
+	}
+	if created {
+		users = append(users, name)
+		sort.Strings(users)
+	}
+	c.Users = users
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomicallyWithDefaults(c.path, b)
+}
+
+// updatePasswd applies the changes from oldUsers to newUsers: users dropped
+// are removed if the daemon created them, users added are created unless they
+// already exist, then the password hash, groups and SSH keys of each user are
+// updated. "core" always exists, and is never removed.
+func (dn *Daemon) updatePasswd(oldUsers, newUsers []ignv2_2types.PasswdUser) error {
+	created, err := loadCreatedUsers(dn.createdUsersPath)
+	if err != nil {
+		return err
+	}
+
+	oldByName := make(map[string]ignv2_2types.PasswdUser)
+	for _, u := range oldUsers {
+		oldByName[u.Name] = u
+	}
+	newByName := make(map[string]ignv2_2types.PasswdUser)
+	for _, u := range newUsers {
+		newByName[u.Name] = u
+	}
+
+	for _, u := range oldUsers {
+		if _, ok := newByName[u.Name]; ok || u.Name == coreUserName {
+			continue
+		}
+		if !created.has(u.Name) {
+			glog.Infof("Leaving user %s, which the daemon didn't create", u.Name)
+			continue
+		}
+		glog.Infof("Removing user %s", u.Name)
+		if err := runUserCommand("userdel", "--remove", u.Name); err != nil {
+			return err
+		}
+		if err := created.set(u.Name, false); err != nil {
+			return err
+		}
+	}
+
+	for _, u := range newUsers {
+		// users the daemon starts managing have all their fields applied
+		old := oldByName[u.Name]
+		if u.Name != coreUserName {
+			isNew, err := dn.ensureUser(u, created)
+			if err != nil {
+				return err
+			}
+			if !isNew && !reflect.DeepEqual(old.Groups, u.Groups) {
+				if err := runUserCommand("usermod", "--groups", joinGroups(u.Groups), u.Name); err != nil {
+					return err
+				}
+			}
+			if !isNew && !reflect.DeepEqual(old.PasswordHash, u.PasswordHash) {
+				if err := setPasswordHash(u); err != nil {
+					return err
+				}
+			}
+		} else if !reflect.DeepEqual(old.PasswordHash, u.PasswordHash) {
+			if err := setPasswordHash(u); err != nil {
+				return err
+			}
+		}
+
+		var keys string
+		for _, k := range u.SSHAuthorizedKeys {
+			keys = keys + string(k) + "\n"
+		}
+		if err := dn.atomicSSHKeysWriter(u, keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureUser creates the user pwdUser, with its groups and password hash, if
+// it doesn't exist yet, and returns whether it did.
+func (dn *Daemon) ensureUser(pwdUser ignv2_2types.PasswdUser, created *createdUsers) (bool, error) {
+	_, err := lookupHostUser(pwdUser.Name)
+	if err == nil {
+		return false, nil
+	}
+	if _, ok := err.(user.UnknownUserError); !ok {
+		return false, errors.Wrapf(err, "looking up user %s", pwdUser.Name)
+	}
+
+	glog.Infof("Creating user %s", pwdUser.Name)
+	args := []string{"--create-home"}
+	if len(pwdUser.Groups) > 0 {
+		args = append(args, "--groups", joinGroups(pwdUser.Groups))
+	}
+	if pwdUser.PasswordHash != nil {
+		args = append(args, "--password", *pwdUser.PasswordHash)
+	}
+	if err := runUserCommand("useradd", append(args, pwdUser.Name)...); err != nil {
+		return false, err
+	}
+	return true, created.set(pwdUser.Name, true)
+}
+
+// setPasswordHash sets the password hash of pwdUser, or locks its password if
+// it has none.
+func setPasswordHash(pwdUser ignv2_2types.PasswdUser) error {
+	hash := lockedPasswordHash
+	if pwdUser.PasswordHash != nil {
+		hash = *pwdUser.PasswordHash
+	}
+	glog.Infof("Updating the password of user %s", pwdUser.Name)
+	return runUserCommand("usermod", "--password", hash, pwdUser.Name)
+}
+
+func joinGroups(groups []ignv2_2types.Group) string {
+	var names []string
+	for _, g := range groups {
+		names = append(names, string(g))
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,173 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHostUsers swaps out the host users and the commands managing them, and
+// returns the commands run.
+func fakeHostUsers(existing ...string) (*[]string, func()) {
+	hostUsers := make(map[string]bool)
+	for _, name := range existing {
+		hostUsers[name] = true
+	}
+	var commands []string
+	origLookup, origRun := lookupHostUser, runUserCommand
+	lookupHostUser = func(name string) (*user.User, error) {
+		if !hostUsers[name] {
+			return nil, user.UnknownUserError(name)
+		}
+		return &user.User{Username: name, Uid: "1000", HomeDir: "/home/" + name}, nil
+	}
+	runUserCommand = func(name string, args ...string) error {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		switch name {
+		case "useradd":
+			hostUsers[args[len(args)-1]] = true
+		case "userdel":
+			delete(hostUsers, args[len(args)-1])
+		}
+		return nil
+	}
+	return &commands, func() {
+		lookupHostUser, runUserCommand = origLookup, origRun
+	}
+}
+
+func TestUpdatePasswd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcd-users")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	commands, restore := fakeHostUsers("core", "existing")
+	defer restore()
+
+	keys := make(map[string]string)
+	dn := &Daemon{
+		createdUsersPath: filepath.Join(dir, "created-users.json"),
+		atomicSSHKeysWriter: func(u ignv2_2types.PasswdUser, k string) error {
+			keys[u.Name] = k
+			return nil
+		},
+	}
+
+	hash := "$6$hash"
+	core := ignv2_2types.PasswdUser{Name: "core", SSHAuthorizedKeys: []ignv2_2types.SSHAuthorizedKey{"core-key"}}
+	admin := ignv2_2types.PasswdUser{
+		Name:              "admin",
+		SSHAuthorizedKeys: []ignv2_2types.SSHAuthorizedKey{"admin-key"},
+		PasswordHash:      &hash,
+		Groups:            []ignv2_2types.Group{"wheel"},
+	}
+	existing := ignv2_2types.PasswdUser{Name: "existing"}
+	users := []ignv2_2types.PasswdUser{core, admin, existing}
+
+	require.Nil(t, dn.updatePasswd([]ignv2_2types.PasswdUser{core}, users))
+	assert.Equal(t, []string{"useradd --create-home --groups wheel --password $6$hash admin"}, *commands)
+	assert.Equal(t, map[string]string{"core": "core-key\n", "admin": "admin-key\n", "existing": ""}, keys)
+
+	// dropping the password hash locks the password
+	*commands = nil
+	admin.PasswordHash = nil
+	require.Nil(t, dn.updatePasswd(users, []ignv2_2types.PasswdUser{core, admin, existing}))
+	assert.Equal(t, []string{"usermod --password ! admin"}, *commands)
+
+	// only the users the daemon created are removed, and it doesn't track
+	// them anymore
+	*commands = nil
+	require.Nil(t, dn.updatePasswd([]ignv2_2types.PasswdUser{core, admin, existing}, []ignv2_2types.PasswdUser{core}))
+	assert.Equal(t, []string{"userdel --remove admin"}, *commands)
+	created, err := loadCreatedUsers(dn.createdUsersPath)
+	require.Nil(t, err)
+	assert.Empty(t, created.Users)
+}
+
+func TestUsersUpdatableLive(t *testing.T) {
+	hash := "$6$hash"
+	core := ignv2_2types.PasswdUser{Name: "core", SSHAuthorizedKeys: []ignv2_2types.SSHAuthorizedKey{"key"}}
+	withHash := core
+	withHash.PasswordHash = &hash
+	admin := ignv2_2types.PasswdUser{Name: "admin", Groups: []ignv2_2types.Group{"wheel"}}
+	withShell := ignv2_2types.PasswdUser{Name: "admin", Shell: "/bin/zsh"}
+
+	for _, tc := range []struct {
+		name             string
+		oldUsers         []ignv2_2types.PasswdUser
+		newUsers         []ignv2_2types.PasswdUser
+		live, onlySSHKey bool
+	}{
+		{"keys", []ignv2_2types.PasswdUser{{Name: "core"}}, []ignv2_2types.PasswdUser{core}, true, true},
+		{"password", []ignv2_2types.PasswdUser{core}, []ignv2_2types.PasswdUser{withHash}, true, false},
+		{"added", []ignv2_2types.PasswdUser{core}, []ignv2_2types.PasswdUser{core, admin}, true, false},
+		{"removed", []ignv2_2types.PasswdUser{core, admin}, []ignv2_2types.PasswdUser{core}, true, false},
+		{"shell", []ignv2_2types.PasswdUser{core}, []ignv2_2types.PasswdUser{core, withShell}, false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.live, usersUpdatableLive(tc.oldUsers, tc.newUsers))
+			assert.Equal(t, tc.onlySSHKey, onlySSHKeysChanged(tc.oldUsers, tc.newUsers))
+		})
+	}
+}
+
+func TestGetFileOwnershipByName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "owners")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(passwd, group string) { hostPasswdPath, hostGroupPath = passwd, group }(hostPasswdPath, hostGroupPath)
+	hostPasswdPath, hostGroupPath = filepath.Join(dir, "passwd"), filepath.Join(dir, "group")
+	writeHostIDs := func(uid, gid string) {
+		require.Nil(t, ioutil.WriteFile(hostPasswdPath, []byte("root:x:0:0:root:/root:/bin/bash\nchrony:x:"+uid+":"+gid+"::/var/lib/chrony:/sbin/nologin\n"), 0644))
+		require.Nil(t, ioutil.WriteFile(hostGroupPath, []byte("root:x:0:\nchrony:x:"+gid+":\n"), 0644))
+	}
+	writeHostIDs("994", "991")
+
+	chrony := newTestFile(filepath.Join(dir, "etc/chrony.keys"), "1 SHA1 HEX:0123\n")
+	chrony.User = &ignv2_2types.NodeUser{Name: "chrony"}
+	chrony.Group = &ignv2_2types.NodeGroup{Name: "chrony"}
+	uid, gid, err := getFileOwnership(chrony)
+	require.Nil(t, err)
+	assert.Equal(t, []int{994, 991}, []int{uid, gid})
+
+	// numeric ids are taken as they are
+	id := 42
+	f := newTestFile("/etc/foo", "")
+	f.User = &ignv2_2types.NodeUser{ID: &id, Name: "chrony"}
+	uid, gid, err = getFileOwnership(f)
+	require.Nil(t, err)
+	assert.Equal(t, []int{42, 0}, []int{uid, gid})
+
+	f.User = &ignv2_2types.NodeUser{Name: "ntp"}
+	_, _, err = getFileOwnership(f)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), `user "ntp" does not exist`)
+	f.User = nil
+	f.Group = &ignv2_2types.NodeGroup{Name: "ntp"}
+	_, _, err = getFileOwnership(f)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), `group "ntp" does not exist`)
+
+	if os.Geteuid() != 0 {
+		t.Skip("chowning files needs root")
+	}
+	dn := &Daemon{
+		ownedFilesPath:   filepath.Join(dir, "owned-files.json"),
+		originalFilesDir: filepath.Join(dir, "orig"),
+	}
+	files := []ignv2_2types.File{chrony}
+	require.Nil(t, dn.writeFiles(files))
+	assert.Empty(t, checkFiles(files))
+
+	// the names are resolved again, the ids may change with the OS
+	writeHostIDs("995", "992")
+	assert.Equal(t, []string{chrony.Path + " (owner 994:991, expected 995:992)"}, checkFiles(files))
+	require.Nil(t, dn.writeFiles(files))
+	assert.Empty(t, checkFiles(files))
+}
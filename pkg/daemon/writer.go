@@ -1,16 +1,34 @@
 package daemon
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/golang/glog"
 	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/pkg/errors"
 	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
 	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/util/wait"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	corelisterv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
 	"k8s.io/client-go/util/retry"
 )
 
@@ -18,148 +36,1189 @@ const (
 	// defaultWriterQueue the number of pending writes to queue
 	defaultWriterQueue = 25
 
-	// machineConfigDaemonSSHAccessAnnotationKey is used to mark a node after it has been accessed via SSH
+	// machineConfigDaemonSSHAccessAnnotationKey is used to mark a node after it has been accessed via SSH.
+	// Its value is the number of accesses detected.
 	machineConfigDaemonSSHAccessAnnotationKey = "machineconfiguration.openshift.io/ssh"
-	// MachineConfigDaemonSSHAccessValue is the annotation value applied when ssh access is detected
+	// machineConfigDaemonSSHAccessValue is the value older daemons applied on any ssh access; it counts as one
 	machineConfigDaemonSSHAccessValue = "accessed"
+	// machineConfigDaemonSSHLastAccessedAnnotationKey records the time of the last SSH access, in RFC3339
+	machineConfigDaemonSSHLastAccessedAnnotationKey = "machineconfiguration.openshift.io/ssh-last-accessed"
+	// machineConfigDaemonSSHUsersAnnotationKey lists the users the SSH accesses were made as, comma separated
+	machineConfigDaemonSSHUsersAnnotationKey = "machineconfiguration.openshift.io/ssh-users"
+
+	// updateProgressAnnotationKey holds the UpdateProgress of the update in progress, as JSON
+	updateProgressAnnotationKey = "machineconfiguration.openshift.io/update-progress"
+	// maxUpdateProgressLength caps the size of the update-progress annotation
+	maxUpdateProgressLength = 1024
+
+	// maxReasonLength caps the size of the reason annotation; all annotations
+	// on an object share a 256KB limit
+	maxReasonLength = 4096
+
+	// updatingTaintKey is the key of the taint keeping new pods off a node
+	// while it is being updated
+	updatingTaintKey = "machineconfiguration.openshift.io/updating"
+
+	// drainWriteTimeout bounds each write flushed while the writer shuts down
+	drainWriteTimeout = 5 * time.Second
+
+	// maxOutageRetryInterval caps the interval between the retries of a
+	// write while the API server is unavailable
+	maxOutageRetryInterval = 30 * time.Second
+)
+
+// defaultOutageBackoff retries writes while the API server is unavailable for
+// about 13 minutes; the contexts of the writes usually give up first.
+var defaultOutageBackoff = wait.Backoff{
+	Steps:    30,
+	Duration: time.Second,
+	Factor:   2.0,
+	Jitter:   0.1,
+}
+
+var (
+	// ErrNodeGone is the cause of the errors returned for writes to a node
+	// which has been deleted. It is terminal, the write isn't retried.
+	ErrNodeGone = errors.New("node no longer exists")
+	// errNodeWriterClosed is returned for writes requested after the writer was stopped
+	errNodeWriterClosed = errors.New("node writer is closed")
+	// errNodeWriterUnbound is returned for writes requested before Bind was called
+	errNodeWriterUnbound = errors.New("node writer is not bound to a node")
+)
+
+// labels for the state a write is recording, used in metrics
+const (
+	writeStateDone           = "done"
+	writeStateWorking        = "working"
+	writeStateDegraded       = "degraded"
+	writeStateUnreconcilable = "unreconcilable"
+	writeStateHeld           = "held"
+	writeStateSSH            = "ssh"
+	writeStateAnnotations    = "annotations"
+	writeStatePending        = "pending"
+	writeStateSchedulable    = "schedulable"
+	writeStateTaint          = "taint"
+	writeStateProgress       = "progress"
 )
 
-// message wraps a client and responseChannel
+// message wraps a client and the response channels of every caller waiting
+// on it. More than one caller may be waiting when identical writes have been
+// coalesced.
 type message struct {
-	client          corev1.NodeInterface
-	lister          corelisterv1.NodeLister
-	node            string
-	annos           map[string]string
-	responseChannel chan error
+	ctx         context.Context
+	client      corev1.NodeInterface
+	lister      corelisterv1.NodeLister
+	node        string
+	annos       map[string]string
+	removeAnnos []string
+	// removeAnnosIfEqual lists annotations removed only if the node has
+	// exactly the given value for them
+	removeAnnosIfEqual map[string]string
+	// unschedulable, if set, is the desired spec.unschedulable of the node
+	unschedulable *bool
+	// mutate, if set, is called with the node after the other changes, for
+	// changes depending on the current state of the node
+	mutate func(*v1.Node)
+	// addTaints and removeTaints are taints to add to or remove from the
+	// node, matched by key and effect
+	addTaints        []v1.Taint
+	removeTaints     []v1.Taint
+	event            *nodeEvent
+	responseChannels []chan error
+	// state labels the write in metrics
+	state string
+	// queued is when the write was put on the writer channel
+	queued time.Time
+}
+
+// nodeEvent is an event emitted on the node once the write carrying it succeeds
+type nodeEvent struct {
+	eventType string
+	reason    string
+	message   string
 }
 
 // NodeWriter A single writer to Kubernetes to prevent race conditions
 type NodeWriter struct {
-	writer chan message
+	writer chan *message
+
+	// recorder, if set, is used to emit events on the node
+	recorder record.EventRecorder
+	// queueSize is the capacity of the writer channel
+	queueSize int
+	// backoff is how updateNodeRetry retries conflicting writes
+	backoff wait.Backoff
+	// outageBackoff is how writes are retried while the API server is
+	// unavailable, see write
+	outageBackoff wait.Backoff
+	// rateLimiter, if set, is waited on before each write
+	rateLimiter flowcontrol.RateLimiter
+	// shards, when there is more than one, are the queues of the workers
+	// writing concurrently to different nodes. All the writes for a node go
+	// through the same shard so that they stay ordered.
+	shards []*shard
+
+	// client, lister and node are the node the writer is bound to, see Bind.
+	// They are guarded by lock.
+	client corev1.NodeInterface
+	lister corelisterv1.NodeLister
+	node   string
+
+	// lock guards pending, sent and the responseChannels of pending messages
+	lock sync.Mutex
+	// pending maps a node name to the last message queued for it which
+	// hasn't been picked up by Run yet.
+	pending map[string]*message
+	// sent is closed once the last message queued is on the writer channel,
+	// or given up on, see enqueue
+	sent chan struct{}
+	// heldUntil is when the last write retried while the API server was
+	// unavailable was done with; the writes queued before were held behind
+	// it, see collapse.
+	heldUntil time.Time
+
+	// closeCh is closed by Close to ask Run to stop
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	// closed is closed once no more writes are accepted
+	closed chan struct{}
+	// done is closed when Run returns
+	done chan struct{}
+}
+
+// Option configures a NodeWriter created by NewNodeWriterWithOptions.
+type Option func(*NodeWriter)
+
+// WithRecorder sets the recorder used to emit events on the node. Without
+// one, no events are emitted.
+func WithRecorder(recorder record.EventRecorder) Option {
+	return func(nw *NodeWriter) {
+		nw.recorder = recorder
+	}
+}
+
+// WithBackoff sets how writes are retried on conflicts. The default is
+// retry.DefaultBackoff.
+func WithBackoff(backoff wait.Backoff) Option {
+	return func(nw *NodeWriter) {
+		nw.backoff = backoff
+	}
+}
+
+// WithOutageBackoff sets how writes are retried while the API server is
+// unavailable, the interval being capped at maxOutageRetryInterval. The writes
+// queued behind are held meanwhile. The default is defaultOutageBackoff; with
+// no steps such writes fail at once.
+func WithOutageBackoff(backoff wait.Backoff) Option {
+	return func(nw *NodeWriter) {
+		nw.outageBackoff = backoff
+	}
+}
+
+// WithQueueSize sets the number of writes which can be queued before callers
+// block.
+func WithQueueSize(size int) Option {
+	return func(nw *NodeWriter) {
+		nw.queueSize = size
+	}
+}
+
+// WithRateLimit limits the writes sent to the API server to qps per second.
+func WithRateLimit(qps float32) Option {
+	return func(nw *NodeWriter) {
+		nw.rateLimiter = flowcontrol.NewTokenBucketRateLimiter(qps, 1)
+	}
+}
+
+// WithConcurrency sets the number of nodes written to concurrently. Writes to
+// the same node are always serialized. The default is 1.
+func WithConcurrency(n int) Option {
+	return func(nw *NodeWriter) {
+		if n > 1 {
+			nw.shards = make([]*shard, n)
+		}
+	}
+}
+
+// NewNodeWriter Create a new NodeWriter. recorder may be nil, in which case
+// no events are emitted.
+func NewNodeWriter(recorder record.EventRecorder) *NodeWriter {
+	return NewNodeWriterWithOptions(WithRecorder(recorder))
 }
 
-// NewNodeWriter Create a new NodeWriter
-func NewNodeWriter() *NodeWriter {
-	return &NodeWriter{
-		writer: make(chan message, defaultWriterQueue),
+// NewNodeWriterWithOptions creates a new NodeWriter configured by opts.
+func NewNodeWriterWithOptions(opts ...Option) *NodeWriter {
+	nw := &NodeWriter{
+		queueSize:     defaultWriterQueue,
+		backoff:       retry.DefaultBackoff,
+		outageBackoff: defaultOutageBackoff,
+		pending:       make(map[string]*message),
+		sent:          make(chan struct{}),
+		closeCh:       make(chan struct{}),
+		closed:        make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(nw)
+	}
+	close(nw.sent)
+	nw.writer = make(chan *message, nw.queueSize)
+	for i := range nw.shards {
+		nw.shards[i] = &shard{wake: make(chan struct{}, 1)}
 	}
+	return nw
+}
+
+// Bind sets the node written to by SetDone, SetWorking and the other methods
+// which don't take a node. lister may be nil, in which case the node is always
+// read from the API server.
+func (nw *NodeWriter) Bind(client corev1.NodeInterface, lister corelisterv1.NodeLister, node string) {
+	nw.lock.Lock()
+	defer nw.lock.Unlock()
+	nw.client = client
+	nw.lister = lister
+	nw.node = node
 }
 
 // Run reads from the writer channel and sets the node annotation. It will
-// return if the stop channel is closed. Intended to be run via a goroutine.
+// return if the stop channel is closed or Close is called, after flushing the
+// writes still queued. Intended to be run via a goroutine.
 func (nw *NodeWriter) Run(stop <-chan struct{}) {
+	defer close(nw.done)
+	if len(nw.shards) > 0 {
+		nw.runSharded(stop)
+		return
+	}
 	for {
 		select {
 		case <-stop:
+			nw.drain(nw.processMessage)
+			return
+		case <-nw.closeCh:
+			nw.drain(nw.processMessage)
 			return
 		case msg := <-nw.writer:
-			_, err := setNodeAnnotations(msg.client, msg.lister, msg.node, msg.annos)
-			msg.responseChannel <- err
+			nw.processMessage(msg)
 		}
 	}
 }
 
-// SetDone sets the state to Done.
-func (nw *NodeWriter) SetDone(client corev1.NodeInterface, lister corelisterv1.NodeLister, node string, dcAnnotation string) error {
-	annos := map[string]string{
-		constants.MachineConfigDaemonStateAnnotationKey: constants.MachineConfigDaemonStateDone,
-		constants.CurrentMachineConfigAnnotationKey:     dcAnnotation,
+// shard is the queue of a worker writing to the nodes hashing to it.
+type shard struct {
+	lock sync.Mutex
+	// queue holds the writes handed to the worker, in order. It isn't
+	// bounded so that handing a write over never waits on a slow node.
+	queue []*message
+	// wake is signaled when a write is queued
+	wake chan struct{}
+}
+
+// push queues msg and wakes the worker.
+func (s *shard) push(msg *message) {
+	s.lock.Lock()
+	s.queue = append(s.queue, msg)
+	s.lock.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
 	}
-	respChan := make(chan error, 1)
-	nw.writer <- message{
-		client:          client,
-		lister:          lister,
-		node:            node,
-		annos:           annos,
-		responseChannel: respChan,
+}
+
+// pop returns the next write to make, or nil if there is none.
+func (s *shard) pop() *message {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.queue) == 0 {
+		return nil
 	}
-	return <-respChan
+	msg := s.queue[0]
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+	return msg
 }
 
-// SetWorking Sets the state to Working.
-func (nw *NodeWriter) SetWorking(client corev1.NodeInterface, lister corelisterv1.NodeLister, node string) error {
-	annos := map[string]string{
-		constants.MachineConfigDaemonStateAnnotationKey: constants.MachineConfigDaemonStateWorking,
+// len returns the number of writes queued.
+func (s *shard) len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.queue)
+}
+
+// runSharded is Run for more than one worker: it hands every message to the
+// shard of its node and leaves the writing to the shard workers.
+func (nw *NodeWriter) runSharded(stop <-chan struct{}) {
+	var wg sync.WaitGroup
+	drained := make(chan struct{})
+	for _, s := range nw.shards {
+		wg.Add(1)
+		go func(s *shard) {
+			defer wg.Done()
+			nw.work(s, drained)
+		}(s)
 	}
-	respChan := make(chan error, 1)
-	nw.writer <- message{
-		client:          client,
-		lister:          lister,
-		node:            node,
-		annos:           annos,
-		responseChannel: respChan,
+	defer func() {
+		close(drained)
+		wg.Wait()
+	}()
+
+	for {
+		select {
+		case <-stop:
+			nw.drain(nw.dispatch)
+			return
+		case <-nw.closeCh:
+			nw.drain(nw.dispatch)
+			return
+		case msg := <-nw.writer:
+			nw.dispatch(msg)
+		}
 	}
-	return <-respChan
 }
 
-// SetUnreconcilable Sets the state to Unreconcilable.
-func (nw *NodeWriter) SetUnreconcilable(err error, client corev1.NodeInterface, lister corelisterv1.NodeLister, node string) error {
-	glog.Errorf("Marking Unreconcilable due to: %v", err)
-	annos := map[string]string{
-		constants.MachineConfigDaemonStateAnnotationKey: constants.MachineConfigDaemonStateUnreconcilable,
+// work makes the writes queued on s until drained is closed and none is left.
+func (nw *NodeWriter) work(s *shard, drained <-chan struct{}) {
+	for {
+		for msg := s.pop(); msg != nil; msg = s.pop() {
+			nw.processMessage(msg)
+		}
+		select {
+		case <-s.wake:
+		case <-drained:
+			for msg := s.pop(); msg != nil; msg = s.pop() {
+				nw.processMessage(msg)
+			}
+			return
+		}
+	}
+}
+
+// shardOf returns the shard the writes for node are queued on.
+func (nw *NodeWriter) shardOf(node string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(node))
+	return nw.shards[h.Sum32()%uint32(len(nw.shards))]
+}
+
+// dispatch queues msg on the shard of its node, without waiting for the
+// writes queued before it there.
+func (nw *NodeWriter) dispatch(msg *message) {
+	nw.shardOf(msg.node).push(msg)
+}
+
+// queueDepth returns the number of writes queued and not yet started.
+func (nw *NodeWriter) queueDepth() int {
+	n := len(nw.writer)
+	for _, s := range nw.shards {
+		n += s.len()
+	}
+	return n
+}
+
+// Close stops accepting writes, waits for the queued ones to be flushed and
+// for Run to return.
+func (nw *NodeWriter) Close() {
+	nw.closeOnce.Do(func() { close(nw.closeCh) })
+	<-nw.done
+}
+
+// drain rejects new writes and then hands every write that is still queued to
+// handle, so no caller is left waiting.
+func (nw *NodeWriter) drain(handle func(*message)) {
+	close(nw.closed)
+	// Senders check closed while holding the lock, so once we get it no
+	// further writes can be queued; the ones already queued are on the
+	// writer channel, or given up on, once sent is closed.
+	nw.lock.Lock()
+	sent := nw.sent
+	nw.lock.Unlock()
+	<-sent
+
+	glog.Infof("Flushing %d pending node writes before exiting", nw.queueDepth())
+	for {
+		select {
+		case msg := <-nw.writer:
+			handle(msg)
+		default:
+			return
+		}
+	}
+}
+
+// processMessage processes msg. Once the writer is closed, each write is
+// bounded by drainWriteTimeout so that shutting down doesn't take long.
+func (nw *NodeWriter) processMessage(msg *message) {
+	select {
+	case <-nw.closed:
+		ctx, cancel := context.WithTimeout(msg.ctx, drainWriteTimeout)
+		defer cancel()
+		nw.process(ctx, msg)
+	default:
+		nw.process(msg.ctx, msg)
+	}
+}
+
+// process performs the write described by msg and answers every caller
+// waiting on it.
+func (nw *NodeWriter) process(ctx context.Context, msg *message) {
+	nw.lock.Lock()
+	if nw.pending[msg.node] == msg {
+		delete(nw.pending, msg.node)
+	}
+	nw.lock.Unlock()
+	nodeWriterQueueDepth.Set(float64(nw.queueDepth()))
+
+	node, written, err := nw.write(ctx, msg)
+	if !written {
+		return
+	}
+	nodeWriterWriteLatency.Observe(time.Since(msg.queued).Seconds())
+	if err != nil {
+		nodeWriterErrors.WithLabelValues(msg.state).Inc()
+	} else if state, ok := msg.annos[constants.MachineConfigDaemonStateAnnotationKey]; ok {
+		setDaemonStateMetric(state)
+	}
+	if err == nil && msg.event != nil && nw.recorder != nil {
+		nw.recorder.Event(getNodeRef(node), msg.event.eventType, msg.event.reason, msg.event.message)
+	}
+	for _, respChan := range msg.responseChannels {
+		respChan <- err
+	}
+}
+
+// write performs msg, unless it was collapsed into a later write, see
+// collapse, in which case it returns false. While the API server is
+// unavailable the write is retried with the outage backoff until ctx is done,
+// holding the writes queued behind it so that they are flushed in order once
+// the API server is back; they are checked for one making msg obsolete before
+// each retry.
+func (nw *NodeWriter) write(ctx context.Context, msg *message) (*v1.Node, bool, error) {
+	if nw.collapse(msg, false) {
+		return nil, false, nil
+	}
+	delay := nw.outageBackoff.Duration
+	for attempt := 1; ; attempt++ {
+		if nw.rateLimiter != nil {
+			nw.rateLimiter.Accept()
+		}
+		node, err := updateNodeRetry(ctx, msg.client, msg.lister, msg.node, nw.backoff, msg.apply)
+		if err == nil || attempt >= nw.outageBackoff.Steps || !isAPIUnavailable(err) {
+			if attempt > 1 {
+				nw.lock.Lock()
+				nw.heldUntil = time.Now()
+				nw.lock.Unlock()
+			}
+			return node, true, err
+		}
+		if delay > maxOutageRetryInterval {
+			delay = maxOutageRetryInterval
+		}
+		sleep := delay
+		if nw.outageBackoff.Jitter > 0 {
+			sleep = wait.Jitter(delay, nw.outageBackoff.Jitter)
+		}
+		glog.Warningf("API server unavailable, retrying %s write to node %s in %v: %v", msg.state, msg.node, sleep, err)
+		nodeWriterOutageRetries.Inc()
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return nil, true, err
+		case <-nw.closed:
+			return nil, true, err
+		}
+		if nw.collapse(msg, true) {
+			return nil, false, nil
+		}
+		delay = time.Duration(float64(delay) * nw.outageBackoff.Factor)
+	}
+}
+
+// collapse hands the callers waiting on msg over to the last write queued for
+// the same node if it supersedes msg, so that the writes buffered while the
+// API server is unavailable, like a Working followed by a Done, aren't all
+// replayed. Only writes held by an outage are collapsed: msg while it is
+// retried, held true, or when it was queued before heldUntil; otherwise
+// writes are made as they come. It returns whether msg was collapsed.
+func (nw *NodeWriter) collapse(msg *message, held bool) bool {
+	nw.lock.Lock()
+	defer nw.lock.Unlock()
+	if !held && !msg.queued.Before(nw.heldUntil) {
+		return false
+	}
+	newer, ok := nw.pending[msg.node]
+	if !ok || newer == msg || !newer.supersedes(msg) {
+		return false
+	}
+	glog.V(4).Infof("Collapsing %s write for node %s into a pending %s write", msg.state, msg.node, newer.state)
+	newer.responseChannels = append(newer.responseChannels, msg.responseChannels...)
+	return true
+}
+
+// supersedes returns whether m makes writing older before it pointless: older
+// only sets and removes annotations, without an event, and m sets or removes
+// every annotation older does.
+func (m *message) supersedes(older *message) bool {
+	if older.event != nil || older.mutate != nil || older.unschedulable != nil || len(older.addTaints) > 0 || len(older.removeTaints) > 0 {
+		return false
+	}
+	overwrites := func(key string) bool {
+		if _, ok := m.annos[key]; ok {
+			return true
+		}
+		for _, k := range m.removeAnnos {
+			if k == key {
+				return true
+			}
+		}
+		return false
+	}
+	for k := range older.annos {
+		if !overwrites(k) {
+			return false
+		}
+	}
+	for _, k := range older.removeAnnos {
+		if !overwrites(k) {
+			return false
+		}
+	}
+	for k := range older.removeAnnosIfEqual {
+		if !overwrites(k) {
+			return false
+		}
+	}
+	return true
+}
+
+// isAPIUnavailable returns whether err, returned for a write, means the API
+// server couldn't be reached or couldn't serve the write for now, rather than
+// that it rejected it.
+func isAPIUnavailable(err error) bool {
+	err = errors.Cause(err)
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return false
 	}
+	if apierrors.IsServerTimeout(err) || apierrors.IsServiceUnavailable(err) || apierrors.IsTimeout(err) || apierrors.IsTooManyRequests(err) {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return utilnet.IsConnectionReset(err) || utilnet.IsProbableEOF(err)
+}
+
+// bind points msg at the node the writer is bound to.
+func (nw *NodeWriter) bind(msg *message) error {
+	nw.lock.Lock()
+	msg.client, msg.lister, msg.node = nw.client, nw.lister, nw.node
+	nw.lock.Unlock()
+	if msg.client == nil {
+		return errNodeWriterUnbound
+	}
+	return nil
+}
+
+// sendBound sends msg to the node the writer is bound to.
+func (nw *NodeWriter) sendBound(msg *message) error {
+	if err := nw.bind(msg); err != nil {
+		return err
+	}
+	return nw.send(msg)
+}
+
+// PendingWrite is a write queued without waiting for it, see QueueWorking.
+type PendingWrite struct {
+	done chan struct{}
+	err  error
+}
+
+// Wait waits for the write to be made, or for its context to be done, and
+// returns its outcome.
+func (w *PendingWrite) Wait() error {
+	<-w.done
+	return w.err
+}
+
+// failedWrite returns a PendingWrite which failed with err without being
+// queued.
+func failedWrite(err error) *PendingWrite {
+	w := &PendingWrite{done: make(chan struct{}), err: err}
+	close(w.done)
+	return w
+}
+
+// queueBound queues msg for the node the writer is bound to, in order with
+// the other writes, and returns without waiting for it to be made.
+func (nw *NodeWriter) queueBound(msg *message) *PendingWrite {
+	if err := nw.bind(msg); err != nil {
+		return failedWrite(err)
+	}
+	respChan, err := nw.enqueue(msg)
+	if err != nil {
+		return failedWrite(err)
+	}
+	w := &PendingWrite{done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		w.err = nw.await(msg, respChan)
+	}()
+	return w
+}
+
+// sendTo sends msg to the given node, ignoring the one the writer is bound to.
+func (nw *NodeWriter) sendTo(msg *message, client corev1.NodeInterface, lister corelisterv1.NodeLister, node string) error {
+	msg.client, msg.lister, msg.node = client, lister, node
+	return nw.send(msg)
+}
+
+// send queues msg on the writer channel and waits for its response. It gives
+// up with ctx.Err() if ctx is done before the write is queued or completed.
+//
+// If the last write queued for the same node is still waiting and carries
+// exactly the same annotations, no new write is queued and the caller shares
+// the response of the pending one instead. Only the last pending write is
+// considered so that the ordering of different values is preserved.
+func (nw *NodeWriter) send(msg *message) error {
+	respChan, err := nw.enqueue(msg)
+	if err != nil {
+		return err
+	}
+	return nw.await(msg, respChan)
+}
+
+// enqueue queues msg, or coalesces it with the pending write, see send, and
+// returns the channel its response is sent on.
+func (nw *NodeWriter) enqueue(msg *message) (chan error, error) {
 	respChan := make(chan error, 1)
-	nw.writer <- message{
-		client:          client,
-		lister:          lister,
-		node:            node,
-		annos:           annos,
-		responseChannel: respChan,
-	}
-	clientErr := <-respChan
-	if  clientErr != nil {
-		glog.Errorf("Error setting Unreconcilable annotation for node %s: %v", node, clientErr)
+
+	nw.lock.Lock()
+	select {
+	case <-nw.closed:
+		nw.lock.Unlock()
+		return nil, errNodeWriterClosed
+	default:
+	}
+	// the changes of mutate can't be compared, e.g. each SSH access is
+	// counted
+	if p, ok := nw.pending[msg.node]; ok && p.mutate == nil && msg.mutate == nil && reflect.DeepEqual(p.annos, msg.annos) && reflect.DeepEqual(p.removeAnnos, msg.removeAnnos) && reflect.DeepEqual(p.removeAnnosIfEqual, msg.removeAnnosIfEqual) && reflect.DeepEqual(p.unschedulable, msg.unschedulable) && reflect.DeepEqual(p.addTaints, msg.addTaints) && reflect.DeepEqual(p.removeTaints, msg.removeTaints) && reflect.DeepEqual(p.event, msg.event) {
+		glog.V(4).Infof("Coalescing annotation write for node %s with a pending one", msg.node)
+		p.responseChannels = append(p.responseChannels, respChan)
+		nw.lock.Unlock()
+		return respChan, nil
+	}
+	msg.responseChannels = []chan error{respChan}
+	msg.queued = time.Now()
+	nw.pending[msg.node] = msg
+	// The messages are put on the writer channel in the order they are
+	// registered in pending, each once the one before it is, without
+	// holding the lock while the channel is full.
+	turn := nw.sent
+	sent := make(chan struct{})
+	nw.sent = sent
+	nw.lock.Unlock()
+	defer close(sent)
+
+	err := nw.sendInTurn(msg, turn)
+	if err != nil {
+		nw.abandon(msg, err)
+		return nil, err
+	}
+	nodeWriterQueueDepth.Set(float64(nw.queueDepth()))
+	return respChan, nil
+}
+
+// await waits for the response of msg on respChan, giving up with ctx.Err()
+// once the context of msg is done.
+func (nw *NodeWriter) await(msg *message, respChan chan error) error {
+	select {
+	case err := <-respChan:
+		return err
+	case <-msg.ctx.Done():
+		return msg.ctx.Err()
+	}
+}
+
+// sendInTurn puts msg on the writer channel once turn is closed.
+func (nw *NodeWriter) sendInTurn(msg *message, turn chan struct{}) error {
+	select {
+	case <-turn:
+	case <-msg.ctx.Done():
+		return msg.ctx.Err()
+	case <-nw.closed:
+		return errNodeWriterClosed
+	}
+	select {
+	case nw.writer <- msg:
+		return nil
+	case <-msg.ctx.Done():
+		return msg.ctx.Err()
+	case <-nw.closed:
+		return errNodeWriterClosed
+	}
+}
+
+// abandon unregisters msg, which couldn't be put on the writer channel, and
+// answers the callers coalesced with it with err.
+func (nw *NodeWriter) abandon(msg *message, err error) {
+	nw.lock.Lock()
+	defer nw.lock.Unlock()
+	if nw.pending[msg.node] == msg {
+		delete(nw.pending, msg.node)
+	}
+	for _, respChan := range msg.responseChannels[1:] {
+		respChan <- err
+	}
+}
+
+// SetAnnotations sets the given annotations on the node, serialized through
+// the writer channel like every other write.
+func (nw *NodeWriter) SetAnnotations(ctx context.Context, annos map[string]string) error {
+	return nw.sendBound(annotationsMessage(ctx, annos))
+}
+
+// RemoveAnnotations removes the given annotation keys from the node. Keys the
+// node doesn't have are ignored; if none are present no patch is sent.
+func (nw *NodeWriter) RemoveAnnotations(ctx context.Context, keys []string) error {
+	return nw.sendBound(removeAnnotationsMessage(ctx, keys))
+}
+
+// QueueAnnotations is SetAnnotations without waiting for the write.
+func (nw *NodeWriter) QueueAnnotations(ctx context.Context, annos map[string]string) *PendingWrite {
+	return nw.queueBound(annotationsMessage(ctx, annos))
+}
+
+// QueueRemoveAnnotations is RemoveAnnotations without waiting for the write.
+func (nw *NodeWriter) QueueRemoveAnnotations(ctx context.Context, keys []string) *PendingWrite {
+	return nw.queueBound(removeAnnotationsMessage(ctx, keys))
+}
+
+// SetUnschedulable cordons or uncordons the node, setting annos in the same
+// patch. annos may be nil.
+func (nw *NodeWriter) SetUnschedulable(ctx context.Context, desired bool, annos map[string]string) error {
+	return nw.sendBound(&message{
+		ctx:           ctx,
+		annos:         annos,
+		unschedulable: &desired,
+		state:         writeStateSchedulable,
+	})
+}
+
+// updatingTaint keeps pods which don't tolerate it from being scheduled on a
+// node while its update is in progress.
+var updatingTaint = v1.Taint{
+	Key:    updatingTaintKey,
+	Effect: v1.TaintEffectNoSchedule,
+}
+
+// ApplyUpdatingTaint taints the node as being updated. It is a no-op if the
+// node already has the taint.
+func (nw *NodeWriter) ApplyUpdatingTaint(ctx context.Context) error {
+	return nw.sendBound(&message{
+		ctx:       ctx,
+		addTaints: []v1.Taint{updatingTaint},
+		state:     writeStateTaint,
+	})
+}
+
+// RemoveUpdatingTaint removes the taint set by ApplyUpdatingTaint. It is a
+// no-op if the node doesn't have the taint.
+func (nw *NodeWriter) RemoveUpdatingTaint(ctx context.Context) error {
+	return nw.sendBound(&message{
+		ctx:          ctx,
+		removeTaints: []v1.Taint{updatingTaint},
+		state:        writeStateTaint,
+	})
+}
+
+// UpdateProgress describes how far along an update is. It is published on the
+// node for tooling; the controllers don't read it.
+type UpdateProgress struct {
+	// Phase is the phase the update is in, e.g. Draining
+	Phase string `json:"phase"`
+	// Step is the position of Phase among the phases of an update, e.g. 3/6
+	Step string `json:"step"`
+	// StartedAt is when Phase started
+	StartedAt time.Time `json:"startedAt"`
+	// Detail is free form, e.g. the config being updated to
+	Detail string `json:"detail,omitempty"`
+}
+
+// SetUpdateProgress publishes progress on the node. It is cleared by SetDone.
+func (nw *NodeWriter) SetUpdateProgress(ctx context.Context, progress UpdateProgress) error {
+	b, err := marshalUpdateProgress(progress)
+	if err != nil {
+		return err
+	}
+	return nw.sendBound(&message{
+		ctx: ctx,
+		annos: map[string]string{
+			updateProgressAnnotationKey: b,
+		},
+		state: writeStateProgress,
+	})
+}
+
+// QueueUpdateProgress is SetUpdateProgress without waiting for the write.
+func (nw *NodeWriter) QueueUpdateProgress(ctx context.Context, progress UpdateProgress) *PendingWrite {
+	b, err := marshalUpdateProgress(progress)
+	if err != nil {
+		return failedWrite(err)
+	}
+	return nw.queueBound(&message{
+		ctx: ctx,
+		annos: map[string]string{
+			updateProgressAnnotationKey: b,
+		},
+		state: writeStateProgress,
+	})
+}
+
+// marshalUpdateProgress marshals progress, shortening its detail so that the
+// result fits in maxUpdateProgressLength.
+func marshalUpdateProgress(progress UpdateProgress) (string, error) {
+	b, err := json.Marshal(progress)
+	if err != nil {
+		return "", err
+	}
+	if over := len(b) - maxUpdateProgressLength; over > 0 {
+		// escaping may make the detail longer in JSON than it is, so
+		// this can cut more than needed but never too little
+		progress.Detail = truncateUTF8(progress.Detail, len(progress.Detail)-over)
+		if b, err = json.Marshal(progress); err != nil {
+			return "", err
+		}
+		if len(b) > maxUpdateProgressLength {
+			return "", fmt.Errorf("update progress is %d bytes, more than %d", len(b), maxUpdateProgressLength)
+		}
+	}
+	return string(b), nil
+}
+
+// SetPendingConfig records that the node is about to reboot into the given
+// config. It is cleared by the SetDone for the same config.
+func (nw *NodeWriter) SetPendingConfig(ctx context.Context, config string) error {
+	return nw.sendBound(pendingConfigMessage(ctx, config))
+}
+
+// SetDone sets the state to Done, clears any reason and update progress and
+// emits a Normal event.
+// The pending config is cleared too if it is dcAnnotation.
+func (nw *NodeWriter) SetDone(ctx context.Context, dcAnnotation string) error {
+	return nw.sendBound(doneMessage(ctx, dcAnnotation))
+}
+
+// SetWorking Sets the state to Working and clears any reason.
+func (nw *NodeWriter) SetWorking(ctx context.Context) error {
+	return nw.sendBound(workingMessage(ctx))
+}
+
+// QueueWorking is SetWorking without waiting for the write, for callers which
+// can carry on while the API server is unavailable. The write stays queued
+// until it is made, superseded by a later state, or ctx is done.
+func (nw *NodeWriter) QueueWorking(ctx context.Context) *PendingWrite {
+	return nw.queueBound(workingMessage(ctx))
+}
+
+// SetHeld sets the state to Held, for the update to config which isn't
+// started while the node is held, and emits a Normal event.
+func (nw *NodeWriter) SetHeld(ctx context.Context, config string) error {
+	return nw.sendBound(heldMessage(ctx, config))
+}
+
+// SetUnreconcilable Sets the state to Unreconcilable, records err as the reason
+// and emits a Warning event.
+func (nw *NodeWriter) SetUnreconcilable(ctx context.Context, err error) error {
+	glog.Errorf("Marking Unreconcilable due to: %v", err)
+	clientErr := nw.sendBound(unreconcilableMessage(ctx, err))
+	if clientErr != nil {
+		glog.Errorf("Error setting Unreconcilable annotation: %v", clientErr)
 	}
 	return clientErr
 }
 
-// SetDegraded logs the error and sets the state to Degraded.
+// SetDegraded logs the error and sets the state to Degraded, recording err as the
+// reason and emitting a Warning event.
 // Returns an error if it couldn't set the annotation.
-func (nw *NodeWriter) SetDegraded(err error, client corev1.NodeInterface, lister corelisterv1.NodeLister, node string) error {
+func (nw *NodeWriter) SetDegraded(ctx context.Context, err error) error {
 	glog.Errorf("Marking Degraded due to: %v", err)
-	annos := map[string]string{
-		constants.MachineConfigDaemonStateAnnotationKey: constants.MachineConfigDaemonStateDegraded,
+	clientErr := nw.sendBound(degradedMessage(ctx, err))
+	if clientErr != nil {
+		glog.Errorf("Error setting Degraded annotation: %v", clientErr)
 	}
-	respChan := make(chan error, 1)
-	nw.writer <- message{
-		client:          client,
-		lister:          lister,
-		node:            node,
-		annos:           annos,
-		responseChannel: respChan,
-	}
-	clientErr := <-respChan
-	if  clientErr != nil {
+	return clientErr
+}
+
+// SetSSHAccessed increments the count of SSH accesses recorded on the node and
+// records the time of this one, and user, if known, among the users accesses
+// were made as. The annotations are read when writing, so no access is lost
+// to conflicting writes.
+func (nw *NodeWriter) SetSSHAccessed(ctx context.Context, user string) error {
+	return nw.sendBound(sshAccessedMessage(ctx, user))
+}
+
+// SetAnnotationsForNode is SetAnnotations for the given node.
+//
+// Deprecated: use Bind and SetAnnotations.
+func (nw *NodeWriter) SetAnnotationsForNode(ctx context.Context, client corev1.NodeInterface, lister corelisterv1.NodeLister, node string, annos map[string]string) error {
+	return nw.sendTo(annotationsMessage(ctx, annos), client, lister, node)
+}
+
+// RemoveAnnotationsForNode is RemoveAnnotations for the given node.
+//
+// Deprecated: use Bind and RemoveAnnotations.
+func (nw *NodeWriter) RemoveAnnotationsForNode(ctx context.Context, client corev1.NodeInterface, lister corelisterv1.NodeLister, node string, keys []string) error {
+	return nw.sendTo(removeAnnotationsMessage(ctx, keys), client, lister, node)
+}
+
+// SetDoneForNode is SetDone for the given node.
+//
+// Deprecated: use Bind and SetDone.
+func (nw *NodeWriter) SetDoneForNode(ctx context.Context, client corev1.NodeInterface, lister corelisterv1.NodeLister, node string, dcAnnotation string) error {
+	return nw.sendTo(doneMessage(ctx, dcAnnotation), client, lister, node)
+}
+
+// SetWorkingForNode is SetWorking for the given node.
+//
+// Deprecated: use Bind and SetWorking.
+func (nw *NodeWriter) SetWorkingForNode(ctx context.Context, client corev1.NodeInterface, lister corelisterv1.NodeLister, node string) error {
+	return nw.sendTo(workingMessage(ctx), client, lister, node)
+}
+
+// SetUnreconcilableForNode is SetUnreconcilable for the given node.
+//
+// Deprecated: use Bind and SetUnreconcilable.
+func (nw *NodeWriter) SetUnreconcilableForNode(ctx context.Context, err error, client corev1.NodeInterface, lister corelisterv1.NodeLister, node string) error {
+	glog.Errorf("Marking Unreconcilable due to: %v", err)
+	clientErr := nw.sendTo(unreconcilableMessage(ctx, err), client, lister, node)
+	if clientErr != nil {
+		glog.Errorf("Error setting Unreconcilable annotation for node %s: %v", node, clientErr)
+	}
+	return clientErr
+}
+
+// SetDegradedForNode is SetDegraded for the given node.
+//
+// Deprecated: use Bind and SetDegraded.
+func (nw *NodeWriter) SetDegradedForNode(ctx context.Context, err error, client corev1.NodeInterface, lister corelisterv1.NodeLister, node string) error {
+	glog.Errorf("Marking Degraded due to: %v", err)
+	clientErr := nw.sendTo(degradedMessage(ctx, err), client, lister, node)
+	if clientErr != nil {
 		glog.Errorf("Error setting Degraded annotation for node %s: %v", node, clientErr)
 	}
 	return clientErr
 }
 
-// SetSSHAccessed sets the ssh annotation to accessed
-func (nw *NodeWriter) SetSSHAccessed(client corev1.NodeInterface, lister corelisterv1.NodeLister, node string) error {
-	annos := map[string]string{
-		machineConfigDaemonSSHAccessAnnotationKey: machineConfigDaemonSSHAccessValue,
+// SetSSHAccessedForNode is SetSSHAccessed for the given node.
+//
+// Deprecated: use Bind and SetSSHAccessed.
+func (nw *NodeWriter) SetSSHAccessedForNode(ctx context.Context, client corev1.NodeInterface, lister corelisterv1.NodeLister, node string) error {
+	return nw.sendTo(sshAccessedMessage(ctx, ""), client, lister, node)
+}
+
+func annotationsMessage(ctx context.Context, annos map[string]string) *message {
+	return &message{
+		ctx:   ctx,
+		annos: annos,
+		state: writeStateAnnotations,
 	}
-	respChan := make(chan error, 1)
-	nw.writer <- message{
-		client:          client,
-		lister:          lister,
-		node:            node,
-		annos:           annos,
-		responseChannel: respChan,
+}
+
+func removeAnnotationsMessage(ctx context.Context, keys []string) *message {
+	return &message{
+		ctx:         ctx,
+		removeAnnos: keys,
+		state:       writeStateAnnotations,
+	}
+}
+
+func pendingConfigMessage(ctx context.Context, config string) *message {
+	return &message{
+		ctx: ctx,
+		annos: map[string]string{
+			constants.PendingMachineConfigAnnotationKey: config,
+		},
+		state: writeStatePending,
 	}
-	return <-respChan
+}
+
+func doneMessage(ctx context.Context, dcAnnotation string) *message {
+	return &message{
+		ctx: ctx,
+		annos: map[string]string{
+			constants.MachineConfigDaemonStateAnnotationKey: constants.MachineConfigDaemonStateDone,
+			constants.CurrentMachineConfigAnnotationKey:     dcAnnotation,
+		},
+		removeAnnos: []string{constants.MachineConfigDaemonReasonAnnotationKey, updateProgressAnnotationKey},
+		removeAnnosIfEqual: map[string]string{
+			constants.PendingMachineConfigAnnotationKey: dcAnnotation,
+		},
+		event: &nodeEvent{
+			eventType: v1.EventTypeNormal,
+			reason:    constants.MachineConfigDaemonStateDone,
+			message:   fmt.Sprintf("Completed update to config %s", dcAnnotation),
+		},
+		state: writeStateDone,
+	}
+}
+
+func workingMessage(ctx context.Context) *message {
+	return &message{
+		ctx: ctx,
+		annos: map[string]string{
+			constants.MachineConfigDaemonStateAnnotationKey: constants.MachineConfigDaemonStateWorking,
+		},
+		removeAnnos: []string{constants.MachineConfigDaemonReasonAnnotationKey},
+		state:       writeStateWorking,
+	}
+}
+
+func heldMessage(ctx context.Context, config string) *message {
+	return &message{
+		ctx: ctx,
+		annos: map[string]string{
+			constants.MachineConfigDaemonStateAnnotationKey: constants.MachineConfigDaemonStateHeld,
+		},
+		removeAnnos: []string{constants.MachineConfigDaemonReasonAnnotationKey},
+		event: &nodeEvent{
+			eventType: v1.EventTypeNormal,
+			reason:    constants.MachineConfigDaemonStateHeld,
+			message:   fmt.Sprintf("Holding update to config %s, the node has %s=true", config, constants.NodeHoldAnnotationKey),
+		},
+		state: writeStateHeld,
+	}
+}
+
+func unreconcilableMessage(ctx context.Context, err error) *message {
+	return &message{
+		ctx: ctx,
+		annos: map[string]string{
+			constants.MachineConfigDaemonStateAnnotationKey:  constants.MachineConfigDaemonStateUnreconcilable,
+			constants.MachineConfigDaemonReasonAnnotationKey: truncateReason(err.Error()),
+		},
+		event: &nodeEvent{
+			eventType: v1.EventTypeWarning,
+			reason:    constants.MachineConfigDaemonStateUnreconcilable,
+			message:   err.Error(),
+		},
+		state: writeStateUnreconcilable,
+	}
+}
+
+func degradedMessage(ctx context.Context, err error) *message {
+	return &message{
+		ctx: ctx,
+		annos: map[string]string{
+			constants.MachineConfigDaemonStateAnnotationKey:  constants.MachineConfigDaemonStateDegraded,
+			constants.MachineConfigDaemonReasonAnnotationKey: truncateReason(err.Error()),
+		},
+		event: &nodeEvent{
+			eventType: v1.EventTypeWarning,
+			reason:    constants.MachineConfigDaemonStateDegraded,
+			message:   err.Error(),
+		},
+		state: writeStateDegraded,
+	}
+}
+
+func sshAccessedMessage(ctx context.Context, user string) *message {
+	return &message{
+		ctx: ctx,
+		mutate: func(node *v1.Node) {
+			recordSSHAccess(node, user)
+		},
+		state: writeStateSSH,
+	}
+}
+
+// recordSSHAccess increments the SSH access count of node, sets the time of
+// the last access to now and adds user, unless unknown, to the users accesses
+// were made as.
+func recordSSHAccess(node *v1.Node, user string) {
+	count := 0
+	if v, ok := node.Annotations[machineConfigDaemonSSHAccessAnnotationKey]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			// "accessed", or a value we can't make sense of; either way
+			// the node was accessed at least once
+			n = 1
+		}
+		count = n
+	}
+	node.Annotations[machineConfigDaemonSSHAccessAnnotationKey] = strconv.Itoa(count + 1)
+	node.Annotations[machineConfigDaemonSSHLastAccessedAnnotationKey] = time.Now().UTC().Format(time.RFC3339)
+	if user == "" {
+		return
+	}
+	var users []string
+	if v := node.Annotations[machineConfigDaemonSSHUsersAnnotationKey]; v != "" {
+		users = strings.Split(v, ",")
+	}
+	for _, u := range users {
+		if u == user {
+			return
+		}
+	}
+	users = append(users, user)
+	sort.Strings(users)
+	node.Annotations[machineConfigDaemonSSHUsersAnnotationKey] = strings.Join(users, ",")
+}
+
+// truncateReason shortens reason to at most maxReasonLength bytes without
+// splitting a multi-byte character.
+func truncateReason(reason string) string {
+	return truncateUTF8(reason, maxReasonLength)
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a multi-byte
+// character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	if n <= 0 {
+		return ""
+	}
+	i := n
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return s[:i]
 }
 
 // updateNodeRetry calls f to update a node object in Kubernetes.
-// It will attempt to update the node by applying f to it up to DefaultBackoff
+// It will attempt to update the node by applying f to it up to backoff.Steps
 // number of times.
 // f will be called each time since the node object will likely have changed if
-// a retry is necessary.
-func updateNodeRetry(client corev1.NodeInterface, lister corelisterv1.NodeLister, nodeName string, f func(*v1.Node)) (*v1.Node, error) {
-	var node *v1.Node
-	if err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
-		n, err := lister.Get(nodeName)
+// a retry is necessary. No further attempts are made once ctx is done.
+//
+// The first attempt reads the node from the lister, if any; retries only happen
+// on conflicts, which means the lister is likely stale, so they GET the node
+// from the API server instead.
+//
+// If the node is not found, ErrNodeGone is returned as the cause without
+// retrying.
+func updateNodeRetry(ctx context.Context, client corev1.NodeInterface, lister corelisterv1.NodeLister, nodeName string, backoff wait.Backoff, f func(*v1.Node)) (*v1.Node, error) {
+	var (
+		node         *v1.Node
+		lastPatchErr error
+	)
+	firstAttempt := true
+	if err := retry.RetryOnConflict(backoff, func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var (
+			n   *v1.Node
+			err error
+		)
+		if firstAttempt && lister != nil {
+			firstAttempt = false
+			n, err = lister.Get(nodeName)
+		} else {
+			n, err = client.Get(nodeName, metav1.GetOptions{})
+		}
+		if apierrors.IsNotFound(err) {
+			return ErrNodeGone
+		}
 		if err != nil {
 			return err
 		}
@@ -175,26 +1234,96 @@ func updateNodeRetry(client corev1.NodeInterface, lister corelisterv1.NodeLister
 		if err != nil {
 			return err
 		}
+		if bytes.Equal(oldNode, newNode) {
+			// f didn't change anything, no need to bother the API server
+			node = n
+			return nil
+		}
 
 		patchBytes, err := strategicpatch.CreateTwoWayMergePatch(oldNode, newNode, v1.Node{})
 		if err != nil {
 			return fmt.Errorf("failed to create patch for node %q: %v", nodeName, err)
 		}
+		if len(patchBytes) == 0 || string(patchBytes) == "{}" {
+			// e.g. a nil and an empty map marshal differently but are the
+			// same to the API server
+			node = n
+			return nil
+		}
 
 		node, err = client.Patch(nodeName, types.StrategicMergePatchType, patchBytes)
+		if apierrors.IsNotFound(err) {
+			// deleted since we read it
+			return ErrNodeGone
+		}
+		if err != nil {
+			lastPatchErr = err
+		}
 		return err
 	}); err != nil {
 		// may be conflict if max retries were hit
-		return nil, fmt.Errorf("unable to update node %q: %v", node, err)
+		// the cause is kept for ErrNodeGone and isAPIUnavailable
+		if lastPatchErr != nil && lastPatchErr != err {
+			return nil, errors.Wrapf(err, "unable to update node %q (last patch error: %v)", nodeName, lastPatchErr)
+		}
+		return nil, errors.Wrapf(err, "unable to update node %q", nodeName)
 	}
 	return node, nil
 }
 
-func setNodeAnnotations(client corev1.NodeInterface, lister corelisterv1.NodeLister, nodeName string, m map[string]string) (*v1.Node, error) {
-	node, err := updateNodeRetry(client, lister, nodeName, func(node *v1.Node) {
-		for k, v := range m {
-			node.Annotations[k] = v
+// apply makes the changes described by m on node.
+func (m *message) apply(node *v1.Node) {
+	if m.unschedulable != nil {
+		node.Spec.Unschedulable = *m.unschedulable
+	}
+	for _, t := range m.addTaints {
+		if !hasTaint(node.Spec.Taints, t) {
+			node.Spec.Taints = append(node.Spec.Taints, t)
 		}
-	})
-	return node, err
+	}
+	if len(m.removeTaints) > 0 {
+		var taints []v1.Taint
+		for _, t := range node.Spec.Taints {
+			if !hasTaint(m.removeTaints, t) {
+				taints = append(taints, t)
+			}
+		}
+		node.Spec.Taints = taints
+	}
+	// nodes freshly registered by the kubelet may have no annotations yet
+	if node.Annotations == nil {
+		node.Annotations = map[string]string{}
+	}
+	for k, v := range m.annos {
+		node.Annotations[k] = v
+	}
+	for _, k := range m.removeAnnos {
+		delete(node.Annotations, k)
+	}
+	for k, v := range m.removeAnnosIfEqual {
+		if cur, ok := node.Annotations[k]; ok && cur == v {
+			delete(node.Annotations, k)
+		}
+	}
+	if m.mutate != nil {
+		m.mutate(node)
+	}
+}
+
+// hasTaint returns whether taints has one with the key and effect of t.
+func hasTaint(taints []v1.Taint, t v1.Taint) bool {
+	for i := range taints {
+		if taints[i].MatchTaint(&t) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateNodeAnnotations sets the annotations in m on the node and deletes the
+// ones listed in remove. The resulting patch carries a null value for every
+// deleted key.
+func updateNodeAnnotations(ctx context.Context, client corev1.NodeInterface, lister corelisterv1.NodeLister, nodeName string, m map[string]string, remove []string) (*v1.Node, error) {
+	msg := &message{annos: m, removeAnnos: remove}
+	return updateNodeRetry(ctx, client, lister, nodeName, retry.DefaultBackoff, msg.apply)
 }
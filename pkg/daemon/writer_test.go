@@ -0,0 +1,1147 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	corelisterv1 "k8s.io/client-go/listers/core/v1"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+)
+
+func newTestNode(name string, annos map[string]string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: annos,
+		},
+	}
+}
+
+func newTestNodeLister(t *testing.T, nodes ...*corev1.Node) corelisterv1.NodeLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, n := range nodes {
+		require.Nil(t, indexer.Add(n))
+	}
+	return corelisterv1.NewNodeLister(indexer)
+}
+
+func TestNodeWriterSetWorking(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+	go nw.Run(stopCh)
+
+	err := nw.SetWorking(context.Background())
+	require.Nil(t, err)
+
+	updated, err := client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, constants.MachineConfigDaemonStateWorking, updated.Annotations[constants.MachineConfigDaemonStateAnnotationKey])
+}
+
+func TestNodeWriterSetHeld(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+	recorder := record.NewFakeRecorder(10)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(recorder)
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+	go nw.Run(stopCh)
+
+	require.Nil(t, nw.SetHeld(context.Background(), "rendered-worker-1"))
+
+	updated, err := client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, constants.MachineConfigDaemonStateHeld, updated.Annotations[constants.MachineConfigDaemonStateAnnotationKey])
+	assert.Equal(t, "Normal Held Holding update to config rendered-worker-1, the node has machineconfiguration.openshift.io/hold=true", <-recorder.Events)
+}
+
+func TestNodeWriterSetAnnotations(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{"untouched": "value"})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+	go nw.Run(stopCh)
+
+	annos := map[string]string{
+		constants.CurrentMachineConfigAnnotationKey: "rendered-worker-1",
+		"example.com/custom":                        "foo",
+	}
+	require.Nil(t, nw.SetAnnotations(context.Background(), annos))
+
+	updated, err := client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, "rendered-worker-1", updated.Annotations[constants.CurrentMachineConfigAnnotationKey])
+	assert.Equal(t, "foo", updated.Annotations["example.com/custom"])
+	assert.Equal(t, "value", updated.Annotations["untouched"])
+}
+
+func TestNodeWriterRemoveAnnotations(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{
+		machineConfigDaemonSSHAccessAnnotationKey: machineConfigDaemonSSHAccessValue,
+		"untouched": "value",
+	})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+	go nw.Run(stopCh)
+
+	require.Nil(t, nw.RemoveAnnotations(context.Background(), []string{machineConfigDaemonSSHAccessAnnotationKey}))
+
+	var patches []clienttesting.PatchAction
+	for _, a := range client.Actions() {
+		if p, ok := a.(clienttesting.PatchAction); ok {
+			patches = append(patches, p)
+		}
+	}
+	require.Len(t, patches, 1)
+	// The fake clientset unmarshals the merged node on top of the stored
+	// one, so it never drops map keys; check the patch itself instead.
+	assert.Equal(t, `{"metadata":{"annotations":{"`+machineConfigDaemonSSHAccessAnnotationKey+`":null}}}`, string(patches[0].GetPatch()))
+}
+
+func TestNodeWriterRemoveMissingAnnotation(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{"untouched": "value"})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+	go nw.Run(stopCh)
+
+	require.Nil(t, nw.RemoveAnnotations(context.Background(), []string{"missing"}))
+	assert.Equal(t, 0, countPatches(client))
+}
+
+func TestNodeWriterDegradedReason(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+	go nw.Run(stopCh)
+
+	require.Nil(t, nw.SetDegraded(context.Background(), fmt.Errorf("failed to drain node")))
+
+	updated, err := client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, constants.MachineConfigDaemonStateDegraded, updated.Annotations[constants.MachineConfigDaemonStateAnnotationKey])
+	assert.Equal(t, "failed to drain node", updated.Annotations[constants.MachineConfigDaemonReasonAnnotationKey])
+}
+
+func TestTruncateReason(t *testing.T) {
+	short := "short reason"
+	assert.Equal(t, short, truncateReason(short))
+
+	long := strings.Repeat("a", maxReasonLength-1) + "é"
+	truncated := truncateReason(long)
+	assert.Equal(t, maxReasonLength-1, len(truncated))
+	assert.True(t, utf8.ValidString(truncated))
+}
+
+func TestNodeWriterContextDeadline(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+
+	// Run is never started, so the write can't complete and must time out.
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := nw.SetWorking(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestUpdateNodeRetryCanceledContext(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := updateNodeAnnotations(ctx, client.CoreV1().Nodes(), lister, node.Name, map[string]string{"foo": "bar"}, nil)
+	require.NotNil(t, err)
+	for _, a := range client.Actions() {
+		assert.NotEqual(t, "patch", a.GetVerb())
+	}
+}
+
+// waitForQueued blocks until n writes are sitting in the writer channel.
+func waitForQueued(t *testing.T, nw *NodeWriter, n int) {
+	err := wait.PollImmediate(time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(nw.writer) == n, nil
+	})
+	require.Nil(t, err, "timed out waiting for %d queued writes", n)
+}
+
+// waitForWaiters blocks until the pending write for node has n callers.
+func waitForWaiters(t *testing.T, nw *NodeWriter, node string, n int) {
+	err := wait.PollImmediate(time.Millisecond, 5*time.Second, func() (bool, error) {
+		nw.lock.Lock()
+		defer nw.lock.Unlock()
+		p, ok := nw.pending[node]
+		return ok && len(p.responseChannels) == n, nil
+	})
+	require.Nil(t, err, "timed out waiting for %d callers on node %s", n, node)
+}
+
+func countPatches(client *k8sfake.Clientset) int {
+	patches := 0
+	for _, a := range client.Actions() {
+		if a.GetVerb() == "patch" {
+			patches++
+		}
+	}
+	return patches
+}
+
+func TestNodeWriterCoalescesIdenticalWrites(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+
+	const callers = 5
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			errs <- nw.SetWorking(context.Background())
+		}()
+	}
+	waitForWaiters(t, nw, node.Name, callers)
+	waitForQueued(t, nw, 1)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go nw.Run(stopCh)
+
+	for i := 0; i < callers; i++ {
+		assert.Nil(t, <-errs)
+	}
+	assert.Equal(t, 1, countPatches(client))
+}
+
+func TestNodeWriterDoesNotCoalesceDifferentValues(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	nodes := client.CoreV1().Nodes()
+	lister := newTestNodeLister(t, node)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+
+	errs := make(chan error, 3)
+	go func() { errs <- nw.SetWorking(context.Background()) }()
+	waitForQueued(t, nw, 1)
+	go func() { errs <- nw.SetDegraded(context.Background(), fmt.Errorf("test")) }()
+	waitForQueued(t, nw, 2)
+	go func() { errs <- nw.SetWorking(context.Background()) }()
+	waitForQueued(t, nw, 3)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go nw.Run(stopCh)
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, <-errs)
+	}
+	assert.Equal(t, 3, countPatches(client))
+
+	// last writer wins
+	updated, err := nodes.Get(node.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, constants.MachineConfigDaemonStateWorking, updated.Annotations[constants.MachineConfigDaemonStateAnnotationKey])
+}
+
+func TestNodeWriterFullQueue(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	nodes := client.CoreV1().Nodes()
+	lister := newTestNodeLister(t, node)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	client.PrependReactor("patch", "nodes", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		return false, nil, nil
+	})
+	nw := NewNodeWriterWithOptions(WithQueueSize(1))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go nw.Run(stopCh)
+
+	const callers = 6
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func(i int) {
+			errs <- nw.SetAnnotationsForNode(context.Background(), nodes, lister, node.Name, map[string]string{"foo": fmt.Sprint(i)})
+		}(i)
+	}
+	<-started
+	waitForQueued(t, nw, 1)
+
+	// the callers waiting for room in the queue don't keep another one from
+	// giving up
+	late := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		late <- nw.SetAnnotationsForNode(ctx, nodes, lister, node.Name, map[string]string{"foo": "late"})
+	}()
+	select {
+	case err := <-late:
+		assert.Equal(t, context.DeadlineExceeded, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("caller blocked past its deadline")
+	}
+
+	close(release)
+	for i := 0; i < callers; i++ {
+		assert.Nil(t, <-errs)
+	}
+	assert.Equal(t, callers, countPatches(client))
+}
+
+func TestNodeWriterEvents(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+	recorder := record.NewFakeRecorder(10)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(recorder)
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+	go nw.Run(stopCh)
+
+	require.Nil(t, nw.SetWorking(context.Background()))
+	require.Nil(t, nw.SetDegraded(context.Background(), fmt.Errorf("boom")))
+	require.Nil(t, nw.SetUnreconcilable(context.Background(), fmt.Errorf("bad config")))
+	require.Nil(t, nw.SetDone(context.Background(), "rendered-worker-1"))
+
+	close(recorder.Events)
+	var events []string
+	for e := range recorder.Events {
+		events = append(events, e)
+	}
+	assert.Equal(t, []string{
+		"Warning Degraded boom",
+		"Warning Unreconcilable bad config",
+		"Normal Done Completed update to config rendered-worker-1",
+	}, events)
+}
+
+// gatherMetric scrapes the default registry and returns the value of the
+// counter, gauge or histogram sample count matching name and labels.
+func gatherMetric(t *testing.T, name string, labels map[string]string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.Nil(t, err)
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if labels[l.GetName()] != l.GetValue() {
+					continue metrics
+				}
+			}
+			switch f.GetType() {
+			case dto.MetricType_COUNTER:
+				return m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				return m.GetGauge().GetValue()
+			case dto.MetricType_HISTOGRAM:
+				return float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return 0
+}
+
+func TestNodeWriterMetrics(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+	go nw.Run(stopCh)
+
+	degraded := map[string]string{"state": writeStateDegraded}
+	errorsBefore := gatherMetric(t, "mcd_node_writer_errors_total", degraded)
+	writesBefore := gatherMetric(t, "mcd_node_writer_write_duration_seconds", nil)
+
+	nodes := client.CoreV1().Nodes()
+	require.Nil(t, nw.SetWorking(context.Background()))
+	// the lister doesn't know about this node, so the write fails
+	require.NotNil(t, nw.SetDegradedForNode(context.Background(), fmt.Errorf("test"), nodes, lister, "missing-node"))
+
+	assert.Equal(t, errorsBefore+1, gatherMetric(t, "mcd_node_writer_errors_total", degraded))
+	assert.Equal(t, writesBefore+2, gatherMetric(t, "mcd_node_writer_write_duration_seconds", nil))
+	assert.Equal(t, float64(0), gatherMetric(t, "mcd_node_writer_queue_depth", nil))
+}
+
+func TestUpdateNodeRetryStaleLister(t *testing.T) {
+	stale := newTestNode("node-0", map[string]string{})
+	stale.ResourceVersion = "1"
+	fresh := stale.DeepCopy()
+	fresh.ResourceVersion = "2"
+	fresh.Annotations["added-by-someone-else"] = "true"
+
+	client := k8sfake.NewSimpleClientset(fresh)
+	lister := newTestNodeLister(t, stale)
+
+	// Conflict on the first patch, which is computed against the stale node.
+	conflicted := false
+	client.PrependReactor("patch", "nodes", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if !conflicted {
+			conflicted = true
+			return true, nil, apierrors.NewConflict(corev1.Resource("nodes"), stale.Name, fmt.Errorf("stale"))
+		}
+		return false, nil, nil
+	})
+
+	_, err := updateNodeAnnotations(context.Background(), client.CoreV1().Nodes(), lister, stale.Name, map[string]string{"foo": "bar"}, nil)
+	require.Nil(t, err)
+	assert.True(t, conflicted)
+
+	var verbs []string
+	for _, a := range client.Actions() {
+		verbs = append(verbs, a.GetVerb())
+	}
+	assert.Equal(t, []string{"patch", "get", "patch"}, verbs)
+
+	updated, err := client.CoreV1().Nodes().Get(stale.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, "bar", updated.Annotations["foo"])
+	assert.Equal(t, "true", updated.Annotations["added-by-someone-else"])
+}
+
+func TestUpdateNodeAnnotationsNilAnnotations(t *testing.T) {
+	node := newTestNode("node-0", nil)
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+
+	_, err := updateNodeAnnotations(context.Background(), client.CoreV1().Nodes(), lister, node.Name, map[string]string{"foo": "bar"}, nil)
+	require.Nil(t, err)
+
+	updated, err := client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, "bar", updated.Annotations["foo"])
+}
+
+func TestUpdateNodeRetryErrorMessage(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+
+	client.PrependReactor("patch", "nodes", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(corev1.Resource("nodes"), node.Name, fmt.Errorf("not allowed"))
+	})
+
+	_, err := updateNodeAnnotations(context.Background(), client.CoreV1().Nodes(), lister, node.Name, map[string]string{"foo": "bar"}, nil)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), `unable to update node "node-0"`)
+	assert.Contains(t, err.Error(), "not allowed")
+	assert.NotContains(t, err.Error(), "%!")
+}
+
+func TestNodeWriterDrainsOnStop(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+
+	errs := make(chan error, 2)
+	go func() { errs <- nw.SetWorking(context.Background()) }()
+	waitForQueued(t, nw, 1)
+	go func() { errs <- nw.SetDone(context.Background(), "rendered-worker-1") }()
+	waitForQueued(t, nw, 2)
+
+	// Run with an already closed stop channel must still flush both writes.
+	stopCh := make(chan struct{})
+	close(stopCh)
+	nw.Run(stopCh)
+
+	assert.Nil(t, <-errs)
+	assert.Nil(t, <-errs)
+	assert.Equal(t, 2, countPatches(client))
+
+	// and then refuse new ones instead of blocking
+	assert.Equal(t, errNodeWriterClosed, nw.SetWorking(context.Background()))
+}
+
+func TestNodeWriterClose(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+	go nw.Run(stopCh)
+
+	require.Nil(t, nw.SetDone(context.Background(), "rendered-worker-1"))
+	nw.Close()
+	// Close is idempotent
+	nw.Close()
+	assert.Equal(t, errNodeWriterClosed, nw.SetWorking(context.Background()))
+}
+
+func TestNodeWriterUnbound(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(nil)
+	go nw.Run(stopCh)
+
+	assert.Equal(t, errNodeWriterUnbound, nw.SetWorking(context.Background()))
+}
+
+func TestNodeWriterBindWithoutLister(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), nil, node.Name)
+	go nw.Run(stopCh)
+
+	require.Nil(t, nw.SetDone(context.Background(), "rendered-worker-1"))
+	updated, err := client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, "rendered-worker-1", updated.Annotations[constants.CurrentMachineConfigAnnotationKey])
+}
+
+func TestNodeWriterSetPendingConfig(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+	go nw.Run(stopCh)
+
+	require.Nil(t, nw.SetPendingConfig(context.Background(), "rendered-worker-2"))
+	updated, err := client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, "rendered-worker-2", updated.Annotations[constants.PendingMachineConfigAnnotationKey])
+}
+
+func TestDoneClearsMatchingPendingConfig(t *testing.T) {
+	for _, tc := range []struct {
+		pending     string
+		done        string
+		wantPending bool
+	}{
+		{pending: "rendered-worker-2", done: "rendered-worker-2", wantPending: false},
+		// a SetDone for another config must not lose track of the reboot
+		{pending: "rendered-worker-2", done: "rendered-worker-1", wantPending: true},
+	} {
+		node := newTestNode("node-0", map[string]string{constants.PendingMachineConfigAnnotationKey: tc.pending})
+		doneMessage(context.Background(), tc.done).apply(node)
+		_, ok := node.Annotations[constants.PendingMachineConfigAnnotationKey]
+		assert.Equal(t, tc.wantPending, ok, "pending %s, done %s", tc.pending, tc.done)
+	}
+}
+
+func TestNodeWriterSetUnschedulable(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+	go nw.Run(stopCh)
+
+	annos := map[string]string{
+		constants.MachineConfigDaemonStateAnnotationKey: constants.MachineConfigDaemonStateWorking,
+	}
+	require.Nil(t, nw.SetUnschedulable(context.Background(), true, annos))
+
+	var patches []clienttesting.PatchAction
+	for _, a := range client.Actions() {
+		if p, ok := a.(clienttesting.PatchAction); ok {
+			patches = append(patches, p)
+		}
+	}
+	// cordoning and the annotation go out in a single patch
+	require.Len(t, patches, 1)
+	patch := string(patches[0].GetPatch())
+	assert.Contains(t, patch, `"unschedulable":true`)
+	assert.Contains(t, patch, constants.MachineConfigDaemonStateAnnotationKey)
+
+	updated, err := client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.True(t, updated.Spec.Unschedulable)
+	assert.Equal(t, constants.MachineConfigDaemonStateWorking, updated.Annotations[constants.MachineConfigDaemonStateAnnotationKey])
+}
+
+func TestNodeWriterUpdatingTaint(t *testing.T) {
+	other := corev1.Taint{Key: "other", Effect: corev1.TaintEffectNoExecute}
+	node := newTestNode("node-0", map[string]string{})
+	node.Spec.Taints = []corev1.Taint{other}
+	client := k8sfake.NewSimpleClientset(node)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(nil)
+	// no lister, so each write sees the result of the previous one
+	nw.Bind(client.CoreV1().Nodes(), nil, node.Name)
+	go nw.Run(stopCh)
+
+	getTaints := func() []corev1.Taint {
+		updated, err := client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+		require.Nil(t, err)
+		return updated.Spec.Taints
+	}
+
+	require.Nil(t, nw.ApplyUpdatingTaint(context.Background()))
+	assert.Equal(t, []corev1.Taint{other, updatingTaint}, getTaints())
+	// applying it again doesn't add a duplicate
+	require.Nil(t, nw.ApplyUpdatingTaint(context.Background()))
+	assert.Equal(t, []corev1.Taint{other, updatingTaint}, getTaints())
+
+	require.Nil(t, nw.RemoveUpdatingTaint(context.Background()))
+	assert.Equal(t, []corev1.Taint{other}, getTaints())
+	// and removing it when it's gone is fine too
+	require.Nil(t, nw.RemoveUpdatingTaint(context.Background()))
+	assert.Equal(t, []corev1.Taint{other}, getTaints())
+	assert.Equal(t, 2, countPatches(client))
+}
+
+func TestUpdateNodeRetryNodeGone(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+	// the lister still has the node, but it is deleted from the API server
+	// before the patch
+	client.PrependReactor("patch", "nodes", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewNotFound(corev1.Resource("nodes"), node.Name)
+	})
+
+	_, err := updateNodeAnnotations(context.Background(), client.CoreV1().Nodes(), lister, node.Name, map[string]string{"foo": "bar"}, nil)
+	require.NotNil(t, err)
+	assert.Equal(t, ErrNodeGone, errors.Cause(err))
+	// not retried
+	assert.Equal(t, 1, countPatches(client))
+
+	// and a node missing from the lister is gone too
+	_, err = updateNodeAnnotations(context.Background(), client.CoreV1().Nodes(), newTestNodeLister(t), node.Name, map[string]string{"foo": "bar"}, nil)
+	require.NotNil(t, err)
+	assert.Equal(t, ErrNodeGone, errors.Cause(err))
+}
+
+func TestUpdateNodeRetryNodeGoneAfterConflict(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+	client.PrependReactor("patch", "nodes", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewConflict(corev1.Resource("nodes"), node.Name, fmt.Errorf("conflict"))
+	})
+	// deleted before the retry reads it again
+	client.PrependReactor("get", "nodes", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewNotFound(corev1.Resource("nodes"), node.Name)
+	})
+
+	_, err := updateNodeAnnotations(context.Background(), client.CoreV1().Nodes(), lister, node.Name, map[string]string{"foo": "bar"}, nil)
+	require.NotNil(t, err)
+	assert.Equal(t, ErrNodeGone, errors.Cause(err))
+	assert.Contains(t, err.Error(), "last patch error")
+}
+
+func TestNewNodeWriterWithOptions(t *testing.T) {
+	// defaults are the same as NewNodeWriter
+	nw := NewNodeWriterWithOptions()
+	assert.Equal(t, defaultWriterQueue, cap(nw.writer))
+	assert.Equal(t, retry.DefaultBackoff, nw.backoff)
+	assert.Equal(t, defaultOutageBackoff, nw.outageBackoff)
+	assert.Nil(t, nw.rateLimiter)
+	assert.Nil(t, nw.recorder)
+
+	backoff := wait.Backoff{Steps: 2, Duration: time.Millisecond, Factor: 1}
+	recorder := record.NewFakeRecorder(1)
+	nw = NewNodeWriterWithOptions(WithQueueSize(3), WithBackoff(backoff), WithRateLimit(10), WithRecorder(recorder))
+	assert.Equal(t, 3, cap(nw.writer))
+	assert.Equal(t, backoff, nw.backoff)
+	assert.Equal(t, float32(10), nw.rateLimiter.QPS())
+	assert.Equal(t, recorder, nw.recorder)
+}
+
+func TestNodeWriterBackoff(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+	client.PrependReactor("patch", "nodes", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewConflict(corev1.Resource("nodes"), node.Name, fmt.Errorf("conflict"))
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriterWithOptions(WithBackoff(wait.Backoff{Steps: 6, Duration: time.Millisecond, Factor: 1}))
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+	go nw.Run(stopCh)
+
+	require.NotNil(t, nw.SetWorking(context.Background()))
+	assert.Equal(t, 6, countPatches(client))
+}
+
+func TestNodeWriterOutage(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+	failures := 3
+	client.PrependReactor("patch", "nodes", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if failures > 0 {
+			failures--
+			return true, nil, apierrors.NewServiceUnavailable("apiserver is shutting down")
+		}
+		return false, nil, nil
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriterWithOptions(WithOutageBackoff(wait.Backoff{Steps: 10, Duration: time.Millisecond, Factor: 1}))
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+	go nw.Run(stopCh)
+
+	// the writes queued behind are flushed in order once the API is back
+	working := nw.QueueWorking(context.Background())
+	progress := nw.QueueUpdateProgress(context.Background(), UpdateProgress{Phase: updatePhaseUpdatingFiles})
+	require.Nil(t, working.Wait())
+	require.Nil(t, progress.Wait())
+	assert.Equal(t, 5, countPatches(client))
+	updated, err := client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, constants.MachineConfigDaemonStateWorking, updated.Annotations[constants.MachineConfigDaemonStateAnnotationKey])
+	assert.Contains(t, updated.Annotations[updateProgressAnnotationKey], updatePhaseUpdatingFiles)
+}
+
+func TestNodeWriterOutageGivesUp(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	lister := newTestNodeLister(t, node)
+	client.PrependReactor("patch", "nodes", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewServiceUnavailable("apiserver is shutting down")
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriterWithOptions(WithOutageBackoff(wait.Backoff{Steps: 1000, Duration: time.Millisecond, Factor: 1}))
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+	go nw.Run(stopCh)
+
+	// once the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := nw.QueueWorking(ctx).Wait()
+	require.NotNil(t, err)
+
+	// or the steps are exhausted
+	nw = NewNodeWriterWithOptions(WithOutageBackoff(wait.Backoff{Steps: 3, Duration: time.Millisecond, Factor: 1}))
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+	go nw.Run(stopCh)
+	client.ClearActions()
+	err = nw.SetWorking(context.Background())
+	require.NotNil(t, err)
+	assert.True(t, apierrors.IsServiceUnavailable(errors.Cause(err)))
+	assert.Equal(t, 3, countPatches(client))
+
+	// without steps, at once
+	nw = NewNodeWriterWithOptions(WithOutageBackoff(wait.Backoff{}))
+	nw.Bind(client.CoreV1().Nodes(), lister, node.Name)
+	go nw.Run(stopCh)
+	client.ClearActions()
+	require.NotNil(t, nw.SetWorking(context.Background()))
+	assert.Equal(t, 1, countPatches(client))
+}
+
+func TestNodeWriterCollapsesHeldWrites(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	nodes := client.CoreV1().Nodes()
+	lister := newTestNodeLister(t, node)
+	nw := NewNodeWriter(nil)
+	nw.Bind(nodes, lister, node.Name)
+
+	// as if the writes had been held behind one retried during an outage
+	working := nw.QueueWorking(context.Background())
+	waitForQueued(t, nw, 1)
+	errs := make(chan error, 1)
+	go func() { errs <- nw.SetDone(context.Background(), "rendered-worker-1") }()
+	waitForQueued(t, nw, 2)
+	nw.lock.Lock()
+	nw.heldUntil = time.Now()
+	nw.lock.Unlock()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go nw.Run(stopCh)
+
+	// Working is superseded by Done, its caller gets the outcome of Done
+	assert.Nil(t, working.Wait())
+	assert.Nil(t, <-errs)
+	assert.Equal(t, 1, countPatches(client))
+	updated, err := nodes.Get(node.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, constants.MachineConfigDaemonStateDone, updated.Annotations[constants.MachineConfigDaemonStateAnnotationKey])
+	assert.Equal(t, "rendered-worker-1", updated.Annotations[constants.CurrentMachineConfigAnnotationKey])
+}
+
+func TestMessageSupersedes(t *testing.T) {
+	ctx := context.Background()
+	progress := &message{annos: map[string]string{updateProgressAnnotationKey: "{}"}}
+	tests := []struct {
+		name         string
+		older, newer *message
+		supersedes   bool
+	}{
+		{"done supersedes working", workingMessage(ctx), doneMessage(ctx, "rendered-worker-1"), true},
+		{"degraded supersedes working", workingMessage(ctx), degradedMessage(ctx, fmt.Errorf("boom")), true},
+		{"progress supersedes progress", progress, progress, true},
+		{"progress leaves the state", workingMessage(ctx), progress, false},
+		{"working leaves the current config", doneMessage(ctx, "rendered-worker-1"), workingMessage(ctx), false},
+		{"events are emitted", heldMessage(ctx, "rendered-worker-1"), doneMessage(ctx, "rendered-worker-1"), false},
+		{"mutations are made", sshAccessedMessage(ctx, "core"), doneMessage(ctx, "rendered-worker-1"), false},
+		{"pending configs are conditionally removed", pendingConfigMessage(ctx, "rendered-worker-1"), doneMessage(ctx, "rendered-worker-1"), false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.supersedes, test.newer.supersedes(test.older), test.name)
+	}
+}
+
+func TestIsAPIUnavailable(t *testing.T) {
+	resource := corev1.Resource("nodes")
+	tests := []struct {
+		err         error
+		unavailable bool
+	}{
+		{apierrors.NewServiceUnavailable("shutting down"), true},
+		{apierrors.NewServerTimeout(resource, "patch", 1), true},
+		{apierrors.NewTimeoutError("timed out", 1), true},
+		{apierrors.NewTooManyRequests("slow down", 1), true},
+		{errors.Wrap(&url.Error{Op: "Patch", URL: "https://api:6443", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, "unable to update node"), true},
+		{io.EOF, true},
+		{apierrors.NewConflict(resource, "node-0", fmt.Errorf("conflict")), false},
+		{apierrors.NewForbidden(resource, "node-0", fmt.Errorf("not allowed")), false},
+		{errors.Wrap(ErrNodeGone, "unable to update node"), false},
+		{context.DeadlineExceeded, false},
+		{context.Canceled, false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.unavailable, isAPIUnavailable(test.err), "%v", test.err)
+	}
+}
+
+func TestNodeWriterSkipsNoopPatches(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(nil)
+	// no lister, so each write sees the result of the previous one
+	nw.Bind(client.CoreV1().Nodes(), nil, node.Name)
+	go nw.Run(stopCh)
+
+	require.Nil(t, nw.SetDone(context.Background(), "rendered-worker-1"))
+	assert.Equal(t, 1, countPatches(client))
+	// re-asserting the same state succeeds without a patch
+	require.Nil(t, nw.SetDone(context.Background(), "rendered-worker-1"))
+	assert.Equal(t, 1, countPatches(client))
+
+	// but the same key with a different value is patched
+	require.Nil(t, nw.SetDone(context.Background(), "rendered-worker-2"))
+	assert.Equal(t, 2, countPatches(client))
+	updated, err := client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, "rendered-worker-2", updated.Annotations[constants.CurrentMachineConfigAnnotationKey])
+}
+
+func TestNodeWriterConcurrency(t *testing.T) {
+	// find two nodes landing on different shards
+	nw := NewNodeWriterWithOptions(WithConcurrency(2))
+	slow := newTestNode("node-0", map[string]string{})
+	var fast *corev1.Node
+	for i := 1; fast == nil; i++ {
+		n := newTestNode(fmt.Sprintf("node-%d", i), map[string]string{})
+		if nw.shardOf(n.Name) != nw.shardOf(slow.Name) {
+			fast = n
+		}
+	}
+	// The fake clientset is locked while a reactor runs, so each node gets
+	// its own.
+	slowClient := k8sfake.NewSimpleClientset(slow)
+	fastClient := k8sfake.NewSimpleClientset(fast)
+	lister := newTestNodeLister(t, slow, fast)
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	slowClient.PrependReactor("patch", "nodes", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		started <- struct{}{}
+		<-release
+		return false, nil, nil
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go nw.Run(stopCh)
+
+	slowErrs := make(chan error, 2)
+	go func() {
+		slowErrs <- nw.SetWorkingForNode(context.Background(), slowClient.CoreV1().Nodes(), lister, slow.Name)
+	}()
+	<-started
+	go func() {
+		slowErrs <- nw.SetDoneForNode(context.Background(), slowClient.CoreV1().Nodes(), lister, slow.Name, "rendered-worker-1")
+	}()
+
+	// the blocked node doesn't hold up writes to the other one
+	require.Nil(t, nw.SetWorkingForNode(context.Background(), fastClient.CoreV1().Nodes(), lister, fast.Name))
+
+	close(release)
+	require.Nil(t, <-slowErrs)
+	require.Nil(t, <-slowErrs)
+
+	// and the writes to the same node kept their order
+	var patches []string
+	for _, a := range slowClient.Actions() {
+		if p, ok := a.(clienttesting.PatchAction); ok {
+			patches = append(patches, string(p.GetPatch()))
+		}
+	}
+	require.Len(t, patches, 2)
+	assert.Contains(t, patches[0], constants.MachineConfigDaemonStateWorking)
+	assert.Contains(t, patches[1], constants.MachineConfigDaemonStateDone)
+}
+
+func TestNodeWriterStuckNode(t *testing.T) {
+	nw := NewNodeWriterWithOptions(WithConcurrency(2), WithQueueSize(1))
+	stuck := newTestNode("node-0", map[string]string{})
+	var other *corev1.Node
+	for i := 1; other == nil; i++ {
+		n := newTestNode(fmt.Sprintf("node-%d", i), map[string]string{})
+		if nw.shardOf(n.Name) != nw.shardOf(stuck.Name) {
+			other = n
+		}
+	}
+	stuckClient := k8sfake.NewSimpleClientset(stuck)
+	otherClient := k8sfake.NewSimpleClientset(other)
+	lister := newTestNodeLister(t, stuck, other)
+	release := make(chan struct{})
+	stuckClient.PrependReactor("patch", "nodes", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		<-release
+		return false, nil, nil
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go nw.Run(stopCh)
+
+	// more writes for the stuck node than fit in the queue
+	const writes = 5
+	errs := make(chan error, writes)
+	for i := 0; i < writes; i++ {
+		go func(i int) {
+			errs <- nw.SetAnnotationsForNode(context.Background(), stuckClient.CoreV1().Nodes(), lister, stuck.Name, map[string]string{"foo": fmt.Sprint(i)})
+		}(i)
+	}
+	err := wait.PollImmediate(time.Millisecond, 5*time.Second, func() (bool, error) {
+		return nw.shardOf(stuck.Name).len() == writes-1, nil
+	})
+	require.Nil(t, err, "timed out waiting for the writes to the stuck node")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.Nil(t, nw.SetWorkingForNode(ctx, otherClient.CoreV1().Nodes(), lister, other.Name), "the write to the other node is delayed")
+
+	close(release)
+	for i := 0; i < writes; i++ {
+		assert.Nil(t, <-errs)
+	}
+}
+
+func TestNodeWriterSetSSHAccessed(t *testing.T) {
+	for _, tc := range []struct {
+		current string
+		want    string
+	}{
+		{current: "", want: "1"},
+		// legacy value written by older daemons
+		{current: machineConfigDaemonSSHAccessValue, want: "2"},
+		{current: "5", want: "6"},
+	} {
+		annos := map[string]string{}
+		if tc.current != "" {
+			annos[machineConfigDaemonSSHAccessAnnotationKey] = tc.current
+		}
+		node := newTestNode("node-0", annos)
+		sshAccessedMessage(context.Background(), "").apply(node)
+		assert.Equal(t, tc.want, node.Annotations[machineConfigDaemonSSHAccessAnnotationKey], "current %q", tc.current)
+		_, err := time.Parse(time.RFC3339, node.Annotations[machineConfigDaemonSSHLastAccessedAnnotationKey])
+		assert.Nil(t, err)
+		_, ok := node.Annotations[machineConfigDaemonSSHUsersAnnotationKey]
+		assert.False(t, ok, "unknown user recorded")
+	}
+}
+
+func TestNodeWriterSetSSHAccessedUsers(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	for _, user := range []string{"core", "admin", "core"} {
+		sshAccessedMessage(context.Background(), user).apply(node)
+	}
+	assert.Equal(t, "3", node.Annotations[machineConfigDaemonSSHAccessAnnotationKey])
+	assert.Equal(t, "admin,core", node.Annotations[machineConfigDaemonSSHUsersAnnotationKey])
+}
+
+func TestNodeWriterSetSSHAccessedConflict(t *testing.T) {
+	// the lister hasn't seen the second access yet
+	cached := newTestNode("node-0", map[string]string{machineConfigDaemonSSHAccessAnnotationKey: "1"})
+	client := k8sfake.NewSimpleClientset(newTestNode("node-0", map[string]string{machineConfigDaemonSSHAccessAnnotationKey: "2"}))
+	lister := newTestNodeLister(t, cached)
+	conflicted := false
+	client.PrependReactor("patch", "nodes", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if !conflicted {
+			conflicted = true
+			return true, nil, apierrors.NewConflict(corev1.Resource("nodes"), cached.Name, fmt.Errorf("conflict"))
+		}
+		return false, nil, nil
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), lister, cached.Name)
+	go nw.Run(stopCh)
+
+	require.Nil(t, nw.SetSSHAccessed(context.Background(), "core"))
+	updated, err := client.CoreV1().Nodes().Get(cached.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	// the retry counted from the latest value, not the cached one
+	assert.Equal(t, "3", updated.Annotations[machineConfigDaemonSSHAccessAnnotationKey])
+}
+
+func TestNodeWriterSetSSHAccessedNotCoalesced(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), nil, node.Name)
+
+	// both accesses are queued while the writer isn't running
+	errs := make(chan error, 2)
+	go func() { errs <- nw.SetSSHAccessed(context.Background(), "alice") }()
+	waitForQueued(t, nw, 1)
+	go func() { errs <- nw.SetSSHAccessed(context.Background(), "bob") }()
+	waitForQueued(t, nw, 2)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go nw.Run(stopCh)
+
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, <-errs)
+	}
+	updated, err := client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, "2", updated.Annotations[machineConfigDaemonSSHAccessAnnotationKey])
+	assert.Equal(t, "alice,bob", updated.Annotations[machineConfigDaemonSSHUsersAnnotationKey])
+}
+
+func TestNodeWriterSetUpdateProgress(t *testing.T) {
+	node := newTestNode("node-0", map[string]string{})
+	client := k8sfake.NewSimpleClientset(node)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nw := NewNodeWriter(nil)
+	nw.Bind(client.CoreV1().Nodes(), nil, node.Name)
+	go nw.Run(stopCh)
+
+	started := time.Date(2019, 2, 1, 10, 0, 0, 0, time.UTC)
+	progress := UpdateProgress{Phase: "Draining", Step: "5/6", StartedAt: started, Detail: "updating to rendered-worker-2"}
+	require.Nil(t, nw.SetUpdateProgress(context.Background(), progress))
+
+	updated, err := client.CoreV1().Nodes().Get(node.Name, metav1.GetOptions{})
+	require.Nil(t, err)
+	var got UpdateProgress
+	require.Nil(t, json.Unmarshal([]byte(updated.Annotations[updateProgressAnnotationKey]), &got))
+	assert.Equal(t, progress, got)
+
+	// SetDone clears it
+	n := updated.DeepCopy()
+	doneMessage(context.Background(), "rendered-worker-2").apply(n)
+	_, ok := n.Annotations[updateProgressAnnotationKey]
+	assert.False(t, ok)
+}
+
+func TestMarshalUpdateProgressCapped(t *testing.T) {
+	progress := UpdateProgress{Phase: "UpdatingOS", Step: "4/6", Detail: strings.Repeat("é\"", maxUpdateProgressLength)}
+	b, err := marshalUpdateProgress(progress)
+	require.Nil(t, err)
+	assert.True(t, len(b) <= maxUpdateProgressLength, "%d bytes", len(b))
+	var got UpdateProgress
+	require.Nil(t, json.Unmarshal([]byte(b), &got))
+	assert.Equal(t, "UpdatingOS", got.Phase)
+	assert.True(t, utf8.ValidString(got.Detail))
+}
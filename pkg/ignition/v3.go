@@ -0,0 +1,341 @@
+package ignition
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	ignv2 "github.com/coreos/ignition/config/v2_2"
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/coreos/ignition/config/validate"
+	"github.com/pkg/errors"
+)
+
+// v3Version is the version of the Ignition 3 spec configs can be in.
+const v3Version = "3.0.0"
+
+// The types below are those of the Ignition 3.0 spec the MCO reads. They
+// differ from those of 2.2 in their optional fields, which are pointers, in
+// file appends, which are a list of fragments, and in files not naming their
+// filesystem.
+
+type v3Config struct {
+	Ignition v3Ignition `json:"ignition"`
+	Passwd   v3Passwd   `json:"passwd,omitempty"`
+	Storage  v3Storage  `json:"storage,omitempty"`
+	Systemd  v3Systemd  `json:"systemd,omitempty"`
+}
+
+type v3Ignition struct {
+	Config   v3IgnitionConfig      `json:"config,omitempty"`
+	Security ignv2_2types.Security `json:"security,omitempty"`
+	Timeouts ignv2_2types.Timeouts `json:"timeouts,omitempty"`
+	Version  string                `json:"version,omitempty"`
+}
+
+type v3IgnitionConfig struct {
+	Merge   []v3ConfigReference `json:"merge,omitempty"`
+	Replace v3ConfigReference   `json:"replace,omitempty"`
+}
+
+type v3ConfigReference struct {
+	Source       *string                   `json:"source,omitempty"`
+	Verification ignv2_2types.Verification `json:"verification,omitempty"`
+}
+
+type v3Passwd struct {
+	Groups []v3PasswdGroup `json:"groups,omitempty"`
+	Users  []v3PasswdUser  `json:"users,omitempty"`
+}
+
+type v3PasswdGroup struct {
+	Gid          *int    `json:"gid,omitempty"`
+	Name         string  `json:"name"`
+	PasswordHash *string `json:"passwordHash,omitempty"`
+	System       *bool   `json:"system,omitempty"`
+}
+
+type v3PasswdUser struct {
+	Gecos             *string  `json:"gecos,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+	HomeDir           *string  `json:"homeDir,omitempty"`
+	Name              string   `json:"name"`
+	NoCreateHome      *bool    `json:"noCreateHome,omitempty"`
+	NoLogInit         *bool    `json:"noLogInit,omitempty"`
+	NoUserGroup       *bool    `json:"noUserGroup,omitempty"`
+	PasswordHash      *string  `json:"passwordHash,omitempty"`
+	PrimaryGroup      *string  `json:"primaryGroup,omitempty"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+	Shell             *string  `json:"shell,omitempty"`
+	System            *bool    `json:"system,omitempty"`
+	UID               *int     `json:"uid,omitempty"`
+}
+
+type v3Storage struct {
+	Directories []v3Directory `json:"directories,omitempty"`
+	// Disks, Filesystems and Raid are only checked for being empty, see
+	// translateV3
+	Disks       []json.RawMessage `json:"disks,omitempty"`
+	Files       []v3File          `json:"files,omitempty"`
+	Filesystems []json.RawMessage `json:"filesystems,omitempty"`
+	Links       []v3Link          `json:"links,omitempty"`
+	Raid        []json.RawMessage `json:"raid,omitempty"`
+}
+
+type v3Node struct {
+	Group     v3NodeGroup `json:"group,omitempty"`
+	Overwrite *bool       `json:"overwrite,omitempty"`
+	Path      string      `json:"path"`
+	User      v3NodeUser  `json:"user,omitempty"`
+}
+
+type v3NodeGroup struct {
+	ID   *int    `json:"id,omitempty"`
+	Name *string `json:"name,omitempty"`
+}
+
+type v3NodeUser struct {
+	ID   *int    `json:"id,omitempty"`
+	Name *string `json:"name,omitempty"`
+}
+
+type v3Directory struct {
+	v3Node
+	Mode *int `json:"mode,omitempty"`
+}
+
+type v3File struct {
+	v3Node
+	Append   []v3FileContents `json:"append,omitempty"`
+	Contents v3FileContents   `json:"contents,omitempty"`
+	Mode     *int             `json:"mode,omitempty"`
+}
+
+type v3FileContents struct {
+	Compression  *string                   `json:"compression,omitempty"`
+	Source       *string                   `json:"source,omitempty"`
+	Verification ignv2_2types.Verification `json:"verification,omitempty"`
+}
+
+type v3Link struct {
+	v3Node
+	Hard   *bool  `json:"hard,omitempty"`
+	Target string `json:"target"`
+}
+
+type v3Systemd struct {
+	Units []v3Unit `json:"units,omitempty"`
+}
+
+type v3Unit struct {
+	Contents *string    `json:"contents,omitempty"`
+	Dropins  []v3Dropin `json:"dropins,omitempty"`
+	Enabled  *bool      `json:"enabled,omitempty"`
+	Mask     *bool      `json:"mask,omitempty"`
+	Name     string     `json:"name"`
+}
+
+type v3Dropin struct {
+	Contents *string `json:"contents,omitempty"`
+	Name     string  `json:"name"`
+}
+
+// Version returns the version of the Ignition config raw, empty if it isn't
+// one.
+func Version(raw []byte) string {
+	var config struct {
+		Ignition struct {
+			Version string `json:"version"`
+		} `json:"ignition"`
+	}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return ""
+	}
+	return config.Ignition.Version
+}
+
+// IsV3 returns whether raw is an Ignition config of the 3 spec.
+func IsV3(raw []byte) bool {
+	return strings.HasPrefix(Version(raw), "3.")
+}
+
+// Parse parses raw, an Ignition config of the 2.x or 3.0 spec, into the 2.2
+// config the MCO works with, and validates it.
+func Parse(raw []byte) (ignv2_2types.Config, error) {
+	if IsV3(raw) {
+		config, err := ParseV3(raw)
+		if err != nil {
+			return ignv2_2types.Config{}, err
+		}
+		if rpt := validate.ValidateWithoutSource(reflect.ValueOf(config)); rpt.IsFatal() {
+			return ignv2_2types.Config{}, errors.Errorf("invalid Ignition config: %v", rpt)
+		}
+		return config, nil
+	}
+	config, _, err := ignv2.Parse(raw)
+	return config, err
+}
+
+// ParseV3 parses raw, an Ignition config of the 3.0 spec, into the 2.2 config
+// the MCO works with. Fields unknown to the 3.0 spec are errors, and so are
+// those which have no 2.2 equivalent: the disks, RAID arrays and filesystems,
+// which nodes only get when provisioned anyway.
+func ParseV3(raw []byte) (ignv2_2types.Config, error) {
+	var config v3Config
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return ignv2_2types.Config{}, errors.Wrapf(err, "parsing Ignition %s config", v3Version)
+	}
+	if config.Ignition.Version != v3Version {
+		return ignv2_2types.Config{}, fmt.Errorf("unsupported Ignition config version %q, expected 2.x or %s", config.Ignition.Version, v3Version)
+	}
+	return translateV3(config)
+}
+
+func translateV3(config v3Config) (ignv2_2types.Config, error) {
+	out := ignv2_2types.Config{
+		Ignition: ignv2_2types.Ignition{
+			Version:  ignv2_2types.MaxVersion.String(),
+			Security: config.Ignition.Security,
+			Timeouts: config.Ignition.Timeouts,
+		},
+	}
+	for _, ref := range config.Ignition.Config.Merge {
+		out.Ignition.Config.Append = append(out.Ignition.Config.Append, translateConfigReference(ref))
+	}
+	if config.Ignition.Config.Replace.Source != nil {
+		ref := translateConfigReference(config.Ignition.Config.Replace)
+		out.Ignition.Config.Replace = &ref
+	}
+
+	for _, group := range config.Passwd.Groups {
+		out.Passwd.Groups = append(out.Passwd.Groups, ignv2_2types.PasswdGroup{
+			Gid:          group.Gid,
+			Name:         group.Name,
+			PasswordHash: stringValue(group.PasswordHash),
+			System:       boolValue(group.System),
+		})
+	}
+	for _, user := range config.Passwd.Users {
+		u := ignv2_2types.PasswdUser{
+			Gecos:        stringValue(user.Gecos),
+			HomeDir:      stringValue(user.HomeDir),
+			Name:         user.Name,
+			NoCreateHome: boolValue(user.NoCreateHome),
+			NoLogInit:    boolValue(user.NoLogInit),
+			NoUserGroup:  boolValue(user.NoUserGroup),
+			PasswordHash: user.PasswordHash,
+			PrimaryGroup: stringValue(user.PrimaryGroup),
+			Shell:        stringValue(user.Shell),
+			System:       boolValue(user.System),
+			UID:          user.UID,
+		}
+		for _, group := range user.Groups {
+			u.Groups = append(u.Groups, ignv2_2types.Group(group))
+		}
+		for _, key := range user.SSHAuthorizedKeys {
+			u.SSHAuthorizedKeys = append(u.SSHAuthorizedKeys, ignv2_2types.SSHAuthorizedKey(key))
+		}
+		out.Passwd.Users = append(out.Passwd.Users, u)
+	}
+
+	for _, section := range []struct {
+		name  string
+		items []json.RawMessage
+	}{
+		{"disks", config.Storage.Disks},
+		{"filesystems", config.Storage.Filesystems},
+		{"raid", config.Storage.Raid},
+	} {
+		if len(section.items) > 0 {
+			return ignv2_2types.Config{}, fmt.Errorf("storage.%s of Ignition %s configs aren't supported", section.name, v3Version)
+		}
+	}
+	for _, dir := range config.Storage.Directories {
+		out.Storage.Directories = append(out.Storage.Directories, ignv2_2types.Directory{
+			Node:               translateNode(dir.v3Node),
+			DirectoryEmbedded1: ignv2_2types.DirectoryEmbedded1{Mode: dir.Mode},
+		})
+	}
+	for _, file := range config.Storage.Files {
+		f := ignv2_2types.File{
+			Node: translateNode(file.v3Node),
+			FileEmbedded1: ignv2_2types.FileEmbedded1{
+				Contents: translateFileContents(file.Contents),
+				Mode:     file.Mode,
+			},
+		}
+		// 2.2 has an entry per fragment appended instead, after the one
+		// replacing the contents if any
+		if file.Contents.Source != nil || len(file.Append) == 0 {
+			out.Storage.Files = append(out.Storage.Files, f)
+		}
+		for _, fragment := range file.Append {
+			f.Append = true
+			f.Contents = translateFileContents(fragment)
+			out.Storage.Files = append(out.Storage.Files, f)
+		}
+	}
+	for _, link := range config.Storage.Links {
+		out.Storage.Links = append(out.Storage.Links, ignv2_2types.Link{
+			Node:          translateNode(link.v3Node),
+			LinkEmbedded1: ignv2_2types.LinkEmbedded1{Hard: boolValue(link.Hard), Target: link.Target},
+		})
+	}
+
+	for _, unit := range config.Systemd.Units {
+		u := ignv2_2types.Unit{
+			Contents: stringValue(unit.Contents),
+			Enabled:  unit.Enabled,
+			Mask:     boolValue(unit.Mask),
+			Name:     unit.Name,
+		}
+		for _, dropin := range unit.Dropins {
+			u.Dropins = append(u.Dropins, ignv2_2types.SystemdDropin{Contents: stringValue(dropin.Contents), Name: dropin.Name})
+		}
+		out.Systemd.Units = append(out.Systemd.Units, u)
+	}
+	return out, nil
+}
+
+func translateConfigReference(ref v3ConfigReference) ignv2_2types.ConfigReference {
+	return ignv2_2types.ConfigReference{Source: stringValue(ref.Source), Verification: ref.Verification}
+}
+
+// translateNode translates node, on the root filesystem in 2.2.
+func translateNode(node v3Node) ignv2_2types.Node {
+	out := ignv2_2types.Node{
+		Filesystem: "root",
+		Overwrite:  node.Overwrite,
+		Path:       node.Path,
+	}
+	if node.User.ID != nil || node.User.Name != nil {
+		out.User = &ignv2_2types.NodeUser{ID: node.User.ID, Name: stringValue(node.User.Name)}
+	}
+	if node.Group.ID != nil || node.Group.Name != nil {
+		out.Group = &ignv2_2types.NodeGroup{ID: node.Group.ID, Name: stringValue(node.Group.Name)}
+	}
+	return out
+}
+
+func translateFileContents(contents v3FileContents) ignv2_2types.FileContents {
+	return ignv2_2types.FileContents{
+		Compression:  stringValue(contents.Compression),
+		Source:       stringValue(contents.Source),
+		Verification: contents.Verification,
+	}
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func boolValue(b *bool) bool {
+	return b != nil && *b
+}
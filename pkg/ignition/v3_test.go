@@ -0,0 +1,104 @@
+package ignition
+
+import (
+	"encoding/json"
+	"testing"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testV3Config and testV2Config are the same config in both specs.
+const (
+	testV3Config = `{
+  "ignition": {"version": "3.0.0"},
+  "passwd": {"users": [{"name": "core", "sshAuthorizedKeys": ["ssh-rsa AAAA core@example.com"]}]},
+  "storage": {
+    "files": [
+      {"path": "/etc/chrony.conf", "mode": 420, "overwrite": true, "user": {"name": "root"},
+       "contents": {"source": "data:,server%20pool.ntp.org", "verification": {"hash": "sha512-00000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"}}},
+      {"path": "/etc/motd", "append": [{"source": "data:,hello"}]}
+    ],
+    "directories": [{"path": "/etc/foo.d", "mode": 493}],
+    "links": [{"path": "/etc/localtime", "target": "/usr/share/zoneinfo/UTC"}]
+  },
+  "systemd": {"units": [
+    {"name": "kubelet.service", "enabled": true, "contents": "[Service]\nExecStart=/usr/bin/kubelet\n",
+     "dropins": [{"name": "10-env.conf", "contents": "[Service]\nEnvironment=A=B\n"}]},
+    {"name": "rpcbind.service", "mask": true}
+  ]}
+}`
+	testV2Config = `{
+  "ignition": {"version": "2.2.0"},
+  "passwd": {"users": [{"name": "core", "sshAuthorizedKeys": ["ssh-rsa AAAA core@example.com"]}]},
+  "storage": {
+    "files": [
+      {"filesystem": "root", "path": "/etc/chrony.conf", "mode": 420, "overwrite": true, "user": {"name": "root"},
+       "contents": {"source": "data:,server%20pool.ntp.org", "verification": {"hash": "sha512-00000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"}}},
+      {"filesystem": "root", "path": "/etc/motd", "append": true, "contents": {"source": "data:,hello"}}
+    ],
+    "directories": [{"filesystem": "root", "path": "/etc/foo.d", "mode": 493}],
+    "links": [{"filesystem": "root", "path": "/etc/localtime", "target": "/usr/share/zoneinfo/UTC"}]
+  },
+  "systemd": {"units": [
+    {"name": "kubelet.service", "enabled": true, "contents": "[Service]\nExecStart=/usr/bin/kubelet\n",
+     "dropins": [{"name": "10-env.conf", "contents": "[Service]\nEnvironment=A=B\n"}]},
+    {"name": "rpcbind.service", "mask": true}
+  ]}
+}`
+)
+
+func TestParseV3(t *testing.T) {
+	assert.Equal(t, "3.0.0", Version([]byte(testV3Config)))
+	assert.True(t, IsV3([]byte(testV3Config)))
+	assert.False(t, IsV3([]byte(testV2Config)))
+	assert.Equal(t, "", Version([]byte("not a config")))
+
+	fromV3, err := Parse([]byte(testV3Config))
+	require.Nil(t, err)
+	fromV2, err := Parse([]byte(testV2Config))
+	require.Nil(t, err)
+	assert.Equal(t, fromV2, fromV3, "both specs parse into the same config")
+	require.Len(t, fromV3.Storage.Files, 2)
+	assert.True(t, fromV3.Storage.Files[1].Append)
+	require.Len(t, fromV3.Systemd.Units, 2)
+	assert.Equal(t, []ignv2_2types.SystemdDropin{{Name: "10-env.conf", Contents: "[Service]\nEnvironment=A=B\n"}}, fromV3.Systemd.Units[0].Dropins)
+	assert.True(t, fromV3.Systemd.Units[1].Mask)
+	assert.Equal(t, []ignv2_2types.SSHAuthorizedKey{"ssh-rsa AAAA core@example.com"}, fromV3.Passwd.Users[0].SSHAuthorizedKeys)
+
+	// the translated config reads back as it is
+	b, err := json.Marshal(fromV3)
+	require.Nil(t, err)
+	roundTrip, err := Parse(b)
+	require.Nil(t, err)
+	assert.Equal(t, fromV3, roundTrip)
+}
+
+func TestParseV3Appends(t *testing.T) {
+	config, err := ParseV3([]byte(`{"ignition": {"version": "3.0.0"}, "storage": {"files": [
+		{"path": "/etc/motd", "mode": 420, "contents": {"source": "data:,base"}, "append": [{"source": "data:,a"}, {"source": "data:,b"}]}
+	]}}`))
+	require.Nil(t, err)
+	require.Len(t, config.Storage.Files, 3, "an entry for the contents and one per fragment")
+	for i, source := range []string{"data:,base", "data:,a", "data:,b"} {
+		f := config.Storage.Files[i]
+		assert.Equal(t, "/etc/motd", f.Path)
+		assert.Equal(t, source, f.Contents.Source)
+		assert.Equal(t, i > 0, f.Append)
+		assert.Equal(t, 420, *f.Mode)
+	}
+}
+
+func TestParseV3Errors(t *testing.T) {
+	for config, expected := range map[string]string{
+		`{"ignition": {"version": "3.1.0"}}`:                                                 `unsupported Ignition config version "3.1.0", expected 2.x or 3.0.0`,
+		`{"ignition": {"version": "3.0.0"}, "networkd": {}}`:                                 `parsing Ignition 3.0.0 config: json: unknown field "networkd"`,
+		`{"ignition": {"version": "3.0.0"}, "storage": {"disks": [{"device": "/dev/sdb"}]}}`: "storage.disks of Ignition 3.0.0 configs aren't supported",
+	} {
+		_, err := ParseV3([]byte(config))
+		if assert.NotNil(t, err, config) {
+			assert.Equal(t, expected, err.Error(), config)
+		}
+	}
+}
@@ -498,6 +498,12 @@ rules:
 - apiGroups: ["machineconfiguration.openshift.io"]
   resources: ["machineconfigs"]
   verbs: ["*"]
+- apiGroups: ["machineconfiguration.openshift.io"]
+  resources: ["machineconfigpools"]
+  verbs: ["get", "list"]
+- apiGroups: ["machineconfiguration.openshift.io"]
+  resources: ["controllerconfigs"]
+  verbs: ["get"]
 `)
 
 func manifestsMachineconfigdaemonClusterroleYamlBytes() ([]byte, error) {
@@ -564,10 +570,30 @@ spec:
         image: {{.Images.MachineConfigDaemon}}
         args:
           - "start"
+          # scraped by the cluster monitoring stack
+          - "--metrics-bind-address=:8797"
+        ports:
+          - name: metrics
+            containerPort: 8797
+            protocol: TCP
         resources:
           requests:
             cpu: 20m
             memory: 50Mi
+        livenessProbe:
+          httpGet:
+            path: /healthz
+            port: 8799
+          initialDelaySeconds: 30
+          periodSeconds: 30
+          timeoutSeconds: 5
+          failureThreshold: 3
+        readinessProbe:
+          httpGet:
+            path: /healthz
+            port: 8799
+          periodSeconds: 10
+          timeoutSeconds: 5
         securityContext:
           privileged: true
         volumeMounts:
@@ -973,10 +999,31 @@ spec:
         args:
           - "start"
           - "--apiserver-url={{.APIServerURL}}"
+          # scraped by the cluster monitoring stack
+          - "--metrics-bind-address=:22625"
+        ports:
+          - name: metrics
+            containerPort: 22625
+            protocol: TCP
         resources:
           requests:
             cpu: 20m
             memory: 50Mi
+        # not ready while a pool has no config to serve, restarting the
+        # server wouldn't help that
+        readinessProbe:
+          httpGet:
+            path: /healthz
+            port: 22624
+          periodSeconds: 10
+          timeoutSeconds: 5
+        livenessProbe:
+          tcpSocket:
+            port: 22624
+          initialDelaySeconds: 30
+          periodSeconds: 30
+          timeoutSeconds: 5
+          failureThreshold: 3
         volumeMounts:
         - name: certs
           mountPath: /etc/ssl/mcs
@@ -987,6 +1034,8 @@ spec:
         node-role.kubernetes.io/master: ""
       priorityClassName: "system-cluster-critical"
       serviceAccountName: machine-config-server
+      # above the --shutdown-grace-period of the responses in flight
+      terminationGracePeriodSeconds: 30
       tolerations:
         - key: node-role.kubernetes.io/master
           operator: Exists
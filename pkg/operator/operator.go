@@ -334,6 +334,11 @@ func (optr *Operator) sync(key string) error {
 	if err != nil {
 		return err
 	}
+	// the additional trust bundle is optional
+	additionalTrustBundle, err := optr.getCAsFromConfigMap("openshift-config", "user-ca-bundle", "ca-bundle.crt")
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
 	bundle := make([]byte, 0)
 	bundle = append(bundle, rootCA...)
 	bundle = append(bundle, kubeAPIServerServingCABytes...)
@@ -359,13 +364,19 @@ func (optr *Operator) sync(key string) error {
 	spec.EtcdCAData = etcdCA
 	spec.EtcdMetricCAData = etcdMetricCA
 	spec.RootCAData = bundle
+	spec.AdditionalTrustBundle = additionalTrustBundle
+	spec.Proxy, err = optr.getProxy()
+	if err != nil {
+		return err
+	}
 	spec.PullSecret = &v1.ObjectReference{Namespace: "openshift-config", Name: "pull-secret"}
 	spec.OSImageURL = imgs.MachineOSContent
 	spec.Images = map[string]string{
-		templatectrl.EtcdImageKey:            imgs.Etcd,
-		templatectrl.SetupEtcdEnvKey:         imgs.SetupEtcdEnv,
-		templatectrl.InfraImageKey:           imgs.InfraImage,
-		templatectrl.KubeClientAgentImageKey: imgs.KubeClientAgent,
+		templatectrl.EtcdImageKey:                imgs.Etcd,
+		templatectrl.SetupEtcdEnvKey:             imgs.SetupEtcdEnv,
+		templatectrl.InfraImageKey:               imgs.InfraImage,
+		templatectrl.KubeClientAgentImageKey:     imgs.KubeClientAgent,
+		templatectrl.MachineConfigDaemonImageKey: imgs.MachineConfigDaemon,
 	}
 
 	// create renderConfig
@@ -424,6 +435,19 @@ func (optr *Operator) getGlobalConfig() (*configv1.Infrastructure, *configv1.Net
 	return infra, network, nil
 }
 
+// getProxy gets the spec of the cluster-wide proxy, named `cluster` as the rest
+// of the global configuration. Clusters without one get nil.
+func (optr *Operator) getProxy() (*configv1.ProxySpec, error) {
+	proxy, err := optr.configClient.ConfigV1().Proxies().Get("cluster", metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &proxy.Spec, nil
+}
+
 func getRenderConfig(tnamespace, kubeAPIServerServingCA string, ccSpec *mcfgv1.ControllerConfigSpec, imgs Images, apiServerURL string) renderConfig {
 	return renderConfig{
 		TargetNamespace:  tnamespace,
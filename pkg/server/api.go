@@ -1,16 +1,91 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"mime"
 	"net/http"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
 	"github.com/golang/glog"
 )
 
+// ignitionMediaType is the media type of Ignition configs, its version
+// parameter is their spec version, e.g.
+// application/vnd.coreos.ignition+json; version=3.1.0.
+const ignitionMediaType = "application/vnd.coreos.ignition+json"
+
+// ignitionSpec is a spec version of the Ignition configs served.
+type ignitionSpec struct {
+	version string
+	// translate translates the rendered config to the spec
+	translate func(*servedConfig) (interface{}, error)
+}
+
+// ignitionSpecs are the spec versions served. The first one is served to
+// the clients which don't ask for a version.
+var ignitionSpecs = []ignitionSpec{
+	{version: "2.2.0", translate: translateToV2},
+	{version: "3.0.0", translate: v3Translation("3.0.0")},
+	{version: "3.1.0", translate: v3Translation("3.1.0")},
+}
+
+// servedConfig is the rendered config served, of spec 2.2 in V2, or of spec 3
+// in V3 for the v3Servers.
+type servedConfig struct {
+	V2 *ignv2_2types.Config `json:"v2,omitempty"`
+	V3 *ignv3Config         `json:"v3,omitempty"`
+}
+
+// translateToV2 returns conf in spec 2.2, translated down if it is of spec 3.
+// The configs using features spec 2.2 can't represent fail with HTTP Status
+// Code 406.
+func translateToV2(conf *servedConfig) (interface{}, error) {
+	if conf.V3 == nil {
+		return conf.V2, nil
+	}
+	v2, err := translateFromV3(conf.V3)
+	if err != nil {
+		return nil, notRepresentableError(err)
+	}
+	return v2, nil
+}
+
+// v3Translation returns the translation of the configs to spec version, 3.0.0
+// or 3.1.0.
+func v3Translation(version string) func(*servedConfig) (interface{}, error) {
+	return func(conf *servedConfig) (interface{}, error) {
+		if conf.V3 == nil {
+			return translateToV3(conf.V2, version)
+		}
+		v3 := *conf.V3
+		v3.Ignition.Version = version
+		return &v3, nil
+	}
+}
+
+// renderedConfigPath is the path the rendered configs are served at by name,
+// e.g. /config/rendered/rendered-worker-<hash>, pinning the config served to
+// new machines, unlike /config/<pool> which serves the current one of the
+// pool.
+const renderedConfigPath = "/config/rendered/"
+
+// renderedConfigPrefix is the prefix of the names of the configs rendered for
+// the pools, the only configs served by name.
+const renderedConfigPrefix = "rendered-"
+
 type poolRequest struct {
 	machineConfigPool string
+	// renderedConfig is the rendered config requested by name, if any, as
+	// opposed to the current one of machineConfigPool
+	renderedConfig string
 }
 
 // APIServer provides the HTTP(s) endpoint
@@ -21,6 +96,7 @@ type APIServer struct {
 	insecure bool
 	cert     string
 	key      string
+	server   *http.Server
 }
 
 // NewAPIServer initializes a new API server
@@ -29,7 +105,7 @@ type APIServer struct {
 func NewAPIServer(a *APIHandler, p int, is bool, c, k string) *APIServer {
 	mux := http.NewServeMux()
 	mux.Handle("/config/", a)
-	mux.Handle("/healthz", &healthHandler{})
+	mux.Handle("/healthz", &healthHandler{server: a.server})
 	mux.Handle("/", &defaultHandler{})
 
 	return &APIServer{
@@ -38,106 +114,495 @@ func NewAPIServer(a *APIHandler, p int, is bool, c, k string) *APIServer {
 		insecure: is,
 		cert:     c,
 		key:      k,
+		server: &http.Server{
+			Addr:    fmt.Sprintf(":%v", p),
+			Handler: mux,
+		},
 	}
 }
 
-// Serve launches the API Server.
+// Serve launches the API Server. It returns once the server is shut down.
 func (a *APIServer) Serve() {
-	mcs := &http.Server{
-		Addr:    fmt.Sprintf(":%v", a.port),
-		Handler: a.handler,
-	}
-
 	glog.Info("launching server")
 	if a.insecure {
 		// Serve a non TLS server.
-		if err := mcs.ListenAndServe(); err != http.ErrServerClosed {
+		if err := a.server.ListenAndServe(); err != http.ErrServerClosed {
 			glog.Exitf("Machine Config Server exited with error: %v", err)
 		}
 	} else {
-		if err := mcs.ListenAndServeTLS(a.cert, a.key); err != http.ErrServerClosed {
+		// Serve the certificate from the files, reloading it as they are
+		// rotated.
+		reloader, err := newCertificateReloader(a.cert, a.key)
+		if err != nil {
+			glog.Exitf("Machine Config Server could not load its certificate: %v", err)
+		}
+		stopCh := make(chan struct{})
+		a.server.RegisterOnShutdown(func() { close(stopCh) })
+		go reloader.run(certReloadInterval, stopCh)
+		a.server.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+		if err := a.server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
 			glog.Exitf("Machine Config Server exited with error: %v", err)
 		}
 	}
 }
 
+// Shutdown stops the API Server from accepting connections, closes the idle
+// ones and waits for the responses in flight to be written, until ctx is
+// done. Clients provisioning a machine get their whole config.
+func (a *APIServer) Shutdown(ctx context.Context) error {
+	return a.server.Shutdown(ctx)
+}
+
 // APIHandler is the HTTP Handler for the
 // Machine Config Server.
 type APIHandler struct {
 	server Server
+	// limiter limits the rate of the requests of each client, if set
+	limiter *clientRateLimiter
+	// cache has the serialized configs of servers which are configResolvers
+	cache *configCache
+	// appenders are run over the configs before they are cached and served
+	appenders []Appender
+	// requestAppenders are run over the configs for each request, after the
+	// cache lookup
+	requestAppenders []Appender
+	// authorizer authorizes the config requests, if set
+	authorizer *TokenAuthorizer
+}
+
+// APIHandlerOption configures an APIHandler created by
+// NewServerAPIHandlerWithOptions.
+type APIHandlerOption func(*APIHandler)
+
+// WithClientRateLimit limits the config requests of each client IP to qps per
+// second, with bursts of burst requests, the others get HTTP Status Code 429.
+// The limit is shared by the servers the handler is used by. A qps of 0
+// disables it.
+func WithClientRateLimit(qps float32, burst int) APIHandlerOption {
+	return func(sh *APIHandler) {
+		if qps > 0 {
+			sh.limiter = newClientRateLimiter(qps, burst, realClock{})
+		}
+	}
 }
 
 // NewServerAPIHandler initializes a new API handler
 // for the Machine Config Server.
 func NewServerAPIHandler(s Server) *APIHandler {
-	return &APIHandler{
-		server: s,
+	return NewServerAPIHandlerWithOptions(s)
+}
+
+// NewServerAPIHandlerWithOptions initializes a new API handler for the
+// Machine Config Server configured by opts.
+func NewServerAPIHandlerWithOptions(s Server, opts ...APIHandlerOption) *APIHandler {
+	sh := &APIHandler{
+		server:    s,
+		cache:     newConfigCache(configCacheSize),
+		appenders: defaultAppenders(),
 	}
+	for _, opt := range opts {
+		opt(sh)
+	}
+	return sh
 }
 
 // ServeHTTP handles the requests for the machine config server
-// API handler.
+// API handler. Each request is logged, with the client, what it asked for
+// and the response, the rate limited ones only at verbosity 2.
 func (sh *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	client := clientIP(r)
+	specVersion := ""
+	if sh.limiter != nil && !sh.limiter.allow(client) {
+		w.Header().Set("Content-Length", "0")
+		w.Header().Set("Retry-After", strconv.Itoa(sh.limiter.retryAfter()))
+		sw.WriteHeader(http.StatusTooManyRequests)
+	} else {
+		specVersion = sh.serveConfig(sw, r)
+	}
+	duration := time.Since(start)
+
+	pool, rendered := "", ""
+	if strings.HasPrefix(r.URL.Path, renderedConfigPath) {
+		rendered = strings.TrimPrefix(r.URL.Path, renderedConfigPath)
+	} else {
+		pool = path.Base(r.URL.Path)
+	}
+	observeConfigRequest(pool, sw.status, specVersion, duration)
+	if sw.status != http.StatusTooManyRequests || glog.V(2) {
+		glog.Infof("config request: client=%s method=%s pool=%q rendered=%q spec=%q user-agent=%q status=%d bytes=%d duration=%s",
+			client, r.Method, pool, rendered, specVersion, r.UserAgent(), sw.status, sw.bytes, duration)
+	}
+}
+
+// serveConfig serves the config of the pool requested by r, it returns the
+// spec version negotiated once it fetched the config, or "" if it didn't get
+// that far.
+func (sh *APIHandler) serveConfig(w http.ResponseWriter, r *http.Request) string {
 	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		w.Header().Set("Content-Length", "0")
 		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
+		return ""
 	}
 
 	if r.URL.Path == "" {
 		w.Header().Set("Content-Length", "0")
 		w.WriteHeader(http.StatusBadRequest)
-		return
+		return ""
+	}
+
+	spec, contentType := negotiateSpec(r.Header.Get("Accept"))
+	if spec == nil {
+		body := fmt.Sprintf("none of the requested Ignition spec versions is supported, supported versions: %s\n", strings.Join(supportedSpecVersions(), ", "))
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusNotAcceptable)
+		if r.Method == http.MethodGet {
+			w.Write([]byte(body))
+		}
+		return ""
 	}
 
 	cr := poolRequest{
 		machineConfigPool: path.Base(r.URL.Path),
 	}
-
-	conf, err := sh.server.GetConfig(cr)
-	if err != nil {
-		w.Header().Set("Content-Length", "0")
-		w.WriteHeader(http.StatusInternalServerError)
-		glog.Errorf("couldn't get config for req: %v, error: %v", cr, err)
-		return
+	if strings.HasPrefix(r.URL.Path, renderedConfigPath) {
+		cr = poolRequest{
+			renderedConfig: strings.TrimPrefix(r.URL.Path, renderedConfigPath),
+		}
+		if cr.renderedConfig == "" || strings.Contains(cr.renderedConfig, "/") {
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusNotFound)
+			return ""
+		}
+		if !strings.HasPrefix(cr.renderedConfig, renderedConfigPrefix) {
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusForbidden)
+			glog.Errorf("refusing to serve config %q by name, only %s* configs are served", cr.renderedConfig, renderedConfigPrefix)
+			return ""
+		}
 	}
-	if conf == nil && err == nil {
-		w.Header().Set("Content-Length", "0")
-		w.WriteHeader(http.StatusNotFound)
-		return
+
+	if sh.authorizer != nil {
+		pool := cr.machineConfigPool
+		if cr.renderedConfig != "" {
+			pool = renderedConfigPool(cr.renderedConfig)
+		}
+		if !sh.authorizer.authorize(pool, bearerToken(r)) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="machine-config-server"`)
+			writeConfigError(w, r, unauthorizedError(pool))
+			return ""
+		}
 	}
 
-	data, err := json.Marshal(conf)
+	encoding := ""
+	if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		encoding = gzipEncoding
+	}
+	req := RequestInfo{ClientIP: clientIP(r), Header: r.Header}
+	data, etag, err := sh.configPayload(cr, spec, encoding, req)
+	if _, ok := sh.server.(v3Server); ok && err == nil && spec.version == ignitionSpecs[0].version {
+		observeDowngradedServe(cr, req.ClientIP)
+	}
 	if err != nil {
+		// the errors aren't compressed
+		if cerr, ok := err.(*configError); ok {
+			writeConfigError(w, r, cerr)
+			return spec.version
+		}
 		w.Header().Set("Content-Length", "0")
 		w.WriteHeader(http.StatusInternalServerError)
-		glog.Errorf("failed to marshal %v config: %v", cr, err)
-		return
+		glog.Errorf("couldn't get config for req: %v, error: %v", cr, err)
+		return spec.version
 	}
 
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Accept, Accept-Encoding")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return spec.version
+	}
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", contentType)
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
 	if r.Method == http.MethodHead {
 		w.WriteHeader(http.StatusOK)
-		return
+		return spec.version
 	}
 
 	_, err = w.Write(data)
 	if err != nil {
 		glog.Errorf("failed to write %v response: %v", cr, err)
 	}
+	return spec.version
+}
+
+// configPayload returns the config served for cr in spec to the request req,
+// serialized with the content coding encoding, "" for none, and its ETag.
+// The configs of servers which are configResolvers are taken from the cache,
+// or fetched and cached. The configs which can't be served because of the
+// request fail with a *configError.
+func (sh *APIHandler) configPayload(cr poolRequest, spec *ignitionSpec, encoding string, req RequestInfo) ([]byte, string, error) {
+	version := ""
+	if resolver, ok := sh.server.(configResolver); ok {
+		resolved, v, err := resolver.resolveConfig(cr)
+		if err != nil {
+			return nil, "", err
+		}
+		if resolved.renderedConfig != "" {
+			// the config fetched is the one resolved, even if the pool
+			// moves to another meanwhile
+			cr, version = resolved, v
+			sh.cache.observe(cr.machineConfigPool, version)
+			if len(sh.requestAppenders) == 0 {
+				if entry, ok := sh.cache.get(cacheKey(version, spec.version, encoding)); ok {
+					return entry.data, entry.etag, nil
+				}
+				if encoding != "" {
+					if entry, ok := sh.cache.get(cacheKey(version, spec.version, "")); ok {
+						return sh.encodePayload(version, spec, entry.data, entry.etag, encoding)
+					}
+				}
+			}
+		}
+	}
+
+	req.Pool, req.RenderedConfig = cr.machineConfigPool, cr.renderedConfig
+	conf, err := sh.appendedConfig(cr, version, req)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(sh.requestAppenders) > 0 {
+		if err := appendConfig(conf, sh.requestAppenders, req); err != nil {
+			return nil, "", err
+		}
+		// the configs served differ by request
+		version = ""
+	}
+
+	served, err := spec.translate(conf)
+	if cerr, ok := err.(*configError); ok {
+		return nil, "", cerr
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("couldn't translate config to spec %s: %v", spec.version, err)
+	}
+
+	data, err := json.Marshal(served)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal config: %v", err)
+	}
+	etag := payloadETag(data)
+	if version != "" {
+		sh.cache.add(cacheKey(version, spec.version, ""), version, data, etag)
+	}
+	return sh.encodePayload(version, spec, data, etag, encoding)
+}
+
+// appendedConfig returns the config of cr, of version, with the content of
+// the Appenders run before the cache. With request Appenders the configs
+// served aren't cached, this one is instead, under no spec version.
+func (sh *APIHandler) appendedConfig(cr poolRequest, version string, req RequestInfo) (*servedConfig, error) {
+	cached := version != "" && len(sh.requestAppenders) > 0
+	if cached {
+		if entry, ok := sh.cache.get(cacheKey(version, "", "")); ok {
+			conf := new(servedConfig)
+			if err := json.Unmarshal(entry.data, conf); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal cached config: %v", err)
+			}
+			return conf, nil
+		}
+	}
+
+	conf, err := sh.getConfig(cr)
+	if err != nil {
+		return nil, err
+	}
+	if err := appendConfig(conf, sh.appenders, req); err != nil {
+		return nil, err
+	}
+	if cached {
+		data, err := json.Marshal(conf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal config: %v", err)
+		}
+		sh.cache.add(cacheKey(version, "", ""), version, data, "")
+	}
+	return conf, nil
+}
+
+// getConfig returns the rendered config of cr, of spec 3 for the v3Servers.
+func (sh *APIHandler) getConfig(cr poolRequest) (*servedConfig, error) {
+	conf := new(servedConfig)
+	var err error
+	if v3, ok := sh.server.(v3Server); ok {
+		conf.V3, err = v3.getConfigV3(cr)
+		if err == nil && conf.V3 == nil {
+			err = notFoundError(cr)
+		}
+	} else {
+		conf.V2, err = sh.server.GetConfig(cr)
+		if err == nil && conf.V2 == nil {
+			err = notFoundError(cr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// appendConfig runs appenders over conf for req. The content they write in
+// spec 2.2 is translated into the configs of spec 3.
+func appendConfig(conf *servedConfig, appenders []Appender, req RequestInfo) error {
+	target := conf.V2
+	if conf.V3 != nil {
+		target = new(ignv2_2types.Config)
+	}
+	for _, a := range appenders {
+		if err := a.Append(target, req); err != nil {
+			return fmt.Errorf("couldn't append to config: %v", err)
+		}
+	}
+	if conf.V3 != nil {
+		appended, err := translateToV3(target, conf.V3.Ignition.Version)
+		if err != nil {
+			return fmt.Errorf("couldn't append to config: %v", err)
+		}
+		mergeV3(conf.V3, appended)
+	}
+	return nil
+}
+
+// encodePayload compresses the config data of ETag etag with the content
+// coding encoding, caching it if the config has a version. Only gzip is
+// supported.
+func (sh *APIHandler) encodePayload(version string, spec *ignitionSpec, data []byte, etag, encoding string) ([]byte, string, error) {
+	if encoding == "" {
+		return data, etag, nil
+	}
+	encoded, err := gzipPayload(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to compress config: %v", err)
+	}
+	etag = encodedETag(etag, encoding)
+	if version != "" {
+		sh.cache.add(cacheKey(version, spec.version, encoding), version, encoded, etag)
+	}
+	return encoded, etag, nil
+}
+
+// negotiateSpec returns the spec version to serve to a client sending the
+// Accept header accept, and the content type to serve it with, or nil if it
+// accepts none of those served. The media ranges are tried by decreasing
+// quality. Clients accepting any JSON, or not sending the header, get the
+// default spec as application/json, those asking for Ignition configs get
+// the version they ask for, or the default one if they don't say.
+func negotiateSpec(accept string) (*ignitionSpec, string) {
+	if strings.TrimSpace(accept) == "" {
+		return &ignitionSpecs[0], "application/json"
+	}
+	type mediaRange struct {
+		mediaType string
+		version   string
+		quality   float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality > 0 {
+			ranges = append(ranges, mediaRange{mediaType, params["version"], quality})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].quality > ranges[j].quality })
+	for _, mr := range ranges {
+		switch mr.mediaType {
+		case ignitionMediaType:
+			spec := &ignitionSpecs[0]
+			if mr.version != "" {
+				if spec = findSpec(mr.version); spec == nil {
+					continue
+				}
+			}
+			return spec, ignitionMediaType + "; version=" + spec.version
+		case "application/json", "application/*", "*/*":
+			return &ignitionSpecs[0], "application/json"
+		}
+	}
+	return nil, ""
+}
+
+// findSpec returns the spec served of version, which can leave out the patch
+// version, e.g. 3.1, or nil if it isn't served.
+func findSpec(version string) *ignitionSpec {
+	if strings.Count(version, ".") == 1 {
+		version += ".0"
+	}
+	for i := range ignitionSpecs {
+		if ignitionSpecs[i].version == version {
+			return &ignitionSpecs[i]
+		}
+	}
+	return nil
+}
+
+func supportedSpecVersions() []string {
+	var versions []string
+	for _, spec := range ignitionSpecs {
+		versions = append(versions, spec.version)
+	}
+	return versions
 }
 
-type healthHandler struct{}
+// healthChecker is implemented by the servers which can tell whether they
+// can serve configs.
+type healthChecker interface {
+	// checkHealth returns why the server can't serve the config of a pool,
+	// if it can't
+	checkHealth() error
+}
 
-// ServeHTTP handles /healthz requests.
+type healthHandler struct {
+	// server is checked if it is a healthChecker
+	server Server
+}
+
+// ServeHTTP handles /healthz requests. They fail with HTTP Status Code 503
+// and the reason when the server can't serve the config of a pool.
 func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Length", "0")
 	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		if checker, ok := h.server.(healthChecker); ok {
+			if err := checker.checkHealth(); err != nil {
+				glog.Warningf("health check failed: %v", err)
+				body := err.Error() + "\n"
+				w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				if r.Method == http.MethodGet {
+					w.Write([]byte(body))
+				}
+				return
+			}
+		}
+		w.Header().Set("Content-Length", "0")
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
+	w.Header().Set("Content-Length", "0")
+
 	w.WriteHeader(http.StatusMethodNotAllowed)
 	return
 }
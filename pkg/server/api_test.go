@@ -1,13 +1,21 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type mockServer struct {
@@ -79,6 +87,177 @@ func TestAPIHandler(t *testing.T) {
 				checkBodyLength(t, response, 0)
 			},
 		},
+		{
+			name:    "get rendered config by name",
+			request: httptest.NewRequest(http.MethodGet, "http://testrequest/config/rendered/rendered-worker-0123", nil),
+			serverFunc: func(pr poolRequest) (*ignv2_2types.Config, error) {
+				if pr != (poolRequest{renderedConfig: "rendered-worker-0123"}) {
+					t.Errorf("expected a request for rendered-worker-0123 alone, received %+v", pr)
+				}
+				return new(ignv2_2types.Config), nil
+			},
+			checkResponse: func(t *testing.T, response *http.Response) {
+				checkStatus(t, response, http.StatusOK)
+				checkContentType(t, response, "application/json")
+				// with the node annotations of rendered-worker-0123
+				checkContentLength(t, response, 503)
+				checkBodyLength(t, response, 503)
+			},
+		},
+		{
+			name:    "get rendered config that does not exist",
+			request: httptest.NewRequest(http.MethodGet, "http://testrequest/config/rendered/rendered-worker-0123", nil),
+			serverFunc: func(poolRequest) (*ignv2_2types.Config, error) {
+				return nil, nil
+			},
+			checkResponse: func(t *testing.T, response *http.Response) {
+				checkStatus(t, response, http.StatusNotFound)
+				checkContentType(t, response, "application/json")
+				checkBody(t, response, `{"error":"rendered config \"rendered-worker-0123\" not found"}`)
+			},
+		},
+		{
+			name:    "get config of pool that does not exist",
+			request: httptest.NewRequest(http.MethodGet, "http://testrequest/config/wroker", nil),
+			serverFunc: func(pr poolRequest) (*ignv2_2types.Config, error) {
+				return nil, poolNotFoundError(pr.machineConfigPool)
+			},
+			checkResponse: func(t *testing.T, response *http.Response) {
+				checkStatus(t, response, http.StatusNotFound)
+				checkContentType(t, response, "application/json")
+				checkContentLength(t, response, 37)
+				checkBody(t, response, `{"error":"pool \"wroker\" not found"}`)
+			},
+		},
+		{
+			name:    "head config of pool that does not exist",
+			request: httptest.NewRequest(http.MethodHead, "http://testrequest/config/wroker", nil),
+			serverFunc: func(pr poolRequest) (*ignv2_2types.Config, error) {
+				return nil, poolNotFoundError(pr.machineConfigPool)
+			},
+			checkResponse: func(t *testing.T, response *http.Response) {
+				checkStatus(t, response, http.StatusNotFound)
+				checkContentType(t, response, "application/json")
+				checkContentLength(t, response, 37)
+				checkBodyLength(t, response, 0)
+			},
+		},
+		{
+			name:    "get config of pool that is not rendered yet",
+			request: httptest.NewRequest(http.MethodGet, "http://testrequest/config/worker", nil),
+			serverFunc: func(pr poolRequest) (*ignv2_2types.Config, error) {
+				return nil, configNotReadyError(pr.machineConfigPool, "")
+			},
+			checkResponse: func(t *testing.T, response *http.Response) {
+				checkStatus(t, response, http.StatusServiceUnavailable)
+				checkContentType(t, response, "application/json")
+				checkRetryAfter(t, response, "10")
+				checkBody(t, response, `{"error":"pool \"worker\" has no rendered config yet"}`)
+			},
+		},
+		{
+			name:    "head config of pool whose rendered config does not exist yet",
+			request: httptest.NewRequest(http.MethodHead, "http://testrequest/config/worker", nil),
+			serverFunc: func(pr poolRequest) (*ignv2_2types.Config, error) {
+				return nil, configNotReadyError(pr.machineConfigPool, "rendered-worker-0123")
+			},
+			checkResponse: func(t *testing.T, response *http.Response) {
+				checkStatus(t, response, http.StatusServiceUnavailable)
+				checkContentType(t, response, "application/json")
+				checkRetryAfter(t, response, "10")
+				checkContentLength(t, response, 85)
+				checkBodyLength(t, response, 0)
+			},
+		},
+		{
+			name:    "get config the server fails to fetch",
+			request: httptest.NewRequest(http.MethodGet, "http://testrequest/config/worker", nil),
+			serverFunc: func(poolRequest) (*ignv2_2types.Config, error) {
+				return nil, fmt.Errorf("connection refused")
+			},
+			checkResponse: func(t *testing.T, response *http.Response) {
+				checkStatus(t, response, http.StatusInternalServerError)
+				checkContentLength(t, response, 0)
+				checkBodyLength(t, response, 0)
+			},
+		},
+		{
+			name:    "get config by name that is not rendered",
+			request: httptest.NewRequest(http.MethodGet, "http://testrequest/config/rendered/00-worker", nil),
+			serverFunc: func(poolRequest) (*ignv2_2types.Config, error) {
+				t.Fatal("only rendered configs are fetched by name")
+				return nil, nil
+			},
+			checkResponse: func(t *testing.T, response *http.Response) {
+				checkStatus(t, response, http.StatusForbidden)
+				checkContentLength(t, response, 0)
+				checkBodyLength(t, response, 0)
+			},
+		},
+		{
+			name:    "get config below a rendered config",
+			request: httptest.NewRequest(http.MethodGet, "http://testrequest/config/rendered/rendered-worker-0123/worker", nil),
+			serverFunc: func(poolRequest) (*ignv2_2types.Config, error) {
+				t.Fatal("the config isn't fetched for invalid names")
+				return nil, nil
+			},
+			checkResponse: func(t *testing.T, response *http.Response) {
+				checkStatus(t, response, http.StatusNotFound)
+				checkContentLength(t, response, 0)
+				checkBodyLength(t, response, 0)
+			},
+		},
+		{
+			name:    "get config of pool named rendered",
+			request: httptest.NewRequest(http.MethodGet, "http://testrequest/config/rendered", nil),
+			serverFunc: func(pr poolRequest) (*ignv2_2types.Config, error) {
+				if pr != (poolRequest{machineConfigPool: "rendered"}) {
+					t.Errorf("expected a request for pool rendered, received %+v", pr)
+				}
+				return new(ignv2_2types.Config), nil
+			},
+			checkResponse: func(t *testing.T, response *http.Response) {
+				checkStatus(t, response, http.StatusOK)
+			},
+		},
+		{
+			name:    "get config in spec 3.1",
+			request: withAccept(httptest.NewRequest(http.MethodGet, "http://testrequest/config/master", nil), "application/vnd.coreos.ignition+json;version=3.1.0, */*;q=0.1"),
+			serverFunc: func(poolRequest) (*ignv2_2types.Config, error) {
+				return new(ignv2_2types.Config), nil
+			},
+			checkResponse: func(t *testing.T, response *http.Response) {
+				checkStatus(t, response, http.StatusOK)
+				checkContentType(t, response, "application/vnd.coreos.ignition+json; version=3.1.0")
+				checkContentLength(t, response, 118)
+				checkBodyLength(t, response, 118)
+			},
+		},
+		{
+			name:    "get config in unsupported spec",
+			request: withAccept(httptest.NewRequest(http.MethodGet, "http://testrequest/config/master", nil), "application/vnd.coreos.ignition+json; version=4.0.0"),
+			serverFunc: func(poolRequest) (*ignv2_2types.Config, error) {
+				t.Fatal("the config isn't fetched for unsupported versions")
+				return nil, nil
+			},
+			checkResponse: func(t *testing.T, response *http.Response) {
+				checkStatus(t, response, http.StatusNotAcceptable)
+				checkContentType(t, response, "text/plain; charset=utf-8")
+				checkBody(t, response, "none of the requested Ignition spec versions is supported, supported versions: 2.2.0, 3.0.0, 3.1.0\n")
+			},
+		},
+		{
+			name:    "get config which can't be translated",
+			request: withAccept(httptest.NewRequest(http.MethodGet, "http://testrequest/config/master", nil), "application/vnd.coreos.ignition+json; version=3.0.0"),
+			serverFunc: func(poolRequest) (*ignv2_2types.Config, error) {
+				return &ignv2_2types.Config{Storage: ignv2_2types.Storage{Disks: []ignv2_2types.Disk{{Device: "/dev/sdb"}}}}, nil
+			},
+			checkResponse: func(t *testing.T, response *http.Response) {
+				checkStatus(t, response, http.StatusInternalServerError)
+				checkContentLength(t, response, 0)
+				checkBodyLength(t, response, 0)
+			},
+		},
 	}
 
 	for _, scenario := range scenarios {
@@ -149,6 +328,107 @@ func TestHealthzHandler(t *testing.T) {
 	}
 }
 
+type mockHealthServer struct {
+	mockServer
+	err error
+}
+
+func (ms *mockHealthServer) checkHealth() error {
+	return ms.err
+}
+
+func TestHealthzHandlerChecksServer(t *testing.T) {
+	ms := &mockHealthServer{err: fmt.Errorf("pool worker has no rendered config")}
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		w := httptest.NewRecorder()
+		handler := &healthHandler{server: ms}
+		handler.ServeHTTP(w, httptest.NewRequest(method, "http://testrequest/healthz", nil))
+		resp := w.Result()
+		checkStatus(t, resp, http.StatusServiceUnavailable)
+		if method == http.MethodGet {
+			checkBody(t, resp, "pool worker has no rendered config\n")
+		} else {
+			checkBodyLength(t, resp, 0)
+		}
+	}
+
+	ms.err = nil
+	w := httptest.NewRecorder()
+	server := NewAPIServer(NewServerAPIHandler(ms), 0, false, "", "")
+	server.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://testrequest/healthz", nil))
+	checkStatus(t, w.Result(), http.StatusNoContent)
+}
+
+// TestAPIServerShutdown tests a slow client still gets its whole config when
+// the server shuts down while serving it, and that no connections are
+// accepted meanwhile.
+func TestAPIServerShutdown(t *testing.T) {
+	conf := new(ignv2_2types.Config)
+	for i := 0; i < 200; i++ {
+		appendFileToIgnition(conf, fmt.Sprintf("/etc/test-%d", i), strings.Repeat("x", 10000))
+	}
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	ms := &mockServer{
+		GetConfigFn: func(poolRequest) (*ignv2_2types.Config, error) {
+			close(fetching)
+			<-release
+			return conf, nil
+		},
+	}
+	server := NewAPIServer(NewServerAPIHandler(ms), 0, true, "", "")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	served := make(chan error, 1)
+	go func() { served <- server.server.Serve(l) }()
+	url := fmt.Sprintf("http://%s/config/worker", l.Addr())
+
+	type response struct {
+		body []byte
+		err  error
+	}
+	received := make(chan response, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			received <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		// read slowly
+		var body []byte
+		buf := make([]byte, 128*1024)
+		for {
+			n, err := resp.Body.Read(buf)
+			body = append(body, buf[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				received <- response{err: err}
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		received <- response{body: body}
+	}()
+
+	<-fetching
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+	require.Equal(t, http.ErrServerClosed, <-served)
+	_, err = http.Get(url)
+	assert.NotNil(t, err, "no connections are accepted once shutting down")
+	close(release)
+
+	r := <-received
+	require.Nil(t, r.err)
+	served2 := new(ignv2_2types.Config)
+	require.Nil(t, json.Unmarshal(r.body, served2), "the config is complete")
+	assert.Len(t, served2.Storage.Files, 200)
+	assert.Nil(t, <-shutdown)
+}
+
 func TestDefaultHandler(t *testing.T) {
 	scenarios := []scenario{
 		{
@@ -361,6 +641,28 @@ func checkContentLength(t *testing.T, response *http.Response, l int) {
 	}
 }
 
+func checkBody(t *testing.T, response *http.Response, expected string) {
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != expected {
+		t.Errorf("expected response body %q, received %q", expected, string(body))
+	}
+}
+
+func checkRetryAfter(t *testing.T, response *http.Response, expected string) {
+	actual := response.Header.Get("Retry-After")
+	if actual != expected {
+		t.Errorf("expected response Retry-After %q, received %q", expected, actual)
+	}
+}
+
+func withAccept(request *http.Request, accept string) *http.Request {
+	request.Header.Set("Accept", accept)
+	return request
+}
+
 func checkBodyLength(t *testing.T, response *http.Response, l int) {
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
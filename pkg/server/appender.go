@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net/http"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+)
+
+// RequestInfo is what Appenders know of the request a config is served for.
+type RequestInfo struct {
+	// Pool is the pool requested, empty for the rendered configs requested
+	// by name.
+	Pool string
+	// RenderedConfig is the name of the rendered config served, the current
+	// one of Pool for the pools requested. It is empty if the Server doesn't
+	// resolve its configs.
+	RenderedConfig string
+	// ClientIP is the IP of the client, as for the rate limits.
+	ClientIP string
+	// Header is the header of the request.
+	Header http.Header
+}
+
+// Appender adds content to the configs served, on top of the rendered
+// config, before they are serialized. An error fails the request, rather than
+// serving the config without the content.
+type Appender interface {
+	Append(cfg *ignv2_2types.Config, req RequestInfo) error
+}
+
+// defaultAppenders are the Appenders run over every config served.
+func defaultAppenders() []Appender {
+	return []Appender{
+		nodeAnnotationsAppender{},
+	}
+}
+
+// nodeAnnotationsAppender writes the node annotations the
+// machine-config-daemon starts from, with the rendered config served as the
+// current and desired config of the node.
+type nodeAnnotationsAppender struct{}
+
+func (nodeAnnotationsAppender) Append(cfg *ignv2_2types.Config, req RequestInfo) error {
+	if req.RenderedConfig == "" {
+		return nil
+	}
+	return appendNodeAnnotations(cfg, req.RenderedConfig)
+}
+
+// WithAppenders adds appenders to the Appenders run over every config served,
+// after the default ones. Their content is cached with the config, by its
+// rendered config: use WithRequestAppenders for content which depends on
+// more of the request.
+func WithAppenders(appenders ...Appender) APIHandlerOption {
+	return func(sh *APIHandler) {
+		sh.appenders = append(sh.appenders, appenders...)
+	}
+}
+
+// WithRequestAppenders adds appenders to the Appenders run over the config
+// for each request, e.g. for the content of a single node, after the ones
+// added with WithAppenders. Only the config they are run over is cached.
+func WithRequestAppenders(appenders ...Appender) APIHandlerOption {
+	return func(sh *APIHandler) {
+		sh.requestAppenders = append(sh.requestAppenders, appenders...)
+	}
+}
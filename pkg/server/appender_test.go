@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// appenderFn is an Appender recording the requests it appends for.
+type appenderFn struct {
+	requests []RequestInfo
+	err      error
+}
+
+func (a *appenderFn) Append(cfg *ignv2_2types.Config, req RequestInfo) error {
+	a.requests = append(a.requests, req)
+	if a.err != nil {
+		return a.err
+	}
+	appendFileToIgnition(cfg, "/etc/appended", req.Pool)
+	return nil
+}
+
+func TestAPIHandlerAppenders(t *testing.T) {
+	ms := &mockResolverServer{pools: map[string]string{"worker": "rendered-worker-0"}}
+	appender := &appenderFn{}
+	handler := NewServerAPIHandlerWithOptions(ms, WithAppenders(appender))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://testrequest/config/worker", nil))
+	resp := w.Result()
+	checkStatus(t, resp, http.StatusOK)
+	require.Len(t, appender.requests, 1)
+	assert.Equal(t, "worker", appender.requests[0].Pool)
+	assert.Equal(t, "rendered-worker-0", appender.requests[0].RenderedConfig)
+	assert.Equal(t, "192.0.2.1", appender.requests[0].ClientIP)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	var served ignv2_2types.Config
+	require.Nil(t, json.Unmarshal(body, &served))
+	files := make(map[string]string)
+	for _, f := range served.Storage.Files {
+		if f.Contents.Source == "" {
+			continue
+		}
+		contents, err := getDecodedContent(f.Contents.Source)
+		require.Nil(t, err)
+		files[f.Path] = contents
+	}
+	anno, err := getNodeAnnotation("rendered-worker-0")
+	require.Nil(t, err)
+	assert.Equal(t, anno, files[daemonconsts.InitialNodeAnnotationsFilePath], "the node annotations have the rendered config of the pool")
+	assert.Equal(t, "worker", files["/etc/appended"], "the appenders added run after the default ones")
+
+	// a failing appender fails the request
+	failing := &appenderFn{err: fmt.Errorf("no hostname for node")}
+	handler = NewServerAPIHandlerWithOptions(ms, WithAppenders(failing))
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://testrequest/config/worker", nil))
+		resp = w.Result()
+		checkStatus(t, resp, http.StatusInternalServerError)
+		checkContentLength(t, resp, 0)
+		checkBodyLength(t, resp, 0)
+	}
+	assert.Len(t, failing.requests, 2, "the configs failing to be appended to aren't cached")
+}
+
+// clientAppender is an Appender writing the IP of the client.
+type clientAppender struct{}
+
+func (clientAppender) Append(cfg *ignv2_2types.Config, req RequestInfo) error {
+	appendFileToIgnition(cfg, "/etc/client", req.ClientIP+" "+req.Header.Get("User-Agent"))
+	return nil
+}
+
+func TestAPIHandlerRequestAppenders(t *testing.T) {
+	ms := &mockResolverServer{pools: map[string]string{"worker": "rendered-worker-0"}}
+	appender := &appenderFn{}
+	handler := NewServerAPIHandlerWithOptions(ms, WithAppenders(appender), WithRequestAppenders(clientAppender{}))
+
+	for _, client := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.1"} {
+		request := httptest.NewRequest(http.MethodGet, "http://testrequest/config/worker", nil)
+		request.RemoteAddr = client + ":1234"
+		request.Header.Set("User-Agent", "Ignition/0.28.0")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request)
+		resp := w.Result()
+		checkStatus(t, resp, http.StatusOK)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		var served ignv2_2types.Config
+		require.Nil(t, json.Unmarshal(body, &served))
+		files := make(map[string]string)
+		for _, f := range served.Storage.Files {
+			if f.Contents.Source == "" {
+				continue
+			}
+			contents, err := getDecodedContent(f.Contents.Source)
+			require.Nil(t, err)
+			files[f.Path] = contents
+		}
+		assert.Equal(t, client+" Ignition/0.28.0", files["/etc/client"], "the config served has the content of its request")
+		assert.Equal(t, "worker", files["/etc/appended"])
+	}
+	assert.Equal(t, 1, ms.fetched, "the config the request appenders run over is cached")
+	assert.Len(t, appender.requests, 1)
+}
+
+func TestNodeAnnotationsAppender(t *testing.T) {
+	var conf ignv2_2types.Config
+	require.Nil(t, nodeAnnotationsAppender{}.Append(&conf, RequestInfo{}))
+	assert.Empty(t, conf.Storage.Files, "nothing is annotated without a rendered config")
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	// DefaultAuthTokenGracePeriod is how long the tokens removed from the
+	// tokens directory are still accepted by default, for the user data of
+	// the machines provisioned with them to be updated
+	DefaultAuthTokenGracePeriod = time.Hour
+
+	// authTokensReloadInterval is how often the tokens directory is checked
+	// for changes
+	authTokensReloadInterval = 30 * time.Second
+)
+
+// TokenAuthorizer authorizes the config requests of each pool with the bearer
+// tokens of the pool. The tokens of a pool are read from the file named after
+// it in a directory, as mounted from a secret, one per line. Rotating a token
+// replaces it in the file: the tokens removed are still accepted for a grace
+// period.
+type TokenAuthorizer struct {
+	dir         string
+	gracePeriod time.Duration
+	clock       flowcontrol.Clock
+
+	mu sync.RWMutex
+	// tokens are the hashes of the tokens of each pool, with the time they
+	// expire at, zero for the tokens in the files
+	tokens map[string]map[[sha256.Size]byte]time.Time
+	// fingerprint is of the files the tokens were read from
+	fingerprint string
+}
+
+// NewTokenAuthorizer reads the tokens of the pools from dir, and reads them
+// again as the files change until stopCh is closed. The tokens removed are
+// accepted for gracePeriod.
+func NewTokenAuthorizer(dir string, gracePeriod time.Duration, stopCh <-chan struct{}) (*TokenAuthorizer, error) {
+	a := newTokenAuthorizer(dir, gracePeriod, realClock{})
+	if _, err := a.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	go a.run(authTokensReloadInterval, stopCh)
+	return a, nil
+}
+
+func newTokenAuthorizer(dir string, gracePeriod time.Duration, clock flowcontrol.Clock) *TokenAuthorizer {
+	return &TokenAuthorizer{
+		dir:         dir,
+		gracePeriod: gracePeriod,
+		clock:       clock,
+		tokens:      make(map[string]map[[sha256.Size]byte]time.Time),
+	}
+}
+
+// WithTokenAuth requires the config requests to have a bearer token
+// authorized by a, the others get HTTP Status Code 401.
+func WithTokenAuth(a *TokenAuthorizer) APIHandlerOption {
+	return func(sh *APIHandler) {
+		sh.authorizer = a
+	}
+}
+
+// authorize returns whether token is one of the tokens of pool. The hashes
+// of the tokens are compared in constant time.
+func (a *TokenAuthorizer) authorize(pool, token string) bool {
+	if token == "" {
+		return false
+	}
+	hash := sha256.Sum256([]byte(token))
+	now := a.clock.Now()
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	authorized := false
+	for valid, expiry := range a.tokens[pool] {
+		if subtle.ConstantTimeCompare(hash[:], valid[:]) == 1 && (expiry.IsZero() || now.Before(expiry)) {
+			authorized = true
+		}
+	}
+	return authorized
+}
+
+// reloadIfChanged reads the tokens again if the files of the directory
+// changed since they were read, it returns whether they were. The tokens
+// which aren't in the files anymore expire after the grace period.
+func (a *TokenAuthorizer) reloadIfChanged() (bool, error) {
+	files, fingerprint, err := readTokenFiles(a.dir)
+	if err != nil {
+		return false, err
+	}
+	a.mu.RLock()
+	changed := fingerprint != a.fingerprint
+	a.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	now := a.clock.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	tokens := make(map[string]map[[sha256.Size]byte]time.Time, len(files))
+	for pool, poolTokens := range files {
+		tokens[pool] = make(map[[sha256.Size]byte]time.Time, len(poolTokens))
+		for _, token := range poolTokens {
+			tokens[pool][sha256.Sum256([]byte(token))] = time.Time{}
+		}
+	}
+	for pool, previous := range a.tokens {
+		for hash, expiry := range previous {
+			if _, ok := tokens[pool][hash]; ok {
+				continue
+			}
+			if expiry.IsZero() {
+				expiry = now.Add(a.gracePeriod)
+			}
+			if !now.Before(expiry) {
+				continue
+			}
+			if tokens[pool] == nil {
+				tokens[pool] = make(map[[sha256.Size]byte]time.Time)
+			}
+			tokens[pool][hash] = expiry
+		}
+	}
+	a.tokens = tokens
+	a.fingerprint = fingerprint
+	return true, nil
+}
+
+// run reads the tokens again as the files change, checking them every
+// interval until stopCh is closed. Intended to be run via a goroutine.
+func (a *TokenAuthorizer) run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			reloaded, err := a.reloadIfChanged()
+			if err != nil {
+				glog.Errorf("Keeping the previous auth tokens: %v", err)
+			} else if reloaded {
+				glog.Infof("Reloaded auth tokens from %s", a.dir)
+			}
+		}
+	}
+}
+
+// readTokenFiles reads the tokens of each pool from the file named after it
+// in dir, skipping the empty lines and those starting with #. The hidden
+// files, like the ..data link of the secret volumes, are skipped. It also
+// returns a fingerprint of the files, which changes as they do.
+func readTokenFiles(dir string) (map[string][]string, string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	tokens := make(map[string][]string)
+	var fingerprint []string
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		fileName := filepath.Join(dir, info.Name())
+		// the files of secret volumes are links
+		info, err := os.Stat(fileName)
+		if err != nil {
+			return nil, "", err
+		}
+		if info.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not read tokens of pool %s: %v", info.Name(), err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			tokens[info.Name()] = append(tokens[info.Name()], line)
+		}
+		fingerprint = append(fingerprint, fmt.Sprintf("%s %d %d", info.Name(), info.Size(), info.ModTime().UnixNano()))
+	}
+	sort.Strings(fingerprint)
+	return tokens, strings.Join(fingerprint, "\n"), nil
+}
+
+// bearerToken returns the bearer token of the Authorization header of r, if
+// any.
+func bearerToken(r *http.Request) string {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(parts[1])
+}
+
+// renderedConfigPool returns the pool of the rendered config renderedConfig,
+// named rendered-<pool>-<hash>.
+func renderedConfigPool(renderedConfig string) string {
+	name := strings.TrimPrefix(renderedConfig, renderedConfigPrefix)
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return ""
+	}
+	return name[:i]
+}
+
+// unauthorizedError is the error of the requests without a token of the pool.
+func unauthorizedError(pool string) *configError {
+	return &configError{status: http.StatusUnauthorized, message: fmt.Sprintf("a valid bearer token for pool %q is required", pool)}
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTokens writes the tokens file of pool to dir, modified at modTime.
+func writeTokens(t *testing.T, dir, pool, contents string, modTime time.Time) {
+	path := filepath.Join(dir, pool)
+	require.Nil(t, ioutil.WriteFile(path, []byte(contents), 0600))
+	require.Nil(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestTokenAuthorizer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcs-tokens")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	modTime := time.Now().Add(-time.Minute)
+	writeTokens(t, dir, "worker", "# installer token\nworker-a\n\n", modTime)
+	writeTokens(t, dir, "master", "master-a\n", modTime)
+	writeTokens(t, dir, ".hidden", "hidden-a\n", modTime)
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "..data"), 0755))
+
+	clock := &fakeClock{now: time.Now()}
+	a := newTokenAuthorizer(dir, time.Hour, clock)
+	reloaded, err := a.reloadIfChanged()
+	require.Nil(t, err)
+	assert.True(t, reloaded)
+
+	assert.True(t, a.authorize("worker", "worker-a"))
+	assert.False(t, a.authorize("master", "worker-a"), "the tokens are per pool")
+	assert.False(t, a.authorize("worker", ""))
+	assert.False(t, a.authorize("worker", "# installer token"), "comments aren't tokens")
+	assert.False(t, a.authorize(".hidden", "hidden-a"), "hidden files are skipped")
+	assert.False(t, a.authorize("infra", "worker-a"), "pools without tokens aren't authorized")
+
+	reloaded, err = a.reloadIfChanged()
+	require.Nil(t, err)
+	assert.False(t, reloaded, "the files didn't change")
+
+	// rotate the token of worker
+	writeTokens(t, dir, "worker", "worker-b\n", modTime.Add(time.Second))
+	reloaded, err = a.reloadIfChanged()
+	require.Nil(t, err)
+	assert.True(t, reloaded)
+	assert.True(t, a.authorize("worker", "worker-b"))
+	assert.True(t, a.authorize("worker", "worker-a"), "the previous token is accepted during the grace period")
+
+	clock.Sleep(time.Hour + time.Second)
+	assert.False(t, a.authorize("worker", "worker-a"), "the previous token expires after the grace period")
+	assert.True(t, a.authorize("worker", "worker-b"))
+
+	// the files of secret volumes are links
+	require.Nil(t, os.Remove(filepath.Join(dir, "master")))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "..data", "master"), []byte("master-b\n"), 0600))
+	require.Nil(t, os.Symlink(filepath.Join("..data", "master"), filepath.Join(dir, "master")))
+	_, err = a.reloadIfChanged()
+	require.Nil(t, err)
+	assert.True(t, a.authorize("master", "master-b"))
+	assert.True(t, a.authorize("master", "master-a"), "the tokens of a removed file are accepted during the grace period")
+}
+
+func TestAPIHandlerTokenAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcs-tokens")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writeTokens(t, dir, "worker", "worker-a\n", time.Now())
+	a := newTokenAuthorizer(dir, time.Hour, realClock{})
+	_, err = a.reloadIfChanged()
+	require.Nil(t, err)
+
+	ms := &mockServer{
+		GetConfigFn: func(poolRequest) (*ignv2_2types.Config, error) {
+			return new(ignv2_2types.Config), nil
+		},
+	}
+	server := NewAPIServer(NewServerAPIHandlerWithOptions(ms, WithTokenAuth(a)), 0, false, "", "")
+	get := func(method, url, authorization string) *http.Response {
+		request := httptest.NewRequest(method, url, nil)
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		server.handler.ServeHTTP(w, request)
+		return w.Result()
+	}
+
+	resp := get(http.MethodGet, "http://testrequest/config/worker", "")
+	checkStatus(t, resp, http.StatusUnauthorized)
+	assert.Equal(t, `Bearer realm="machine-config-server"`, resp.Header.Get("WWW-Authenticate"))
+	checkContentType(t, resp, "application/json")
+	checkBody(t, resp, `{"error":"a valid bearer token for pool \"worker\" is required"}`)
+	resp = get(http.MethodHead, "http://testrequest/config/worker", "Bearer worker-b")
+	checkStatus(t, resp, http.StatusUnauthorized)
+	checkBodyLength(t, resp, 0)
+	checkStatus(t, get(http.MethodGet, "http://testrequest/config/worker", "Basic worker-a"), http.StatusUnauthorized)
+
+	checkStatus(t, get(http.MethodGet, "http://testrequest/config/worker", "Bearer worker-a"), http.StatusOK)
+	checkStatus(t, get(http.MethodGet, "http://testrequest/config/rendered/rendered-worker-0123", "Bearer worker-a"), http.StatusOK)
+	checkStatus(t, get(http.MethodGet, "http://testrequest/config/master", "Bearer worker-a"), http.StatusUnauthorized)
+	checkStatus(t, get(http.MethodGet, "http://testrequest/config/rendered/rendered-master-0123", "Bearer worker-a"), http.StatusUnauthorized)
+
+	checkStatus(t, get(http.MethodGet, "http://testrequest/healthz", ""), http.StatusNoContent)
+}
+
+func TestRenderedConfigPool(t *testing.T) {
+	assert.Equal(t, "worker", renderedConfigPool("rendered-worker-0123"))
+	assert.Equal(t, "infra-worker", renderedConfigPool("rendered-infra-worker-0123"))
+	assert.Equal(t, "", renderedConfigPool("rendered-0123"))
+}
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 
 	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
 	yaml "github.com/ghodss/yaml"
@@ -41,68 +42,136 @@ func NewBootstrapServer(dir, kubeconfig string) (Server, error) {
 
 // GetConfig fetches the machine config(type - Ignition) from the bootstrap server,
 // based on the pool request.
-// It returns nil for conf, error if the config isn't found. It returns a formatted
-// error if any other error is encountered during its operations.
+// It returns nil for conf, error if the rendered config requested by name isn't
+// found, and a *configError if the pool requested doesn't exist or its rendered
+// config isn't there yet. It returns a formatted error if any other error is
+// encountered during its operations.
 //
 // The method does the following:
 //
 // 1. Read the machine config pool by using the following path template:
 // 		"<serverBaseDir>/machine-pools/<machineConfigPoolName>.yaml"
+//    This is skipped for the requests of a rendered config by name.
 //
-// 2. Read the currentConfig field from the Status and read the config file
-//    using the following path template:
+// 2. Read the currentConfig field from the Status, or take the rendered
+//    config requested, and read the config file using the following path
+//    template:
 // 		"<serverBaseDir>/machine-configs/<currentConfig>.yaml"
 //
 // 3. Load the machine config.
-// 4. Append the machine annotations file.
-// 5. Append the KubeConfig file.
+// 4. Append the KubeConfig file.
+//
+// The machine annotations file is appended by the APIHandler.
 func (bsc *bootstrapServer) GetConfig(cr poolRequest) (*ignv2_2types.Config, error) {
 
 	// 1. Read the Machine Config Pool object.
-	fileName := path.Join(bsc.serverBaseDir, "machine-pools", cr.machineConfigPool+".yaml")
+	currConf := cr.renderedConfig
+	if currConf == "" {
+		var err error
+		currConf, err = bsc.poolConfig(cr.machineConfigPool)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 2. Read the Machine Config object.
+	fileName := path.Join(bsc.serverBaseDir, "machine-configs", currConf+".yaml")
 	glog.Infof("reading file %q", fileName)
 	data, err := ioutil.ReadFile(fileName)
 	if os.IsNotExist(err) {
 		glog.Errorf("could not find file: %s", fileName)
-		return nil, nil
+		if cr.machineConfigPool == "" {
+			return nil, nil
+		}
+		return nil, configNotReadyError(cr.machineConfigPool, currConf)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("server: could not read file %s, err: %v", fileName, err)
 	}
 
-	mp := new(v1.MachineConfigPool)
-	err = yaml.Unmarshal(data, mp)
+	mc := new(v1.MachineConfig)
+	err = yaml.Unmarshal(data, mc)
 	if err != nil {
 		return nil, fmt.Errorf("server: could not unmarshal file %s, err: %v", fileName, err)
 	}
 
-	currConf := mp.Status.Configuration.Name
+	appenders := getAppenders(cr, bsc.kubeconfigFunc, mc)
+	for _, a := range appenders {
+		if err := a(&mc.Spec.Config); err != nil {
+			return nil, err
+		}
+	}
+	return &mc.Spec.Config, nil
+}
 
-	// 2. Read the Machine Config object.
-	fileName = path.Join(bsc.serverBaseDir, "machine-configs", currConf+".yaml")
+// poolConfig reads the rendered config of pool from
+// <serverBaseDir>/machine-pools/<pool>.yaml.
+func (bsc *bootstrapServer) poolConfig(pool string) (string, error) {
+	fileName := path.Join(bsc.serverBaseDir, "machine-pools", pool+".yaml")
 	glog.Infof("reading file %q", fileName)
-	data, err = ioutil.ReadFile(fileName)
+	data, err := ioutil.ReadFile(fileName)
 	if os.IsNotExist(err) {
 		glog.Errorf("could not find file: %s", fileName)
-		return nil, nil
+		return "", poolNotFoundError(pool)
 	}
 	if err != nil {
-		return nil, fmt.Errorf("server: could not read file %s, err: %v", fileName, err)
+		return "", fmt.Errorf("server: could not read file %s, err: %v", fileName, err)
 	}
 
-	mc := new(v1.MachineConfig)
-	err = yaml.Unmarshal(data, mc)
+	mp := new(v1.MachineConfigPool)
+	err = yaml.Unmarshal(data, mp)
 	if err != nil {
-		return nil, fmt.Errorf("server: could not unmarshal file %s, err: %v", fileName, err)
+		return "", fmt.Errorf("server: could not unmarshal file %s, err: %v", fileName, err)
+	}
+	if mp.Status.Configuration.Name == "" {
+		return "", configNotReadyError(pool, "")
 	}
+	return mp.Status.Configuration.Name, nil
+}
 
-	appenders := getAppenders(cr, currConf, bsc.kubeconfigFunc, mc.Spec.OSImageURL)
-	for _, a := range appenders {
-		if err := a(&mc.Spec.Config); err != nil {
-			return nil, err
+// resolveConfig sets the rendered config of the pool requested, it returns
+// the version of the config served from it.
+func (bsc *bootstrapServer) resolveConfig(cr poolRequest) (poolRequest, string, error) {
+	if cr.renderedConfig == "" {
+		currConf, err := bsc.poolConfig(cr.machineConfigPool)
+		if err != nil {
+			return cr, "", err
 		}
+		cr.renderedConfig = currConf
 	}
-	return &mc.Spec.Config, nil
+	kcData, _, err := bsc.kubeconfigFunc()
+	if err != nil {
+		return cr, "", err
+	}
+	return cr, configVersion(cr.renderedConfig, kcData), nil
+}
+
+// checkHealth checks the server can serve the config of every pool: that the
+// rendered config of each pool under <serverBaseDir>/machine-pools exists, and
+// the kubeconfig appended to the configs can be read.
+func (bsc *bootstrapServer) checkHealth() error {
+	if _, _, err := bsc.kubeconfigFunc(); err != nil {
+		return fmt.Errorf("could not get kubeconfig: %v", err)
+	}
+	poolFiles, err := filepath.Glob(path.Join(bsc.serverBaseDir, "machine-pools", "*.yaml"))
+	if err != nil {
+		return err
+	}
+	for _, fileName := range poolFiles {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return fmt.Errorf("server: could not read file %s, err: %v", fileName, err)
+		}
+		mp := new(v1.MachineConfigPool)
+		if err := yaml.Unmarshal(data, mp); err != nil {
+			return fmt.Errorf("server: could not unmarshal file %s, err: %v", fileName, err)
+		}
+		currConf := mp.Status.Configuration.Name
+		if _, err := os.Stat(path.Join(bsc.serverBaseDir, "machine-configs", currConf+".yaml")); err != nil {
+			return fmt.Errorf("could not find config %s of pool %s: %v", currConf, mp.GetName(), err)
+		}
+	}
+	return nil
 }
 
 func kubeconfigFromFile(path string) ([]byte, []byte, error) {
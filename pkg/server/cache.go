@@ -0,0 +1,141 @@
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// configCacheSize is the number of serialized configs cached, a config being
+// cached once per spec version and content coding served.
+const configCacheSize = 32
+
+// configResolver is implemented by the servers whose configs can be cached.
+// The rendered configs are named after a hash of their contents, so a config
+// is cached by the name of the rendered config it is served from, along with
+// the rest of what goes in it.
+type configResolver interface {
+	// resolveConfig returns cr with the rendered config to serve set, and
+	// the version of the config served for it, which changes with its
+	// contents. The rendered config is left empty if there is none.
+	resolveConfig(cr poolRequest) (poolRequest, string, error)
+}
+
+// configVersion returns the version of the config served from renderedConfig
+// with the kubeconfig kubeconfigData, which can be rotated.
+func configVersion(renderedConfig string, kubeconfigData []byte) string {
+	return fmt.Sprintf("%s/%x", renderedConfig, sha256.Sum256(kubeconfigData))
+}
+
+// payloadETag returns the ETag of the serialized config data.
+func payloadETag(data []byte) string {
+	return fmt.Sprintf("%q", fmt.Sprintf("%x", sha256.Sum256(data)))
+}
+
+// etagMatches returns whether the If-None-Match header ifNoneMatch lists
+// etag, or is *.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// configCache is a bounded cache of serialized configs, evicting the least
+// recently used ones. The configs of the previous rendered config of a pool
+// are dropped once the pool is seen on another one.
+type configCache struct {
+	maxEntries int
+
+	mu sync.Mutex
+	// lru has the cacheEntries, the most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+	// pools are the config versions last served for each pool
+	pools map[string]string
+}
+
+type cacheEntry struct {
+	key     string
+	version string
+	data    []byte
+	etag    string
+}
+
+func newConfigCache(maxEntries int) *configCache {
+	return &configCache{
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+		pools:      make(map[string]string),
+	}
+}
+
+// cacheKey is the key a config of version is cached at in spec version
+// specVersion, with the content coding encoding, "" for none.
+func cacheKey(version, specVersion, encoding string) string {
+	key := version + " " + specVersion
+	if encoding != "" {
+		key += " " + encoding
+	}
+	return key
+}
+
+// observe records that pool is served the config of version, dropping the
+// configs of the one it was served before, if it changed.
+func (c *configCache) observe(pool, version string) {
+	if pool == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous, ok := c.pools[pool]
+	c.pools[pool] = version
+	if !ok || previous == version {
+		return
+	}
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if entry := e.Value.(*cacheEntry); entry.version == previous {
+			c.lru.Remove(e)
+			delete(c.entries, entry.key)
+		}
+		e = next
+	}
+}
+
+// get returns the config cached at key.
+func (c *configCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		configCacheRequests.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	configCacheRequests.WithLabelValues("hit").Inc()
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry), true
+}
+
+// add caches the config of version data, with its etag, at key.
+func (c *configCache) add(key, version string, data []byte, etag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		e.Value = &cacheEntry{key: key, version: version, data: data, etag: etag}
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, version: version, data: data, etag: etag})
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockResolverServer serves the rendered configs set in pools, counting the
+// configs fetched.
+type mockResolverServer struct {
+	pools   map[string]string
+	fetched int
+}
+
+func (ms *mockResolverServer) GetConfig(pr poolRequest) (*ignv2_2types.Config, error) {
+	ms.fetched++
+	if pr.renderedConfig == "" {
+		return nil, fmt.Errorf("config of pool %s fetched without resolving it", pr.machineConfigPool)
+	}
+	conf := new(ignv2_2types.Config)
+	conf.Ignition.Version = ignv2_2types.MaxVersion.String()
+	conf.Storage.Files = []ignv2_2types.File{{Node: ignv2_2types.Node{Filesystem: "root", Path: "/etc/" + pr.renderedConfig}}}
+	return conf, nil
+}
+
+func (ms *mockResolverServer) resolveConfig(cr poolRequest) (poolRequest, string, error) {
+	if cr.renderedConfig == "" {
+		cr.renderedConfig = ms.pools[cr.machineConfigPool]
+	}
+	return cr, configVersion(cr.renderedConfig, []byte("kubeconfig")), nil
+}
+
+func TestConfigCache(t *testing.T) {
+	c := newConfigCache(2)
+	c.add("a 2.2.0", "a", []byte("a"), `"a"`)
+	c.add("b 2.2.0", "b", []byte("b"), `"b"`)
+	_, ok := c.get("a 2.2.0")
+	require.True(t, ok)
+	c.add("c 2.2.0", "c", []byte("c"), `"c"`)
+	_, ok = c.get("b 2.2.0")
+	assert.False(t, ok, "the least recently used config is evicted")
+	_, ok = c.get("a 2.2.0")
+	assert.True(t, ok)
+
+	c.observe("worker", "a")
+	c.observe("worker", "a")
+	_, ok = c.get("a 2.2.0")
+	assert.True(t, ok)
+	c.observe("worker", "c")
+	_, ok = c.get("a 2.2.0")
+	assert.False(t, ok, "the configs of the previous rendered config of a pool are dropped")
+	_, ok = c.get("c 2.2.0")
+	assert.True(t, ok)
+}
+
+func TestEtagMatches(t *testing.T) {
+	assert.True(t, etagMatches(`"a"`, `"a"`))
+	assert.True(t, etagMatches(`"b", W/"a"`, `"a"`))
+	assert.True(t, etagMatches("*", `"a"`))
+	assert.False(t, etagMatches(`"b"`, `"a"`))
+	assert.False(t, etagMatches("", `"a"`))
+}
+
+func TestAPIHandlerCache(t *testing.T) {
+	ms := &mockResolverServer{pools: map[string]string{"worker": "rendered-worker-0"}}
+	handler := NewServerAPIHandler(ms)
+	get := func(request *http.Request) *http.Response {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request)
+		return w.Result()
+	}
+
+	first := get(httptest.NewRequest(http.MethodGet, "http://testrequest/config/worker", nil))
+	checkStatus(t, first, http.StatusOK)
+	etag := first.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+	resp := get(httptest.NewRequest(http.MethodGet, "http://testrequest/config/worker", nil))
+	checkStatus(t, resp, http.StatusOK)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+	assert.Equal(t, 1, ms.fetched, "the config is served from the cache")
+
+	checkStatus(t, get(withAccept(httptest.NewRequest(http.MethodGet, "http://testrequest/config/worker", nil), "application/vnd.coreos.ignition+json; version=3.1.0")), http.StatusOK)
+	assert.Equal(t, 2, ms.fetched, "the config is cached once per spec version")
+
+	request := httptest.NewRequest(http.MethodGet, "http://testrequest/config/worker", nil)
+	request.Header.Set("If-None-Match", etag)
+	resp = get(request)
+	checkStatus(t, resp, http.StatusNotModified)
+	checkBodyLength(t, resp, 0)
+
+	ms.pools["worker"] = "rendered-worker-1"
+	resp = get(request)
+	checkStatus(t, resp, http.StatusOK)
+	assert.NotEqual(t, etag, resp.Header.Get("ETag"), "the pool is served its new config")
+	assert.Equal(t, 3, ms.fetched)
+	assert.Len(t, handler.cache.entries, 1, "the configs of the previous rendered config are dropped")
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// certReloadInterval is how often the certificate files of the secure
+// server are checked for changes.
+const certReloadInterval = 30 * time.Second
+
+// certificateReloader serves the certificate of a TLS server from files, and
+// reloads it when they change, as when the secret they are mounted from is
+// rotated, without restarting the server.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	// certModTime and keyModTime are the modification times of the files
+	// the certificate was loaded from
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// newCertificateReloader loads the certificate from certFile and keyFile.
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reloadIfChanged reloads the certificate if either of its files was
+// modified since it was loaded, it returns whether it was. The certificate
+// loaded before is kept if the files can't be loaded, e.g. while the key
+// doesn't match the certificate yet.
+func (r *certificateReloader) reloadIfChanged() (bool, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false, fmt.Errorf("could not read certificate: %v", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("could not read key: %v", err)
+	}
+
+	r.mu.RLock()
+	changed := r.cert == nil || !certInfo.ModTime().Equal(r.certModTime) || !keyInfo.ModTime().Equal(r.keyModTime)
+	r.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("could not load certificate %s and key %s: %v", r.certFile, r.keyFile, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+	return true, nil
+}
+
+// GetCertificate returns the certificate last loaded, for tls.Config.
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// run checks the files for changes every interval until stopCh is closed.
+// Intended to be run via a goroutine.
+func (r *certificateReloader) run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			reloaded, err := r.reloadIfChanged()
+			if err != nil {
+				glog.Errorf("Keeping the previous certificate: %v", err)
+			} else if reloaded {
+				glog.Infof("Reloaded certificate from %s", r.certFile)
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCertificate writes a self-signed certificate for commonName and its
+// key to certFile and keyFile, modified at modTime.
+func writeCertificate(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	require.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	require.Nil(t, os.Chtimes(certFile, modTime, modTime))
+	require.Nil(t, os.Chtimes(keyFile, modTime, modTime))
+}
+
+func servedCommonName(t *testing.T, r *certificateReloader) string {
+	cert, err := r.GetCertificate(nil)
+	require.Nil(t, err)
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	require.Nil(t, err)
+	return parsed.Subject.CommonName
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcs-certs")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	_, err = newCertificateReloader(certFile, keyFile)
+	assert.NotNil(t, err, "the certificate must exist at start")
+
+	modTime := time.Now().Add(-time.Minute)
+	writeCertificate(t, certFile, keyFile, "first", modTime)
+	r, err := newCertificateReloader(certFile, keyFile)
+	require.Nil(t, err)
+	assert.Equal(t, "first", servedCommonName(t, r))
+
+	reloaded, err := r.reloadIfChanged()
+	require.Nil(t, err)
+	assert.False(t, reloaded, "the files didn't change")
+
+	writeCertificate(t, certFile, keyFile, "second", modTime.Add(time.Second))
+	reloaded, err = r.reloadIfChanged()
+	require.Nil(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, "second", servedCommonName(t, r), "the rotated certificate is served")
+
+	// a certificate written before its key doesn't match it
+	keyData, err := ioutil.ReadFile(keyFile)
+	require.Nil(t, err)
+	writeCertificate(t, certFile, keyFile, "third", modTime.Add(2*time.Second))
+	require.Nil(t, ioutil.WriteFile(keyFile, keyData, 0600))
+	_, err = r.reloadIfChanged()
+	assert.NotNil(t, err)
+	assert.Equal(t, "second", servedCommonName(t, r), "the previous certificate is kept")
+}
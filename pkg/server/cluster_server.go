@@ -8,6 +8,7 @@ import (
 	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
 	yaml "github.com/ghodss/yaml"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	rest "k8s.io/client-go/rest"
 	clientcmd "k8s.io/client-go/tools/clientcmd"
@@ -56,29 +57,97 @@ func NewClusterServer(kubeConfig, apiserverURL string) (Server, error) {
 }
 
 // GetConfig fetches the machine config(type - Ignition) from the cluster,
-// based on the pool request.
+// based on the pool request. It returns nil for conf, error if the rendered
+// config requested by name isn't found, and a *configError if the pool
+// requested doesn't exist or its rendered config isn't there yet.
 func (cs *clusterServer) GetConfig(cr poolRequest) (*ignv2_2types.Config, error) {
-	mp, err := cs.machineClient.MachineConfigPools().Get(cr.machineConfigPool, metav1.GetOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("could not fetch pool. err: %v", err)
+	currConf := cr.renderedConfig
+	if currConf == "" {
+		var err error
+		currConf, err = cs.poolConfig(cr.machineConfigPool)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	currConf := mp.Status.Configuration.Name
-
 	mc, err := cs.machineClient.MachineConfigs().Get(currConf, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if cr.machineConfigPool == "" {
+			return nil, nil
+		}
+		return nil, configNotReadyError(cr.machineConfigPool, currConf)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("could not fetch config %s, err: %v", currConf, err)
 	}
 
-	appenders := getAppenders(cr, currConf, cs.kubeconfigFunc, mc.Spec.OSImageURL)
+	appenders := getAppenders(cr, cs.kubeconfigFunc, mc)
 	for _, a := range appenders {
 		if err := a(&mc.Spec.Config); err != nil {
 			return nil, err
 		}
 	}
+	if cr.machineConfigPool != "" {
+		renderedConfigAges.record(cr.machineConfigPool, mc.CreationTimestamp.Time)
+	}
 	return &mc.Spec.Config, nil
 }
 
+// poolConfig fetches the rendered config of pool.
+func (cs *clusterServer) poolConfig(pool string) (string, error) {
+	mp, err := cs.machineClient.MachineConfigPools().Get(pool, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", poolNotFoundError(pool)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not fetch pool. err: %v", err)
+	}
+	if mp.Status.Configuration.Name == "" {
+		return "", configNotReadyError(pool, "")
+	}
+	return mp.Status.Configuration.Name, nil
+}
+
+// resolveConfig sets the rendered config of the pool requested, it returns
+// the version of the config served from it.
+func (cs *clusterServer) resolveConfig(cr poolRequest) (poolRequest, string, error) {
+	if cr.renderedConfig == "" {
+		currConf, err := cs.poolConfig(cr.machineConfigPool)
+		if err != nil {
+			return cr, "", err
+		}
+		cr.renderedConfig = currConf
+	}
+	kcData, _, err := cs.kubeconfigFunc()
+	if err != nil {
+		return cr, "", err
+	}
+	return cr, configVersion(cr.renderedConfig, kcData), nil
+}
+
+// checkHealth checks the server can serve the config of every pool: that the
+// rendered config of each pool exists, and the kubeconfig appended to the
+// configs can be read.
+func (cs *clusterServer) checkHealth() error {
+	if _, _, err := cs.kubeconfigFunc(); err != nil {
+		return fmt.Errorf("could not get kubeconfig: %v", err)
+	}
+	pools, err := cs.machineClient.MachineConfigPools().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list pools: %v", err)
+	}
+	for _, mp := range pools.Items {
+		currConf := mp.Status.Configuration.Name
+		if currConf == "" {
+			return fmt.Errorf("pool %s has no rendered config", mp.GetName())
+		}
+		if _, err := cs.machineClient.MachineConfigs().Get(currConf, metav1.GetOptions{}); err != nil {
+			return fmt.Errorf("could not fetch config %s of pool %s: %v", currConf, mp.GetName(), err)
+		}
+	}
+	return nil
+}
+
 // getClientConfig returns a Kubernetes client Config.
 func getClientConfig(path string) (*rest.Config, error) {
 	if path != inClusterConfig {
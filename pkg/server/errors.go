@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// configNotReadyRetryAfter is the number of seconds after which the clients
+// asking for a config which isn't rendered yet are told to retry.
+const configNotReadyRetryAfter = 10
+
+// configError is returned by Servers for the configs they can't serve
+// because of the request, rather than an error of theirs. It is answered
+// with its status code and message, the others with HTTP Status Code 500.
+type configError struct {
+	status  int
+	message string
+}
+
+func (e *configError) Error() string {
+	return e.message
+}
+
+// poolNotFoundError is the error of the requests for a pool which doesn't
+// exist, as with a typo in the URL of the user data.
+func poolNotFoundError(pool string) error {
+	return &configError{status: http.StatusNotFound, message: fmt.Sprintf("pool %q not found", pool)}
+}
+
+// renderedConfigNotFoundError is the error of the requests for a rendered
+// config by name which doesn't exist.
+func renderedConfigNotFoundError(renderedConfig string) error {
+	return &configError{status: http.StatusNotFound, message: fmt.Sprintf("rendered config %q not found", renderedConfig)}
+}
+
+// configNotReadyError is the error of the requests for a pool which exists
+// but whose rendered config, currConf, isn't set or doesn't exist yet. The
+// clients are told to retry.
+func configNotReadyError(pool, currConf string) error {
+	if currConf == "" {
+		return &configError{status: http.StatusServiceUnavailable, message: fmt.Sprintf("pool %q has no rendered config yet", pool)}
+	}
+	return &configError{status: http.StatusServiceUnavailable, message: fmt.Sprintf("rendered config %q of pool %q not found yet", currConf, pool)}
+}
+
+// notFoundError is the error of the requests for cr the Server found no
+// config for.
+func notFoundError(cr poolRequest) error {
+	if cr.machineConfigPool == "" {
+		return renderedConfigNotFoundError(cr.renderedConfig)
+	}
+	return poolNotFoundError(cr.machineConfigPool)
+}
+
+// notRepresentableError is the error of the requests for a config of spec 3
+// in spec 2.2, which can't represent the features of the config err is about.
+func notRepresentableError(err error) error {
+	return &configError{status: http.StatusNotAcceptable, message: fmt.Sprintf("the config can't be served in Ignition spec 2.2: %v; boot an image whose Ignition supports spec 3", err)}
+}
+
+// writeConfigError answers r with err, with its message in a JSON body, e.g.
+//
+//	{"error":"pool \"wroker\" not found"}
+//
+// The body is left out of the answers to HEAD requests, their headers are
+// the same.
+func writeConfigError(w http.ResponseWriter, r *http.Request, err *configError) {
+	body, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{Error: err.message})
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Content-Type", "application/json")
+	if err.status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(configNotReadyRetryAfter))
+	}
+	w.WriteHeader(err.status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strconv"
+	"strings"
+)
+
+// gzipEncoding is the content coding of the configs compressed for the
+// clients accepting it.
+const gzipEncoding = "gzip"
+
+// acceptsGzip returns whether the Accept-Encoding header acceptEncoding
+// accepts gzip, by name or as *, with a non-zero weight.
+func acceptsGzip(acceptEncoding string) bool {
+	accepted := false
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != gzipEncoding && name != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if name == gzipEncoding {
+			// gzip by name takes precedence over *
+			return q > 0
+		}
+		accepted = q > 0
+	}
+	return accepted
+}
+
+// gzipPayload compresses the serialized config data.
+func gzipPayload(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodedETag returns the ETag of the config of ETag etag served with the
+// content coding encoding, the ETags of a config differing by encoding.
+func encodedETag(etag, encoding string) string {
+	if encoding == "" {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
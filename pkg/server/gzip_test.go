@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, expected := range map[string]bool{
+		"":                        false,
+		"gzip":                    true,
+		"GZIP":                    true,
+		"deflate, gzip;q=0.5":     true,
+		"gzip;q=0":                false,
+		"*":                       true,
+		"*;q=0":                   false,
+		"gzip;q=0, *":             false,
+		"identity, deflate, br":   false,
+		"deflate;q=1, *;q=0.1":    true,
+		"gzip; q=0.8, identity":   true,
+		"gzip;q=0.000, identity ": false,
+	} {
+		assert.Equal(t, expected, acceptsGzip(header), "Accept-Encoding: %q", header)
+	}
+}
+
+func gunzip(t *testing.T, data []byte) []byte {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	require.Nil(t, err)
+	decoded, err := ioutil.ReadAll(gz)
+	require.Nil(t, err)
+	return decoded
+}
+
+func TestAPIHandlerGzip(t *testing.T) {
+	ms := &mockResolverServer{pools: map[string]string{"worker": "rendered-worker-0"}}
+	handler := NewServerAPIHandler(ms)
+	get := func(path, acceptEncoding, ifNoneMatch string) (*http.Response, []byte) {
+		request := httptest.NewRequest(http.MethodGet, "http://testrequest"+path, nil)
+		if acceptEncoding != "" {
+			request.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		if ifNoneMatch != "" {
+			request.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request)
+		body, err := ioutil.ReadAll(w.Result().Body)
+		require.Nil(t, err)
+		return w.Result(), body
+	}
+
+	plain, plainBody := get("/config/worker", "", "")
+	checkStatus(t, plain, http.StatusOK)
+	assert.Empty(t, plain.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept, Accept-Encoding", plain.Header.Get("Vary"))
+
+	gzipped, gzippedBody := get("/config/worker", "gzip, deflate", "")
+	checkStatus(t, gzipped, http.StatusOK)
+	assert.Equal(t, "gzip", gzipped.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept, Accept-Encoding", gzipped.Header.Get("Vary"))
+	checkContentLength(t, gzipped, len(gzippedBody))
+	assert.Equal(t, plainBody, gunzip(t, gzippedBody))
+	assert.NotEqual(t, plain.Header.Get("ETag"), gzipped.Header.Get("ETag"), "the ETag varies by encoding")
+	assert.Equal(t, 1, ms.fetched, "the compressed config is made from the one cached")
+
+	resp, _ := get("/config/worker", "gzip", "")
+	assert.Equal(t, gzipped.Header.Get("ETag"), resp.Header.Get("ETag"))
+	resp, body := get("/config/worker", "gzip", gzipped.Header.Get("ETag"))
+	checkStatus(t, resp, http.StatusNotModified)
+	assert.Empty(t, body)
+	resp, _ = get("/config/worker", "gzip", plain.Header.Get("ETag"))
+	checkStatus(t, resp, http.StatusOK)
+
+	// errors aren't compressed
+	handler = NewServerAPIHandler(&mockServer{
+		GetConfigFn: func(poolRequest) (*ignv2_2types.Config, error) {
+			return nil, nil
+		},
+	})
+	resp, body = get("/config/does-not-exist", "gzip", "")
+	checkStatus(t, resp, http.StatusNotFound)
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.True(t, json.Valid(body), "the error body is plain JSON, got %q", body)
+	request := httptest.NewRequest(http.MethodGet, "http://testrequest/config/worker", nil)
+	request.Header.Set("Accept", "application/vnd.coreos.ignition+json; version=4.0.0")
+	request.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, request)
+	checkStatus(t, w.Result(), http.StatusNotAcceptable)
+	assert.Empty(t, w.Result().Header.Get("Content-Encoding"))
+}
+
+// largeTestConfig returns a config the size of those of clusters with big
+// CA bundles and registry mirror lists: a bundle of certs CA certificates
+// and mirrors registry mirrors.
+func largeTestConfig(tb testing.TB, certs, mirrors int) *ignv2_2types.Config {
+	var bundle bytes.Buffer
+	for i := 0; i < certs; i++ {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.Nil(tb, err)
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(int64(i + 1)),
+			Subject:               pkix.Name{CommonName: fmt.Sprintf("ca-%d.example.com", i), Organization: []string{"Example"}},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		require.Nil(tb, err)
+		require.Nil(tb, pem.Encode(&bundle, &pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	}
+
+	var registries strings.Builder
+	for i := 0; i < mirrors; i++ {
+		fmt.Fprintf(&registries, "[[registry]]\nprefix = \"\"\nlocation = \"quay.io/org-%d/release\"\nmirror-by-digest-only = true\n\n[[registry.mirror]]\nlocation = \"mirror-%d.internal.example.com:5000/org-%d/release\"\n\n", i, i%10, i)
+	}
+
+	conf := new(ignv2_2types.Config)
+	conf.Ignition.Version = ignv2_2types.MaxVersion.String()
+	appendFileToIgnition(conf, "/etc/pki/ca-trust/source/anchors/openshift-config-user-ca-bundle.crt", bundle.String())
+	appendFileToIgnition(conf, "/etc/containers/registries.conf", registries.String())
+	return conf
+}
+
+func TestGzipPayloadReduction(t *testing.T) {
+	data, err := json.Marshal(largeTestConfig(t, 200, 500))
+	require.Nil(t, err)
+	compressed, err := gzipPayload(data)
+	require.Nil(t, err)
+	assert.Equal(t, data, gunzip(t, compressed))
+	assert.True(t, len(compressed) < len(data)/2, "expected the config of %d bytes to be compressed to less than half, got %d bytes", len(data), len(compressed))
+}
+
+// BenchmarkGzipPayload reports the compression of a large config, in
+// compressed-bytes and ratio, e.g. with
+//
+//	go test -run XXX -bench GzipPayload ./pkg/server
+func BenchmarkGzipPayload(b *testing.B) {
+	data, err := json.Marshal(largeTestConfig(b, 200, 500))
+	require.Nil(b, err)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	var compressed []byte
+	for i := 0; i < b.N; i++ {
+		compressed, err = gzipPayload(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(data)), "bytes")
+	b.ReportMetric(float64(len(compressed)), "compressed-bytes")
+	b.ReportMetric(float64(len(compressed))/float64(len(data)), "ratio")
+}
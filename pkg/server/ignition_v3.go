@@ -0,0 +1,484 @@
+package server
+
+import (
+	"fmt"
+	"path"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+)
+
+// The types of the Ignition spec 3 configs served, for the fields the
+// translation from spec 2.2 sets. Spec 3.1 only adds fields to 3.0, those
+// configs only differ by their version.
+type ignv3Config struct {
+	Ignition ignv3Ignition `json:"ignition"`
+	Passwd   ignv3Passwd   `json:"passwd,omitempty"`
+	Storage  ignv3Storage  `json:"storage,omitempty"`
+	Systemd  ignv3Systemd  `json:"systemd,omitempty"`
+}
+
+type ignv3Ignition struct {
+	Config   ignv3IgnitionConfig `json:"config,omitempty"`
+	Security ignv3Security       `json:"security,omitempty"`
+	Timeouts ignv3Timeouts       `json:"timeouts,omitempty"`
+	Version  string              `json:"version"`
+}
+
+type ignv3IgnitionConfig struct {
+	Merge   []ignv3Resource `json:"merge,omitempty"`
+	Replace *ignv3Resource  `json:"replace,omitempty"`
+}
+
+type ignv3Security struct {
+	TLS ignv3TLS `json:"tls,omitempty"`
+}
+
+type ignv3TLS struct {
+	CertificateAuthorities []ignv3Resource `json:"certificateAuthorities,omitempty"`
+}
+
+type ignv3Timeouts struct {
+	HTTPResponseHeaders *int `json:"httpResponseHeaders,omitempty"`
+	HTTPTotal           *int `json:"httpTotal,omitempty"`
+}
+
+// ignv3Resource is a config reference, CA reference or file contents, which
+// are the same in spec 3.
+type ignv3Resource struct {
+	Compression  string            `json:"compression,omitempty"`
+	Source       *string           `json:"source,omitempty"`
+	Verification ignv3Verification `json:"verification,omitempty"`
+}
+
+type ignv3Verification struct {
+	Hash *string `json:"hash,omitempty"`
+}
+
+type ignv3Passwd struct {
+	Groups []ignv3PasswdGroup `json:"groups,omitempty"`
+	Users  []ignv3PasswdUser  `json:"users,omitempty"`
+}
+
+type ignv3PasswdGroup struct {
+	Gid          *int    `json:"gid,omitempty"`
+	Name         string  `json:"name"`
+	PasswordHash *string `json:"passwordHash,omitempty"`
+	System       *bool   `json:"system,omitempty"`
+}
+
+type ignv3PasswdUser struct {
+	Gecos             *string  `json:"gecos,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+	HomeDir           *string  `json:"homeDir,omitempty"`
+	Name              string   `json:"name"`
+	NoCreateHome      *bool    `json:"noCreateHome,omitempty"`
+	NoLogInit         *bool    `json:"noLogInit,omitempty"`
+	NoUserGroup       *bool    `json:"noUserGroup,omitempty"`
+	PasswordHash      *string  `json:"passwordHash,omitempty"`
+	PrimaryGroup      *string  `json:"primaryGroup,omitempty"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+	Shell             *string  `json:"shell,omitempty"`
+	System            *bool    `json:"system,omitempty"`
+	UID               *int     `json:"uid,omitempty"`
+}
+
+type ignv3Storage struct {
+	Directories []ignv3Directory `json:"directories,omitempty"`
+	Files       []ignv3File      `json:"files,omitempty"`
+	Links       []ignv3Link      `json:"links,omitempty"`
+}
+
+type ignv3Node struct {
+	Group     *ignv3NodeOwner `json:"group,omitempty"`
+	Overwrite *bool           `json:"overwrite,omitempty"`
+	Path      string          `json:"path"`
+	User      *ignv3NodeOwner `json:"user,omitempty"`
+}
+
+type ignv3NodeOwner struct {
+	ID   *int    `json:"id,omitempty"`
+	Name *string `json:"name,omitempty"`
+}
+
+type ignv3Directory struct {
+	ignv3Node
+	Mode *int `json:"mode,omitempty"`
+}
+
+type ignv3File struct {
+	ignv3Node
+	Append   []ignv3Resource `json:"append,omitempty"`
+	Contents ignv3Resource   `json:"contents,omitempty"`
+	Mode     *int            `json:"mode,omitempty"`
+}
+
+type ignv3Link struct {
+	ignv3Node
+	Hard   *bool  `json:"hard,omitempty"`
+	Target string `json:"target"`
+}
+
+type ignv3Systemd struct {
+	Units []ignv3Unit `json:"units,omitempty"`
+}
+
+type ignv3Unit struct {
+	Contents *string       `json:"contents,omitempty"`
+	Dropins  []ignv3Dropin `json:"dropins,omitempty"`
+	Enabled  *bool         `json:"enabled,omitempty"`
+	Mask     *bool         `json:"mask,omitempty"`
+	Name     string        `json:"name"`
+}
+
+type ignv3Dropin struct {
+	Contents *string `json:"contents,omitempty"`
+	Name     string  `json:"name"`
+}
+
+// networkdDir is where the networkd units of spec 2 configs are written as
+// files in spec 3, which has no networkd section.
+const networkdDir = "/etc/systemd/network"
+
+// translateToV3 translates conf to an Ignition config of spec version, 3.0.0
+// or 3.1.0, as Ignition would apply it. Nodes have to be on the root
+// filesystem, spec 3 has no filesystem field. The networkd units become files
+// under /etc/systemd/network. Configs which partition disks, set up RAID or
+// filesystems, or create users with the deprecated create field aren't
+// translated, their semantics changed in spec 3.
+func translateToV3(conf *ignv2_2types.Config, version string) (*ignv3Config, error) {
+	if len(conf.Storage.Disks) > 0 || len(conf.Storage.Raid) > 0 || len(conf.Storage.Filesystems) > 0 {
+		return nil, fmt.Errorf("disks, raid and filesystems can't be translated to spec %s", version)
+	}
+	v3 := &ignv3Config{
+		Ignition: ignv3Ignition{
+			Version: version,
+			Timeouts: ignv3Timeouts{
+				HTTPResponseHeaders: conf.Ignition.Timeouts.HTTPResponseHeaders,
+				HTTPTotal:           conf.Ignition.Timeouts.HTTPTotal,
+			},
+		},
+	}
+	for _, ref := range conf.Ignition.Config.Append {
+		v3.Ignition.Config.Merge = append(v3.Ignition.Config.Merge, translateResource("", ref.Source, ref.Verification))
+	}
+	if ref := conf.Ignition.Config.Replace; ref != nil {
+		replace := translateResource("", ref.Source, ref.Verification)
+		v3.Ignition.Config.Replace = &replace
+	}
+	for _, ca := range conf.Ignition.Security.TLS.CertificateAuthorities {
+		v3.Ignition.Security.TLS.CertificateAuthorities = append(v3.Ignition.Security.TLS.CertificateAuthorities, translateResource("", ca.Source, ca.Verification))
+	}
+
+	for _, g := range conf.Passwd.Groups {
+		v3.Passwd.Groups = append(v3.Passwd.Groups, ignv3PasswdGroup{
+			Gid:          g.Gid,
+			Name:         g.Name,
+			PasswordHash: stringToPtr(g.PasswordHash),
+			System:       trueToPtr(g.System),
+		})
+	}
+	for _, u := range conf.Passwd.Users {
+		if u.Create != nil {
+			return nil, fmt.Errorf("user %q: the create field can't be translated to spec %s", u.Name, version)
+		}
+		user := ignv3PasswdUser{
+			Gecos:        stringToPtr(u.Gecos),
+			HomeDir:      stringToPtr(u.HomeDir),
+			Name:         u.Name,
+			NoCreateHome: trueToPtr(u.NoCreateHome),
+			NoLogInit:    trueToPtr(u.NoLogInit),
+			NoUserGroup:  trueToPtr(u.NoUserGroup),
+			PasswordHash: u.PasswordHash,
+			PrimaryGroup: stringToPtr(u.PrimaryGroup),
+			Shell:        stringToPtr(u.Shell),
+			System:       trueToPtr(u.System),
+			UID:          u.UID,
+		}
+		for _, g := range u.Groups {
+			user.Groups = append(user.Groups, string(g))
+		}
+		for _, k := range u.SSHAuthorizedKeys {
+			user.SSHAuthorizedKeys = append(user.SSHAuthorizedKeys, string(k))
+		}
+		v3.Passwd.Users = append(v3.Passwd.Users, user)
+	}
+
+	for _, d := range conf.Storage.Directories {
+		node, err := translateNode(d.Node, version)
+		if err != nil {
+			return nil, err
+		}
+		v3.Storage.Directories = append(v3.Storage.Directories, ignv3Directory{ignv3Node: node, Mode: d.Mode})
+	}
+	for _, f := range conf.Storage.Files {
+		node, err := translateNode(f.Node, version)
+		if err != nil {
+			return nil, err
+		}
+		file := ignv3File{ignv3Node: node, Mode: f.Mode}
+		contents := translateResource(f.Contents.Compression, f.Contents.Source, f.Contents.Verification)
+		if f.Append {
+			// appending never overwrites
+			file.Overwrite = nil
+			file.Append = []ignv3Resource{contents}
+		} else {
+			file.Contents = contents
+			// spec 2 overwrites files by default, spec 3 doesn't, and only
+			// overwrites files it has the contents of
+			if file.Overwrite == nil && contents.Source != nil {
+				file.Overwrite = boolToPtr(true)
+			}
+		}
+		v3.Storage.Files = append(v3.Storage.Files, file)
+	}
+	for _, l := range conf.Storage.Links {
+		node, err := translateNode(l.Node, version)
+		if err != nil {
+			return nil, err
+		}
+		v3.Storage.Links = append(v3.Storage.Links, ignv3Link{ignv3Node: node, Hard: trueToPtr(l.Hard), Target: l.Target})
+	}
+	for _, u := range conf.Networkd.Units {
+		v3.Storage.Files = append(v3.Storage.Files, networkdFile(path.Join(networkdDir, u.Name), u.Contents))
+		for _, d := range u.Dropins {
+			v3.Storage.Files = append(v3.Storage.Files, networkdFile(path.Join(networkdDir, u.Name+".d", d.Name), d.Contents))
+		}
+	}
+
+	for _, u := range conf.Systemd.Units {
+		unit := ignv3Unit{
+			Contents: stringToPtr(u.Contents),
+			Enabled:  u.Enabled,
+			Mask:     trueToPtr(u.Mask),
+			Name:     u.Name,
+		}
+		// enable is the deprecated form of enabled
+		if unit.Enabled == nil && u.Enable {
+			unit.Enabled = boolToPtr(true)
+		}
+		for _, d := range u.Dropins {
+			unit.Dropins = append(unit.Dropins, ignv3Dropin{Contents: stringToPtr(d.Contents), Name: d.Name})
+		}
+		v3.Systemd.Units = append(v3.Systemd.Units, unit)
+	}
+	return v3, nil
+}
+
+func translateNode(n ignv2_2types.Node, version string) (ignv3Node, error) {
+	if n.Filesystem != "" && n.Filesystem != defaultFileSystem {
+		return ignv3Node{}, fmt.Errorf("%s is on filesystem %q, only nodes on %q can be translated to spec %s", n.Path, n.Filesystem, defaultFileSystem, version)
+	}
+	node := ignv3Node{Overwrite: n.Overwrite, Path: n.Path}
+	if n.User != nil {
+		node.User = &ignv3NodeOwner{ID: n.User.ID, Name: stringToPtr(n.User.Name)}
+	}
+	if n.Group != nil {
+		node.Group = &ignv3NodeOwner{ID: n.Group.ID, Name: stringToPtr(n.Group.Name)}
+	}
+	return node, nil
+}
+
+func translateResource(compression, source string, verification ignv2_2types.Verification) ignv3Resource {
+	return ignv3Resource{
+		Compression:  compression,
+		Source:       stringToPtr(source),
+		Verification: ignv3Verification{Hash: verification.Hash},
+	}
+}
+
+func networkdFile(path, contents string) ignv3File {
+	mode := 0644
+	return ignv3File{
+		ignv3Node: ignv3Node{Overwrite: boolToPtr(true), Path: path},
+		Contents:  ignv3Resource{Source: stringToPtr(getEncodedContent(contents))},
+		Mode:      &mode,
+	}
+}
+
+// stringToPtr returns a pointer to s, or nil if it is empty, for the optional
+// strings of spec 3.
+func stringToPtr(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// trueToPtr returns a pointer to b, or nil if it is false, for the optional
+// booleans of spec 3.
+func trueToPtr(b bool) *bool {
+	if !b {
+		return nil
+	}
+	return &b
+}
+
+// translateFromV3 translates conf, of spec 3, down to spec 2.2 for the
+// Ignition of old bootimages, as the Ignition of spec 3 would apply it. The
+// features spec 2.2 can't represent fail the translation: config and CA
+// references which are compressed, and files appending more than one
+// fragment, or appending to the contents they replace.
+func translateFromV3(conf *ignv3Config) (*ignv2_2types.Config, error) {
+	v2 := &ignv2_2types.Config{
+		Ignition: ignv2_2types.Ignition{
+			Version: "2.2.0",
+			Timeouts: ignv2_2types.Timeouts{
+				HTTPResponseHeaders: conf.Ignition.Timeouts.HTTPResponseHeaders,
+				HTTPTotal:           conf.Ignition.Timeouts.HTTPTotal,
+			},
+		},
+	}
+	for _, ref := range conf.Ignition.Config.Merge {
+		if ref.Compression != "" {
+			return nil, fmt.Errorf("config %s is compressed", ptrToString(ref.Source))
+		}
+		v2.Ignition.Config.Append = append(v2.Ignition.Config.Append, ignv2_2types.ConfigReference{
+			Source:       ptrToString(ref.Source),
+			Verification: ignv2_2types.Verification{Hash: ref.Verification.Hash},
+		})
+	}
+	if ref := conf.Ignition.Config.Replace; ref != nil {
+		if ref.Compression != "" {
+			return nil, fmt.Errorf("config %s is compressed", ptrToString(ref.Source))
+		}
+		v2.Ignition.Config.Replace = &ignv2_2types.ConfigReference{
+			Source:       ptrToString(ref.Source),
+			Verification: ignv2_2types.Verification{Hash: ref.Verification.Hash},
+		}
+	}
+	for _, ca := range conf.Ignition.Security.TLS.CertificateAuthorities {
+		if ca.Compression != "" {
+			return nil, fmt.Errorf("certificate authority %s is compressed", ptrToString(ca.Source))
+		}
+		v2.Ignition.Security.TLS.CertificateAuthorities = append(v2.Ignition.Security.TLS.CertificateAuthorities, ignv2_2types.CaReference{
+			Source:       ptrToString(ca.Source),
+			Verification: ignv2_2types.Verification{Hash: ca.Verification.Hash},
+		})
+	}
+
+	for _, g := range conf.Passwd.Groups {
+		v2.Passwd.Groups = append(v2.Passwd.Groups, ignv2_2types.PasswdGroup{
+			Gid:          g.Gid,
+			Name:         g.Name,
+			PasswordHash: ptrToString(g.PasswordHash),
+			System:       ptrToBool(g.System),
+		})
+	}
+	for _, u := range conf.Passwd.Users {
+		user := ignv2_2types.PasswdUser{
+			Gecos:        ptrToString(u.Gecos),
+			HomeDir:      ptrToString(u.HomeDir),
+			Name:         u.Name,
+			NoCreateHome: ptrToBool(u.NoCreateHome),
+			NoLogInit:    ptrToBool(u.NoLogInit),
+			NoUserGroup:  ptrToBool(u.NoUserGroup),
+			PasswordHash: u.PasswordHash,
+			PrimaryGroup: ptrToString(u.PrimaryGroup),
+			Shell:        ptrToString(u.Shell),
+			System:       ptrToBool(u.System),
+			UID:          u.UID,
+		}
+		for _, g := range u.Groups {
+			user.Groups = append(user.Groups, ignv2_2types.Group(g))
+		}
+		for _, k := range u.SSHAuthorizedKeys {
+			user.SSHAuthorizedKeys = append(user.SSHAuthorizedKeys, ignv2_2types.SSHAuthorizedKey(k))
+		}
+		v2.Passwd.Users = append(v2.Passwd.Users, user)
+	}
+
+	for _, d := range conf.Storage.Directories {
+		v2.Storage.Directories = append(v2.Storage.Directories, ignv2_2types.Directory{
+			Node:               translateNodeFromV3(d.ignv3Node),
+			DirectoryEmbedded1: ignv2_2types.DirectoryEmbedded1{Mode: d.Mode},
+		})
+	}
+	for _, f := range conf.Storage.Files {
+		file := ignv2_2types.File{
+			Node:          translateNodeFromV3(f.ignv3Node),
+			FileEmbedded1: ignv2_2types.FileEmbedded1{Mode: f.Mode},
+		}
+		switch {
+		case len(f.Append) == 0:
+			file.Contents = translateContentsFromV3(f.Contents)
+			// spec 2.2 overwrites files by default, spec 3 doesn't
+			if file.Overwrite == nil {
+				file.Overwrite = boolToPtr(false)
+			}
+		case f.Contents.Source != nil:
+			return nil, fmt.Errorf("file %s appends to the contents it replaces, spec 2.2 only appends to existing contents", f.Path)
+		case len(f.Append) > 1:
+			return nil, fmt.Errorf("file %s appends %d fragments, spec 2.2 appends a single one to a file", f.Path, len(f.Append))
+		default:
+			// appending never overwrites
+			file.Overwrite = nil
+			file.Append = true
+			file.Contents = translateContentsFromV3(f.Append[0])
+		}
+		v2.Storage.Files = append(v2.Storage.Files, file)
+	}
+	for _, l := range conf.Storage.Links {
+		v2.Storage.Links = append(v2.Storage.Links, ignv2_2types.Link{
+			Node:          translateNodeFromV3(l.ignv3Node),
+			LinkEmbedded1: ignv2_2types.LinkEmbedded1{Hard: ptrToBool(l.Hard), Target: l.Target},
+		})
+	}
+
+	for _, u := range conf.Systemd.Units {
+		unit := ignv2_2types.Unit{
+			Contents: ptrToString(u.Contents),
+			Enabled:  u.Enabled,
+			Mask:     ptrToBool(u.Mask),
+			Name:     u.Name,
+		}
+		for _, d := range u.Dropins {
+			unit.Dropins = append(unit.Dropins, ignv2_2types.SystemdDropin{Contents: ptrToString(d.Contents), Name: d.Name})
+		}
+		v2.Systemd.Units = append(v2.Systemd.Units, unit)
+	}
+	return v2, nil
+}
+
+func translateNodeFromV3(n ignv3Node) ignv2_2types.Node {
+	node := ignv2_2types.Node{Filesystem: defaultFileSystem, Overwrite: n.Overwrite, Path: n.Path}
+	if n.User != nil {
+		node.User = &ignv2_2types.NodeUser{ID: n.User.ID, Name: ptrToString(n.User.Name)}
+	}
+	if n.Group != nil {
+		node.Group = &ignv2_2types.NodeGroup{ID: n.Group.ID, Name: ptrToString(n.Group.Name)}
+	}
+	return node
+}
+
+func translateContentsFromV3(r ignv3Resource) ignv2_2types.FileContents {
+	return ignv2_2types.FileContents{
+		Compression:  r.Compression,
+		Source:       ptrToString(r.Source),
+		Verification: ignv2_2types.Verification{Hash: r.Verification.Hash},
+	}
+}
+
+// mergeV3 appends the content of from to conf, both of spec 3.
+func mergeV3(conf, from *ignv3Config) {
+	conf.Ignition.Config.Merge = append(conf.Ignition.Config.Merge, from.Ignition.Config.Merge...)
+	conf.Ignition.Security.TLS.CertificateAuthorities = append(conf.Ignition.Security.TLS.CertificateAuthorities, from.Ignition.Security.TLS.CertificateAuthorities...)
+	conf.Passwd.Groups = append(conf.Passwd.Groups, from.Passwd.Groups...)
+	conf.Passwd.Users = append(conf.Passwd.Users, from.Passwd.Users...)
+	conf.Storage.Directories = append(conf.Storage.Directories, from.Storage.Directories...)
+	conf.Storage.Files = append(conf.Storage.Files, from.Storage.Files...)
+	conf.Storage.Links = append(conf.Storage.Links, from.Storage.Links...)
+	conf.Systemd.Units = append(conf.Systemd.Units, from.Systemd.Units...)
+}
+
+// ptrToString returns the string s points to, or "" if it is nil.
+func ptrToString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// ptrToBool returns the boolean b points to, or false if it is nil.
+func ptrToBool(b *bool) bool {
+	return b != nil && *b
+}
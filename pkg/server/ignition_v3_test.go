@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func intToPtr(i int) *int {
+	return &i
+}
+
+// newTestRoundTripConfig returns a config with files, units and ssh keys
+// with the fields set as a translation to spec 3 and back sets them.
+func newTestRoundTripConfig() *ignv2_2types.Config {
+	hash := "sha512-0123456789abcdef"
+	return &ignv2_2types.Config{
+		Ignition: ignv2_2types.Ignition{Version: "2.2.0"},
+		Passwd: ignv2_2types.Passwd{
+			Users: []ignv2_2types.PasswdUser{{
+				Name:              "core",
+				SSHAuthorizedKeys: []ignv2_2types.SSHAuthorizedKey{"ssh-rsa AAAA first", "ssh-ed25519 AAAA second"},
+			}},
+		},
+		Storage: ignv2_2types.Storage{
+			Directories: []ignv2_2types.Directory{{
+				Node:               ignv2_2types.Node{Filesystem: "root", Path: "/etc/foo.d"},
+				DirectoryEmbedded1: ignv2_2types.DirectoryEmbedded1{Mode: intToPtr(0755)},
+			}},
+			Files: []ignv2_2types.File{{
+				Node: ignv2_2types.Node{
+					Filesystem: "root",
+					Path:       "/etc/foo.d/foo.conf",
+					Overwrite:  boolToPtr(true),
+					User:       &ignv2_2types.NodeUser{Name: "core"},
+					Group:      &ignv2_2types.NodeGroup{ID: intToPtr(1000)},
+				},
+				FileEmbedded1: ignv2_2types.FileEmbedded1{
+					Contents: ignv2_2types.FileContents{
+						Source:       getEncodedContent("foo=bar\n"),
+						Verification: ignv2_2types.Verification{Hash: &hash},
+					},
+					Mode: intToPtr(0600),
+				},
+			}, {
+				Node: ignv2_2types.Node{Filesystem: "root", Path: "/etc/motd"},
+				FileEmbedded1: ignv2_2types.FileEmbedded1{
+					Append:   true,
+					Contents: ignv2_2types.FileContents{Source: getEncodedContent("welcome\n")},
+					Mode:     intToPtr(0644),
+				},
+			}},
+			Links: []ignv2_2types.Link{{
+				Node:          ignv2_2types.Node{Filesystem: "root", Path: "/etc/foo.conf"},
+				LinkEmbedded1: ignv2_2types.LinkEmbedded1{Target: "/etc/foo.d/foo.conf"},
+			}},
+		},
+		Systemd: ignv2_2types.Systemd{
+			Units: []ignv2_2types.Unit{{
+				Name:     "foo.service",
+				Enabled:  boolToPtr(true),
+				Contents: "[Service]\nExecStart=/usr/bin/foo\n[Install]\nWantedBy=multi-user.target\n",
+			}, {
+				Name:    "kubelet.service",
+				Dropins: []ignv2_2types.SystemdDropin{{Name: "10-foo.conf", Contents: "[Service]\nEnvironment=FOO=1\n"}},
+			}, {
+				Name: "bar.service",
+				Mask: true,
+			}},
+		},
+	}
+}
+
+func TestServeSpecVersionsRoundTrip(t *testing.T) {
+	for _, spec := range ignitionSpecs {
+		t.Run(spec.version, func(t *testing.T) {
+			ms := &mockServer{
+				GetConfigFn: func(poolRequest) (*ignv2_2types.Config, error) {
+					return newTestRoundTripConfig(), nil
+				},
+			}
+			request := httptest.NewRequest(http.MethodGet, "http://testrequest/config/master", nil)
+			request.Header.Set("Accept", fmt.Sprintf("application/vnd.coreos.ignition+json;version=%s, */*;q=0.1", spec.version))
+			w := httptest.NewRecorder()
+			NewServerAPIHandler(ms).ServeHTTP(w, request)
+
+			resp := w.Result()
+			defer resp.Body.Close()
+			checkStatus(t, resp, http.StatusOK)
+			checkContentType(t, resp, "application/vnd.coreos.ignition+json; version="+spec.version)
+
+			decoder := json.NewDecoder(resp.Body)
+			decoder.DisallowUnknownFields()
+			var served *ignv2_2types.Config
+			if spec.version == "2.2.0" {
+				served = new(ignv2_2types.Config)
+				require.Nil(t, decoder.Decode(served))
+			} else {
+				var v3 ignv3Config
+				require.Nil(t, decoder.Decode(&v3))
+				assert.Equal(t, spec.version, v3.Ignition.Version)
+				var err error
+				served, err = translateFromV3(&v3)
+				require.Nil(t, err)
+			}
+			assert.Equal(t, newTestRoundTripConfig(), served)
+		})
+	}
+}
+
+func TestTranslateToV3(t *testing.T) {
+	conf := &ignv2_2types.Config{
+		Ignition: ignv2_2types.Ignition{Version: "2.2.0"},
+		Networkd: ignv2_2types.Networkd{
+			Units: []ignv2_2types.Networkdunit{{
+				Name:     "10-eth0.network",
+				Contents: "[Match]\nName=eth0\n",
+				Dropins:  []ignv2_2types.NetworkdDropin{{Name: "mtu.conf", Contents: "[Link]\nMTUBytes=9000\n"}},
+			}},
+		},
+		Storage: ignv2_2types.Storage{
+			Files: []ignv2_2types.File{
+				{
+					Node:          ignv2_2types.Node{Filesystem: "root", Path: "/etc/default-overwrite"},
+					FileEmbedded1: ignv2_2types.FileEmbedded1{Contents: ignv2_2types.FileContents{Source: getEncodedContent("a\n")}},
+				},
+				{Node: ignv2_2types.Node{Filesystem: "root", Path: "/etc/empty"}},
+			},
+		},
+		Systemd: ignv2_2types.Systemd{
+			Units: []ignv2_2types.Unit{{Name: "deprecated.service", Enable: true}},
+		},
+	}
+	v3, err := translateToV3(conf, "3.1.0")
+	require.Nil(t, err)
+	assert.Equal(t, "3.1.0", v3.Ignition.Version)
+	require.Len(t, v3.Storage.Files, 4)
+	assert.Equal(t, boolToPtr(true), v3.Storage.Files[0].Overwrite, "spec 2 overwrites files by default")
+	assert.Nil(t, v3.Storage.Files[1].Overwrite, "files without contents aren't overwritten")
+	assert.Equal(t, "/etc/systemd/network/10-eth0.network", v3.Storage.Files[2].Path)
+	assert.Equal(t, getEncodedContent("[Match]\nName=eth0\n"), *v3.Storage.Files[2].Contents.Source)
+	assert.Equal(t, "/etc/systemd/network/10-eth0.network.d/mtu.conf", v3.Storage.Files[3].Path)
+	assert.Equal(t, boolToPtr(true), v3.Systemd.Units[0].Enabled, "enable is translated to enabled")
+
+	data, err := json.Marshal(v3)
+	require.Nil(t, err)
+	assert.False(t, bytes.Contains(data, []byte("filesystem")), "spec 3 has no filesystem field")
+	assert.False(t, bytes.Contains(data, []byte("networkd")), "spec 3 has no networkd section")
+
+	for name, unsupported := range map[string]func(*ignv2_2types.Config){
+		"disks": func(c *ignv2_2types.Config) {
+			c.Storage.Disks = []ignv2_2types.Disk{{Device: "/dev/sdb"}}
+		},
+		"other filesystem": func(c *ignv2_2types.Config) {
+			c.Storage.Files[0].Filesystem = "var"
+		},
+		"user create": func(c *ignv2_2types.Config) {
+			c.Passwd.Users = []ignv2_2types.PasswdUser{{Name: "foo", Create: &ignv2_2types.Usercreate{}}}
+		},
+	} {
+		c := *conf
+		c.Storage.Files = append([]ignv2_2types.File(nil), conf.Storage.Files...)
+		unsupported(&c)
+		_, err := translateToV3(&c, "3.0.0")
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestTranslateFromV3(t *testing.T) {
+	// the configs translated to spec 3 translate back to the same
+	conf := newTestRoundTripConfig()
+	conf.Ignition.Config.Append = []ignv2_2types.ConfigReference{{Source: "https://example.com/extra.ign"}}
+	conf.Ignition.Security.TLS.CertificateAuthorities = []ignv2_2types.CaReference{{Source: getEncodedContent("ca")}}
+	conf.Ignition.Timeouts.HTTPTotal = intToPtr(60)
+	conf.Passwd.Groups = []ignv2_2types.PasswdGroup{{Name: "foo", Gid: intToPtr(1001), System: true}}
+	conf.Passwd.Users = append(conf.Passwd.Users, ignv2_2types.PasswdUser{
+		Name:         "foo",
+		Groups:       []ignv2_2types.Group{"foo", "wheel"},
+		HomeDir:      "/var/home/foo",
+		NoCreateHome: true,
+		PrimaryGroup: "foo",
+		Shell:        "/bin/bash",
+		UID:          intToPtr(1001),
+	})
+	conf.Storage.Files[0].Contents.Compression = "gzip"
+	conf.Storage.Links[0].Hard = true
+	v3, err := translateToV3(conf, "3.1.0")
+	require.Nil(t, err)
+	v2, err := translateFromV3(v3)
+	require.Nil(t, err)
+	assert.Equal(t, conf, v2)
+
+	// spec 3 doesn't overwrite files by default
+	v2, err = translateFromV3(&ignv3Config{
+		Storage: ignv3Storage{Files: []ignv3File{{ignv3Node: ignv3Node{Path: "/etc/empty"}}}},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, boolToPtr(false), v2.Storage.Files[0].Overwrite)
+
+	source := stringToPtr(getEncodedContent("a\n"))
+	for name, unrepresentable := range map[string]ignv3Config{
+		"fragments": {Storage: ignv3Storage{Files: []ignv3File{{
+			ignv3Node: ignv3Node{Path: "/etc/motd"},
+			Append:    []ignv3Resource{{Source: source}, {Source: source}},
+		}}}},
+		"replaced contents": {Storage: ignv3Storage{Files: []ignv3File{{
+			ignv3Node: ignv3Node{Path: "/etc/motd", Overwrite: boolToPtr(true)},
+			Contents:  ignv3Resource{Source: source},
+			Append:    []ignv3Resource{{Source: source}},
+		}}}},
+		"compressed config": {Ignition: ignv3Ignition{Config: ignv3IgnitionConfig{
+			Merge: []ignv3Resource{{Compression: "gzip", Source: source}},
+		}}},
+		"compressed certificate authority": {Ignition: ignv3Ignition{Security: ignv3Security{TLS: ignv3TLS{
+			CertificateAuthorities: []ignv3Resource{{Compression: "gzip", Source: source}},
+		}}}},
+	} {
+		c := unrepresentable
+		_, err := translateFromV3(&c)
+		assert.NotNil(t, err, name)
+	}
+}
+
+// mockV3Server serves the configs of spec 3 of config.
+type mockV3Server struct {
+	config func() *ignv3Config
+}
+
+func (ms *mockV3Server) GetConfig(poolRequest) (*ignv2_2types.Config, error) {
+	return nil, fmt.Errorf("the configs are of spec 3")
+}
+
+func (ms *mockV3Server) getConfigV3(poolRequest) (*ignv3Config, error) {
+	return ms.config(), nil
+}
+
+func TestServeV3ConfigToV2(t *testing.T) {
+	downgraded := func() float64 {
+		return readMetric(t, downgradedServes.WithLabelValues("v3-pool")).GetCounter().GetValue()
+	}
+	fragments := 1
+	ms := &mockV3Server{config: func() *ignv3Config {
+		v3, err := translateToV3(newTestRoundTripConfig(), "3.1.0")
+		require.Nil(t, err)
+		for i := 1; i < fragments; i++ {
+			v3.Storage.Files[1].Append = append(v3.Storage.Files[1].Append, v3.Storage.Files[1].Append[0])
+		}
+		return v3
+	}}
+	handler := NewServerAPIHandlerWithOptions(ms, WithAppenders(&appenderFn{}))
+	get := func(accept string) *http.Response {
+		request := httptest.NewRequest(http.MethodGet, "http://testrequest/config/v3-pool", nil)
+		if accept != "" {
+			request.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request)
+		return w.Result()
+	}
+
+	// the clients of spec 2.2 get the config translated down, with the
+	// content of the appenders
+	before := downgraded()
+	resp := get("")
+	checkStatus(t, resp, http.StatusOK)
+	var v2 ignv2_2types.Config
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&v2))
+	expected := newTestRoundTripConfig()
+	appendFileToIgnition(expected, "/etc/appended", "v3-pool")
+	expected.Storage.Files[2].Overwrite = boolToPtr(true)
+	assert.Equal(t, expected, &v2)
+	assert.Equal(t, before+1, downgraded(), "the downgraded serves are counted")
+
+	// those of spec 3 get it as it is
+	resp = get("application/vnd.coreos.ignition+json; version=3.0.0")
+	checkStatus(t, resp, http.StatusOK)
+	var v3 ignv3Config
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&v3))
+	assert.Equal(t, "3.0.0", v3.Ignition.Version)
+	assert.Len(t, v3.Storage.Files, 3)
+	assert.Equal(t, before+1, downgraded())
+
+	// the configs spec 2.2 can't represent are refused, explaining why
+	fragments = 2
+	resp = get("")
+	checkStatus(t, resp, http.StatusNotAcceptable)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	assert.Contains(t, string(body), "file /etc/motd appends 2 fragments")
+	assert.Equal(t, before+1, downgraded())
+	checkStatus(t, get("application/vnd.coreos.ignition+json; version=3.1.0"), http.StatusOK)
+}
+
+func TestNegotiateSpec(t *testing.T) {
+	for _, tc := range []struct {
+		accept      string
+		version     string
+		contentType string
+	}{
+		{"", "2.2.0", "application/json"},
+		{"application/json", "2.2.0", "application/json"},
+		{"*/*", "2.2.0", "application/json"},
+		// as sent by Ignition 0.x, which serves spec 2
+		{"application/vnd.coreos.ignition+json; version=2.2.0, application/vnd.coreos.ignition+json; version=1; q=0.5, */*; q=0.1", "2.2.0", "application/vnd.coreos.ignition+json; version=2.2.0"},
+		{"application/vnd.coreos.ignition+json; version=3.1.0", "3.1.0", "application/vnd.coreos.ignition+json; version=3.1.0"},
+		{"application/vnd.coreos.ignition+json;version=3.0.0, */*;q=0.1", "3.0.0", "application/vnd.coreos.ignition+json; version=3.0.0"},
+		{"application/vnd.coreos.ignition+json; version=3.1", "3.1.0", "application/vnd.coreos.ignition+json; version=3.1.0"},
+		{"application/vnd.coreos.ignition+json", "2.2.0", "application/vnd.coreos.ignition+json; version=2.2.0"},
+		{"application/vnd.coreos.ignition+json; version=3.0.0; q=0.5, application/vnd.coreos.ignition+json; version=3.1.0", "3.1.0", "application/vnd.coreos.ignition+json; version=3.1.0"},
+		// unsupported versions fall back to the next range
+		{"application/vnd.coreos.ignition+json; version=3.2.0, application/vnd.coreos.ignition+json; version=3.1.0; q=0.9", "3.1.0", "application/vnd.coreos.ignition+json; version=3.1.0"},
+		{"application/vnd.coreos.ignition+json; version=3.2.0", "", ""},
+		{"text/html", "", ""},
+		{"application/json; q=0", "", ""},
+	} {
+		spec, contentType := negotiateSpec(tc.accept)
+		if tc.version == "" {
+			assert.Nil(t, spec, tc.accept)
+			continue
+		}
+		require.NotNil(t, spec, tc.accept)
+		assert.Equal(t, tc.version, spec.version, tc.accept)
+		assert.Equal(t, tc.contentType, contentType, tc.accept)
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/golang/glog"
+
+	"github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
+	"github.com/openshift/machine-config-operator/pkg/controller/bootstrap"
+	"github.com/openshift/machine-config-operator/pkg/controller/render"
+)
+
+// manifestsReloadInterval is how often the manifests directory is checked
+// for changes.
+const manifestsReloadInterval = 5 * time.Second
+
+// ensure manifestsServer implements the
+// Server interface.
+var _ = Server(&manifestsServer{})
+
+// manifestsServer serves the configs rendered from the MachineConfigPools and
+// MachineConfigs of the manifests in a directory, before the cluster API
+// exists. The configs are rendered the way the render controller does in the
+// cluster, and rendered again as the manifests change.
+type manifestsServer struct {
+	manifestsDir   string
+	kubeconfigFunc kubeconfigFunc
+
+	mu sync.RWMutex
+	// pools are the pools rendered, by name
+	pools map[string]*v1.MachineConfigPool
+	// configs are the rendered configs, by name
+	configs map[string]*v1.MachineConfig
+	// fingerprint is of the files the configs were rendered from
+	fingerprint string
+}
+
+// NewManifestsServer initializes a new Server that renders the configs from
+// the manifests in dir, and renders them again as the manifests change until
+// stopCh is closed.
+func NewManifestsServer(dir, kubeconfig string, stopCh <-chan struct{}) (Server, error) {
+	ms := &manifestsServer{
+		manifestsDir:   dir,
+		kubeconfigFunc: func() ([]byte, []byte, error) { return kubeconfigFromFile(kubeconfig) },
+	}
+	if _, err := ms.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	go ms.run(manifestsReloadInterval, stopCh)
+	return ms, nil
+}
+
+// GetConfig fetches the config rendered for the pool, or the rendered config
+// requested by name, and appends what the bootstrap and cluster servers do.
+// It returns nil for conf, error if the rendered config requested by name
+// isn't found, and a *configError if the pool requested doesn't exist.
+func (ms *manifestsServer) GetConfig(cr poolRequest) (*ignv2_2types.Config, error) {
+	ms.mu.RLock()
+	currConf := cr.renderedConfig
+	if currConf == "" {
+		if mp, ok := ms.pools[cr.machineConfigPool]; ok {
+			currConf = mp.Status.Configuration.Name
+		} else {
+			ms.mu.RUnlock()
+			return nil, poolNotFoundError(cr.machineConfigPool)
+		}
+	}
+	rendered, ok := ms.configs[currConf]
+	ms.mu.RUnlock()
+	if !ok {
+		glog.Errorf("could not find config %q for req %v", currConf, cr)
+		if cr.machineConfigPool == "" {
+			return nil, nil
+		}
+		return nil, configNotReadyError(cr.machineConfigPool, currConf)
+	}
+
+	// the rendered configs are shared with the other requests
+	mc := rendered.DeepCopy()
+	appenders := getAppenders(cr, ms.kubeconfigFunc, mc)
+	for _, a := range appenders {
+		if err := a(&mc.Spec.Config); err != nil {
+			return nil, err
+		}
+	}
+	return &mc.Spec.Config, nil
+}
+
+// resolveConfig sets the rendered config of the pool requested, it returns
+// the version of the config served from it.
+func (ms *manifestsServer) resolveConfig(cr poolRequest) (poolRequest, string, error) {
+	if cr.renderedConfig == "" {
+		ms.mu.RLock()
+		mp, ok := ms.pools[cr.machineConfigPool]
+		ms.mu.RUnlock()
+		if !ok {
+			return cr, "", poolNotFoundError(cr.machineConfigPool)
+		}
+		cr.renderedConfig = mp.Status.Configuration.Name
+	}
+	kcData, _, err := ms.kubeconfigFunc()
+	if err != nil {
+		return cr, "", err
+	}
+	return cr, configVersion(cr.renderedConfig, kcData), nil
+}
+
+// checkHealth checks the kubeconfig appended to the configs can be read, the
+// configs of all the pools being rendered before the server starts.
+func (ms *manifestsServer) checkHealth() error {
+	if _, _, err := ms.kubeconfigFunc(); err != nil {
+		return fmt.Errorf("could not get kubeconfig: %v", err)
+	}
+	return nil
+}
+
+// reloadIfChanged renders the configs again if the files of the manifests
+// directory changed since they were rendered, it returns whether they were.
+// The configs rendered before are kept if the manifests can't be rendered,
+// e.g. while they are being written.
+func (ms *manifestsServer) reloadIfChanged() (bool, error) {
+	fingerprint, err := manifestsFingerprint(ms.manifestsDir)
+	if err != nil {
+		return false, err
+	}
+	ms.mu.RLock()
+	changed := ms.pools == nil || fingerprint != ms.fingerprint
+	ms.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	cconfig, pools, configs, err := bootstrap.LoadManifests(ms.manifestsDir)
+	if err != nil {
+		return false, fmt.Errorf("could not load manifests from %s: %v", ms.manifestsDir, err)
+	}
+	if len(pools) == 0 {
+		return false, fmt.Errorf("no machineconfigpool found in dir: %q", ms.manifestsDir)
+	}
+	if cconfig == nil {
+		// the configs are merged with the OS image of the ControllerConfig
+		cconfig = &v1.ControllerConfig{}
+	}
+	rpools, rconfigs, err := render.RunBootstrap(pools, configs, cconfig)
+	if err != nil {
+		return false, fmt.Errorf("could not render the manifests of %s: %v", ms.manifestsDir, err)
+	}
+
+	renderedPools := make(map[string]*v1.MachineConfigPool, len(rpools))
+	for _, p := range rpools {
+		renderedPools[p.Name] = p
+	}
+	renderedConfigs := make(map[string]*v1.MachineConfig, len(rconfigs))
+	for _, c := range rconfigs {
+		renderedConfigs[c.Name] = c
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	// the configs pinned by name stay served while the server runs
+	for name, c := range ms.configs {
+		if _, ok := renderedConfigs[name]; !ok {
+			renderedConfigs[name] = c
+		}
+	}
+	ms.pools = renderedPools
+	ms.configs = renderedConfigs
+	ms.fingerprint = fingerprint
+	return true, nil
+}
+
+// run renders the configs again as the manifests change, checking them every
+// interval until stopCh is closed. Intended to be run via a goroutine.
+func (ms *manifestsServer) run(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			reloaded, err := ms.reloadIfChanged()
+			if err != nil {
+				glog.Errorf("Keeping the configs rendered before: %v", err)
+			} else if reloaded {
+				glog.Infof("Rendered the configs of the manifests in %s", ms.manifestsDir)
+			}
+		}
+	}
+}
+
+// manifestsFingerprint returns a fingerprint of the names, sizes and
+// modification times of the files in dir, which changes as they do.
+func manifestsFingerprint(dir string) (string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var files []string
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		files = append(files, fmt.Sprintf("%s %d %d", info.Name(), info.Size(), info.ModTime().UnixNano()))
+	}
+	sort.Strings(files)
+	return strings.Join(files, "\n"), nil
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testManifestsPool = `apiVersion: machineconfiguration.openshift.io/v1
+kind: MachineConfigPool
+metadata:
+  name: test-pool
+spec:
+  machineConfigSelector:
+    matchLabels:
+      machineconfiguration.openshift.io/role: test
+`
+
+const testManifestsConfig = `apiVersion: machineconfiguration.openshift.io/v1
+kind: MachineConfig
+metadata:
+  name: 00-test
+  labels:
+    machineconfiguration.openshift.io/role: test
+spec:
+  config:
+    ignition:
+      version: 2.2.0
+    storage:
+      files:
+      - filesystem: root
+        path: /etc/%s
+        mode: 420
+        contents:
+          source: "data:,test"
+`
+
+// writeManifest writes a manifest to dir, modified at modTime.
+func writeManifest(t *testing.T, dir, name, contents string, modTime time.Time) {
+	path := filepath.Join(dir, name)
+	require.Nil(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	require.Nil(t, os.Chtimes(path, modTime, modTime))
+}
+
+func servedPaths(t *testing.T, s Server, cr poolRequest) []string {
+	conf, err := s.GetConfig(cr)
+	require.Nil(t, err)
+	require.NotNil(t, conf)
+	var paths []string
+	for _, f := range conf.Storage.Files {
+		paths = append(paths, f.Path)
+	}
+	return paths
+}
+
+func TestManifestsServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcs-manifests")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	_, err = NewManifestsServer(dir, testKubeConfig, stopCh)
+	assert.NotNil(t, err, "a pool is needed to serve configs")
+
+	modTime := time.Now().Add(-time.Minute)
+	writeManifest(t, dir, "pool.yaml", testManifestsPool, modTime)
+	writeManifest(t, dir, "config.yaml", strings.Replace(testManifestsConfig, "%s", "first", 1), modTime)
+	s, err := NewManifestsServer(dir, testKubeConfig, stopCh)
+	require.Nil(t, err)
+	ms := s.(*manifestsServer)
+	ms.kubeconfigFunc = func() ([]byte, []byte, error) { return getKubeConfigContent(t) }
+
+	first := ms.pools["test-pool"].Status.Configuration.Name
+	assert.True(t, strings.HasPrefix(first, "rendered-test-pool-"), "the configs are rendered the way the render controller does, got %s", first)
+	assert.Contains(t, servedPaths(t, s, poolRequest{machineConfigPool: "test-pool"}), "/etc/first")
+	conf, err := s.GetConfig(poolRequest{machineConfigPool: "does-not-exist"})
+	assert.Equal(t, poolNotFoundError("does-not-exist"), err)
+	assert.Nil(t, conf)
+
+	// the configs are served by the same handler as in the cluster
+	w := httptest.NewRecorder()
+	NewServerAPIHandler(s).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://testrequest/config/test-pool", nil))
+	checkStatus(t, w.Result(), http.StatusOK)
+
+	reloaded, err := ms.reloadIfChanged()
+	require.Nil(t, err)
+	assert.False(t, reloaded, "the manifests didn't change")
+
+	writeManifest(t, dir, "config.yaml", strings.Replace(testManifestsConfig, "%s", "second", 1), modTime.Add(time.Second))
+	reloaded, err = ms.reloadIfChanged()
+	require.Nil(t, err)
+	assert.True(t, reloaded)
+	assert.NotEqual(t, first, ms.pools["test-pool"].Status.Configuration.Name)
+	assert.Contains(t, servedPaths(t, s, poolRequest{machineConfigPool: "test-pool"}), "/etc/second", "the pool is served the config rendered again")
+	assert.Contains(t, servedPaths(t, s, poolRequest{renderedConfig: first}), "/etc/first", "the config rendered before is still served by name")
+
+	writeManifest(t, dir, "broken.yaml", "kind: [", modTime.Add(2*time.Second))
+	_, err = ms.reloadIfChanged()
+	assert.NotNil(t, err)
+	assert.Contains(t, servedPaths(t, s, poolRequest{machineConfigPool: "test-pool"}), "/etc/second", "the configs rendered before are kept")
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// DefaultMetricsBindAddress is the address the metrics listener binds to by default
+	DefaultMetricsBindAddress = "127.0.0.1:22625"
+
+	metricsNamespace = "mcs"
+
+	// maxPoolLabels is the number of distinct pools requests are labeled
+	// with, the pool of the requests is taken from their URL, whatever it
+	// is. The requests for the other pools are labeled with otherPoolLabel.
+	maxPoolLabels  = 32
+	otherPoolLabel = "other"
+	// noneLabel is the label of requests without a pool, or a spec version
+	// when none was negotiated
+	noneLabel = "none"
+)
+
+var (
+	// configRequests counts the config requests by pool, status code and
+	// spec version served
+	configRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "config_requests_total",
+			Help:      "Number of config requests, by pool, HTTP status code and Ignition spec version.",
+		}, []string{"pool", "code", "spec_version"})
+
+	// configServeDuration is the time taken to render and serve the configs
+	configServeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "config_serve_duration_seconds",
+			Help:      "Time taken to render and serve a config, by Ignition spec version.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"spec_version"})
+
+	// configCacheRequests counts the lookups of serialized configs in the
+	// cache, by result
+	configCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "config_cache_requests_total",
+			Help:      "Number of lookups of serialized configs in the cache, by result: hit or miss.",
+		}, []string{"result"})
+
+	// downgradedServes counts the configs of spec 3 served translated down to
+	// spec 2.2, by pool
+	downgradedServes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "downgraded_config_serves_total",
+			Help:      "Number of spec 3 configs served translated down to spec 2.2, by pool: machines booting images to update.",
+		}, []string{"pool"})
+
+	// renderedConfigAges is the age of the rendered config last served for
+	// each pool
+	renderedConfigAges = newRenderedConfigAgeCollector()
+)
+
+func init() {
+	prometheus.MustRegister(
+		configRequests,
+		configServeDuration,
+		configCacheRequests,
+		downgradedServes,
+		renderedConfigAges,
+	)
+}
+
+// poolLabels are the pools requests were labeled with.
+var poolLabels = struct {
+	sync.Mutex
+	seen map[string]bool
+}{seen: make(map[string]bool)}
+
+// poolLabel returns the label of the requests for pool, see maxPoolLabels.
+func poolLabel(pool string) string {
+	if pool == "" || pool == "." || pool == "/" {
+		return noneLabel
+	}
+	poolLabels.Lock()
+	defer poolLabels.Unlock()
+	if !poolLabels.seen[pool] {
+		if len(poolLabels.seen) >= maxPoolLabels {
+			return otherPoolLabel
+		}
+		poolLabels.seen[pool] = true
+	}
+	return pool
+}
+
+// observeConfigRequest records a config request for pool answered with
+// status. The duration is only recorded for those which got as far as
+// fetching the config, which have a spec version.
+func observeConfigRequest(pool string, status int, specVersion string, duration time.Duration) {
+	if specVersion == "" {
+		specVersion = noneLabel
+	} else {
+		configServeDuration.WithLabelValues(specVersion).Observe(duration.Seconds())
+	}
+	configRequests.WithLabelValues(poolLabel(pool), strconv.Itoa(status), specVersion).Inc()
+}
+
+// observeDowngradedServe records that the config of cr, of spec 3, was
+// served translated down to spec 2.2 to client, whose machine booted an
+// image with an old Ignition.
+func observeDowngradedServe(cr poolRequest, client string) {
+	glog.Warningf("Served the spec 3 config of req: %v translated down to spec 2.2 to %s, its machine booted an image to update", cr, client)
+	downgradedServes.WithLabelValues(poolLabel(cr.machineConfigPool)).Inc()
+}
+
+// renderedConfigAgeCollector reports the age of the rendered config last
+// served for each pool, from its creation, as of the time it is scraped.
+type renderedConfigAgeCollector struct {
+	desc    *prometheus.Desc
+	mu      sync.Mutex
+	created map[string]time.Time
+}
+
+func newRenderedConfigAgeCollector() *renderedConfigAgeCollector {
+	return &renderedConfigAgeCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "rendered_config_age_seconds"),
+			"Age of the rendered config last served for the pool.",
+			[]string{"pool"}, nil),
+		created: make(map[string]time.Time),
+	}
+}
+
+// record records that the rendered config served for pool was created at
+// created. Configs without a creation time, as read by the bootstrap server,
+// aren't recorded.
+func (c *renderedConfigAgeCollector) record(pool string, created time.Time) {
+	if created.IsZero() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.created[pool] = created
+}
+
+func (c *renderedConfigAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *renderedConfigAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for pool, created := range c.created {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Since(created).Seconds(), pool)
+	}
+}
+
+// statusWriter records the status code and the size of the body of the
+// response it writes.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// StartMetricsListener serves the registered metrics on addr until stopCh is
+// closed, apart from the ports the configs are served on. Intended to be run
+// via a goroutine.
+func StartMetricsListener(addr string, stopCh <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	glog.Infof("Starting metrics listener on %s", addr)
+	s := http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			glog.Errorf("metrics listener exited with error: %v", err)
+		}
+	}()
+	<-stopCh
+	if err := s.Shutdown(context.Background()); err != nil {
+		glog.Errorf("error stopping metrics listener: %v", err)
+	}
+}
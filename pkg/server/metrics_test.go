@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readMetric(t *testing.T, m prometheus.Metric) *dto.Metric {
+	var out dto.Metric
+	require.Nil(t, m.Write(&out))
+	return &out
+}
+
+func TestConfigRequestMetrics(t *testing.T) {
+	requests := func(pool, code, version string) float64 {
+		return readMetric(t, configRequests.WithLabelValues(pool, code, version)).GetCounter().GetValue()
+	}
+	serves := func(version string) uint64 {
+		return readMetric(t, configServeDuration.WithLabelValues(version).(prometheus.Metric)).GetHistogram().GetSampleCount()
+	}
+	handler := NewServerAPIHandler(&mockServer{
+		GetConfigFn: func(pr poolRequest) (*ignv2_2types.Config, error) {
+			if pr.machineConfigPool != "metrics-pool" {
+				return nil, nil
+			}
+			return new(ignv2_2types.Config), nil
+		},
+	})
+	get := func(url, accept string) {
+		request := httptest.NewRequest(http.MethodGet, url, nil)
+		if accept != "" {
+			request.Header.Set("Accept", accept)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	ok22, ok31, notFound, notAcceptable := requests("metrics-pool", "200", "2.2.0"), requests("metrics-pool", "200", "3.1.0"), requests("metrics-missing", "404", "2.2.0"), requests("metrics-pool", "406", noneLabel)
+	served22, served31 := serves("2.2.0"), serves("3.1.0")
+	get("http://testrequest/config/metrics-pool", "")
+	get("http://testrequest/config/metrics-pool", "application/vnd.coreos.ignition+json; version=3.1.0")
+	get("http://testrequest/config/metrics-missing", "")
+	get("http://testrequest/config/metrics-pool", "application/vnd.coreos.ignition+json; version=4.0.0")
+
+	assert.Equal(t, ok22+1, requests("metrics-pool", "200", "2.2.0"))
+	assert.Equal(t, ok31+1, requests("metrics-pool", "200", "3.1.0"))
+	assert.Equal(t, notFound+1, requests("metrics-missing", "404", "2.2.0"))
+	assert.Equal(t, notAcceptable+1, requests("metrics-pool", "406", noneLabel), "requests without a negotiated version are counted")
+	assert.Equal(t, served22+2, serves("2.2.0"), "not found configs are timed too")
+	assert.Equal(t, served31+1, serves("3.1.0"))
+}
+
+func TestPoolLabel(t *testing.T) {
+	assert.Equal(t, noneLabel, poolLabel(""))
+	assert.Equal(t, noneLabel, poolLabel("/"))
+	for i := 0; i < maxPoolLabels; i++ {
+		poolLabel(fmt.Sprintf("label-pool-%d", i))
+	}
+	assert.Equal(t, otherPoolLabel, poolLabel("label-pool-new"), "the pools past maxPoolLabels share a label")
+	assert.Equal(t, "label-pool-0", poolLabel("label-pool-0"), "the pools labeled keep their label")
+}
+
+func TestRenderedConfigAgeCollector(t *testing.T) {
+	c := newRenderedConfigAgeCollector()
+	c.record("master", time.Now().Add(-time.Hour))
+	c.record("worker", time.Time{})
+
+	ch := make(chan prometheus.Metric, 4)
+	c.Collect(ch)
+	close(ch)
+	var metrics []*dto.Metric
+	for m := range ch {
+		metrics = append(metrics, readMetric(t, m))
+	}
+	require.Len(t, metrics, 1, "configs without a creation time aren't reported")
+	assert.Equal(t, "master", metrics[0].GetLabel()[0].GetValue())
+	assert.InDelta(t, time.Hour.Seconds(), metrics[0].GetGauge().GetValue(), 60)
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	// DefaultRateLimitQPS is the rate of the config requests allowed to each
+	// client by default
+	DefaultRateLimitQPS = 5
+	// DefaultRateLimitBurst is the number of config requests each client can
+	// make at once by default
+	DefaultRateLimitBurst = 20
+
+	// minClientIdleTimeout is how long the bucket of a client which made no
+	// requests is kept at least, it is kept until the bucket is full again
+	// otherwise
+	minClientIdleTimeout = 10 * time.Minute
+)
+
+// clientRateLimiter limits the rate of the requests of each client with a
+// token bucket, by IP. The buckets of idle clients are dropped.
+type clientRateLimiter struct {
+	qps         float32
+	burst       int
+	idleTimeout time.Duration
+	clock       flowcontrol.Clock
+
+	mu        sync.Mutex
+	clients   map[string]*clientBucket
+	lastSweep time.Time
+}
+
+type clientBucket struct {
+	limiter  flowcontrol.RateLimiter
+	lastSeen time.Time
+}
+
+// newClientRateLimiter returns a limiter allowing qps requests a second to
+// each client, and bursts of burst requests.
+func newClientRateLimiter(qps float32, burst int, clock flowcontrol.Clock) *clientRateLimiter {
+	idleTimeout := time.Duration(float64(burst) / float64(qps) * float64(time.Second))
+	if idleTimeout < minClientIdleTimeout {
+		idleTimeout = minClientIdleTimeout
+	}
+	return &clientRateLimiter{
+		qps:         qps,
+		burst:       burst,
+		idleTimeout: idleTimeout,
+		clock:       clock,
+		clients:     make(map[string]*clientBucket),
+		lastSweep:   clock.Now(),
+	}
+}
+
+// allow takes a token from the bucket of client, it returns false if there
+// is none left.
+func (l *clientRateLimiter) allow(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	if now.Sub(l.lastSweep) > l.idleTimeout {
+		for c, b := range l.clients {
+			if now.Sub(b.lastSeen) > l.idleTimeout {
+				delete(l.clients, c)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.clients[client]
+	if !ok {
+		b = &clientBucket{limiter: flowcontrol.NewTokenBucketRateLimiterWithClock(l.qps, l.burst, l.clock)}
+		l.clients[client] = b
+	}
+	b.lastSeen = now
+	return b.limiter.TryAccept()
+}
+
+// retryAfter is the number of seconds after which a client which was
+// limited gets a token again, for the Retry-After header.
+func (l *clientRateLimiter) retryAfter() int {
+	return int(math.Ceil(1 / float64(l.qps)))
+}
+
+// realClock is the flowcontrol.Clock of the time.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// clientIP returns the IP r was sent from. The headers set by proxies, like
+// X-Forwarded-For, are ignored, clients could set them to get around the
+// limits. The load balancers in front of the server pass on the connections.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
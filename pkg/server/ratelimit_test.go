@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestClientRateLimiter(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	l := newClientRateLimiter(1, 3, clock)
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.allow("10.0.0.1"), "request %d is within the burst", i)
+	}
+	assert.False(t, l.allow("10.0.0.1"))
+	assert.True(t, l.allow("10.0.0.2"), "each client has its bucket")
+
+	clock.Sleep(time.Second)
+	assert.True(t, l.allow("10.0.0.1"), "the bucket refills at qps")
+	assert.False(t, l.allow("10.0.0.1"))
+	assert.Equal(t, 1, l.retryAfter())
+
+	clock.Sleep(minClientIdleTimeout + time.Second)
+	assert.True(t, l.allow("10.0.0.3"))
+	assert.Len(t, l.clients, 1, "the buckets of idle clients are dropped")
+}
+
+func TestAPIServerRateLimit(t *testing.T) {
+	ms := &mockServer{
+		GetConfigFn: func(poolRequest) (*ignv2_2types.Config, error) {
+			return new(ignv2_2types.Config), nil
+		},
+	}
+	handler := NewServerAPIHandlerWithOptions(ms, WithClientRateLimit(0.5, 2))
+	server := NewAPIServer(handler, 0, false, "", "")
+	get := func(url, remoteAddr string) *http.Response {
+		request := httptest.NewRequest(http.MethodGet, url, nil)
+		request.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		server.handler.ServeHTTP(w, request)
+		return w.Result()
+	}
+
+	for i := 0; i < 2; i++ {
+		checkStatus(t, get("http://testrequest/config/worker", "10.0.0.1:40000"), http.StatusOK)
+	}
+	resp := get("http://testrequest/config/worker", "10.0.0.1:40001")
+	checkStatus(t, resp, http.StatusTooManyRequests)
+	checkContentLength(t, resp, 0)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+	checkStatus(t, get("http://testrequest/config/rendered/rendered-worker-0123", "10.0.0.1:40002"), http.StatusTooManyRequests)
+	checkStatus(t, get("http://testrequest/config/worker", "10.0.0.2:40000"), http.StatusOK)
+
+	for i := 0; i < 5; i++ {
+		checkStatus(t, get("http://testrequest/healthz", "10.0.0.1:40003"), http.StatusNoContent)
+	}
+
+	// no limit by default
+	server = NewAPIServer(NewServerAPIHandler(ms), 0, false, "", "")
+	for i := 0; i < 5; i++ {
+		checkStatus(t, get("http://testrequest/config/worker", "10.0.0.1:40000"), http.StatusOK)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "http://testrequest/config/worker", nil)
+	request.Header.Set("X-Forwarded-For", "10.0.0.9")
+	request.RemoteAddr = "10.0.0.1:40000"
+	assert.Equal(t, "10.0.0.1", clientIP(request), "headers set by the client are ignored")
+	request.RemoteAddr = "[fd00::1]:40000"
+	assert.Equal(t, "fd00::1", clientIP(request))
+}
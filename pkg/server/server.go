@@ -7,8 +7,10 @@ import (
 	"net/url"
 
 	ignv2_2types "github.com/coreos/ignition/config/v2_2/types"
+	mcfgv1 "github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
 	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
 	"github.com/vincent-petithory/dataurl"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 const (
@@ -37,12 +39,19 @@ type Server interface {
 	GetConfig(poolRequest) (*ignv2_2types.Config, error)
 }
 
-func getAppenders(cr poolRequest, currMachineConfig string, f kubeconfigFunc, osimageurl string) []appenderFunc {
+// v3Server is implemented by the Servers whose rendered configs are of spec
+// 3, which the API handler gets instead of those of GetConfig. They are
+// translated down for the clients asking for spec 2.2.
+type v3Server interface {
+	getConfigV3(poolRequest) (*ignv3Config, error)
+}
+
+func getAppenders(cr poolRequest, f kubeconfigFunc, mc *mcfgv1.MachineConfig) []appenderFunc {
 	appenders := []appenderFunc{
-		// append machine annotations file.
-		func(config *ignv2_2types.Config) error { return appendNodeAnnotations(config, currMachineConfig) },
+		// append the parts of the config left to the firstboot service.
+		func(config *ignv2_2types.Config) error { return appendEncapsulated(config, mc) },
 		// append pivot
-		func(config *ignv2_2types.Config) error { return appendInitialPivot(config, osimageurl) },
+		func(config *ignv2_2types.Config) error { return appendInitialPivot(config, mc.Spec.OSImageURL) },
 		// append kubeconfig.
 		func(config *ignv2_2types.Config) error { return appendKubeConfig(config, f) },
 	}
@@ -82,6 +91,30 @@ WantedBy=multi-user.target
 	return nil
 }
 
+// appendEncapsulated embeds the config mc for the firstboot service of the
+// daemon to apply what Ignition can't: the OS image, kernel arguments, kernel
+// type and extensions. The Ignition config itself is left out, Ignition applies
+// it.
+func appendEncapsulated(conf *ignv2_2types.Config, mc *mcfgv1.MachineConfig) error {
+	encapsulated := &mcfgv1.MachineConfig{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: mcfgv1.SchemeGroupVersion.String(),
+			Kind:       "MachineConfig",
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: mc.GetName()},
+		Spec:       *mc.Spec.DeepCopy(),
+	}
+	encapsulated.Spec.Config = ignv2_2types.Config{
+		Ignition: ignv2_2types.Ignition{Version: mc.Spec.Config.Ignition.Version},
+	}
+	contents, err := json.Marshal(encapsulated)
+	if err != nil {
+		return fmt.Errorf("could not marshal encapsulated config, err: %v", err)
+	}
+	appendFileToIgnition(conf, daemonconsts.MachineConfigEncapsulatedPath, string(contents))
+	return nil
+}
+
 func appendKubeConfig(conf *ignv2_2types.Config, f kubeconfigFunc) error {
 	kcData, _, err := f()
 	if err != nil {
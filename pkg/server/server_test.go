@@ -1,8 +1,10 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
 	"path/filepath"
 	"reflect"
@@ -13,6 +15,7 @@ import (
 	"github.com/openshift/machine-config-operator/pkg/apis/machineconfiguration.openshift.io/v1"
 	daemonconsts "github.com/openshift/machine-config-operator/pkg/daemon/constants"
 	"github.com/openshift/machine-config-operator/pkg/generated/clientset/versioned/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 const (
@@ -50,21 +53,14 @@ func TestStringEncode(t *testing.T) {
 // when it's running in bootstrap mode.
 // The test does the following:
 //
-// 1. Fetch the MachineConfigPool from the testdata.
-// 2. Fetch the MachineConfig from the testdata.
-// 3. Manually update the ignition config from Step 2 by adding
-//    the NodeAnnotations file, the kubeconfig file (which is read
-//    from the testdata). This Ignition config is then
+// 1. Fetch the MachineConfig from the testdata.
+// 2. Manually update the ignition config from Step 1 by adding
+//    the kubeconfig file (which is read from the testdata). This Ignition config is then
 //    labeled as expected Ignition config.
-// 4. Call the Bootstrap GetConfig method by passing the reference to the
+// 3. Call the Bootstrap GetConfig method by passing the reference to the
 //    MachineConfigPool present in the testdata folder.
-// 5. Compare the Ignition configs from Step 3 and Step 4.
+// 4. Compare the Ignition configs from Step 2 and Step 3.
 func TestBootstrapServer(t *testing.T) {
-	mp, err := getTestMachineConfigPool()
-	if err != nil {
-		t.Fatal(err)
-	}
-
 	mcPath := filepath.Join(testDir, "machine-configs", testConfig+".yaml")
 	mcData, err := ioutil.ReadFile(mcPath)
 	if err != nil {
@@ -83,11 +79,9 @@ func TestBootstrapServer(t *testing.T) {
 		t.Fatal(err)
 	}
 	appendFileToIgnition(&mc.Spec.Config, defaultMachineKubeConfPath, string(kc))
-	anno, err := getNodeAnnotation(mp.Status.Configuration.Name)
-	if err != nil {
-		t.Fatalf("unexpected error while creating annotations err: %v", err)
+	if err := appendEncapsulated(&mc.Spec.Config, mc); err != nil {
+		t.Fatalf("unexpected error while encapsulating config err: %v", err)
 	}
-	appendFileToIgnition(&mc.Spec.Config, daemonconsts.InitialNodeAnnotationsFilePath, anno)
 
 	// initialize bootstrap server and get config.
 	bs := &bootstrapServer{
@@ -116,8 +110,7 @@ func TestBootstrapServer(t *testing.T) {
 // 1. Fetch the MachineConfigPool from the testdata.
 // 2. Fetch the MachineConfig from the testdata, call this origMC.
 // 3. Manually update the ignition config from Step 2 by adding
-//    the NodeAnnotations file, the kubeconfig file (which is read
-//    from the testdata). This Ignition config is then
+//    the kubeconfig file (which is read from the testdata). This Ignition config is then
 //    labeled as expected Ignition config (mc).
 // 4. Use the Kubernetes fake client to Create the MachineConfigPool
 //    and the MachineConfig objects from Step 1, 2 inside the cluster.
@@ -166,11 +159,9 @@ func TestClusterServer(t *testing.T) {
 		t.Fatal(err)
 	}
 	appendFileToIgnition(&mc.Spec.Config, defaultMachineKubeConfPath, string(kc))
-	anno, err := getNodeAnnotation(mp.Status.Configuration.Name)
-	if err != nil {
-		t.Fatalf("unexpected error while creating annotations err: %v", err)
+	if err := appendEncapsulated(&mc.Spec.Config, mc); err != nil {
+		t.Fatalf("unexpected error while encapsulating config err: %v", err)
 	}
-	appendFileToIgnition(&mc.Spec.Config, daemonconsts.InitialNodeAnnotationsFilePath, anno)
 
 	res, err := csc.GetConfig(poolRequest{
 		machineConfigPool: testPool,
@@ -183,6 +174,202 @@ func TestClusterServer(t *testing.T) {
 	validateIgnitionSystemd(t, res.Systemd.Units, mc.Spec.Config.Systemd.Units)
 }
 
+// TestGetRenderedConfigByName tests both servers serve a rendered config
+// requested by name without reading a pool, and return nil for the configs
+// which don't exist.
+func TestGetRenderedConfigByName(t *testing.T) {
+	mcPath := filepath.Join(testDir, "machine-configs", testConfig+".yaml")
+	mcData, err := ioutil.ReadFile(mcPath)
+	if err != nil {
+		t.Fatalf("unexpected error while reading machine-config: %s, err: %v", mcPath, err)
+	}
+	mc := new(v1.MachineConfig)
+	if err := yaml.Unmarshal([]byte(mcData), mc); err != nil {
+		t.Fatalf("unexpected error while unmarshaling machine-config: %s, err: %v", mcPath, err)
+	}
+	cs := fake.NewSimpleClientset()
+	if _, err := cs.MachineconfigurationV1().MachineConfigs().Create(mc); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := mc.DeepCopy()
+	kc, _, err := getKubeConfigContent(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendFileToIgnition(&expected.Spec.Config, defaultMachineKubeConfPath, string(kc))
+	if err := appendEncapsulated(&expected.Spec.Config, mc); err != nil {
+		t.Fatal(err)
+	}
+
+	servers := map[string]Server{
+		"bootstrap": &bootstrapServer{
+			serverBaseDir:  testDir,
+			kubeconfigFunc: func() ([]byte, []byte, error) { return getKubeConfigContent(t) },
+		},
+		"cluster": &clusterServer{
+			machineClient:  cs.MachineconfigurationV1(),
+			kubeconfigFunc: func() ([]byte, []byte, error) { return getKubeConfigContent(t) },
+		},
+	}
+	for name, s := range servers {
+		res, err := s.GetConfig(poolRequest{renderedConfig: testConfig})
+		if err != nil {
+			t.Fatalf("%s: expected err to be nil, received: %v", name, err)
+		}
+		if res == nil {
+			t.Fatalf("%s: expected config %s to be served", name, testConfig)
+		}
+		validateIgnitionFiles(t, res.Storage.Files, expected.Spec.Config.Storage.Files)
+		validateIgnitionSystemd(t, res.Systemd.Units, expected.Spec.Config.Systemd.Units)
+
+		res, err = s.GetConfig(poolRequest{renderedConfig: "rendered-does-not-exist"})
+		if err != nil || res != nil {
+			t.Errorf("%s: expected no config and no error for a missing config, received: %v, %v", name, res, err)
+		}
+	}
+}
+
+// TestCheckHealth tests both servers are only healthy while they can serve
+// the config of every pool.
+func TestCheckHealth(t *testing.T) {
+	bs := &bootstrapServer{
+		serverBaseDir:  testDir,
+		kubeconfigFunc: func() ([]byte, []byte, error) { return getKubeConfigContent(t) },
+	}
+	if err := bs.checkHealth(); err != nil {
+		t.Errorf("expected the bootstrap server to be healthy, received: %v", err)
+	}
+	bs.serverBaseDir = "./does-not-exist"
+	if err := bs.checkHealth(); err != nil {
+		t.Errorf("expected the bootstrap server without pools to be healthy, received: %v", err)
+	}
+
+	mp, err := getTestMachineConfigPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := fake.NewSimpleClientset()
+	if _, err := cs.MachineconfigurationV1().MachineConfigPools().Create(mp); err != nil {
+		t.Fatal(err)
+	}
+	csc := &clusterServer{
+		machineClient:  cs.MachineconfigurationV1(),
+		kubeconfigFunc: func() ([]byte, []byte, error) { return getKubeConfigContent(t) },
+	}
+	if err := csc.checkHealth(); err == nil {
+		t.Errorf("expected the cluster server to be unhealthy while config %s is missing", testConfig)
+	}
+	if _, err := cs.MachineconfigurationV1().MachineConfigs().Create(&v1.MachineConfig{ObjectMeta: metav1.ObjectMeta{Name: testConfig}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := csc.checkHealth(); err != nil {
+		t.Errorf("expected the cluster server to be healthy, received: %v", err)
+	}
+	csc.kubeconfigFunc = func() ([]byte, []byte, error) { return nil, nil, fmt.Errorf("no token") }
+	if err := csc.checkHealth(); err == nil {
+		t.Errorf("expected the cluster server to be unhealthy without a kubeconfig")
+	}
+}
+
+// TestGetConfigErrors tests both servers tell the pools which don't exist
+// from the pools whose rendered config isn't there yet.
+func TestGetConfigErrors(t *testing.T) {
+	mp, err := getTestMachineConfigPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unrendered := mp.DeepCopy()
+	unrendered.Name = "unrendered-pool"
+	unrendered.Status.Configuration.Name = ""
+	cs := fake.NewSimpleClientset(mp, unrendered)
+
+	dir, err := ioutil.TempDir("", "mcs-errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "machine-pools"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*v1.MachineConfigPool{mp, unrendered} {
+		data, err := yaml.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "machine-pools", p.Name+".yaml"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	servers := map[string]Server{
+		"bootstrap": &bootstrapServer{
+			serverBaseDir:  dir,
+			kubeconfigFunc: func() ([]byte, []byte, error) { return getKubeConfigContent(t) },
+		},
+		"cluster": &clusterServer{
+			machineClient:  cs.MachineconfigurationV1(),
+			kubeconfigFunc: func() ([]byte, []byte, error) { return getKubeConfigContent(t) },
+		},
+	}
+	expected := map[string]error{
+		"does-not-exist":  poolNotFoundError("does-not-exist"),
+		"unrendered-pool": configNotReadyError("unrendered-pool", ""),
+		testPool:          configNotReadyError(testPool, testConfig),
+	}
+	for name, s := range servers {
+		for pool, expectedErr := range expected {
+			_, err := s.GetConfig(poolRequest{machineConfigPool: pool})
+			if !reflect.DeepEqual(err, expectedErr) {
+				t.Errorf("%s: expected %v for pool %s, received: %v", name, expectedErr, pool, err)
+			}
+		}
+		if _, _, err := s.(configResolver).resolveConfig(poolRequest{machineConfigPool: "does-not-exist"}); !reflect.DeepEqual(err, expected["does-not-exist"]) {
+			t.Errorf("%s: expected the pool not to be resolved, received: %v", name, err)
+		}
+	}
+}
+
+func TestAppendEncapsulated(t *testing.T) {
+	mc := &v1.MachineConfig{
+		ObjectMeta: metav1.ObjectMeta{Name: testConfig},
+		Spec: v1.MachineConfigSpec{
+			OSImageURL:      "example.com/os@sha256:0123",
+			KernelArguments: []string{"nosmt"},
+			Config: ignv2_2types.Config{
+				Ignition: ignv2_2types.Ignition{Version: "2.2.0"},
+			},
+		},
+	}
+	appendFileToIgnition(&mc.Spec.Config, "/etc/test", "test")
+
+	conf := ignv2_2types.Config{}
+	if err := appendEncapsulated(&conf, mc); err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Storage.Files) != 1 || conf.Storage.Files[0].Path != daemonconsts.MachineConfigEncapsulatedPath {
+		t.Fatalf("expected %s to be appended, got %v", daemonconsts.MachineConfigEncapsulatedPath, conf.Storage.Files)
+	}
+	contents, err := getDecodedContent(conf.Storage.Files[0].Contents.Source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encapsulated := new(v1.MachineConfig)
+	if err := json.Unmarshal([]byte(contents), encapsulated); err != nil {
+		t.Fatal(err)
+	}
+	if encapsulated.Kind != "MachineConfig" || encapsulated.GetName() != testConfig {
+		t.Errorf("expected MachineConfig %s, got %s %s", testConfig, encapsulated.Kind, encapsulated.GetName())
+	}
+	if encapsulated.Spec.OSImageURL != mc.Spec.OSImageURL || !reflect.DeepEqual(encapsulated.Spec.KernelArguments, mc.Spec.KernelArguments) {
+		t.Errorf("expected the spec of %s, got %+v", testConfig, encapsulated.Spec)
+	}
+	// Ignition applies the files itself
+	if len(encapsulated.Spec.Config.Storage.Files) != 0 || encapsulated.Spec.Config.Ignition.Version != "2.2.0" {
+		t.Errorf("expected an empty Ignition config, got %+v", encapsulated.Spec.Config)
+	}
+}
+
 func getKubeConfigContent(t *testing.T) ([]byte, []byte, error) {
 	return []byte("dummy-kubeconfig"), []byte("dummy-root-ca"), nil
 }